@@ -0,0 +1,83 @@
+// Placement router is an example of a custom Router. It asks an internal
+// placement service which backends should serve each request and falls
+// back to catalog routing when the service is unavailable.
+//
+// To build it into the gateway, copy this file into the repository root
+// and start the gateway with ROUTER=placement and PLACEMENT_URL set. The
+// service receives {"model": ..., "key_id": ...} and answers with
+// {"backends": ["name", ...], "model": "optional upstream model"}, naming
+// backends from the catalog.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+func init() {
+	registerRouter("placement", func() (Router, error) {
+		url := os.Getenv("PLACEMENT_URL")
+		if url == "" {
+			return nil, errors.New("PLACEMENT_URL is not set")
+		}
+		return &placementRouter{url: url, client: &http.Client{Timeout: 500 * time.Millisecond}}, nil
+	})
+}
+
+type placementRouter struct {
+	url    string
+	client *http.Client
+}
+
+type placementAnswer struct {
+	Backends []string `json:"backends"`
+	Model    string   `json:"model"`
+}
+
+func (p *placementRouter) Route(ctx context.Context, rc *RequestContext) (RouteDecision, error) {
+	answer, err := p.ask(ctx, rc)
+	if err != nil {
+		log.Printf("Placement for %s failed, using the catalog: %v", rc.RequestID, err)
+		return catalogRouter{}.Route(ctx, rc)
+	}
+	var d RouteDecision
+	for _, name := range answer.Backends {
+		b, ok := lookupBackend(name)
+		if !ok {
+			log.Printf("Placement for %s named unknown backend %q", rc.RequestID, name)
+			continue
+		}
+		d.Targets = append(d.Targets, RouteTarget{Backend: b, Model: answer.Model})
+	}
+	if len(d.Targets) == 0 {
+		return catalogRouter{}.Route(ctx, rc)
+	}
+	return d, nil
+}
+
+func (p *placementRouter) ask(ctx context.Context, rc *RequestContext) (placementAnswer, error) {
+	body, _ := json.Marshal(map[string]string{"model": rc.Request.Model, "key_id": rc.KeyID})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return placementAnswer{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return placementAnswer{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return placementAnswer{}, fmt.Errorf("placement service returned status %d", resp.StatusCode)
+	}
+	var answer placementAnswer
+	err = json.NewDecoder(resp.Body).Decode(&answer)
+	return answer, err
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// requestRecord collects per-request details for the access log. Handlers
+// fill in what they learn while serving the request.
+type requestRecord struct {
+	RequestID string
+	Route     string
+	KeyID     string
+	Model     string
+	// ClientModel is the model name the client sent, when it was resolved
+	// to a different catalog ID
+	ClientModel string
+	Backend     string
+	UserHash    string
+	// Start is when the request arrived
+	Start time.Time
+	// Age is how old the request was on arrival, by X-Request-Start, when
+	// HasAge is set
+	Age     time.Duration
+	HasAge  bool
+	Timings timings
+	// DryRun marks requests answered with a dry-run report
+	DryRun bool
+
+	// Usage is the token usage returned to the client, when known
+	Usage *Usage
+	// FinishReason is the first choice's finish_reason, when known
+	FinishReason string
+	// Experiment and Variant are the prompt experiment variant the request
+	// was assigned, if any
+	Experiment string
+	Variant    string
+
+	// catalog is the catalog active when the request was admitted, which
+	// it keeps for its whole lifetime, reloads notwithstanding
+	catalog *modelCatalog
+	// apiVersion is the API version the request is served under, once
+	// authenticated
+	apiVersion *APIVersion
+}
+
+// admittedCatalog returns the catalog rec was admitted under, or the active
+// one for records that weren't admitted.
+func (rec *requestRecord) admittedCatalog() *modelCatalog {
+	if rec.catalog != nil {
+		return rec.catalog
+	}
+	return catalog.Load()
+}
+
+// requestCatalog returns the catalog the request in ctx was admitted
+// under, so routing decisions agree however the catalog is reloaded.
+func requestCatalog(ctx context.Context) *modelCatalog {
+	return recordFromContext(ctx).admittedCatalog()
+}
+
+type requestRecordKey struct{}
+
+// recordFromContext returns the request's access log record. It is never nil
+// so handlers can set fields without checking.
+func recordFromContext(ctx context.Context) *requestRecord {
+	if rec, ok := ctx.Value(requestRecordKey{}).(*requestRecord); ok {
+		return rec
+	}
+	return &requestRecord{}
+}
+
+// statusRecorder captures the response status while keeping Flush working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	// wroteAt is when the response headers went out
+	wroteAt time.Time
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+		s.wroteAt = time.Now()
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// accessEntry is one request's access log line.
+type accessEntry struct {
+	Time       time.Time
+	Method     string
+	Path       string
+	Status     int
+	Duration   time.Duration
+	RequestID  string
+	KeyID      string
+	Model      string
+	Backend    string
+	UserHash   string
+	Age        time.Duration
+	HasAge     bool
+	Experiment string
+	Variant    string
+	// Generation is the catalog generation the request was admitted under
+	Generation int64
+	Timings    stageTimings
+}
+
+// text renders the entry as a line of the process log.
+func (e *accessEntry) text() string {
+	var age string
+	if e.HasAge {
+		age = " age=" + e.Age.Round(time.Millisecond).String()
+	}
+	var experiment string
+	if e.Experiment != "" {
+		experiment = fmt.Sprintf(" experiment=%q variant=%q", e.Experiment, e.Variant)
+	}
+	return fmt.Sprintf("access method=%s path=%q status=%d duration=%s request_id=%q key=%q model=%q backend=%q user=%q generation=%d%s%s %s",
+		e.Method, e.Path, e.Status, e.Duration.Round(time.Millisecond),
+		e.RequestID, e.KeyID, e.Model, e.Backend, e.UserHash, e.Generation, age, experiment, e.Timings.logFields())
+}
+
+// accessLog logs one line per request once it completes.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &requestRecord{Start: start}
+		done := generations.admit(rec)
+		if rec.Age, rec.HasAge = requestAge(r, start); rec.HasAge {
+			requestAges.observe(rec.Age)
+		}
+		sw := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), requestRecordKey{}, rec)))
+		done(sw.status)
+
+		duration := time.Since(start)
+		accessLogs.write(&accessEntry{
+			Time: time.Now(), Method: r.Method, Path: r.URL.Path, Status: sw.status, Duration: duration,
+			RequestID: rec.RequestID, KeyID: rec.KeyID, Model: rec.Model, Backend: rec.Backend, UserHash: rec.UserHash,
+			Age: rec.Age, HasAge: rec.HasAge, Experiment: rec.Experiment, Variant: rec.Variant,
+			Generation: rec.catalog.generation, Timings: rec.Timings.stages(start),
+		})
+
+		latency := time.Since(start)
+		if !sw.wroteAt.IsZero() {
+			latency = sw.wroteAt.Sub(start)
+		}
+		if rec.DryRun {
+			return
+		}
+		slos.observe(rec.Route, sw.status, latency)
+		finishReasons.observe(rec.Model, rec.Route, rec.FinishReason)
+		promptExperiments.observe(rec, sw.status, duration)
+
+		if r.URL.Path == "/v1/chat/completions" && !isReplay(r) {
+			webhooks.notify(rec, sw.status, time.Since(start))
+			eventBus.notify(rec, sw.status, time.Since(start))
+			recordUsage(rec, sw.status, start)
+		}
+	})
+}
+
+// hashUser returns a salted, truncated hash of the OpenAI `user` field so
+// end users can be correlated in logs without recording raw identifiers.
+// The salt comes from USER_HASH_SALT.
+func hashUser(user string) string {
+	if user == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(os.Getenv("USER_HASH_SALT")))
+	mac.Write([]byte(user))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLog sends the process log to a buffer for the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(prev) })
+	return &buf
+}
+
+// chatAs serves a chat completion with body through the access log as key
+// id.
+func chatAs(id, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), identityContextKey{}, identity{KeyID: id, Method: "api_key"}))
+	w := httptest.NewRecorder()
+	accessLog(http.HandlerFunc(chatCompletionsHandler)).ServeHTTP(w, r)
+	return w
+}
+
+func TestHashUserIsStablePerSalt(t *testing.T) {
+	t.Setenv("USER_HASH_SALT", "pepper")
+	first := hashUser("alice@example.com")
+	if len(first) != 16 || first != hashUser("alice@example.com") {
+		t.Fatalf("hash = %q, then %q; want the same 16 hex digits", first, hashUser("alice@example.com"))
+	}
+	if hashUser("bob@example.com") == first {
+		t.Error("different users hash alike")
+	}
+	if hashUser("") != "" {
+		t.Error("empty user hashed")
+	}
+
+	t.Setenv("USER_HASH_SALT", "other")
+	if hashUser("alice@example.com") == first {
+		t.Error("hash doesn't depend on the salt")
+	}
+}
+
+func TestAccessLogHasOnlyTheUserHash(t *testing.T) {
+	t.Setenv("USER_HASH_SALT", "pepper")
+	logs := captureLog(t)
+	const user = "alice@example.com"
+	w := chatAs("", `{"model":"m","user":"`+user+`","messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if strings.Contains(logs.String(), user) || strings.Contains(logs.String(), "alice") {
+		t.Errorf("log has the raw user:\n%s", logs)
+	}
+	if !strings.Contains(logs.String(), `user="`+hashUser(user)+`"`) {
+		t.Errorf("log lacks the user hash:\n%s", logs)
+	}
+}
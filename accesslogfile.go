@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAccessLogQueue         = 10000
+	defaultAccessLogFlushInterval = time.Second
+	accessLogBufferSize           = 64 << 10
+	// maxAccessRecord bounds a msgpack record logcat will read, so a
+	// corrupt length prefix fails rather than allocating gigabytes
+	maxAccessRecord = 1 << 20
+)
+
+// accessLogDropped counts access log entries that were never written, by
+// reason: queue_full, write_error and closed (logged while the gateway was
+// stopping).
+var accessLogDropped = expvar.NewMap("gateway_access_log_dropped_total")
+
+// accessLogs is nil unless ACCESS_LOG_FILE is set, and entries go to the
+// process log as they are logged.
+var accessLogs *accessLogWriter
+
+// accessLogWriter writes access log entries to a file from a single
+// worker, so requests never wait for the disk or pay for formatting: they
+// only queue the entry. Writes are buffered and flushed every interval.
+type accessLogWriter struct {
+	path     string
+	msgpack  bool
+	interval time.Duration
+
+	mu     sync.Mutex
+	queue  chan accessEntry
+	closed bool
+	done   chan struct{}
+
+	// Owned by the worker. pending counts the entries buffered since the
+	// last flush, which a failed write loses
+	file    *os.File
+	buf     *bufio.Writer
+	pending int64
+	// scratch is the encoding buffer, reused across entries
+	scratch []byte
+}
+
+// loadAccessLogWriter reads ACCESS_LOG_FILE, ACCESS_LOG_FORMAT (text, the
+// process log's line, or msgpack), ACCESS_LOG_QUEUE_SIZE and
+// ACCESS_LOG_FLUSH_INTERVAL, opens the file for appending and starts the
+// worker. It returns nil when no file is configured.
+func loadAccessLogWriter() (*accessLogWriter, error) {
+	path := os.Getenv("ACCESS_LOG_FILE")
+	format := os.Getenv("ACCESS_LOG_FORMAT")
+	if format != "" && format != "text" && format != "msgpack" {
+		return nil, fmt.Errorf("unknown ACCESS_LOG_FORMAT %q: want text or msgpack", format)
+	}
+	if path == "" {
+		if format == "msgpack" {
+			return nil, errors.New("ACCESS_LOG_FORMAT=msgpack needs ACCESS_LOG_FILE")
+		}
+		return nil, nil
+	}
+	queueSize, err := envInt("ACCESS_LOG_QUEUE_SIZE")
+	if err != nil {
+		return nil, err
+	}
+	if queueSize == 0 {
+		queueSize = defaultAccessLogQueue
+	}
+	interval := envDuration("ACCESS_LOG_FLUSH_INTERVAL", defaultAccessLogFlushInterval)
+	if interval <= 0 {
+		return nil, errors.New("ACCESS_LOG_FLUSH_INTERVAL must be positive")
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &accessLogWriter{
+		path:     path,
+		msgpack:  format == "msgpack",
+		interval: interval,
+		queue:    make(chan accessEntry, queueSize),
+		done:     make(chan struct{}),
+		file:     f,
+	}
+	if w.msgpack {
+		w.buf = bufio.NewWriterSize(f, accessLogBufferSize)
+	} else {
+		w.buf = bufio.NewWriterSize(redactingWriter{f}, accessLogBufferSize)
+	}
+	go w.run()
+	return w, nil
+}
+
+// write logs e: queued for the file without blocking, or to the process
+// log when no file is configured.
+func (w *accessLogWriter) write(e *accessEntry) {
+	if w == nil {
+		log.Print(e.text())
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		accessLogDropped.Add("closed", 1)
+		return
+	}
+	select {
+	case w.queue <- *e:
+	default:
+		accessLogDropped.Add("queue_full", 1)
+	}
+}
+
+// run writes queued entries into the buffer, which goes to the file as it
+// fills and every interval.
+func (w *accessLogWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-w.queue:
+			if !ok {
+				w.flush()
+				if err := w.file.Close(); err != nil {
+					log.Printf("Closing access log %s failed: %v", w.path, err)
+				}
+				return
+			}
+			w.encode(&e)
+		case <-ticker.C:
+			w.flush()
+		}
+	}
+}
+
+func (w *accessLogWriter) encode(e *accessEntry) {
+	if w.msgpack {
+		// Each record is its length, 4 bytes big-endian, and a msgpack map
+		w.scratch = e.appendMsgpack(append(w.scratch[:0], 0, 0, 0, 0))
+		binary.BigEndian.PutUint32(w.scratch, uint32(len(w.scratch)-4))
+	} else {
+		w.scratch = append(e.Time.AppendFormat(w.scratch[:0], "2006/01/02 15:04:05 "), e.text()...)
+		w.scratch = append(w.scratch, '\n')
+	}
+	w.pending++
+	if _, err := w.buf.Write(w.scratch); err != nil {
+		w.failed(err)
+	}
+}
+
+func (w *accessLogWriter) flush() {
+	if err := w.buf.Flush(); err != nil {
+		w.failed(err)
+		return
+	}
+	w.pending = 0
+}
+
+// failed drops what the buffer holds: a bufio.Writer stays failed after an
+// error, so it is started afresh and later entries get their own chance.
+func (w *accessLogWriter) failed(err error) {
+	log.Printf("Writing access log %s failed: %v", w.path, err)
+	accessLogDropped.Add("write_error", w.pending)
+	w.pending = 0
+	if w.msgpack {
+		w.buf.Reset(w.file)
+	} else {
+		w.buf.Reset(redactingWriter{w.file})
+	}
+}
+
+// close writes the entries already queued, flushes and closes the file.
+func (w *accessLogWriter) close() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	<-w.done
+}
+
+// appendMsgpack appends the entry as a msgpack map with the keys logcat
+// prints, leaving out empty strings and zero timings. Durations are in
+// milliseconds, as float32: a microsecond's precision up to two hours.
+func (e *accessEntry) appendMsgpack(b []byte) []byte {
+	header := len(b)
+	b = append(b, 0xde, 0, 0)
+	n := 0
+	key := func(k string) {
+		b = appendMsgpackString(b, k)
+		n++
+	}
+	str := func(k, v string) {
+		if v != "" {
+			key(k)
+			b = appendMsgpackString(b, v)
+		}
+	}
+	millis := func(k string, d time.Duration) {
+		if d != 0 {
+			key(k)
+			b = appendMsgpackFloat32(b, float32(ms(d)))
+		}
+	}
+
+	key("time")
+	b = appendMsgpackTime(b, e.Time)
+	str("method", e.Method)
+	str("path", e.Path)
+	key("status")
+	b = appendMsgpackInt(b, int64(e.Status))
+	key("duration_ms")
+	b = appendMsgpackFloat32(b, float32(ms(e.Duration)))
+	str("request_id", e.RequestID)
+	str("key", e.KeyID)
+	str("model", e.Model)
+	str("backend", e.Backend)
+	str("user", e.UserHash)
+	str("experiment", e.Experiment)
+	str("variant", e.Variant)
+	key("generation")
+	b = appendMsgpackInt(b, e.Generation)
+	if e.HasAge {
+		key("age_ms")
+		b = appendMsgpackFloat32(b, float32(ms(e.Age)))
+	}
+	t := &e.Timings
+	millis("queue_ms", t.queue)
+	millis("validate_ms", t.validate)
+	millis("dns_ms", t.dns)
+	millis("connect_ms", t.connect)
+	millis("tls_ms", t.tls)
+	millis("ttfb_ms", t.ttfb)
+	millis("transfer_ms", t.transfer)
+	millis("post_ms", t.post)
+	millis("backend_ms", t.backend)
+	millis("overhead_ms", t.overhead)
+	if t.reused {
+		key("conn_reused")
+		b = append(b, 0xc3)
+	}
+	binary.BigEndian.PutUint16(b[header+1:], uint16(n))
+	return b
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n < 1<<8:
+		b = append(b, 0xd9, byte(n))
+	case n < 1<<16:
+		b = append(b, 0xda, byte(n>>8), byte(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+func appendMsgpackInt(b []byte, v int64) []byte {
+	if v >= 0 && v < 128 {
+		return append(b, byte(v))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(v))
+}
+
+func appendMsgpackFloat32(b []byte, v float32) []byte {
+	return binary.BigEndian.AppendUint32(append(b, 0xca), math.Float32bits(v))
+}
+
+// appendMsgpackTime appends t as the msgpack timestamp extension, in its
+// 96-bit form.
+func appendMsgpackTime(b []byte, t time.Time) []byte {
+	b = append(b, 0xc7, 12, 0xff)
+	b = binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+	return binary.BigEndian.AppendUint64(b, uint64(t.Unix()))
+}
+
+// logcatMain implements the logcat subcommand, which prints msgpack access
+// logs as JSON lines.
+func logcatMain(args []string) {
+	if err := runLogcat(args, os.Stdout); err != nil {
+		log.Fatalf("logcat: %v", err)
+	}
+	os.Exit(0)
+}
+
+func runLogcat(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("logcat", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: gateway logcat [file ...]\n\nPrints ACCESS_LOG_FORMAT=msgpack access logs as JSON lines; with no files, reads stdin.")
+	}
+	fs.Parse(args)
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	if fs.NArg() == 0 {
+		return logcat(bufio.NewReader(os.Stdin), w)
+	}
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = logcat(bufio.NewReader(f), w)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// logcat converts every record of r. A record cut off at the end, by a
+// crash mid-write, is ignored.
+func logcat(r io.Reader, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	var header [4]byte
+	for n := 1; ; n++ {
+		if _, err := io.ReadFull(r, header[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if size > maxAccessRecord {
+			return fmt.Errorf("record %d: implausible length %d, not a msgpack access log?", n, size)
+		}
+		record := make([]byte, size)
+		if _, err := io.ReadFull(r, record); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		d := msgpackDecoder{b: record}
+		v, err := d.value()
+		if err == nil && len(d.b) > 0 {
+			err = errors.New("trailing bytes")
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+}
+
+var errMsgpackShort = errors.New("truncated msgpack value")
+
+// msgpackDecoder decodes the msgpack the access log writes: maps, strings,
+// integers, floats, booleans, nil and timestamps.
+type msgpackDecoder struct {
+	b []byte
+}
+
+func (d *msgpackDecoder) take(n int) ([]byte, error) {
+	if n > len(d.b) {
+		return nil, errMsgpackShort
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v, nil
+}
+
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.take(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *msgpackDecoder) value() (any, error) {
+	tag, err := d.take(1)
+	if err != nil {
+		return nil, err
+	}
+	switch t := tag[0]; {
+	case t < 0x80:
+		return int64(t), nil
+	case t >= 0xe0:
+		return int64(int8(t)), nil
+	case t&0xf0 == 0x80:
+		return d.mapOf(int(t & 0x0f))
+	case t&0xe0 == 0xa0:
+		return d.str(int(t & 0x1f))
+	case t == 0xc0:
+		return nil, nil
+	case t == 0xc2 || t == 0xc3:
+		return t == 0xc3, nil
+	case t >= 0xd9 && t <= 0xdb:
+		n, err := d.uint(1 << (t - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case t == 0xde || t == 0xdf:
+		n, err := d.uint(2 << (t - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapOf(int(n))
+	case t >= 0xcc && t <= 0xcf:
+		return d.uint(1 << (t - 0xcc))
+	case t >= 0xd0 && t <= 0xd3:
+		size := 1 << (t - 0xd0)
+		v, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		shift := 64 - 8*size
+		return int64(v<<shift) >> shift, nil
+	case t == 0xca:
+		v, err := d.uint(4)
+		// As written, rather than the float32's exact float64 value
+		f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(math.Float32frombits(uint32(v))), 'g', -1, 32), 64)
+		return f, err
+	case t == 0xcb:
+		v, err := d.uint(8)
+		return math.Float64frombits(v), err
+	case t == 0xd6 || t == 0xd7 || t == 0xc7:
+		return d.timestamp(t)
+	}
+	return nil, fmt.Errorf("unsupported msgpack type 0x%02x", tag[0])
+}
+
+func (d *msgpackDecoder) str(n int) (string, error) {
+	b, err := d.take(n)
+	return string(b), err
+}
+
+func (d *msgpackDecoder) mapOf(n int) (map[string]any, error) {
+	if n > len(d.b) {
+		return nil, errMsgpackShort
+	}
+	m := make(map[string]any, n)
+	for range n {
+		k, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, errors.New("msgpack map key is not a string")
+		}
+		if m[key], err = d.value(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// timestamp decodes the timestamp extension in any of its three forms,
+// after the tag t.
+func (d *msgpackDecoder) timestamp(t byte) (time.Time, error) {
+	size := map[byte]int{0xd6: 4, 0xd7: 8}[t]
+	if t == 0xc7 {
+		n, err := d.uint(1)
+		if err != nil {
+			return time.Time{}, err
+		}
+		size = int(n)
+	}
+	typ, err := d.take(1)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if int8(typ[0]) != -1 {
+		return time.Time{}, fmt.Errorf("unsupported msgpack extension %d", int8(typ[0]))
+	}
+	switch size {
+	case 4:
+		sec, err := d.uint(4)
+		return time.Unix(int64(sec), 0).UTC(), err
+	case 8:
+		v, err := d.uint(8)
+		return time.Unix(int64(v&(1<<34-1)), int64(v>>34)).UTC(), err
+	case 12:
+		nsec, err := d.uint(4)
+		if err != nil {
+			return time.Time{}, err
+		}
+		sec, err := d.uint(8)
+		return time.Unix(int64(sec), int64(nsec)).UTC(), err
+	}
+	return time.Time{}, fmt.Errorf("msgpack timestamp of %d bytes", size)
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sampleAccessEntry() *accessEntry {
+	return &accessEntry{
+		Time: time.Date(2026, 3, 1, 12, 30, 0, 123456789, time.UTC), Method: "POST", Path: "/v1/chat/completions",
+		Status: 200, Duration: 1234 * time.Millisecond, RequestID: "req-1", KeyID: "team-a", Model: "gpt-4o",
+		Backend: "vllm-a", UserHash: "0123456789abcdef", Generation: 3,
+		Timings: stageTimings{queue: 2 * time.Millisecond, ttfb: 180 * time.Millisecond, backend: 1200 * time.Millisecond, overhead: 32 * time.Millisecond, reused: true},
+	}
+}
+
+// useAccessLogFile starts a writer for a fresh file with format and a long
+// flush interval, so only a full buffer or closing writes it out.
+func useAccessLogFile(t testing.TB, format string) (*accessLogWriter, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "access.log")
+	t.Setenv("ACCESS_LOG_FILE", path)
+	t.Setenv("ACCESS_LOG_FORMAT", format)
+	t.Setenv("ACCESS_LOG_FLUSH_INTERVAL", "1h")
+	t.Setenv("ACCESS_LOG_QUEUE_SIZE", "")
+	w, err := loadAccessLogWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(w.close)
+	return w, path
+}
+
+func TestAccessLogFlushesOnClose(t *testing.T) {
+	for _, format := range []string{"text", "msgpack"} {
+		t.Run(format, func(t *testing.T) {
+			w, path := useAccessLogFile(t, format)
+			for range 100 {
+				w.write(sampleAccessEntry())
+			}
+			// Queued and buffered, not yet written
+			time.Sleep(10 * time.Millisecond)
+			if info, _ := os.Stat(path); info.Size() != 0 {
+				t.Fatalf("%d bytes written before the flush", info.Size())
+			}
+
+			w.close()
+			data, _ := os.ReadFile(path)
+			var lines []string
+			if format == "msgpack" {
+				var out bytes.Buffer
+				if err := logcat(bytes.NewReader(data), &out); err != nil {
+					t.Fatal(err)
+				}
+				data = out.Bytes()
+			}
+			lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+			if len(lines) != 100 {
+				t.Fatalf("%d entries after closing, want 100", len(lines))
+			}
+			if !strings.Contains(lines[99], `req-1`) {
+				t.Errorf("last entry = %s", lines[99])
+			}
+
+			// Entries logged while stopping are counted, not written
+			before := expvarInt(accessLogDropped, "closed")
+			w.write(sampleAccessEntry())
+			if got := expvarInt(accessLogDropped, "closed") - before; got != 1 {
+				t.Errorf("dropped %d entries as closed, want 1", got)
+			}
+			w.close()
+		})
+	}
+}
+
+func TestAccessLogFlushesEveryInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	t.Setenv("ACCESS_LOG_FILE", path)
+	t.Setenv("ACCESS_LOG_FLUSH_INTERVAL", "10ms")
+	w, err := loadAccessLogWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+	w.write(sampleAccessEntry())
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if data, _ := os.ReadFile(path); len(data) > 0 {
+			if want := "2026/03/01 12:30:00 access method=POST"; !strings.HasPrefix(string(data), want) {
+				t.Errorf("line = %s, want it to start %q", data, want)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("nothing flushed after 2s")
+		}
+	}
+}
+
+func TestAccessLogDropsWhenSaturated(t *testing.T) {
+	// No worker drains this queue
+	w := &accessLogWriter{queue: make(chan accessEntry, 2)}
+	before := expvarInt(accessLogDropped, "queue_full")
+	for range 5 {
+		w.write(sampleAccessEntry())
+	}
+	if got := expvarInt(accessLogDropped, "queue_full") - before; got != 3 || len(w.queue) != 2 {
+		t.Errorf("dropped %d, queued %d; want 3 and 2", got, len(w.queue))
+	}
+}
+
+func TestAccessLogWriteErrors(t *testing.T) {
+	logs := captureLog(t)
+	path := filepath.Join(t.TempDir(), "access.log")
+	os.WriteFile(path, nil, 0o600)
+	// A read-only file fails every flush
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &accessLogWriter{path: path, interval: time.Hour, queue: make(chan accessEntry, 10), done: make(chan struct{}), file: f}
+	w.buf = bufio.NewWriterSize(redactingWriter{f}, accessLogBufferSize)
+	go w.run()
+
+	before := expvarInt(accessLogDropped, "write_error")
+	for range 3 {
+		w.write(sampleAccessEntry())
+	}
+	w.close()
+	if got := expvarInt(accessLogDropped, "write_error") - before; got != 3 {
+		t.Errorf("dropped %d entries on write errors, want 3", got)
+	}
+	if !strings.Contains(logs.String(), "Writing access log "+path+" failed") {
+		t.Errorf("log = %s", logs)
+	}
+}
+
+func TestAccessLogTextIsRedacted(t *testing.T) {
+	w, path := useAccessLogFile(t, "text")
+	redactor.add("sk-in-a-path-0001")
+	e := sampleAccessEntry()
+	e.Path = "/v1/keys/sk-in-a-path-0001"
+	w.write(e)
+	w.close()
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "sk-in-a-path-0001") || !strings.Contains(string(data), "/v1/keys/[redacted]") {
+		t.Errorf("line = %s", data)
+	}
+}
+
+func TestAccessLogWithoutFileUsesProcessLog(t *testing.T) {
+	logs := captureLog(t)
+	var w *accessLogWriter
+	w.write(sampleAccessEntry())
+	w.close()
+	want := `access method=POST path="/v1/chat/completions" status=200 duration=1.234s request_id="req-1" key="team-a" model="gpt-4o" backend="vllm-a" user="0123456789abcdef" generation=3 queue_ms=2.0`
+	if !strings.Contains(logs.String(), want) {
+		t.Errorf("log = %s\nwant %s", logs, want)
+	}
+}
+
+func TestAccessLogsFromRequests(t *testing.T) {
+	captureLog(t)
+	useFakeBackend(t)
+	w, path := useAccessLogFile(t, "msgpack")
+	prev := accessLogs
+	accessLogs = w
+	t.Cleanup(func() { accessLogs = prev })
+
+	chatAs("team-a", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`)
+	w.close()
+	data, _ := os.ReadFile(path)
+	var out bytes.Buffer
+	if err := logcat(bytes.NewReader(data), &out); err != nil {
+		t.Fatal(err)
+	}
+	var entry map[string]any
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("%v: %s", err, out.String())
+	}
+	if entry["path"] != "/v1/chat/completions" || entry["key"] != "team-a" || entry["status"] != float64(200) || entry["backend_ms"] == nil {
+		t.Errorf("entry = %v", entry)
+	}
+}
+
+func TestLoadAccessLogWriterConfig(t *testing.T) {
+	tests := []struct {
+		file, format, interval, queue, err string
+	}{
+		{"", "", "", "", ""},
+		{"", "text", "", "", ""},
+		{"", "msgpack", "", "", "ACCESS_LOG_FORMAT=msgpack needs ACCESS_LOG_FILE"},
+		{"access.log", "json", "", "", `unknown ACCESS_LOG_FORMAT "json": want text or msgpack`},
+		{"access.log", "", "-1s", "", "ACCESS_LOG_FLUSH_INTERVAL must be positive"},
+		{"access.log", "", "", "many", "ACCESS_LOG_QUEUE_SIZE"},
+		{"missing/dir/access.log", "", "", "", "no such file or directory"},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		file := tt.file
+		if file != "" {
+			file = filepath.Join(dir, file)
+		}
+		t.Setenv("ACCESS_LOG_FILE", file)
+		t.Setenv("ACCESS_LOG_FORMAT", tt.format)
+		t.Setenv("ACCESS_LOG_FLUSH_INTERVAL", tt.interval)
+		t.Setenv("ACCESS_LOG_QUEUE_SIZE", tt.queue)
+		w, err := loadAccessLogWriter()
+		w.close()
+		if tt.err == "" && (err != nil || w != nil) {
+			t.Errorf("%+v: %v, %v; want no writer", tt, w, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%+v: err = %v, want %s", tt, err, tt.err)
+		}
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	e := sampleAccessEntry()
+	e.Age, e.HasAge = 1500*time.Millisecond, true
+	e.Experiment = strings.Repeat("e", 40)
+	e.Variant = strings.Repeat("v", 300)
+	e.Model = strings.Repeat("m", 70000)
+	e.Generation = 1 << 40
+	e.Backend = ""
+
+	var out bytes.Buffer
+	record := e.appendMsgpack(append([]byte(nil), 0, 0, 0, 0))
+	binary.BigEndian.PutUint32(record, uint32(len(record)-4))
+	if err := logcat(bytes.NewReader(record), &out); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"time": "2026-03-01T12:30:00.123456789Z", "method": "POST", "path": "/v1/chat/completions", "status": float64(200),
+		"duration_ms": float64(1234), "request_id": "req-1", "key": "team-a", "model": e.Model, "user": "0123456789abcdef",
+		"experiment": e.Experiment, "variant": e.Variant, "generation": float64(1 << 40), "age_ms": float64(1500),
+		"queue_ms": float64(2), "ttfb_ms": float64(180), "backend_ms": float64(1200), "overhead_ms": float64(32), "conn_reused": true,
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+	// Empty strings and zero timings are left out
+	for _, k := range []string{"backend", "dns_ms", "tls_ms"} {
+		if _, ok := got[k]; ok {
+			t.Errorf("%s written: %v", k, got[k])
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("%d keys, want %d: %v", len(got), len(want), got)
+	}
+}
+
+func TestMsgpackDecoder(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		want any
+	}{
+		{[]byte{0x05}, int64(5)},
+		{[]byte{0xff}, int64(-1)},
+		{[]byte{0xd0, 0x80}, int64(-128)},
+		{[]byte{0xd1, 0xff, 0x00}, int64(-256)},
+		{[]byte{0xd3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}, int64(-2)},
+		{[]byte{0xcc, 0xff}, uint64(255)},
+		{[]byte{0xcd, 0x01, 0x00}, uint64(256)},
+		{[]byte{0xc0}, nil},
+		{[]byte{0xc2}, false},
+		{[]byte{0xa2, 'h', 'i'}, "hi"},
+		{[]byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, 1.5},
+		{[]byte{0xca, 0x3d, 0xcc, 0xcc, 0xcd}, 0.1},
+		{[]byte{0xd6, 0xff, 0, 0, 0, 60}, time.Unix(60, 0).UTC()},
+		{[]byte{0xd7, 0xff, 0, 0, 0, 4, 0, 0, 0, 60}, time.Unix(60, 1).UTC()},
+	}
+	for _, tt := range tests {
+		d := msgpackDecoder{b: tt.in}
+		got, err := d.value()
+		if err != nil || got != tt.want || len(d.b) != 0 {
+			t.Errorf("% x = %v (%T), %v; want %v", tt.in, got, got, err, tt.want)
+		}
+	}
+
+	for _, in := range [][]byte{{}, {0xa5, 'h'}, {0x81, 0x01, 0x02}, {0xc1}, {0xd6, 0x01, 0, 0, 0, 0}, {0x85}} {
+		d := msgpackDecoder{b: in}
+		if v, err := d.value(); err == nil {
+			t.Errorf("% x decoded to %v", in, v)
+		}
+	}
+}
+
+func TestLogcat(t *testing.T) {
+	record := func(payload ...byte) []byte {
+		return append(binary.BigEndian.AppendUint32(nil, uint32(len(payload))), payload...)
+	}
+	one := record(0x81, 0xa1, 'a', 0x01)
+	tests := []struct {
+		name, want, err string
+		in              []byte
+	}{
+		{"empty", "", "", nil},
+		{"records", "{\"a\":1}\n{\"a\":1}\n", "", append(bytes.Clone(one), one...)},
+		{"cut off mid-record", "{\"a\":1}\n", "", append(bytes.Clone(one), one[:6]...)},
+		{"cut off in the length", "{\"a\":1}\n", "", append(bytes.Clone(one), 0, 0)},
+		{"trailing bytes", "", "record 1: trailing bytes", record(0x01, 0x02)},
+		{"bad length", "", "record 1: implausible length", []byte{0xff, 0xff, 0xff, 0xff}},
+		{"not a log", "", "record 1: unsupported msgpack type 0xc1", record(0xc1)},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		err := logcat(bytes.NewReader(tt.in), &out)
+		if (tt.err == "") != (err == nil) || err != nil && !strings.HasPrefix(err.Error(), tt.err) || out.String() != tt.want {
+			t.Errorf("%s: %q, %v; want %q, %s", tt.name, out.String(), err, tt.want, tt.err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "access.mp")
+	os.WriteFile(path, one, 0o600)
+	var out bytes.Buffer
+	if err := runLogcat([]string{path, path}, &out); err != nil || out.String() != "{\"a\":1}\n{\"a\":1}\n" {
+		t.Errorf("runLogcat = %q, %v", out.String(), err)
+	}
+	if err := runLogcat([]string{path + ".missing"}, io.Discard); err == nil {
+		t.Error("missing file accepted")
+	}
+}
+
+// BenchmarkAccessLogSync is the path without ACCESS_LOG_FILE: formatting
+// and a synchronous write to the process log, on the request goroutine.
+func BenchmarkAccessLogSync(b *testing.B) {
+	f, err := os.Create(filepath.Join(b.TempDir(), "gateway.log"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	prev := log.Writer()
+	log.SetOutput(redactingWriter{f})
+	defer log.SetOutput(prev)
+	var w *accessLogWriter
+	e := sampleAccessEntry()
+	b.ReportAllocs()
+	for b.Loop() {
+		w.write(e)
+	}
+}
+
+// BenchmarkAccessLogAsync is what a request pays with ACCESS_LOG_FILE:
+// queueing its entry. The worker formats and writes it concurrently.
+func BenchmarkAccessLogAsync(b *testing.B) {
+	for _, format := range []string{"text", "msgpack"} {
+		b.Run(format, func(b *testing.B) {
+			w, _ := useAccessLogFile(b, format)
+			e := sampleAccessEntry()
+			before := expvarInt(accessLogDropped, "queue_full")
+			b.ReportAllocs()
+			for b.Loop() {
+				w.write(e)
+			}
+			b.StopTimer()
+			w.close()
+			b.ReportMetric(float64(expvarInt(accessLogDropped, "queue_full")-before)/float64(b.N), "dropped/op")
+		})
+	}
+}
+
+// BenchmarkAccessLogEncode is the worker's cost per entry, by format.
+func BenchmarkAccessLogEncode(b *testing.B) {
+	for _, format := range []string{"text", "msgpack"} {
+		b.Run(format, func(b *testing.B) {
+			w := &accessLogWriter{msgpack: format == "msgpack"}
+			w.buf = bufio.NewWriterSize(io.Discard, accessLogBufferSize)
+			e := sampleAccessEntry()
+			b.ReportAllocs()
+			for b.Loop() {
+				w.encode(e)
+			}
+			b.SetBytes(int64(len(w.scratch)))
+		})
+	}
+}
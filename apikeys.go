@@ -0,0 +1,559 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vinayhpandya/ai_inference_gateway/client"
+)
+
+// apiKeyPrefix starts every generated key so leaked keys are recognizable.
+const apiKeyPrefix = "gwk_"
+
+// apiKeys is nil unless API_KEY_STORE is set.
+var apiKeys *apiKeyStore
+
+// APIKey is a bearer key's metadata as shown to admins; it is shared with
+// the client package.
+type APIKey = client.APIKey
+
+// storedAPIKey is the persisted form: metadata plus the SHA-256 of the key.
+type storedAPIKey struct {
+	APIKey
+	Hash string `json:"hash"`
+}
+
+// apiKeyIndex is an immutable view of the enabled keys. Mutations build a
+// new one and swap it in, so lookups on the request path never lock.
+type apiKeyIndex struct {
+	byHash map[string]*APIKey
+	byID   map[string]*APIKey
+}
+
+// apiKeyStore persists keys as a JSON file. Writes are serialized by mu.
+type apiKeyStore struct {
+	mu    sync.Mutex
+	path  string
+	keys  map[string]*storedAPIKey
+	index atomic.Pointer[apiKeyIndex]
+
+	budgets *budgetLedger
+}
+
+// loadAPIKeyStore opens the key file named by API_KEY_STORE, creating it on
+// first write. It returns nil when bearer keys are not configured.
+func loadAPIKeyStore() (*apiKeyStore, error) {
+	path := os.Getenv("API_KEY_STORE")
+	if path == "" {
+		return nil, nil
+	}
+	s := &apiKeyStore{path: path, keys: make(map[string]*storedAPIKey)}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		var stored []*storedAPIKey
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", path, err)
+		}
+		for _, k := range stored {
+			s.keys[k.ID] = k
+		}
+	}
+	s.rebuild()
+	if s.budgets, err = loadBudgetLedger(path); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// rebuild swaps in a fresh index of the enabled keys. Children of a
+// disabled parent are left out with it. Callers hold mu, except during load.
+func (s *apiKeyStore) rebuild() {
+	idx := &apiKeyIndex{byHash: make(map[string]*APIKey), byID: make(map[string]*APIKey)}
+	for _, k := range s.keys {
+		if k.Disabled {
+			continue
+		}
+		if parent, ok := s.keys[k.ParentID]; k.ParentID != "" && (!ok || parent.Disabled) {
+			continue
+		}
+		meta := k.APIKey
+		idx.byHash[k.Hash] = &meta
+		idx.byID[k.ID] = &meta
+	}
+	s.index.Store(idx)
+}
+
+// save writes every key to the store file. Callers hold mu.
+func (s *apiKeyStore) save() error {
+	stored := make([]*storedAPIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		stored = append(stored, k)
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].ID < stored[j].ID })
+	return writeJSONFile(s.path, stored)
+}
+
+// authenticate returns the enabled key matching a presented bearer token.
+func (s *apiKeyStore) authenticate(token string) (*APIKey, bool) {
+	k, ok := s.index.Load().byHash[hashAPIKey(token)]
+	return k, ok
+}
+
+// lineage returns an enabled key followed by its parent, if it has one.
+func (idx *apiKeyIndex) lineage(id string) []*APIKey {
+	k, ok := idx.byID[id]
+	if !ok {
+		return nil
+	}
+	if parent, ok := idx.byID[k.ParentID]; ok {
+		return []*APIKey{k, parent}
+	}
+	return []*APIKey{k}
+}
+
+// tenant returns the key IDs a request from id counts against: id and its
+// parent's, if it has one.
+func (s *apiKeyStore) tenant(id string) []string {
+	if s == nil {
+		return []string{id}
+	}
+	lineage := s.index.Load().lineage(id)
+	if len(lineage) == 0 {
+		return []string{id}
+	}
+	ids := make([]string, len(lineage))
+	for i, k := range lineage {
+		ids[i] = k.ID
+	}
+	return ids
+}
+
+// maxConcurrent returns a key's concurrency override, if it or its parent
+// has one.
+func (s *apiKeyStore) maxConcurrent(id string) (int, bool) {
+	if s == nil {
+		return 0, false
+	}
+	for _, k := range s.index.Load().lineage(id) {
+		if k.MaxConcurrent != 0 {
+			return k.MaxConcurrent, true
+		}
+	}
+	return 0, false
+}
+
+// rateLimit returns a key's rate limit override, from it or its parent,
+// and when the key was created.
+func (s *apiKeyStore) rateLimit(id string) (rpm, burst int, createdAt int64, ok bool) {
+	if s == nil {
+		return 0, 0, 0, false
+	}
+	keys := s.index.Load().lineage(id)
+	for _, k := range keys {
+		if k.RateLimitRPM != 0 {
+			return k.RateLimitRPM, k.RateLimitBurst, keys[0].CreatedAt, true
+		}
+	}
+	if len(keys) > 0 {
+		return 0, 0, keys[0].CreatedAt, false
+	}
+	return 0, 0, 0, false
+}
+
+// allowsModel reports whether the caller may use model. Callers without a
+// stored key, and keys without an allowlist, may use any model; a child key
+// must be allowed by its parent's allowlist too.
+func (s *apiKeyStore) allowsModel(id, model string) bool {
+	if s == nil {
+		return true
+	}
+	for _, k := range s.index.Load().lineage(id) {
+		if len(k.AllowedModels) > 0 && !slices.Contains(k.AllowedModels, model) {
+			return false
+		}
+	}
+	return true
+}
+
+// keyAllows reports whether a stored key, and its parent if it has one,
+// both have the permission flag returns: a child never has more than its
+// parent grants.
+func (s *apiKeyStore) keyAllows(id string, flag func(*APIKey) bool) bool {
+	if s == nil {
+		return false
+	}
+	keys := s.index.Load().lineage(id)
+	for _, k := range keys {
+		if !flag(k) {
+			return false
+		}
+	}
+	return len(keys) > 0
+}
+
+// requiresUser reports whether a stored key, or its parent if it has one,
+// requires the user field.
+func (s *apiKeyStore) requiresUser(id string) bool {
+	if s == nil {
+		return false
+	}
+	for _, k := range s.index.Load().lineage(id) {
+		if k.RequireUser {
+			return true
+		}
+	}
+	return false
+}
+
+// apiVersion returns the API version a stored key, or else its parent if
+// it has one, sets; "" if neither does.
+func (s *apiKeyStore) apiVersion(id string) string {
+	if s == nil {
+		return ""
+	}
+	for _, k := range s.index.Load().lineage(id) {
+		if k.APIVersion != "" {
+			return k.APIVersion
+		}
+	}
+	return ""
+}
+
+// apiKeyRequest is the body for creating and updating keys. Absent fields
+// are left unchanged on update.
+type apiKeyRequest = client.KeyRequest
+
+func applyKeyRequest(req apiKeyRequest, k *APIKey) error {
+	if req.Name != nil {
+		k.Name = *req.Name
+	}
+	if req.Disabled != nil {
+		k.Disabled = *req.Disabled
+	}
+	if req.MaxConcurrent != nil {
+		if *req.MaxConcurrent < 0 {
+			return errNegativeConcurrency
+		}
+		k.MaxConcurrent = *req.MaxConcurrent
+	}
+	if req.RateLimitRPM != nil {
+		if *req.RateLimitRPM < 0 {
+			return errNegativeRateLimit
+		}
+		k.RateLimitRPM = *req.RateLimitRPM
+	}
+	if req.RateLimitBurst != nil {
+		if *req.RateLimitBurst < 0 {
+			return errNegativeRateLimit
+		}
+		k.RateLimitBurst = *req.RateLimitBurst
+	}
+	if req.AllowedModels != nil {
+		k.AllowedModels = *req.AllowedModels
+	}
+	if req.DryRun != nil {
+		k.DryRun = *req.DryRun
+	}
+	if req.DataCollection != nil {
+		k.DataCollection = *req.DataCollection
+	}
+	if req.CanOverrideRouting != nil {
+		k.CanOverrideRouting = *req.CanOverrideRouting
+	}
+	if req.BypassInjectionGuard != nil {
+		k.BypassInjectionGuard = *req.BypassInjectionGuard
+	}
+	if req.ServerTiming != nil {
+		k.ServerTiming = *req.ServerTiming
+	}
+	if req.RequireUser != nil {
+		k.RequireUser = *req.RequireUser
+	}
+	if req.APIVersion != nil {
+		if *req.APIVersion != "" && lookupAPIVersion(*req.APIVersion) == nil {
+			return errUnknownAPIVersion
+		}
+		k.APIVersion = *req.APIVersion
+	}
+	if req.ParentID != nil && *req.ParentID != k.ParentID {
+		return errParentImmutable
+	}
+	if req.TokenBudget != nil {
+		if *req.TokenBudget < 0 {
+			return errNegativeBudget
+		}
+		k.TokenBudget = *req.TokenBudget
+	}
+	if req.BudgetPeriod != nil {
+		if !validBudgetPeriod(*req.BudgetPeriod) {
+			return errInvalidBudgetPeriod
+		}
+		k.BudgetPeriod = *req.BudgetPeriod
+	}
+	if req.Defaults != nil {
+		if err := validateKeyDefaults(req.Defaults); err != nil {
+			return err
+		}
+		// {} clears the defaults
+		k.Defaults = req.Defaults
+		if emptyKeyDefaults(k.Defaults) {
+			k.Defaults = nil
+		}
+	}
+	if req.SystemPrompt != nil {
+		if len(*req.SystemPrompt) > maxSystemPromptLength {
+			return errSystemPromptTooLong
+		}
+		k.SystemPrompt = *req.SystemPrompt
+	}
+	return nil
+}
+
+// create stores a new key and returns it with its plaintext, which is not
+// kept anywhere.
+func (s *apiKeyStore) create(req apiKeyRequest) (APIKey, string, error) {
+	secret := make([]byte, 24)
+	rand.Read(secret)
+	plaintext := apiKeyPrefix + hex.EncodeToString(secret)
+
+	now := time.Now().Unix()
+	k := &storedAPIKey{
+		APIKey: APIKey{
+			ID:        "key_" + uuid.New().String(),
+			Prefix:    plaintext[:len(apiKeyPrefix)+8],
+			CreatedAt: now,
+			UpdatedAt: now,
+		},
+		Hash: hashAPIKey(plaintext),
+	}
+	if req.ParentID != nil {
+		k.ParentID = *req.ParentID
+	}
+	if err := applyKeyRequest(req, &k.APIKey); err != nil {
+		return APIKey{}, "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if k.ParentID != "" {
+		parent, ok := s.keys[k.ParentID]
+		if !ok {
+			return APIKey{}, "", errParentNotFound
+		}
+		// Hierarchies are two levels: a team key and its apps' keys
+		if parent.ParentID != "" {
+			return APIKey{}, "", errNestedParent
+		}
+	}
+	s.keys[k.ID] = k
+	if err := s.save(); err != nil {
+		delete(s.keys, k.ID)
+		return APIKey{}, "", err
+	}
+	s.rebuild()
+	return k.APIKey, plaintext, nil
+}
+
+func (s *apiKeyStore) list() []APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k.APIKey)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt < keys[j].CreatedAt })
+	return keys
+}
+
+var (
+	errKeyNotFound         = errors.New("no such key")
+	errNegativeConcurrency = errors.New("max_concurrent must not be negative")
+	errNegativeRateLimit   = errors.New("rate_limit_rpm and rate_limit_burst must not be negative")
+	errNegativeBudget      = errors.New("token_budget must not be negative")
+	errInvalidBudgetPeriod = errors.New("budget_period must be month or day")
+	errParentNotFound      = errors.New("parent_id names no key")
+	errNestedParent        = errors.New("parent_id must name a key without a parent of its own")
+	errParentImmutable     = errors.New("parent_id can only be set when a key is created")
+)
+
+func (s *apiKeyStore) update(id string, req apiKeyRequest) (APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return APIKey{}, errKeyNotFound
+	}
+	updated := *k
+	if err := applyKeyRequest(req, &updated.APIKey); err != nil {
+		return APIKey{}, err
+	}
+	updated.UpdatedAt = time.Now().Unix()
+	s.keys[id] = &updated
+	if err := s.save(); err != nil {
+		s.keys[id] = k
+		return APIKey{}, err
+	}
+	s.rebuild()
+	return updated.APIKey, nil
+}
+
+// delete removes a key along with its children, which are returned after it.
+func (s *apiKeyStore) delete(id string) ([]APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return nil, errKeyNotFound
+	}
+	removed := []*storedAPIKey{k}
+	for _, child := range s.keys {
+		if child.ParentID == id {
+			removed = append(removed, child)
+		}
+	}
+	for _, r := range removed {
+		delete(s.keys, r.ID)
+	}
+	if err := s.save(); err != nil {
+		for _, r := range removed {
+			s.keys[r.ID] = r
+		}
+		return nil, err
+	}
+	s.rebuild()
+	keys := make([]APIKey, len(removed))
+	ids := make([]string, len(removed))
+	for i, r := range removed {
+		keys[i], ids[i] = r.APIKey, r.ID
+	}
+	s.budgets.forget(ids...)
+	return keys, nil
+}
+
+// children lists the stored keys whose parent is id.
+func (s *apiKeyStore) children(id string) []APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []APIKey
+	for _, k := range s.keys {
+		if k.ParentID == id {
+			keys = append(keys, k.APIKey)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt < keys[j].CreatedAt })
+	return keys
+}
+
+// auditKey logs a key mutation. The key's plaintext and hash are never logged.
+func auditKey(r *http.Request, action string, k APIKey) {
+	log.Printf("audit action=%s key=%q name=%q disabled=%t max_concurrent=%d rate_limit_rpm=%d rate_limit_burst=%d allowed_models=%q dry_run=%t data_collection=%t can_override_routing=%t bypass_injection_guard=%t server_timing=%t require_user=%t parent=%q token_budget=%d budget_period=%q defaults=%t system_prompt_bytes=%d api_version=%q remote=%s",
+		action, k.ID, truncateForLog(k.Name), k.Disabled, k.MaxConcurrent, k.RateLimitRPM, k.RateLimitBurst, k.AllowedModels, k.DryRun, k.DataCollection, k.CanOverrideRouting, k.BypassInjectionGuard, k.ServerTiming, k.RequireUser, k.ParentID, k.TokenBudget, k.BudgetPeriod,
+		k.Defaults != nil, len(k.SystemPrompt), k.APIVersion, r.RemoteAddr)
+}
+
+// requireAPIKeys returns 404 for key admin endpoints when no store is configured.
+func requireAPIKeys(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if apiKeys == nil {
+			writeJSONError(w, http.StatusNotFound, "invalid_request_error", "not_found", "API key management is not enabled on this gateway")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// createKeyHandler implements POST /admin/keys. The response is the only
+// time the plaintext key is shown.
+func createKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_json", "Invalid JSON: "+describeJSONError(err))
+		return
+	}
+	k, plaintext, err := apiKeys.create(req)
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	auditKey(r, "key.create", k)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		APIKey
+		Key string `json:"key"`
+	}{k, plaintext})
+}
+
+// listKeysHandler implements GET /admin/keys.
+func listKeysHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": apiKeys.list()})
+}
+
+// updateKeyHandler implements PATCH /admin/keys/{id}.
+func updateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_json", "Invalid JSON: "+describeJSONError(err))
+		return
+	}
+	k, err := apiKeys.update(r.PathValue("id"), req)
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	auditKey(r, "key.update", k)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(k)
+}
+
+// deleteKeyHandler implements DELETE /admin/keys/{id}.
+func deleteKeyHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := apiKeys.delete(r.PathValue("id"))
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	for _, k := range keys {
+		auditKey(r, "key.delete", k)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeKeyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errKeyNotFound):
+		writeJSONError(w, http.StatusNotFound, "invalid_request_error", "key_not_found", "No API key with that ID")
+	case errors.Is(err, errNegativeConcurrency), errors.Is(err, errNegativeRateLimit), errors.Is(err, errNegativeBudget), errors.Is(err, errInvalidBudgetPeriod),
+		errors.Is(err, errParentNotFound), errors.Is(err, errNestedParent), errors.Is(err, errParentImmutable),
+		errors.Is(err, errInvalidDefaults), errors.Is(err, errSystemPromptTooLong), errors.Is(err, errUnknownAPIVersion):
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_value", err.Error())
+	default:
+		log.Printf("API key store error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "key_store_error", "Failed to update the key store")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useAPIKeys installs a key store holding keys as apiKeys for the test.
+func useAPIKeys(t *testing.T, keys ...APIKey) *apiKeyStore {
+	t.Helper()
+	s := &apiKeyStore{
+		keys:    map[string]*storedAPIKey{},
+		budgets: &budgetLedger{path: t.TempDir() + "/keys.usage.json", now: time.Now, spend: map[string]*keySpend{}},
+	}
+	for _, k := range keys {
+		s.keys[k.ID] = &storedAPIKey{APIKey: k, Hash: hashAPIKey(k.ID)}
+	}
+	s.rebuild()
+	prev := apiKeys
+	apiKeys = s
+	t.Cleanup(func() { apiKeys = prev })
+	return s
+}
+
+func TestKeyPermissionsNeedTheParents(t *testing.T) {
+	s := useAPIKeys(t,
+		APIKey{ID: "team", ServerTiming: true, DryRun: true},
+		APIKey{ID: "child", ParentID: "team", ServerTiming: true},
+		APIKey{ID: "locked", ParentID: "plain", ServerTiming: true},
+		APIKey{ID: "plain"},
+	)
+	serverTiming := func(k *APIKey) bool { return k.ServerTiming }
+	for id, want := range map[string]bool{"team": true, "child": true, "locked": false, "plain": false, "unknown": false} {
+		if got := s.keyAllows(id, serverTiming); got != want {
+			t.Errorf("keyAllows(%q, server timing) = %t, want %t", id, got, want)
+		}
+	}
+	if s.keyAllows("child", func(k *APIKey) bool { return k.DryRun }) {
+		t.Error("child allowed dry runs it wasn't given")
+	}
+	if (*apiKeyStore)(nil).keyAllows("team", serverTiming) {
+		t.Error("nil store allowed server timing")
+	}
+
+	// Every permission the gateway checks follows the rule
+	useAPIKeys(t,
+		APIKey{ID: "team", DryRun: true, DataCollection: true, CanOverrideRouting: true, BypassInjectionGuard: true},
+		APIKey{ID: "child", ParentID: "team", DryRun: true, DataCollection: true, CanOverrideRouting: true, BypassInjectionGuard: true},
+		APIKey{ID: "solo", ParentID: "plain", DryRun: true, DataCollection: true, CanOverrideRouting: true, BypassInjectionGuard: true},
+		APIKey{ID: "plain"},
+	)
+	t.Setenv("DRY_RUN_KEYS", "")
+	t.Setenv("ROUTING_OVERRIDE_KEYS", "")
+	t.Setenv("INJECTION_BYPASS_KEYS", "")
+	checks := map[string]func(string) bool{
+		"dry run":          dryRunAllowed,
+		"data collection":  (&dataCollector{}).consents,
+		"routing override": routingOverrideAllowed,
+		"injection bypass": injectionBypassAllowed,
+	}
+	for name, allowed := range checks {
+		for id, want := range map[string]bool{"child": true, "solo": false} {
+			if got := allowed(id); got != want {
+				t.Errorf("%s for %s = %t, want %t", name, id, got, want)
+			}
+		}
+	}
+}
+
+func TestRequireUserIsPerKey(t *testing.T) {
+	captureLog(t)
+	useAPIKeys(t,
+		APIKey{ID: "team", RequireUser: true},
+		APIKey{ID: "child", ParentID: "team"},
+		APIKey{ID: "plain"},
+	)
+	body := `{"model":"m","messages":[{"role":"user","content":"hi"}]}`
+	for id, want := range map[string]int{"team": http.StatusBadRequest, "child": http.StatusBadRequest, "plain": http.StatusOK, "": http.StatusOK} {
+		w := chatAs(id, body)
+		if w.Code != want || (want == http.StatusBadRequest && !strings.Contains(w.Body.String(), `"missing_user"`)) {
+			t.Errorf("key %q: response = %d %s, want %d", id, w.Code, w.Body, want)
+		}
+	}
+	if w := chatAs("child", `{"model":"m","user":"u1","messages":[{"role":"user","content":"hi"}]}`); w.Code != http.StatusOK {
+		t.Errorf("with user: status = %d, want 200", w.Code)
+	}
+}
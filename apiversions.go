@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	// apiVersionHeader is how a client opts into an API version. It is
+	// not X-Gateway-Version, which responses carry the build in with
+	// VERSION_HEADER
+	apiVersionHeader = "X-API-Version"
+	// apiVersionResponseHeader names the version a request was served
+	// under
+	apiVersionResponseHeader = "X-Gateway-API-Version"
+)
+
+// Error shapes an API version can answer with.
+const (
+	// errorShapeText keeps the plain-text bodies some errors had before
+	// API versions
+	errorShapeText = "text"
+	// errorShapeJSON answers every error with an OpenAI-style error object
+	errorShapeJSON = "json"
+)
+
+// APIVersionFlags are the behaviors that differ between API versions.
+type APIVersionFlags struct {
+	// StrictRequests rejects chat completions with unknown top-level fields
+	// with 400 unknown_field; STRICT_REQUESTS and STRICT_REQUEST_KEYS still
+	// turn it on under versions without it
+	StrictRequests bool `json:"strict_requests"`
+	// ErrorShape is text or json
+	ErrorShape string `json:"error_shape"`
+	// WarnDeprecatedFields names deprecated request fields a request sets
+	// in X-Gateway-Warning, with their replacement; they still work
+	WarnDeprecatedFields bool `json:"warn_deprecated_fields"`
+}
+
+// APIVersion is a dated set of behavior flags. A released version never
+// changes; a behavior change ships as a new version clients opt into.
+type APIVersion struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Flags       APIVersionFlags `json:"flags"`
+}
+
+// apiVersions is the registry of supported versions, oldest first.
+var apiVersions = []*APIVersion{
+	{Name: "2024-06", Description: "The behavior before API versions", Flags: APIVersionFlags{ErrorShape: errorShapeText}},
+	{Name: "2024-11", Description: "Strict request checking, JSON bodies for every error, and warnings for deprecated fields",
+		Flags: APIVersionFlags{StrictRequests: true, ErrorShape: errorShapeJSON, WarnDeprecatedFields: true}},
+}
+
+// deprecatedFields maps deprecated chat completion fields to what replaces
+// them.
+var deprecatedFields = map[string]string{
+	"max_tokens": "max_completion_tokens",
+}
+
+var errUnknownAPIVersion = fmt.Errorf("api_version must be one of %s", strings.Join(apiVersionNames(), ", "))
+
+// defaultAPIVersion serves requests that name no version and whose key
+// sets none: API_VERSION_DEFAULT, or the oldest version so clients that
+// predate versions keep their behavior.
+var defaultAPIVersion = apiVersions[0]
+
+// loadAPIVersionDefault reads API_VERSION_DEFAULT.
+func loadAPIVersionDefault() error {
+	name := os.Getenv("API_VERSION_DEFAULT")
+	if name == "" {
+		return nil
+	}
+	v := lookupAPIVersion(name)
+	if v == nil {
+		return fmt.Errorf("API_VERSION_DEFAULT %q: want one of %s", name, strings.Join(apiVersionNames(), ", "))
+	}
+	defaultAPIVersion = v
+	return nil
+}
+
+func lookupAPIVersion(name string) *APIVersion {
+	for _, v := range apiVersions {
+		if v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+func apiVersionNames() []string {
+	names := make([]string, len(apiVersions))
+	for i, v := range apiVersions {
+		names[i] = v.Name
+	}
+	return names
+}
+
+// resolveAPIVersion returns the version r asks for in X-API-Version,
+// or else its key's, or else the default. It returns nil for a version
+// that isn't supported.
+func resolveAPIVersion(r *http.Request) *APIVersion {
+	if name := strings.TrimSpace(r.Header.Get(apiVersionHeader)); name != "" {
+		return lookupAPIVersion(name)
+	}
+	if v := lookupAPIVersion(apiKeys.apiVersion(identityFromContext(r.Context()).KeyID)); v != nil {
+		return v
+	}
+	return defaultAPIVersion
+}
+
+// requestAPIVersion returns the version the request in r is served under.
+// Requests the gateway makes itself, like batch lines, take their key's.
+func requestAPIVersion(r *http.Request) *APIVersion {
+	if v := recordFromContext(r.Context()).apiVersion; v != nil {
+		return v
+	}
+	if v := resolveAPIVersion(r); v != nil {
+		return v
+	}
+	return defaultAPIVersion
+}
+
+// withAPIVersion settles the version an authenticated request is served
+// under, rejecting versions that aren't supported.
+func withAPIVersion(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := resolveAPIVersion(r)
+		if v == nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "unsupported_api_version",
+				fmt.Sprintf("%s %q is not supported; supported versions are %s", apiVersionHeader, r.Header.Get(apiVersionHeader), strings.Join(apiVersionNames(), ", ")))
+			return
+		}
+		recordFromContext(r.Context()).apiVersion = v
+		w.Header().Set(apiVersionResponseHeader, v.Name)
+		next(w, r)
+	}
+}
+
+// writeVersionedError writes an error in the shape r's API version asks
+// for: as an OpenAI-style error object, or as the plain message.
+func writeVersionedError(w http.ResponseWriter, r *http.Request, status int, errType, code, message string) {
+	if requestAPIVersion(r).Flags.ErrorShape == errorShapeText {
+		http.Error(w, message, status)
+		return
+	}
+	writeJSONError(w, status, errType, code, message)
+}
+
+// warnDeprecatedFields names the deprecated fields among body's top-level
+// keys in X-Gateway-Warning, for versions that warn of them.
+func warnDeprecatedFields(w http.ResponseWriter, r *http.Request, body json.RawMessage) {
+	if !requestAPIVersion(r).Flags.WarnDeprecatedFields {
+		return
+	}
+	var top map[string]json.RawMessage
+	if json.Unmarshal(body, &top) != nil {
+		return
+	}
+	for field, replacement := range deprecatedFields {
+		if _, ok := top[field]; ok {
+			w.Header().Add("X-Gateway-Warning", fmt.Sprintf("%s is deprecated; use %s", field, replacement))
+		}
+	}
+}
+
+// apiVersionInfo is a version as GET /admin/api-versions reports it.
+type apiVersionInfo struct {
+	*APIVersion
+	Default bool `json:"default"`
+	// Changes are the flags that differ from the version before
+	Changes map[string]apiFlagChange `json:"changes"`
+}
+
+type apiFlagChange struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+// apiVersionsAdminHandler implements GET /admin/api-versions.
+func apiVersionsAdminHandler(w http.ResponseWriter, r *http.Request) {
+	out := make([]apiVersionInfo, len(apiVersions))
+	var prev map[string]any
+	for i, v := range apiVersions {
+		flags := flagValues(v.Flags)
+		changes := map[string]apiFlagChange{}
+		for name, to := range flags {
+			if from, ok := prev[name]; ok && from != to {
+				changes[name] = apiFlagChange{From: from, To: to}
+			}
+		}
+		out[i] = apiVersionInfo{APIVersion: v, Default: v == defaultAPIVersion, Changes: changes}
+		prev = flags
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"object": "list", "default": defaultAPIVersion.Name, "data": out})
+}
+
+// flagValues returns flags by their JSON names.
+func flagValues(flags APIVersionFlags) map[string]any {
+	data, _ := json.Marshal(flags)
+	var m map[string]any
+	json.Unmarshal(data, &m)
+	return m
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vinayhpandya/ai_inference_gateway/fakeback"
+)
+
+// versionedRequest is a request from key id asking for version, if any,
+// with the access log's record in its context.
+func versionedRequest(id, version, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	if version != "" {
+		r.Header.Set(apiVersionHeader, version)
+	}
+	return r.WithContext(context.WithValue(r.Context(), identityContextKey{}, identity{KeyID: id, Method: "api_key"}))
+}
+
+// chatVersioned sends body as key id under version through withAPIVersion.
+func chatVersioned(id, version, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	accessLog(withAPIVersion(chatCompletionsHandler)).ServeHTTP(w, versionedRequest(id, version, body))
+	return w
+}
+
+func TestResolveAPIVersionPrecedence(t *testing.T) {
+	useAPIKeys(t,
+		APIKey{ID: "team", APIVersion: "2024-11"},
+		APIKey{ID: "child", ParentID: "team"},
+		APIKey{ID: "pinned", ParentID: "team", APIVersion: "2024-06"},
+		APIKey{ID: "plain"},
+	)
+	tests := []struct {
+		key, header, want string
+	}{
+		{"plain", "", "2024-06"},
+		{"team", "", "2024-11"},
+		{"child", "", "2024-11"},
+		{"pinned", "", "2024-06"},
+		{"pinned", "2024-11", "2024-11"},
+		{"team", " 2024-06 ", "2024-06"},
+	}
+	for _, tt := range tests {
+		v := resolveAPIVersion(versionedRequest(tt.key, tt.header, ""))
+		if v == nil || v.Name != tt.want {
+			t.Errorf("key %q, header %q: version = %v, want %s", tt.key, tt.header, v, tt.want)
+		}
+	}
+	if v := resolveAPIVersion(versionedRequest("plain", "2023-01", "")); v != nil {
+		t.Errorf("unsupported version resolved to %s", v.Name)
+	}
+}
+
+func TestWithAPIVersion(t *testing.T) {
+	useAPIKeys(t)
+	var served *APIVersion
+	h := accessLog(withAPIVersion(func(w http.ResponseWriter, r *http.Request) { served = requestAPIVersion(r) }))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, versionedRequest("", "2024-11", ""))
+	if served == nil || served.Name != "2024-11" || w.Header().Get(apiVersionResponseHeader) != "2024-11" {
+		t.Errorf("served %v, %s = %q", served, apiVersionResponseHeader, w.Header().Get(apiVersionResponseHeader))
+	}
+
+	served = nil
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, versionedRequest("", "2030-01", ""))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"code":"unsupported_api_version"`) || served != nil {
+		t.Errorf("response = %d %s, want 400 unsupported_api_version", w.Code, w.Body)
+	}
+}
+
+func TestBuildVersionHeaderDoesNotSelectAPIVersion(t *testing.T) {
+	useAPIKeys(t)
+	r := versionedRequest("", "", "")
+	r.Header.Set("X-Gateway-Version", "2024-11")
+	if v := resolveAPIVersion(r); v != defaultAPIVersion {
+		t.Errorf("version = %s, want the default %s", v.Name, defaultAPIVersion.Name)
+	}
+	r.Header.Set("X-Gateway-Version", "v1.2.3")
+	w := httptest.NewRecorder()
+	accessLog(withAPIVersion(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("build version in the request rejected: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestStrictRequestsFlag(t *testing.T) {
+	captureLog(t)
+	useAPIKeys(t)
+	back := useFakeBackend(t)
+	body := `{"model":"m","messages":[{"role":"user","content":"hi"}],"temprature":0.2}`
+
+	w := chatVersioned("", "2024-11", body)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"code":"unknown_field"`) {
+		t.Errorf("2024-11: response = %d %s, want 400 unknown_field", w.Code, w.Body)
+	}
+
+	back.Enqueue(fakeback.Behavior{Content: "ok"})
+	if w := chatVersioned("", "2024-06", body); w.Code != http.StatusOK {
+		t.Errorf("2024-06: response = %d %s, want the unknown field let through", w.Code, w.Body)
+	}
+}
+
+func TestErrorShapeFlag(t *testing.T) {
+	captureLog(t)
+	useAPIKeys(t)
+	w := chatVersioned("", "2024-06", `{"model":`)
+	if w.Code != http.StatusBadRequest || strings.HasPrefix(w.Body.String(), "{") || !strings.Contains(w.Body.String(), "Invalid JSON") {
+		t.Errorf("2024-06: response = %d %s, want a plain-text error", w.Code, w.Body)
+	}
+	w = chatVersioned("", "2024-11", `{"model":`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"code":"invalid_json"`) {
+		t.Errorf("2024-11: response = %d %s, want a JSON error", w.Code, w.Body)
+	}
+}
+
+func TestWarnDeprecatedFieldsFlag(t *testing.T) {
+	captureLog(t)
+	useAPIKeys(t)
+	back := useFakeBackend(t)
+	body := `{"model":"m","max_tokens":5,"messages":[{"role":"user","content":"hi"}]}`
+
+	back.Enqueue(fakeback.Behavior{Content: "ok"})
+	w := chatVersioned("", "2024-11", body)
+	if got := w.Header().Get("X-Gateway-Warning"); got != "max_tokens is deprecated; use max_completion_tokens" {
+		t.Errorf("2024-11: X-Gateway-Warning = %q", got)
+	}
+
+	back.Enqueue(fakeback.Behavior{Content: "ok"})
+	w = chatVersioned("", "2024-06", body)
+	if got := w.Header().Get("X-Gateway-Warning"); got != "" {
+		t.Errorf("2024-06: X-Gateway-Warning = %q, want none", got)
+	}
+}
+
+func TestLoadAPIVersionDefault(t *testing.T) {
+	prev := defaultAPIVersion
+	t.Cleanup(func() { defaultAPIVersion = prev })
+
+	t.Setenv("API_VERSION_DEFAULT", "2024-11")
+	if err := loadAPIVersionDefault(); err != nil || defaultAPIVersion.Name != "2024-11" {
+		t.Errorf("default = %s, %v", defaultAPIVersion.Name, err)
+	}
+	t.Setenv("API_VERSION_DEFAULT", "latest")
+	if err := loadAPIVersionDefault(); err == nil {
+		t.Error("API_VERSION_DEFAULT=latest accepted")
+	}
+	if defaultAPIVersion.Name != "2024-11" {
+		t.Errorf("rejected default changed it to %s", defaultAPIVersion.Name)
+	}
+}
+
+func TestKeyAPIVersionMustBeSupported(t *testing.T) {
+	var k APIKey
+	bad, good, clear := "2030-01", "2024-11", ""
+	if err := applyKeyRequest(apiKeyRequest{APIVersion: &bad}, &k); err != errUnknownAPIVersion {
+		t.Errorf("unknown version: err = %v", err)
+	}
+	if err := applyKeyRequest(apiKeyRequest{APIVersion: &good}, &k); err != nil || k.APIVersion != good {
+		t.Errorf("known version: %q, %v", k.APIVersion, err)
+	}
+	if err := applyKeyRequest(apiKeyRequest{APIVersion: &clear}, &k); err != nil || k.APIVersion != "" {
+		t.Errorf("clearing: %q, %v", k.APIVersion, err)
+	}
+}
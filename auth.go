@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// identity is the authenticated caller a request is attributed to.
+type identity struct {
+	KeyID  string
+	Method string
+}
+
+type identityContextKey struct{}
+
+// identityFromContext returns the caller identity, or the zero value when
+// the request was not authenticated.
+func identityFromContext(ctx context.Context) identity {
+	id, _ := ctx.Value(identityContextKey{}).(identity)
+	return id
+}
+
+// hmacAuth verifies requests signed with a shared secret. The caller sends:
+//
+//	X-Key-ID:    key identifier
+//	X-Timestamp: unix seconds
+//	X-Signature: sha256=<hex(HMAC-SHA256(secret, timestamp + "." + body))>
+//
+// A signature is accepted once: the same signed request sent again while
+// its timestamp is within the skew is a replay.
+type hmacAuth struct {
+	secrets map[string][]byte
+	maxSkew time.Duration
+	// maxBody bounds the body read to check a signature
+	maxBody int64
+	now     func() time.Time
+
+	mu sync.Mutex
+	// seen holds the signatures accepted, by key ID and signature, until
+	// their timestamp leaves the skew
+	seen      map[string]time.Time
+	maxSeen   int
+	lastSweep time.Time
+}
+
+// defaultHMACMaxBody is large enough for a signed file upload.
+const defaultHMACMaxBody = maxBatchFileBytes + 1<<20
+
+const defaultHMACReplayCache = 100000
+
+var (
+	errSignatureReplayed = errors.New("signature already used")
+	errReplayCacheFull   = errors.New("replay cache full")
+)
+
+// loadHMACAuth reads HMAC_KEYS ("id:secret,id2:secret2"), HMAC_MAX_SKEW,
+// HMAC_MAX_BODY_BYTES and HMAC_REPLAY_CACHE. It returns nil when HMAC auth
+// is not configured.
+func loadHMACAuth() (*hmacAuth, error) {
+	raw := os.Getenv("HMAC_KEYS")
+	if raw == "" {
+		return nil, nil
+	}
+
+	a := &hmacAuth{
+		secrets: make(map[string][]byte),
+		maxSkew: 5 * time.Minute,
+		maxBody: defaultHMACMaxBody,
+		now:     time.Now,
+		seen:    make(map[string]time.Time),
+		maxSeen: defaultHMACReplayCache,
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		id, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("invalid HMAC_KEYS entry %q", pair)
+		}
+		a.secrets[id] = []byte(secret)
+	}
+
+	if v := os.Getenv("HMAC_MAX_SKEW"); v != "" {
+		skew, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HMAC_MAX_SKEW: %w", err)
+		}
+		a.maxSkew = skew
+	}
+	maxBody, err := envInt("HMAC_MAX_BODY_BYTES")
+	if err != nil {
+		return nil, err
+	}
+	if maxBody > 0 {
+		a.maxBody = int64(maxBody)
+	}
+	maxSeen, err := envInt("HMAC_REPLAY_CACHE")
+	if err != nil {
+		return nil, err
+	}
+	if maxSeen > 0 {
+		a.maxSeen = maxSeen
+	}
+	return a, nil
+}
+
+// verify checks the signature headers against the body and returns the key ID.
+func (a *hmacAuth) verify(header http.Header, body []byte) (string, error) {
+	keyID := header.Get("X-Key-ID")
+	secret, ok := a.secrets[keyID]
+	if !ok {
+		return "", fmt.Errorf("unknown key")
+	}
+
+	timestamp := header.Get("X-Timestamp")
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid timestamp")
+	}
+	skew := a.now().Sub(time.Unix(unix, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > a.maxSkew {
+		return "", fmt.Errorf("stale timestamp")
+	}
+
+	sig, ok := strings.CutPrefix(header.Get("X-Signature"), "sha256=")
+	if !ok {
+		return "", fmt.Errorf("missing signature")
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return "", fmt.Errorf("malformed signature")
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return "", fmt.Errorf("signature mismatch")
+	}
+	// Keyed on the decoded MAC: hex decoding ignores case, so the header
+	// string can be re-cased into a replay the cache hasn't seen
+	if err := a.remember(keyID+":"+hex.EncodeToString(got), time.Unix(unix, 0).Add(a.maxSkew)); err != nil {
+		return "", err
+	}
+	return keyID, nil
+}
+
+// remember records a signature as used until expires, failing when it
+// already was. When the cache is full of signatures still in the skew,
+// requests are refused rather than letting a replay through.
+func (a *hmacAuth) remember(sig string, expires time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	if until, ok := a.seen[sig]; ok && now.Before(until) {
+		return errSignatureReplayed
+	}
+	if len(a.seen) >= a.maxSeen || now.Sub(a.lastSweep) > a.maxSkew {
+		for s, until := range a.seen {
+			if !now.Before(until) {
+				delete(a.seen, s)
+			}
+		}
+		a.lastSweep = now
+	}
+	if len(a.seen) >= a.maxSeen {
+		return errReplayCacheFull
+	}
+	a.seen[sig] = expires
+	return nil
+}
+
+// requireAuth wraps a handler with the configured authentication: a bearer
+// key from the API key store, or an HMAC signature. When neither is
+// configured requests pass through anonymously.
+func requireAuth(a *hmacAuth, next http.HandlerFunc) http.HandlerFunc {
+	next = withAPIVersion(next)
+	if a == nil && apiKeys == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && apiKeys != nil {
+			key, ok := apiKeys.authenticate(token)
+			if !ok {
+				log.Printf("API key auth rejected key with prefix %q", truncateForLog(token[:min(len(token), len(apiKeyPrefix)+8)]))
+				writeVersionedError(w, r, http.StatusUnauthorized, "authentication_error", "invalid_api_key", "Unauthorized")
+				return
+			}
+			ctx := context.WithValue(r.Context(), identityContextKey{}, identity{KeyID: key.ID, Method: "api_key"})
+			next(w, r.WithContext(ctx))
+			return
+		}
+		if a == nil {
+			writeVersionedError(w, r, http.StatusUnauthorized, "authentication_error", "invalid_api_key", "Unauthorized")
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, a.maxBody))
+		var tooLarge *http.MaxBytesError
+		switch {
+		case rejectOverLimit(w, err):
+			return
+		case errors.As(err, &tooLarge):
+			writeVersionedError(w, r, http.StatusRequestEntityTooLarge, "invalid_request_error", "request_too_large",
+				fmt.Sprintf("Signed request bodies are limited to %d bytes", a.maxBody))
+			return
+		case err != nil:
+			writeVersionedError(w, r, http.StatusBadRequest, "invalid_request_error", "invalid_body", "Failed to read request body")
+			return
+		}
+
+		keyID, err := a.verify(r.Header, body)
+		if errors.Is(err, errReplayCacheFull) {
+			log.Printf("HMAC auth refused key %q: %v", r.Header.Get("X-Key-ID"), err)
+			writeVersionedError(w, r, http.StatusServiceUnavailable, "server_error", "replay_cache_full", "Too many signed requests; retry shortly")
+			return
+		}
+		if err != nil {
+			log.Printf("HMAC auth rejected key %q: %v", r.Header.Get("X-Key-ID"), err)
+			writeVersionedError(w, r, http.StatusUnauthorized, "authentication_error", "invalid_api_key", "Unauthorized")
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		ctx := context.WithValue(r.Context(), identityContextKey{}, identity{KeyID: keyID, Method: "hmac"})
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// requireAdmin guards admin endpoints with the ADMIN_TOKEN bearer token.
+// Admin endpoints are disabled entirely when ADMIN_TOKEN is unset.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	token := os.Getenv("ADMIN_TOKEN")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !hmac.Equal([]byte(got), []byte(token)) {
+			writeVersionedError(w, r, http.StatusUnauthorized, "authentication_error", "invalid_api_key", "Unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testHMACNow = time.Unix(1_700_000_000, 0)
+
+func testHMACAuth() *hmacAuth {
+	return &hmacAuth{
+		secrets: map[string][]byte{"svc": []byte("s3cret")},
+		maxSkew: 5 * time.Minute,
+		maxBody: 1 << 10,
+		now:     func() time.Time { return testHMACNow },
+		seen:    map[string]time.Time{},
+		maxSeen: 10,
+	}
+}
+
+// signedRequest builds a request to the gateway signed as key id with
+// secret at ts.
+func signedRequest(id, secret string, ts time.Time, body string) *http.Request {
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + body))
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	r.Header.Set("X-Key-ID", id)
+	r.Header.Set("X-Timestamp", timestamp)
+	r.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+// serveSigned runs r through requireAuth and returns the response, and the
+// body and key ID the handler saw when it was reached.
+func serveSigned(a *hmacAuth, r *http.Request) (*httptest.ResponseRecorder, string, string) {
+	var gotBody, gotKey string
+	h := requireAuth(a, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		gotBody, gotKey = string(b), identityFromContext(r.Context()).KeyID
+	})
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w, gotBody, gotKey
+}
+
+func TestHMACAuthAcceptsValidSignature(t *testing.T) {
+	body := `{"model":"m","messages":[]}`
+	w, got, key := serveSigned(testHMACAuth(), signedRequest("svc", "s3cret", testHMACNow, body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if got != body || key != "svc" {
+		t.Errorf("handler saw body %q, key %q; want the signed body and svc", got, key)
+	}
+}
+
+func TestHMACAuthRejectsBadSignatures(t *testing.T) {
+	tests := []struct {
+		name string
+		r    *http.Request
+	}{
+		{"wrong secret", signedRequest("svc", "other", testHMACNow, "{}")},
+		{"unknown key", signedRequest("nobody", "s3cret", testHMACNow, "{}")},
+		{"tampered body", func() *http.Request {
+			r := signedRequest("svc", "s3cret", testHMACNow, "{}")
+			r.Body = io.NopCloser(strings.NewReader(`{"x":1}`))
+			return r
+		}()},
+		{"missing signature", func() *http.Request {
+			r := signedRequest("svc", "s3cret", testHMACNow, "{}")
+			r.Header.Del("X-Signature")
+			return r
+		}()},
+		{"stale timestamp", signedRequest("svc", "s3cret", testHMACNow.Add(-6*time.Minute), "{}")},
+		{"future timestamp", signedRequest("svc", "s3cret", testHMACNow.Add(6*time.Minute), "{}")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w, _, _ := serveSigned(testHMACAuth(), tt.r); w.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d, want 401", w.Code)
+			}
+		})
+	}
+}
+
+func TestHMACAuthAllowsSkewWithinLimit(t *testing.T) {
+	for _, off := range []time.Duration{-4 * time.Minute, 4 * time.Minute} {
+		if w, _, _ := serveSigned(testHMACAuth(), signedRequest("svc", "s3cret", testHMACNow.Add(off), "{}")); w.Code != http.StatusOK {
+			t.Errorf("skew %v: status = %d, want 200", off, w.Code)
+		}
+	}
+}
+
+func TestHMACAuthRejectsReplay(t *testing.T) {
+	a := testHMACAuth()
+	first := signedRequest("svc", "s3cret", testHMACNow, "{}")
+	sig := strings.TrimPrefix(first.Header.Get("X-Signature"), "sha256=")
+	if w, _, _ := serveSigned(a, first); w.Code != http.StatusOK {
+		t.Fatalf("first request: status = %d, want 200", w.Code)
+	}
+	if w, _, _ := serveSigned(a, signedRequest("svc", "s3cret", testHMACNow, "{}")); w.Code != http.StatusUnauthorized {
+		t.Errorf("replay: status = %d, want 401", w.Code)
+	}
+	// Hex decoding ignores case, so a re-cased signature is the same one
+	recased := signedRequest("svc", "s3cret", testHMACNow, "{}")
+	recased.Header.Set("X-Signature", "sha256="+strings.ToUpper(sig))
+	if w, _, _ := serveSigned(a, recased); w.Code != http.StatusUnauthorized {
+		t.Errorf("replay with an upper-cased signature: status = %d, want 401", w.Code)
+	}
+	// A different body signs differently
+	if w, _, _ := serveSigned(a, signedRequest("svc", "s3cret", testHMACNow, "{ }")); w.Code != http.StatusOK {
+		t.Errorf("new request: status = %d, want 200", w.Code)
+	}
+
+	// Once the timestamp is past the skew the signature is forgotten, and
+	// would be refused as stale anyway
+	a.now = func() time.Time { return testHMACNow.Add(6 * time.Minute) }
+	if w, _, _ := serveSigned(a, signedRequest("svc", "s3cret", testHMACNow.Add(6*time.Minute), "[]")); w.Code != http.StatusOK {
+		t.Fatalf("later request: status = %d, want 200", w.Code)
+	}
+	if _, ok := a.seen["svc:"+sig]; ok {
+		t.Error("expired signature still cached")
+	}
+}
+
+func TestHMACAuthRefusesWhenReplayCacheFull(t *testing.T) {
+	a := testHMACAuth()
+	a.maxSeen = 2
+	for i, body := range []string{"1", "2", "3"} {
+		w, _, _ := serveSigned(a, signedRequest("svc", "s3cret", testHMACNow, body))
+		want := http.StatusOK
+		if i == 2 {
+			want = http.StatusServiceUnavailable
+		}
+		if w.Code != want {
+			t.Errorf("request %d: status = %d, want %d", i, w.Code, want)
+		}
+	}
+}
+
+func TestHMACAuthBoundsBody(t *testing.T) {
+	body := strings.Repeat("x", 2<<10)
+	w, _, _ := serveSigned(testHMACAuth(), signedRequest("svc", "s3cret", testHMACNow, body))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", w.Code)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Gateway error taxonomy. Backend failures of every provider are reported
+// to clients with one of these as error.type and error.code; the provider's
+// own status, type, code and message are kept under error.upstream.
+const (
+	errInvalidRequest     = "invalid_request"
+	errAuth               = "auth"
+	errRateLimited        = "rate_limited"
+	errContextLength      = "context_length"
+	errContentFilter      = "content_filter"
+	errBackendUnavailable = "backend_unavailable"
+	errProxyUnavailable   = "proxy_unavailable"
+	errTimeout            = "timeout"
+	errInternal           = "internal"
+)
+
+// taxonomyStatus is the status returned to clients for each category. Auth
+// failures against a backend are the gateway's misconfiguration, not the
+// caller's, so they surface as 502.
+var taxonomyStatus = map[string]int{
+	errInvalidRequest:     http.StatusBadRequest,
+	errAuth:               http.StatusBadGateway,
+	errRateLimited:        http.StatusTooManyRequests,
+	errContextLength:      http.StatusBadRequest,
+	errContentFilter:      http.StatusBadRequest,
+	errBackendUnavailable: http.StatusBadGateway,
+	errProxyUnavailable:   http.StatusBadGateway,
+	errTimeout:            http.StatusGatewayTimeout,
+	errInternal:           http.StatusInternalServerError,
+}
+
+// backendErrors counts backend failures returned to clients, by category.
+var backendErrors = expvar.NewMap("gateway_backend_errors_total")
+
+// upstreamError is a provider error as the provider reported it.
+type upstreamError struct {
+	Status  int    `json:"status,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// backendErrorResponse is the body for normalized backend errors.
+type backendErrorResponse struct {
+	Error struct {
+		Message  string         `json:"message"`
+		Type     string         `json:"type"`
+		Code     string         `json:"code"`
+		Backend  string         `json:"backend,omitempty"`
+		Upstream *upstreamError `json:"upstream,omitempty"`
+	} `json:"error"`
+}
+
+// classifyStatus is the fallback mapping from an upstream HTTP status.
+func classifyStatus(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return errAuth
+	case status == http.StatusTooManyRequests:
+		return errRateLimited
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		return errTimeout
+	case status == http.StatusRequestEntityTooLarge:
+		return errContextLength
+	case status >= 500:
+		return errBackendUnavailable
+	default:
+		return errInvalidRequest
+	}
+}
+
+// isContextLengthMessage recognizes context overflows that providers only
+// report as generic validation errors.
+func isContextLengthMessage(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, s := range []string{
+		"maximum context length",               // OpenAI, vLLM
+		"context length",                       // vLLM
+		"input is too long",                    // Bedrock
+		"too many input tokens",                // Bedrock
+		"`max_new_tokens` must be <=",          // TGI
+		"exceeds the maximum number of tokens", // Gemini
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeBackendError reports a failed backend call to the client in the
+// gateway taxonomy. Rate limits carry the backend's Retry-After.
+//
+// Outside ERROR_DETAIL=verbose, clients learn the backend's logical name
+// at most: transport errors, which name the endpoint, are replaced by a
+// summary and logged in full, and endpoints in upstream messages are
+// replaced by the backend name.
+func writeBackendError(w http.ResponseWriter, err error, backend *Backend) {
+	var body backendErrorResponse
+	detail := errorDetail()
+	if detail != detailNone {
+		body.Error.Backend = backend.Name
+	}
+
+	var statusErr *backendStatusError
+	var proxyErr *proxyError
+	switch {
+	case errors.As(err, &proxyErr):
+		body.Error.Type = errProxyUnavailable
+	case errors.As(err, &statusErr):
+		upstream := adapterFor(backend).parseError(statusErr.StatusCode, statusErr.Header, []byte(statusErr.Body))
+		body.Error.Type = upstream.category
+		body.Error.Upstream = &upstream.upstreamError
+		body.Error.Message = upstream.Message
+		if statusErr.StatusCode == http.StatusTooManyRequests {
+			backendRateLimited.Add(backend.Name, 1)
+			if delay, ok := backendRetryAfter(statusErr.Header); ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			}
+		}
+	case errors.Is(err, context.DeadlineExceeded):
+		body.Error.Type = errTimeout
+	default:
+		body.Error.Type = errBackendUnavailable
+	}
+	if body.Error.Message == "" {
+		body.Error.Message = "Backend error: " + err.Error()
+		if detail != detailVerbose {
+			requestID := w.Header().Get("X-Request-ID")
+			log.Printf("Backend %s error for request %s: %v", backend.Name, requestID, err)
+			summary := "The backend is unavailable"
+			switch {
+			case statusErr != nil:
+				summary = fmt.Sprintf("The backend returned status %d", statusErr.StatusCode)
+			case body.Error.Type == errTimeout:
+				summary = "The backend timed out"
+			case proxyErr != nil:
+				summary = "The outbound proxy to the backend is unavailable"
+			}
+			body.Error.Message = withheldDetail(summary, requestID)
+		}
+	}
+	// A backend echoing the gateway's credentials mustn't pass them on, nor
+	// an error page the internal endpoints it came from
+	body.Error.Message = scrubTopology(redactor.redactString(body.Error.Message), backend)
+	if body.Error.Upstream != nil {
+		body.Error.Upstream.Message = scrubTopology(redactor.redactString(body.Error.Upstream.Message), backend)
+	}
+	body.Error.Code = body.Error.Type
+	backendErrors.Add(body.Error.Type, 1)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(taxonomyStatus[body.Error.Type])
+	json.NewEncoder(w).Encode(body)
+}
+
+// classifiedError is an upstream error with its taxonomy category.
+type classifiedError struct {
+	upstreamError
+	category string
+}
+
+// classify picks the category for u from a provider's table of type/code
+// values, falling back to the HTTP status. Providers report context
+// overflows as generic validation errors, so those are refined by message.
+// Messages are cut to BACKEND_ERROR_EXCERPT_BYTES before reaching clients.
+func classify(u upstreamError, table map[string]string) classifiedError {
+	u.Message = truncateExcerpt(u.Message, errorExcerptLimit())
+	c := classifiedError{upstreamError: u, category: classifyStatus(u.Status)}
+	for _, key := range []string{u.Code, u.Type} {
+		if category, ok := table[key]; ok && key != "" {
+			c.category = category
+			break
+		}
+	}
+	if c.category == errInvalidRequest && isContextLengthMessage(u.Message) {
+		c.category = errContextLength
+	}
+	return c
+}
+
+// jsonString reads a JSON value that providers send as either a string or
+// a number (vLLM's code is the HTTP status).
+func jsonString(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	return strings.Trim(string(raw), `"`)
+}
+
+// openaiErrorTable maps OpenAI and vLLM error codes and types.
+var openaiErrorTable = map[string]string{
+	"context_length_exceeded":  errContextLength,
+	"string_above_max_length":  errContextLength,
+	"content_filter":           errContentFilter,
+	"content_policy_violation": errContentFilter,
+	"invalid_api_key":          errAuth,
+	"authentication_error":     errAuth,
+	"permission_error":         errAuth,
+	"insufficient_quota":       errRateLimited,
+	"rate_limit_exceeded":      errRateLimited,
+	"server_error":             errBackendUnavailable,
+	"service_unavailable":      errBackendUnavailable,
+	"invalid_request_error":    errInvalidRequest,
+	"BadRequestError":          errInvalidRequest,
+	"NotFoundError":            errInvalidRequest,
+	"InternalServerError":      errBackendUnavailable,
+}
+
+func (openaiAdapter) parseError(status int, header http.Header, body []byte) classifiedError {
+	var resp struct {
+		Error *struct {
+			Message string          `json:"message"`
+			Type    string          `json:"type"`
+			Code    json.RawMessage `json:"code"`
+		} `json:"error"`
+		// vLLM puts the fields at the top level
+		Message string          `json:"message"`
+		Type    string          `json:"type"`
+		Code    json.RawMessage `json:"code"`
+	}
+	u := upstreamError{Status: status}
+	if json.Unmarshal(body, &resp) == nil {
+		if e := resp.Error; e != nil {
+			u.Message, u.Type, u.Code = e.Message, e.Type, jsonString(e.Code)
+		} else {
+			u.Message, u.Type, u.Code = resp.Message, resp.Type, jsonString(resp.Code)
+		}
+	} else {
+		u.Message = describeErrorBody(header, body)
+	}
+	return classify(u, openaiErrorTable)
+}
+
+// geminiErrorTable maps google.rpc status names.
+var geminiErrorTable = map[string]string{
+	"INVALID_ARGUMENT":    errInvalidRequest,
+	"FAILED_PRECONDITION": errInvalidRequest,
+	"NOT_FOUND":           errInvalidRequest,
+	"UNAUTHENTICATED":     errAuth,
+	"PERMISSION_DENIED":   errAuth,
+	"RESOURCE_EXHAUSTED":  errRateLimited,
+	"DEADLINE_EXCEEDED":   errTimeout,
+	"UNAVAILABLE":         errBackendUnavailable,
+	"INTERNAL":            errBackendUnavailable,
+}
+
+func (geminiAdapter) parseError(status int, header http.Header, body []byte) classifiedError {
+	var resp struct {
+		Error struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+		} `json:"error"`
+	}
+	u := upstreamError{Status: status}
+	if json.Unmarshal(body, &resp) == nil {
+		u.Message, u.Code = resp.Error.Message, resp.Error.Status
+	} else {
+		u.Message = describeErrorBody(header, body)
+	}
+	return classify(u, geminiErrorTable)
+}
+
+// bedrockErrorTable maps x-amzn-ErrorType exception names.
+var bedrockErrorTable = map[string]string{
+	"ValidationException":           errInvalidRequest,
+	"ResourceNotFoundException":     errInvalidRequest,
+	"AccessDeniedException":         errAuth,
+	"UnrecognizedClientException":   errAuth,
+	"ExpiredTokenException":         errAuth,
+	"ThrottlingException":           errRateLimited,
+	"ServiceQuotaExceededException": errRateLimited,
+	"ModelTimeoutException":         errTimeout,
+	"ModelNotReadyException":        errBackendUnavailable,
+	"ServiceUnavailableException":   errBackendUnavailable,
+	"InternalServerException":       errBackendUnavailable,
+	"ModelErrorException":           errBackendUnavailable,
+}
+
+func (bedrockAdapter) parseError(status int, header http.Header, body []byte) classifiedError {
+	var resp struct {
+		Message string `json:"message"`
+	}
+	u := upstreamError{Status: status}
+	if json.Unmarshal(body, &resp) == nil {
+		u.Message = resp.Message
+	} else {
+		u.Message = describeErrorBody(header, body)
+	}
+	// x-amzn-ErrorType is "Name:namespace-url"; older responses carry the
+	// name in the body as __type instead
+	u.Type, _, _ = strings.Cut(header.Get("X-Amzn-Errortype"), ":")
+	if u.Type == "" {
+		var typed struct {
+			Type string `json:"__type"`
+		}
+		json.Unmarshal(body, &typed)
+		u.Type = typed.Type[strings.LastIndex(typed.Type, "#")+1:]
+	}
+	return classify(u, bedrockErrorTable)
+}
+
+// tgiErrorTable maps TGI error_type values.
+var tgiErrorTable = map[string]string{
+	"validation":            errInvalidRequest,
+	"overloaded":            errRateLimited,
+	"generation":            errInternal,
+	"incomplete_generation": errInternal,
+}
+
+func (tgiAdapter) parseError(status int, header http.Header, body []byte) classifiedError {
+	var resp struct {
+		Error     string `json:"error"`
+		ErrorType string `json:"error_type"`
+	}
+	u := upstreamError{Status: status}
+	if json.Unmarshal(body, &resp) == nil {
+		u.Message, u.Type = resp.Error, resp.ErrorType
+	} else {
+		u.Message = describeErrorBody(header, body)
+	}
+	return classify(u, tgiErrorTable)
+}
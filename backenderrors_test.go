@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Representative error payloads, as each provider sends them.
+func TestParseBackendErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		backend  string
+		status   int
+		header   http.Header
+		body     string
+		category string
+		upstream upstreamError
+	}{
+		{"openai context length", "openai", 400, nil,
+			`{"error":{"message":"This model's maximum context length is 8192 tokens. However, your messages resulted in 9000 tokens.","type":"invalid_request_error","param":"messages","code":"context_length_exceeded"}}`,
+			errContextLength, upstreamError{Status: 400, Type: "invalid_request_error", Code: "context_length_exceeded", Message: "This model's maximum context length is 8192 tokens. However, your messages resulted in 9000 tokens."}},
+		{"openai rate limit", "openai", 429, nil,
+			`{"error":{"message":"Rate limit reached for gpt-4o in organization org-x on tokens per min (TPM): Limit 30000, Used 30000, Requested 500.","type":"tokens","param":null,"code":"rate_limit_exceeded"}}`,
+			errRateLimited, upstreamError{Status: 429, Type: "tokens", Code: "rate_limit_exceeded", Message: "Rate limit reached for gpt-4o in organization org-x on tokens per min (TPM): Limit 30000, Used 30000, Requested 500."}},
+		{"openai bad key", "openai", 401, nil,
+			`{"error":{"message":"Incorrect API key provided: sk-abc.","type":"invalid_request_error","param":null,"code":"invalid_api_key"}}`,
+			errAuth, upstreamError{Status: 401, Type: "invalid_request_error", Code: "invalid_api_key", Message: "Incorrect API key provided: sk-abc."}},
+		{"openai content filter", "openai", 400, nil,
+			`{"error":{"message":"Your request was rejected as a result of our safety system.","type":"invalid_request_error","param":null,"code":"content_policy_violation"}}`,
+			errContentFilter, upstreamError{Status: 400, Type: "invalid_request_error", Code: "content_policy_violation", Message: "Your request was rejected as a result of our safety system."}},
+		{"vllm context length", "vllm", 400, nil,
+			`{"object":"error","message":"This model's maximum context length is 4096 tokens. However, you requested 5000 tokens (4000 in the messages, 1000 in the completion).","type":"BadRequestError","param":null,"code":400}`,
+			errContextLength, upstreamError{Status: 400, Type: "BadRequestError", Code: "400", Message: "This model's maximum context length is 4096 tokens. However, you requested 5000 tokens (4000 in the messages, 1000 in the completion)."}},
+		{"vllm unknown model", "vllm", 404, nil,
+			`{"object":"error","message":"The model ` + "`llama`" + ` does not exist.","type":"NotFoundError","param":null,"code":404}`,
+			errInvalidRequest, upstreamError{Status: 404, Type: "NotFoundError", Code: "404", Message: "The model `llama` does not exist."}},
+		{"gemini quota", "gemini", 429, nil,
+			`{"error":{"code":429,"message":"Resource has been exhausted (e.g. check quota).","status":"RESOURCE_EXHAUSTED"}}`,
+			errRateLimited, upstreamError{Status: 429, Code: "RESOURCE_EXHAUSTED", Message: "Resource has been exhausted (e.g. check quota)."}},
+		{"gemini too long", "gemini", 400, nil,
+			`{"error":{"code":400,"message":"The input token count (40000) exceeds the maximum number of tokens allowed (32768).","status":"INVALID_ARGUMENT"}}`,
+			errContextLength, upstreamError{Status: 400, Code: "INVALID_ARGUMENT", Message: "The input token count (40000) exceeds the maximum number of tokens allowed (32768)."}},
+		{"gemini bad key", "gemini", 403, nil,
+			`{"error":{"code":403,"message":"Method doesn't allow unregistered callers.","status":"PERMISSION_DENIED"}}`,
+			errAuth, upstreamError{Status: 403, Code: "PERMISSION_DENIED", Message: "Method doesn't allow unregistered callers."}},
+		{"bedrock throttled", "bedrock", 429, http.Header{"X-Amzn-Errortype": {"ThrottlingException:http://internal.amazon.com/coral/com.amazon.bedrock/"}},
+			`{"message":"Too many requests, please wait before trying again."}`,
+			errRateLimited, upstreamError{Status: 429, Type: "ThrottlingException", Message: "Too many requests, please wait before trying again."}},
+		{"bedrock too long", "bedrock", 400, http.Header{"X-Amzn-Errortype": {"ValidationException:http://internal.amazon.com/coral/com.amazon.bedrock/"}},
+			`{"message":"Input is too long for requested model."}`,
+			errContextLength, upstreamError{Status: 400, Type: "ValidationException", Message: "Input is too long for requested model."}},
+		{"bedrock typed body", "bedrock", 403, nil,
+			`{"__type":"com.amazon.coral.service#AccessDeniedException","message":"You don't have access to the model with the specified model ID."}`,
+			errAuth, upstreamError{Status: 403, Type: "AccessDeniedException", Message: "You don't have access to the model with the specified model ID."}},
+		{"bedrock model timeout", "bedrock", 408, http.Header{"X-Amzn-Errortype": {"ModelTimeoutException"}},
+			`{"message":"Model has timed out in processing the request."}`,
+			errTimeout, upstreamError{Status: 408, Type: "ModelTimeoutException", Message: "Model has timed out in processing the request."}},
+		{"tgi validation", "tgi", 422, nil,
+			`{"error":"Input validation error: ` + "`inputs` tokens + `max_new_tokens` must be <= 4096" + `. Given: 4000 ` + "`inputs`" + ` tokens and 200 ` + "`max_new_tokens`" + `","error_type":"validation"}`,
+			errContextLength, upstreamError{Status: 422, Type: "validation", Message: "Input validation error: `inputs` tokens + `max_new_tokens` must be <= 4096. Given: 4000 `inputs` tokens and 200 `max_new_tokens`"}},
+		{"tgi overloaded", "tgi", 429, nil,
+			`{"error":"Model is overloaded","error_type":"overloaded"}`,
+			errRateLimited, upstreamError{Status: 429, Type: "overloaded", Message: "Model is overloaded"}},
+		{"tgi generation", "tgi", 500, nil,
+			`{"error":"Request failed during generation: Server error: CUDA out of memory","error_type":"generation"}`,
+			errInternal, upstreamError{Status: 500, Type: "generation", Message: "Request failed during generation: Server error: CUDA out of memory"}},
+		{"proxy html", "openai", 503, http.Header{"Content-Type": {"text/html"}},
+			`<html><body><h1>503 Service Temporarily Unavailable</h1></body></html>`,
+			errBackendUnavailable, upstreamError{Status: 503, Message: "503 Service Temporarily Unavailable"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := tt.header
+			if header == nil {
+				header = http.Header{}
+			}
+			got := adapterFor(&Backend{Type: tt.backend}).parseError(tt.status, header, []byte(tt.body))
+			if got.category != tt.category || got.upstreamError != tt.upstream {
+				t.Errorf("parsed %s %+v\nwant %s %+v", got.category, got.upstreamError, tt.category, tt.upstream)
+			}
+		})
+	}
+}
+
+func TestClassifyStatusFallback(t *testing.T) {
+	for status, want := range map[int]string{
+		400: errInvalidRequest, 401: errAuth, 403: errAuth, 404: errInvalidRequest, 408: errTimeout,
+		413: errContextLength, 429: errRateLimited, 500: errBackendUnavailable, 503: errBackendUnavailable, 504: errTimeout,
+	} {
+		if got := classify(upstreamError{Status: status}, nil).category; got != want {
+			t.Errorf("status %d: %s, want %s", status, got, want)
+		}
+	}
+}
+
+func TestWriteBackendError(t *testing.T) {
+	captureLog(t)
+	backend := &Backend{Name: "primary", Type: "openai", URL: "http://10.0.0.5:8000"}
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"upstream", &backendStatusError{StatusCode: 429, Header: http.Header{"Retry-After": {"7"}},
+			Body: `{"error":{"message":"Rate limit reached","type":"requests","code":"rate_limit_exceeded"}}`}, 429, errRateLimited},
+		{"auth", &backendStatusError{StatusCode: 401, Header: http.Header{}, Body: `{"error":{"message":"bad key","code":"invalid_api_key"}}`}, 502, errAuth},
+		{"timeout", fmt.Errorf("request failed: %w", context.DeadlineExceeded), 504, errTimeout},
+		{"refused", errors.New("dial tcp 10.0.0.5:8000: connect: connection refused"), 502, errBackendUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := expvarInt(backendErrors, tt.code)
+			w := httptest.NewRecorder()
+			writeBackendError(w, tt.err, backend)
+			var body backendErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != tt.status || body.Error.Type != tt.code || body.Error.Code != tt.code || body.Error.Backend != "primary" {
+				t.Errorf("response = %d %s, want %d %s", w.Code, w.Body, tt.status, tt.code)
+			}
+			if strings.Contains(w.Body.String(), "10.0.0.5") {
+				t.Errorf("response names the endpoint: %s", w.Body)
+			}
+			if got := expvarInt(backendErrors, tt.code); got != before+1 {
+				t.Errorf("gateway_backend_errors_total[%s] went from %d to %d", tt.code, before, got)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	writeBackendError(w, tests[0].err, backend)
+	var body backendErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Header().Get("Retry-After") != "7" || body.Error.Upstream == nil ||
+		*body.Error.Upstream != (upstreamError{Status: 429, Type: "requests", Code: "rate_limit_exceeded", Message: "Rate limit reached"}) {
+		t.Errorf("rate limited: Retry-After %q, upstream %+v", w.Header().Get("Retry-After"), body.Error.Upstream)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultQueueTimeout = 30 * time.Second
+
+// queueRejected counts requests a backend queue turned away, by backend.
+var queueRejected = expvar.NewMap("gateway_backend_queue_rejected_total")
+
+var (
+	errQueueFull    = errors.New("backend queue is full")
+	errQueueTimeout = errors.New("timed out in backend queue")
+)
+
+// BackendQueue caps the requests the gateway has open to a backend and
+// queues the rest in order, so callers of a saturated backend are told
+// where they stand rather than piling onto it:
+//
+//	"queue": {"max_concurrent": 8, "max_depth": 32, "timeout": "30s"}
+type BackendQueue struct {
+	MaxConcurrent int `json:"max_concurrent"`
+	// MaxDepth caps how many requests wait (default 4 × MaxConcurrent);
+	// requests beyond it are rejected at once
+	MaxDepth int `json:"max_depth,omitempty"`
+	// Timeout is how long a request waits for a slot (default 30s)
+	Timeout string `json:"timeout,omitempty"`
+	// Reservations hold slots for keys, by key ID. A key that is the
+	// parent of others reserves them for its children too
+	Reservations map[string]QueueReservation `json:"reservations,omitempty"`
+
+	timeout  time.Duration
+	reserved int
+}
+
+// QueueReservation is a slice of a backend's slots only its key can take.
+// Lent slots can be taken by others while the key leaves them unused; the
+// key takes them back as soon as it needs them, without waiting for the
+// borrowers to finish, so the backend briefly carries more than
+// max_concurrent requests.
+type QueueReservation struct {
+	Slots int  `json:"slots"`
+	Lend  bool `json:"lend,omitempty"`
+}
+
+// validate fills in defaults once the catalog entry is parsed.
+func (q *BackendQueue) validate() error {
+	if q.MaxConcurrent <= 0 {
+		return errors.New("queue max_concurrent must be positive")
+	}
+	if q.MaxDepth < 0 {
+		return errors.New("queue max_depth must not be negative")
+	}
+	if q.MaxDepth == 0 {
+		q.MaxDepth = 4 * q.MaxConcurrent
+	}
+	var err error
+	if q.timeout, err = positiveDuration(q.Timeout, defaultQueueTimeout); err != nil {
+		return fmt.Errorf("invalid queue timeout: %w", err)
+	}
+	q.reserved = 0
+	for key, r := range q.Reservations {
+		if key == "" || r.Slots <= 0 {
+			return fmt.Errorf("queue reservation %q: slots must be positive", key)
+		}
+		q.reserved += r.Slots
+	}
+	if q.reserved > q.MaxConcurrent {
+		return fmt.Errorf("queue reservations hold %d slots, more than max_concurrent %d", q.reserved, q.MaxConcurrent)
+	}
+	return nil
+}
+
+func (q BackendQueue) equal(o BackendQueue) bool {
+	return q.MaxConcurrent == o.MaxConcurrent && q.MaxDepth == o.MaxDepth && q.timeout == o.timeout &&
+		maps.Equal(q.Reservations, o.Reservations)
+}
+
+// queueStatus is where a request stands in a backend's queue. The
+// estimates come from the queue's EWMA of service time and are left out
+// until the backend has completed a request through it.
+type queueStatus struct {
+	Backend string `json:"backend,omitempty"`
+	// Position is the request's 1-based place in line
+	Position      int `json:"position,omitempty"`
+	Depth         int `json:"depth"`
+	InFlight      int `json:"in_flight"`
+	MaxConcurrent int `json:"max_concurrent"`
+	// EstimatedServiceSeconds is the recent average time a request holds
+	// its slot, streaming included
+	EstimatedServiceSeconds *float64 `json:"estimated_service_seconds,omitempty"`
+	// EstimatedWaitSeconds is how long until Position gets a slot, taking
+	// slots to free up evenly: position × service time / max_concurrent
+	EstimatedWaitSeconds *float64 `json:"estimated_wait_seconds,omitempty"`
+	// Reservations are only reported to admins
+	Reservations []reservationStatus `json:"reservations,omitempty"`
+}
+
+// reservationStatus is how much of a key's reservation is in use.
+type reservationStatus struct {
+	Key   string `json:"key"`
+	Slots int    `json:"slots"`
+	Lend  bool   `json:"lend"`
+	// InUse counts the key's requests in its reserved slots, and Lent
+	// others' requests in the slots it lends
+	InUse int `json:"in_use"`
+	Lent  int `json:"lent"`
+	// Utilization is InUse / Slots
+	Utilization float64 `json:"utilization"`
+}
+
+// backendQueue is a backend's concurrency limiter. Slots are handed over to
+// waiting requests first come, first served, except that a request with a
+// free reserved slot never waits.
+type backendQueue struct {
+	mu       sync.Mutex
+	cfg      BackendQueue
+	inflight int
+	// shared counts requests in the slots no reservation holds. reserved
+	// and lent count, by reserving key, the key's requests in its slots and
+	// others' in the slots it lends
+	shared   int
+	reserved map[string]int
+	lent     map[string]int
+	waiting  []*queueWaiter
+	// service is an EWMA of how long requests hold a slot
+	service time.Duration
+}
+
+// queueWaiter is a request waiting in line.
+type queueWaiter struct {
+	// keys are the caller's key and its parent's, either of which may
+	// hold a reservation
+	keys  []string
+	ready chan struct{}
+	slot  queueSlot
+}
+
+// queueSlot is which of a backend's slots a request holds: a shared one,
+// one reserved for key, or one lent by key.
+type queueSlot struct {
+	pool string
+	key  string
+}
+
+// backendQueues holds each backend's queue by backend name. A queue outlives
+// catalog reloads, which only change its limits, so requests waiting or in
+// flight stay counted.
+var backendQueues = struct {
+	sync.Mutex
+	byName map[string]*backendQueue
+}{byName: make(map[string]*backendQueue)}
+
+// queueFor returns backend's queue, with its current config, or nil if it
+// has none.
+func queueFor(backend *Backend) *backendQueue {
+	if backend.Queue == nil {
+		return nil
+	}
+	backendQueues.Lock()
+	q, ok := backendQueues.byName[backend.Name]
+	if !ok {
+		q = &backendQueue{reserved: make(map[string]int), lent: make(map[string]int)}
+		backendQueues.byName[backend.Name] = q
+	}
+	backendQueues.Unlock()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.cfg.equal(*backend.Queue) {
+		q.cfg = *backend.Queue
+		// A raised limit lets waiting requests through straight away
+		q.dispatch()
+	}
+	return q
+}
+
+// acquire takes a slot for the caller ctx identifies, waiting in line for
+// one if the backend is at its limit. A request the queue turns away gets
+// errQueueFull or errQueueTimeout with where it stood; one whose client
+// went away gets the context's error. Callers call release once the
+// request is done.
+func (q *backendQueue) acquire(ctx context.Context) (release func(), status *queueStatus, err error) {
+	if q == nil {
+		return func() {}, nil, nil
+	}
+	keys := apiKeys.tenant(identityFromContext(ctx).KeyID)
+	q.mu.Lock()
+	if slot, ok := q.take(keys, len(q.waiting) == 0); ok {
+		q.mu.Unlock()
+		return q.releaser(slot), nil, nil
+	}
+	if len(q.waiting) >= q.cfg.MaxDepth {
+		status = q.status(len(q.waiting) + 1)
+		q.mu.Unlock()
+		return nil, status, errQueueFull
+	}
+	waiter := &queueWaiter{keys: keys, ready: make(chan struct{})}
+	q.waiting = append(q.waiting, waiter)
+	timer := time.NewTimer(q.cfg.timeout)
+	q.mu.Unlock()
+	defer timer.Stop()
+
+	select {
+	case <-waiter.ready:
+		return q.releaser(waiter.slot), nil, nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := slices.Index(q.waiting, waiter)
+	if i < 0 {
+		// Handed a slot just as it gave up; the handler notices a gone
+		// client itself
+		return q.releaser(waiter.slot), nil, nil
+	}
+	if err == errQueueTimeout {
+		status = q.status(i + 1)
+	}
+	q.waiting = slices.Delete(q.waiting, i, i+1)
+	return nil, status, err
+}
+
+// take gives a request from keys a free slot: one of its reservation's,
+// else a shared one, else one another key lends. With inTurn false, when
+// others are waiting, only a reserved slot will do. It reports false when
+// there is none. Callers hold mu.
+func (q *backendQueue) take(keys []string, inTurn bool) (queueSlot, bool) {
+	slot, ok := q.free(keys, inTurn)
+	if !ok {
+		return slot, false
+	}
+	q.inflight++
+	switch slot.pool {
+	case "reserved":
+		q.reserved[slot.key]++
+	case "lent":
+		q.lent[slot.key]++
+	default:
+		q.shared++
+	}
+	return slot, true
+}
+
+func (q *backendQueue) free(keys []string, inTurn bool) (queueSlot, bool) {
+	for _, key := range keys {
+		// Slots lent out count as free: the borrowers finish in
+		// the slots' stead
+		if r, ok := q.cfg.Reservations[key]; ok && q.reserved[key] < r.Slots {
+			return queueSlot{pool: "reserved", key: key}, true
+		}
+	}
+	if !inTurn {
+		return queueSlot{}, false
+	}
+	if q.shared < q.cfg.MaxConcurrent-q.cfg.reserved {
+		return queueSlot{pool: "shared"}, true
+	}
+	for _, key := range sortedKeys(q.cfg.Reservations) {
+		r := q.cfg.Reservations[key]
+		if r.Lend && !slices.Contains(keys, key) && q.reserved[key]+q.lent[key] < r.Slots {
+			return queueSlot{pool: "lent", key: key}, true
+		}
+	}
+	return queueSlot{}, false
+}
+
+// releaser gives slot back, to the next request in line that can take it
+// if any, and adds the time it was held to the service time EWMA.
+func (q *backendQueue) releaser(slot queueSlot) func() {
+	start := time.Now()
+	return sync.OnceFunc(func() {
+		d := time.Since(start)
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if q.service == 0 {
+			q.service = d
+		} else {
+			q.service = time.Duration(latencyWeight*float64(d) + (1-latencyWeight)*float64(q.service))
+		}
+		q.inflight--
+		switch slot.pool {
+		case "reserved":
+			q.reserved[slot.key]--
+		case "lent":
+			q.lent[slot.key]--
+		default:
+			q.shared--
+		}
+		q.dispatch()
+	})
+}
+
+// dispatch hands free slots to waiting requests, in line order, skipping
+// those whose only way in is a slot still taken. Callers hold mu.
+func (q *backendQueue) dispatch() {
+	for i := 0; i < len(q.waiting); {
+		w := q.waiting[i]
+		slot, ok := q.take(w.keys, true)
+		if !ok {
+			i++
+			continue
+		}
+		w.slot = slot
+		close(w.ready)
+		q.waiting = slices.Delete(q.waiting, i, i+1)
+	}
+}
+
+// reservations reports each reservation's use. Callers hold mu.
+func (q *backendQueue) reservations() []reservationStatus {
+	var out []reservationStatus
+	for _, key := range sortedKeys(q.cfg.Reservations) {
+		r := q.cfg.Reservations[key]
+		out = append(out, reservationStatus{
+			Key: key, Slots: r.Slots, Lend: r.Lend, InUse: q.reserved[key], Lent: q.lent[key],
+			Utilization: math.Round(float64(q.reserved[key])/float64(r.Slots)*1000) / 1000,
+		})
+	}
+	return out
+}
+
+// status reports the queue as seen from position. Callers hold mu.
+func (q *backendQueue) status(position int) *queueStatus {
+	st := &queueStatus{Position: position, Depth: len(q.waiting), InFlight: q.inflight, MaxConcurrent: q.cfg.MaxConcurrent}
+	if q.service > 0 {
+		service := roundSeconds(q.service.Seconds())
+		wait := roundSeconds(float64(position) * q.service.Seconds() / float64(q.cfg.MaxConcurrent))
+		st.EstimatedServiceSeconds, st.EstimatedWaitSeconds = &service, &wait
+	}
+	return st
+}
+
+func roundSeconds(s float64) float64 {
+	return math.Round(s*1000) / 1000
+}
+
+// writeQueueRejection answers a request the queue turned away with 503 and
+// where it stood, in the error body and in headers.
+func writeQueueRejection(w http.ResponseWriter, model string, backend *Backend, st *queueStatus, err error) {
+	queueRejected.Add(backend.Name, 1)
+	code := "backend_queue_full"
+	if err == errQueueTimeout {
+		code = "backend_queue_timeout"
+	}
+	msg := fmt.Sprintf("Backend for model %q is saturated; you were number %d in line", model, st.Position)
+	w.Header().Set("X-Gateway-Queue-Position", strconv.Itoa(st.Position))
+	w.Header().Set("X-Gateway-Queue-Depth", strconv.Itoa(st.Depth))
+	if st.EstimatedWaitSeconds != nil {
+		wait := *st.EstimatedWaitSeconds
+		msg += fmt.Sprintf(", estimated wait %s", (time.Duration(math.Ceil(wait)) * time.Second).String())
+		w.Header().Set("X-Gateway-Estimated-Wait", strconv.FormatFloat(wait, 'f', -1, 64))
+		w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(wait)), 1)))
+	}
+
+	var body struct {
+		Error struct {
+			ErrorDetail
+			Queue *queueStatus `json:"queue"`
+		} `json:"error"`
+	}
+	body.Error.ErrorDetail = ErrorDetail{Message: msg + "; retry later", Type: "server_error", Code: code}
+	body.Error.Queue = st
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(body)
+}
+
+// queuesAdminHandler implements GET /admin/queues: each queued backend's
+// depth, in-flight requests, reservations and the estimates a request
+// arriving now would get.
+func queuesAdminHandler(w http.ResponseWriter, r *http.Request) {
+	c := catalog.Load()
+	data := []*queueStatus{}
+	for _, b := range c.backends {
+		q := queueFor(b)
+		if q == nil {
+			continue
+		}
+		q.mu.Lock()
+		st := q.status(len(q.waiting) + 1)
+		st.Reservations = q.reservations()
+		q.mu.Unlock()
+		st.Backend, st.Position = b.Name, 0
+		data = append(data, st)
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].Backend < data[j].Backend })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": data})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"os"
+)
+
+// Backend is an upstream that serves chat completions.
+type Backend struct {
+	Name string `json:"-"`
+	Type string `json:"type"`
+	URL  string `json:"url"`
+	// URLs lists further endpoints serving the same models; requests rotate
+	// across URL and URLs and fail over between them on connection errors
+	URLs []string `json:"urls,omitempty"`
+
+	// Models lists catalog models the backend also serves, besides those
+	// routed to it, for requests sent to it with X-Gateway-Target-Backend
+	Models []string `json:"models,omitempty"`
+
+	// EndpointRegions maps URL and URLs entries to the region they run in.
+	// With EndpointPolicy prefer-local-region, endpoints in GATEWAY_REGION
+	// are used before any other
+	EndpointRegions map[string]string `json:"endpoint_regions,omitempty"`
+	EndpointPolicy  string            `json:"endpoint_policy,omitempty"`
+
+	// Balancing, when set, weights requests across the endpoints instead
+	// of rotating evenly, statically or by observed latency and errors
+	Balancing *Balancing `json:"balancing,omitempty"`
+
+	// Provider credentials for backend types that need them. APIKey may be
+	// a secret reference (env://, file:// or exec://), resolved on every
+	// catalog load; apiKeyRef keeps the reference
+	APIKey          string `json:"api_key,omitempty"`
+	apiKeyRef       string
+	CredentialsFile string `json:"credentials_file,omitempty"`
+	Region          string `json:"region,omitempty"`
+
+	// MaxTokensField is the completion limit field OpenAI-compatible
+	// backends receive: max_tokens (default) or max_completion_tokens
+	MaxTokensField string `json:"max_tokens_field,omitempty"`
+
+	// AcceptEncoding is what the gateway asks the backend to compress
+	// responses with: gzip (default) or identity, for backends that
+	// mishandle compression
+	AcceptEncoding string `json:"accept_encoding,omitempty"`
+
+	// RequestCompression, when set, gzips large chat completions request
+	// bodies; openai and vllm only
+	RequestCompression *RequestCompression `json:"request_compression,omitempty"`
+
+	// SuppressForwarding keeps the caller's IP and the gateway's Via out of
+	// requests to this backend, e.g. for third-party providers
+	SuppressForwarding bool `json:"suppress_forwarding,omitempty"`
+
+	// Paths, when set, moves the routes called under URL
+	Paths *BackendPaths `json:"paths,omitempty"`
+
+	// Responses sends /v1/responses requests to the backend's own
+	// Responses API as they came, instead of translating them to chat
+	// completions; openai and vllm only
+	Responses bool `json:"responses,omitempty"`
+
+	// MessageNormalization, when set, overrides how the backend type's
+	// message rules reshape conversations before they are sent
+	MessageNormalization *MessageNormalization `json:"message_normalization,omitempty"`
+
+	// RequestFields strips, renames and defaults request fields for
+	// servers that are particular about them
+	RequestFields *RequestFields `json:"request_fields,omitempty"`
+
+	// Pool sizes the backend's connection pool
+	Pool *PoolConfig `json:"pool,omitempty"`
+
+	// Proxy, when set, overrides the environment's outbound proxy for this
+	// backend
+	Proxy *ProxyConfig `json:"proxy,omitempty"`
+
+	// Shedding, when set, rejects part of the backend's traffic while it
+	// is overloaded
+	Shedding *Shedding `json:"shedding,omitempty"`
+
+	// Queue, when set, caps the backend's concurrent requests and queues
+	// the rest
+	Queue *BackendQueue `json:"queue,omitempty"`
+
+	// Warmup, when set, primes the backend at startup and after it recovers
+	// from an outage, before it takes traffic
+	Warmup *Warmup `json:"warmup,omitempty"`
+
+	// SelfTest checks the backend at startup; SELF_TEST turns it on for
+	// every backend
+	SelfTest *SelfTest `json:"self_test,omitempty"`
+}
+
+// backendAdapter translates between the gateway's OpenAI-style types and a
+// backend type's wire format.
+type backendAdapter interface {
+	// newRequest builds the upstream request; req.Stream selects streaming
+	newRequest(ctx context.Context, backend *Backend, req ChatCompletionRequest, requestID string) (*http.Request, error)
+	// decodeResponse converts a successful non-streaming response body
+	decodeResponse(body io.Reader) (ChatCompletionResponse, error)
+	// streamBody converts a successful streaming body into OpenAI SSE
+	streamBody(body io.ReadCloser, requestID string) io.ReadCloser
+	// parseError extracts and classifies a non-200 response body
+	parseError(status int, header http.Header, body []byte) classifiedError
+}
+
+// adapters maps backend types to their adapters.
+var adapters = map[string]backendAdapter{
+	"openai":  openaiAdapter{},
+	"vllm":    openaiAdapter{},
+	"gemini":  geminiAdapter{},
+	"bedrock": bedrockAdapter{},
+	"tgi":     tgiAdapter{},
+}
+
+// adapterFor returns the adapter for backend, defaulting to OpenAI format.
+func adapterFor(backend *Backend) backendAdapter {
+	if a, ok := adapters[backend.Type]; ok {
+		return a
+	}
+	return openaiAdapter{}
+}
+
+// openaiAdapter speaks the OpenAI chat completions format natively.
+type openaiAdapter struct{}
+
+func (openaiAdapter) newRequest(ctx context.Context, backend *Backend, req ChatCompletionRequest, requestID string) (*http.Request, error) {
+	return newOpenAIRequest(ctx, backend, req, requestID)
+}
+
+func (openaiAdapter) decodeResponse(body io.Reader) (ChatCompletionResponse, error) {
+	var response ChatCompletionResponse
+	err := json.NewDecoder(body).Decode(&response)
+	return response, err
+}
+
+func (openaiAdapter) streamBody(body io.ReadCloser, requestID string) io.ReadCloser {
+	return body
+}
+
+// echoBackend answers locally without any upstream. Models can target it by
+// name ("backend": "echo") to expose fake models alongside real ones.
+var echoBackend = &Backend{Name: "echo", Type: "echo"}
+
+// backendRequests counts chat completions handled by each backend.
+var backendRequests = expvar.NewMap("gateway_backend_requests_total")
+
+// defaultBackend is the backend for models without a catalog routing entry:
+// BACKEND_URL/BACKEND_TYPE, or echo mode when BACKEND_URL is unset.
+func defaultBackend() *Backend {
+	url := os.Getenv("BACKEND_URL")
+	if url == "" {
+		return echoBackend
+	}
+	backendType := os.Getenv("BACKEND_TYPE")
+	if backendType == "" {
+		backendType = "openai"
+	}
+	return &Backend{Name: "default", Type: backendType, URL: url}
+}
+
+// routeBackend picks the backend serving model, per the catalog.
+func (c *modelCatalog) routeBackend(model string) *Backend {
+	if m, ok := c.lookup(model); ok && m.Backend != "" {
+		if m.Backend == echoBackend.Name {
+			return echoBackend
+		}
+		if b, ok := c.backends[m.Backend]; ok {
+			return b
+		}
+	}
+	return defaultBackend()
+}
+
+// upstreamModel maps a public model alias to the ID its backend expects.
+func (c *modelCatalog) upstreamModel(model string) string {
+	if m, ok := c.lookup(model); ok && m.UpstreamModel != "" {
+		return m.UpstreamModel
+	}
+	return model
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// errSlowClient ends a stream whose client has fallen too far behind.
+var errSlowClient = errors.New("client is not reading the stream fast enough")
+
+// slowClientStreams counts streams terminated because the client was too slow.
+var slowClientStreams = expvar.NewInt("gateway_streams_dropped_slow_client_total")
+
+// eventQueue is a bounded buffer between the backend reader and the client
+// writer. The backend side may run ahead by up to the buffer size; if the
+// buffer stays full for longer than the grace period the stream is dropped
+// instead of letting memory grow with every slow client.
+type eventQueue struct {
+	events       chan []byte
+	grace        time.Duration
+	writeTimeout time.Duration
+	done         chan struct{}
+	err          error
+	slow         atomic.Bool
+}
+
+const (
+	defaultSlowClientGrace    = 10 * time.Second
+	defaultStreamWriteTimeout = 30 * time.Second
+)
+
+// streamBufferSize is STREAM_BUFFER, defaulting to 64 events.
+func streamBufferSize() int {
+	if v, err := strconv.Atoi(os.Getenv("STREAM_BUFFER")); err == nil && v > 0 {
+		return v
+	}
+	return 64
+}
+
+// startQueue attaches an eventQueue to s and starts delivering events. Sizes
+// come from STREAM_BUFFER (events, default 64), STREAM_SLOW_CLIENT_GRACE
+// (default 10s) and STREAM_WRITE_TIMEOUT (per write, default 30s).
+func (s *sseWriter) startQueue(rc *http.ResponseController, requestID string) {
+	s.queue = &eventQueue{
+		events:       make(chan []byte, streamBufferSize()),
+		grace:        envDuration("STREAM_SLOW_CLIENT_GRACE", defaultSlowClientGrace),
+		writeTimeout: envDuration("STREAM_WRITE_TIMEOUT", defaultStreamWriteTimeout),
+		done:         make(chan struct{}),
+	}
+	go s.drain(rc, requestID)
+}
+
+// push enqueues an event, waiting up to the grace period for room.
+func (q *eventQueue) push(data []byte) error {
+	if q.slow.Load() {
+		return errSlowClient
+	}
+
+	select {
+	case q.events <- data:
+		return nil
+	case <-q.done:
+		return q.err
+	default:
+	}
+
+	timer := time.NewTimer(q.grace)
+	defer timer.Stop()
+	select {
+	case q.events <- data:
+		return nil
+	case <-q.done:
+		return q.err
+	case <-timer.C:
+		q.slow.Store(true)
+		return errSlowClient
+	}
+}
+
+// close stops accepting events and waits until the writer has finished.
+func (q *eventQueue) close() {
+	close(q.events)
+	<-q.done
+}
+
+// drain writes queued events to the client, each under a write deadline,
+// merging content chunks first when the stream is coalesced. Once the
+// client is declared slow, the backlog is discarded and the stream ends
+// with an error event.
+func (s *sseWriter) drain(rc *http.ResponseController, requestID string) {
+	q := s.queue
+	defer close(q.done)
+
+	write := func(events [][]byte) bool {
+		for _, data := range events {
+			rc.SetWriteDeadline(time.Now().Add(q.writeTimeout))
+			if err := s.writeNow(data); err != nil {
+				q.err = err
+				return false
+			}
+		}
+		return true
+	}
+
+	var coalesce *deltaCoalescer
+	if s.coalesce != nil {
+		coalesce = newDeltaCoalescer(s.coalesce)
+	}
+	due := time.NewTimer(0)
+	due.Stop()
+	defer due.Stop()
+	for open := true; open; {
+		var events [][]byte
+		select {
+		case data, ok := <-q.events:
+			switch {
+			case !ok:
+				open = false
+				if coalesce != nil {
+					events = coalesce.flush()
+				}
+			case coalesce != nil:
+				events = coalesce.add(data)
+			default:
+				events = [][]byte{data}
+			}
+		case <-due.C:
+			events = coalesce.flush()
+		}
+		if q.slow.Load() {
+			continue
+		}
+		if !write(events) {
+			return
+		}
+		if at, ok := coalesce.deadline(); ok {
+			due.Reset(time.Until(at))
+		}
+	}
+
+	if q.slow.Load() {
+		rc.SetWriteDeadline(time.Now().Add(q.writeTimeout))
+		data, _ := json.Marshal(ErrorResponse{Error: ErrorDetail{
+			Message: "Stream terminated: client is not reading fast enough",
+			Type:    "server_error",
+			Code:    "slow_consumer",
+		}})
+		if err := s.writeNow(data); err != nil {
+			log.Printf("Stream %s: failed to send slow-consumer error: %v", requestID, err)
+		}
+	}
+}
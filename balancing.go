@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Endpoint balancing policies. Without a balancing block a backend rotates
+// over its endpoints evenly.
+const (
+	// balanceStatic picks endpoints in proportion to their configured weights
+	balanceStatic = "static"
+	// balanceEWMA scales the weights by each endpoint's latency and error
+	// rate, both exponentially weighted moving averages
+	balanceEWMA = "ewma"
+	// balancePeakEWMA is balanceEWMA with latency that jumps to each new
+	// peak and only decays gradually, so a slowing endpoint loses traffic
+	// at once
+	balancePeakEWMA = "peak-ewma"
+)
+
+const (
+	defaultBalancingSmoothing = 0.2
+	defaultBalancingFloor     = 0.05
+)
+
+// Balancing weights a backend's endpoints:
+//
+//	"balancing": {"policy": "peak-ewma", "weights": {"http://vllm-a:8000": 2}, "smoothing": 0.2, "floor": 0.05}
+type Balancing struct {
+	// Policy is static (default), ewma or peak-ewma
+	Policy string `json:"policy,omitempty"`
+	// Weights are static weights by endpoint URL; unlisted endpoints weigh 1
+	Weights map[string]float64 `json:"weights,omitempty"`
+	// Smoothing is the weight of each new sample in the moving averages,
+	// from 0 to 1 (default 0.2); higher reacts faster
+	Smoothing float64 `json:"smoothing,omitempty"`
+	// Floor is the least fraction of its static weight an adaptive
+	// endpoint keeps (default 0.05), so none is starved of the traffic
+	// that would show it recovering
+	Floor *float64 `json:"floor,omitempty"`
+
+	floor float64
+}
+
+// validate fills in defaults once the backend's endpoints are known.
+func (bal *Balancing) validate(endpoints []string) error {
+	switch bal.Policy {
+	case "":
+		bal.Policy = balanceStatic
+	case balanceStatic, balanceEWMA, balancePeakEWMA:
+	default:
+		return fmt.Errorf("unknown balancing policy %q: want %s, %s or %s", bal.Policy, balanceStatic, balanceEWMA, balancePeakEWMA)
+	}
+	for ep, w := range bal.Weights {
+		if !slices.Contains(endpoints, ep) {
+			return fmt.Errorf("balancing weights name %q, which is not one of the backend's urls", ep)
+		}
+		if w <= 0 {
+			return fmt.Errorf("balancing weight for %q must be positive", ep)
+		}
+	}
+	if bal.Smoothing < 0 || bal.Smoothing > 1 {
+		return errors.New("balancing smoothing must be between 0 and 1")
+	}
+	if bal.Smoothing == 0 {
+		bal.Smoothing = defaultBalancingSmoothing
+	}
+	bal.floor = defaultBalancingFloor
+	if bal.Floor != nil {
+		if *bal.Floor < 0 || *bal.Floor > 1 {
+			return errors.New("balancing floor must be between 0 and 1")
+		}
+		bal.floor = *bal.Floor
+	}
+	return nil
+}
+
+func (bal *Balancing) adaptive() bool {
+	return bal.Policy == balanceEWMA || bal.Policy == balancePeakEWMA
+}
+
+func (bal *Balancing) weight(endpoint string) float64 {
+	if w, ok := bal.Weights[endpoint]; ok {
+		return w
+	}
+	return 1
+}
+
+// endpointHealth is an endpoint's moving averages for adaptive balancing.
+type endpointHealth struct {
+	// latency is the time to response headers, in seconds
+	latency float64
+	// errors is the fraction of requests that failed to connect or got a
+	// 5xx
+	errors  float64
+	samples int64
+}
+
+// observeEndpoint feeds a request's outcome into the endpoint's health for
+// backends balanced adaptively. Failed requests don't sample latency.
+func observeEndpoint(b *Backend, endpoint string, d time.Duration, failed bool) {
+	bal := b.Balancing
+	if bal == nil || !bal.adaptive() {
+		return
+	}
+	endpointBalancer.mu.Lock()
+	defer endpointBalancer.mu.Unlock()
+	h := endpointBalancer.health[endpoint]
+	if h == nil {
+		h = &endpointHealth{}
+		endpointBalancer.health[endpoint] = h
+	}
+	failure := 0.0
+	if failed {
+		failure = 1
+	}
+	if h.samples == 0 {
+		h.errors = failure
+	} else {
+		h.errors = bal.Smoothing*failure + (1-bal.Smoothing)*h.errors
+	}
+	h.samples++
+	if failed {
+		return
+	}
+	switch s := d.Seconds(); {
+	case h.latency == 0:
+		h.latency = s
+	case bal.Policy == balancePeakEWMA && s > h.latency:
+		h.latency = s
+	default:
+		h.latency = bal.Smoothing*s + (1-bal.Smoothing)*h.latency
+	}
+}
+
+// effectiveWeights are the weights b's endpoints are picked by. Adaptive
+// weights are the static ones scaled by how an endpoint's latency compares
+// with the fastest one's and by its success rate, never below the floor.
+// Endpoints not yet measured count as the fastest, so they get measured.
+// Must be called with endpointBalancer.mu held.
+func effectiveWeights(b *Backend, eps []string) []float64 {
+	bal := b.Balancing
+	weights := make([]float64, len(eps))
+	for i, ep := range eps {
+		weights[i] = bal.weight(ep)
+	}
+	if !bal.adaptive() || endpointBalancer.pinStatic[b.Name] {
+		return weights
+	}
+	best := 0.0
+	for _, ep := range eps {
+		if h := endpointBalancer.health[ep]; h != nil && h.latency > 0 && (best == 0 || h.latency < best) {
+			best = h.latency
+		}
+	}
+	for i, ep := range eps {
+		h := endpointBalancer.health[ep]
+		if h == nil {
+			continue
+		}
+		scale := 1 - h.errors
+		if h.latency > 0 && best > 0 {
+			scale *= best / h.latency
+		}
+		weights[i] *= max(scale, bal.floor)
+	}
+	return weights
+}
+
+// pickWeighted returns the index in b's endpoints to start the rotation
+// at, drawn by effective weight. With the prefer-local-region policy it
+// draws among the local endpoints, which regionOrder tries first.
+func pickWeighted(b *Backend) int {
+	eps := b.endpoints()
+	endpointBalancer.mu.Lock()
+	weights := effectiveWeights(b, eps)
+	forced := endpointBalancer.forceRemote[b.Name]
+	endpointBalancer.mu.Unlock()
+	if b.EndpointPolicy == policyPreferLocalRegion && !forced && slices.ContainsFunc(eps, b.isLocal) {
+		for i, ep := range eps {
+			if !b.isLocal(ep) {
+				weights[i] = 0
+			}
+		}
+	}
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return i
+		}
+		r -= w
+	}
+	return len(eps) - 1
+}
+
+type balancingEndpoint struct {
+	URL          string  `json:"url"`
+	StaticWeight float64 `json:"static_weight"`
+	// Share is the fraction of requests the endpoint is picked for
+	Share     float64  `json:"share"`
+	LatencyMS *float64 `json:"latency_ms,omitempty"`
+	ErrorRate *float64 `json:"error_rate,omitempty"`
+	Samples   int64    `json:"samples"`
+}
+
+type backendBalancing struct {
+	Backend   string              `json:"backend"`
+	Policy    string              `json:"policy"`
+	Smoothing float64             `json:"smoothing"`
+	Floor     float64             `json:"floor"`
+	PinStatic bool                `json:"pin_static"`
+	Endpoints []balancingEndpoint `json:"endpoints"`
+}
+
+func balancingOf(b *Backend) backendBalancing {
+	bal := b.Balancing
+	eps := b.endpoints()
+	endpointBalancer.mu.Lock()
+	defer endpointBalancer.mu.Unlock()
+	out := backendBalancing{Backend: b.Name, Policy: bal.Policy, Smoothing: bal.Smoothing, Floor: bal.floor, PinStatic: endpointBalancer.pinStatic[b.Name]}
+	weights := effectiveWeights(b, eps)
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	for i, ep := range eps {
+		e := balancingEndpoint{URL: ep, StaticWeight: bal.weight(ep), Share: round3(weights[i] / total)}
+		if h := endpointBalancer.health[ep]; h != nil {
+			latency, errRate := round3(h.latency*1000), round3(h.errors)
+			e.LatencyMS, e.ErrorRate, e.Samples = &latency, &errRate, h.samples
+		}
+		out.Endpoints = append(out.Endpoints, e)
+	}
+	return out
+}
+
+// balancingAdminHandler implements GET /admin/balancing: each balanced
+// backend's endpoints with their effective share of traffic and the
+// latency and error rate behind it.
+func balancingAdminHandler(w http.ResponseWriter, r *http.Request) {
+	data := []backendBalancing{}
+	for _, b := range catalog.Load().backends {
+		if b.Balancing != nil {
+			data = append(data, balancingOf(b))
+		}
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].Backend < data[j].Backend })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": data})
+}
+
+// updateBalancingHandler implements PATCH /admin/balancing/{backend}. With
+// {"pin_static": true} an adaptive backend is balanced by its static
+// weights alone until unpinned; health is still tracked meanwhile. The pin
+// is kept in memory, like force_cross_region.
+func updateBalancingHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("backend")
+	b, ok := catalog.Load().backends[name]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "invalid_request_error", "backend_not_found", fmt.Sprintf("No backend %q in the catalog", name))
+		return
+	}
+	var req struct {
+		PinStatic *bool `json:"pin_static"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_json", "Invalid JSON: "+describeJSONError(err))
+		return
+	}
+	if req.PinStatic == nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_value", "pin_static is required")
+		return
+	}
+	if b.Balancing == nil || !b.Balancing.adaptive() {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_value",
+			fmt.Sprintf("Backend %q is not balanced adaptively", name))
+		return
+	}
+
+	endpointBalancer.mu.Lock()
+	if *req.PinStatic {
+		endpointBalancer.pinStatic[name] = true
+	} else {
+		delete(endpointBalancer.pinStatic, name)
+	}
+	endpointBalancer.mu.Unlock()
+	log.Printf("Admin set pin_static=%t for backend %s", *req.PinStatic, name)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(balancingOf(b))
+}
+
+func round3(x float64) float64 {
+	return math.Round(x*1000) / 1000
+}
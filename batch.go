@@ -0,0 +1,793 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vinayhpandya/ai_inference_gateway/client"
+)
+
+// The batch API accepts OpenAI Batch input files (JSONL, one request per
+// line) and works through them in the background against the same chat
+// completions pipeline live traffic uses. It is enabled by BATCH_DIR, where
+// files and batch state are persisted so a restart resumes where it left off.
+//
+// Simplifications relative to OpenAI:
+//   - completion_window must be "24h". Lines not started when the window
+//     passes are dropped and the batch ends "expired".
+//   - Cancelling stops new lines from starting; lines already running finish
+//     and are written out before the batch becomes "cancelled".
+//   - output_file_id and error_file_id are assigned when the batch starts and
+//     grow as lines finish, so partial results can be downloaded early.
+//   - Only /v1/chat/completions is supported, and lines may not stream.
+//   - Lines run at most once per batch: on restart, lines already present in
+//     the output or error file are skipped, and a partially written trailing
+//     line is discarded and rerun.
+
+// maxBatchFileBytes bounds uploads to /v1/files.
+const maxBatchFileBytes = 200 << 20
+
+// batchWindow is the only supported completion_window.
+const batchWindow = 24 * time.Hour
+
+// The OpenAI file and batch objects are shared with the client package.
+type (
+	File               = client.File
+	Batch              = client.Batch
+	BatchErrors        = client.BatchErrors
+	BatchError         = client.BatchError
+	BatchRequestCounts = client.BatchRequestCounts
+)
+
+// batchLine is one request in an input file.
+type batchLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// batchResult is one line of an output or error file.
+type batchResult struct {
+	ID       string               `json:"id"`
+	CustomID string               `json:"custom_id"`
+	Response *batchResultResponse `json:"response"`
+	Error    *BatchError          `json:"error"`
+}
+
+type batchResultResponse struct {
+	StatusCode int             `json:"status_code"`
+	RequestID  string          `json:"request_id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// storedFile and storedBatch are the on-disk records; owner scopes access
+// to the key that created them.
+type storedFile struct {
+	File  *File  `json:"file"`
+	Owner string `json:"owner"`
+}
+
+type storedBatch struct {
+	Batch *Batch `json:"batch"`
+	Owner string `json:"owner"`
+}
+
+// batchStore holds files and batches under dir and runs batches on a shared
+// worker pool.
+type batchStore struct {
+	dir     string
+	handler http.HandlerFunc
+
+	// workers bounds lines in flight across all batches; tick, when set,
+	// paces line starts to BATCH_RATE per second
+	workers chan struct{}
+	tick    <-chan time.Time
+
+	mu      sync.Mutex
+	files   map[string]*storedFile
+	batches map[string]*storedBatch
+}
+
+// batches is the active store; nil disables the batch API.
+var batches *batchStore
+
+// loadBatchStore opens BATCH_DIR, if set, and resumes unfinished batches.
+// BATCH_WORKERS (default 4) bounds concurrent lines and BATCH_RATE (lines
+// per second, default 0 = unlimited) paces them.
+func loadBatchStore(handler http.HandlerFunc) (*batchStore, error) {
+	dir := os.Getenv("BATCH_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+
+	workers := 4
+	if v := os.Getenv("BATCH_WORKERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid BATCH_WORKERS %q", v)
+		}
+		workers = n
+	}
+
+	s := &batchStore{
+		dir:     dir,
+		handler: handler,
+		workers: make(chan struct{}, workers),
+		files:   make(map[string]*storedFile),
+		batches: make(map[string]*storedBatch),
+	}
+	if v := os.Getenv("BATCH_RATE"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("invalid BATCH_RATE %q", v)
+		}
+		if rate > 0 {
+			s.tick = time.NewTicker(time.Duration(float64(time.Second) / rate)).C
+		}
+	}
+
+	for _, sub := range []string{"files", "batches"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	for _, b := range s.batches {
+		switch b.Batch.Status {
+		case "validating", "in_progress", "cancelling":
+			log.Printf("Resuming batch %s (%s)", b.Batch.ID, b.Batch.Status)
+			go s.run(b)
+		}
+	}
+	return s, nil
+}
+
+// load reads every persisted file and batch record. A record that doesn't
+// decode is quarantined rather than failing startup.
+func (s *batchStore) load() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "files", "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		var f storedFile
+		err := readJSONFile(path, &f)
+		if err == nil && (f.File == nil || f.File.ID == "") {
+			err = errMissingRecordID
+		}
+		if errors.Is(err, errCorruptRecord) {
+			quarantineRecord(path, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		s.files[f.File.ID] = &f
+	}
+
+	paths, err = filepath.Glob(filepath.Join(s.dir, "batches", "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		var b storedBatch
+		err := readJSONFile(path, &b)
+		if err == nil && (b.Batch == nil || b.Batch.ID == "") {
+			err = errMissingRecordID
+		}
+		if errors.Is(err, errCorruptRecord) {
+			quarantineRecord(path, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		s.batches[b.Batch.ID] = &b
+	}
+	return nil
+}
+
+var (
+	errCorruptRecord   = errors.New("corrupt record")
+	errMissingRecordID = fmt.Errorf("%w: no id", errCorruptRecord)
+)
+
+// quarantineRecord moves a corrupt record aside to path.corrupt, where it
+// is no longer loaded but can still be inspected.
+func quarantineRecord(path string, err error) {
+	log.Printf("Quarantining %s: %v", path, err)
+	if err := os.Rename(path, path+".corrupt"); err != nil {
+		log.Printf("Failed to quarantine %s: %v", path, err)
+	}
+}
+
+func readJSONFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %w", errCorruptRecord, err)
+	}
+	return nil
+}
+
+// writeJSONFile replaces path atomically so a crash never leaves a torn record.
+func writeJSONFile(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over path,
+// so readers see either the old contents or the new, never a partial file.
+// The file is synced before the rename and the directory after it, so the
+// new contents survive a crash once it returns.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir fsyncs dir, making renames and creations in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *batchStore) contentPath(fileID string) string {
+	return filepath.Join(s.dir, "files", fileID+".jsonl")
+}
+
+// createFile registers a new file owned by owner; content may be nil for
+// output files that are appended to later.
+func (s *batchStore) createFile(owner, filename, purpose string, content []byte) (*File, error) {
+	f := &File{
+		ID:        "file-" + uuid.New().String(),
+		Object:    "file",
+		Bytes:     int64(len(content)),
+		CreatedAt: time.Now().Unix(),
+		Filename:  filename,
+		Purpose:   purpose,
+	}
+	if err := os.WriteFile(s.contentPath(f.ID), content, 0o600); err != nil {
+		return nil, err
+	}
+	stored := &storedFile{File: f, Owner: owner}
+	if err := writeJSONFile(filepath.Join(s.dir, "files", f.ID+".json"), stored); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.files[f.ID] = stored
+	s.mu.Unlock()
+	return f, nil
+}
+
+// file returns owner's file with its current size.
+func (s *batchStore) file(owner, id string) (*File, bool) {
+	s.mu.Lock()
+	stored, ok := s.files[id]
+	s.mu.Unlock()
+	if !ok || stored.Owner != owner {
+		return nil, false
+	}
+	f := *stored.File
+	if info, err := os.Stat(s.contentPath(id)); err == nil {
+		f.Bytes = info.Size()
+	}
+	return &f, true
+}
+
+// batch returns a snapshot of owner's batch.
+func (s *batchStore) batch(owner, id string) (*Batch, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.batches[id]
+	if !ok || stored.Owner != owner {
+		return nil, false
+	}
+	b := *stored.Batch
+	return &b, true
+}
+
+// update applies fn to a batch under the lock and persists the result.
+func (s *batchStore) update(stored *storedBatch, fn func(b *Batch)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fn(stored.Batch)
+	if err := writeJSONFile(filepath.Join(s.dir, "batches", stored.Batch.ID+".json"), stored); err != nil {
+		log.Printf("Failed to persist batch %s: %v", stored.Batch.ID, err)
+	}
+}
+
+// status reads a batch's status under the lock.
+func (s *batchStore) status(stored *storedBatch) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return stored.Batch.Status
+}
+
+// run validates the input file and executes its lines. It is safe to call
+// again for a batch interrupted by a restart.
+func (s *batchStore) run(stored *storedBatch) {
+	b := stored.Batch
+	lines, errs := s.readInput(b)
+	if len(errs) > 0 {
+		s.update(stored, func(b *Batch) {
+			b.Status = "failed"
+			b.FailedAt = time.Now().Unix()
+			b.Errors = &BatchErrors{Object: "list", Data: errs}
+		})
+		return
+	}
+
+	out, err := openBatchOutput(s.contentPath(b.OutputFileID))
+	if err != nil {
+		log.Printf("Batch %s failed to open output: %v", b.ID, err)
+		return
+	}
+	defer out.Close()
+	errOut, err := openBatchOutput(s.contentPath(b.ErrorFileID))
+	if err != nil {
+		log.Printf("Batch %s failed to open error file: %v", b.ID, err)
+		return
+	}
+	defer errOut.Close()
+
+	done := make(map[string]bool)
+	completed := markFinished(s.contentPath(b.OutputFileID), done)
+	failed := markFinished(s.contentPath(b.ErrorFileID), done)
+	s.update(stored, func(b *Batch) {
+		if b.Status == "validating" {
+			b.Status = "in_progress"
+			b.InProgressAt = time.Now().Unix()
+		}
+		b.RequestCounts = BatchRequestCounts{Total: len(lines), Completed: completed, Failed: failed}
+	})
+
+	var wg sync.WaitGroup
+	var writeMu sync.Mutex
+	expired := false
+	for i, line := range lines {
+		resultID := fmt.Sprintf("batch_req_%s_%d", strings.TrimPrefix(b.ID, "batch_"), i)
+		if done[resultID] {
+			continue
+		}
+		if s.status(stored) == "cancelling" {
+			break
+		}
+		if time.Now().Unix() >= b.ExpiresAt {
+			expired = true
+			break
+		}
+
+		s.workers <- struct{}{}
+		if s.tick != nil {
+			<-s.tick
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-s.workers }()
+
+			result := s.execute(stored.Owner, resultID, line)
+			data, _ := json.Marshal(result)
+
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			dest := out
+			if result.Error != nil || result.Response.StatusCode >= 300 {
+				dest = errOut
+			}
+			if _, err := dest.Write(append(data, '\n')); err != nil {
+				log.Printf("Batch %s failed to write result: %v", b.ID, err)
+				return
+			}
+			s.update(stored, func(b *Batch) {
+				if dest == out {
+					b.RequestCounts.Completed++
+				} else {
+					b.RequestCounts.Failed++
+				}
+			})
+		}()
+	}
+	wg.Wait()
+
+	var final Batch
+	s.update(stored, func(b *Batch) {
+		defer func() { final = *b }()
+		now := time.Now().Unix()
+		switch {
+		case b.Status == "cancelling":
+			b.Status = "cancelled"
+			b.CancelledAt = now
+		case expired:
+			b.Status = "expired"
+			b.ExpiredAt = now
+		default:
+			b.Status = "completed"
+			b.CompletedAt = now
+		}
+	})
+	log.Printf("Batch %s %s: %d completed, %d failed of %d",
+		final.ID, final.Status, final.RequestCounts.Completed, final.RequestCounts.Failed, final.RequestCounts.Total)
+}
+
+// readInput parses and validates every line of the batch's input file.
+func (s *batchStore) readInput(b *Batch) ([]batchLine, []BatchError) {
+	data, err := os.ReadFile(s.contentPath(b.InputFileID))
+	if err != nil {
+		return nil, []BatchError{{Code: "file_not_found", Message: err.Error()}}
+	}
+
+	var lines []batchLine
+	var errs []BatchError
+	seen := make(map[string]bool)
+	for i, raw := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(raw)) == 0 {
+			continue
+		}
+		var line batchLine
+		switch {
+		case json.Unmarshal(raw, &line) != nil:
+			errs = append(errs, BatchError{Code: "invalid_json_line", Message: "line is not valid JSON", Line: i + 1})
+		case line.CustomID == "" || seen[line.CustomID]:
+			errs = append(errs, BatchError{Code: "invalid_custom_id", Message: "custom_id must be present and unique", Line: i + 1})
+		case line.Method != http.MethodPost:
+			errs = append(errs, BatchError{Code: "invalid_method", Message: "method must be POST", Line: i + 1})
+		case line.URL != b.Endpoint:
+			errs = append(errs, BatchError{Code: "invalid_url", Message: fmt.Sprintf("url must be %s", b.Endpoint), Line: i + 1})
+		default:
+			seen[line.CustomID] = true
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 && len(errs) == 0 {
+		errs = append(errs, BatchError{Code: "empty_file", Message: "input file has no requests"})
+	}
+	return lines, errs
+}
+
+// openBatchOutput opens a result file for appending, first discarding any
+// partial line left by a crash mid-write.
+func openBatchOutput(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	keep := int64(bytes.LastIndexByte(data, '\n') + 1)
+	if err := f.Truncate(keep); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(keep, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// markFinished records the result IDs already in a result file and returns
+// how many there were.
+func markFinished(path string, done map[string]bool) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxBatchFileBytes)
+	for scanner.Scan() {
+		var result batchResult
+		if json.Unmarshal(scanner.Bytes(), &result) == nil && result.ID != "" {
+			done[result.ID] = true
+			n++
+		}
+	}
+	return n
+}
+
+// execute runs one line through the chat completions handler as owner.
+func (s *batchStore) execute(owner, resultID string, line batchLine) batchResult {
+	result := batchResult{ID: resultID, CustomID: line.CustomID}
+
+	var req ChatCompletionRequest
+	if err := json.Unmarshal(line.Body, &req); err != nil {
+		result.Error = &BatchError{Code: "invalid_request", Message: "invalid body: " + describeJSONError(err)}
+		return result
+	}
+	if req.Stream {
+		result.Error = &BatchError{Code: "invalid_request", Message: "streaming is not supported in batches"}
+		return result
+	}
+
+	ctx := context.WithValue(context.Background(), identityContextKey{}, identity{KeyID: owner, Method: "batch"})
+	rec := &requestRecord{Start: time.Now()}
+	ctx = context.WithValue(ctx, requestRecordKey{}, rec)
+	r, err := http.NewRequestWithContext(ctx, line.Method, line.URL, bytes.NewReader(line.Body))
+	if err != nil {
+		result.Error = &BatchError{Code: "invalid_request", Message: err.Error()}
+		return result
+	}
+	// Lines are chat completions, held to that route's limits
+	r.Body = requestLimits.body("POST /v1/chat/completions", r.Body)
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Request-ID", resultID)
+
+	w := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+	start := time.Now()
+	done := generations.admit(rec)
+	s.handler(w, r)
+	done(w.status)
+	recordUsage(rec, w.status, start)
+
+	body := bytes.TrimSpace(w.body.Bytes())
+	if !json.Valid(body) {
+		// Plain-text errors become a JSON string so the line stays valid
+		body, _ = json.Marshal(string(body))
+	}
+	result.Response = &batchResultResponse{
+		StatusCode: w.status,
+		RequestID:  w.header.Get("X-Request-ID"),
+		Body:       body,
+	}
+	return result
+}
+
+// bufferedResponse collects a handler's response in memory.
+type bufferedResponse struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if !b.wroteHeader {
+		b.status = status
+		b.wroteHeader = true
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.wroteHeader = true
+	return b.body.Write(p)
+}
+
+// requireBatches answers 404 when the batch API is not enabled.
+func requireBatches(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if batches == nil {
+			writeJSONError(w, http.StatusNotFound, "invalid_request_error", "not_found", "The batch API is not enabled on this gateway")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// uploadFileHandler implements POST /v1/files for multipart uploads with
+// purpose "batch".
+func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchFileBytes+1<<20)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_upload", fmt.Sprintf("Invalid multipart upload: %v", err))
+		return
+	}
+	if purpose := r.FormValue("purpose"); purpose != "batch" {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_purpose", "purpose must be \"batch\"")
+		return
+	}
+	upload, header, err := r.FormFile("file")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "missing_file", "Missing file field")
+		return
+	}
+	defer upload.Close()
+
+	content, err := io.ReadAll(io.LimitReader(upload, maxBatchFileBytes+1))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_upload", fmt.Sprintf("Failed to read file: %v", err))
+		return
+	}
+	if len(content) > maxBatchFileBytes {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "invalid_request_error", "file_too_large",
+			fmt.Sprintf("Files are limited to %d bytes", maxBatchFileBytes))
+		return
+	}
+
+	owner := identityFromContext(r.Context()).KeyID
+	f, err := batches.createFile(owner, header.Filename, "batch", content)
+	if err != nil {
+		log.Printf("Failed to store file: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "storage_error", "Failed to store file")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
+
+// getFileHandler implements GET /v1/files/{id}.
+func getFileHandler(w http.ResponseWriter, r *http.Request) {
+	f, ok := batches.file(identityFromContext(r.Context()).KeyID, r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "invalid_request_error", "not_found", "No such file")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
+
+// fileContentHandler implements GET /v1/files/{id}/content.
+func fileContentHandler(w http.ResponseWriter, r *http.Request) {
+	f, ok := batches.file(identityFromContext(r.Context()).KeyID, r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "invalid_request_error", "not_found", "No such file")
+		return
+	}
+	w.Header().Set("Content-Type", "application/jsonl")
+	http.ServeFile(w, r, batches.contentPath(f.ID))
+}
+
+// createBatchHandler implements POST /v1/batches.
+func createBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var req client.CreateBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_json", "Invalid JSON: "+describeJSONError(err))
+		return
+	}
+	if req.Endpoint != "/v1/chat/completions" {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_endpoint", "endpoint must be /v1/chat/completions")
+		return
+	}
+	if req.CompletionWindow != "24h" {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_completion_window", "completion_window must be \"24h\"")
+		return
+	}
+
+	owner := identityFromContext(r.Context()).KeyID
+	if _, ok := batches.file(owner, req.InputFileID); !ok {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "file_not_found", "No such input file")
+		return
+	}
+
+	b, err := batches.create(owner, req.InputFileID, req.Endpoint, req.CompletionWindow, req.Metadata)
+	if err != nil {
+		log.Printf("Failed to create batch: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "storage_error", "Failed to create batch")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+// create persists a new batch with empty output files and starts it.
+func (s *batchStore) create(owner, inputFileID, endpoint, window string, metadata map[string]string) (*Batch, error) {
+	id := "batch_" + uuid.New().String()
+	output, err := s.createFile(owner, id+"_output.jsonl", "batch_output", nil)
+	if err != nil {
+		return nil, err
+	}
+	errors, err := s.createFile(owner, id+"_errors.jsonl", "batch_output", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	stored := &storedBatch{
+		Owner: owner,
+		Batch: &Batch{
+			ID:               id,
+			Object:           "batch",
+			Endpoint:         endpoint,
+			InputFileID:      inputFileID,
+			CompletionWindow: window,
+			Status:           "validating",
+			OutputFileID:     output.ID,
+			ErrorFileID:      errors.ID,
+			CreatedAt:        now.Unix(),
+			ExpiresAt:        now.Add(batchWindow).Unix(),
+			Metadata:         metadata,
+		},
+	}
+	s.mu.Lock()
+	s.batches[id] = stored
+	s.mu.Unlock()
+	s.update(stored, func(*Batch) {})
+
+	go s.run(stored)
+	b := *stored.Batch
+	return &b, nil
+}
+
+// getBatchHandler implements GET /v1/batches/{id}.
+func getBatchHandler(w http.ResponseWriter, r *http.Request) {
+	b, ok := batches.batch(identityFromContext(r.Context()).KeyID, r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "invalid_request_error", "not_found", "No such batch")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+// cancelBatchHandler implements POST /v1/batches/{id}/cancel. Batches that
+// already finished are returned unchanged.
+func cancelBatchHandler(w http.ResponseWriter, r *http.Request) {
+	owner := identityFromContext(r.Context()).KeyID
+	id := r.PathValue("id")
+	if _, ok := batches.batch(owner, id); !ok {
+		writeJSONError(w, http.StatusNotFound, "invalid_request_error", "not_found", "No such batch")
+		return
+	}
+
+	batches.mu.Lock()
+	stored := batches.batches[id]
+	batches.mu.Unlock()
+	batches.update(stored, func(b *Batch) {
+		if b.Status == "validating" || b.Status == "in_progress" {
+			b.Status = "cancelling"
+			b.CancellingAt = time.Now().Unix()
+		}
+	})
+
+	b, _ := batches.batch(owner, id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
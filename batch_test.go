@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	for _, data := range []string{"first", "second"} {
+		if err := writeFileAtomic(path, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(path); err != nil || string(got) != data {
+			t.Errorf("read %q, %v; want %q", got, err, data)
+		}
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	missing := filepath.Join(t.TempDir(), "gone", "state.json")
+	if err := writeFileAtomic(missing, []byte("x")); err == nil {
+		t.Error("write into a missing directory succeeded")
+	}
+}
+
+func TestBatchStoreQuarantinesCorruptRecords(t *testing.T) {
+	captureLog(t)
+	dir := t.TempDir()
+	records := map[string]string{
+		"files/file-ok.json":     `{"file":{"id":"file-ok","object":"file"},"owner":"k"}`,
+		"files/file-torn.json":   `{"file":{"id":"file-to`,
+		"files/file-empty.json":  `{}`,
+		"batches/batch-ok.json":  `{"batch":{"id":"batch-ok","status":"completed"},"owner":"k"}`,
+		"batches/batch-bad.json": `not json`,
+	}
+	for name, data := range records {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o700)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("BATCH_DIR", dir)
+	s, err := loadBatchStore(func(http.ResponseWriter, *http.Request) {})
+	if err != nil {
+		t.Fatalf("corrupt records failed startup: %v", err)
+	}
+	if len(s.files) != 1 || s.files["file-ok"] == nil || len(s.batches) != 1 || s.batches["batch-ok"] == nil {
+		t.Errorf("loaded files %v, batches %v; want only the good records", s.files, s.batches)
+	}
+	for _, name := range []string{"files/file-torn.json", "files/file-empty.json", "batches/batch-bad.json"} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s still in place", name)
+		}
+		if got, err := os.ReadFile(path + ".corrupt"); err != nil || string(got) != records[name] {
+			t.Errorf("%s.corrupt = %q, %v", name, got, err)
+		}
+	}
+
+	// A second start doesn't see the quarantined records again
+	s, err = loadBatchStore(func(http.ResponseWriter, *http.Request) {})
+	if err != nil || len(s.files) != 1 || len(s.batches) != 1 {
+		t.Errorf("restart: %d files, %d batches, %v", len(s.files), len(s.batches), err)
+	}
+}
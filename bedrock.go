@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// bedrockAdapter translates chat completions to the AWS Bedrock Converse
+// API, signing each request with SigV4. Backends set "region"; the URL
+// defaults to the regional bedrock-runtime endpoint.
+type bedrockAdapter struct{}
+
+// maxEventStreamMessage bounds a single ConverseStream frame.
+const maxEventStreamMessage = 16 << 20
+
+// Bedrock Converse request types
+type bedrockRequest struct {
+	Messages        []bedrockMessage        `json:"messages"`
+	System          []bedrockText           `json:"system,omitempty"`
+	InferenceConfig *bedrockInferenceConfig `json:"inferenceConfig,omitempty"`
+}
+
+type bedrockMessage struct {
+	Role    string        `json:"role"`
+	Content []bedrockText `json:"content"`
+}
+
+type bedrockText struct {
+	Text string `json:"text"`
+}
+
+type bedrockInferenceConfig struct {
+	MaxTokens     *int     `json:"maxTokens,omitempty"`
+	Temperature   *float64 `json:"temperature,omitempty"`
+	TopP          *float64 `json:"topP,omitempty"`
+	StopSequences []string `json:"stopSequences,omitempty"`
+}
+
+// Bedrock Converse response types
+type bedrockResponse struct {
+	Output struct {
+		Message bedrockMessage `json:"message"`
+	} `json:"output"`
+	StopReason string       `json:"stopReason"`
+	Usage      bedrockUsage `json:"usage"`
+}
+
+type bedrockUsage struct {
+	InputTokens  int `json:"inputTokens"`
+	OutputTokens int `json:"outputTokens"`
+	TotalTokens  int `json:"totalTokens"`
+}
+
+func (bedrockAdapter) newRequest(ctx context.Context, backend *Backend, req ChatCompletionRequest, requestID string) (*http.Request, error) {
+	if req.Model == "" {
+		return nil, fmt.Errorf("bedrock backends require a model")
+	}
+
+	body := bedrockRequest{Messages: []bedrockMessage{}}
+	for _, m := range req.Messages {
+		switch m.Role {
+		case "system":
+			body.System = append(body.System, bedrockText{Text: m.Content})
+		case "assistant":
+			body.Messages = append(body.Messages, bedrockMessage{Role: "assistant", Content: []bedrockText{{Text: m.Content}}})
+		default:
+			body.Messages = append(body.Messages, bedrockMessage{Role: "user", Content: []bedrockText{{Text: m.Content}}})
+		}
+	}
+	if req.Temperature != nil || req.TopP != nil || req.MaxTokens != nil || len(req.Stop) > 0 {
+		body.InferenceConfig = &bedrockInferenceConfig{
+			MaxTokens:     req.MaxTokens,
+			Temperature:   req.Temperature,
+			TopP:          req.TopP,
+			StopSequences: req.Stop,
+		}
+	}
+
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	action := "/converse"
+	if req.Stream {
+		action = "/converse-stream"
+	}
+	endpoint := strings.TrimSuffix(backend.URL, "/") + "/model/" + url.PathEscape(req.Model) + action
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	creds, err := loadAWSCredentials(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS credentials: %w", err)
+	}
+	signSigV4(httpReq, reqBody, creds, backend.Region, "bedrock", time.Now())
+
+	httpReq.Header.Set("X-Request-ID", requestID)
+	return httpReq, nil
+}
+
+func (bedrockAdapter) decodeResponse(body io.Reader) (ChatCompletionResponse, error) {
+	var resp bedrockResponse
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return ChatCompletionResponse{}, err
+	}
+
+	var text strings.Builder
+	for _, c := range resp.Output.Message.Content {
+		text.WriteString(c.Text)
+	}
+	return ChatCompletionResponse{
+		Object: "chat.completion",
+		Choices: []Choice{{
+			Index:        0,
+			Message:      Message{Role: "assistant", Content: text.String()},
+			FinishReason: bedrockFinishReason(resp.StopReason),
+		}},
+		Usage: Usage{
+			PromptTokens:     resp.Usage.InputTokens,
+			CompletionTokens: resp.Usage.OutputTokens,
+			TotalTokens:      resp.Usage.TotalTokens,
+		},
+	}, nil
+}
+
+// streamBody converts ConverseStream's binary event stream into OpenAI SSE.
+func (bedrockAdapter) streamBody(body io.ReadCloser, requestID string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		sse := &sseWriter{w: pw, flusher: nopFlusher{}}
+		for {
+			headers, payload, err := readEventStreamMessage(body)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+
+			if headers[":message-type"] == "exception" {
+				pw.CloseWithError(fmt.Errorf("bedrock %s: %s", headers[":exception-type"], payload))
+				return
+			}
+
+			var event struct {
+				Role  string `json:"role"`
+				Delta struct {
+					Text string `json:"text"`
+				} `json:"delta"`
+				StopReason string        `json:"stopReason"`
+				Usage      *bedrockUsage `json:"usage"`
+			}
+			if err := json.Unmarshal(payload, &event); err != nil {
+				pw.CloseWithError(fmt.Errorf("invalid bedrock stream event: %w", err))
+				return
+			}
+
+			switch headers[":event-type"] {
+			case "messageStart":
+				sse.writeChunk(ChatCompletionChunk{
+					ID:      requestID,
+					Object:  "chat.completion.chunk",
+					Choices: []ChunkChoice{{Index: 0, Delta: Delta{Role: "assistant"}}},
+				})
+			case "contentBlockDelta":
+				if event.Delta.Text != "" {
+					sse.writeChunk(ChatCompletionChunk{
+						ID:      requestID,
+						Object:  "chat.completion.chunk",
+						Choices: []ChunkChoice{{Index: 0, Delta: Delta{Content: event.Delta.Text}}},
+					})
+				}
+			case "messageStop":
+				sse.writeChunk(finishChunk(requestID, bedrockFinishReason(event.StopReason)))
+			case "metadata":
+				if u := event.Usage; u != nil {
+					sse.writeChunk(ChatCompletionChunk{
+						ID:      requestID,
+						Object:  "chat.completion.chunk",
+						Choices: []ChunkChoice{},
+						Usage: &Usage{
+							PromptTokens:     u.InputTokens,
+							CompletionTokens: u.OutputTokens,
+							TotalTokens:      u.TotalTokens,
+						},
+					})
+				}
+			}
+		}
+		sse.writeDone()
+		pw.Close()
+	}()
+	return &translatedStream{Reader: pr, pipe: pr, upstream: body}
+}
+
+// readEventStreamMessage reads one frame of the AWS event stream encoding:
+// total length, headers length and prelude CRC (4 bytes each), headers,
+// payload, and a trailing CRC of the whole message. Only string-valued
+// headers are returned; others are skipped.
+func readEventStreamMessage(r io.Reader) (map[string]string, []byte, error) {
+	prelude := make([]byte, 12)
+	if _, err := io.ReadFull(r, prelude); err != nil {
+		return nil, nil, err
+	}
+	if crc32.ChecksumIEEE(prelude[:8]) != binary.BigEndian.Uint32(prelude[8:]) {
+		return nil, nil, fmt.Errorf("event stream prelude checksum mismatch")
+	}
+
+	total := binary.BigEndian.Uint32(prelude[0:4])
+	headersLen := binary.BigEndian.Uint32(prelude[4:8])
+	if total < 16 || total > maxEventStreamMessage || headersLen > total-16 {
+		return nil, nil, fmt.Errorf("invalid event stream frame length %d", total)
+	}
+
+	rest := make([]byte, total-12)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, nil, err
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(prelude)
+	crc.Write(rest[:len(rest)-4])
+	if crc.Sum32() != binary.BigEndian.Uint32(rest[len(rest)-4:]) {
+		return nil, nil, fmt.Errorf("event stream message checksum mismatch")
+	}
+
+	headers := make(map[string]string)
+	raw := rest[:headersLen]
+	for len(raw) > 0 {
+		nameLen := int(raw[0])
+		if len(raw) < 2+nameLen {
+			return nil, nil, fmt.Errorf("truncated event stream header")
+		}
+		name := string(raw[1 : 1+nameLen])
+		valueType := raw[1+nameLen]
+		raw = raw[2+nameLen:]
+
+		// Value sizes by type: bool true/false, byte, short, int, long,
+		// bytes, string, timestamp, uuid
+		var size int
+		switch valueType {
+		case 0, 1:
+			size = 0
+		case 2:
+			size = 1
+		case 3:
+			size = 2
+		case 4:
+			size = 4
+		case 5, 8:
+			size = 8
+		case 9:
+			size = 16
+		case 6, 7:
+			if len(raw) < 2 {
+				return nil, nil, fmt.Errorf("truncated event stream header")
+			}
+			size = 2 + int(binary.BigEndian.Uint16(raw))
+		default:
+			return nil, nil, fmt.Errorf("unknown event stream header type %d", valueType)
+		}
+		if len(raw) < size {
+			return nil, nil, fmt.Errorf("truncated event stream header")
+		}
+		if valueType == 7 {
+			headers[name] = string(raw[2:size])
+		}
+		raw = raw[size:]
+	}
+
+	return headers, rest[headersLen : len(rest)-4], nil
+}
+
+// bedrockFinishReason maps Converse stop reasons onto OpenAI's.
+func bedrockFinishReason(reason string) string {
+	switch reason {
+	case "end_turn", "stop_sequence", "":
+		return "stop"
+	case "max_tokens":
+		return "length"
+	case "content_filtered", "guardrail_intervened":
+		return "content_filter"
+	case "tool_use":
+		return "tool_calls"
+	default:
+		return reason
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// blocklistLookback is how much already-streamed text a streamed chunk is
+// scanned with, so a blocked phrase split across chunks is still caught.
+const blocklistLookback = 256
+
+// BlocklistConfig is the file GUARDRAIL_BLOCKLIST names:
+//
+//	{
+//	  "prompt":     {"keywords": ["project titan"], "patterns": ["\\b\\d{3}-\\d{2}-\\d{4}\\b"]},
+//	  "completion": {"keywords": ["internal use only"], "action": "redact"}
+//	}
+type BlocklistConfig struct {
+	Prompt     *Blocklist `json:"prompt,omitempty"`
+	Completion *Blocklist `json:"completion,omitempty"`
+}
+
+// Blocklist is what one side of a conversation may not contain.
+type Blocklist struct {
+	// Keywords match anywhere, ignoring case
+	Keywords []string `json:"keywords,omitempty"`
+	// Patterns are regular expressions (RE2 syntax)
+	Patterns []string `json:"patterns,omitempty"`
+	// Action is block (default), rejecting the request or ending the
+	// response, or redact, replacing each match with [redacted]
+	Action string `json:"action,omitempty"`
+	// Message is the client-facing error for a block
+	Message string `json:"message,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (b *Blocklist) compile() error {
+	switch b.Action {
+	case "":
+		b.Action = DecisionBlock
+	case DecisionBlock, "redact":
+	default:
+		return fmt.Errorf("unknown action %q: want block or redact", b.Action)
+	}
+	var alts []string
+	if len(b.Keywords) > 0 {
+		quoted := make([]string, len(b.Keywords))
+		for i, k := range b.Keywords {
+			if k == "" {
+				return errors.New("keywords must not be empty")
+			}
+			quoted[i] = regexp.QuoteMeta(k)
+		}
+		alts = append(alts, "(?i:"+strings.Join(quoted, "|")+")")
+	}
+	for _, p := range b.Patterns {
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+		alts = append(alts, "(?:"+p+")")
+	}
+	if len(alts) == 0 {
+		return errors.New("needs keywords or patterns")
+	}
+	b.re = regexp.MustCompile(strings.Join(alts, "|"))
+	return nil
+}
+
+// blocklistGuardrail is the built-in keyword and pattern Guardrail.
+type blocklistGuardrail struct {
+	cfg BlocklistConfig
+}
+
+// newBlocklistGuardrail loads the blocklists from GUARDRAIL_BLOCKLIST.
+func newBlocklistGuardrail() (Guardrail, error) {
+	path := os.Getenv("GUARDRAIL_BLOCKLIST")
+	if path == "" {
+		return nil, errors.New("GUARDRAIL_BLOCKLIST is not set")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var g blocklistGuardrail
+	if err := json.Unmarshal(data, &g.cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if g.cfg.Prompt == nil && g.cfg.Completion == nil {
+		return nil, fmt.Errorf("%s has no prompt or completion blocklist", path)
+	}
+	for side, b := range map[string]*Blocklist{"prompt": g.cfg.Prompt, "completion": g.cfg.Completion} {
+		if b == nil {
+			continue
+		}
+		if err := b.compile(); err != nil {
+			return nil, fmt.Errorf("%s blocklist: %w", side, err)
+		}
+	}
+	return &g, nil
+}
+
+func (g *blocklistGuardrail) CheckRequest(ctx context.Context, rc *RequestContext) (Decision, error) {
+	b := g.cfg.Prompt
+	if b == nil {
+		return Decision{}, nil
+	}
+	var redacted []Message
+	for i, m := range rc.Request.Messages {
+		if !b.re.MatchString(m.Content) {
+			continue
+		}
+		if b.Action == DecisionBlock {
+			return b.block("prompt_blocked", "The prompt contains content this gateway does not allow"), nil
+		}
+		if redacted == nil {
+			redacted = append([]Message(nil), rc.Request.Messages...)
+		}
+		redacted[i].Content = b.re.ReplaceAllString(m.Content, redactedSecret)
+	}
+	if redacted == nil {
+		return Decision{}, nil
+	}
+	return Decision{Action: DecisionMutate, Messages: redacted}, nil
+}
+
+// CheckResponse scans Delta along with the end of the text before it. Only
+// matches that end inside Delta count, so text already checked isn't
+// blocked twice; redaction only reaches the part of a match inside Delta.
+func (g *blocklistGuardrail) CheckResponse(ctx context.Context, rc *RequestContext, rsp *ResponseContent) (Decision, error) {
+	b := g.cfg.Completion
+	if b == nil || rsp.Delta == "" {
+		return Decision{}, nil
+	}
+	prior := len(rsp.Text) - len(rsp.Delta)
+	from := max(0, prior-blocklistLookback)
+	window := rsp.Text[from:]
+	hit := false
+	for _, m := range b.re.FindAllStringIndex(window, -1) {
+		if from+m[1] > prior {
+			hit = true
+			break
+		}
+	}
+	if !hit {
+		return Decision{}, nil
+	}
+	if b.Action == DecisionBlock {
+		return b.block("completion_blocked", "The response contained content this gateway does not allow"), nil
+	}
+	return Decision{Action: DecisionMutate, Content: b.re.ReplaceAllString(rsp.Delta, redactedSecret)}, nil
+}
+
+func (b *Blocklist) block(code, message string) Decision {
+	if b.Message != "" {
+		message = b.Message
+	}
+	return Decision{Action: DecisionBlock, Code: code, Message: message}
+}
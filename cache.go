@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultCacheEntries = 1000
+
+// cacheLookups counts response cache hits, misses and stores, shared by
+// streaming and non-streaming requests.
+var cacheLookups = expvar.NewMap("gateway_response_cache_total")
+
+// responseCache is nil unless RESPONSE_CACHE_TTL is set.
+var responseCache *respCache
+
+// respCache holds completed responses to deterministic requests. Entries
+// are keyed by the request as sent upstream, so a streaming request and
+// its non-streaming twin are cached separately.
+type respCache struct {
+	ttl        time.Duration
+	maxEntries int
+	// pacing is "original" to replay streams at their recorded timing,
+	// otherwise they are replayed as fast as the client reads
+	pacing string
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+// cacheEntry is one cached response: a decoded completion, or the ordered
+// SSE events of a stream that reached [DONE].
+type cacheEntry struct {
+	expires  time.Time
+	response *ChatCompletionResponse
+	events   []cachedEvent
+}
+
+// cachedEvent is one SSE data payload and when it was sent, relative to
+// the start of the stream.
+type cachedEvent struct {
+	data []byte
+	at   time.Duration
+}
+
+// cacheLookup carries a cacheable request's key, and its entry on a hit.
+type cacheLookup struct {
+	key   string
+	entry *cacheEntry
+}
+
+// loadResponseCache reads RESPONSE_CACHE_TTL, RESPONSE_CACHE_MAX_ENTRIES and
+// CACHE_REPLAY_PACING. It returns nil when caching is not configured.
+func loadResponseCache() (*respCache, error) {
+	raw := os.Getenv("RESPONSE_CACHE_TTL")
+	if raw == "" {
+		return nil, nil
+	}
+	ttl, err := time.ParseDuration(raw)
+	if err != nil || ttl <= 0 {
+		return nil, fmt.Errorf("invalid RESPONSE_CACHE_TTL %q", raw)
+	}
+	maxEntries, err := envInt("RESPONSE_CACHE_MAX_ENTRIES")
+	if err != nil {
+		return nil, err
+	}
+	if maxEntries == 0 {
+		maxEntries = defaultCacheEntries
+	}
+	pacing := os.Getenv("CACHE_REPLAY_PACING")
+	switch pacing {
+	case "":
+		pacing = "instant"
+	case "instant", "original":
+	default:
+		return nil, fmt.Errorf("invalid CACHE_REPLAY_PACING %q: want instant or original", pacing)
+	}
+	return &respCache{ttl: ttl, maxEntries: maxEntries, pacing: pacing, entries: make(map[string]*cacheEntry)}, nil
+}
+
+// lookup returns the cache state for a request, or nil when caching is off
+// or the request is not cacheable. Only requests with temperature 0 are
+// cached, scoped to the caller's key and the catalog model.
+func (c *respCache) lookup(owner, model string, req ChatCompletionRequest) *cacheLookup {
+	if c == nil || req.Temperature == nil || *req.Temperature != 0 {
+		return nil
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", owner, model)
+	h.Write(data)
+	l := &cacheLookup{key: hex.EncodeToString(h.Sum(nil))}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[l.key]; ok && time.Now().Before(e.expires) {
+		l.entry = e
+		cacheLookups.Add("hit", 1)
+	} else {
+		cacheLookups.Add("miss", 1)
+	}
+	return l
+}
+
+// store saves a completed response under l's key.
+func (c *respCache) store(l *cacheLookup, e *cacheEntry) {
+	now := time.Now()
+	e.expires = now.Add(c.ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.maxEntries {
+		for k, old := range c.entries {
+			if now.After(old.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			c.entries = make(map[string]*cacheEntry)
+		}
+	}
+	c.entries[l.key] = e
+	cacheLookups.Add("store", 1)
+}
+
+// replay renders a cached stream as an SSE body for the stream relay,
+// which rewrites the chunk IDs for the new request.
+func (c *respCache) replay(ctx context.Context, e *cacheEntry) io.ReadCloser {
+	if c.pacing != "original" {
+		var buf bytes.Buffer
+		for _, ev := range e.events {
+			fmt.Fprintf(&buf, "data: %s\n\n", ev.data)
+		}
+		return io.NopCloser(&buf)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		start := time.Now()
+		for _, ev := range e.events {
+			if wait := ev.at - time.Since(start); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					pw.CloseWithError(ctx.Err())
+					return
+				}
+			}
+			if _, err := fmt.Fprintf(pw, "data: %s\n\n", ev.data); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+	return pr
+}
+
+// streamRecording collects the events written to a client so a stream that
+// completes can be cached.
+type streamRecording struct {
+	start  time.Time
+	events []cachedEvent
+}
+
+func (s *streamRecording) add(data []byte) {
+	s.events = append(s.events, cachedEvent{data: bytes.Clone(data), at: time.Since(s.start)})
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// ModelInfo describes what a model supports and what it costs.
+type ModelInfo struct {
+	ID               string  `json:"id"`
+	ContextWindow    int     `json:"context_window,omitempty"`
+	MaxOutputTokens  int     `json:"max_output_tokens,omitempty"`
+	SupportsVision   bool    `json:"supports_vision"`
+	SupportsTools    bool    `json:"supports_tools"`
+	SupportsJSONMode bool    `json:"supports_json_mode"`
+	Pricing          Pricing `json:"pricing"`
+
+	// Backend names the backend serving this model; empty means the default
+	Backend string `json:"backend,omitempty"`
+
+	// UpstreamModel is the model ID sent to the backend when it differs
+	// from the public alias (e.g. a Bedrock model ARN)
+	UpstreamModel string `json:"upstream_model,omitempty"`
+
+	// Aliases are other names clients may request this model by; they are
+	// matched after model name normalization
+	Aliases []string `json:"aliases,omitempty"`
+
+	// RevealResolvedName reports this model's ID in responses to requests
+	// that named it by an alias or unnormalized name, rather than the name
+	// the client sent
+	RevealResolvedName bool `json:"reveal_resolved_name,omitempty"`
+
+	// ChatTemplate renders messages into a prompt for tgi backends: a
+	// built-in name (llama-3, chatml) or a Go text/template
+	ChatTemplate string `json:"chat_template,omitempty"`
+
+	// Deprecated models keep working but carry warning headers; after
+	// SunsetDate (YYYY-MM-DD, UTC) requests are rejected naming Replacement
+	Deprecated  bool   `json:"deprecated,omitempty"`
+	SunsetDate  string `json:"sunset_date,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+
+	// Ensemble makes this a synthetic model answered by its member models
+	Ensemble *Ensemble `json:"ensemble,omitempty"`
+
+	// DegradedResponse, if set, is returned as a 200 completion when the
+	// model's backend is unreachable or returns 5xx
+	DegradedResponse string `json:"degraded_response,omitempty"`
+
+	// EnforceStop applies stop sequences in the gateway, streaming and
+	// not, for backends that ignore the parameter
+	EnforceStop bool `json:"enforce_stop,omitempty"`
+
+	// RequireUserMessage rejects requests for this model whose messages
+	// have no user turn, for backends whose chat templates fail without one
+	RequireUserMessage bool `json:"require_user_message,omitempty"`
+
+	chatTemplate *template.Template
+	sunset       time.Time
+
+	// source records where the entry came from: "discovery" or "file"
+	source string
+}
+
+// Pricing is the per-1K-token price in USD.
+type Pricing struct {
+	PromptPer1K     float64 `json:"prompt_per_1k"`
+	CompletionPer1K float64 `json:"completion_per_1k"`
+}
+
+// modelCatalog indexes models by ID. It is immutable once built; reloads
+// swap in a new catalog.
+type modelCatalog struct {
+	models   map[string]*ModelInfo
+	backends map[string]*Backend
+	// names maps normalized model IDs and aliases to model IDs
+	names     map[string]string
+	nameRules modelNameRules
+	// generation counts the catalogs loaded since startup, this one
+	// included; loadedAt is when it was loaded
+	generation int64
+	loadedAt   time.Time
+}
+
+// catalog is the active model catalog, replaced atomically on SIGHUP.
+var catalog atomic.Pointer[modelCatalog]
+
+// catalogLoads numbers the catalogs loadCatalog builds.
+var catalogLoads atomic.Int64
+
+func init() {
+	catalog.Store(&modelCatalog{models: map[string]*ModelInfo{}, backends: map[string]*Backend{}})
+}
+
+func (c *modelCatalog) lookup(id string) (*ModelInfo, bool) {
+	m, ok := c.models[id]
+	return m, ok
+}
+
+// lookupUpstream finds the model whose upstream_model is id.
+func (c *modelCatalog) lookupUpstream(id string) (*ModelInfo, bool) {
+	for _, m := range c.models {
+		if m.UpstreamModel == id {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// sorted returns the models ordered by ID.
+func (c *modelCatalog) sorted() []*ModelInfo {
+	models := make([]*ModelInfo, 0, len(c.models))
+	for _, m := range c.models {
+		models = append(models, m)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].ID < models[j].ID })
+	return models
+}
+
+// loadCatalog builds the catalog from the backend's /v1/models (when
+// MODEL_DISCOVERY=true) overlaid with the JSON file at MODEL_CATALOG:
+//
+//	{
+//	  "backends": {"vllm-a": {"type": "vllm", "url": "http://vllm-a:8000"}},
+//	  "models": [
+//	    {"id": "llama-3-70b", "backend": "vllm-a", "supports_tools": true, ...},
+//	    {"id": "mock-gpt", "backend": "echo"}
+//	  ]
+//	}
+func loadCatalog() (*modelCatalog, error) {
+	c := &modelCatalog{
+		models:   make(map[string]*ModelInfo),
+		backends: make(map[string]*Backend),
+	}
+
+	if os.Getenv("MODEL_DISCOVERY") == "true" {
+		ids, err := discoverModels(os.Getenv("BACKEND_URL"))
+		if err != nil {
+			// Discovery is best-effort; configured entries still apply
+			log.Printf("Model discovery failed: %v", err)
+		}
+		for _, id := range ids {
+			c.models[id] = &ModelInfo{ID: id, source: "discovery"}
+		}
+	}
+
+	path := os.Getenv("MODEL_CATALOG")
+	if path == "" {
+		return c, c.indexNames()
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalog: %w", err)
+	}
+	var file struct {
+		Backends map[string]*Backend `json:"backends"`
+		Models   []*ModelInfo        `json:"models"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse catalog: %w", err)
+	}
+	for name, b := range file.Backends {
+		if name == echoBackend.Name {
+			return nil, fmt.Errorf("backend name %q is reserved", name)
+		}
+		if b.Type == "bedrock" {
+			if b.Region == "" {
+				return nil, fmt.Errorf("bedrock backend %q missing region", name)
+			}
+			if b.URL == "" {
+				b.URL = "https://bedrock-runtime." + b.Region + ".amazonaws.com"
+			}
+		}
+		if b.URL == "" && len(b.URLs) > 0 {
+			b.URL = b.URLs[0]
+		}
+		if b.URL == "" {
+			return nil, fmt.Errorf("backend %q missing url", name)
+		}
+		if b.Type == "" {
+			b.Type = "openai"
+		}
+		if err := b.validateRegions(); err != nil {
+			return nil, fmt.Errorf("backend %q: %w", name, err)
+		}
+		if b.Balancing != nil {
+			if err := b.Balancing.validate(b.endpoints()); err != nil {
+				return nil, fmt.Errorf("backend %q: %w", name, err)
+			}
+		}
+		if _, ok := adapters[b.Type]; !ok {
+			return nil, fmt.Errorf("backend %q has unknown type %q", name, b.Type)
+		}
+		if !validMaxTokensField(b.MaxTokensField) {
+			return nil, fmt.Errorf("backend %q has unknown max_tokens_field %q", name, b.MaxTokensField)
+		}
+		if err := b.resolveSecrets(); err != nil {
+			return nil, fmt.Errorf("backend %q: %w", name, err)
+		}
+		if !validAcceptEncoding(b.AcceptEncoding) {
+			return nil, fmt.Errorf("backend %q has unknown accept_encoding %q: want gzip or identity", name, b.AcceptEncoding)
+		}
+		if b.Responses && b.Type != "openai" && b.Type != "vllm" {
+			return nil, fmt.Errorf("backend %q: responses is not supported for %s backends", name, b.Type)
+		}
+		if b.RequestCompression != nil {
+			if err := b.RequestCompression.validate(b.Type); err != nil {
+				return nil, fmt.Errorf("backend %q: %w", name, err)
+			}
+		}
+		if b.RequestFields != nil {
+			if err := b.RequestFields.validate(b.Type); err != nil {
+				return nil, fmt.Errorf("backend %q: %w", name, err)
+			}
+		}
+		if b.Paths != nil {
+			if err := b.Paths.validate(b.Type); err != nil {
+				return nil, fmt.Errorf("backend %q: %w", name, err)
+			}
+		}
+		if b.Pool != nil {
+			if err := b.Pool.validate(); err != nil {
+				return nil, fmt.Errorf("backend %q: %w", name, err)
+			}
+		}
+		if b.Proxy != nil {
+			if err := b.Proxy.validate(); err != nil {
+				return nil, fmt.Errorf("backend %q: %w", name, err)
+			}
+		}
+		if b.Shedding != nil {
+			if err := b.Shedding.validate(b.URL); err != nil {
+				return nil, fmt.Errorf("backend %q: %w", name, err)
+			}
+		}
+		if b.Queue != nil {
+			if err := b.Queue.validate(); err != nil {
+				return nil, fmt.Errorf("backend %q: %w", name, err)
+			}
+		}
+		if b.Warmup != nil {
+			if err := b.Warmup.validate(); err != nil {
+				return nil, fmt.Errorf("backend %q: %w", name, err)
+			}
+		}
+		if b.SelfTest != nil {
+			if err := b.SelfTest.validate(); err != nil {
+				return nil, fmt.Errorf("backend %q: %w", name, err)
+			}
+		}
+		b.Name = name
+		c.backends[name] = b
+	}
+	for _, m := range file.Models {
+		if m.ID == "" {
+			return nil, fmt.Errorf("catalog entry missing id")
+		}
+		if _, ok := c.backends[m.Backend]; m.Backend != "" && m.Backend != echoBackend.Name && !ok {
+			return nil, fmt.Errorf("model %q references unknown backend %q", m.ID, m.Backend)
+		}
+		if m.ChatTemplate != "" {
+			tmpl, err := parseChatTemplate(m.ChatTemplate)
+			if err != nil {
+				return nil, fmt.Errorf("model %q has invalid chat_template: %w", m.ID, err)
+			}
+			m.chatTemplate = tmpl
+		}
+		if m.SunsetDate != "" {
+			sunset, err := time.Parse(sunsetDateLayout, m.SunsetDate)
+			if err != nil {
+				return nil, fmt.Errorf("model %q has invalid sunset_date: %w", m.ID, err)
+			}
+			m.sunset = sunset
+		}
+		m.source = "file"
+		c.models[m.ID] = m
+	}
+	if err := validateEnsembles(c); err != nil {
+		return nil, err
+	}
+	if err := checkBackendModels(c); err != nil {
+		return nil, err
+	}
+	if err := c.indexNames(); err != nil {
+		return nil, err
+	}
+	if err := transparentRoutes.checkCatalog(c); err != nil {
+		return nil, err
+	}
+	if err := comparisons.checkCatalog(c); err != nil {
+		return nil, err
+	}
+	c.generation, c.loadedAt = catalogLoads.Add(1), time.Now()
+	return c, nil
+}
+
+// reloadCatalog swaps in a freshly loaded catalog, keeping the old one on error.
+func reloadCatalog() {
+	c, err := loadCatalog()
+	if err != nil {
+		log.Printf("Catalog reload failed, keeping previous catalog: %v", err)
+		return
+	}
+	prev, drained := generations.swap(c)
+	log.Printf("Loaded model catalog generation %d with %d models", c.generation, len(c.models))
+	warmCatalog(prev, c, "reload")
+	shedCatalog(c)
+	go func(start time.Time) {
+		<-drained
+		log.Printf("Catalog generation %d drained %s after reload", prev.generation, time.Since(start).Round(time.Millisecond))
+	}(time.Now())
+}
+
+// discoverModels lists model IDs from an OpenAI-compatible /v1/models.
+func discoverModels(base string) ([]string, error) {
+	if base == "" {
+		return nil, nil
+	}
+
+	resp, err := httpClient.Get(backendURL(base, defaultModelsPath))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &backendStatusError{StatusCode: resp.StatusCode}
+	}
+
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(list.Data))
+	for _, m := range list.Data {
+		ids = append(ids, m.ID)
+	}
+	return ids, nil
+}
+
+// checkModelCapabilities rejects requests using features the catalog says
+// the model lacks. Models missing from the catalog are not checked.
+func (c *modelCatalog) checkModelCapabilities(req ChatCompletionRequest) error {
+	m, ok := c.lookup(req.Model)
+	if !ok {
+		return nil
+	}
+	if len(req.Tools) > 0 && !m.SupportsTools {
+		return fmt.Errorf("model %q does not support tools", m.ID)
+	}
+	if req.ResponseFormat != nil && req.ResponseFormat.Type == "json_object" && !m.SupportsJSONMode {
+		return fmt.Errorf("model %q does not support JSON mode", m.ID)
+	}
+	if req.MaxTokens != nil && m.MaxOutputTokens > 0 && *req.MaxTokens > m.MaxOutputTokens {
+		return fmt.Errorf("max_tokens %d exceeds the %d output tokens supported by model %q", *req.MaxTokens, m.MaxOutputTokens, m.ID)
+	}
+	return nil
+}
+
+// Model list types (OpenAI-style)
+type ModelList struct {
+	Object string        `json:"object"`
+	Data   []ModelObject `json:"data"`
+}
+
+type ModelObject struct {
+	ID      string     `json:"id"`
+	Object  string     `json:"object"`
+	OwnedBy string     `json:"owned_by"`
+	Gateway *ModelInfo `json:"gateway"`
+}
+
+func modelsHandler(w http.ResponseWriter, r *http.Request) {
+	list := ModelList{Object: "list", Data: []ModelObject{}}
+	for _, m := range catalog.Load().sorted() {
+		list.Data = append(list.Data, ModelObject{
+			ID:      m.ID,
+			Object:  "model",
+			OwnedBy: "gateway",
+			Gateway: m,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
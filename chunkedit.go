@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// rawObject is a JSON object's members in order, each value as it was
+// sent, so a chunk can be changed without dropping or reordering the fields
+// the gateway doesn't model.
+type rawObject []rawMember
+
+type rawMember struct {
+	key   string
+	value json.RawMessage
+}
+
+func parseRawObject(data []byte) (rawObject, bool) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, false
+	}
+	obj := rawObject{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, false
+		}
+		key, _ := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, false
+		}
+		obj = append(obj, rawMember{key: key, value: value})
+	}
+	return obj, true
+}
+
+// get returns key's value, or nil. As in encoding/json, the last of
+// duplicate keys wins.
+func (o rawObject) get(key string) json.RawMessage {
+	for i := len(o) - 1; i >= 0; i-- {
+		if o[i].key == key {
+			return o[i].value
+		}
+	}
+	return nil
+}
+
+// set replaces key's value, or adds key last.
+func (o *rawObject) set(key string, value json.RawMessage) {
+	for i := range *o {
+		if (*o)[i].key == key {
+			(*o)[i].value = value
+			return
+		}
+	}
+	*o = append(*o, rawMember{key: key, value: value})
+}
+
+func (o *rawObject) delete(key string) {
+	kept := (*o)[:0]
+	for _, m := range *o {
+		if m.key != key {
+			kept = append(kept, m)
+		}
+	}
+	*o = kept
+}
+
+func (o rawObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(m.key)
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(m.value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// isNull reports whether a raw value is absent or null.
+func isNull(v json.RawMessage) bool {
+	return len(v) == 0 || string(v) == "null"
+}
+
+// chunkEdit changes a chunk event's choices, by their position in the
+// choices array, and its top-level fields. The event is only parsed once
+// something changes, so events left alone pass byte-for-byte.
+type chunkEdit struct {
+	data    []byte
+	obj     rawObject
+	choices []rawObject
+	dropped []bool
+	// parsed is set once obj and choices hold the event; failed when it
+	// couldn't be parsed, which leaves the event unchanged
+	parsed, failed bool
+	changed        bool
+}
+
+func (e *chunkEdit) parse() bool {
+	if e.parsed {
+		return !e.failed
+	}
+	e.parsed = true
+	obj, ok := parseRawObject(e.data)
+	var choices []json.RawMessage
+	if ok && !isNull(obj.get("choices")) {
+		ok = json.Unmarshal(obj.get("choices"), &choices) == nil
+	}
+	for _, c := range choices {
+		choice, valid := parseRawObject(c)
+		ok = ok && valid
+		e.choices = append(e.choices, choice)
+	}
+	e.obj, e.dropped, e.failed = obj, make([]bool, len(e.choices)), !ok
+	return ok
+}
+
+// dropField removes a top-level field.
+func (e *chunkEdit) dropField(key string) {
+	if e.parse() {
+		e.obj.delete(key)
+		e.changed = true
+	}
+}
+
+// dropChoice removes the choice at position i.
+func (e *chunkEdit) dropChoice(i int) {
+	if e.parse() && i < len(e.choices) {
+		e.dropped[i] = true
+		e.changed = true
+	}
+}
+
+// setContent replaces the delta content of the choice at position i;
+// empty content is left out, as the gateway's own chunks leave it out.
+func (e *chunkEdit) setContent(i int, content string) {
+	if !e.parse() || i >= len(e.choices) {
+		return
+	}
+	delta, ok := parseRawObject(e.choices[i].get("delta"))
+	if !ok {
+		delta = rawObject{}
+	}
+	if content == "" {
+		delta.delete("content")
+	} else {
+		quoted, _ := json.Marshal(content)
+		delta.set("content", quoted)
+	}
+	value, _ := delta.MarshalJSON()
+	e.choices[i].set("delta", value)
+	e.changed = true
+}
+
+// setFinishReason sets the finish_reason of the choice at position i.
+func (e *chunkEdit) setFinishReason(i int, reason string) {
+	if !e.parse() || i >= len(e.choices) {
+		return
+	}
+	quoted, _ := json.Marshal(reason)
+	e.choices[i].set("finish_reason", quoted)
+	e.changed = true
+}
+
+// empty reports whether the chunk, as edited, carries nothing for the
+// client: no choice left with content, any other delta field, logprobs or
+// a finish_reason. Only a changed chunk can be empty; one the backend sent
+// that way passes as it was.
+func (e *chunkEdit) empty() bool {
+	if !e.changed || e.failed {
+		return false
+	}
+	for i, c := range e.choices {
+		if e.dropped[i] {
+			continue
+		}
+		if !isNull(c.get("finish_reason")) || !isNull(c.get("logprobs")) {
+			return false
+		}
+		delta, _ := parseRawObject(c.get("delta"))
+		for _, m := range delta {
+			if !isNull(m.value) && (m.key != "content" || string(m.value) != `""`) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// bytes returns the event as edited.
+func (e *chunkEdit) bytes() []byte {
+	if !e.changed || e.failed {
+		return e.data
+	}
+	if e.obj.get("choices") != nil {
+		var b bytes.Buffer
+		b.WriteByte('[')
+		for i, c := range e.choices {
+			if e.dropped[i] {
+				continue
+			}
+			if b.Len() > 1 {
+				b.WriteByte(',')
+			}
+			value, _ := c.MarshalJSON()
+			b.Write(value)
+		}
+		b.WriteByte(']')
+		e.obj.set("choices", b.Bytes())
+	}
+	data, _ := e.obj.MarshalJSON()
+	return data
+}
@@ -0,0 +1,300 @@
+// Package client calls the gateway's APIs beyond OpenAI's chat
+// completions: API key administration, usage, batches and dry runs.
+//
+//	admin := client.New("https://gateway.internal", os.Getenv("ADMIN_TOKEN"))
+//	key, err := admin.CreateKey(ctx, client.KeyRequest{Name: client.Ptr("search-indexer")})
+//	...
+//	app := client.New("https://gateway.internal", key.Key)
+//	report, err := app.DryRun(ctx, map[string]any{"model": "llama-3-8b", "messages": msgs})
+//
+// Admin methods need a client made with ADMIN_TOKEN; the rest need a key
+// the gateway accepts. Errors the gateway answers with are *Error.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// dryRunHeader asks the gateway for a dry-run report.
+const dryRunHeader = "X-Gateway-Dry-Run"
+
+// Client calls one gateway with one bearer token.
+type Client struct {
+	// BaseURL is the gateway's address, such as https://gateway.internal;
+	// a path prefix is kept
+	BaseURL string
+	// Token is sent as the bearer token: ADMIN_TOKEN for admin methods,
+	// an API key for the rest
+	Token string
+	// HTTPClient sends the requests (default http.DefaultClient)
+	HTTPClient *http.Client
+}
+
+// New returns a client for the gateway at baseURL.
+func New(baseURL, token string) *Client {
+	return &Client{BaseURL: baseURL, Token: token}
+}
+
+// Error is an error response from the gateway.
+type Error struct {
+	Status  int
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("gateway: %d %s: %s", e.Status, e.Code, e.Message)
+	}
+	return fmt.Sprintf("gateway: %d: %s", e.Status, e.Message)
+}
+
+// Ptr returns a pointer to v, for the optional fields of KeyRequest.
+func Ptr[T any](v T) *T {
+	return &v
+}
+
+// CreateKey creates an API key. The result is the only time its plaintext
+// Key is shown.
+func (c *Client) CreateKey(ctx context.Context, req KeyRequest) (*CreatedKey, error) {
+	var out CreatedKey
+	return &out, c.doJSON(ctx, http.MethodPost, "/admin/keys", req, &out)
+}
+
+// ListKeys lists every API key, oldest first.
+func (c *Client) ListKeys(ctx context.Context) ([]APIKey, error) {
+	var out struct {
+		Data []APIKey `json:"data"`
+	}
+	err := c.doJSON(ctx, http.MethodGet, "/admin/keys", nil, &out)
+	return out.Data, err
+}
+
+// UpdateKey changes the fields req sets on key id.
+func (c *Client) UpdateKey(ctx context.Context, id string, req KeyRequest) (*APIKey, error) {
+	var out APIKey
+	return &out, c.doJSON(ctx, http.MethodPatch, "/admin/keys/"+url.PathEscape(id), req, &out)
+}
+
+// DeleteKey deletes key id, and its children with it.
+func (c *Client) DeleteKey(ctx context.Context, id string) error {
+	return c.doJSON(ctx, http.MethodDelete, "/admin/keys/"+url.PathEscape(id), nil, nil)
+}
+
+// GetUsage returns key id's budget status in its current period, broken
+// down by child for a team key.
+func (c *Client) GetUsage(ctx context.Context, id string) (*KeyUsage, error) {
+	var out KeyUsage
+	return &out, c.doJSON(ctx, http.MethodGet, "/admin/keys/"+url.PathEscape(id)+"/usage", nil, &out)
+}
+
+// UsageQuery selects the rows of a usage export. From and To are UTC days
+// as YYYY-MM-DD and default to today; Parent limits the rows to a team key
+// and its children.
+type UsageQuery struct {
+	From, To string
+	Parent   string
+}
+
+// ExportUsage returns the daily usage rows the query selects.
+func (c *Client) ExportUsage(ctx context.Context, q UsageQuery) ([]UsageRow, error) {
+	v := url.Values{"format": {"jsonl"}}
+	for name, value := range map[string]string{"from": q.From, "to": q.To, "parent": q.Parent} {
+		if value != "" {
+			v.Set(name, value)
+		}
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/admin/usage/export?"+v.Encode(), "", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var rows []UsageRow
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var row UsageRow
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return nil, fmt.Errorf("gateway: invalid usage row: %w", err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+// UploadFile uploads a batch input file: JSON lines, each a request to
+// /v1/chat/completions.
+func (c *Client) UploadFile(ctx context.Context, filename string, content io.Reader) (*File, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("purpose", "batch")
+	part, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, content); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/v1/files", mw.FormDataContentType(), &body, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var out File
+	return &out, decode(resp, &out)
+}
+
+// CreateBatch starts a batch over an uploaded input file. Endpoint and
+// CompletionWindow default to the only values the gateway supports.
+func (c *Client) CreateBatch(ctx context.Context, req CreateBatchRequest) (*Batch, error) {
+	if req.Endpoint == "" {
+		req.Endpoint = "/v1/chat/completions"
+	}
+	if req.CompletionWindow == "" {
+		req.CompletionWindow = "24h"
+	}
+	var out Batch
+	return &out, c.doJSON(ctx, http.MethodPost, "/v1/batches", req, &out)
+}
+
+// SubmitBatch uploads the JSON lines in input and starts a batch over them.
+func (c *Client) SubmitBatch(ctx context.Context, input io.Reader, metadata map[string]string) (*Batch, error) {
+	f, err := c.UploadFile(ctx, "batch.jsonl", input)
+	if err != nil {
+		return nil, err
+	}
+	return c.CreateBatch(ctx, CreateBatchRequest{InputFileID: f.ID, Metadata: metadata})
+}
+
+// GetBatch returns batch id as it stands.
+func (c *Client) GetBatch(ctx context.Context, id string) (*Batch, error) {
+	var out Batch
+	return &out, c.doJSON(ctx, http.MethodGet, "/v1/batches/"+url.PathEscape(id), nil, &out)
+}
+
+// CancelBatch stops batch id; requests already sent still finish.
+func (c *Client) CancelBatch(ctx context.Context, id string) (*Batch, error) {
+	var out Batch
+	return &out, c.doJSON(ctx, http.MethodPost, "/v1/batches/"+url.PathEscape(id)+"/cancel", nil, &out)
+}
+
+// FileContent returns a file's content, such as a batch's output file.
+// The caller closes it.
+func (c *Client) FileContent(ctx context.Context, id string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/v1/files/"+url.PathEscape(id)+"/content", "", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// DryRun reports what the gateway would do with a chat completions
+// request, which may be any value that encodes to one, without calling a
+// backend. The key must be allowed dry runs.
+func (c *Client) DryRun(ctx context.Context, req any) (*DryRunReport, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/v1/chat/completions", "application/json", bytes.NewReader(data), http.Header{dryRunHeader: {"true"}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var out DryRunReport
+	return &out, decode(resp, &out)
+}
+
+// doJSON sends in, when not nil, as JSON and decodes the response into out,
+// when not nil.
+func (c *Client) doJSON(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	contentType := ""
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body, contentType = bytes.NewReader(data), "application/json"
+	}
+	resp, err := c.do(ctx, method, path, contentType, body, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return decode(resp, out)
+}
+
+// do sends a request and returns the response if its status is 2xx;
+// anything else is returned as an *Error.
+func (c *Client) do(ctx context.Context, method, path, contentType string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.BaseURL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, readError(resp)
+}
+
+// readError reads an OpenAI-style error body, or takes a plain one as the
+// message.
+func readError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var body struct {
+		Error *Error `json:"error"`
+	}
+	if json.Unmarshal(data, &body) == nil && body.Error != nil {
+		body.Error.Status = resp.StatusCode
+		return body.Error
+	}
+	e := &Error{Status: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+	if e.Message == "" {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
+
+func decode(resp *http.Response, out any) error {
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("gateway: invalid response: %w", err)
+	}
+	return nil
+}
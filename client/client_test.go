@@ -0,0 +1,234 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// gateway is a fake gateway: each handler answers one route, and the
+// requests it sees are checked for the client's token.
+func gateway(t *testing.T, handlers map[string]http.HandlerFunc) *Client {
+	t.Helper()
+	mux := http.NewServeMux()
+	for pattern, h := range handlers {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			if got := r.Header.Get("Authorization"); got != "Bearer tok" {
+				t.Errorf("%s: Authorization = %q", pattern, got)
+			}
+			h(w, r)
+		})
+	}
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	// A trailing slash on the base URL is tolerated
+	return New(srv.URL+"/", "tok")
+}
+
+func reply(status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}
+}
+
+// decodeBody decodes r's JSON body into v, failing the test otherwise.
+func decodeBody(t *testing.T, r *http.Request, v any) {
+	t.Helper()
+	if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		t.Errorf("request body: %v", err)
+	}
+}
+
+func TestKeyMethods(t *testing.T) {
+	ctx := context.Background()
+	c := gateway(t, map[string]http.HandlerFunc{
+		"POST /admin/keys": func(w http.ResponseWriter, r *http.Request) {
+			var req map[string]any
+			decodeBody(t, r, &req)
+			if len(req) != 2 || req["name"] != "indexer" || req["dry_run"] != true {
+				t.Errorf("create body = %v, want only the fields set", req)
+			}
+			reply(http.StatusCreated, `{"id":"k1","name":"indexer","dry_run":true,"key":"gw-secret"}`)(w, r)
+		},
+		"GET /admin/keys": reply(http.StatusOK, `{"object":"list","data":[{"id":"k1"},{"id":"k2","parent_id":"k1"}]}`),
+		"PATCH /admin/keys/{id}": func(w http.ResponseWriter, r *http.Request) {
+			var req KeyRequest
+			decodeBody(t, r, &req)
+			if r.PathValue("id") != "a/b" || req.Disabled == nil || !*req.Disabled {
+				t.Errorf("update %s with %+v", r.PathValue("id"), req)
+			}
+			reply(http.StatusOK, `{"id":"a/b","disabled":true}`)(w, r)
+		},
+		"DELETE /admin/keys/{id}":    reply(http.StatusOK, `{"deleted":["k1","k2"]}`),
+		"GET /admin/keys/{id}/usage": reply(http.StatusOK, `{"key_id":"k1","period":"2026-10","used_tokens":30,"children":[{"key_id":"k2","used_tokens":10}]}`),
+	})
+
+	created, err := c.CreateKey(ctx, KeyRequest{Name: Ptr("indexer"), DryRun: Ptr(true)})
+	if err != nil || created.ID != "k1" || created.Key != "gw-secret" || !created.DryRun {
+		t.Errorf("CreateKey = %+v, %v", created, err)
+	}
+	keys, err := c.ListKeys(ctx)
+	if err != nil || len(keys) != 2 || keys[1].ParentID != "k1" {
+		t.Errorf("ListKeys = %+v, %v", keys, err)
+	}
+	// The ID is escaped as one path segment
+	updated, err := c.UpdateKey(ctx, "a/b", KeyRequest{Disabled: Ptr(true)})
+	if err != nil || updated.ID != "a/b" || !updated.Disabled {
+		t.Errorf("UpdateKey = %+v, %v", updated, err)
+	}
+	if err := c.DeleteKey(ctx, "k1"); err != nil {
+		t.Errorf("DeleteKey = %v", err)
+	}
+	usage, err := c.GetUsage(ctx, "k1")
+	if err != nil || usage.UsedTokens != 30 || len(usage.Children) != 1 || usage.Children[0].KeyID != "k2" {
+		t.Errorf("GetUsage = %+v, %v", usage, err)
+	}
+}
+
+func TestExportUsage(t *testing.T) {
+	c := gateway(t, map[string]http.HandlerFunc{
+		"GET /admin/usage/export": func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			if q.Get("format") != "jsonl" || q.Get("from") != "2026-10-01" || q.Get("parent") != "team" || q.Has("to") {
+				t.Errorf("query = %v", q)
+			}
+			io.WriteString(w, `{"date":"2026-10-01","key_id":"k1","model":"m","requests":2,"total_tokens":40,"cost_usd":0.5}`+"\n\n"+
+				`{"date":"2026-10-02","key_id":"k1","model":"m","requests":1,"total_tokens":10}`+"\n")
+		},
+	})
+	rows, err := c.ExportUsage(context.Background(), UsageQuery{From: "2026-10-01", Parent: "team"})
+	if err != nil || len(rows) != 2 || rows[0].CostUSD != 0.5 || rows[1].Date != "2026-10-02" {
+		t.Errorf("ExportUsage = %+v, %v", rows, err)
+	}
+}
+
+func TestExportUsageRejectsBadRow(t *testing.T) {
+	c := gateway(t, map[string]http.HandlerFunc{"GET /admin/usage/export": reply(http.StatusOK, "{\"date\":\"x\"}\nnot json\n")})
+	if _, err := c.ExportUsage(context.Background(), UsageQuery{}); err == nil || !strings.Contains(err.Error(), "invalid usage row") {
+		t.Errorf("ExportUsage = %v, want an invalid row error", err)
+	}
+}
+
+func TestBatchMethods(t *testing.T) {
+	ctx := context.Background()
+	c := gateway(t, map[string]http.HandlerFunc{
+		"POST /v1/files": func(w http.ResponseWriter, r *http.Request) {
+			f, header, err := r.FormFile("file")
+			if err != nil {
+				t.Fatalf("upload: %v", err)
+			}
+			content, _ := io.ReadAll(f)
+			if r.FormValue("purpose") != "batch" || header.Filename != "batch.jsonl" || string(content) != `{"custom_id":"1"}` {
+				t.Errorf("upload %q of %q, purpose %q", header.Filename, content, r.FormValue("purpose"))
+			}
+			reply(http.StatusOK, `{"id":"file-1","object":"file","filename":"batch.jsonl","purpose":"batch"}`)(w, r)
+		},
+		"POST /v1/batches": func(w http.ResponseWriter, r *http.Request) {
+			var req CreateBatchRequest
+			decodeBody(t, r, &req)
+			want := CreateBatchRequest{InputFileID: "file-1", Endpoint: "/v1/chat/completions", CompletionWindow: "24h", Metadata: map[string]string{"job": "nightly"}}
+			if req.InputFileID != want.InputFileID || req.Endpoint != want.Endpoint || req.CompletionWindow != want.CompletionWindow || req.Metadata["job"] != "nightly" {
+				t.Errorf("create batch = %+v, want %+v", req, want)
+			}
+			reply(http.StatusOK, `{"id":"batch-1","status":"validating","input_file_id":"file-1"}`)(w, r)
+		},
+		"GET /v1/batches/{id}":         reply(http.StatusOK, `{"id":"batch-1","status":"completed","output_file_id":"file-2","request_counts":{"total":1,"completed":1}}`),
+		"POST /v1/batches/{id}/cancel": reply(http.StatusOK, `{"id":"batch-1","status":"cancelling"}`),
+		"GET /v1/files/{id}/content":   reply(http.StatusOK, `{"custom_id":"1","response":{}}`+"\n"),
+	})
+
+	batch, err := c.SubmitBatch(ctx, strings.NewReader(`{"custom_id":"1"}`), map[string]string{"job": "nightly"})
+	if err != nil || batch.ID != "batch-1" || batch.Status != "validating" {
+		t.Fatalf("SubmitBatch = %+v, %v", batch, err)
+	}
+	batch, err = c.GetBatch(ctx, "batch-1")
+	if err != nil || batch.OutputFileID != "file-2" || batch.RequestCounts.Completed != 1 {
+		t.Errorf("GetBatch = %+v, %v", batch, err)
+	}
+	if batch, err = c.CancelBatch(ctx, "batch-1"); err != nil || batch.Status != "cancelling" {
+		t.Errorf("CancelBatch = %+v, %v", batch, err)
+	}
+	content, err := c.FileContent(ctx, "file-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	if data, _ := io.ReadAll(content); !strings.HasPrefix(string(data), `{"custom_id":"1"`) {
+		t.Errorf("FileContent = %q", data)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	c := gateway(t, map[string]http.HandlerFunc{
+		"POST /v1/chat/completions": func(w http.ResponseWriter, r *http.Request) {
+			var req map[string]any
+			decodeBody(t, r, &req)
+			if r.Header.Get("X-Gateway-Dry-Run") != "true" || req["model"] != "m" {
+				t.Errorf("dry run header %q, body %v", r.Header.Get("X-Gateway-Dry-Run"), req)
+			}
+			reply(http.StatusOK, `{"object":"gateway.dry_run","model":"m","backend":"default","transforms":[],"request":{"model":"m"},"estimated_prompt_tokens":3}`)(w, r)
+		},
+	})
+	report, err := c.DryRun(context.Background(), map[string]any{"model": "m", "messages": []any{}})
+	if err != nil || report.Backend != "default" || report.EstimatedPromptTokens != 3 || string(report.Request) != `{"model":"m"}` {
+		t.Errorf("DryRun = %+v, %v", report, err)
+	}
+}
+
+func TestErrorDecoding(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    Error
+		message string
+	}{
+		{"gateway error", http.StatusForbidden, `{"error":{"message":"This key may not send dry-run requests","type":"permission_error","code":"dry_run_not_allowed"}}`,
+			Error{Status: 403, Type: "permission_error", Code: "dry_run_not_allowed", Message: "This key may not send dry-run requests"},
+			"gateway: 403 dry_run_not_allowed: This key may not send dry-run requests"},
+		{"plain body", http.StatusBadGateway, "upstream connect error\n", Error{Status: 502, Message: "upstream connect error"}, "gateway: 502: upstream connect error"},
+		{"empty body", http.StatusUnauthorized, "", Error{Status: 401, Message: "Unauthorized"}, "gateway: 401: Unauthorized"},
+		{"json without error", http.StatusNotFound, `{"detail":"nope"}`, Error{Status: 404, Message: `{"detail":"nope"}`}, `gateway: 404: {"detail":"nope"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := gateway(t, map[string]http.HandlerFunc{"GET /v1/batches/{id}": reply(tt.status, tt.body)})
+			_, err := c.GetBatch(context.Background(), "b")
+			var e *Error
+			if !errors.As(err, &e) || *e != tt.want || err.Error() != tt.message {
+				t.Errorf("error = %#v (%v), want %+v", err, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidResponse(t *testing.T) {
+	c := gateway(t, map[string]http.HandlerFunc{"GET /v1/batches/{id}": reply(http.StatusOK, `{"id":`)})
+	_, err := c.GetBatch(context.Background(), "b")
+	var e *Error
+	if err == nil || errors.As(err, &e) || !strings.Contains(err.Error(), "invalid response") {
+		t.Errorf("error = %v, want an invalid response error", err)
+	}
+}
+
+func TestBaseURLPathPrefix(t *testing.T) {
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		io.WriteString(w, `{"data":[]}`)
+	}))
+	defer srv.Close()
+	if _, err := New(srv.URL+"/gateway", "").ListKeys(context.Background()); err != nil || path != "/gateway/admin/keys" {
+		t.Errorf("ListKeys went to %q: %v", path, err)
+	}
+}
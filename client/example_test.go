@@ -0,0 +1,80 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/vinayhpandya/ai_inference_gateway/client"
+)
+
+// fakeGateway answers the examples' requests as the gateway would.
+func fakeGateway() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /admin/keys", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"id":"key_1","name":"search-indexer","allowed_models":["llama-3-8b"],"key":"gw-example"}`)
+	})
+	mux.HandleFunc("POST /v1/files", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"id":"file-1","object":"file","purpose":"batch"}`)
+	})
+	mux.HandleFunc("POST /v1/batches", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"id":"batch-1","object":"batch","status":"validating","input_file_id":"file-1"}`)
+	})
+	mux.HandleFunc("POST /v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `{"error":{"message":"This key may not send dry-run requests","type":"permission_error","code":"dry_run_not_allowed"}}`)
+	})
+	return httptest.NewServer(mux)
+}
+
+func ExampleClient_CreateKey() {
+	gw := fakeGateway()
+	defer gw.Close()
+
+	admin := client.New(gw.URL, "admin-token")
+	key, err := admin.CreateKey(context.Background(), client.KeyRequest{
+		Name:          client.Ptr("search-indexer"),
+		AllowedModels: client.Ptr([]string{"llama-3-8b"}),
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(key.ID, key.AllowedModels, key.Key)
+	// Output: key_1 [llama-3-8b] gw-example
+}
+
+func ExampleClient_SubmitBatch() {
+	gw := fakeGateway()
+	defer gw.Close()
+
+	app := client.New(gw.URL, "gw-example")
+	input := strings.NewReader(`{"custom_id":"1","method":"POST","url":"/v1/chat/completions","body":{"model":"llama-3-8b","messages":[{"role":"user","content":"hi"}]}}` + "\n")
+	batch, err := app.SubmitBatch(context.Background(), input, map[string]string{"job": "nightly"})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(batch.ID, batch.Status)
+	// Output: batch-1 validating
+}
+
+func ExampleError() {
+	gw := fakeGateway()
+	defer gw.Close()
+
+	app := client.New(gw.URL, "gw-example")
+	_, err := app.DryRun(context.Background(), map[string]any{"model": "llama-3-8b", "messages": []any{}})
+	var e *client.Error
+	if errors.As(err, &e) && e.Code == "dry_run_not_allowed" {
+		fmt.Println(e.Status, e.Type)
+	}
+	fmt.Println(err)
+	// Output:
+	// 403 permission_error
+	// gateway: 403 dry_run_not_allowed: This key may not send dry-run requests
+}
@@ -0,0 +1,223 @@
+package client
+
+import "encoding/json"
+
+// The types below are the gateway's own wire types: the server uses them
+// too, so they always match what it sends and accepts.
+
+// APIKey is a bearer key's metadata as shown to admins. The key itself is
+// only ever returned by create.
+type APIKey struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Prefix    string `json:"prefix"`
+	CreatedAt int64  `json:"created_at"`
+	UpdatedAt int64  `json:"updated_at"`
+	Disabled  bool   `json:"disabled"`
+
+	// MaxConcurrent overrides MAX_CONCURRENT_REQUESTS for this key; 0 keeps the default
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+	// AllowedModels restricts the key to these models; empty allows all
+	AllowedModels []string `json:"allowed_models,omitempty"`
+	// DryRun lets the key send X-Gateway-Dry-Run requests
+	DryRun bool `json:"dry_run,omitempty"`
+	// DataCollection records the key's consent to having sampled traffic
+	// kept as training data
+	DataCollection bool `json:"data_collection,omitempty"`
+	// CanOverrideRouting lets the key send requests to a backend of its
+	// choosing with X-Gateway-Target-Backend
+	CanOverrideRouting bool `json:"can_override_routing,omitempty"`
+	// BypassInjectionGuard lets the key's requests through the injection
+	// guardrail, for callers its heuristics misjudge
+	BypassInjectionGuard bool `json:"bypass_injection_guard,omitempty"`
+	// ServerTiming gives the key's responses the Server-Timing header when
+	// SERVER_TIMING=keys
+	ServerTiming bool `json:"server_timing,omitempty"`
+	// RequireUser rejects the key's chat completions that don't send the
+	// user field
+	RequireUser bool `json:"require_user,omitempty"`
+	// RateLimitRPM overrides RATE_LIMIT_RPM, the requests per minute the
+	// key sustains, and RateLimitBurst RATE_LIMIT_BURST, how many it may
+	// send at once; 0 keeps the default
+	RateLimitRPM   int `json:"rate_limit_rpm,omitempty"`
+	RateLimitBurst int `json:"rate_limit_burst,omitempty"`
+
+	// ParentID makes this a child of a team key, set when the key is
+	// created. A child is also bound by its parent's allowlist, dry-run,
+	// data collection, routing override, injection bypass, server timing
+	// and require_user settings and budget, defaults to its parent's max_concurrent
+	// and rate limit, and is revoked with its parent.
+	ParentID string `json:"parent_id,omitempty"`
+	// TokenBudget caps the tokens the key may use per BudgetPeriod; a
+	// parent's budget covers its children's usage too. 0 is unlimited
+	TokenBudget int64 `json:"token_budget,omitempty"`
+	// BudgetPeriod is the UTC month (default) or day a budget covers
+	BudgetPeriod string `json:"budget_period,omitempty"`
+
+	// Defaults fill sampling parameters the key's requests leave unset, and
+	// SystemPrompt is put before their messages. A child uses its parent's
+	// for whatever it doesn't set itself
+	Defaults     *KeyDefaults `json:"defaults,omitempty"`
+	SystemPrompt string       `json:"system_prompt,omitempty"`
+
+	// APIVersion is the API version the key's requests are served under
+	// when they don't send X-API-Version; a child without one uses its
+	// parent's, and a key without either API_VERSION_DEFAULT
+	APIVersion string `json:"api_version,omitempty"`
+}
+
+// KeyDefaults are sampling parameters a key's requests get when they don't
+// set them themselves.
+type KeyDefaults struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+}
+
+// KeyRequest is the body for creating and updating keys. Absent fields
+// are left unchanged on update.
+type KeyRequest struct {
+	Name                 *string      `json:"name,omitempty"`
+	Disabled             *bool        `json:"disabled,omitempty"`
+	MaxConcurrent        *int         `json:"max_concurrent,omitempty"`
+	AllowedModels        *[]string    `json:"allowed_models,omitempty"`
+	DryRun               *bool        `json:"dry_run,omitempty"`
+	DataCollection       *bool        `json:"data_collection,omitempty"`
+	CanOverrideRouting   *bool        `json:"can_override_routing,omitempty"`
+	BypassInjectionGuard *bool        `json:"bypass_injection_guard,omitempty"`
+	ServerTiming         *bool        `json:"server_timing,omitempty"`
+	RequireUser          *bool        `json:"require_user,omitempty"`
+	RateLimitRPM         *int         `json:"rate_limit_rpm,omitempty"`
+	RateLimitBurst       *int         `json:"rate_limit_burst,omitempty"`
+	ParentID             *string      `json:"parent_id,omitempty"`
+	TokenBudget          *int64       `json:"token_budget,omitempty"`
+	BudgetPeriod         *string      `json:"budget_period,omitempty"`
+	Defaults             *KeyDefaults `json:"defaults,omitempty"`
+	SystemPrompt         *string      `json:"system_prompt,omitempty"`
+	APIVersion           *string      `json:"api_version,omitempty"`
+}
+
+// CreatedKey is a new key with its plaintext, which is shown only once.
+type CreatedKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// KeyUsage is a key's budget status. For a parent, UsedTokens includes its
+// children, which are broken down under Children.
+type KeyUsage struct {
+	KeyID           string     `json:"key_id"`
+	Name            string     `json:"name"`
+	Period          string     `json:"period"`
+	TokenBudget     int64      `json:"token_budget,omitempty"`
+	UsedTokens      int64      `json:"used_tokens"`
+	ReservedTokens  int64      `json:"reserved_tokens"`
+	RemainingTokens *int64     `json:"remaining_tokens,omitempty"`
+	Children        []KeyUsage `json:"children,omitempty"`
+}
+
+// UsageRow is one day's usage for a key and model. Cost is priced when each
+// request completes, so later pricing changes don't rewrite history.
+type UsageRow struct {
+	Date             string  `json:"date"`
+	KeyID            string  `json:"key_id"`
+	Model            string  `json:"model"`
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+// File is an OpenAI file object.
+type File struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+}
+
+// Batch is an OpenAI batch object.
+type Batch struct {
+	ID               string             `json:"id"`
+	Object           string             `json:"object"`
+	Endpoint         string             `json:"endpoint"`
+	InputFileID      string             `json:"input_file_id"`
+	CompletionWindow string             `json:"completion_window"`
+	Status           string             `json:"status"`
+	OutputFileID     string             `json:"output_file_id"`
+	ErrorFileID      string             `json:"error_file_id"`
+	Errors           *BatchErrors       `json:"errors,omitempty"`
+	CreatedAt        int64              `json:"created_at"`
+	InProgressAt     int64              `json:"in_progress_at,omitempty"`
+	ExpiresAt        int64              `json:"expires_at"`
+	CompletedAt      int64              `json:"completed_at,omitempty"`
+	FailedAt         int64              `json:"failed_at,omitempty"`
+	ExpiredAt        int64              `json:"expired_at,omitempty"`
+	CancellingAt     int64              `json:"cancelling_at,omitempty"`
+	CancelledAt      int64              `json:"cancelled_at,omitempty"`
+	RequestCounts    BatchRequestCounts `json:"request_counts"`
+	Metadata         map[string]string  `json:"metadata,omitempty"`
+}
+
+// BatchErrors lists validation failures of the input file.
+type BatchErrors struct {
+	Object string       `json:"object"`
+	Data   []BatchError `json:"data"`
+}
+
+type BatchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Line    int    `json:"line,omitempty"`
+}
+
+type BatchRequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// CreateBatchRequest is the body of POST /v1/batches. Endpoint must be
+// /v1/chat/completions and CompletionWindow 24h.
+type CreateBatchRequest struct {
+	InputFileID      string            `json:"input_file_id"`
+	Endpoint         string            `json:"endpoint"`
+	CompletionWindow string            `json:"completion_window"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+}
+
+// DryRunReport describes how the gateway would have handled a request.
+type DryRunReport struct {
+	Object    string `json:"object"`
+	RequestID string `json:"request_id"`
+	Route     string `json:"route"`
+	Model     string `json:"model"`
+	// RequestedModel is the name the client sent, when it resolved to Model
+	RequestedModel string `json:"requested_model,omitempty"`
+	Backend        string `json:"backend"`
+	BackendType    string `json:"backend_type,omitempty"`
+	UpstreamModel  string `json:"upstream_model,omitempty"`
+	RoutingToken   string `json:"routing_token,omitempty"`
+	// Fallbacks are the router's further backend choices, in order
+	Fallbacks []string `json:"fallbacks,omitempty"`
+	// Members lists the models an ensemble would call, judge last
+	Members []string `json:"members,omitempty"`
+
+	// Transforms are the changes the gateway made to the request
+	Transforms []string `json:"transforms"`
+	Warnings   []string `json:"warnings,omitempty"`
+	// ParameterSources says where each sampling parameter set in Request
+	// came from: the request, the key's defaults, or the model's limit
+	ParameterSources map[string]string `json:"parameter_sources,omitempty"`
+	// Request is what the backend would receive, before translation to
+	// the backend's wire format
+	Request json.RawMessage `json:"request"`
+
+	EstimatedPromptTokens int `json:"estimated_prompt_tokens"`
+	// EstimatedCostUSD prices the prompt estimate, plus max_tokens of
+	// completion when the request sets it
+	EstimatedCostUSD float64 `json:"estimated_cost_usd"`
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+	"unicode/utf8"
+)
+
+// streamCadenceHeader set to "raw" asks for the backend's own event
+// cadence on a route that coalesces.
+const streamCadenceHeader = "X-Gateway-Stream-Cadence"
+
+// coalescedEvents counts backend events merged into a previous one instead
+// of being sent on their own.
+var coalescedEvents = expvar.NewInt("gateway_stream_events_coalesced_total")
+
+// streamCoalescing is nil unless STREAM_COALESCE_CONFIG is set.
+var streamCoalescing *streamCoalescer
+
+// StreamCoalesce is a route's stream coalescing, as configured in
+// STREAM_COALESCE_CONFIG:
+//
+//	{"POST /v1/chat/completions": {"interval": "50ms", "max_chars": 200}}
+type StreamCoalesce struct {
+	// Interval is the least time between two content events sent to the
+	// client
+	Interval string `json:"interval"`
+	// MaxChars, when set, sends the merged content early once it is this
+	// many characters long
+	MaxChars int `json:"max_chars,omitempty"`
+
+	interval time.Duration
+}
+
+func (c *StreamCoalesce) validate() error {
+	d, err := time.ParseDuration(c.Interval)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid interval %q", c.Interval)
+	}
+	c.interval = d
+	if c.MaxChars < 0 {
+		return fmt.Errorf("max_chars must not be negative")
+	}
+	return nil
+}
+
+// streamCoalescer holds the coalescing of each configured route.
+type streamCoalescer struct {
+	routes map[string]*StreamCoalesce
+}
+
+// loadStreamCoalescing reads the per-route coalescing in the JSON file
+// named by STREAM_COALESCE_CONFIG. It returns nil when none is configured.
+func loadStreamCoalescing() (*streamCoalescer, error) {
+	path := os.Getenv("STREAM_COALESCE_CONFIG")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string]*StreamCoalesce
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	for route, cfg := range file {
+		if err := cfg.validate(); err != nil {
+			return nil, fmt.Errorf("stream coalescing for %q: %w", route, err)
+		}
+	}
+	return &streamCoalescer{routes: file}, nil
+}
+
+// checkRoutes fails for coalescing naming routes other than chat
+// completions, the only route whose streams the gateway relays itself.
+func (c *streamCoalescer) checkRoutes(patterns []string) error {
+	if c == nil {
+		return nil
+	}
+	for route := range c.routes {
+		if !slices.Contains(patterns, route) {
+			return fmt.Errorf("stream coalescing for unknown route %q", route)
+		}
+		if route != "POST /v1/chat/completions" || transparentRoutes.covers("/v1/chat/completions") {
+			return fmt.Errorf("stream coalescing for %q: only POST /v1/chat/completions, when not transparent, can be coalesced", route)
+		}
+	}
+	return nil
+}
+
+// route returns the coalescing configured for route, or nil.
+func (c *streamCoalescer) route(route string) *StreamCoalesce {
+	if c == nil {
+		return nil
+	}
+	return c.routes[route]
+}
+
+// forRequest returns the coalescing r's stream gets: its route's, unless
+// the client asked for the raw cadence.
+func (c *streamCoalescer) forRequest(r *http.Request) *StreamCoalesce {
+	if r.Header.Get(streamCadenceHeader) == "raw" {
+		return nil
+	}
+	return c.route(recordFromContext(r.Context()).Route)
+}
+
+// deltaCoalescer merges consecutive content-only chunks between flushes.
+// Any other event (the role chunk, a finish reason, tool calls, logprobs,
+// usage, errors, [DONE]) flushes what is pending and is sent as it came,
+// so the stream's structure is unchanged. The first content chunk is sent
+// at once, so coalescing never delays the first token.
+type deltaCoalescer struct {
+	cfg *StreamCoalesce
+	// now is the coalescer's clock; tests may replace it
+	now func() time.Time
+
+	pending   *ChatCompletionChunk
+	chars     int
+	lastFlush time.Time
+	sentFirst bool
+}
+
+func newDeltaCoalescer(cfg *StreamCoalesce) *deltaCoalescer {
+	return &deltaCoalescer{cfg: cfg, now: time.Now}
+}
+
+// add takes the next event and returns the events to send now, in order.
+func (c *deltaCoalescer) add(data []byte) [][]byte {
+	chunk, ok := contentOnlyChunk(data)
+	if !ok {
+		return append(c.flush(), data)
+	}
+	if !c.sentFirst {
+		c.sentFirst = true
+		c.lastFlush = c.now()
+		return [][]byte{data}
+	}
+
+	var out [][]byte
+	if p := c.pending; p != nil && (p.ID != chunk.ID || p.Model != chunk.Model || p.Choices[0].Index != chunk.Choices[0].Index) {
+		out = c.flush()
+	}
+	content := chunk.Choices[0].Delta.Content
+	if c.pending == nil {
+		c.pending = chunk
+	} else {
+		c.pending.Choices[0].Delta.Content += content
+		coalescedEvents.Add(1)
+	}
+	c.chars += utf8.RuneCountInString(content)
+	if (c.cfg.MaxChars > 0 && c.chars >= c.cfg.MaxChars) || c.now().Sub(c.lastFlush) >= c.cfg.interval {
+		out = append(out, c.flush()...)
+	}
+	return out
+}
+
+// flush returns the pending merged chunk, if any.
+func (c *deltaCoalescer) flush() [][]byte {
+	if c.pending == nil {
+		return nil
+	}
+	c.lastFlush = c.now()
+	data, _ := json.Marshal(c.pending)
+	c.pending, c.chars = nil, 0
+	return [][]byte{data}
+}
+
+// deadline returns when the pending content is due, and false when
+// nothing is pending.
+func (c *deltaCoalescer) deadline() (time.Time, bool) {
+	if c == nil || c.pending == nil {
+		return time.Time{}, false
+	}
+	return c.lastFlush.Add(c.cfg.interval), true
+}
+
+// contentOnlyChunk parses data as a chunk carrying nothing but content for
+// a single choice. Such chunks can be merged; anything else can't.
+func contentOnlyChunk(data []byte) (*ChatCompletionChunk, bool) {
+	var chunk ChatCompletionChunk
+	if json.Unmarshal(data, &chunk) != nil || chunk.Usage != nil || chunk.Gateway != nil || len(chunk.Choices) != 1 {
+		return nil, false
+	}
+	choice := chunk.Choices[0]
+	if choice.FinishReason != nil || choice.Delta.Role != "" || choice.Delta.Content == "" ||
+		(len(choice.Logprobs) > 0 && string(choice.Logprobs) != "null") {
+		return nil, false
+	}
+	// Fields the gateway doesn't model, such as tool_calls, can't be merged
+	var raw struct {
+		Choices []struct {
+			Delta map[string]json.RawMessage `json:"delta"`
+		} `json:"choices"`
+	}
+	if json.Unmarshal(data, &raw) != nil || len(raw.Choices) != 1 {
+		return nil, false
+	}
+	for field, value := range raw.Choices[0].Delta {
+		if field != "content" && field != "role" && string(value) != "null" {
+			return nil, false
+		}
+	}
+	return &chunk, true
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultComparisonWindow  = 1000
+	defaultComparisonTimeout = time.Minute
+	// maxComparisonsInFlight caps candidate requests running at once;
+	// sampled requests beyond it aren't compared
+	maxComparisonsInFlight = 64
+	comparisonReportQueue  = 1000
+)
+
+// comparisonsTotal counts differential tests by outcome: compared,
+// candidate_error, skipped (too many in flight), similarity_error and
+// report_dropped.
+var comparisonsTotal = expvar.NewMap("gateway_comparisons_total")
+
+// comparisons is nil unless COMPARISON_CONFIG is set.
+var comparisons *comparator
+
+// Comparison is a route's differential test, as configured in
+// COMPARISON_CONFIG:
+//
+//	{"POST /v1/chat/completions": {"backend": "vllm-b", "sample_rate": 0.05,
+//	                               "models": ["llama-3-70b"],
+//	                               "embedding": {"backend": "openai", "model": "text-embedding-3-small"}}}
+type Comparison struct {
+	// Backend is the catalog backend each sampled request is also sent to;
+	// the backend routing picked still serves the client
+	Backend string `json:"backend"`
+	// Model is the model the candidate is asked for (default the model
+	// sent to the primary)
+	Model string `json:"model,omitempty"`
+	// SampleRate is the share of the route's requests compared, above 0
+	// and at most 1
+	SampleRate float64 `json:"sample_rate"`
+	// Models, when set, limits comparison to these requested models
+	Models []string `json:"models,omitempty"`
+	// Embedding, when set, scores how similar the two completions are
+	Embedding *ComparisonEmbedding `json:"embedding,omitempty"`
+	// Window is how many recent comparisons the summary covers (default 1000)
+	Window int `json:"window,omitempty"`
+	// Timeout bounds the candidate request (default 1m)
+	Timeout string `json:"timeout,omitempty"`
+
+	timeout time.Duration
+}
+
+// ComparisonEmbedding names an openai or vllm catalog backend serving
+// /v1/embeddings, and the model to embed completions with.
+type ComparisonEmbedding struct {
+	Backend string `json:"backend"`
+	Model   string `json:"model"`
+}
+
+func (c *Comparison) validate() error {
+	if c.Backend == "" {
+		return fmt.Errorf("needs a backend")
+	}
+	if c.SampleRate <= 0 || c.SampleRate > 1 {
+		return fmt.Errorf("sample_rate must be above 0 and at most 1")
+	}
+	if c.Embedding != nil && (c.Embedding.Backend == "" || c.Embedding.Model == "") {
+		return fmt.Errorf("embedding needs a backend and a model")
+	}
+	if c.Window < 0 {
+		return fmt.Errorf("window must not be negative")
+	}
+	if c.Window == 0 {
+		c.Window = defaultComparisonWindow
+	}
+	c.timeout = defaultComparisonTimeout
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout %q", c.Timeout)
+		}
+		c.timeout = d
+	}
+	return nil
+}
+
+// comparisonSide is one backend's half of a comparison.
+type comparisonSide struct {
+	Backend          string  `json:"backend"`
+	Model            string  `json:"model"`
+	LatencyMS        float64 `json:"latency_ms"`
+	CompletionTokens int     `json:"completion_tokens"`
+	FinishReason     string  `json:"finish_reason,omitempty"`
+	Error            string  `json:"error,omitempty"`
+}
+
+// comparisonReport is one compared request, as written to
+// COMPARISON_REPORT. It never carries message content.
+type comparisonReport struct {
+	RequestID  string         `json:"request_id"`
+	CreatedAt  time.Time      `json:"created_at"`
+	Route      string         `json:"route"`
+	Model      string         `json:"model"`
+	Primary    comparisonSide `json:"primary"`
+	Candidate  comparisonSide `json:"candidate"`
+	Compared   bool           `json:"compared"`
+	LatencyMS  float64        `json:"latency_delta_ms,omitempty"`
+	TokenDelta int            `json:"token_delta,omitempty"`
+	// FinishReasonMatch is whether both backends stopped for the same reason
+	FinishReasonMatch bool `json:"finish_reason_match"`
+	// Similarity is the completions' embedding cosine similarity
+	Similarity *float64 `json:"similarity,omitempty"`
+}
+
+// comparisonRoute keeps a route's recent reports for its summary.
+type comparisonRoute struct {
+	cfg *Comparison
+
+	mu      sync.Mutex
+	reports []comparisonReport
+	next    int
+}
+
+// comparator sends a sample of each configured route's requests to a
+// second backend, compares the responses once both are done and keeps a
+// rolling summary. Reports also go to the COMPARISON_REPORT file, written
+// by a single goroutine so requests never wait for the disk.
+type comparator struct {
+	routes   map[string]*comparisonRoute
+	inflight atomic.Int64
+
+	reportPath string
+	mu         sync.Mutex
+	queue      chan []byte
+	closed     bool
+	done       chan struct{}
+}
+
+// loadComparisons reads the per-route comparisons in the JSON file named
+// by COMPARISON_CONFIG, and COMPARISON_REPORT, the JSONL file reports are
+// appended to. It returns nil when comparison is not configured.
+func loadComparisons() (*comparator, error) {
+	path := os.Getenv("COMPARISON_CONFIG")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string]*Comparison
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	c := &comparator{routes: make(map[string]*comparisonRoute), reportPath: os.Getenv("COMPARISON_REPORT")}
+	for route, cfg := range file {
+		if err := cfg.validate(); err != nil {
+			return nil, fmt.Errorf("comparison for %q: %w", route, err)
+		}
+		c.routes[route] = &comparisonRoute{cfg: cfg}
+	}
+	if err := c.checkCatalog(catalog.Load()); err != nil {
+		return nil, err
+	}
+	if c.reportPath != "" {
+		f, err := os.OpenFile(c.reportPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		c.queue = make(chan []byte, comparisonReportQueue)
+		c.done = make(chan struct{})
+		go c.writeReports(f)
+	}
+	expvar.Publish("gateway_comparison", expvar.Func(c.gauges))
+	return c, nil
+}
+
+// checkRoutes fails for comparisons naming routes other than chat
+// completions, the only route that can be compared.
+func (c *comparator) checkRoutes(patterns []string) error {
+	if c == nil {
+		return nil
+	}
+	for route := range c.routes {
+		if !slices.Contains(patterns, route) {
+			return fmt.Errorf("comparison for unknown route %q", route)
+		}
+		if route != "POST /v1/chat/completions" || transparentRoutes.covers("/v1/chat/completions") {
+			return fmt.Errorf("comparison for %q: only POST /v1/chat/completions, when not transparent, can be compared", route)
+		}
+	}
+	return nil
+}
+
+// checkCatalog rejects catalogs missing a backend the comparisons use.
+func (c *comparator) checkCatalog(m *modelCatalog) error {
+	if c == nil {
+		return nil
+	}
+	for route, cr := range c.routes {
+		if _, ok := m.backends[cr.cfg.Backend]; !ok {
+			return fmt.Errorf("comparison for %q uses unknown backend %q", route, cr.cfg.Backend)
+		}
+		if e := cr.cfg.Embedding; e != nil {
+			b, ok := m.backends[e.Backend]
+			if !ok {
+				return fmt.Errorf("comparison for %q embeds with unknown backend %q", route, e.Backend)
+			}
+			if b.Type != "openai" && b.Type != "vllm" {
+				return fmt.Errorf("comparison for %q embeds with %s backend %q; want openai or vllm", route, b.Type, e.Backend)
+			}
+		}
+	}
+	return nil
+}
+
+// comparison is a sampled request whose candidate is running.
+type comparison struct {
+	route     *comparisonRoute
+	report    comparisonReport
+	started   time.Time
+	candidate chan candidateResult
+}
+
+type candidateResult struct {
+	response ChatCompletionResponse
+	latency  time.Duration
+	err      error
+}
+
+// start decides whether to compare a request about to go to primary and,
+// if so, sends it to the route's candidate at once, so both see the same
+// moment's load. It returns nil for requests that aren't compared.
+func (c *comparator) start(r *http.Request, req ChatCompletionRequest, model string, primary *Backend, requestID string) *comparison {
+	if c == nil {
+		return nil
+	}
+	routeName := recordFromContext(r.Context()).Route
+	cr, ok := c.routes[routeName]
+	if !ok || (len(cr.cfg.Models) > 0 && !slices.Contains(cr.cfg.Models, model)) || rand.Float64() >= cr.cfg.SampleRate {
+		return nil
+	}
+	candidate, ok := requestCatalog(r.Context()).backends[cr.cfg.Backend]
+	if !ok || candidate == primary {
+		return nil
+	}
+	if c.inflight.Add(1) > maxComparisonsInFlight {
+		c.inflight.Add(-1)
+		comparisonsTotal.Add("skipped", 1)
+		return nil
+	}
+
+	creq := req
+	creq.Messages = slices.Clone(req.Messages)
+	creq.Stream, creq.StreamOptions = false, nil
+	if cr.cfg.Model != "" {
+		creq.Model = cr.cfg.Model
+	}
+	normalizeForBackend(&creq, candidate, requestID)
+
+	cmp := &comparison{
+		route:     cr,
+		started:   time.Now(),
+		candidate: make(chan candidateResult, 1),
+		report: comparisonReport{
+			RequestID: requestID,
+			CreatedAt: time.Now().UTC(),
+			Route:     routeName,
+			Model:     model,
+			Primary:   comparisonSide{Backend: primary.Name, Model: req.Model},
+			Candidate: comparisonSide{Backend: candidate.Name, Model: creq.Model},
+		},
+	}
+	go func() {
+		defer c.inflight.Add(-1)
+		// Its own record, so the candidate's timings stay out of the
+		// client's access log line
+		ctx := context.WithValue(context.Background(), requestRecordKey{}, &requestRecord{})
+		ctx, cancel := context.WithTimeout(ctx, cr.cfg.timeout)
+		defer cancel()
+		sent := time.Now()
+		response, err := forwardToBackend(ctx, candidate, creq, requestID+"-compare")
+		cmp.candidate <- candidateResult{response: response, latency: time.Since(sent), err: err}
+	}()
+	return cmp
+}
+
+// finish records the primary's completion and compares it with the
+// candidate's once that is in, without holding up the client. Requests
+// the primary failed aren't compared.
+func (cmp *comparison) finish(content, finishReason string, usage *Usage) {
+	if cmp == nil {
+		return
+	}
+	p := &cmp.report.Primary
+	p.LatencyMS = ms(time.Since(cmp.started).Round(time.Microsecond))
+	p.FinishReason = finishReason
+	p.CompletionTokens = completionTokenCount(usage, content)
+
+	go func() {
+		result := <-cmp.candidate
+		report := cmp.report
+		cand := &report.Candidate
+		cand.LatencyMS = ms(result.latency.Round(time.Microsecond))
+		if result.err != nil || len(result.response.Choices) == 0 {
+			cand.Error = "no choices in response"
+			if result.err != nil {
+				cand.Error = result.err.Error()
+			}
+			comparisonsTotal.Add("candidate_error", 1)
+			comparisons.record(cmp.route, report)
+			return
+		}
+		choice := result.response.Choices[0]
+		cand.FinishReason = choice.FinishReason
+		cand.CompletionTokens = completionTokenCount(&result.response.Usage, choice.Message.Content)
+
+		report.Compared = true
+		report.LatencyMS = math.Round((cand.LatencyMS-p.LatencyMS)*1000) / 1000
+		report.TokenDelta = cand.CompletionTokens - p.CompletionTokens
+		report.FinishReasonMatch = cand.FinishReason == p.FinishReason
+		if e := cmp.route.cfg.Embedding; e != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), cmp.route.cfg.timeout)
+			sim, err := embeddingSimilarity(ctx, e, content, choice.Message.Content)
+			cancel()
+			if err != nil {
+				log.Printf("Comparison similarity for %s failed: %v", report.RequestID, err)
+				comparisonsTotal.Add("similarity_error", 1)
+			} else {
+				report.Similarity = &sim
+			}
+		}
+		comparisonsTotal.Add("compared", 1)
+		comparisons.record(cmp.route, report)
+	}()
+}
+
+// completionTokenCount is the usage's completion tokens, or the gateway's
+// estimate when the backend reported none.
+func completionTokenCount(usage *Usage, content string) int {
+	if usage != nil && usage.CompletionTokens > 0 {
+		return usage.CompletionTokens
+	}
+	return approximateTokens(content)
+}
+
+// embeddingSimilarity embeds a and b with e's backend and returns their
+// cosine similarity.
+func embeddingSimilarity(ctx context.Context, e *ComparisonEmbedding, a, b string) (float64, error) {
+	backend, ok := catalog.Load().backends[e.Backend]
+	if !ok {
+		return 0, fmt.Errorf("unknown backend %q", e.Backend)
+	}
+	body, err := json.Marshal(map[string]any{"model": e.Model, "input": []string{a, b}})
+	if err != nil {
+		return 0, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, backendURL(backend.URL, "/v1/embeddings"), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if backend.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+backend.APIKey)
+	}
+	resp, err := poolFor(backend).client.Do(httpReq)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("embedding backend returned status %d", resp.StatusCode)
+	}
+	var out struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return 0, fmt.Errorf("invalid embedding response: %w", err)
+	}
+	vectors := make([][]float64, 2)
+	for _, d := range out.Data {
+		if d.Index == 0 || d.Index == 1 {
+			vectors[d.Index] = d.Embedding
+		}
+	}
+	if len(vectors[0]) == 0 || len(vectors[0]) != len(vectors[1]) {
+		return 0, fmt.Errorf("embedding response has no matching pair of vectors")
+	}
+	return cosine(vectors[0], vectors[1]), nil
+}
+
+func cosine(a, b []float64) float64 {
+	var dot, na, nb float64
+	for i := range a {
+		dot += a[i] * b[i]
+		na += a[i] * a[i]
+		nb += b[i] * b[i]
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
+
+// record adds a finished report to its route's window and queues it for
+// the report file, dropping it there when the queue is full.
+func (c *comparator) record(cr *comparisonRoute, report comparisonReport) {
+	cr.mu.Lock()
+	if len(cr.reports) < cr.cfg.Window {
+		cr.reports = append(cr.reports, report)
+	} else {
+		cr.reports[cr.next] = report
+		cr.next = (cr.next + 1) % cr.cfg.Window
+	}
+	cr.mu.Unlock()
+
+	if c.queue == nil {
+		return
+	}
+	line, err := json.Marshal(report)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		comparisonsTotal.Add("report_dropped", 1)
+		return
+	}
+	select {
+	case c.queue <- append(line, '\n'):
+	default:
+		comparisonsTotal.Add("report_dropped", 1)
+	}
+}
+
+func (c *comparator) writeReports(f *os.File) {
+	defer close(c.done)
+	defer f.Close()
+	for line := range c.queue {
+		if _, err := f.Write(line); err != nil {
+			log.Printf("Writing comparison report failed: %v", err)
+		}
+	}
+}
+
+// close stops writing reports once the queued ones are written.
+// Comparisons still running when the gateway stops are not reported.
+func (c *comparator) close() {
+	if c == nil || c.queue == nil {
+		return
+	}
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	c.mu.Unlock()
+	<-c.done
+}
+
+// comparisonSummary is a route's rolling comparison summary. Means are
+// over the comparisons where both backends answered.
+type comparisonSummary struct {
+	Route           string `json:"route"`
+	Backend         string `json:"backend"`
+	Reports         int    `json:"reports"`
+	Compared        int    `json:"compared"`
+	CandidateErrors int    `json:"candidate_errors"`
+	// FinishReasonMatchRate is the share of comparisons whose finish
+	// reasons matched
+	FinishReasonMatchRate *float64 `json:"finish_reason_match_rate,omitempty"`
+	// Latency deltas are candidate minus primary, so positive means the
+	// candidate was slower
+	MeanLatencyDeltaMS *float64 `json:"mean_latency_delta_ms,omitempty"`
+	P95LatencyDeltaMS  *float64 `json:"p95_latency_delta_ms,omitempty"`
+	MeanTokenDelta     *float64 `json:"mean_token_delta,omitempty"`
+	MeanSimilarity     *float64 `json:"mean_similarity,omitempty"`
+}
+
+func (cr *comparisonRoute) summary(route string) comparisonSummary {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	s := comparisonSummary{Route: route, Backend: cr.cfg.Backend, Reports: len(cr.reports)}
+	var matches, similar int
+	var latency, tokens, similarity float64
+	var deltas []float64
+	for _, r := range cr.reports {
+		if !r.Compared {
+			s.CandidateErrors++
+			continue
+		}
+		s.Compared++
+		if r.FinishReasonMatch {
+			matches++
+		}
+		latency += r.LatencyMS
+		tokens += float64(r.TokenDelta)
+		deltas = append(deltas, r.LatencyMS)
+		if r.Similarity != nil {
+			similar++
+			similarity += *r.Similarity
+		}
+	}
+	if s.Compared > 0 {
+		n := float64(s.Compared)
+		sort.Float64s(deltas)
+		matchRate, meanLatency, p95, meanTokens := float64(matches)/n, latency/n, deltas[int(math.Ceil(0.95*n))-1], tokens/n
+		s.FinishReasonMatchRate, s.MeanLatencyDeltaMS, s.P95LatencyDeltaMS, s.MeanTokenDelta = &matchRate, &meanLatency, &p95, &meanTokens
+	}
+	if similar > 0 {
+		mean := similarity / float64(similar)
+		s.MeanSimilarity = &mean
+	}
+	return s
+}
+
+// summary reports every route's summary, sorted by route.
+func (c *comparator) summary() []comparisonSummary {
+	out := make([]comparisonSummary, 0, len(c.routes))
+	for route, cr := range c.routes {
+		out = append(out, cr.summary(route))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Route < out[j].Route })
+	return out
+}
+
+// gauges publishes the summaries as flat numeric gauges per route.
+func (c *comparator) gauges() any {
+	g := make(map[string]map[string]float64, len(c.routes))
+	for _, s := range c.summary() {
+		m := map[string]float64{"compared": float64(s.Compared), "candidate_errors": float64(s.CandidateErrors)}
+		for name, v := range map[string]*float64{
+			"finish_reason_match_rate": s.FinishReasonMatchRate,
+			"mean_latency_delta_ms":    s.MeanLatencyDeltaMS,
+			"p95_latency_delta_ms":     s.P95LatencyDeltaMS,
+			"mean_token_delta":         s.MeanTokenDelta,
+			"mean_similarity":          s.MeanSimilarity,
+		} {
+			if v != nil {
+				m[name] = *v
+			}
+		}
+		g[s.Route] = m
+	}
+	return g
+}
+
+// comparisonAdminHandler implements GET /admin/comparisons.
+func comparisonAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if comparisons == nil {
+		writeJSONError(w, http.StatusNotFound, "invalid_request_error", "not_found", "No comparisons are configured on this gateway")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": comparisons.summary()})
+}
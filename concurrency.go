@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// topConcurrencyKeys bounds how many keys the concurrency metric reports.
+const topConcurrencyKeys = 20
+
+// concurrencyLimiter caps simultaneous requests per caller key, counted for
+// the whole lifetime of the request including streaming.
+type concurrencyLimiter struct {
+	mu       sync.Mutex
+	def      int
+	perKey   map[string]int
+	inflight map[string]int
+}
+
+// loadConcurrencyLimiter reads MAX_CONCURRENT_REQUESTS (default per key,
+// 0 = unlimited) and KEY_MAX_CONCURRENT ("id:n,id2:n") overrides.
+func loadConcurrencyLimiter() (*concurrencyLimiter, error) {
+	l := &concurrencyLimiter{
+		perKey:   make(map[string]int),
+		inflight: make(map[string]int),
+	}
+
+	if v := os.Getenv("MAX_CONCURRENT_REQUESTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAX_CONCURRENT_REQUESTS: %w", err)
+		}
+		l.def = n
+	}
+
+	if raw := os.Getenv("KEY_MAX_CONCURRENT"); raw != "" {
+		for _, pair := range strings.Split(raw, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			n, err := strconv.Atoi(value)
+			if !ok || err != nil {
+				return nil, fmt.Errorf("invalid KEY_MAX_CONCURRENT entry %q", pair)
+			}
+			l.perKey[key] = n
+		}
+	}
+
+	expvar.Publish("gateway_concurrent_requests", expvar.Func(func() any {
+		return l.snapshot(topConcurrencyKeys)
+	}))
+	return l, nil
+}
+
+func (l *concurrencyLimiter) limit(key string) int {
+	if n, ok := l.perKey[key]; ok {
+		return n
+	}
+	if n, ok := apiKeys.maxConcurrent(key); ok {
+		return n
+	}
+	return l.def
+}
+
+// acquire takes a slot for key, returning false if the key is at its limit.
+func (l *concurrencyLimiter) acquire(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if max := l.limit(key); max > 0 && l.inflight[key] >= max {
+		return false
+	}
+	l.inflight[key]++
+	return true
+}
+
+func (l *concurrencyLimiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inflight[key]--
+	if l.inflight[key] <= 0 {
+		delete(l.inflight, key)
+	}
+}
+
+// snapshot returns current in-flight counts, limited to the busiest n keys
+// when n > 0.
+func (l *concurrencyLimiter) snapshot(n int) map[string]int {
+	l.mu.Lock()
+	keys := make([]string, 0, len(l.inflight))
+	for key := range l.inflight {
+		keys = append(keys, key)
+	}
+	counts := make(map[string]int, len(keys))
+	for _, key := range keys {
+		counts[key] = l.inflight[key]
+	}
+	l.mu.Unlock()
+
+	if n <= 0 || len(keys) <= n {
+		return counts
+	}
+	sort.Slice(keys, func(i, j int) bool { return counts[keys[i]] > counts[keys[j]] })
+	top := make(map[string]int, n)
+	for _, key := range keys[:n] {
+		top[key] = counts[key]
+	}
+	return top
+}
+
+// limitConcurrency rejects requests beyond the caller's rate limit with 429
+// rate_limit_exceeded, and beyond its concurrent limit with 429
+// concurrency_limit_exceeded. Permitted dry runs aren't rate limited. It
+// must run inside requireAuth.
+func limitConcurrency(l *concurrencyLimiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := identityFromContext(r.Context()).KeyID
+		if isDryRun(r) && dryRunAllowed(key) {
+			dryKey, limited := dryRunLimitKey(key)
+			if !limited {
+				next(w, r)
+				return
+			}
+			key = dryKey
+		} else if ok, retryAfter, lim := rateLimits.allow(key); !ok {
+			gatewayRateLimited.Add("rate_limit_exceeded", 1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, "rate_limit_error", "rate_limit_exceeded",
+				fmt.Sprintf("Rate limit exceeded (%g requests per minute, bursts of %g); retry later", lim.rpm, lim.burst))
+			return
+		}
+		start := time.Now()
+		acquired := l.acquire(key)
+		rec := recordFromContext(r.Context())
+		rec.Timings.set(&rec.Timings.queue, time.Since(start))
+		if !acquired {
+			gatewayRateLimited.Add("concurrency_limit_exceeded", 1)
+			writeJSONError(w, http.StatusTooManyRequests, "rate_limit_error", "concurrency_limit_exceeded",
+				fmt.Sprintf("Too many concurrent requests (limit %d)", l.limit(key)))
+			return
+		}
+		defer l.release(key)
+		next(w, r)
+	}
+}
+
+// concurrencyAdminHandler reports in-flight requests per key.
+func concurrencyAdminHandler(l *concurrencyLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(l.snapshot(0))
+	}
+}
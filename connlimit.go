@@ -0,0 +1,147 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	openConnections     = expvar.NewInt("gateway_open_connections")
+	rejectedConnections = expvar.NewMap("gateway_connections_rejected_total")
+)
+
+// limitListener caps open connections overall (max) and per client IP
+// (perIP) at accept time, before any request is read. Connections over a
+// limit are closed immediately. A zero limit disables that check.
+type limitListener struct {
+	net.Listener
+	max   int
+	perIP int
+
+	mu        sync.Mutex
+	open      int
+	perIPOpen map[string]int
+
+	// Rejections are logged at most once per second with a count of those
+	// suppressed in between
+	lastLog    time.Time
+	suppressed int
+}
+
+// limitConnections wraps ln with MAX_CONNECTIONS and MAX_CONNECTIONS_PER_IP.
+// Both default to 0 (off), in which case ln is returned unchanged.
+func limitConnections(ln net.Listener) (net.Listener, error) {
+	max, err := envInt("MAX_CONNECTIONS")
+	if err != nil {
+		return nil, err
+	}
+	perIP, err := envInt("MAX_CONNECTIONS_PER_IP")
+	if err != nil {
+		return nil, err
+	}
+	if max == 0 && perIP == 0 {
+		return ln, nil
+	}
+	return &limitListener{Listener: ln, max: max, perIP: perIP, perIPOpen: make(map[string]int)}, nil
+}
+
+func envInt(name string) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return n, nil
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := clientIP(conn.RemoteAddr())
+		if reason := l.admit(ip); reason != "" {
+			conn.Close()
+			rejectedConnections.Add(reason, 1)
+			l.logRejection(ip, reason)
+			continue
+		}
+		openConnections.Add(1)
+		return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+	}
+}
+
+// admit reserves a slot for ip, returning the limit that was hit otherwise.
+func (l *limitListener) admit(ip string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.max > 0 && l.open >= l.max {
+		return "global"
+	}
+	if l.perIP > 0 && l.perIPOpen[ip] >= l.perIP {
+		return "per_ip"
+	}
+	l.open++
+	l.perIPOpen[ip]++
+	return ""
+}
+
+func (l *limitListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.open--
+	if l.perIPOpen[ip]--; l.perIPOpen[ip] <= 0 {
+		delete(l.perIPOpen, ip)
+	}
+	openConnections.Add(-1)
+}
+
+func (l *limitListener) logRejection(ip, reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if time.Since(l.lastLog) < time.Second {
+		l.suppressed++
+		return
+	}
+	log.Printf("Rejected connection from %s (%s limit); %d more rejections since last report", ip, reason, l.suppressed)
+	l.lastLog = time.Now()
+	l.suppressed = 0
+}
+
+// limitedConn gives its slot back exactly once, however often it is closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+func clientIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ConversationStore keeps server-side chat history for X-Conversation-ID
+// sessions. Sessions are scoped by owner (the caller's key ID) so one tenant
+// can never read another's history.
+type ConversationStore interface {
+	Load(owner, id string) []Message
+	Append(owner, id string, messages ...Message)
+	Delete(owner, id string) bool
+}
+
+// conversations is the active store; nil disables session mode.
+var conversations ConversationStore
+
+const (
+	defaultConversationTTL      = 30 * time.Minute
+	defaultMaxConversations     = 10000
+	defaultMaxConversationBytes = 256 << 20
+)
+
+// conversationEvictions counts sessions dropped to stay within the store's
+// bounds before they expired.
+var conversationEvictions = expvar.NewInt("gateway_conversation_evictions_total")
+
+type conversationKey struct {
+	owner string
+	id    string
+}
+
+type conversation struct {
+	key       conversationKey
+	messages  []Message
+	bytes     int
+	expiresAt time.Time
+}
+
+// messageBytes is what a message costs the store.
+func messageBytes(m Message) int {
+	return len(m.Role) + len(m.Content)
+}
+
+// memoryConversationStore is an in-process ConversationStore whose sessions
+// expire after ttl without activity. It holds at most maxSessions sessions
+// and maxBytes of messages, evicting the least recently used sessions to
+// stay within both.
+type memoryConversationStore struct {
+	mu          sync.Mutex
+	ttl         time.Duration
+	maxSessions int
+	maxBytes    int
+	now         func() time.Time
+	sessions    map[conversationKey]*list.Element
+	// lru holds the sessions, most recently used first
+	lru   *list.List
+	bytes int
+}
+
+func newMemoryConversationStore(ttl time.Duration, maxSessions, maxBytes int) *memoryConversationStore {
+	s := &memoryConversationStore{
+		ttl:         ttl,
+		maxSessions: maxSessions,
+		maxBytes:    maxBytes,
+		now:         time.Now,
+		sessions:    make(map[conversationKey]*list.Element),
+		lru:         list.New(),
+	}
+	go s.sweep()
+	return s
+}
+
+// live returns key's session, unless it's missing or expired.
+func (s *memoryConversationStore) live(key conversationKey) (*list.Element, *conversation) {
+	e, ok := s.sessions[key]
+	if !ok {
+		return nil, nil
+	}
+	c := e.Value.(*conversation)
+	if s.now().After(c.expiresAt) {
+		s.remove(e)
+		return nil, nil
+	}
+	return e, c
+}
+
+func (s *memoryConversationStore) remove(e *list.Element) {
+	c := s.lru.Remove(e).(*conversation)
+	delete(s.sessions, c.key)
+	s.bytes -= c.bytes
+}
+
+func (s *memoryConversationStore) Load(owner, id string) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, c := s.live(conversationKey{owner, id})
+	if c == nil {
+		return nil
+	}
+	s.lru.MoveToFront(e)
+	return append([]Message(nil), c.messages...)
+}
+
+func (s *memoryConversationStore) Append(owner, id string, messages ...Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := conversationKey{owner, id}
+	e, c := s.live(key)
+	if c == nil {
+		c = &conversation{key: key}
+		e = s.lru.PushFront(c)
+		s.sessions[key] = e
+	} else {
+		s.lru.MoveToFront(e)
+	}
+	for _, m := range messages {
+		c.messages = append(c.messages, m)
+		c.bytes += messageBytes(m)
+		s.bytes += messageBytes(m)
+	}
+	c.expiresAt = s.now().Add(s.ttl)
+
+	for s.lru.Len() > 1 && (s.lru.Len() > s.maxSessions || s.bytes > s.maxBytes) {
+		s.remove(s.lru.Back())
+		conversationEvictions.Add(1)
+	}
+	// A session bigger than the whole store on its own keeps its newest
+	// messages
+	for len(c.messages) > 0 && c.bytes > s.maxBytes {
+		c.bytes -= messageBytes(c.messages[0])
+		s.bytes -= messageBytes(c.messages[0])
+		c.messages = c.messages[1:]
+	}
+}
+
+func (s *memoryConversationStore) Delete(owner, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, c := s.live(conversationKey{owner, id})
+	if c == nil {
+		return false
+	}
+	s.remove(e)
+	return true
+}
+
+// sweep periodically drops expired sessions so idle ones don't accumulate.
+func (s *memoryConversationStore) sweep() {
+	for range time.Tick(s.ttl / 2) {
+		s.mu.Lock()
+		s.dropExpired()
+		s.mu.Unlock()
+	}
+}
+
+func (s *memoryConversationStore) dropExpired() {
+	now := s.now()
+	for e := s.lru.Back(); e != nil; {
+		prev := e.Prev()
+		if now.After(e.Value.(*conversation).expiresAt) {
+			s.remove(e)
+		}
+		e = prev
+	}
+}
+
+// loadConversationStore enables session mode when CONVERSATIONS=on.
+// CONVERSATION_TTL sets the idle expiry (default 30m), and
+// CONVERSATION_MAX_SESSIONS and CONVERSATION_MAX_BYTES bound the store.
+func loadConversationStore() (ConversationStore, error) {
+	switch v := os.Getenv("CONVERSATIONS"); v {
+	case "", "off":
+		return nil, nil
+	case "on":
+	default:
+		return nil, fmt.Errorf("invalid CONVERSATIONS %q: want on or off", v)
+	}
+
+	ttl := defaultConversationTTL
+	if v := os.Getenv("CONVERSATION_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		ttl = d
+	}
+	maxSessions, err := envInt("CONVERSATION_MAX_SESSIONS")
+	if err != nil {
+		return nil, err
+	}
+	if maxSessions == 0 {
+		maxSessions = defaultMaxConversations
+	}
+	maxBytes, err := envInt("CONVERSATION_MAX_BYTES")
+	if err != nil {
+		return nil, err
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultMaxConversationBytes
+	}
+	return newMemoryConversationStore(ttl, maxSessions, maxBytes), nil
+}
+
+func deleteConversationHandler(w http.ResponseWriter, r *http.Request) {
+	if conversations == nil {
+		writeVersionedError(w, r, http.StatusNotFound, "invalid_request_error", "not_found", "Conversations are disabled")
+		return
+	}
+
+	owner := identityFromContext(r.Context()).KeyID
+	id := r.PathValue("id")
+	if !conversations.Delete(owner, id) {
+		writeVersionedError(w, r, http.StatusNotFound, "invalid_request_error", "conversation_not_found", "Conversation not found")
+		return
+	}
+
+	log.Printf("Deleted conversation %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
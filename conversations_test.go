@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testConversationStore(maxSessions, maxBytes int) (*memoryConversationStore, *time.Time) {
+	now := time.Unix(1_700_000_000, 0)
+	s := newMemoryConversationStore(time.Minute, maxSessions, maxBytes)
+	s.now = func() time.Time { return now }
+	return s, &now
+}
+
+func TestConversationsAreScopedByOwner(t *testing.T) {
+	s, _ := testConversationStore(10, 1<<20)
+	s.Append("key-a", "c1", Message{Role: "user", Content: "a's secret"})
+
+	if got := s.Load("key-b", "c1"); got != nil {
+		t.Errorf("other owner loaded %v", got)
+	}
+	if s.Delete("key-b", "c1") {
+		t.Error("other owner deleted the conversation")
+	}
+	if got := s.Load("key-a", "c1"); len(got) != 1 || got[0].Content != "a's secret" {
+		t.Errorf("owner loaded %v", got)
+	}
+	if !s.Delete("key-a", "c1") || s.Load("key-a", "c1") != nil {
+		t.Error("owner couldn't delete the conversation")
+	}
+}
+
+func TestConversationsExpire(t *testing.T) {
+	s, now := testConversationStore(10, 1<<20)
+	s.Append("k", "c1", Message{Role: "user", Content: "hi"})
+	*now = now.Add(59 * time.Second)
+	if s.Load("k", "c1") == nil {
+		t.Fatal("conversation expired early")
+	}
+	s.Append("k", "c1", Message{Role: "assistant", Content: "hello"})
+	// Appending restarts the idle timer
+	*now = now.Add(59 * time.Second)
+	if got := s.Load("k", "c1"); len(got) != 2 {
+		t.Fatalf("loaded %v, want both messages", got)
+	}
+	*now = now.Add(2 * time.Minute)
+	if s.Load("k", "c1") != nil || s.Delete("k", "c1") {
+		t.Error("expired conversation still there")
+	}
+	if s.bytes != 0 || s.lru.Len() != 0 {
+		t.Errorf("store holds %d bytes in %d sessions after expiry", s.bytes, s.lru.Len())
+	}
+}
+
+func TestConversationsEvictLeastRecentlyUsed(t *testing.T) {
+	s, _ := testConversationStore(2, 1<<20)
+	s.Append("k", "c1", Message{Role: "user", Content: "one"})
+	s.Append("k", "c2", Message{Role: "user", Content: "two"})
+	// Reading c1 makes c2 the least recently used
+	s.Load("k", "c1")
+	s.Append("k", "c3", Message{Role: "user", Content: "three"})
+
+	if s.Load("k", "c2") != nil {
+		t.Error("least recently used conversation kept")
+	}
+	if s.Load("k", "c1") == nil || s.Load("k", "c3") == nil {
+		t.Error("recently used conversation evicted")
+	}
+}
+
+func TestConversationsEvictToStayWithinBytes(t *testing.T) {
+	s, _ := testConversationStore(10, 100)
+	big := strings.Repeat("x", 36)
+	s.Append("k", "c1", Message{Role: "user", Content: big})
+	s.Append("k", "c2", Message{Role: "user", Content: big})
+	s.Append("k", "c3", Message{Role: "user", Content: big})
+
+	if s.Load("k", "c1") != nil {
+		t.Error("oldest conversation kept past the byte bound")
+	}
+	if s.Load("k", "c2") == nil || s.Load("k", "c3") == nil {
+		t.Error("conversations within the bound evicted")
+	}
+	if s.bytes != 80 {
+		t.Errorf("store holds %d bytes, want 80", s.bytes)
+	}
+}
+
+func TestConversationLongerThanStoreKeepsNewest(t *testing.T) {
+	s, _ := testConversationStore(10, 50)
+	for _, c := range []string{"first turn", "second turn", "third turn", "fourth turn"} {
+		s.Append("k", "c1", Message{Role: "user", Content: c})
+	}
+	got := s.Load("k", "c1")
+	if len(got) == 0 || got[len(got)-1].Content != "fourth turn" || got[0].Content == "first turn" {
+		t.Errorf("loaded %v, want the newest messages", got)
+	}
+	if s.bytes > 50 {
+		t.Errorf("store holds %d bytes, over its bound of 50", s.bytes)
+	}
+}
+
+func TestConversationsAreOptIn(t *testing.T) {
+	for v, want := range map[string]bool{"": false, "off": false, "on": true} {
+		t.Setenv("CONVERSATIONS", v)
+		store, err := loadConversationStore()
+		if err != nil || (store != nil) != want {
+			t.Errorf("CONVERSATIONS=%q: store = %v, %v", v, store, err)
+		}
+	}
+	t.Setenv("CONVERSATIONS", "yes")
+	if _, err := loadConversationStore(); err == nil {
+		t.Error("CONVERSATIONS=yes accepted")
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCollectionQueue    = 1000
+	defaultCollectionMaxBytes = 64 << 20
+	defaultCollectionRotate   = time.Hour
+	// batchRoute is the route batch lines are collected under
+	batchRoute = "POST /v1/batches"
+)
+
+// collectableRoutes are the routes whose completions can be collected.
+var collectableRoutes = []string{"POST /v1/chat/completions", "POST /v1/responses", batchRoute}
+
+// collectedSamples counts training-data samples by outcome: written,
+// dropped (the queue was full), write_error and uploaded (files).
+var collectedSamples = expvar.NewMap("gateway_data_collection_total")
+
+// dataCollection is nil unless DATA_COLLECTION_DIR is set.
+var dataCollection *dataCollector
+
+// trainingRecord is one sampled exchange. It never carries the caller's
+// key or identity.
+type trainingRecord struct {
+	ID           string            `json:"id"`
+	CreatedAt    time.Time         `json:"created_at"`
+	Route        string            `json:"route"`
+	Model        string            `json:"model"`
+	Messages     []Message         `json:"messages"`
+	Completion   string            `json:"completion"`
+	FinishReason string            `json:"finish_reason,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+}
+
+// dataCollector writes a sample of consented traffic as training data.
+// Requests are eligible when their route is in routes and their key
+// consents; eligible requests are kept at rate. Records are redacted,
+// then appended to samples-<UTC time>.jsonl files in dir by a single
+// writer goroutine, which rotates them at maxBytes or after rotateEvery
+// and, with an S3 URL, uploads closed files and removes them locally.
+type dataCollector struct {
+	dir         string
+	routes      []string
+	keys        []string
+	rate        float64
+	tags        map[string]string
+	redact      *regexp.Regexp
+	redactPath  string
+	maxBytes    int64
+	rotateEvery time.Duration
+	s3URL       string
+	s3Region    string
+
+	mu     sync.Mutex
+	queue  chan []byte
+	closed bool
+	done   chan struct{}
+
+	// Owned by the writer goroutine
+	file   *os.File
+	buf    *bufio.Writer
+	size   int64
+	opened time.Time
+}
+
+// loadDataCollection reads DATA_COLLECTION_DIR, DATA_COLLECTION_ROUTES,
+// DATA_COLLECTION_KEYS, DATA_COLLECTION_SAMPLE_RATE, DATA_COLLECTION_TAGS,
+// DATA_COLLECTION_REDACT, DATA_COLLECTION_MAX_BYTES,
+// DATA_COLLECTION_ROTATE_INTERVAL and the optional S3 settings, and starts
+// the writer. It returns nil when collection is off, which is the default.
+func loadDataCollection() (*dataCollector, error) {
+	dir := os.Getenv("DATA_COLLECTION_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+	c := &dataCollector{
+		dir:         dir,
+		rate:        1,
+		tags:        make(map[string]string),
+		rotateEvery: envDuration("DATA_COLLECTION_ROTATE_INTERVAL", defaultCollectionRotate),
+		s3URL:       strings.TrimSuffix(os.Getenv("DATA_COLLECTION_S3_URL"), "/"),
+		s3Region:    os.Getenv("DATA_COLLECTION_S3_REGION"),
+		queue:       make(chan []byte, defaultCollectionQueue),
+		done:        make(chan struct{}),
+	}
+	for _, route := range strings.Split(os.Getenv("DATA_COLLECTION_ROUTES"), ",") {
+		if route = strings.TrimSpace(route); route != "" {
+			c.routes = append(c.routes, route)
+		}
+	}
+	if len(c.routes) == 0 {
+		return nil, errors.New("DATA_COLLECTION_ROUTES must list the routes to collect from, such as POST /v1/chat/completions")
+	}
+	for _, key := range strings.Split(os.Getenv("DATA_COLLECTION_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			c.keys = append(c.keys, key)
+		}
+	}
+	if v := os.Getenv("DATA_COLLECTION_SAMPLE_RATE"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid DATA_COLLECTION_SAMPLE_RATE %q: want a number from 0 to 1", v)
+		}
+		c.rate = rate
+	}
+	if raw := os.Getenv("DATA_COLLECTION_TAGS"); raw != "" {
+		for _, pair := range strings.Split(raw, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || name == "" {
+				return nil, fmt.Errorf("invalid DATA_COLLECTION_TAGS entry %q: want name=value", pair)
+			}
+			c.tags[name] = value
+		}
+	}
+	if path := os.Getenv("DATA_COLLECTION_REDACT"); path != "" {
+		re, err := loadRedactPatterns(path)
+		if err != nil {
+			return nil, fmt.Errorf("DATA_COLLECTION_REDACT: %w", err)
+		}
+		c.redact, c.redactPath = re, path
+	}
+	maxBytes, err := envInt("DATA_COLLECTION_MAX_BYTES")
+	if err != nil {
+		return nil, err
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultCollectionMaxBytes
+	}
+	c.maxBytes = int64(maxBytes)
+	if c.rotateEvery <= 0 {
+		return nil, errors.New("invalid DATA_COLLECTION_ROTATE_INTERVAL: must be positive")
+	}
+	if c.s3Region == "" {
+		c.s3Region = "us-east-1"
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	go c.run()
+	return c, nil
+}
+
+// loadRedactPatterns reads a JSON file of keywords and patterns, as in a
+// guardrail blocklist, into one expression.
+func loadRedactPatterns(path string) (*regexp.Regexp, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var b Blocklist
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := b.compile(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return b.re, nil
+}
+
+// checkRoutes rejects routes that aren't registered or serve no
+// completions, and those relayed transparently, whose bodies the gateway
+// never reads.
+func (c *dataCollector) checkRoutes(patterns []string) error {
+	if c == nil {
+		return nil
+	}
+	for _, route := range c.routes {
+		if !slices.Contains(patterns, route) {
+			return fmt.Errorf("DATA_COLLECTION_ROUTES names unknown route %q", route)
+		}
+		if !slices.Contains(collectableRoutes, route) {
+			return fmt.Errorf("DATA_COLLECTION_ROUTES route %q serves no completions; want one of %s", route, strings.Join(collectableRoutes, ", "))
+		}
+		if _, path, _ := strings.Cut(route, " "); transparentRoutes.covers(path) {
+			return fmt.Errorf("DATA_COLLECTION_ROUTES route %q is relayed by TRANSPARENT_ROUTES, which never reads bodies", route)
+		}
+	}
+	return nil
+}
+
+func (c *dataCollector) covers(route string) bool {
+	return c != nil && slices.Contains(c.routes, route)
+}
+
+// consents reports whether key's traffic may be collected: listed in
+// DATA_COLLECTION_KEYS (or * for every caller), or a stored key that
+// consents with its parent.
+func (c *dataCollector) consents(key string) bool {
+	return slices.Contains(c.keys, "*") || slices.Contains(c.keys, key) ||
+		apiKeys.keyAllows(key, func(k *APIKey) bool { return k.DataCollection })
+}
+
+// sample decides whether to collect a request, returning the record to
+// finish once the completion is known, or nil. Batch lines are collected
+// under POST /v1/batches.
+func (c *dataCollector) sample(r *http.Request, req ChatCompletionRequest, model, requestID string) *trainingRecord {
+	if c == nil {
+		return nil
+	}
+	id := identityFromContext(r.Context())
+	route := recordFromContext(r.Context()).Route
+	if id.Method == "batch" {
+		route = batchRoute
+	}
+	if !c.covers(route) || !c.consents(id.KeyID) || rand.Float64() >= c.rate {
+		return nil
+	}
+	tr := &trainingRecord{
+		ID:        requestID,
+		CreatedAt: time.Now().UTC(),
+		Route:     route,
+		Model:     model,
+		Messages:  slices.Clone(req.Messages),
+	}
+	// X-Gateway-Tags ("name=value,...") tags the record alongside
+	// DATA_COLLECTION_TAGS, which win
+	tags := parseTags(r.Header.Get("X-Gateway-Tags"))
+	for name, value := range c.tags {
+		tags[name] = value
+	}
+	if len(tags) > 0 {
+		tr.Tags = tags
+	}
+	return tr
+}
+
+// parseTags reads "name=value" pairs separated by commas, skipping
+// malformed ones.
+func parseTags(raw string) map[string]string {
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		if name, value, ok := strings.Cut(strings.TrimSpace(pair), "="); ok && name != "" {
+			tags[name] = value
+		}
+	}
+	return tags
+}
+
+// finish completes a sampled record and queues it for the writer without
+// blocking; records that don't fit in the queue are dropped and counted.
+func (tr *trainingRecord) finish(completion, finishReason string) {
+	if tr == nil {
+		return
+	}
+	c := dataCollection
+	tr.Completion, tr.FinishReason = c.redactText(completion), finishReason
+	for i := range tr.Messages {
+		tr.Messages[i].Content = c.redactText(tr.Messages[i].Content)
+	}
+	line, err := json.Marshal(tr)
+	if err != nil {
+		log.Printf("Error encoding training record: %v", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		collectedSamples.Add("dropped", 1)
+		return
+	}
+	select {
+	case c.queue <- append(line, '\n'):
+	default:
+		collectedSamples.Add("dropped", 1)
+	}
+}
+
+// redactText removes resolved secrets and the DATA_COLLECTION_REDACT
+// patterns from s.
+func (c *dataCollector) redactText(s string) string {
+	s = redactor.redactString(s)
+	if c.redact != nil {
+		s = c.redact.ReplaceAllString(s, redactedSecret)
+	}
+	return s
+}
+
+// run writes queued records, rotating files by size and age. Files left
+// over from before a restart are uploaded once the first rotation comes.
+func (c *dataCollector) run() {
+	ticker := time.NewTicker(min(c.rotateEvery, time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case line, ok := <-c.queue:
+			if !ok {
+				c.rotate()
+				close(c.done)
+				return
+			}
+			c.write(line)
+		case <-ticker.C:
+			if c.buf != nil {
+				c.buf.Flush()
+				if time.Since(c.opened) >= c.rotateEvery {
+					c.rotate()
+				}
+			}
+		}
+	}
+}
+
+func (c *dataCollector) write(line []byte) {
+	if c.buf != nil && c.size > 0 && c.size+int64(len(line)) > c.maxBytes {
+		c.rotate()
+	}
+	if c.buf == nil {
+		name := filepath.Join(c.dir, "samples-"+time.Now().UTC().Format("20060102T150405.000000000")+".jsonl")
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+		if err != nil {
+			log.Printf("Opening training data file failed: %v", err)
+			collectedSamples.Add("write_error", 1)
+			return
+		}
+		c.file, c.buf, c.size, c.opened = f, bufio.NewWriter(f), 0, time.Now()
+	}
+	n, err := c.buf.Write(line)
+	c.size += int64(n)
+	if err != nil {
+		log.Printf("Writing training data failed: %v", err)
+		collectedSamples.Add("write_error", 1)
+		return
+	}
+	collectedSamples.Add("written", 1)
+}
+
+// rotate closes the current file and, with an S3 URL, uploads every closed
+// file, removing those uploaded. Failed uploads are retried next rotation.
+func (c *dataCollector) rotate() {
+	if c.buf != nil {
+		if err := c.buf.Flush(); err != nil {
+			log.Printf("Writing training data failed: %v", err)
+			collectedSamples.Add("write_error", 1)
+		}
+		c.file.Close()
+		c.file, c.buf = nil, nil
+	}
+	if c.s3URL == "" {
+		return
+	}
+	names, _ := filepath.Glob(filepath.Join(c.dir, "samples-*.jsonl"))
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err == nil {
+			err = uploadS3(c.s3URL, c.s3Region, filepath.Base(name), "application/jsonl", data)
+		}
+		if err != nil {
+			log.Printf("Uploading training data file %s failed: %v", filepath.Base(name), err)
+			return
+		}
+		os.Remove(name)
+		collectedSamples.Add("uploaded", 1)
+	}
+}
+
+// close stops accepting records and waits until the queued ones are
+// written and the last file closed.
+func (c *dataCollector) close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	c.mu.Unlock()
+	<-c.done
+}
+
+// stage describes collection on route for /admin/routes.
+func (c *dataCollector) stage(route string) routeStage {
+	stage := routeStage{Name: "data_collection", Enabled: c.covers(route)}
+	if c == nil {
+		return stage
+	}
+	stage.Settings = map[string]setting{
+		"routes":      envSetting("DATA_COLLECTION_ROUTES", c.routes),
+		"keys":        envSetting("DATA_COLLECTION_KEYS", c.keys),
+		"sample_rate": envSetting("DATA_COLLECTION_SAMPLE_RATE", c.rate),
+		"dir":         envSetting("DATA_COLLECTION_DIR", c.dir),
+		"redact":      envSetting("DATA_COLLECTION_REDACT", c.redactPath),
+		"s3_url":      envSetting("DATA_COLLECTION_S3_URL", c.s3URL),
+	}
+	return stage
+}
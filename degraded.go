@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+)
+
+// degradedResponses counts completions synthesized because the backend was down.
+var degradedResponses = expvar.NewInt("gateway_degraded_responses_total")
+
+// isBackendUnavailable reports whether err means the backend could not serve
+// the request at all (transport failure or 5xx), as opposed to rejecting it.
+func isBackendUnavailable(err error) bool {
+	var statusErr *backendStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// degradedResponse returns the canned completion the catalog opts model
+// into when its backend is down, or "".
+func (c *modelCatalog) degradedResponse(model string) string {
+	if m, ok := c.lookup(model); ok {
+		return m.DegradedResponse
+	}
+	return ""
+}
+
+// createDegradedResponse builds the canned completion served when the
+// model sets degraded_response and the backend is unavailable. Usage is estimated
+// from the full conversation so callers aren't told the request was free.
+func createDegradedResponse(requestID string, messages []Message, content string) ChatCompletionResponse {
+	promptTokens := estimatePromptTokens(messages)
+	completionTokens := approximateTokens(content)
+
+	return ChatCompletionResponse{
+		ID:     requestID,
+		Object: "chat.completion",
+		Choices: []Choice{
+			{
+				Index: 0,
+				Message: Message{
+					Role:    "assistant",
+					Content: content,
+				},
+				FinishReason: "stop",
+			},
+		},
+		Usage: Usage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
+		},
+	}
+}
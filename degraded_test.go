@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestIsBackendUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"transport error", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"timeout", context.DeadlineExceeded, true},
+		{"500", &backendStatusError{StatusCode: http.StatusInternalServerError}, true},
+		{"503", &backendStatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{"wrapped 502", fmt.Errorf("calling backend: %w", &backendStatusError{StatusCode: http.StatusBadGateway}), true},
+		{"400", &backendStatusError{StatusCode: http.StatusBadRequest}, false},
+		{"429", &backendStatusError{StatusCode: http.StatusTooManyRequests}, false},
+		{"wrapped 404", fmt.Errorf("calling backend: %w", &backendStatusError{StatusCode: http.StatusNotFound}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isBackendUnavailable(tt.err); got != tt.want {
+				t.Errorf("isBackendUnavailable(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateDegradedResponse(t *testing.T) {
+	messages := []Message{
+		{Role: "system", Content: "You are terse."},
+		{Role: "user", Content: "What is the capital of France?"},
+	}
+	resp := createDegradedResponse("req-1", messages, "The service is busy, try again shortly.")
+
+	if resp.ID != "req-1" || resp.Object != "chat.completion" {
+		t.Errorf("id, object = %q, %q, want req-1, chat.completion", resp.ID, resp.Object)
+	}
+	if len(resp.Choices) != 1 {
+		t.Fatalf("got %d choices, want 1", len(resp.Choices))
+	}
+	c := resp.Choices[0]
+	if c.Index != 0 || c.FinishReason != "stop" || c.Message.Role != "assistant" || c.Message.Content != "The service is busy, try again shortly." {
+		t.Errorf("choice = %+v", c)
+	}
+	// The prompt estimate covers the whole conversation, system prompt
+	// included: 44 bytes at ~4 per token
+	if resp.Usage.PromptTokens != 11 {
+		t.Errorf("prompt_tokens = %d, want 11", resp.Usage.PromptTokens)
+	}
+	if resp.Usage.CompletionTokens != 10 {
+		t.Errorf("completion_tokens = %d, want 10", resp.Usage.CompletionTokens)
+	}
+	if resp.Usage.TotalTokens != resp.Usage.PromptTokens+resp.Usage.CompletionTokens {
+		t.Errorf("total_tokens = %d, want %d", resp.Usage.TotalTokens, resp.Usage.PromptTokens+resp.Usage.CompletionTokens)
+	}
+}
+
+func TestDegradedResponseIsPerModel(t *testing.T) {
+	c := &modelCatalog{models: map[string]*ModelInfo{
+		"opted-in": {ID: "opted-in", DegradedResponse: "Try again later."},
+		"plain":    {ID: "plain"},
+	}}
+	for model, want := range map[string]string{"opted-in": "Try again later.", "plain": "", "unknown": ""} {
+		if got := c.degradedResponse(model); got != want {
+			t.Errorf("degradedResponse(%q) = %q, want %q", model, got, want)
+		}
+	}
+}
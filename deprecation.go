@@ -0,0 +1,55 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// deprecatedRequests counts requests to deprecated models, by model.
+var deprecatedRequests = expvar.NewMap("gateway_deprecated_model_requests_total")
+
+// sunsetDateLayout is the catalog format for sunset_date.
+const sunsetDateLayout = "2006-01-02"
+
+// checkDeprecation adds Deprecation, Sunset and Warning headers for
+// deprecated models. Once the sunset date has passed it returns an error
+// naming the replacement, unless SUNSET_POLICY=warn keeps serving the model.
+func (c *modelCatalog) checkDeprecation(w http.ResponseWriter, model string) error {
+	m, ok := c.lookup(model)
+	if !ok || !m.Deprecated {
+		return nil
+	}
+	deprecatedRequests.Add(m.ID, 1)
+
+	past := !m.sunset.IsZero() && !time.Now().Before(m.sunset)
+	msg := fmt.Sprintf("Model %s is deprecated", m.ID)
+	switch {
+	case past:
+		msg += " and was retired on " + m.SunsetDate
+	case !m.sunset.IsZero():
+		msg += " and will be removed on " + m.SunsetDate
+	}
+	if m.Replacement != "" {
+		msg += "; use " + m.Replacement + " instead"
+	}
+
+	if past && os.Getenv("SUNSET_POLICY") != "warn" {
+		log.Printf("Rejected request for sunset model %q", m.ID)
+		if m.Replacement != "" {
+			return fmt.Errorf("model %s was retired on %s; use %s instead", m.ID, m.SunsetDate, m.Replacement)
+		}
+		return fmt.Errorf("model %s was retired on %s", m.ID, m.SunsetDate)
+	}
+
+	log.Printf("Request for deprecated model %q", m.ID)
+	w.Header().Set("Deprecation", "true")
+	if !m.sunset.IsZero() {
+		w.Header().Set("Sunset", m.sunset.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Warning", fmt.Sprintf("299 - %q", msg))
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// echoSystemFingerprint is the system_fingerprint echo mode answers with;
+// its replies depend on nothing but the request.
+const echoSystemFingerprint = "fp_echo"
+
+// errMissingFingerprint ends a deterministic stream whose backend sent no
+// system_fingerprint.
+var errMissingFingerprint = errors.New("backend sent no system_fingerprint")
+
+// deterministicRoutes lists the DETERMINISTIC_ROUTES patterns.
+var deterministicRoutes = loadDeterministicRoutes()
+
+// Determinism identifies what a deterministic route's response was
+// generated from, so a test suite can tell its configuration drifted. It is
+// returned in the response's gateway field.
+type Determinism struct {
+	// RequestHash is the SHA-256 of the backend and the request as sent to
+	// it, without stream, stream_options and user
+	RequestHash string `json:"request_hash"`
+	Seed        int64  `json:"seed"`
+}
+
+// determinismPolicy is the routes whose requests must be reproducible:
+// seeded, at temperature 0, and answered with a system_fingerprint.
+type determinismPolicy []string
+
+func loadDeterministicRoutes() determinismPolicy {
+	var routes determinismPolicy
+	for _, route := range strings.Split(os.Getenv("DETERMINISTIC_ROUTES"), ",") {
+		if route = strings.TrimSpace(route); route != "" {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// checkRoutes fails for routes other than chat completions, the only one
+// with a seed.
+func (d determinismPolicy) checkRoutes(patterns []string) error {
+	for _, route := range d {
+		if !slices.Contains(patterns, route) {
+			return fmt.Errorf("DETERMINISTIC_ROUTES names unknown route %q", route)
+		}
+		if route != "POST /v1/chat/completions" || transparentRoutes.covers("/v1/chat/completions") {
+			return fmt.Errorf("DETERMINISTIC_ROUTES: only POST /v1/chat/completions, when not transparent, can be deterministic")
+		}
+	}
+	return nil
+}
+
+func (d determinismPolicy) covers(route string) bool {
+	return slices.Contains(d, route)
+}
+
+// checkRequest rejects requests to a deterministic route without a seed or
+// with a temperature other than 0, key defaults included.
+func (d determinismPolicy) checkRequest(route string, req *ChatCompletionRequest) *RouteError {
+	if !d.covers(route) {
+		return nil
+	}
+	switch {
+	case req.Seed == nil:
+		return &RouteError{Status: http.StatusBadRequest, Type: "invalid_request_error", Code: "seed_required",
+			Message: "This endpoint is deterministic: requests must set seed"}
+	case req.Temperature == nil || *req.Temperature != 0:
+		return &RouteError{Status: http.StatusBadRequest, Type: "invalid_request_error", Code: "temperature_required",
+			Message: "This endpoint is deterministic: requests must set temperature to 0"}
+	}
+	return nil
+}
+
+// determinism describes req as it is sent to backend, when route is
+// deterministic.
+func (d determinismPolicy) determinism(route string, backend *Backend, req ChatCompletionRequest) *Determinism {
+	if !d.covers(route) || req.Seed == nil {
+		return nil
+	}
+	seed := *req.Seed
+	req.Stream, req.StreamOptions, req.User = false, nil, ""
+	data, _ := json.Marshal(req)
+	h := sha256.New()
+	h.Write([]byte(backend.Name + "\n"))
+	h.Write(data)
+	return &Determinism{RequestHash: "sha256:" + hex.EncodeToString(h.Sum(nil)), Seed: seed}
+}
+
+// missingFingerprint is the error for a deterministic route's backend
+// answering without a system_fingerprint, so the response can't be
+// checked for reproducibility.
+func missingFingerprint(backend *Backend) *RouteError {
+	return &RouteError{Status: http.StatusBadGateway, Type: "server_error", Code: "missing_system_fingerprint",
+		Message: fmt.Sprintf("Backend %q returned no system_fingerprint, so the response can't be verified as reproducible", backend.Name)}
+}
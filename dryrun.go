@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/vinayhpandya/ai_inference_gateway/client"
+)
+
+// dryRunHeader asks the gateway to report what it would do with a request
+// instead of sending it.
+const dryRunHeader = "X-Gateway-Dry-Run"
+
+// dryRuns counts dry-run reports served, by model.
+var dryRuns = expvar.NewMap("gateway_dry_runs_total")
+
+type dryRunKey struct{}
+
+// isDryRun reports whether r asks for a dry run.
+func isDryRun(r *http.Request) bool {
+	return r.Header.Get(dryRunHeader) == "true"
+}
+
+// inDryRun reports whether ctx belongs to a dry run, so stages that would
+// call a backend themselves (such as summarization) can skip it.
+func inDryRun(ctx context.Context) bool {
+	v, _ := ctx.Value(dryRunKey{}).(bool)
+	return v
+}
+
+// dryRunAllowed reports whether keyID may use dry runs: keys listed in
+// DRY_RUN_KEYS ("*" for every caller) and stored API keys with dry_run set.
+func dryRunAllowed(keyID string) bool {
+	for _, k := range strings.Split(os.Getenv("DRY_RUN_KEYS"), ",") {
+		if k = strings.TrimSpace(k); k == "*" || (k != "" && k == keyID) {
+			return true
+		}
+	}
+	return apiKeys.keyAllows(keyID, func(k *APIKey) bool { return k.DryRun })
+}
+
+// dryRunLimitKey returns the concurrency limiter key for a permitted dry
+// run: DRY_RUN_LIMITS=separate gives dry runs their own per-key pool, and
+// the default, exclude, leaves them unlimited (ok is false).
+func dryRunLimitKey(keyID string) (key string, ok bool) {
+	if os.Getenv("DRY_RUN_LIMITS") != "separate" {
+		return "", false
+	}
+	return "dry_run:" + keyID, true
+}
+
+// dryRunReport describes how the gateway would have handled a request; it
+// is shared with the client package.
+type dryRunReport = client.DryRunReport
+
+// writeDryRun completes a report from the request as it would be sent and
+// writes it with status 200.
+func writeDryRun(w http.ResponseWriter, model string, req ChatCompletionRequest, report dryRunReport) {
+	report.Object = "gateway.dry_run"
+	report.Model = model
+	report.Request, _ = json.Marshal(req)
+	if report.Transforms == nil {
+		report.Transforms = []string{}
+	}
+	if catalog.Load().stopEnforced(model, req) {
+		report.Transforms = append(report.Transforms, "stop sequences enforced by the gateway")
+	}
+	for _, name := range []string{"X-Gateway-Warning", "Warning"} {
+		if v := w.Header().Get(name); v != "" {
+			report.Warnings = append(report.Warnings, v)
+		}
+	}
+
+	report.EstimatedPromptTokens = estimatePromptTokens(req.Messages)
+	if m, ok := catalog.Load().lookup(model); ok {
+		report.EstimatedCostUSD = float64(report.EstimatedPromptTokens) * m.Pricing.PromptPer1K / 1000
+		if req.MaxTokens != nil {
+			report.EstimatedCostUSD += float64(*req.MaxTokens) * m.Pricing.CompletionPer1K / 1000
+		}
+	}
+	dryRuns.Add(model, 1)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// ensembleDryRun reports an ensemble request without calling its members.
+func ensembleDryRun(w http.ResponseWriter, req ChatCompletionRequest, e *Ensemble, report dryRunReport) {
+	report.Backend = "ensemble"
+	report.Members = slices.Clone(e.Members)
+	report.Transforms = []string{"ensemble policy " + e.Policy}
+	if e.Policy == policyJudge {
+		report.Members = append(report.Members, e.JudgeModel)
+	}
+	writeDryRun(w, req.Model, req, report)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits echo mode enforces as OpenAI does, so clients tested against echo
+// fail there the way they would in production.
+const (
+	maxEchoChoices     = 128
+	maxStopSequences   = 4
+	maxEchoTopLogprobs = 20
+)
+
+// validateEchoRequest rejects parameters OpenAI would, for requests echo
+// mode answers. Backends validate their own requests.
+func validateEchoRequest(req ChatCompletionRequest) *RouteError {
+	invalid := func(format string, args ...any) *RouteError {
+		return &RouteError{Status: http.StatusBadRequest, Type: "invalid_request_error", Code: "invalid_value", Message: fmt.Sprintf(format, args...)}
+	}
+	conflict := func(message string) *RouteError {
+		return &RouteError{Status: http.StatusBadRequest, Type: "invalid_request_error", Code: "conflicting_parameters", Message: message}
+	}
+	switch {
+	case len(req.Messages) == 0:
+		return invalid("messages must contain at least one message")
+	case req.N != nil && (*req.N < 1 || *req.N > maxEchoChoices):
+		return invalid("n must be between 1 and %d, got %d", maxEchoChoices, *req.N)
+	case req.MaxTokens != nil && *req.MaxTokens < 1:
+		return invalid("max_tokens must be at least 1, got %d", *req.MaxTokens)
+	case req.Temperature != nil && (*req.Temperature < 0 || *req.Temperature > 2):
+		return invalid("temperature must be between 0 and 2, got %g", *req.Temperature)
+	case req.TopP != nil && (*req.TopP < 0 || *req.TopP > 1):
+		return invalid("top_p must be between 0 and 1, got %g", *req.TopP)
+	case len(req.Stop) > maxStopSequences:
+		return invalid("stop may have at most %d sequences, got %d", maxStopSequences, len(req.Stop))
+	case req.TopLogprobs != nil && (*req.TopLogprobs < 0 || *req.TopLogprobs > maxEchoTopLogprobs):
+		return invalid("top_logprobs must be between 0 and %d, got %d", maxEchoTopLogprobs, *req.TopLogprobs)
+	case req.TopLogprobs != nil && (req.Logprobs == nil || !*req.Logprobs):
+		return conflict("top_logprobs requires logprobs to be true")
+	case req.StreamOptions != nil && !req.Stream:
+		return conflict("stream_options is only allowed when stream is true")
+	}
+	return nil
+}
+
+// echoCompletion is echo mode's reply to req as a backend would return it:
+// cut at the first stop sequence, then at max_tokens, with the finish
+// reason either sets.
+func echoCompletion(req ChatCompletionRequest, prompt Message) (string, string) {
+	content, _ := truncateAtStop(echoReply(prompt), req.Stop)
+	// The inverse of approximateTokens
+	if req.MaxTokens != nil && approximateTokens(content) > *req.MaxTokens {
+		cut := *req.MaxTokens * 4
+		for cut > 0 && !utf8.RuneStart(content[cut]) {
+			cut--
+		}
+		return content[:cut], "length"
+	}
+	return content, "stop"
+}
+
+// echoChoices is how many choices req asks for.
+func echoChoices(req ChatCompletionRequest) int {
+	if req.N == nil {
+		return 1
+	}
+	return *req.N
+}
+
+// echoUsage counts an echo reply's tokens, completion tokens for each of
+// its choices.
+func echoUsage(req ChatCompletionRequest, content string) Usage {
+	promptTokens := estimatePromptTokens(req.Messages)
+	completionTokens := echoChoices(req) * approximateTokens(content)
+	return Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+}
+
+// echoWords splits an echo reply into the deltas it is streamed as.
+func echoWords(content string) []string {
+	if content == "" {
+		return nil
+	}
+	return strings.SplitAfter(content, " ")
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// openAIFinishReasons are the finish reasons OpenAI's schema allows.
+var openAIFinishReasons = []string{"stop", "length", "tool_calls", "content_filter", "function_call"}
+
+// checkFields reports the keys of want missing from obj or of the wrong
+// JSON type: "string", "number", "object", "array" or "null".
+func checkFields(t *testing.T, where string, obj map[string]any, want map[string]string) {
+	t.Helper()
+	for key, typ := range want {
+		v, ok := obj[key]
+		var got string
+		switch v.(type) {
+		case string:
+			got = "string"
+		case float64:
+			got = "number"
+		case map[string]any:
+			got = "object"
+		case []any:
+			got = "array"
+		case nil:
+			got = "null"
+		}
+		if !ok || !slices.Contains(strings.Split(typ, "|"), got) {
+			t.Errorf("%s: %s is %v, want a %s", where, key, v, typ)
+		}
+	}
+}
+
+// checkUsage checks a usage object's counts and that they add up.
+func checkUsage(t *testing.T, where string, usage map[string]any) {
+	t.Helper()
+	checkFields(t, where+" usage", usage, map[string]string{"prompt_tokens": "number", "completion_tokens": "number", "total_tokens": "number"})
+	if p, c, total := usage["prompt_tokens"], usage["completion_tokens"], usage["total_tokens"]; p != nil && c != nil && total != nil && p.(float64)+c.(float64) != total.(float64) {
+		t.Errorf("%s usage: %v + %v != %v", where, p, c, total)
+	}
+}
+
+// checkCompletionSchema checks a chat.completion has every field OpenAI's
+// schema requires.
+func checkCompletionSchema(t *testing.T, body string) {
+	t.Helper()
+	var resp map[string]any
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	checkFields(t, "completion", resp, map[string]string{"id": "string", "object": "string", "created": "number", "model": "string", "choices": "array", "usage": "object"})
+	if resp["object"] != "chat.completion" {
+		t.Errorf("object = %v, want chat.completion", resp["object"])
+	}
+	choices, _ := resp["choices"].([]any)
+	if len(choices) == 0 {
+		t.Errorf("no choices: %s", body)
+	}
+	for i, c := range choices {
+		choice, _ := c.(map[string]any)
+		checkFields(t, "choice", choice, map[string]string{"index": "number", "message": "object", "finish_reason": "string"})
+		if choice["index"] != float64(i) || !slices.Contains(openAIFinishReasons, choice["finish_reason"].(string)) {
+			t.Errorf("choice %d: index %v, finish_reason %v", i, choice["index"], choice["finish_reason"])
+		}
+		message, _ := choice["message"].(map[string]any)
+		checkFields(t, "message", message, map[string]string{"role": "string", "content": "string|null"})
+		if message["role"] != "assistant" {
+			t.Errorf("choice %d role = %v", i, message["role"])
+		}
+	}
+	usage, _ := resp["usage"].(map[string]any)
+	checkUsage(t, "completion", usage)
+}
+
+// checkChunkSchema checks a chat.completion.chunk has every field OpenAI's
+// schema requires, and returns its usage, if any.
+func checkChunkSchema(t *testing.T, event string) map[string]any {
+	t.Helper()
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(event), &chunk); err != nil {
+		t.Fatalf("%v: %s", err, event)
+	}
+	checkFields(t, "chunk", chunk, map[string]string{"id": "string", "object": "string", "created": "number", "model": "string", "choices": "array"})
+	if chunk["object"] != "chat.completion.chunk" {
+		t.Errorf("object = %v, want chat.completion.chunk", chunk["object"])
+	}
+	choices, _ := chunk["choices"].([]any)
+	for _, c := range choices {
+		choice, _ := c.(map[string]any)
+		checkFields(t, "chunk choice", choice, map[string]string{"index": "number", "delta": "object", "finish_reason": "string|null"})
+		if reason, ok := choice["finish_reason"].(string); ok && !slices.Contains(openAIFinishReasons, reason) {
+			t.Errorf("finish_reason = %q", reason)
+		}
+	}
+	usage, _ := chunk["usage"].(map[string]any)
+	if usage != nil {
+		checkUsage(t, "chunk", usage)
+	}
+	if len(choices) == 0 && usage == nil {
+		t.Errorf("chunk with neither choices nor usage: %s", event)
+	}
+	return usage
+}
+
+// Client scenarios against echo mode, each sent as a plain request and as
+// a stream. Echo replies "Echo: hello there world", 6 tokens, to a prompt
+// of 5.
+func TestEchoScenarios(t *testing.T) {
+	captureLog(t)
+	t.Setenv("BACKEND_URL", "")
+	useCatalog(t)
+	tests := []struct {
+		name   string
+		params string
+		n      int
+		want   string
+		finish string
+	}{
+		{"plain", ``, 1, "Echo: hello there world", "stop"},
+		{"sampling parameters", `,"temperature":2,"top_p":0,"seed":1`, 1, "Echo: hello there world", "stop"},
+		{"max_tokens", `,"max_tokens":2`, 1, "Echo: he", "length"},
+		{"max_tokens above the reply", `,"max_tokens":100`, 1, "Echo: hello there world", "stop"},
+		{"max_completion_tokens", `,"max_completion_tokens":3`, 1, "Echo: hello ", "length"},
+		{"stop string", `,"stop":"there"`, 1, "Echo: hello ", "stop"},
+		{"earliest of several stops", `,"stop":["world","o:"]`, 1, "Ech", "stop"},
+		{"stop inside max_tokens", `,"stop":["world"],"max_tokens":5`, 1, "Echo: hello there ", "stop"},
+		{"max_tokens before the stop", `,"stop":["world"],"max_tokens":4`, 1, "Echo: hello ther", "length"},
+		{"stop not in the reply", `,"stop":["xyz"]`, 1, "Echo: hello there world", "stop"},
+		{"n", `,"n":3`, 3, "Echo: hello there world", "stop"},
+		{"n with max_tokens", `,"n":2,"max_tokens":1`, 2, "Echo", "length"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			promptTokens, completionTokens := 5.0, float64(tt.n*approximateTokens(tt.want))
+
+			w := chatAs("", `{"model":"echo-model","messages":[{"role":"user","content":"hello there world"}]`+tt.params+`}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			checkCompletionSchema(t, w.Body.String())
+			var resp ChatCompletionResponse
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if resp.Model != "echo-model" || len(resp.Choices) != tt.n {
+				t.Errorf("model %q, %d choices; want echo-model and %d", resp.Model, len(resp.Choices), tt.n)
+			}
+			for _, c := range resp.Choices {
+				if c.Message.Content != tt.want || c.FinishReason != tt.finish {
+					t.Errorf("choice %d = %q, %s; want %q, %s", c.Index, c.Message.Content, c.FinishReason, tt.want, tt.finish)
+				}
+			}
+			if u := resp.Usage; float64(u.PromptTokens) != promptTokens || float64(u.CompletionTokens) != completionTokens {
+				t.Errorf("usage = %+v, want %v prompt and %v completion tokens", u, promptTokens, completionTokens)
+			}
+
+			w = chatAs("", `{"model":"echo-model","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hello there world"}]`+tt.params+`}`)
+			if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+				t.Fatalf("stream: %d %s: %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+			}
+			events := sseEvents(w.Body.String())
+			if events[len(events)-1] != "[DONE]" {
+				t.Errorf("stream ends with %q, want [DONE]", events[len(events)-1])
+			}
+			var usage map[string]any
+			for _, e := range events[:len(events)-1] {
+				if u := checkChunkSchema(t, e); u != nil {
+					usage = u
+				}
+			}
+			if usage == nil || usage["prompt_tokens"] != promptTokens || usage["completion_tokens"] != completionTokens {
+				t.Errorf("stream usage = %v, want %v prompt and %v completion tokens", usage, promptTokens, completionTokens)
+			}
+			text, reasons := choiceText(t, events[:len(events)-1]), choiceFinishes(t, events[:len(events)-1])
+			if len(text) != tt.n {
+				t.Errorf("stream choices %v, want %d", text, tt.n)
+			}
+			for i := range tt.n {
+				if text[i] != tt.want || !slices.Equal(reasons[i], []string{tt.finish}) {
+					t.Errorf("stream choice %d = %q, %q; want %q, [%s]", i, text[i], reasons[i], tt.want, tt.finish)
+				}
+			}
+		})
+	}
+}
+
+// Echo mode rejects what OpenAI would, with OpenAI's error body, whether
+// or not the request streams.
+func TestEchoRejectsInvalidParameters(t *testing.T) {
+	captureLog(t)
+	t.Setenv("BACKEND_URL", "")
+	useCatalog(t)
+	user := `"messages":[{"role":"user","content":"hi"}]`
+	tests := []struct {
+		name, body, code, message string
+	}{
+		{"no messages", `"messages":[]`, "invalid_value", "messages must contain at least one message"},
+		{"n of 0", user + `,"n":0`, "invalid_value", "n must be between 1 and 128, got 0"},
+		{"n over the limit", user + `,"n":129`, "invalid_value", "n must be between 1 and 128, got 129"},
+		{"max_tokens of 0", user + `,"max_tokens":0`, "invalid_value", "max_tokens must be at least 1, got 0"},
+		{"temperature", user + `,"temperature":2.5`, "invalid_value", "temperature must be between 0 and 2, got 2.5"},
+		{"negative temperature", user + `,"temperature":-1`, "invalid_value", "temperature must be between 0 and 2, got -1"},
+		{"top_p", user + `,"top_p":-0.1`, "invalid_value", "top_p must be between 0 and 1, got -0.1"},
+		{"too many stops", user + `,"stop":["a","b","c","d","e"]`, "invalid_value", "stop may have at most 4 sequences, got 5"},
+		{"top_logprobs", user + `,"logprobs":true,"top_logprobs":21`, "invalid_value", "top_logprobs must be between 0 and 20, got 21"},
+		{"top_logprobs without logprobs", user + `,"top_logprobs":2`, "conflicting_parameters", "top_logprobs requires logprobs to be true"},
+	}
+	for _, tt := range tests {
+		for _, stream := range []string{"", `,"stream":true`} {
+			w := chatAs("", `{"model":"echo-model",`+tt.body+stream+`}`)
+			if w.Code != http.StatusBadRequest || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+				t.Errorf("%s%s: %d %s, want a 400 JSON error", tt.name, stream, w.Code, w.Header().Get("Content-Type"))
+				continue
+			}
+			var body map[string]map[string]any
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || len(body) != 1 {
+				t.Errorf("%s%s: error body %s", tt.name, stream, w.Body)
+				continue
+			}
+			checkFields(t, tt.name, body["error"], map[string]string{"message": "string", "type": "string", "code": "string"})
+			if e := body["error"]; e["type"] != "invalid_request_error" || e["code"] != tt.code || e["message"] != tt.message {
+				t.Errorf("%s%s: error = %v, want %s: %s", tt.name, stream, e, tt.code, tt.message)
+			}
+		}
+	}
+
+	// What only streams may ask for
+	w := chatAs("", `{"model":"echo-model",`+user+`,"stream_options":{"include_usage":true}}`)
+	if !strings.Contains(w.Body.String(), `"code":"conflicting_parameters"`) || w.Code != http.StatusBadRequest {
+		t.Errorf("stream_options without stream: %d %s", w.Code, w.Body)
+	}
+	if w := chatAs("", `{"model":"echo-model","stream":true,`+user+`,"stream_options":{"include_usage":true}}`); w.Code != http.StatusOK {
+		t.Errorf("stream_options with stream: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestEchoCompletion(t *testing.T) {
+	intp := func(n int) *int { return &n }
+	prompt := Message{Role: "user", Content: "héllo wörld"}
+	tests := []struct {
+		req          ChatCompletionRequest
+		want, finish string
+	}{
+		{ChatCompletionRequest{}, "Echo: héllo wörld", "stop"},
+		// Cut on a rune boundary: byte 8 is inside é
+		{ChatCompletionRequest{MaxTokens: intp(2)}, "Echo: h", "length"},
+		{ChatCompletionRequest{Stop: StopSequences{"", "wö"}}, "Echo: héllo ", "stop"},
+		{ChatCompletionRequest{Stop: StopSequences{"Echo"}}, "", "stop"},
+	}
+	for _, tt := range tests {
+		if got, finish := echoCompletion(tt.req, prompt); got != tt.want || finish != tt.finish {
+			t.Errorf("%+v: %q, %s; want %q, %s", tt.req, got, finish, tt.want, tt.finish)
+		}
+	}
+	// Nothing to stream for an empty reply, but the finish still comes
+	if words := echoWords(""); words != nil {
+		t.Errorf("echoWords(\"\") = %q", words)
+	}
+	if words := echoWords("a b c"); !slices.Equal(words, []string{"a ", "b ", "c"}) {
+		t.Errorf("echoWords = %q", words)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const defaultEndpointNegativeTTL = 5 * time.Second
+
+// endpointFailovers counts requests moved to another endpoint after a
+// connection failure, by backend.
+var endpointFailovers = expvar.NewMap("gateway_endpoint_failovers_total")
+
+// endpoints lists the URLs serving backend: URL first, then URLs.
+func (b *Backend) endpoints() []string {
+	if len(b.URLs) == 0 {
+		return []string{b.URL}
+	}
+	eps := []string{b.URL}
+	for _, u := range b.URLs {
+		if !slices.Contains(eps, u) {
+			eps = append(eps, u)
+		}
+	}
+	return eps
+}
+
+// atEndpoint returns a copy of b that sends to url.
+func (b *Backend) atEndpoint(url string) *Backend {
+	c := *b
+	c.URL = url
+	return &c
+}
+
+// endpointBalancer rotates requests across a backend's endpoints, or with
+// a balancing block starts each request at a weighted pick. Within
+// one request it avoids endpoints already attempted, and across requests it
+// avoids endpoints that refused a connection within ENDPOINT_NEGATIVE_TTL.
+var endpointBalancer = struct {
+	next sync.Map // backend name -> *atomic.Uint64
+
+	mu      sync.Mutex
+	refused map[string]time.Time // endpoint URL -> when it may be tried again
+	// latency is an EWMA of each endpoint's time to response headers
+	latency map[string]time.Duration
+	// forceRemote holds backends an admin moved off their local endpoints
+	forceRemote map[string]bool
+	// health tracks endpoints of adaptively balanced backends; pinStatic
+	// holds backends an admin pinned to their static weights
+	health    map[string]*endpointHealth
+	pinStatic map[string]bool
+	// inflight counts requests open at each endpoint, streams included
+	inflight map[string]int
+}{
+	refused:     make(map[string]time.Time),
+	latency:     make(map[string]time.Duration),
+	forceRemote: make(map[string]bool),
+	health:      make(map[string]*endpointHealth),
+	pinStatic:   make(map[string]bool),
+	inflight:    make(map[string]int),
+}
+
+// eligibleEndpoints lists the endpoints pickEndpoint may choose for b, in
+// its rotation order starting at start.
+func eligibleEndpoints(b *Backend, start int) []string {
+	eps := b.endpoints()
+	order := append(slices.Clone(eps[start%len(eps):]), eps[:start%len(eps)]...)
+	if b.EndpointPolicy == policyPreferLocalRegion {
+		order = regionOrder(b, order)
+	}
+	return order
+}
+
+// pickEndpoint chooses the next endpoint for a request that has already
+// tried the endpoints in tried. Untried endpoints that are not marked as
+// refusing connections come first, then any untried endpoint, and only
+// once every endpoint has been tried are repeats allowed. With the
+// prefer-local-region policy, local endpoints are exhausted before remote
+// ones.
+func pickEndpoint(b *Backend, tried []string) string {
+	if len(b.endpoints()) == 1 {
+		return b.URL
+	}
+	var start int
+	if b.Balancing != nil {
+		start = pickWeighted(b)
+	} else {
+		v, _ := endpointBalancer.next.LoadOrStore(b.Name, new(atomic.Uint64))
+		start = int(v.(*atomic.Uint64).Add(1) % uint64(len(b.endpoints())))
+	}
+	eps := eligibleEndpoints(b, start)
+
+	now := time.Now()
+	endpointBalancer.mu.Lock()
+	defer endpointBalancer.mu.Unlock()
+	var untried string
+	for _, ep := range eps {
+		if slices.Contains(tried, ep) {
+			continue
+		}
+		if now.Before(endpointBalancer.refused[ep]) {
+			if untried == "" {
+				untried = ep
+			}
+			continue
+		}
+		return ep
+	}
+	if untried != "" {
+		return untried
+	}
+	return eps[0]
+}
+
+// startEndpointRequest counts a request open at endpoint until the returned
+// func is called, which may be more than once.
+func startEndpointRequest(endpoint string) (done func()) {
+	endpointBalancer.mu.Lock()
+	endpointBalancer.inflight[endpoint]++
+	endpointBalancer.mu.Unlock()
+	return sync.OnceFunc(func() {
+		endpointBalancer.mu.Lock()
+		defer endpointBalancer.mu.Unlock()
+		if endpointBalancer.inflight[endpoint]--; endpointBalancer.inflight[endpoint] <= 0 {
+			delete(endpointBalancer.inflight, endpoint)
+		}
+	})
+}
+
+// endpointBody keeps a response's request counted at its endpoint until the
+// body is closed.
+type endpointBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (b *endpointBody) Close() error {
+	b.done()
+	return b.ReadCloser.Close()
+}
+
+// noteEndpointError marks an endpoint that refused the connection so other
+// requests skip it for a while.
+func noteEndpointError(endpoint string, err error) {
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return
+	}
+	ttl := envDuration("ENDPOINT_NEGATIVE_TTL", defaultEndpointNegativeTTL)
+	endpointBalancer.mu.Lock()
+	defer endpointBalancer.mu.Unlock()
+	endpointBalancer.refused[endpoint] = time.Now().Add(ttl)
+}
+
+// isDialError reports whether a request failed before reaching the backend,
+// so it is safe to send again elsewhere.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
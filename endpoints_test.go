@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/vinayhpandya/ai_inference_gateway/fakeback"
+)
+
+// downEndpoint returns the URL of a port nothing listens on.
+func downEndpoint(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + ln.Addr().String()
+	ln.Close()
+	return url
+}
+
+// forgetRefused clears the refusals noted for urls when the test ends, so
+// the global balancer doesn't carry them into other tests.
+func forgetRefused(t *testing.T, urls ...string) {
+	t.Cleanup(func() {
+		endpointBalancer.mu.Lock()
+		defer endpointBalancer.mu.Unlock()
+		for _, u := range urls {
+			delete(endpointBalancer.refused, u)
+		}
+	})
+}
+
+func TestPickEndpointAvoidsTried(t *testing.T) {
+	b := &Backend{Name: t.Name(), URL: "http://a", URLs: []string{"http://b", "http://c"}}
+	for range 30 {
+		if ep := pickEndpoint(b, []string{"http://a"}); ep == "http://a" {
+			t.Fatal("picked an endpoint the request already tried")
+		}
+		if ep := pickEndpoint(b, []string{"http://a", "http://b"}); ep != "http://c" {
+			t.Fatalf("picked %s, want the one untried endpoint", ep)
+		}
+		// Every endpoint tried: repeats are allowed
+		if ep := pickEndpoint(b, b.endpoints()); !slices.Contains(b.endpoints(), ep) {
+			t.Fatalf("picked %s", ep)
+		}
+	}
+}
+
+func TestPickEndpointAvoidsRefused(t *testing.T) {
+	b := &Backend{Name: t.Name(), URL: "http://a", URLs: []string{"http://b", "http://c"}}
+	forgetRefused(t, b.endpoints()...)
+	endpointBalancer.mu.Lock()
+	endpointBalancer.refused["http://b"] = time.Now().Add(time.Minute)
+	endpointBalancer.refused["http://c"] = time.Now().Add(-time.Second)
+	endpointBalancer.mu.Unlock()
+
+	seen := map[string]int{}
+	for range 30 {
+		seen[pickEndpoint(b, nil)]++
+	}
+	if seen["http://b"] != 0 || seen["http://a"] == 0 || seen["http://c"] == 0 {
+		t.Errorf("picks = %v, want b skipped while refused and c back after its refusal expired", seen)
+	}
+	// A refused endpoint is still better than none
+	if ep := pickEndpoint(b, []string{"http://a", "http://c"}); ep != "http://b" {
+		t.Errorf("picked %s, want the refused endpoint once the rest were tried", ep)
+	}
+}
+
+func TestNoteEndpointErrorOnlyMarksRefusals(t *testing.T) {
+	down := downEndpoint(t)
+	forgetRefused(t, down)
+	_, err := http.Get(down)
+	if err == nil {
+		t.Fatal("down endpoint answered")
+	}
+	noteEndpointError(down, err)
+	endpointBalancer.mu.Lock()
+	until := endpointBalancer.refused[down]
+	endpointBalancer.mu.Unlock()
+	if d := time.Until(until); d <= 0 || d > defaultEndpointNegativeTTL {
+		t.Errorf("refused for %v, want up to %v", d, defaultEndpointNegativeTTL)
+	}
+	if !isDialError(err) {
+		t.Errorf("isDialError(%v) = false", err)
+	}
+
+	noteEndpointError("http://timeout", &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded})
+	endpointBalancer.mu.Lock()
+	_, marked := endpointBalancer.refused["http://timeout"]
+	endpointBalancer.mu.Unlock()
+	if marked {
+		t.Error("a read timeout marked the endpoint as refusing")
+	}
+}
+
+// threeEndpoints routes model m to a backend with two live endpoints and,
+// between them, one that is down.
+func threeEndpoints(t *testing.T) (*Backend, []*fakeback.Server) {
+	t.Helper()
+	live := []*fakeback.Server{fakeback.New(), fakeback.New()}
+	for _, s := range live {
+		t.Cleanup(s.Close)
+	}
+	down := downEndpoint(t)
+	b := &Backend{Name: t.Name(), Type: "openai", URL: live[0].URL, URLs: []string{down, live[1].URL}}
+	forgetRefused(t, b.endpoints()...)
+	c := useCatalog(t, &ModelInfo{ID: "m", Backend: b.Name})
+	c.backends[b.Name] = b
+	return b, live
+}
+
+func TestFailoverSkipsDownEndpoint(t *testing.T) {
+	captureLog(t)
+	b, live := threeEndpoints(t)
+	before := expvarInt(endpointFailovers, b.Name)
+	for i := range 12 {
+		if w := chatAs("", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d: %s", i, w.Code, w.Body)
+		}
+	}
+	if n := len(live[0].Requests()) + len(live[1].Requests()); n != 12 {
+		t.Errorf("live endpoints served %d requests, want 12", n)
+	}
+	if len(live[0].Requests()) == 0 || len(live[1].Requests()) == 0 {
+		t.Errorf("requests served %d and %d, want both endpoints used", len(live[0].Requests()), len(live[1].Requests()))
+	}
+	// The first refusal keeps the rest of the requests off the down
+	// endpoint for ENDPOINT_NEGATIVE_TTL
+	if n := expvarInt(endpointFailovers, b.Name) - before; n != 1 {
+		t.Errorf("%d failovers, want 1", n)
+	}
+}
+
+func TestFailoverWithoutNegativeCache(t *testing.T) {
+	captureLog(t)
+	t.Setenv("ENDPOINT_NEGATIVE_TTL", "1ns")
+	b, live := threeEndpoints(t)
+	before := expvarInt(endpointFailovers, b.Name)
+	for i := range 12 {
+		if w := chatAs("", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d: %s", i, w.Code, w.Body)
+		}
+	}
+	// Without the negative cache the down endpoint keeps being tried, and
+	// each time the request fails over instead of failing
+	if n := expvarInt(endpointFailovers, b.Name) - before; n < 2 || n > 12 {
+		t.Errorf("%d failovers in 12 requests, want the down endpoint retried", n)
+	}
+	if n := len(live[0].Requests()) + len(live[1].Requests()); n != 12 {
+		t.Errorf("live endpoints served %d requests, want 12", n)
+	}
+}
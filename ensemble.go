@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ensemble selection policies.
+const (
+	policyFirstSuccess = "first_success"
+	policyFastest      = "fastest"
+	policyLongest      = "longest"
+	policyJudge        = "judge"
+)
+
+const defaultJudgePrompt = "You compare candidate answers to the same conversation. " +
+	"Reply with only the number of the best candidate."
+
+// ensembleTokens counts tokens used by ensemble member and judge calls, by model.
+var ensembleTokens = expvar.NewMap("gateway_ensemble_tokens_total")
+
+// Ensemble makes a catalog entry a synthetic model that sends each request
+// to every member model and answers with one member's response.
+type Ensemble struct {
+	// Members are catalog model IDs, called in parallel
+	Members []string `json:"members"`
+	// Policy is first_success (default; the first listed member that
+	// succeeded), fastest, longest (most completion tokens) or judge
+	Policy string `json:"policy,omitempty"`
+	// JudgeModel picks the winner for the judge policy, prompted with
+	// JudgePrompt and the numbered candidates
+	JudgeModel  string `json:"judge_model,omitempty"`
+	JudgePrompt string `json:"judge_prompt,omitempty"`
+}
+
+// EnsembleResult reports how an ensemble response was chosen.
+type EnsembleResult struct {
+	Policy  string           `json:"policy"`
+	Winner  string           `json:"winner"`
+	Members []EnsembleMember `json:"members"`
+	Judge   *EnsembleMember  `json:"judge,omitempty"`
+}
+
+// EnsembleMember is one member or judge call.
+type EnsembleMember struct {
+	Model     string  `json:"model"`
+	Status    int     `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Usage     *Usage  `json:"usage,omitempty"`
+	Error     string  `json:"error,omitempty"`
+
+	response ChatCompletionResponse
+	body     []byte
+	latency  time.Duration
+}
+
+func (m *EnsembleMember) ok() bool {
+	return m.Status == http.StatusOK && len(m.response.Choices) > 0
+}
+
+// validateEnsembles checks ensemble entries once the whole catalog is loaded.
+func validateEnsembles(c *modelCatalog) error {
+	for _, m := range c.models {
+		e := m.Ensemble
+		if e == nil {
+			continue
+		}
+		if len(e.Members) < 2 {
+			return fmt.Errorf("ensemble %q needs at least two members", m.ID)
+		}
+		for _, id := range append(slices.Clip(e.Members), e.JudgeModel) {
+			if id == "" {
+				continue
+			}
+			member, ok := c.models[id]
+			if !ok {
+				return fmt.Errorf("ensemble %q references unknown model %q", m.ID, id)
+			}
+			if member.Ensemble != nil {
+				return fmt.Errorf("ensemble %q cannot include ensemble %q", m.ID, id)
+			}
+		}
+		switch e.Policy {
+		case "":
+			e.Policy = policyFirstSuccess
+		case policyFirstSuccess, policyFastest, policyLongest:
+		case policyJudge:
+			if e.JudgeModel == "" {
+				return fmt.Errorf("ensemble %q uses the judge policy without a judge_model", m.ID)
+			}
+		default:
+			return fmt.Errorf("ensemble %q has unknown policy %q", m.ID, e.Policy)
+		}
+	}
+	return nil
+}
+
+// ensembleFor returns the ensemble config when model is a synthetic model.
+func (c *modelCatalog) ensembleFor(model string) *Ensemble {
+	if m, ok := c.lookup(model); ok {
+		return m.Ensemble
+	}
+	return nil
+}
+
+// serveEnsemble answers a request for an ensemble model. Members run
+// through the full chat handler, each with its own request record, and the
+// response's usage covers every member and judge call.
+func serveEnsemble(w http.ResponseWriter, r *http.Request, req ChatCompletionRequest, e *Ensemble, requestID string) {
+	if req.Stream {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "unsupported_feature",
+			fmt.Sprintf("model %q is an ensemble and does not support streaming", req.Model))
+		return
+	}
+	rec := recordFromContext(r.Context())
+	rec.Backend = "ensemble"
+
+	// Members run in parallel, so waiting for them all is the backend time
+	fanOut := time.Now()
+	members := make([]EnsembleMember, len(e.Members))
+	var wg sync.WaitGroup
+	for i, model := range e.Members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			members[i] = callMember(r, req, model, fmt.Sprintf("%s-%d", requestID, i))
+		}()
+	}
+	wg.Wait()
+	rec.Timings.add(&rec.Timings.backend, time.Since(fanOut))
+
+	result := &EnsembleResult{Policy: e.Policy}
+	winner := -1
+	switch e.Policy {
+	case policyFastest:
+		for i := range members {
+			if members[i].ok() && (winner < 0 || members[i].latency < members[winner].latency) {
+				winner = i
+			}
+		}
+	case policyLongest:
+		for i := range members {
+			if members[i].ok() && (winner < 0 || completionTokens(&members[i]) > completionTokens(&members[winner])) {
+				winner = i
+			}
+		}
+	case policyJudge:
+		winner, result.Judge = judgeMembers(r, req, e, members, requestID)
+	}
+	if winner < 0 {
+		// first_success, and the fallback when a judge gives no usable answer
+		for i := range members {
+			if members[i].ok() {
+				winner = i
+				break
+			}
+		}
+	}
+
+	if winner < 0 {
+		// Every member failed: relay the first member's error as it was
+		log.Printf("All %d members of ensemble %q failed for %s", len(members), req.Model, requestID)
+		w.WriteHeader(members[0].Status)
+		w.Write(members[0].body)
+		return
+	}
+
+	calls := members
+	if result.Judge != nil {
+		calls = append(calls[:len(calls):len(calls)], *result.Judge)
+	}
+	var total Usage
+	for _, m := range calls {
+		if m.Usage != nil {
+			total.PromptTokens += m.Usage.PromptTokens
+			total.CompletionTokens += m.Usage.CompletionTokens
+			total.TotalTokens += m.Usage.TotalTokens
+			total.Estimated = total.Estimated || m.Usage.Estimated
+		}
+	}
+	result.Winner = e.Members[winner]
+	result.Members = members
+
+	response := members[winner].response
+	response.ID = requestID
+	response.Model = req.Model
+	if name := responseModel(rec); name != "" {
+		response.Model = name
+	}
+	response.Usage = total
+	response.Ensemble = result
+	rec.Usage = &response.Usage
+	if len(response.Choices) > 0 {
+		rec.FinishReason = response.Choices[0].FinishReason
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+func completionTokens(m *EnsembleMember) int {
+	if m.Usage != nil && m.Usage.CompletionTokens > 0 {
+		return m.Usage.CompletionTokens
+	}
+	return approximateTokens(m.response.Choices[0].Message.Content)
+}
+
+// callMember runs one member request through the chat handler. The caller's
+// conversation header is dropped so members don't each extend the history.
+func callMember(parent *http.Request, req ChatCompletionRequest, model, requestID string) EnsembleMember {
+	req.Model = model
+	body, err := json.Marshal(req)
+	if err != nil {
+		return EnsembleMember{Model: model, Status: http.StatusInternalServerError, Error: err.Error()}
+	}
+
+	// Members keep the ensemble's catalog, so a reload can't split them,
+	// and its API version
+	prec := recordFromContext(parent.Context())
+	ctx := context.WithValue(parent.Context(), requestRecordKey{}, &requestRecord{catalog: prec.admittedCatalog(), apiVersion: prec.apiVersion})
+	// Members are always chat completions, whatever the client called
+	ctx = context.WithValue(ctx, responsesCallKey{}, (*responsesCall)(nil))
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/v1/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return EnsembleMember{Model: model, Status: http.StatusInternalServerError, Error: err.Error()}
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Request-ID", requestID)
+
+	start := time.Now()
+	w := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+	chatCompletionsHandler(w, r)
+
+	m := EnsembleMember{Model: model, Status: w.status, body: w.body.Bytes(), latency: time.Since(start)}
+	m.LatencyMS = float64(m.latency.Microseconds()) / 1000
+	if m.Status != http.StatusOK {
+		var errBody ErrorResponse
+		if json.Unmarshal(m.body, &errBody) == nil && errBody.Error.Message != "" {
+			m.Error = errBody.Error.Message
+		} else {
+			m.Error = strings.TrimSpace(string(m.body))
+		}
+		return m
+	}
+	if err := json.Unmarshal(m.body, &m.response); err != nil {
+		m.Error = "invalid response: " + err.Error()
+		return m
+	}
+	m.Usage = &m.response.Usage
+	ensembleTokens.Add(model, int64(m.response.Usage.TotalTokens))
+	return m
+}
+
+// judgeMembers asks the judge model to pick among the successful members.
+// It returns -1 when the judge fails or answers with no valid candidate,
+// and a nil judge when fewer than two members succeeded.
+func judgeMembers(r *http.Request, req ChatCompletionRequest, e *Ensemble, members []EnsembleMember, requestID string) (int, *EnsembleMember) {
+	var prompt strings.Builder
+	prompt.WriteString("Conversation:\n")
+	for _, msg := range req.Messages {
+		fmt.Fprintf(&prompt, "%s: %s\n", msg.Role, msg.Content)
+	}
+	var candidates []int
+	for i := range members {
+		if members[i].ok() {
+			candidates = append(candidates, i)
+			fmt.Fprintf(&prompt, "\nCandidate %d:\n%s\n", len(candidates), members[i].response.Choices[0].Message.Content)
+		}
+	}
+
+	if len(candidates) < 2 {
+		return -1, nil
+	}
+
+	instruction := e.JudgePrompt
+	if instruction == "" {
+		instruction = defaultJudgePrompt
+	}
+	judgeReq := ChatCompletionRequest{Messages: []Message{
+		{Role: "system", Content: instruction},
+		{Role: "user", Content: prompt.String()},
+	}}
+	judge := callMember(r, judgeReq, e.JudgeModel, requestID+"-judge")
+	rec := recordFromContext(r.Context())
+	rec.Timings.add(&rec.Timings.backend, judge.latency)
+	if !judge.ok() {
+		return -1, &judge
+	}
+
+	reply := judge.response.Choices[0].Message.Content
+	n, ok := firstNumber(reply)
+	if !ok || n < 1 || n > len(candidates) {
+		log.Printf("Judge %q gave no usable choice for %s: %q", e.JudgeModel, requestID, truncateForLog(reply))
+		return -1, &judge
+	}
+	return candidates[n-1], &judge
+}
+
+// firstNumber parses the first run of digits in s.
+func firstNumber(s string) (int, bool) {
+	start := strings.IndexAny(s, "0123456789")
+	if start < 0 {
+		return 0, false
+	}
+	end := start
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	n, err := strconv.Atoi(s[start:end])
+	return n, err == nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxBackendErrorBody caps how much of an error body is read; the rest
+	// is discarded, so a runaway error page can't exhaust memory
+	maxBackendErrorBody      = 1 << 20
+	defaultErrorExcerptBytes = 512
+)
+
+// validAcceptEncoding reports whether a backend's accept_encoding is one
+// the gateway can decode: gzip (default) or identity.
+func validAcceptEncoding(enc string) bool {
+	return enc == "" || enc == "gzip" || enc == "identity"
+}
+
+// setAcceptEncoding asks for an uncompressed response from backends with
+// accept_encoding identity. Otherwise the transport asks for gzip and
+// decodes it transparently.
+func setAcceptEncoding(httpReq *http.Request, backend *Backend) {
+	if backend.AcceptEncoding == "identity" {
+		httpReq.Header.Set("Accept-Encoding", "identity")
+	}
+}
+
+// decodeBackendBody undoes a Content-Encoding the transport left in place,
+// which happens when a backend or a proxy in front of it compresses a
+// response the gateway didn't ask to be compressed. Encodings the gateway
+// can't decode, such as br, are an error and the body is left as it was.
+func decodeBackendBody(resp *http.Response) error {
+	enc := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	var r io.Reader
+	switch enc {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf("invalid gzip response from backend: %w", err)
+		}
+		r = zr
+	case "deflate":
+		zr, err := zlib.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf("invalid deflate response from backend: %w", err)
+		}
+		r = zr
+	default:
+		return fmt.Errorf("backend sent a %s-encoded response, which the gateway can't decode; set the backend's accept_encoding to identity", enc)
+	}
+	resp.Body = &decodedBody{Reader: r, Closer: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// decodedBody reads the decompressed body and closes the original.
+type decodedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// readErrorBody reads up to maxBackendErrorBody of a non-200 response. With
+// BACKEND_ERROR_DEBUG=true the body is logged in full, since clients only
+// ever see an excerpt.
+func readErrorBody(resp *http.Response, backend *Backend, requestID string) []byte {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxBackendErrorBody))
+	if os.Getenv("BACKEND_ERROR_DEBUG") == "true" {
+		log.Printf("Backend %s returned status %d for request %s (Content-Type %q, Content-Encoding %q, %d bytes read): %q",
+			backend.Name, resp.StatusCode, requestID, resp.Header.Get("Content-Type"), resp.Header.Get("Content-Encoding"), len(data), data)
+	}
+	return data
+}
+
+// errorExcerptLimit is how many bytes of upstream error content reach
+// clients: BACKEND_ERROR_EXCERPT_BYTES, default 512.
+func errorExcerptLimit() int {
+	if n, err := strconv.Atoi(os.Getenv("BACKEND_ERROR_EXCERPT_BYTES")); err == nil && n > 0 {
+		return n
+	}
+	return defaultErrorExcerptBytes
+}
+
+// describeErrorBody renders an error body that isn't the provider's JSON
+// as a readable message: HTML is reduced to its text, and binary and still
+// compressed bodies are omitted. Callers cut it to errorExcerptLimit.
+func describeErrorBody(header http.Header, body []byte) string {
+	if enc := header.Get("Content-Encoding"); enc != "" && !strings.EqualFold(enc, "identity") {
+		return fmt.Sprintf("%s-encoded error body omitted (%d bytes)", enc, len(body))
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return "empty error body"
+	}
+	if isBinary(body) {
+		return fmt.Sprintf("binary error body omitted (%d bytes)", len(body))
+	}
+	text := string(body)
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if mediaType == "text/html" || (mediaType == "" && body[0] == '<') {
+		text = htmlText(text)
+	}
+	return text
+}
+
+// isBinary reports whether body looks like anything but text, judged by
+// its first KiB. A rune cut off at the end of the sample doesn't count.
+func isBinary(body []byte) bool {
+	sample := body[:min(len(body), 1024)]
+	for len(sample) > 0 {
+		r, size := utf8.DecodeRune(sample)
+		if r == 0 || (r == utf8.RuneError && size == 1 && len(sample) >= utf8.UTFMax) {
+			return true
+		}
+		sample = sample[size:]
+	}
+	return false
+}
+
+// htmlText strips tags, scripts and styles from an HTML error page and
+// collapses its whitespace, leaving something like "502 Bad Gateway nginx".
+func htmlText(page string) string {
+	var b strings.Builder
+	for page != "" {
+		i := strings.IndexByte(page, '<')
+		if i < 0 {
+			b.WriteString(page)
+			break
+		}
+		b.WriteString(page[:i])
+		b.WriteByte(' ')
+		page = page[i:]
+		end := strings.IndexByte(page, '>')
+		if end < 0 {
+			break
+		}
+		tag := strings.ToLower(page[1:end])
+		page = page[end+1:]
+		for _, skip := range []string{"script", "style"} {
+			if tag == skip || strings.HasPrefix(tag, skip+" ") {
+				if j := strings.Index(strings.ToLower(page), "</"+skip); j >= 0 {
+					page = page[j:]
+				} else {
+					page = ""
+				}
+			}
+		}
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// truncateExcerpt cuts s to at most n bytes on a rune boundary, noting how
+// much was dropped.
+func truncateExcerpt(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	cut := n
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s... (%d more bytes)", s[:cut], len(s)-cut)
+}
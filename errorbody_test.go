@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const proxyErrorPage = `<html>
+<head><title>502 Bad Gateway</title><style>body { width: 35em; }</style>
+<script type="text/javascript">var internal = "10.0.0.5";</script></head>
+<body><center><h1>502 Bad Gateway</h1></center><hr><center>nginx</center></body>
+</html>`
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.WriteString(zw, s)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDescribeErrorBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		body   string
+		want   string
+	}{
+		{"empty", nil, "", "empty error body"},
+		{"whitespace", nil, " \r\n\t", "empty error body"},
+		{"plain text", http.Header{"Content-Type": {"text/plain"}}, "upstream connect error\n", "upstream connect error"},
+		{"html", http.Header{"Content-Type": {"text/html; charset=utf-8"}}, proxyErrorPage, "502 Bad Gateway 502 Bad Gateway nginx"},
+		{"untyped html", nil, "<h1>Service Unavailable</h1>", "Service Unavailable"},
+		{"binary", nil, "\x00\x01\x02protobuf", "binary error body omitted (11 bytes)"},
+		{"still compressed", http.Header{"Content-Encoding": {"br"}}, "\x8b\x02\x80", "br-encoded error body omitted (3 bytes)"},
+		{"rune cut at the binary sample's end", nil, strings.Repeat("é", 600)[:1023], strings.Repeat("é", 600)[:1023]},
+	}
+	for _, tt := range tests {
+		header := tt.header
+		if header == nil {
+			header = http.Header{}
+		}
+		if got := describeErrorBody(header, []byte(tt.body)); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateExcerpt(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{strings.Repeat("a", 20), 10, "aaaaaaaaaa... (10 more bytes)"},
+		// é is two bytes: never cut one in half
+		{"aé" + strings.Repeat("b", 10), 2, "a... (12 more bytes)"},
+	}
+	for _, tt := range tests {
+		if got := truncateExcerpt(tt.s, tt.n); got != tt.want {
+			t.Errorf("truncateExcerpt(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeBackendBody(t *testing.T) {
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	io.WriteString(zw, "deflated")
+	zw.Close()
+
+	tests := []struct {
+		encoding string
+		body     []byte
+		want     string
+		err      bool
+	}{
+		{"", []byte("plain"), "plain", false},
+		{"identity", []byte("plain"), "plain", false},
+		{"gzip", gzipped(t, "zipped"), "zipped", false},
+		{"X-Gzip", gzipped(t, "zipped"), "zipped", false},
+		{"deflate", deflated.Bytes(), "deflated", false},
+		{"gzip", []byte("not gzip"), "", true},
+		{"br", []byte("\x8b\x02\x80"), "\x8b\x02\x80", true},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(tt.body)), ContentLength: int64(len(tt.body))}
+		if tt.encoding != "" {
+			resp.Header.Set("Content-Encoding", tt.encoding)
+		}
+		err := decodeBackendBody(resp)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: err = %v", tt.encoding, err)
+			continue
+		}
+		if tt.err && tt.encoding == "gzip" {
+			continue
+		}
+		got, _ := io.ReadAll(resp.Body)
+		if string(got) != tt.want {
+			t.Errorf("%s: body = %q, want %q", tt.encoding, got, tt.want)
+		}
+		if !tt.err && tt.encoding != "" && tt.encoding != "identity" && (resp.Header.Get("Content-Encoding") != "" || resp.ContentLength != -1) {
+			t.Errorf("%s: Content-Encoding %q, length %d left on the decoded response", tt.encoding, resp.Header.Get("Content-Encoding"), resp.ContentLength)
+		}
+	}
+}
+
+// rawBackend routes model m to a backend whose every response is written
+// by handler, and returns the Accept-Encoding of each request it got.
+func rawBackend(t *testing.T, acceptEncoding string, handler http.HandlerFunc) *[]string {
+	t.Helper()
+	var seen []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		seen = append(seen, r.Header.Get("Accept-Encoding"))
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("BACKEND_URL", "")
+	c := useCatalog(t, &ModelInfo{ID: "m", Backend: "proxied"})
+	c.backends["proxied"] = &Backend{Name: "proxied", Type: "openai", URL: srv.URL, AcceptEncoding: acceptEncoding}
+	return &seen
+}
+
+// upstreamMessage sends a chat completion and returns the upstream message
+// of the gateway's error response.
+func upstreamMessage(t *testing.T) (int, string) {
+	t.Helper()
+	w := chatAs("", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`)
+	var body backendErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error.Upstream == nil {
+		t.Fatalf("response = %d %s", w.Code, w.Body)
+	}
+	// JSON-escaped control bytes and replaced invalid UTF-8 mean raw
+	// compressed or binary bytes reached the client
+	if strings.Contains(w.Body.String(), `\u001f`) || strings.Contains(w.Body.String(), `\ufffd`) {
+		t.Errorf("response carries raw bytes: %s", w.Body)
+	}
+	return w.Code, body.Error.Upstream.Message
+}
+
+func TestGzipHTMLErrorPage(t *testing.T) {
+	captureLog(t)
+	// gzip (default) leaves decoding to the transport; with identity the
+	// gateway decodes a proxy's unrequested gzip itself
+	for _, enc := range []string{"", "identity"} {
+		t.Run("accept_encoding="+enc, func(t *testing.T) {
+			seen := rawBackend(t, enc, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("Content-Encoding", "gzip")
+				w.WriteHeader(http.StatusBadGateway)
+				w.Write(gzipped(t, proxyErrorPage))
+			})
+			status, msg := upstreamMessage(t)
+			if status != http.StatusBadGateway || msg != "502 Bad Gateway 502 Bad Gateway nginx" {
+				t.Errorf("response = %d %q", status, msg)
+			}
+			want := "gzip"
+			if enc == "identity" {
+				want = "identity"
+			}
+			if (*seen)[0] != want {
+				t.Errorf("backend got Accept-Encoding %q, want %q", (*seen)[0], want)
+			}
+		})
+	}
+}
+
+func TestEmptyErrorBody(t *testing.T) {
+	captureLog(t)
+	rawBackend(t, "", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	if status, msg := upstreamMessage(t); status != http.StatusBadGateway || msg != "empty error body" {
+		t.Errorf("response = %d %q", status, msg)
+	}
+}
+
+func TestBrotliErrorBody(t *testing.T) {
+	captureLog(t)
+	rawBackend(t, "identity", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("\x8b\x02\x80\x1f\x8b"))
+	})
+	if _, msg := upstreamMessage(t); msg != "br-encoded error body omitted (5 bytes)" {
+		t.Errorf("upstream message = %q", msg)
+	}
+}
+
+func TestHugeErrorBody(t *testing.T) {
+	captureLog(t)
+	rawBackend(t, "", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+		line := []byte(strings.Repeat("x", 1023) + "\n")
+		for range 10 << 10 {
+			if _, err := w.Write(line); err != nil {
+				return
+			}
+		}
+	})
+	_, msg := upstreamMessage(t)
+	if !strings.HasPrefix(msg, strings.Repeat("x", 512)+"...") || len(msg) > 600 {
+		t.Errorf("upstream message is %d bytes: %.100q...", len(msg), msg)
+	}
+	if !strings.HasSuffix(msg, "more bytes)") {
+		t.Errorf("upstream message doesn't say it was cut: ...%q", msg[max(len(msg)-40, 0):])
+	}
+
+	t.Setenv("BACKEND_ERROR_EXCERPT_BYTES", "100")
+	if _, msg := upstreamMessage(t); !strings.HasPrefix(msg, strings.Repeat("x", 100)+"...") {
+		t.Errorf("BACKEND_ERROR_EXCERPT_BYTES=100: message starts %.120q", msg)
+	}
+}
+
+func TestReadErrorBodyLimit(t *testing.T) {
+	captureLog(t)
+	resp := &http.Response{StatusCode: 500, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(strings.Repeat("x", 10<<20)))}
+	if got := readErrorBody(resp, &Backend{Name: "b"}, "req"); len(got) != maxBackendErrorBody {
+		t.Errorf("read %d bytes of a 10 MB body, want %d", len(got), maxBackendErrorBody)
+	}
+}
+
+func TestErrorBodyDebugLog(t *testing.T) {
+	logs := captureLog(t)
+	page := "<h1>Bad Gateway</h1>" + strings.Repeat("detail ", 200)
+	read := func() {
+		resp := &http.Response{StatusCode: 502, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(page))}
+		readErrorBody(resp, &Backend{Name: "b"}, "req-7")
+	}
+	read()
+	if logs.Len() != 0 {
+		t.Errorf("logged without BACKEND_ERROR_DEBUG: %s", logs)
+	}
+	t.Setenv("BACKEND_ERROR_DEBUG", "true")
+	read()
+	if !strings.Contains(logs.String(), "req-7") || !strings.Contains(logs.String(), strings.Repeat("detail ", 200)) {
+		t.Errorf("debug log doesn't carry the full body: %.200s", logs)
+	}
+}
+
+func TestValidAcceptEncoding(t *testing.T) {
+	for enc, want := range map[string]bool{"": true, "gzip": true, "identity": true, "br": false, "deflate": false} {
+		if got := validAcceptEncoding(enc); got != want {
+			t.Errorf("validAcceptEncoding(%q) = %t", enc, got)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error response types (OpenAI-style)
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code,omitempty"`
+	// ResumeToken, on a stream's final error event, lets a retry pick up
+	// where the stream stopped
+	ResumeToken string `json:"resume_token,omitempty"`
+	// ChunksDelivered and RetrySafe, on an incomplete stream's final event,
+	// say how many events the client got and whether retrying can succeed
+	ChunksDelivered *int  `json:"chunks_delivered,omitempty"`
+	RetrySafe       *bool `json:"retry_safe,omitempty"`
+}
+
+// writeJSONError writes an OpenAI-style error body with the given status.
+func writeJSONError(w http.ResponseWriter, status int, errType, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Error: ErrorDetail{Message: message, Type: errType, Code: code},
+	})
+}
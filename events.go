@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultEventQueue         = 10000
+	defaultEventBatch         = 100
+	defaultEventBatchInterval = time.Second
+	eventPublishAttempts      = 3
+	eventPublishTimeout       = 10 * time.Second
+)
+
+// eventsPublished counts events the message bus accepted. eventsDropped
+// counts the rest by reason: queue_full, publish_failed (after every
+// attempt) and closed (queued while the gateway was stopping).
+var (
+	eventsPublished = expvar.NewInt("gateway_events_published_total")
+	eventsDropped   = expvar.NewMap("gateway_events_dropped_total")
+)
+
+// eventPublisher sends batches of encoded events to a message bus. It is
+// only called from the bus's worker goroutine, so implementations need no
+// locking. An error fails the whole batch, which may be published again.
+type eventPublisher interface {
+	publish(ctx context.Context, batch [][]byte) error
+	close()
+}
+
+// eventPublishers are the message buses EVENT_PUBLISHER can name, each
+// configured from its own environment variables.
+var eventPublishers = map[string]func() (eventPublisher, error){
+	"kafka": loadKafkaPublisher,
+}
+
+// eventBus is nil unless EVENT_PUBLISHER is set.
+var eventBus *eventPublishing
+
+// eventPublishing queues request events, in the webhook event schema, and
+// publishes them in batches from a single worker, so a slow or unavailable
+// bus costs requests nothing: events that don't fit in the queue are
+// dropped and counted.
+type eventPublishing struct {
+	name      string
+	publisher eventPublisher
+	events    map[string]bool
+	batchSize int
+	interval  time.Duration
+
+	mu     sync.Mutex
+	queue  chan []byte
+	closed bool
+	done   chan struct{}
+
+	// Owned by the worker: once a batch fails while the gateway stops, the
+	// rest are dropped rather than holding up the exit
+	abandoned bool
+}
+
+// loadEventBus reads EVENT_PUBLISHER, EVENT_TYPES, EVENT_QUEUE_SIZE,
+// EVENT_BATCH_SIZE and EVENT_BATCH_INTERVAL, and the named publisher's own
+// settings, and starts the worker. It returns nil when no publisher is
+// configured.
+func loadEventBus() (*eventPublishing, error) {
+	name := os.Getenv("EVENT_PUBLISHER")
+	if name == "" {
+		return nil, nil
+	}
+	load, ok := eventPublishers[name]
+	if !ok {
+		names := make([]string, 0, len(eventPublishers))
+		for n := range eventPublishers {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown EVENT_PUBLISHER %q: want one of %s", name, strings.Join(names, ", "))
+	}
+	events, err := envEventTypes("EVENT_TYPES")
+	if err != nil {
+		return nil, err
+	}
+	queueSize, err := envInt("EVENT_QUEUE_SIZE")
+	if err != nil {
+		return nil, err
+	}
+	if queueSize == 0 {
+		queueSize = defaultEventQueue
+	}
+	batchSize, err := envInt("EVENT_BATCH_SIZE")
+	if err != nil {
+		return nil, err
+	}
+	if batchSize == 0 {
+		batchSize = defaultEventBatch
+	}
+	interval := envDuration("EVENT_BATCH_INTERVAL", defaultEventBatchInterval)
+	if interval <= 0 {
+		return nil, fmt.Errorf("EVENT_BATCH_INTERVAL must be positive")
+	}
+	publisher, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &eventPublishing{
+		name:      name,
+		publisher: publisher,
+		events:    events,
+		batchSize: batchSize,
+		interval:  interval,
+		queue:     make(chan []byte, queueSize),
+		done:      make(chan struct{}),
+	}
+	go b.run()
+	return b, nil
+}
+
+// notify queues an event for the finished request without blocking.
+func (b *eventPublishing) notify(rec *requestRecord, status int, latency time.Duration) {
+	if b == nil {
+		return
+	}
+	typ := eventType(status)
+	if !b.events[typ] {
+		return
+	}
+	event, err := json.Marshal(newWebhookEvent(typ, rec, status, latency))
+	if err != nil {
+		log.Printf("Error encoding %s event: %v", b.name, err)
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		eventsDropped.Add("closed", 1)
+		return
+	}
+	select {
+	case b.queue <- event:
+	default:
+		eventsDropped.Add("queue_full", 1)
+	}
+}
+
+// run publishes queued events once batchSize are waiting or interval has
+// passed, whichever is first.
+func (b *eventPublishing) run() {
+	defer close(b.done)
+	defer b.publisher.close()
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	var batch [][]byte
+	for {
+		select {
+		case event, ok := <-b.queue:
+			if !ok {
+				b.send(batch)
+				return
+			}
+			if batch = append(batch, event); len(batch) >= b.batchSize {
+				b.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			b.send(batch)
+			batch = nil
+		}
+	}
+}
+
+// send publishes batch, retrying with backoff. While the gateway stops, a
+// failed batch isn't retried.
+func (b *eventPublishing) send(batch [][]byte) {
+	if len(batch) == 0 {
+		return
+	}
+	if b.abandoned {
+		eventsDropped.Add("publish_failed", int64(len(batch)))
+		return
+	}
+	for attempt := range eventPublishAttempts {
+		if attempt > 0 {
+			if b.closing() {
+				break
+			}
+			time.Sleep(time.Second << (attempt - 1))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), eventPublishTimeout)
+		err := b.publisher.publish(ctx, batch)
+		cancel()
+		if err == nil {
+			eventsPublished.Add(int64(len(batch)))
+			return
+		}
+		log.Printf("Publishing %d events to %s failed (attempt %d/%d): %v", len(batch), b.name, attempt+1, eventPublishAttempts, err)
+	}
+	eventsDropped.Add("publish_failed", int64(len(batch)))
+	b.abandoned = b.closing()
+}
+
+func (b *eventPublishing) closing() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+// close publishes the events already queued and stops the worker.
+func (b *eventPublishing) close() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.mu.Unlock()
+	<-b.done
+}
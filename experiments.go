@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// experimentLatencyWindow is how many of a variant's latest requests its
+// p95 latency is taken over.
+const experimentLatencyWindow = 1000
+
+// promptExperiments is nil unless PROMPT_EXPERIMENTS_CONFIG is set. The
+// file is read again on SIGHUP.
+var promptExperiments *promptExperimentSet
+
+// PromptExperiment splits a route's traffic between system prompt
+// variants, as configured in PROMPT_EXPERIMENTS_CONFIG:
+//
+//	{"POST /v1/chat/completions": {"name": "tone", "variants": [
+//	    {"name": "control", "prompt": "{{.System}}", "share": 50},
+//	    {"name": "concise", "prompt": "{{.System}}\n\nAnswer in one short paragraph.", "share": 50}]}}
+type PromptExperiment struct {
+	Name string `json:"name"`
+	// Disabled pauses the experiment: requests keep their own system prompt
+	// and go unassigned
+	Disabled bool             `json:"disabled,omitempty"`
+	Variants []*PromptVariant `json:"variants"`
+
+	total int
+}
+
+// PromptVariant is one arm of an experiment.
+type PromptVariant struct {
+	Name string `json:"name"`
+	// Prompt is a Go text/template for the system prompt sent in place of
+	// the request's system messages
+	Prompt string `json:"prompt"`
+	// Share is the variant's weight in the traffic split
+	Share int `json:"share"`
+
+	tmpl *template.Template
+}
+
+// promptData is what a variant's prompt template can use.
+type promptData struct {
+	// System is the request's system messages, key system prompt
+	// included, joined by blank lines
+	System string
+	Model  string
+}
+
+// ExperimentAssignment is the variant a request was assigned, returned in
+// the response's gateway field.
+type ExperimentAssignment struct {
+	Name    string `json:"name"`
+	Variant string `json:"variant"`
+}
+
+func (e *PromptExperiment) validate() error {
+	if !safeClientToken(e.Name, 64) {
+		return fmt.Errorf("name must be 1 to 64 characters from [A-Za-z0-9._:-]")
+	}
+	if len(e.Variants) < 2 {
+		return fmt.Errorf("an experiment needs at least two variants")
+	}
+	e.total = 0
+	seen := make(map[string]bool)
+	for i, v := range e.Variants {
+		switch {
+		case v == nil || !safeClientToken(v.Name, 64):
+			return fmt.Errorf("variant %d: name must be 1 to 64 characters from [A-Za-z0-9._:-]", i)
+		case seen[v.Name]:
+			return fmt.Errorf("variant %q is listed twice", v.Name)
+		case v.Share <= 0:
+			return fmt.Errorf("variant %q: share must be positive", v.Name)
+		}
+		seen[v.Name] = true
+		tmpl, err := template.New(v.Name).Parse(v.Prompt)
+		if err == nil {
+			err = tmpl.Execute(io.Discard, promptData{})
+		}
+		if err != nil {
+			return fmt.Errorf("variant %q: invalid prompt: %w", v.Name, err)
+		}
+		v.tmpl = tmpl
+		e.total += v.Share
+	}
+	return nil
+}
+
+// promptExperimentSet holds the configured experiments, swapped whole on
+// reload, and the per-variant stats, which outlive reloads: a variant
+// keeps its counts as long as its experiment and variant names stay.
+type promptExperimentSet struct {
+	path string
+	// patterns are the registered routes, recorded by checkRoutes so
+	// reloads are checked against them too
+	patterns []string
+	routes   atomic.Pointer[map[string]*PromptExperiment]
+
+	mu    sync.Mutex
+	stats map[string]*variantStats
+}
+
+// variantStats counts a variant's finished requests.
+type variantStats struct {
+	requests, errors int64
+	latencyTotal     time.Duration
+	latencies        []time.Duration
+	next             int
+	promptTokens     int64
+	completionTokens int64
+	finishReasons    map[string]int64
+}
+
+// loadPromptExperiments reads the experiments in the JSON file named by
+// PROMPT_EXPERIMENTS_CONFIG. It returns nil when none is configured.
+func loadPromptExperiments() (*promptExperimentSet, error) {
+	path := os.Getenv("PROMPT_EXPERIMENTS_CONFIG")
+	if path == "" {
+		return nil, nil
+	}
+	routes, err := readPromptExperiments(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &promptExperimentSet{path: path, stats: make(map[string]*variantStats)}
+	s.routes.Store(&routes)
+	return s, nil
+}
+
+func readPromptExperiments(path string) (map[string]*PromptExperiment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string]*PromptExperiment
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	for route, e := range file {
+		if e == nil {
+			return nil, fmt.Errorf("prompt experiment for %q: empty", route)
+		}
+		if err := e.validate(); err != nil {
+			return nil, fmt.Errorf("prompt experiment for %q: %w", route, err)
+		}
+	}
+	return file, nil
+}
+
+// checkRoutes fails for experiments on routes other than chat completions,
+// whose responses carry the assignment back.
+func (s *promptExperimentSet) checkRoutes(patterns []string) error {
+	if s == nil {
+		return nil
+	}
+	s.patterns = patterns
+	return checkExperimentRoutes(*s.routes.Load(), patterns)
+}
+
+func checkExperimentRoutes(routes map[string]*PromptExperiment, patterns []string) error {
+	for route := range routes {
+		if !slices.Contains(patterns, route) {
+			return fmt.Errorf("prompt experiment for unknown route %q", route)
+		}
+		_, path, _ := strings.Cut(route, " ")
+		if route != "POST /v1/chat/completions" || transparentRoutes.covers(path) {
+			return fmt.Errorf("prompt experiment for %q: only POST /v1/chat/completions, when not transparent, can run experiments", route)
+		}
+	}
+	return nil
+}
+
+// reload reads the experiments again, keeping the current ones when the
+// file is invalid.
+func (s *promptExperimentSet) reload() {
+	if s == nil {
+		return
+	}
+	routes, err := readPromptExperiments(s.path)
+	if err == nil {
+		err = checkExperimentRoutes(routes, s.patterns)
+	}
+	if err != nil {
+		log.Printf("Prompt experiments reload failed, keeping previous experiments: %v", err)
+		return
+	}
+	s.routes.Store(&routes)
+	log.Printf("Loaded %d prompt experiments", len(routes))
+}
+
+// route returns the experiment configured for route, or nil.
+func (s *promptExperimentSet) route(route string) *PromptExperiment {
+	if s == nil {
+		return nil
+	}
+	return (*s.routes.Load())[route]
+}
+
+// apply assigns the request rec records to a variant of its route's
+// experiment, when one is running, and replaces req's system messages
+// with the variant's prompt. Requests are assigned by their user field,
+// or their key without one, so a user sees the same variant on every
+// request. It returns the change made, for dry runs.
+func (s *promptExperimentSet) apply(req *ChatCompletionRequest, rec *requestRecord, user string) string {
+	e := s.route(rec.Route)
+	if e == nil || e.Disabled {
+		return ""
+	}
+	unit := "key:" + rec.KeyID
+	switch {
+	case user != "":
+		unit = "user:" + user
+	case rec.KeyID == "":
+		// Nothing to keep the assignment stable by
+		unit = "request:" + rec.RequestID
+	}
+	sum := sha256.Sum256([]byte(e.Name + "\x00" + unit))
+	n := int(binary.BigEndian.Uint64(sum[:8]) % uint64(e.total))
+	v := e.Variants[0]
+	for _, v = range e.Variants {
+		if n -= v.Share; n < 0 {
+			break
+		}
+	}
+
+	var system []string
+	var rest []Message
+	for _, m := range req.Messages {
+		if m.Role == "system" {
+			system = append(system, m.Content)
+		} else {
+			rest = append(rest, m)
+		}
+	}
+	var prompt strings.Builder
+	if err := v.tmpl.Execute(&prompt, promptData{System: strings.Join(system, "\n\n"), Model: req.Model}); err != nil {
+		log.Printf("Prompt experiment %s variant %s failed for request %s, sending the request's own prompt: %v", e.Name, v.Name, rec.RequestID, err)
+		return ""
+	}
+	if prompt.Len() > 0 {
+		rest = append([]Message{{Role: "system", Content: prompt.String()}}, rest...)
+	}
+	req.Messages = rest
+	rec.Experiment, rec.Variant = e.Name, v.Name
+	return fmt.Sprintf("system prompt from experiment %s variant %s", e.Name, v.Name)
+}
+
+// observe counts a finished request against its variant.
+func (s *promptExperimentSet) observe(rec *requestRecord, status int, latency time.Duration) {
+	if s == nil || rec.Experiment == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := rec.Experiment + "/" + rec.Variant
+	st := s.stats[key]
+	if st == nil {
+		st = &variantStats{finishReasons: make(map[string]int64)}
+		s.stats[key] = st
+	}
+	st.requests++
+	if status >= 400 {
+		st.errors++
+	}
+	st.latencyTotal += latency
+	if len(st.latencies) < experimentLatencyWindow {
+		st.latencies = append(st.latencies, latency)
+	} else {
+		st.latencies[st.next] = latency
+		st.next = (st.next + 1) % experimentLatencyWindow
+	}
+	if rec.Usage != nil {
+		st.promptTokens += int64(rec.Usage.PromptTokens)
+		st.completionTokens += int64(rec.Usage.CompletionTokens)
+	}
+	if rec.FinishReason != "" {
+		st.finishReasons[rec.FinishReason]++
+	}
+}
+
+// experimentSummary is an experiment's results so far, per variant.
+type experimentSummary struct {
+	Route    string           `json:"route"`
+	Name     string           `json:"name"`
+	Disabled bool             `json:"disabled"`
+	Variants []variantSummary `json:"variants"`
+}
+
+type variantSummary struct {
+	Name     string `json:"name"`
+	Share    int    `json:"share"`
+	Requests int64  `json:"requests"`
+	Errors   int64  `json:"errors"`
+	// MeanLatencyMS is over every request, P95LatencyMS over the latest
+	// 1000
+	MeanLatencyMS    *float64 `json:"mean_latency_ms,omitempty"`
+	P95LatencyMS     *float64 `json:"p95_latency_ms,omitempty"`
+	PromptTokens     int64    `json:"prompt_tokens"`
+	CompletionTokens int64    `json:"completion_tokens"`
+	// FinishReasons counts requests by their first choice's finish_reason
+	FinishReasons map[string]int64 `json:"finish_reasons"`
+}
+
+// summary reports every configured experiment, sorted by route.
+func (s *promptExperimentSet) summary() []experimentSummary {
+	routes := *s.routes.Load()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]experimentSummary, 0, len(routes))
+	for route, e := range routes {
+		es := experimentSummary{Route: route, Name: e.Name, Disabled: e.Disabled}
+		for _, v := range e.Variants {
+			vs := variantSummary{Name: v.Name, Share: v.Share, FinishReasons: map[string]int64{}}
+			if st := s.stats[e.Name+"/"+v.Name]; st != nil {
+				vs.Requests, vs.Errors = st.requests, st.errors
+				vs.PromptTokens, vs.CompletionTokens = st.promptTokens, st.completionTokens
+				for reason, n := range st.finishReasons {
+					vs.FinishReasons[reason] = n
+				}
+				latencies := slices.Clone(st.latencies)
+				slices.Sort(latencies)
+				mean := float64(st.latencyTotal.Microseconds()) / 1000 / float64(st.requests)
+				p95 := float64(latencies[int(math.Ceil(0.95*float64(len(latencies))))-1].Microseconds()) / 1000
+				vs.MeanLatencyMS, vs.P95LatencyMS = &mean, &p95
+			}
+			es.Variants = append(es.Variants, vs)
+		}
+		out = append(out, es)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Route < out[j].Route })
+	return out
+}
+
+// experimentsAdminHandler implements GET /admin/experiments.
+func experimentsAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if promptExperiments == nil {
+		writeJSONError(w, http.StatusNotFound, "invalid_request_error", "not_found", "No prompt experiments are configured on this gateway")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": promptExperiments.summary()})
+}
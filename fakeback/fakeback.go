@@ -0,0 +1,446 @@
+// Package fakeback is a programmable fake OpenAI-compatible backend for
+// tests: of the gateway, and of integrations that sit behind it.
+//
+// A Server answers /v1/chat/completions (streaming and not), /v1/models
+// and /v1/embeddings. Each request takes the next Behavior queued with
+// Enqueue, or the default one when the queue is empty, and is captured for
+// assertions:
+//
+//	back := fakeback.New()
+//	defer back.Close()
+//	back.Enqueue(fakeback.Error(503, "overloaded"), fakeback.Reply("hello"))
+//	// point the gateway's BACKEND_URL or catalog at back.URL ...
+//	if got := back.Requests(); len(got) != 2 { ... }
+package fakeback
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Behavior is how the server answers one request. The zero Behavior
+// answers 200 with the completion "ok".
+type Behavior struct {
+	// Status, when not 200, answers with an OpenAI-style error carrying
+	// Message
+	Status  int
+	Message string
+	// Body, when set, is sent as is in place of the usual response, such
+	// as malformed JSON
+	Body string
+	// Header is added to the response
+	Header http.Header
+
+	// Content is the completion (default "ok"). Streams send Chunks as
+	// deltas when set, and Content a word at a time otherwise
+	Content string
+	Chunks  []string
+	// FinishReason defaults to stop
+	FinishReason string
+	// Usage overrides the token counts, which are otherwise estimated at
+	// four characters a token
+	Usage *Usage
+
+	// Latency is waited before the response headers; ChunkDelay between
+	// streamed chunks
+	Latency    time.Duration
+	ChunkDelay time.Duration
+	// Drop closes the connection without a response
+	Drop bool
+	// CutAfter, when positive, closes a stream's connection after that
+	// many content chunks, without [DONE]
+	CutAfter int
+
+	// Dimensions is the length of embedding vectors (default 8)
+	Dimensions int
+}
+
+// Reply answers with content.
+func Reply(content string) Behavior {
+	return Behavior{Content: content}
+}
+
+// Error answers with status and an OpenAI-style error.
+func Error(status int, message string) Behavior {
+	return Behavior{Status: status, Message: message}
+}
+
+// Malformed answers 200 with a body that isn't valid JSON.
+func Malformed() Behavior {
+	return Behavior{Body: `{"id": "chatcmpl-fake", "choices": [`}
+}
+
+// Slow answers with content after latency.
+func Slow(latency time.Duration, content string) Behavior {
+	return Behavior{Latency: latency, Content: content}
+}
+
+// Drop closes the connection without answering.
+func Drop() Behavior {
+	return Behavior{Drop: true}
+}
+
+// CutAfter streams the first n words of content, then drops the
+// connection.
+func CutAfter(n int, content string) Behavior {
+	return Behavior{Content: content, CutAfter: n}
+}
+
+// Usage is an OpenAI usage block.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// Request is a request the server received.
+type Request struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// Decode unmarshals the request body into v.
+func (r Request) Decode(v any) error {
+	return json.Unmarshal(r.Body, v)
+}
+
+// Server is a fake backend listening on a local port; URL is its base URL.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	def      Behavior
+	queue    []Behavior
+	requests []Request
+	models   []string
+	seq      int
+}
+
+// New starts a Server serving the model "fake-model".
+func New() *Server {
+	s := &Server{models: []string{"fake-model"}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/chat/completions", s.chatCompletions)
+	mux.HandleFunc("GET /v1/models", s.listModels)
+	mux.HandleFunc("POST /v1/embeddings", s.embeddings)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// SetDefault sets the Behavior for requests when nothing is queued.
+func (s *Server) SetDefault(b Behavior) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.def = b
+}
+
+// Enqueue queues behaviors for the next requests, one each, in order.
+func (s *Server) Enqueue(bs ...Behavior) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = append(s.queue, bs...)
+}
+
+// SetModels sets the models /v1/models lists.
+func (s *Server) SetModels(ids ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.models = ids
+}
+
+// Requests returns the requests received so far, oldest first.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Last returns the most recent request.
+func (s *Server) Last() (Request, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) == 0 {
+		return Request{}, false
+	}
+	return s.requests[len(s.requests)-1], true
+}
+
+// Reset forgets captured requests, queued behaviors and the default.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.def, s.queue, s.requests, s.seq = Behavior{}, nil, nil, 0
+}
+
+// take captures r and returns the behavior it gets and its response ID.
+func (s *Server) take(r *http.Request) (Behavior, []byte, string) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone(), Body: body})
+	b := s.def
+	if len(s.queue) > 0 {
+		b, s.queue = s.queue[0], s.queue[1:]
+	}
+	s.seq++
+	return b, body, fmt.Sprintf("chatcmpl-fake-%d", s.seq)
+}
+
+// start applies what a behavior does before the response proper. It
+// reports false when the response has been dealt with.
+func start(w http.ResponseWriter, b Behavior) bool {
+	if b.Latency > 0 {
+		time.Sleep(b.Latency)
+	}
+	if b.Drop {
+		panic(http.ErrAbortHandler)
+	}
+	for k, vs := range b.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	if b.Body != "" {
+		w.Header().Set("Content-Type", "application/json")
+		status := b.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, b.Body)
+		return false
+	}
+	if b.Status != 0 && b.Status != http.StatusOK {
+		message := b.Message
+		if message == "" {
+			message = http.StatusText(b.Status)
+		}
+		writeJSON(w, b.Status, map[string]any{"error": map[string]any{
+			"message": message,
+			"type":    errorType(b.Status),
+			"code":    nil,
+		}})
+		return false
+	}
+	return true
+}
+
+func errorType(status int) string {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_exceeded"
+	case status >= 500:
+		return "server_error"
+	}
+	return "invalid_request_error"
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+type chatRequest struct {
+	Model    string `json:"model"`
+	Messages []struct {
+		Content string `json:"content"`
+	} `json:"messages"`
+	Stream        bool `json:"stream"`
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+}
+
+func (s *Server) chatCompletions(w http.ResponseWriter, r *http.Request) {
+	b, body, id := s.take(r)
+	var req chatRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": map[string]any{"message": "invalid JSON: " + err.Error(), "type": "invalid_request_error"}})
+		return
+	}
+	if !start(w, b) {
+		return
+	}
+	content := b.Content
+	if content == "" && len(b.Chunks) == 0 {
+		content = "ok"
+	}
+	if len(b.Chunks) > 0 && content == "" {
+		content = strings.Join(b.Chunks, "")
+	}
+	finish := b.FinishReason
+	if finish == "" {
+		finish = "stop"
+	}
+	var prompt strings.Builder
+	for _, m := range req.Messages {
+		prompt.WriteString(m.Content)
+	}
+	usage := Usage{PromptTokens: tokens(prompt.String()), CompletionTokens: tokens(content)}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	if b.Usage != nil {
+		usage = *b.Usage
+	}
+	model := req.Model
+	if model == "" {
+		model = "fake-model"
+	}
+
+	if !req.Stream {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"id":      id,
+			"object":  "chat.completion",
+			"created": time.Now().Unix(),
+			"model":   model,
+			"choices": []any{map[string]any{
+				"index":         0,
+				"message":       map[string]any{"role": "assistant", "content": content},
+				"finish_reason": finish,
+			}},
+			"usage": usage,
+		})
+		return
+	}
+
+	chunks := b.Chunks
+	if len(chunks) == 0 {
+		chunks = words(content)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	send := func(delta map[string]any, finishReason any, u *Usage) {
+		chunk := map[string]any{
+			"id":      id,
+			"object":  "chat.completion.chunk",
+			"created": time.Now().Unix(),
+			"model":   model,
+			"choices": []any{map[string]any{"index": 0, "delta": delta, "finish_reason": finishReason}},
+		}
+		if u != nil {
+			chunk["choices"] = []any{}
+			chunk["usage"] = u
+		}
+		data, _ := json.Marshal(chunk)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	send(map[string]any{"role": "assistant", "content": ""}, nil, nil)
+	for i, c := range chunks {
+		if b.CutAfter > 0 && i == b.CutAfter {
+			panic(http.ErrAbortHandler)
+		}
+		if b.ChunkDelay > 0 && i > 0 {
+			time.Sleep(b.ChunkDelay)
+		}
+		send(map[string]any{"content": c}, nil, nil)
+	}
+	if b.CutAfter > 0 && b.CutAfter >= len(chunks) {
+		panic(http.ErrAbortHandler)
+	}
+	send(map[string]any{}, finish, nil)
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		send(nil, nil, &usage)
+	}
+	io.WriteString(w, "data: [DONE]\n\n")
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+func (s *Server) listModels(w http.ResponseWriter, r *http.Request) {
+	b, _, _ := s.take(r)
+	if !start(w, b) {
+		return
+	}
+	s.mu.Lock()
+	data := make([]any, len(s.models))
+	for i, id := range s.models {
+		data[i] = map[string]any{"id": id, "object": "model", "owned_by": "fakeback"}
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": data})
+}
+
+func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
+	b, body, _ := s.take(r)
+	var req struct {
+		Model string          `json:"model"`
+		Input json.RawMessage `json:"input"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": map[string]any{"message": "invalid JSON: " + err.Error(), "type": "invalid_request_error"}})
+		return
+	}
+	var inputs []string
+	if err := json.Unmarshal(req.Input, &inputs); err != nil {
+		var one string
+		if err := json.Unmarshal(req.Input, &one); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": map[string]any{"message": "input must be a string or an array of strings", "type": "invalid_request_error"}})
+			return
+		}
+		inputs = []string{one}
+	}
+	if !start(w, b) {
+		return
+	}
+	dims := b.Dimensions
+	if dims <= 0 {
+		dims = 8
+	}
+	data := make([]any, len(inputs))
+	prompt := 0
+	for i, in := range inputs {
+		data[i] = map[string]any{"object": "embedding", "index": i, "embedding": vector(in, dims)}
+		prompt += tokens(in)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"object": "list",
+		"model":  req.Model,
+		"data":   data,
+		"usage":  map[string]int{"prompt_tokens": prompt, "total_tokens": prompt},
+	})
+}
+
+// vector is a deterministic unit-ish embedding of s, so equal inputs embed
+// equally.
+func vector(s string, dims int) []float64 {
+	v := make([]float64, dims)
+	h := uint32(2166136261)
+	for i := 0; i < dims; i++ {
+		for _, c := range []byte(s) {
+			h = (h ^ uint32(c)) * 16777619
+		}
+		h = (h ^ uint32(i)) * 16777619
+		v[i] = float64(h%2000)/1000 - 1
+	}
+	return v
+}
+
+// tokens estimates a token count at four characters a token, as the
+// gateway does.
+func tokens(s string) int {
+	return (len(s) + 3) / 4
+}
+
+// words splits content into streaming deltas, each word with the space
+// before it.
+func words(content string) []string {
+	out := strings.Split(content, " ")
+	for i := 1; i < len(out); i++ {
+		out[i] = " " + out[i]
+	}
+	return out
+}
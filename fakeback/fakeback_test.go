@@ -0,0 +1,272 @@
+package fakeback
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func post(t *testing.T, s *Server, path, body string) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.Post(s.URL+path, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	return resp, string(data)
+}
+
+type completion struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage Usage `json:"usage"`
+}
+
+func complete(t *testing.T, s *Server) (int, completion) {
+	t.Helper()
+	resp, body := post(t, s, "/v1/chat/completions", `{"model":"m","messages":[{"role":"user","content":"abcdefgh"}]}`)
+	var c completion
+	if resp.StatusCode == http.StatusOK {
+		if err := json.Unmarshal([]byte(body), &c); err != nil {
+			t.Fatalf("completion %s: %v", body, err)
+		}
+	}
+	return resp.StatusCode, c
+}
+
+func TestQueuedBehaviorsThenDefault(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.SetDefault(Reply("default"))
+	s.Enqueue(Reply("first"), Error(http.StatusServiceUnavailable, "overloaded"))
+
+	if _, c := complete(t, s); c.Choices[0].Message.Content != "first" || c.ID != "chatcmpl-fake-1" || c.Model != "m" {
+		t.Errorf("first = %+v", c)
+	}
+	if status, _ := complete(t, s); status != http.StatusServiceUnavailable {
+		t.Errorf("second status = %d, want 503", status)
+	}
+	for range 2 {
+		if _, c := complete(t, s); c.Choices[0].Message.Content != "default" {
+			t.Errorf("after the queue = %+v", c)
+		}
+	}
+	if n := len(s.Requests()); n != 4 {
+		t.Errorf("captured %d requests, want 4", n)
+	}
+}
+
+func TestZeroBehavior(t *testing.T) {
+	s := New()
+	defer s.Close()
+	_, c := complete(t, s)
+	if c.Choices[0].Message.Content != "ok" || c.Choices[0].FinishReason != "stop" {
+		t.Errorf("completion = %+v", c)
+	}
+	// Four characters a token
+	if c.Usage != (Usage{PromptTokens: 2, CompletionTokens: 1, TotalTokens: 3}) {
+		t.Errorf("usage = %+v", c.Usage)
+	}
+}
+
+func TestErrorBody(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.Enqueue(Error(http.StatusTooManyRequests, ""))
+	resp, body := post(t, s, "/v1/chat/completions", `{"messages":[]}`)
+	var e struct {
+		Error struct{ Message, Type string } `json:"error"`
+	}
+	if resp.StatusCode != http.StatusTooManyRequests || json.Unmarshal([]byte(body), &e) != nil ||
+		e.Error.Type != "rate_limit_exceeded" || e.Error.Message != "Too Many Requests" {
+		t.Errorf("response = %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestMalformedAndDrop(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.Enqueue(Malformed(), Drop())
+	resp, body := post(t, s, "/v1/chat/completions", `{}`)
+	if resp.StatusCode != http.StatusOK || json.Valid([]byte(body)) {
+		t.Errorf("malformed = %d %s", resp.StatusCode, body)
+	}
+	if _, err := http.Post(s.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{}`)); err == nil {
+		t.Error("dropped request got a response")
+	}
+}
+
+func TestLatencyAndHeaders(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.Enqueue(Behavior{Latency: 50 * time.Millisecond, Header: http.Header{"X-Test": {"1"}}})
+	start := time.Now()
+	resp, _ := post(t, s, "/v1/chat/completions", `{}`)
+	if time.Since(start) < 50*time.Millisecond || resp.Header.Get("X-Test") != "1" {
+		t.Errorf("took %v, headers %v", time.Since(start), resp.Header)
+	}
+}
+
+// streamEvents returns the data of each event of a streamed completion.
+func streamEvents(t *testing.T, s *Server, body string) ([]string, error) {
+	t.Helper()
+	resp, err := http.Post(s.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	var events []string
+	for _, e := range strings.Split(string(data), "\n\n") {
+		if e != "" {
+			events = append(events, strings.TrimPrefix(e, "data: "))
+		}
+	}
+	return events, err
+}
+
+func streamContent(t *testing.T, events []string) (string, string, *Usage) {
+	t.Helper()
+	var content, finish string
+	var usage *Usage
+	for _, e := range events {
+		if e == "[DONE]" {
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta        struct{ Content string } `json:"delta"`
+				FinishReason *string                  `json:"finish_reason"`
+			} `json:"choices"`
+			Usage *Usage `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(e), &chunk); err != nil {
+			t.Fatalf("event %s: %v", e, err)
+		}
+		for _, c := range chunk.Choices {
+			content += c.Delta.Content
+			if c.FinishReason != nil {
+				finish = *c.FinishReason
+			}
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+	}
+	return content, finish, usage
+}
+
+func TestStream(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.Enqueue(Behavior{Content: "one two three", FinishReason: "length"}, Behavior{Chunks: []string{"a", "bc"}})
+
+	events, err := streamEvents(t, s, `{"stream":true,"stream_options":{"include_usage":true},"messages":[{"content":"hi"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The role chunk, a chunk per word, the finish and usage chunks and [DONE]
+	if len(events) != 7 || events[6] != "[DONE]" {
+		t.Fatalf("events = %q", events)
+	}
+	content, finish, usage := streamContent(t, events)
+	if content != "one two three" || finish != "length" || usage == nil || usage.CompletionTokens != 4 {
+		t.Errorf("content %q, finish %q, usage %+v", content, finish, usage)
+	}
+
+	events, _ = streamEvents(t, s, `{"stream":true}`)
+	if content, _, usage := streamContent(t, events); content != "abc" || usage != nil || len(events) != 5 {
+		t.Errorf("chunks: content %q, usage %+v, events %q", content, usage, events)
+	}
+}
+
+func TestStreamCutAfter(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.Enqueue(CutAfter(2, "one two three"))
+	events, err := streamEvents(t, s, `{"stream":true}`)
+	if err == nil {
+		t.Error("cut stream ended cleanly")
+	}
+	if content, finish, _ := streamContent(t, events); content != "one two" || finish != "" {
+		t.Errorf("content %q, finish %q before the cut", content, finish)
+	}
+}
+
+func TestModelsAndEmbeddings(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.SetModels("a", "b")
+	resp, err := http.Get(s.URL + "/v1/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var models struct {
+		Data []struct{ ID string } `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&models)
+	resp.Body.Close()
+	if len(models.Data) != 2 || models.Data[0].ID != "a" || models.Data[1].ID != "b" {
+		t.Errorf("models = %+v", models)
+	}
+
+	s.SetDefault(Behavior{Dimensions: 4})
+	var emb struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	_, body := post(t, s, "/v1/embeddings", `{"model":"e","input":["x","y","x"]}`)
+	if err := json.Unmarshal([]byte(body), &emb); err != nil || len(emb.Data) != 3 {
+		t.Fatalf("embeddings = %s", body)
+	}
+	if len(emb.Data[0].Embedding) != 4 || !slices.Equal(emb.Data[0].Embedding, emb.Data[2].Embedding) || slices.Equal(emb.Data[0].Embedding, emb.Data[1].Embedding) {
+		t.Errorf("embeddings = %+v, want equal inputs to embed equally", emb.Data)
+	}
+	if resp, _ := post(t, s, "/v1/embeddings", `{"input":3}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("numeric input: status = %d", resp.StatusCode)
+	}
+}
+
+func TestCaptureAndReset(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.Enqueue(Reply("queued"))
+	req, _ := http.NewRequest(http.MethodPost, s.URL+"/v1/chat/completions", strings.NewReader(`{"model":"m","messages":[]}`))
+	req.Header.Set("Authorization", "Bearer k")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	last, ok := s.Last()
+	var body struct{ Model string }
+	if !ok || last.Method != http.MethodPost || last.Path != "/v1/chat/completions" || last.Header.Get("Authorization") != "Bearer k" || last.Decode(&body) != nil || body.Model != "m" {
+		t.Errorf("captured %+v", last)
+	}
+
+	s.Enqueue(Reply("left over"))
+	s.Reset()
+	if _, ok := s.Last(); ok || len(s.Requests()) != 0 {
+		t.Error("requests kept after Reset")
+	}
+	if _, c := complete(t, s); c.Choices[0].Message.Content != "ok" || c.ID != "chatcmpl-fake-1" {
+		t.Errorf("after Reset = %+v", c)
+	}
+}
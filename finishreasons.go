@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFinishReasonWindow = 10 * time.Minute
+	// defaultFinishReasonMinRequests keeps a handful of requests from
+	// raising an alert on their own
+	defaultFinishReasonMinRequests = 20
+	// maxFinishReasonSeries bounds the model and route pairs tracked apart;
+	// the rest are tracked under the model otherField
+	maxFinishReasonSeries = 200
+)
+
+// finishReasonsTotal counts responses by model, route and finish reason,
+// keyed "model:route:finish_reason".
+var finishReasonsTotal = expvar.NewMap("gateway_finish_reasons_total")
+
+// finishReasons is set up by loadFinishReasons.
+var finishReasons *finishReasonTracker
+
+// finishReasonBucket counts one minute of a series' responses.
+type finishReasonBucket struct {
+	minute   int64
+	total    int64
+	byReason map[string]int64
+}
+
+// finishReasonSeries is one model and route's ring of per-minute buckets,
+// plus the alerts it is raising.
+type finishReasonSeries struct {
+	model    string
+	route    string
+	buckets  []finishReasonBucket
+	alerting map[string]bool
+}
+
+// finishReasonTracker keeps the rolling distribution of finish reasons and
+// warns when one goes over its threshold.
+type finishReasonTracker struct {
+	window time.Duration
+	// thresholds are the shares of responses, from 0 to 1, above which a
+	// finish reason is alerted on
+	thresholds  map[string]float64
+	minRequests int64
+	now         func() time.Time
+
+	mu     sync.Mutex
+	series map[string]*finishReasonSeries
+}
+
+// loadFinishReasons reads FINISH_REASON_WINDOW, FINISH_REASON_ALERTS and
+// FINISH_REASON_ALERT_MIN_REQUESTS. Finish reasons are counted whether or
+// not any alert is configured.
+func loadFinishReasons() (*finishReasonTracker, error) {
+	t := &finishReasonTracker{
+		window:      envDuration("FINISH_REASON_WINDOW", defaultFinishReasonWindow).Truncate(time.Minute),
+		thresholds:  make(map[string]float64),
+		minRequests: defaultFinishReasonMinRequests,
+		now:         time.Now,
+		series:      make(map[string]*finishReasonSeries),
+	}
+	if t.window < time.Minute {
+		return nil, fmt.Errorf("FINISH_REASON_WINDOW must be at least 1m")
+	}
+	for _, entry := range strings.Split(os.Getenv("FINISH_REASON_ALERTS"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		reason, pct, ok := strings.Cut(entry, "=")
+		p, err := strconv.ParseFloat(strings.TrimSuffix(pct, "%"), 64)
+		if !ok || reason == "" || err != nil || p <= 0 || p >= 100 {
+			return nil, fmt.Errorf("invalid FINISH_REASON_ALERTS entry %q: want reason=percent, such as length=20", entry)
+		}
+		t.thresholds[reason] = p / 100
+	}
+	if n, err := envInt("FINISH_REASON_ALERT_MIN_REQUESTS"); err != nil {
+		return nil, err
+	} else if n > 0 {
+		t.minRequests = int64(n)
+	}
+	return t, nil
+}
+
+// observe counts a finished response's finish reason and checks its
+// series against the alert thresholds.
+func (t *finishReasonTracker) observe(model, route, reason string) {
+	if t == nil || reason == "" {
+		return
+	}
+	if !safeClientToken(reason, 32) {
+		reason = otherField
+	}
+	if model == "" {
+		model = otherField
+	}
+	finishReasonsTotal.Add(model+":"+route+":"+reason, 1)
+
+	minute := t.now().Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := model + ":" + route
+	s, ok := t.series[key]
+	if !ok {
+		if len(t.series) >= maxFinishReasonSeries {
+			model, key = otherField, otherField+":"+route
+			s = t.series[key]
+		}
+		if s == nil {
+			s = &finishReasonSeries{model: model, route: route, buckets: make([]finishReasonBucket, int(t.window/time.Minute)), alerting: make(map[string]bool)}
+			t.series[key] = s
+		}
+	}
+	b := &s.buckets[minute%int64(len(s.buckets))]
+	if b.minute != minute || b.byReason == nil {
+		*b = finishReasonBucket{minute: minute, byReason: make(map[string]int64)}
+	}
+	b.total++
+	b.byReason[reason]++
+
+	if len(t.thresholds) > 0 {
+		t.checkAlerts(s, minute)
+	}
+}
+
+// checkAlerts logs a warning when a finish reason's share of the series
+// goes over its threshold, and a notice when it falls back under. Called
+// with t.mu held.
+func (t *finishReasonTracker) checkAlerts(s *finishReasonSeries, minute int64) {
+	total, counts := s.totals(minute)
+	for reason, threshold := range t.thresholds {
+		share := 0.0
+		if total > 0 {
+			share = float64(counts[reason]) / float64(total)
+		}
+		switch over := total >= t.minRequests && share > threshold; {
+		case over && !s.alerting[reason]:
+			s.alerting[reason] = true
+			log.Printf("warning event=finish_reason_spike model=%q route=%q finish_reason=%s share=%.3f threshold=%.3f requests=%d window=%s",
+				s.model, s.route, reason, share, threshold, total, t.window)
+		case !over && s.alerting[reason]:
+			delete(s.alerting, reason)
+			log.Printf("notice event=finish_reason_recovered model=%q route=%q finish_reason=%s share=%.3f threshold=%.3f requests=%d window=%s",
+				s.model, s.route, reason, share, threshold, total, t.window)
+		}
+	}
+}
+
+// totals sums the buckets inside the window ending at minute.
+func (s *finishReasonSeries) totals(minute int64) (int64, map[string]int64) {
+	oldest := minute - int64(len(s.buckets)) + 1
+	var total int64
+	counts := make(map[string]int64)
+	for _, b := range s.buckets {
+		if b.minute < oldest {
+			continue
+		}
+		total += b.total
+		for reason, n := range b.byReason {
+			counts[reason] += n
+		}
+	}
+	return total, counts
+}
+
+type finishReasonShare struct {
+	Count int64   `json:"count"`
+	Share float64 `json:"share"`
+}
+
+type finishReasonSummary struct {
+	Model         string                       `json:"model"`
+	Route         string                       `json:"route"`
+	Requests      int64                        `json:"requests"`
+	FinishReasons map[string]finishReasonShare `json:"finish_reasons"`
+	// Alerts are the finish reasons currently over their threshold
+	Alerts []string `json:"alerts,omitempty"`
+}
+
+// summary reports each series with responses in the window, sorted by
+// model and route.
+func (t *finishReasonTracker) summary() []finishReasonSummary {
+	minute := t.now().Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := []finishReasonSummary{}
+	for _, s := range t.series {
+		total, counts := s.totals(minute)
+		if total == 0 {
+			continue
+		}
+		sum := finishReasonSummary{Model: s.model, Route: s.route, Requests: total, FinishReasons: make(map[string]finishReasonShare, len(counts))}
+		for reason, n := range counts {
+			sum.FinishReasons[reason] = finishReasonShare{Count: n, Share: round3(float64(n) / float64(total))}
+		}
+		for reason := range s.alerting {
+			sum.Alerts = append(sum.Alerts, reason)
+		}
+		sort.Strings(sum.Alerts)
+		out = append(out, sum)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Model != out[j].Model {
+			return out[i].Model < out[j].Model
+		}
+		return out[i].Route < out[j].Route
+	})
+	return out
+}
+
+// finishReasonsAdminHandler implements GET /admin/finish-reasons: the
+// distribution of finish reasons per model and route over
+// FINISH_REASON_WINDOW.
+func finishReasonsAdminHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"object":         "list",
+		"window_seconds": finishReasons.window.Seconds(),
+		"thresholds":     finishReasons.thresholds,
+		"data":           finishReasons.summary(),
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// trustedProxies are the peers whose X-Forwarded-For and X-Forwarded-Proto
+// are believed, from TRUSTED_PROXIES.
+var trustedProxies []netip.Prefix
+
+// loadTrustedProxies parses TRUSTED_PROXIES, a comma-separated list of
+// CIDRs or addresses.
+func loadTrustedProxies() ([]netip.Prefix, error) {
+	raw := os.Getenv("TRUSTED_PROXIES")
+	if raw == "" {
+		return nil, nil
+	}
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if p, err := netip.ParsePrefix(entry); err == nil {
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q", entry)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientInfo describes the caller as seen through any trusted proxies.
+type clientInfo struct {
+	IP    string
+	Proto string
+	Via   string
+}
+
+type clientInfoKey struct{}
+
+// resolveClient finds the real client: the peer, unless it is a trusted
+// proxy, in which case X-Forwarded-For is walked from the right past any
+// further trusted hops.
+func resolveClient(r *http.Request) clientInfo {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	if isTrustedProxy(ip) {
+		if p := r.Header.Get("X-Forwarded-Proto"); p == "http" || p == "https" {
+			proto = p
+		}
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if _, err := netip.ParseAddr(hop); err != nil {
+				break
+			}
+			ip = hop
+			if !isTrustedProxy(hop) {
+				break
+			}
+		}
+	}
+
+	version := "1.1"
+	if r.ProtoMajor >= 2 {
+		version = "2"
+	} else if r.ProtoMinor == 0 {
+		version = "1.0"
+	}
+	return clientInfo{IP: ip, Proto: proto, Via: version + " ai-inference-gateway"}
+}
+
+// withClientInfo records the resolved client for backend forwarding headers.
+func withClientInfo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientInfoKey{}, resolveClient(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// setForwardingHeaders identifies the gateway and, unless the backend has
+// suppress_forwarding set, the original caller. Requests the gateway makes
+// on its own, such as batch lines, carry no client and get no forwarding
+// headers.
+func setForwardingHeaders(ctx context.Context, httpReq *http.Request, backend *Backend) {
+	ua := os.Getenv("GATEWAY_USER_AGENT")
+	if ua == "" {
+		ua = gatewayUserAgent()
+	}
+	httpReq.Header.Set("User-Agent", ua)
+
+	ci, ok := ctx.Value(clientInfoKey{}).(clientInfo)
+	if !ok || backend.SuppressForwarding {
+		return
+	}
+	httpReq.Header.Set("X-Forwarded-For", ci.IP)
+	httpReq.Header.Set("X-Forwarded-Proto", ci.Proto)
+	httpReq.Header.Set("Via", ci.Via)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/vinayhpandya/ai_inference_gateway/fakeback"
+)
+
+func useTrustedProxies(t *testing.T, raw string) {
+	t.Helper()
+	t.Setenv("TRUSTED_PROXIES", raw)
+	prefixes, err := loadTrustedProxies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := trustedProxies
+	trustedProxies = prefixes
+	t.Cleanup(func() { trustedProxies = prev })
+}
+
+func TestLoadTrustedProxies(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.7/24,::1")
+	got, err := loadTrustedProxies()
+	want := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.168.1.0/24"), netip.MustParsePrefix("::1/128")}
+	if err != nil || len(got) != len(want) {
+		t.Fatalf("prefixes = %v, %v", got, err)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("prefix %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8,proxy.internal")
+	if _, err := loadTrustedProxies(); err == nil {
+		t.Error("hostname accepted")
+	}
+}
+
+func TestResolveClient(t *testing.T) {
+	useTrustedProxies(t, "10.0.0.0/8")
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		proto  string
+		tls    bool
+		want   clientInfo
+	}{
+		{"direct", "203.0.113.9:5000", nil, "", false, clientInfo{"203.0.113.9", "http", "1.1 ai-inference-gateway"}},
+		{"direct tls", "203.0.113.9:5000", nil, "", true, clientInfo{"203.0.113.9", "https", "1.1 ai-inference-gateway"}},
+		{"untrusted peer's headers ignored", "203.0.113.9:5000", []string{"1.2.3.4"}, "https", false, clientInfo{"203.0.113.9", "http", "1.1 ai-inference-gateway"}},
+		{"trusted proxy", "10.0.0.2:5000", []string{"198.51.100.4"}, "https", false, clientInfo{"198.51.100.4", "https", "1.1 ai-inference-gateway"}},
+		{"chain of trusted proxies", "10.0.0.2:5000", []string{"1.2.3.4, 198.51.100.4", "10.1.1.1"}, "", false, clientInfo{"198.51.100.4", "http", "1.1 ai-inference-gateway"}},
+		{"spoofed hop left of the client", "10.0.0.2:5000", []string{"10.9.9.9, 198.51.100.4"}, "", false, clientInfo{"198.51.100.4", "http", "1.1 ai-inference-gateway"}},
+		{"garbage hop", "10.0.0.2:5000", []string{"198.51.100.4, unknown"}, "", false, clientInfo{"10.0.0.2", "http", "1.1 ai-inference-gateway"}},
+		{"bad proto", "10.0.0.2:5000", nil, "gopher", false, clientInfo{"10.0.0.2", "http", "1.1 ai-inference-gateway"}},
+		{"mapped ipv4 proxy", "[::ffff:10.0.0.2]:5000", []string{"198.51.100.4"}, "", false, clientInfo{"198.51.100.4", "http", "1.1 ai-inference-gateway"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if got := resolveClient(r); got != tt.want {
+				t.Errorf("client = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// forwardedHeaders sends a chat completion from a client behind a trusted
+// proxy and returns the headers the backend got.
+func forwardedHeaders(t *testing.T, back *fakeback.Server) http.Header {
+	t.Helper()
+	back.Enqueue(fakeback.Behavior{Content: "ok"})
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+	r.RemoteAddr = "10.0.0.2:41000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.4")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	w := httptest.NewRecorder()
+	withClientInfo(accessLog(http.HandlerFunc(chatCompletionsHandler))).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	reqs := back.Requests()
+	return reqs[len(reqs)-1].Header
+}
+
+func TestForwardingHeadersSeenByBackend(t *testing.T) {
+	captureLog(t)
+	useTrustedProxies(t, "10.0.0.0/8")
+	back := useFakeBackend(t)
+
+	h := forwardedHeaders(t, back)
+	want := map[string]string{
+		"User-Agent":        gatewayUserAgent(),
+		"X-Forwarded-For":   "198.51.100.4",
+		"X-Forwarded-Proto": "https",
+		"Via":               "1.1 ai-inference-gateway",
+	}
+	for name, v := range want {
+		if got := h.Values(name); len(got) != 1 || got[0] != v {
+			t.Errorf("%s = %q, want %q", name, got, v)
+		}
+	}
+
+	t.Setenv("GATEWAY_USER_AGENT", "acme-gateway/2.0")
+	if got := forwardedHeaders(t, back).Get("User-Agent"); got != "acme-gateway/2.0" {
+		t.Errorf("User-Agent = %q, want GATEWAY_USER_AGENT", got)
+	}
+}
+
+func TestForwardingSuppressedPerBackend(t *testing.T) {
+	captureLog(t)
+	useTrustedProxies(t, "10.0.0.0/8")
+	back := useFakeBackend(t)
+	c := useCatalog(t, &ModelInfo{ID: "m", Backend: "third-party"})
+	c.backends["third-party"] = &Backend{Name: "third-party", Type: "openai", URL: back.URL, SuppressForwarding: true}
+	// Only the catalog backend reaches the fake
+	t.Setenv("BACKEND_URL", "")
+
+	h := forwardedHeaders(t, back)
+	for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "Via"} {
+		if got := h.Values(name); len(got) != 0 {
+			t.Errorf("%s = %q, want none", name, got)
+		}
+	}
+	if got := h.Get("User-Agent"); got != gatewayUserAgent() {
+		t.Errorf("User-Agent = %q, want %q", got, gatewayUserAgent())
+	}
+}
+
+func TestNoForwardingWithoutClient(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodPost, "http://backend/v1/chat/completions", nil)
+	setForwardingHeaders(t.Context(), r, &Backend{Name: "b"})
+	if r.Header.Get("User-Agent") != gatewayUserAgent() || r.Header.Get("X-Forwarded-For") != "" || r.Header.Get("Via") != "" {
+		t.Errorf("headers = %v, want only User-Agent", r.Header)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// geminiAdapter translates chat completions to the Gemini generateContent
+// API (Google AI or Vertex AI). The backend URL is the prefix under which
+// "/models/{model}:generateContent" lives, for example
+// https://generativelanguage.googleapis.com/v1beta or
+// https://us-central1-aiplatform.googleapis.com/v1/projects/P/locations/us-central1/publishers/google
+type geminiAdapter struct{}
+
+// Gemini request types
+type geminiRequest struct {
+	Contents          []geminiContent         `json:"contents"`
+	SystemInstruction *geminiContent          `json:"systemInstruction,omitempty"`
+	GenerationConfig  *geminiGenerationConfig `json:"generationConfig,omitempty"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiPart struct {
+	Text string `json:"text"`
+}
+
+type geminiGenerationConfig struct {
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"topP,omitempty"`
+	MaxOutputTokens *int     `json:"maxOutputTokens,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+	Seed            *int64   `json:"seed,omitempty"`
+}
+
+// Gemini response types
+type geminiResponse struct {
+	Candidates     []geminiCandidate     `json:"candidates"`
+	PromptFeedback *geminiPromptFeedback `json:"promptFeedback"`
+	UsageMetadata  *geminiUsage          `json:"usageMetadata"`
+	ModelVersion   string                `json:"modelVersion"`
+}
+
+type geminiCandidate struct {
+	Content       geminiContent        `json:"content"`
+	FinishReason  string               `json:"finishReason"`
+	SafetyRatings []geminiSafetyRating `json:"safetyRatings"`
+}
+
+type geminiPromptFeedback struct {
+	BlockReason   string               `json:"blockReason"`
+	SafetyRatings []geminiSafetyRating `json:"safetyRatings"`
+}
+
+type geminiSafetyRating struct {
+	Category    string `json:"category"`
+	Probability string `json:"probability"`
+	Blocked     bool   `json:"blocked"`
+}
+
+type geminiUsage struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+}
+
+func (geminiAdapter) newRequest(ctx context.Context, backend *Backend, req ChatCompletionRequest, requestID string) (*http.Request, error) {
+	if req.Model == "" {
+		return nil, fmt.Errorf("gemini backends require a model")
+	}
+
+	body := geminiRequest{Contents: []geminiContent{}}
+	for _, m := range req.Messages {
+		switch m.Role {
+		case "system":
+			if body.SystemInstruction == nil {
+				body.SystemInstruction = &geminiContent{}
+			}
+			body.SystemInstruction.Parts = append(body.SystemInstruction.Parts, geminiPart{Text: m.Content})
+		case "assistant":
+			body.Contents = append(body.Contents, geminiContent{Role: "model", Parts: []geminiPart{{Text: m.Content}}})
+		default:
+			body.Contents = append(body.Contents, geminiContent{Role: "user", Parts: []geminiPart{{Text: m.Content}}})
+		}
+	}
+	if req.Temperature != nil || req.TopP != nil || req.MaxTokens != nil || len(req.Stop) > 0 || req.Seed != nil {
+		body.GenerationConfig = &geminiGenerationConfig{
+			Temperature:     req.Temperature,
+			TopP:            req.TopP,
+			MaxOutputTokens: req.MaxTokens,
+			StopSequences:   req.Stop,
+			Seed:            req.Seed,
+		}
+	}
+
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	url := backendURL(backend.URL, "/models/"+req.Model+":generateContent")
+	if req.Stream {
+		url = backendURL(backend.URL, "/models/"+req.Model+":streamGenerateContent?alt=sse")
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-Request-ID", requestID)
+
+	switch {
+	case backend.APIKey != "":
+		httpReq.Header.Set("x-goog-api-key", backend.APIKey)
+	case backend.CredentialsFile != "":
+		token, err := serviceAccountToken(ctx, backend.CredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get access token: %w", err)
+		}
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	return httpReq, nil
+}
+
+func (geminiAdapter) decodeResponse(body io.Reader) (ChatCompletionResponse, error) {
+	var resp geminiResponse
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return ChatCompletionResponse{}, err
+	}
+
+	response := ChatCompletionResponse{
+		Object:  "chat.completion",
+		Model:   resp.ModelVersion,
+		Choices: []Choice{},
+	}
+	for i, c := range resp.Candidates {
+		choice := Choice{
+			Index:        i,
+			Message:      Message{Role: "assistant", Content: geminiText(c.Content)},
+			FinishReason: geminiFinishReason(c.FinishReason),
+		}
+		if choice.FinishReason == "content_filter" {
+			choice.ContentFilter = &ContentFilter{Provider: "gemini", Categories: geminiBlockedCategories(c.SafetyRatings)}
+		}
+		response.Choices = append(response.Choices, choice)
+	}
+
+	// A blocked prompt produces no candidates at all
+	if len(resp.Candidates) == 0 && resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != "" {
+		categories := geminiBlockedCategories(resp.PromptFeedback.SafetyRatings)
+		if len(categories) == 0 {
+			categories = []string{resp.PromptFeedback.BlockReason}
+		}
+		response.Choices = append(response.Choices, Choice{
+			Message:       Message{Role: "assistant"},
+			FinishReason:  "content_filter",
+			ContentFilter: &ContentFilter{Provider: "gemini", Categories: categories},
+		})
+	}
+
+	if u := resp.UsageMetadata; u != nil {
+		response.Usage = Usage{
+			PromptTokens:     u.PromptTokenCount,
+			CompletionTokens: u.CandidatesTokenCount,
+			TotalTokens:      u.TotalTokenCount,
+		}
+	}
+	return response, nil
+}
+
+// streamBody converts Gemini's SSE stream (one GenerateContentResponse per
+// event) into OpenAI chat completion chunks.
+func (geminiAdapter) streamBody(body io.ReadCloser, requestID string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		sse := &sseWriter{w: pw, flusher: nopFlusher{}}
+		sse.writeChunk(ChatCompletionChunk{
+			ID:      requestID,
+			Object:  "chat.completion.chunk",
+			Choices: []ChunkChoice{{Index: 0, Delta: Delta{Role: "assistant"}}},
+		})
+
+		var usage *geminiUsage
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data:")
+			if !ok {
+				continue
+			}
+			var resp geminiResponse
+			if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &resp); err != nil {
+				pw.CloseWithError(fmt.Errorf("invalid gemini stream event: %w", err))
+				return
+			}
+			if resp.UsageMetadata != nil {
+				usage = resp.UsageMetadata
+			}
+
+			if len(resp.Candidates) == 0 {
+				if resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != "" {
+					sse.writeChunk(finishChunk(requestID, "content_filter"))
+				}
+				continue
+			}
+			c := resp.Candidates[0]
+			if text := geminiText(c.Content); text != "" {
+				sse.writeChunk(ChatCompletionChunk{
+					ID:      requestID,
+					Object:  "chat.completion.chunk",
+					Choices: []ChunkChoice{{Index: 0, Delta: Delta{Content: text}}},
+				})
+			}
+			if c.FinishReason != "" {
+				sse.writeChunk(finishChunk(requestID, geminiFinishReason(c.FinishReason)))
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		if usage != nil {
+			sse.writeChunk(ChatCompletionChunk{
+				ID:      requestID,
+				Object:  "chat.completion.chunk",
+				Choices: []ChunkChoice{},
+				Usage: &Usage{
+					PromptTokens:     usage.PromptTokenCount,
+					CompletionTokens: usage.CandidatesTokenCount,
+					TotalTokens:      usage.TotalTokenCount,
+				},
+			})
+		}
+		sse.writeDone()
+		pw.Close()
+	}()
+	return &translatedStream{Reader: pr, pipe: pr, upstream: body}
+}
+
+// translatedStream is a converted stream whose Close also releases the
+// upstream body and unblocks the translating goroutine.
+type translatedStream struct {
+	io.Reader
+	pipe     *io.PipeReader
+	upstream io.Closer
+}
+
+func (t *translatedStream) Close() error {
+	t.pipe.Close()
+	return t.upstream.Close()
+}
+
+func geminiText(c geminiContent) string {
+	var text strings.Builder
+	for _, p := range c.Parts {
+		text.WriteString(p.Text)
+	}
+	return text.String()
+}
+
+// geminiFinishReason maps Gemini finish reasons onto OpenAI's.
+func geminiFinishReason(reason string) string {
+	switch reason {
+	case "STOP", "":
+		return "stop"
+	case "MAX_TOKENS":
+		return "length"
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY":
+		return "content_filter"
+	default:
+		return strings.ToLower(reason)
+	}
+}
+
+// geminiBlockedCategories lists the safety categories that caused a block.
+func geminiBlockedCategories(ratings []geminiSafetyRating) []string {
+	categories := []string{}
+	for _, r := range ratings {
+		if r.Blocked || r.Probability == "HIGH" {
+			categories = append(categories, r.Category)
+		}
+	}
+	return categories
+}
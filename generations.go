@@ -0,0 +1,145 @@
+package main
+
+import (
+	"expvar"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// generations counts requests by the catalog generation they were admitted
+// under.
+var generations = newGenerationTracker()
+
+// generationStats counts one catalog generation's requests.
+type generationStats struct {
+	inFlight     int
+	requests     int64
+	clientErrors int64
+	serverErrors int64
+	// retired is set once a reload replaces the generation; drained is
+	// closed when a retired generation has no requests left in flight
+	retired bool
+	drained chan struct{}
+}
+
+// generationTracker pins each request to the catalog active when it was
+// admitted, so a reload never changes a request's routing halfway through,
+// and counts requests per generation so a reload can tell when the one it
+// replaced has drained. Admission and reloads both hold mu, so no request
+// is admitted under a generation after it is retired.
+type generationTracker struct {
+	mu    sync.Mutex
+	stats map[int64]*generationStats
+	// previous is the generation the last reload retired
+	previous int64
+}
+
+func newGenerationTracker() *generationTracker {
+	t := &generationTracker{stats: make(map[int64]*generationStats)}
+	expvar.Publish("gateway_config_generation_requests", expvar.Func(t.gauges))
+	return t
+}
+
+func (t *generationTracker) get(gen int64) *generationStats {
+	s := t.stats[gen]
+	if s == nil {
+		s = &generationStats{drained: make(chan struct{})}
+		t.stats[gen] = s
+	}
+	return s
+}
+
+// admit pins rec to the active catalog and counts it in flight. The
+// returned func ends the request with the status it was answered with.
+func (t *generationTracker) admit(rec *requestRecord) func(status int) {
+	t.mu.Lock()
+	c := catalog.Load()
+	rec.catalog = c
+	s := t.get(c.generation)
+	s.inFlight++
+	s.requests++
+	t.mu.Unlock()
+
+	return func(status int) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		switch {
+		case status >= 500:
+			s.serverErrors++
+		case status >= 400:
+			s.clientErrors++
+		}
+		if s.inFlight--; s.inFlight == 0 && s.retired {
+			close(s.drained)
+			t.prune()
+		}
+	}
+}
+
+// swap makes c the active catalog and retires the one it replaces. The
+// returned channel is closed once every request admitted under the old
+// generation has finished.
+func (t *generationTracker) swap(c *modelCatalog) (prev *modelCatalog, drained <-chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prev = catalog.Swap(c)
+	t.get(c.generation)
+	t.previous = prev.generation
+	old := t.get(prev.generation)
+	old.retired = true
+	if old.inFlight == 0 {
+		close(old.drained)
+	}
+	t.prune()
+	return prev, old.drained
+}
+
+// prune drops drained generations older than the previous one.
+func (t *generationTracker) prune() {
+	for gen, s := range t.stats {
+		if gen < t.previous && s.retired && s.inFlight == 0 {
+			delete(t.stats, gen)
+		}
+	}
+}
+
+// generationState is one generation's requests in the state snapshot.
+type generationState struct {
+	Generation   int64 `json:"generation"`
+	InFlight     int   `json:"in_flight"`
+	Requests     int64 `json:"requests"`
+	ClientErrors int64 `json:"client_errors"`
+	ServerErrors int64 `json:"server_errors"`
+}
+
+// snapshot reports the generations newest first: the current and previous
+// ones and, unless bounded, older ones still draining. The caller holds mu.
+func (t *generationTracker) snapshot(current int64, bounded bool) []generationState {
+	var out []generationState
+	for gen, s := range t.stats {
+		if gen != current && gen != t.previous && (bounded || s.inFlight == 0) {
+			continue
+		}
+		out = append(out, generationState{Generation: gen, InFlight: s.inFlight, Requests: s.requests,
+			ClientErrors: s.clientErrors, ServerErrors: s.serverErrors})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Generation > out[j].Generation })
+	return out
+}
+
+// gauges publishes the current and previous generations only, so labels
+// stay bounded however often the catalog is reloaded.
+func (t *generationTracker) gauges() any {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	gens := t.snapshot(catalog.Load().generation, true)
+	g := make(map[string]map[string]float64, len(gens))
+	for _, s := range gens {
+		g[strconv.FormatInt(s.Generation, 10)] = map[string]float64{
+			"in_flight": float64(s.InFlight), "requests": float64(s.Requests),
+			"client_errors": float64(s.ClientErrors), "server_errors": float64(s.ServerErrors),
+		}
+	}
+	return g
+}
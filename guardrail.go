@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultGuardrailTimeout = 2 * time.Second
+
+// Guardrail outcomes, as counted in gateway_guardrail_decisions_total.
+const (
+	DecisionAllow  = "allow"
+	DecisionBlock  = "block"
+	DecisionMutate = "mutate"
+	// decisionError is a guardrail that failed or timed out
+	decisionError = "error"
+)
+
+// guardrailDecisions counts Guardrail outcomes by guardrail, stage and
+// outcome, as "blocklist:request:block".
+var guardrailDecisions = expvar.NewMap("gateway_guardrail_decisions_total")
+
+// guardrailBuckets are upper bounds in seconds for guardrail latency
+// histograms; guardrails sit on the request path, so they should be fast.
+var guardrailBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// errGuardrailBlocked ends a stream a guardrail blocked part way.
+var errGuardrailBlocked = errors.New("blocked by guardrail")
+
+// Guardrail checks chat completions on their way in and out. CheckRequest
+// sees each request after validation, before routing; CheckResponse sees
+// each choice's completion, or for streams each piece of streamed text
+// before the client does. Requests and responses must be treated as
+// read-only; changes belong in the decision.
+type Guardrail interface {
+	CheckRequest(ctx context.Context, rc *RequestContext) (Decision, error)
+	CheckResponse(ctx context.Context, rc *RequestContext, rsp *ResponseContent) (Decision, error)
+}
+
+// ResponseContent is completion text for CheckResponse.
+type ResponseContent struct {
+	// Choice is the index of the choice the text belongs to
+	Choice int
+	// Text is the completion so far, Delta included: all of it for a
+	// complete response, what the client has plus Delta for a stream
+	Text string
+	// Delta is the text not checked before. It is all of Text for a
+	// complete response
+	Delta string
+	// Final is set on the last check of a choice
+	Final bool
+}
+
+// Decision is a Guardrail's answer. The zero Decision allows.
+type Decision struct {
+	// Action is DecisionAllow, DecisionBlock or DecisionMutate
+	Action string
+	// Code and Message are the client-facing error for a block
+	Code    string
+	Message string
+	// Messages replace the request's messages when CheckRequest mutates
+	Messages []Message
+	// Content replaces Delta when CheckResponse mutates
+	Content string
+}
+
+// guardrailFactories are the Guardrail implementations compiled into the
+// gateway, by the name GUARDRAILS selects. Forks add their own with
+// registerGuardrail from an init function, as with routers.
+var guardrailFactories = map[string]func() (Guardrail, error){
+	"blocklist": newBlocklistGuardrail,
+	"injection": newInjectionGuardrail,
+}
+
+func registerGuardrail(name string, factory func() (Guardrail, error)) {
+	if _, ok := guardrailFactories[name]; ok {
+		panic(fmt.Sprintf("guardrail %q registered twice", name))
+	}
+	guardrailFactories[name] = factory
+}
+
+// guardrails is nil unless GUARDRAILS is set.
+var guardrails *guardrailChain
+
+// guardrailChain runs the configured guardrails in order. Each sees the
+// request or text as the ones before it left it.
+type guardrailChain struct {
+	entries []*guardrailEntry
+	timeout time.Duration
+}
+
+type guardrailEntry struct {
+	name     string
+	g        Guardrail
+	failOpen bool
+	latency  *histogram
+}
+
+// loadGuardrails builds the guardrails GUARDRAILS names, comma-separated in
+// the order they run. Those named in GUARDRAIL_FAIL_OPEN let traffic
+// through when they fail or exceed GUARDRAIL_TIMEOUT (default 2s); the
+// rest reject it. It returns nil when no guardrails are configured.
+func loadGuardrails() (*guardrailChain, error) {
+	raw := os.Getenv("GUARDRAILS")
+	if raw == "" {
+		return nil, nil
+	}
+	failOpen := map[string]bool{}
+	for _, name := range strings.Split(os.Getenv("GUARDRAIL_FAIL_OPEN"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			failOpen[name] = true
+		}
+	}
+	c := &guardrailChain{timeout: envDuration("GUARDRAIL_TIMEOUT", defaultGuardrailTimeout)}
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		factory, ok := guardrailFactories[name]
+		if !ok {
+			names := make([]string, 0, len(guardrailFactories))
+			for n := range guardrailFactories {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown GUARDRAILS entry %q: want one of %s", name, strings.Join(names, ", "))
+		}
+		if slices.ContainsFunc(c.entries, func(e *guardrailEntry) bool { return e.name == name }) {
+			return nil, fmt.Errorf("guardrail %q is listed twice in GUARDRAILS", name)
+		}
+		g, err := factory()
+		if err != nil {
+			return nil, fmt.Errorf("guardrail %q: %w", name, err)
+		}
+		c.entries = append(c.entries, &guardrailEntry{
+			name:     name,
+			g:        g,
+			failOpen: failOpen[name],
+			latency:  newHistogram("gateway_guardrail_"+name+"_seconds", guardrailBuckets),
+		})
+		delete(failOpen, name)
+	}
+	for name := range failOpen {
+		return nil, fmt.Errorf("GUARDRAIL_FAIL_OPEN names %q, which is not in GUARDRAILS", name)
+	}
+	return c, nil
+}
+
+// run calls one guardrail with the chain's timeout and meters it. A failed
+// guardrail is allowed through when it fails open and otherwise rejects.
+func (e *guardrailEntry) run(ctx context.Context, timeout time.Duration, stage string, requestID string, check func(context.Context) (Decision, error)) (Decision, *RouteError) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	d, err := check(ctx)
+	e.latency.observe(time.Since(start))
+	if err == nil {
+		switch d.Action {
+		case "":
+			d.Action = DecisionAllow
+		case DecisionAllow, DecisionBlock, DecisionMutate:
+		default:
+			err = fmt.Errorf("unknown action %q", d.Action)
+		}
+	}
+	if err != nil {
+		guardrailDecisions.Add(e.name+":"+stage+":"+decisionError, 1)
+		if e.failOpen {
+			log.Printf("Guardrail %s failed on %s of %s, failing open: %v", e.name, stage, requestID, err)
+			return Decision{Action: DecisionAllow}, nil
+		}
+		log.Printf("Guardrail %s failed on %s of %s, failing closed: %v", e.name, stage, requestID, err)
+		return Decision{}, &RouteError{Status: http.StatusServiceUnavailable, Type: "server_error", Code: "guardrail_unavailable",
+			Message: withheldDetail("A content guardrail is unavailable; retry later", requestID)}
+	}
+	guardrailDecisions.Add(e.name+":"+stage+":"+d.Action, 1)
+	if d.Action != DecisionBlock {
+		return d, nil
+	}
+	if d.Code == "" {
+		d.Code = "guardrail_blocked"
+	}
+	if d.Message == "" {
+		d.Message = "The request was blocked by a content guardrail"
+	}
+	log.Printf("Guardrail %s blocked %s of %s: %s", e.name, stage, requestID, d.Code)
+	return d, &RouteError{Status: http.StatusBadRequest, Type: "invalid_request_error", Code: d.Code, Message: d.Message}
+}
+
+// checkRequest runs every guardrail on rc's request, applying mutations to
+// it, and returns the rejection if one blocks or fails closed. It also
+// names the guardrails that rewrote the request, for dry-run reports.
+func (c *guardrailChain) checkRequest(ctx context.Context, rc *RequestContext) (rewrote []string, rej *RouteError) {
+	if c == nil {
+		return nil, nil
+	}
+	for _, e := range c.entries {
+		d, rej := e.run(ctx, c.timeout, "request", rc.RequestID, func(ctx context.Context) (Decision, error) {
+			return e.g.CheckRequest(ctx, rc)
+		})
+		if rej != nil {
+			return rewrote, rej
+		}
+		if d.Action == DecisionMutate {
+			rc.Request.Messages = d.Messages
+			rewrote = append(rewrote, e.name)
+		}
+	}
+	return rewrote, nil
+}
+
+// checkResponse runs every guardrail on rsp and returns the text to send in
+// place of rsp.Delta, or the rejection if one blocks or fails closed.
+func (c *guardrailChain) checkResponse(ctx context.Context, rc *RequestContext, rsp ResponseContent) (string, *RouteError) {
+	if c == nil {
+		return rsp.Delta, nil
+	}
+	prefix := rsp.Text[:len(rsp.Text)-len(rsp.Delta)]
+	for _, e := range c.entries {
+		d, rej := e.run(ctx, c.timeout, "response", rc.RequestID, func(ctx context.Context) (Decision, error) {
+			return e.g.CheckResponse(ctx, rc, &rsp)
+		})
+		if rej != nil {
+			return "", rej
+		}
+		if d.Action == DecisionMutate {
+			rsp.Delta = d.Content
+			rsp.Text = prefix + rsp.Delta
+		}
+	}
+	return rsp.Delta, nil
+}
+
+// names lists the guardrails in the order they run.
+func (c *guardrailChain) names() []string {
+	names := []string{}
+	if c != nil {
+		for _, e := range c.entries {
+			names = append(names, e.name)
+		}
+	}
+	return names
+}
+
+func (c *guardrailChain) failOpenNames() []string {
+	names := []string{}
+	if c != nil {
+		for _, e := range c.entries {
+			if e.failOpen {
+				names = append(names, e.name)
+			}
+		}
+	}
+	return names
+}
+
+// checksResponses reports whether responses need their content decoded for
+// guardrails, which rules out passing them through.
+func (c *guardrailChain) checksResponses() bool {
+	return c != nil
+}
+
+// guardResponse checks each choice of a complete response, replacing
+// mutated content in place.
+func (c *guardrailChain) guardResponse(ctx context.Context, rc *RequestContext, response *ChatCompletionResponse) *RouteError {
+	if c == nil {
+		return nil
+	}
+	for i := range response.Choices {
+		content := response.Choices[i].Message.Content
+		if content == "" {
+			continue
+		}
+		out, rej := c.checkResponse(ctx, rc, ResponseContent{Choice: response.Choices[i].Index, Text: content, Delta: content, Final: true})
+		if rej != nil {
+			return rej
+		}
+		response.Choices[i].Message.Content = out
+	}
+	return nil
+}
+
+// streamGuard checks streamed text as it is relayed.
+type streamGuard struct {
+	ctx   context.Context
+	chain *guardrailChain
+	rc    *RequestContext
+}
+
+// check returns the text to stream in place of delta for the choice with
+// index; sent is what the client has of it so far.
+func (g *streamGuard) check(index int, sent, delta string, final bool) (string, *RouteError) {
+	if g == nil || (delta == "" && !final) {
+		return delta, nil
+	}
+	return g.chain.checkResponse(g.ctx, g.rc, ResponseContent{Choice: index, Text: sent + delta, Delta: delta, Final: final})
+}
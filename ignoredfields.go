@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxIgnoredFields bounds how many field names are counted apart; the
+	// rest, and names that aren't plain identifiers, count as otherField
+	maxIgnoredFields = 100
+	otherField       = "_other"
+	// ignoredFieldLogEvery logs a field's first occurrence and every
+	// ignoredFieldLogEvery-th after that
+	ignoredFieldLogEvery = 1000
+)
+
+// ignoredFieldsTotal counts top-level request fields the gateway dropped, by
+// field name: unknown ones in lenient mode and extensions a backend doesn't
+// support.
+var ignoredFieldsTotal = expvar.NewMap("gateway_ignored_fields_total")
+
+// knownFields holds the accepted top-level keys, for lookups that don't
+// allocate.
+var knownFields = sync.OnceValue(func() map[string]struct{} {
+	known := make(map[string]struct{})
+	for _, f := range requestFields() {
+		known[f] = struct{}{}
+	}
+	return known
+})
+
+var ignoredFields = struct {
+	sync.Mutex
+	byName map[string]*ignoredField
+}{byName: make(map[string]*ignoredField)}
+
+type ignoredField struct {
+	Field string `json:"field"`
+	// Reason is unknown for fields the gateway doesn't understand and
+	// stripped for extensions the backend didn't support
+	Reason   string    `json:"reason"`
+	Count    int64     `json:"count"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// noteUnknownFields counts the top-level keys of a request body that the
+// gateway neither understands nor forwards. Bodies with none cost a scan of
+// their keys and nothing else.
+func noteUnknownFields(body []byte) {
+	known := knownFields()
+	forEachTopLevelKey(body, func(key []byte) {
+		if _, ok := known[string(key)]; !ok {
+			noteIgnoredField(string(key), "unknown")
+		}
+	})
+}
+
+// noteIgnoredField counts one dropped field; only its name is ever logged.
+func noteIgnoredField(field, reason string) {
+	if !safeClientToken(field, 64) {
+		field = otherField
+	}
+	ignoredFields.Lock()
+	f, ok := ignoredFields.byName[field]
+	if !ok {
+		if len(ignoredFields.byName) >= maxIgnoredFields {
+			field = otherField
+			f = ignoredFields.byName[field]
+		}
+		if f == nil {
+			f = &ignoredField{Field: field, Reason: reason}
+			ignoredFields.byName[field] = f
+		}
+	}
+	f.Count++
+	f.LastSeen = time.Now()
+	n := f.Count
+	ignoredFields.Unlock()
+
+	ignoredFieldsTotal.Add(field, 1)
+	if n == 1 || n%ignoredFieldLogEvery == 0 {
+		log.Printf("Ignored request field %q (%s; %d so far)", field, reason, n)
+	}
+}
+
+// forEachTopLevelKey calls fn with each key of the JSON object in data,
+// which must already be known to be valid JSON. It returns early on
+// anything that isn't an object. Keys with escapes are unquoted; the rest
+// are passed without copying.
+func forEachTopLevelKey(data []byte, fn func(key []byte)) {
+	depth := 0
+	expectKey := false
+	for i := 0; i < len(data); i++ {
+		switch c := data[i]; c {
+		case '{', '[':
+			if depth == 0 && c != '{' {
+				return
+			}
+			depth++
+			expectKey = depth == 1 && c == '{'
+		case '}', ']':
+			depth--
+		case ',':
+			expectKey = depth == 1
+		case '"':
+			start := i + 1
+			escaped := false
+			for i++; i < len(data) && data[i] != '"'; i++ {
+				if data[i] == '\\' {
+					escaped = true
+					i++
+				}
+			}
+			if !expectKey {
+				continue
+			}
+			expectKey = false
+			key := data[start:min(i, len(data))]
+			if escaped {
+				s, err := strconv.Unquote(string(data[start-1 : i+1]))
+				if err != nil {
+					continue
+				}
+				key = []byte(s)
+			}
+			fn(key)
+		}
+	}
+}
+
+// ignoredFieldsAdminHandler lists the dropped fields since startup, most
+// frequent first.
+func ignoredFieldsAdminHandler(w http.ResponseWriter, r *http.Request) {
+	ignoredFields.Lock()
+	data := make([]ignoredField, 0, len(ignoredFields.byName))
+	for _, f := range ignoredFields.byName {
+		data = append(data, *f)
+	}
+	ignoredFields.Unlock()
+	sort.Slice(data, func(i, j int) bool {
+		if data[i].Count != data[j].Count {
+			return data[i].Count > data[j].Count
+		}
+		return data[i].Field < data[j].Field
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": data})
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const defaultLeakMinLength = 64
+
+// defaultInjectionPatterns are the patterns the injection guardrail runs
+// when GUARDRAIL_INJECTION doesn't list its own.
+var defaultInjectionPatterns = []InjectionPattern{
+	{Name: "ignore_instructions", Pattern: `(?i)\b(ignore|disregard|forget|override)\b[^.\n]{0,40}\b(previous|prior|above|earlier|preceding|all|your|system)\b[^.\n]{0,20}\b(instructions?|prompts?|rules|directions)\b`},
+	{Name: "reveal_prompt", Pattern: `(?i)\b(print|reveal|show|repeat|output|display|tell me|what (is|are)|give me)\b[^.\n]{0,40}\b(system (prompt|message)|(initial|original|hidden|secret) (instructions|prompt)|your (instructions|prompt))\b`},
+	{Name: "mode_switch", Pattern: `(?i)\b(developer|dan|jailbreak|god) mode\b`},
+}
+
+// systemRolePattern matches user text that addresses the model as the
+// system: chat template role markers and "System:" headers that try to
+// pass the text off as the gateway's own instructions.
+var systemRolePattern = regexp.MustCompile(`(?im)^\s*(#{1,3}\s*)?\[?system\]?\s*:|<\|im_start\|>\s*system|<\|system\|>|<<SYS>>|\[/?INST\]|<\|start_header_id\|>\s*system`)
+
+// InjectionConfig is the file GUARDRAIL_INJECTION names. Without one, the
+// default patterns, the system role check and leak blocking all run:
+//
+//	{
+//	  "patterns":    [{"name": "reveal_prompt", "keywords": ["print your system prompt"]}],
+//	  "system_role": true,
+//	  "leak":        {"action": "redact", "min_length": 64}
+//	}
+type InjectionConfig struct {
+	// Patterns are matched against user messages. Left out, the defaults
+	// run; [] runs none
+	Patterns []InjectionPattern `json:"patterns"`
+	// SystemRole blocks user messages that address the system role
+	// (default true)
+	SystemRole *bool          `json:"system_role,omitempty"`
+	Leak       *InjectionLeak `json:"leak,omitempty"`
+	// Message is the client-facing error for a blocked request
+	Message string `json:"message,omitempty"`
+}
+
+// InjectionPattern is one named heuristic: keywords, which match anywhere
+// ignoring case, or a regular expression (RE2 syntax), or both.
+type InjectionPattern struct {
+	Name     string   `json:"name"`
+	Keywords []string `json:"keywords,omitempty"`
+	Pattern  string   `json:"pattern,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// InjectionLeak scans completions for the key's system prompt.
+type InjectionLeak struct {
+	// Action is block (default), ending the response, redact, replacing
+	// the leaked text with [redacted], or off
+	Action string `json:"action,omitempty"`
+	// MinLength is how many bytes of the prompt, copied verbatim, make a
+	// leak (default 64); shorter prompts leak only whole
+	MinLength int `json:"min_length,omitempty"`
+}
+
+// injectionGuardrail is the built-in prompt injection Guardrail. Keys
+// allowed to bypass it are still checked, and what would have been
+// blocked is logged, so false positives can be found and fixed.
+type injectionGuardrail struct {
+	cfg InjectionConfig
+}
+
+// newInjectionGuardrail loads GUARDRAIL_INJECTION, if it is set.
+func newInjectionGuardrail() (Guardrail, error) {
+	var g injectionGuardrail
+	if path := os.Getenv("GUARDRAIL_INJECTION"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &g.cfg); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+	c := &g.cfg
+	if c.Patterns == nil {
+		c.Patterns = append([]InjectionPattern(nil), defaultInjectionPatterns...)
+	}
+	seen := make(map[string]bool)
+	for i := range c.Patterns {
+		p := &c.Patterns[i]
+		if !safeClientToken(p.Name, 64) || p.Name == "system_role" || seen[p.Name] {
+			return nil, fmt.Errorf("pattern %d: name must be unique, other than system_role, and 1 to 64 characters from [A-Za-z0-9._:-]", i)
+		}
+		seen[p.Name] = true
+		var alts []string
+		for _, k := range p.Keywords {
+			if k == "" {
+				return nil, fmt.Errorf("pattern %q: keywords must not be empty", p.Name)
+			}
+			alts = append(alts, "(?i:"+regexp.QuoteMeta(k)+")")
+		}
+		if p.Pattern != "" {
+			if _, err := regexp.Compile(p.Pattern); err != nil {
+				return nil, fmt.Errorf("pattern %q: %w", p.Name, err)
+			}
+			alts = append(alts, "(?:"+p.Pattern+")")
+		}
+		if len(alts) == 0 {
+			return nil, fmt.Errorf("pattern %q needs keywords or a pattern", p.Name)
+		}
+		p.re = regexp.MustCompile(strings.Join(alts, "|"))
+	}
+	if c.SystemRole == nil {
+		on := true
+		c.SystemRole = &on
+	}
+	if c.Leak == nil {
+		c.Leak = &InjectionLeak{}
+	}
+	switch c.Leak.Action {
+	case "":
+		c.Leak.Action = DecisionBlock
+	case DecisionBlock, "redact", "off":
+	default:
+		return nil, fmt.Errorf("unknown leak action %q: want block, redact or off", c.Leak.Action)
+	}
+	switch {
+	case c.Leak.MinLength == 0:
+		c.Leak.MinLength = defaultLeakMinLength
+	case c.Leak.MinLength < 16:
+		return nil, errors.New("leak min_length must be at least 16")
+	}
+	return &g, nil
+}
+
+func (g *injectionGuardrail) CheckRequest(ctx context.Context, rc *RequestContext) (Decision, error) {
+	var matched []string
+	for _, m := range rc.Request.Messages {
+		if m.Role != "user" {
+			continue
+		}
+		for _, p := range g.cfg.Patterns {
+			if p.re.MatchString(m.Content) {
+				matched = append(matched, p.Name)
+			}
+		}
+		if *g.cfg.SystemRole && systemRolePattern.MatchString(m.Content) {
+			matched = append(matched, "system_role")
+		}
+	}
+	if len(matched) == 0 {
+		return Decision{}, nil
+	}
+	sort.Strings(matched)
+	matched = slices.Compact(matched)
+	if injectionBypassAllowed(rc.KeyID) {
+		auditInjection("bypass", rc, matched)
+		return Decision{}, nil
+	}
+	auditInjection("block", rc, matched)
+	message := g.cfg.Message
+	if message == "" {
+		message = "The request looks like an attempt to override or extract the gateway's instructions"
+	}
+	return Decision{Action: DecisionBlock, Code: "prompt_injection", Message: message}, nil
+}
+
+// CheckResponse looks for the key's system prompt in the completion. Only
+// leaks that end inside Delta count, so text already checked isn't
+// caught twice; redaction only reaches the part of a leak inside Delta.
+func (g *injectionGuardrail) CheckResponse(ctx context.Context, rc *RequestContext, rsp *ResponseContent) (Decision, error) {
+	leak := g.cfg.Leak
+	if leak.Action == "off" || rsp.Delta == "" {
+		return Decision{}, nil
+	}
+	_, prompt := apiKeys.requestDefaults(rc.KeyID)
+	if prompt == "" {
+		return Decision{}, nil
+	}
+	minLength := min(leak.MinLength, len(prompt))
+	prior := len(rsp.Text) - len(rsp.Delta)
+	from := max(0, prior-minLength+1)
+	var spans [][2]int
+	for _, s := range leakSpans(rsp.Text[from:], prompt, minLength) {
+		if from+s[1] > prior {
+			spans = append(spans, [2]int{max(from+s[0], prior) - prior, from + s[1] - prior})
+		}
+	}
+	if len(spans) == 0 {
+		return Decision{}, nil
+	}
+	if injectionBypassAllowed(rc.KeyID) {
+		auditInjection("leak_bypass", rc, []string{"system_prompt_leak"})
+		return Decision{}, nil
+	}
+	if leak.Action == DecisionBlock {
+		auditInjection("leak_block", rc, []string{"system_prompt_leak"})
+		return Decision{Action: DecisionBlock, Code: "system_prompt_leak", Message: "The response was withheld because it repeated the gateway's instructions"}, nil
+	}
+	auditInjection("leak_redact", rc, []string{"system_prompt_leak"})
+	var b strings.Builder
+	at := 0
+	for _, s := range spans {
+		if s[0] < at {
+			s[0] = at
+		}
+		if s[0] < s[1] {
+			b.WriteString(rsp.Delta[at:s[0]])
+			b.WriteString(redactedSecret)
+			at = s[1]
+		}
+	}
+	b.WriteString(rsp.Delta[at:])
+	return Decision{Action: DecisionMutate, Content: b.String()}, nil
+}
+
+// leakSpans finds where text copies at least minLength bytes of prompt
+// verbatim, sorted by start. Any such copy contains one of the prompt's
+// chunks of (minLength+1)/2 bytes, at a multiple of that, so each chunk
+// found in text is grown both ways for as long as text and prompt agree.
+func leakSpans(text, prompt string, minLength int) [][2]int {
+	size := (minLength + 1) / 2
+	var spans [][2]int
+	for at := 0; at+size <= len(prompt); at += size {
+		chunk := prompt[at : at+size]
+		for i := 0; ; {
+			j := strings.Index(text[i:], chunk)
+			if j < 0 {
+				break
+			}
+			start, end := i+j, i+j+size
+			p, q := at, at+size
+			for start > 0 && p > 0 && text[start-1] == prompt[p-1] {
+				start, p = start-1, p-1
+			}
+			for end < len(text) && q < len(prompt) && text[end] == prompt[q] {
+				end, q = end+1, q+1
+			}
+			if end-start >= minLength {
+				spans = append(spans, [2]int{start, end})
+			}
+			i = i + j + 1
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+	return spans
+}
+
+// injectionBypassAllowed reports whether keyID's requests get through the
+// injection guardrail: it is listed in INJECTION_BYPASS_KEYS or is a stored
+// key with bypass_injection_guard.
+func injectionBypassAllowed(keyID string) bool {
+	for _, k := range strings.Split(os.Getenv("INJECTION_BYPASS_KEYS"), ",") {
+		if k = strings.TrimSpace(k); k != "" && k == keyID {
+			return true
+		}
+	}
+	return apiKeys.keyAllows(keyID, func(k *APIKey) bool { return k.BypassInjectionGuard })
+}
+
+// auditInjection logs one of the guardrail's decisions with the names of
+// the heuristics that matched; message content is never logged.
+func auditInjection(decision string, rc *RequestContext, matched []string) {
+	log.Printf("audit action=guardrail.injection decision=%s key=%q request=%s matched=%q",
+		decision, rc.KeyID, rc.RequestID, strings.Join(matched, ","))
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJournalQueue         = 10000
+	defaultJournalFsyncInterval = time.Second
+	defaultJournalMaxBytes      = 64 << 20
+	journalCheckpointFile       = "checkpoint"
+)
+
+var (
+	journalDropped     = expvar.NewInt("gateway_journal_dropped_total")
+	journalWriteErrors = expvar.NewInt("gateway_journal_write_errors_total")
+)
+
+// journal is nil unless REQUEST_JOURNAL_DIR is set.
+var journal *requestJournal
+
+// journalRecord is one finished request as the journal keeps it. It never
+// carries message content.
+type journalRecord struct {
+	Seq        int64     `json:"seq"`
+	RequestID  string    `json:"request_id"`
+	KeyID      string    `json:"key,omitempty"`
+	Model      string    `json:"model,omitempty"`
+	Experiment string    `json:"experiment,omitempty"`
+	Variant    string    `json:"variant,omitempty"`
+	Status     int       `json:"status"`
+	Usage      *Usage    `json:"usage,omitempty"`
+	CostUSD    float64   `json:"cost_usd,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+type journalEntry struct {
+	seq  int64
+	line []byte
+}
+
+// requestJournal is a write-ahead log of finished chat completions, so
+// usage aggregated in memory survives a crash. Records are appended to
+// journal-<first seq>.jsonl files in dir by a single writer goroutine,
+// fsynced every fsyncInterval and rotated at maxBytes. The checkpoint file
+// holds the newest record the usage export has safely on disk; on startup
+// the records after it are replayed into the usage export.
+type requestJournal struct {
+	dir           string
+	fsyncInterval time.Duration
+	maxBytes      int64
+
+	// mu orders sequence numbers with the usage export's aggregation, so a
+	// checkpoint covers every record up to it
+	mu       sync.Mutex
+	seq      int64
+	queue    chan journalEntry
+	closed   bool
+	accepted int64
+	synced   int64
+
+	file      *os.File
+	buf       *bufio.Writer
+	size      int64
+	unsynced  int64
+	lastFsync time.Time
+	done      chan struct{}
+
+	checkpointMu  sync.Mutex
+	checkpointSeq int64
+}
+
+// loadRequestJournal reads REQUEST_JOURNAL_DIR, REQUEST_JOURNAL_QUEUE_SIZE,
+// REQUEST_JOURNAL_FSYNC_INTERVAL and REQUEST_JOURNAL_MAX_BYTES, replays
+// unaggregated records into the usage export and starts the writer. It
+// returns nil when the journal is off. Call it after loadUsageExport.
+func loadRequestJournal() (*requestJournal, error) {
+	dir := os.Getenv("REQUEST_JOURNAL_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+	queueSize, err := envInt("REQUEST_JOURNAL_QUEUE_SIZE")
+	if err != nil {
+		return nil, err
+	}
+	if queueSize == 0 {
+		queueSize = defaultJournalQueue
+	}
+	maxBytes, err := envInt("REQUEST_JOURNAL_MAX_BYTES")
+	if err != nil {
+		return nil, err
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultJournalMaxBytes
+	}
+	j := &requestJournal{
+		dir:           dir,
+		fsyncInterval: envDuration("REQUEST_JOURNAL_FSYNC_INTERVAL", defaultJournalFsyncInterval),
+		maxBytes:      int64(maxBytes),
+		queue:         make(chan journalEntry, queueSize),
+		done:          make(chan struct{}),
+	}
+	if j.fsyncInterval <= 0 {
+		return nil, fmt.Errorf("invalid REQUEST_JOURNAL_FSYNC_INTERVAL: must be positive")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := j.replay(); err != nil {
+		return nil, fmt.Errorf("replaying request journal: %w", err)
+	}
+	go j.run()
+	return j, nil
+}
+
+// journalFiles lists the journal's files oldest first, with the sequence
+// number each starts at.
+func (j *requestJournal) journalFiles() ([]string, []int64, error) {
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var names []string
+	var firsts []int64
+	for _, e := range entries {
+		name := e.Name()
+		digits, ok := strings.CutPrefix(name, "journal-")
+		digits, isJSONL := strings.CutSuffix(digits, ".jsonl")
+		first, err := strconv.ParseInt(digits, 10, 64)
+		if !ok || !isJSONL || err != nil {
+			continue
+		}
+		names = append(names, name)
+		firsts = append(firsts, first)
+	}
+	sort.Sort(byFirstSeq{names, firsts})
+	return names, firsts, nil
+}
+
+type byFirstSeq struct {
+	names  []string
+	firsts []int64
+}
+
+func (s byFirstSeq) Len() int           { return len(s.names) }
+func (s byFirstSeq) Less(i, j int) bool { return s.firsts[i] < s.firsts[j] }
+func (s byFirstSeq) Swap(i, j int) {
+	s.names[i], s.names[j] = s.names[j], s.names[i]
+	s.firsts[i], s.firsts[j] = s.firsts[j], s.firsts[i]
+}
+
+// replay adds every record after the checkpoint to the usage export and
+// flushes it, and finds the newest sequence number to carry on from.
+func (j *requestJournal) replay() error {
+	data, err := os.ReadFile(filepath.Join(j.dir, journalCheckpointFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if j.checkpointSeq, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return fmt.Errorf("invalid checkpoint: %w", err)
+		}
+	}
+	j.seq = j.checkpointSeq
+
+	names, firsts, err := j.journalFiles()
+	if err != nil {
+		return err
+	}
+	replayed := 0
+	for i, name := range names {
+		if i+1 < len(names) && (firsts[i+1] <= j.checkpointSeq+1 || usageExport == nil) {
+			// Nothing in it to replay, and a later file has a newer seq
+			continue
+		}
+		n, err := j.replayFile(name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		replayed += n
+	}
+	if replayed > 0 {
+		log.Printf("Replayed %d request journal records after checkpoint %d into usage export", replayed, j.checkpointSeq)
+		if seq, ok := usageExport.write(); ok {
+			j.checkpoint(seq)
+		}
+	}
+	return nil
+}
+
+// replayFile replays one file's records after the checkpoint. A line that
+// doesn't decode was torn by a crash and ends the file.
+func (j *requestJournal) replayFile(name string) (int, error) {
+	f, err := os.Open(filepath.Join(j.dir, name))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	replayed := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var rec journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Printf("Request journal %s ends in a partial record after seq %d; ignoring it", name, j.seq)
+			break
+		}
+		j.seq = max(j.seq, rec.Seq)
+		if rec.Seq <= j.checkpointSeq || rec.Usage == nil || usageExport == nil {
+			continue
+		}
+		day := rec.FinishedAt.UTC().Format(usageDateLayout)
+		if err := usageExport.resumeDay(day); err != nil {
+			return replayed, err
+		}
+		usageExport.add(day, rec.KeyID, rec.Model, rec.Usage, rec.CostUSD, rec.Seq)
+		replayed++
+	}
+	return replayed, scanner.Err()
+}
+
+// recordUsage journals a finished chat completion and adds its usage to the
+// usage export.
+func recordUsage(rec *requestRecord, status int, start time.Time) {
+	if rec.DryRun {
+		return
+	}
+	if journal == nil {
+		usageExport.record(rec, 0)
+		return
+	}
+	journal.append(rec, status, start)
+}
+
+// append queues rec for the writer without blocking. Records that don't
+// fit in the queue are dropped and counted; their usage is still
+// aggregated.
+func (j *requestJournal) append(rec *requestRecord, status int, start time.Time) {
+	jr := journalRecord{
+		RequestID:  rec.RequestID,
+		KeyID:      rec.KeyID,
+		Model:      rec.Model,
+		Experiment: rec.Experiment,
+		Variant:    rec.Variant,
+		Status:     status,
+		Usage:      rec.Usage,
+		StartedAt:  start.UTC(),
+		FinishedAt: time.Now().UTC(),
+	}
+	if rec.Usage != nil {
+		jr.CostUSD = usageCost(rec.Model, rec.Usage)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seq++
+	jr.Seq = j.seq
+	usageExport.record(rec, jr.Seq)
+	if j.closed {
+		journalDropped.Add(1)
+		return
+	}
+	line, err := json.Marshal(jr)
+	if err != nil {
+		log.Printf("Error encoding request journal record: %v", err)
+		return
+	}
+	select {
+	case j.queue <- journalEntry{jr.Seq, append(line, '\n')}:
+		j.accepted++
+	default:
+		journalDropped.Add(1)
+	}
+}
+
+// run writes queued records and fsyncs them every fsyncInterval.
+func (j *requestJournal) run() {
+	ticker := time.NewTicker(j.fsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-j.queue:
+			if !ok {
+				j.sync()
+				if j.file != nil {
+					j.file.Close()
+				}
+				close(j.done)
+				return
+			}
+			j.write(e)
+		case <-ticker.C:
+			j.sync()
+		}
+	}
+}
+
+func (j *requestJournal) write(e journalEntry) {
+	if j.buf != nil && j.size > 0 && j.size+int64(len(e.line)) > j.maxBytes {
+		j.sync()
+		j.file.Close()
+		j.file, j.buf = nil, nil
+	}
+	if j.buf == nil {
+		// The first record since starting or rotating. Each start gets a
+		// new file, so nothing is appended after a record torn by a crash.
+		if err := j.openFile(e.seq); err != nil {
+			log.Printf("Opening request journal file failed: %v", err)
+			journalWriteErrors.Add(1)
+			return
+		}
+	}
+	n, err := j.buf.Write(e.line)
+	j.size += int64(n)
+	if err != nil {
+		log.Printf("Writing request journal failed: %v", err)
+		journalWriteErrors.Add(1)
+		return
+	}
+	j.unsynced++
+}
+
+// openFile starts a new journal file at sequence number first.
+func (j *requestJournal) openFile(first int64) error {
+	f, err := os.OpenFile(filepath.Join(j.dir, fmt.Sprintf("journal-%020d.jsonl", first)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	j.file, j.buf, j.size = f, bufio.NewWriter(f), 0
+	return nil
+}
+
+// sync writes out buffered records and fsyncs the file.
+func (j *requestJournal) sync() {
+	if j.buf == nil || j.unsynced == 0 {
+		return
+	}
+	err := j.buf.Flush()
+	if err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		log.Printf("Syncing request journal failed: %v", err)
+		journalWriteErrors.Add(1)
+		return
+	}
+	j.mu.Lock()
+	j.synced += j.unsynced
+	j.lastFsync = time.Now()
+	j.mu.Unlock()
+	j.unsynced = 0
+}
+
+// close writes and fsyncs every queued record. Records finished after it
+// are dropped.
+func (j *requestJournal) close() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	if !j.closed {
+		j.closed = true
+		close(j.queue)
+	}
+	j.mu.Unlock()
+	<-j.done
+}
+
+// checkpoint records that the usage export has every record up to seq on
+// disk, so a restart replays only the ones after it.
+func (j *requestJournal) checkpoint(seq int64) {
+	if j == nil {
+		return
+	}
+	j.checkpointMu.Lock()
+	defer j.checkpointMu.Unlock()
+	if seq <= j.checkpointSeq {
+		return
+	}
+	if err := writeFileAtomic(filepath.Join(j.dir, journalCheckpointFile), []byte(strconv.FormatInt(seq, 10)+"\n")); err != nil {
+		log.Printf("Writing request journal checkpoint failed: %v", err)
+		return
+	}
+	j.checkpointSeq = seq
+}
+
+type journalStatus struct {
+	Dir           string `json:"dir"`
+	QueueDepth    int    `json:"queue_depth"`
+	QueueCapacity int    `json:"queue_capacity"`
+	// LagRecords counts records accepted but not yet fsynced
+	LagRecords int64      `json:"lag_records"`
+	LastSeq    int64      `json:"last_seq"`
+	LastFsync  *time.Time `json:"last_fsync,omitempty"`
+	// LastFsyncAgeSeconds is how long ago the last fsync was
+	LastFsyncAgeSeconds *float64 `json:"last_fsync_age_seconds,omitempty"`
+	// CheckpointSeq is the newest record the usage export has on disk
+	CheckpointSeq int64 `json:"checkpoint_seq"`
+	Dropped       int64 `json:"dropped"`
+	WriteErrors   int64 `json:"write_errors"`
+}
+
+// requireJournal returns 404 for the journal endpoint when the journal is
+// not configured.
+func requireJournal(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if journal == nil {
+			writeJSONError(w, http.StatusNotFound, "invalid_request_error", "not_found", "The request journal is not enabled on this gateway")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// journalAdminHandler implements GET /admin/journal: how far the journal's
+// writer lags behind finished requests, when it last fsynced, and how far
+// its records are aggregated.
+func journalAdminHandler(w http.ResponseWriter, r *http.Request) {
+	j := journal
+	st := journalStatus{
+		Dir:           j.dir,
+		QueueDepth:    len(j.queue),
+		QueueCapacity: cap(j.queue),
+		Dropped:       journalDropped.Value(),
+		WriteErrors:   journalWriteErrors.Value(),
+	}
+	j.mu.Lock()
+	st.LagRecords, st.LastSeq = j.accepted-j.synced, j.seq
+	if !j.lastFsync.IsZero() {
+		t := j.lastFsync.UTC()
+		age := roundSeconds(time.Since(t).Seconds())
+		st.LastFsync, st.LastFsyncAgeSeconds = &t, &age
+	}
+	j.mu.Unlock()
+	j.checkpointMu.Lock()
+	st.CheckpointSeq = j.checkpointSeq
+	j.checkpointMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kafka API keys and the versions used, all supported by brokers since
+// Kafka 2.0.
+const (
+	kafkaProduce          = 0
+	kafkaMetadata         = 3
+	kafkaSASLHandshake    = 17
+	kafkaSASLAuthenticate = 36
+
+	kafkaProduceVersion          = 3
+	kafkaMetadataVersion         = 4
+	kafkaSASLHandshakeVersion    = 1
+	kafkaSASLAuthenticateVersion = 1
+)
+
+const (
+	kafkaClientID = "ai_inference_gateway"
+	// kafkaMaxResponse bounds the responses read from a broker
+	kafkaMaxResponse = 16 << 20
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaError is an error code returned by a broker.
+type kafkaError int16
+
+// kafkaErrorNames are the codes publishing is likely to run into.
+var kafkaErrorNames = map[kafkaError]string{
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_OR_FOLLOWER",
+	7:  "REQUEST_TIMED_OUT",
+	10: "MESSAGE_TOO_LARGE",
+	19: "NOT_ENOUGH_REPLICAS",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+	33: "UNSUPPORTED_SASL_MECHANISM",
+	34: "ILLEGAL_SASL_STATE",
+	58: "SASL_AUTHENTICATION_FAILED",
+}
+
+func (e kafkaError) Error() string {
+	if name, ok := kafkaErrorNames[e]; ok {
+		return "kafka " + name
+	}
+	return fmt.Sprintf("kafka error %d", int16(e))
+}
+
+// kafkaPublisher produces events to one topic, a batch to each partition
+// in turn. It speaks just enough of the Kafka protocol for that: Metadata,
+// Produce with uncompressed record batches acknowledged by every in-sync
+// replica, and SASL PLAIN and SCRAM authentication.
+type kafkaPublisher struct {
+	brokers []string
+	topic   string
+	tls     *tls.Config
+	sasl    *kafkaSASL
+	dialer  net.Dialer
+
+	// Owned by the publishing goroutine
+	conns      map[string]*kafkaConn
+	partitions []kafkaPartition
+	next       int
+}
+
+type kafkaSASL struct {
+	mechanism string
+	username  string
+	password  string
+}
+
+// kafkaPartition is a partition of the topic and its leader's address.
+type kafkaPartition struct {
+	id     int32
+	leader string
+}
+
+// loadKafkaPublisher reads KAFKA_BROKERS (comma-separated host:port),
+// KAFKA_TOPIC, KAFKA_TLS, KAFKA_TLS_CA, KAFKA_SASL_MECHANISM,
+// KAFKA_SASL_USERNAME and KAFKA_SASL_PASSWORD.
+func loadKafkaPublisher() (eventPublisher, error) {
+	p := &kafkaPublisher{
+		topic:  os.Getenv("KAFKA_TOPIC"),
+		dialer: net.Dialer{Timeout: eventPublishTimeout, KeepAlive: 30 * time.Second},
+		conns:  make(map[string]*kafkaConn),
+	}
+	for _, addr := range strings.Split(os.Getenv("KAFKA_BROKERS"), ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid KAFKA_BROKERS entry %q: want host:port", addr)
+		}
+		p.brokers = append(p.brokers, addr)
+	}
+	if len(p.brokers) == 0 {
+		return nil, errors.New("KAFKA_BROKERS must list at least one broker")
+	}
+	if p.topic == "" {
+		return nil, errors.New("KAFKA_TOPIC must be set")
+	}
+
+	ca := os.Getenv("KAFKA_TLS_CA")
+	if os.Getenv("KAFKA_TLS") == "true" || ca != "" {
+		p.tls = &tls.Config{MinVersion: tls.VersionTLS12}
+		if ca != "" {
+			pem, err := os.ReadFile(ca)
+			if err != nil {
+				return nil, fmt.Errorf("KAFKA_TLS_CA: %w", err)
+			}
+			p.tls.RootCAs = x509.NewCertPool()
+			if !p.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("KAFKA_TLS_CA: no certificates in %s", ca)
+			}
+		}
+	}
+
+	switch mechanism := os.Getenv("KAFKA_SASL_MECHANISM"); mechanism {
+	case "":
+	case "PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512":
+		password, err := resolveSecret(os.Getenv("KAFKA_SASL_PASSWORD"))
+		if err != nil {
+			return nil, fmt.Errorf("KAFKA_SASL_PASSWORD: %w", err)
+		}
+		p.sasl = &kafkaSASL{mechanism: mechanism, username: os.Getenv("KAFKA_SASL_USERNAME"), password: password}
+		if p.sasl.username == "" {
+			return nil, fmt.Errorf("KAFKA_SASL_USERNAME must be set for %s", mechanism)
+		}
+		if mechanism == "PLAIN" && p.tls == nil {
+			log.Printf("KAFKA_SASL_MECHANISM is PLAIN without KAFKA_TLS; the password is sent in the clear")
+		}
+	default:
+		return nil, fmt.Errorf("unknown KAFKA_SASL_MECHANISM %q: want PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512", mechanism)
+	}
+	return p, nil
+}
+
+// publish produces batch to the next partition. After any failure the
+// leaders are looked up afresh, as one may have moved.
+func (p *kafkaPublisher) publish(ctx context.Context, batch [][]byte) error {
+	if len(p.partitions) == 0 {
+		if err := p.refreshMetadata(ctx); err != nil {
+			return err
+		}
+	}
+	part := p.partitions[p.next%len(p.partitions)]
+	p.next++
+	c, err := p.conn(ctx, part.leader)
+	if err == nil {
+		err = c.produce(ctx, p.topic, part.id, kafkaRecordBatch(batch, time.Now()))
+	}
+	if err != nil {
+		if errors.As(err, new(kafkaError)) {
+			err = fmt.Errorf("partition %d: %w", part.id, err)
+		} else {
+			p.drop(part.leader)
+		}
+		p.partitions = nil
+		return err
+	}
+	return nil
+}
+
+// refreshMetadata looks up the topic's partition leaders from the first
+// bootstrap broker that answers.
+func (p *kafkaPublisher) refreshMetadata(ctx context.Context) error {
+	var lastErr error
+	for _, addr := range p.brokers {
+		c, err := p.conn(ctx, addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		partitions, err := c.metadata(ctx, p.topic)
+		if err != nil {
+			if !errors.As(err, new(kafkaError)) {
+				p.drop(addr)
+			}
+			lastErr = fmt.Errorf("metadata from %s: %w", addr, err)
+			continue
+		}
+		p.partitions = partitions
+		return nil
+	}
+	return lastErr
+}
+
+// conn returns the open connection to addr, dialing and authenticating a
+// new one when there is none.
+func (p *kafkaPublisher) conn(ctx context.Context, addr string) (*kafkaConn, error) {
+	if c, ok := p.conns[addr]; ok {
+		return c, nil
+	}
+	nc, err := p.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if p.tls != nil {
+		cfg := p.tls.Clone()
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		tc := tls.Client(nc, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("TLS handshake with %s: %w", addr, err)
+		}
+		nc = tc
+	}
+	c := &kafkaConn{Conn: nc, r: bufio.NewReader(nc)}
+	if p.sasl != nil {
+		if err := c.authenticate(ctx, p.sasl); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("SASL %s with %s: %w", p.sasl.mechanism, addr, err)
+		}
+	}
+	p.conns[addr] = c
+	return c, nil
+}
+
+func (p *kafkaPublisher) drop(addr string) {
+	if c, ok := p.conns[addr]; ok {
+		c.Close()
+		delete(p.conns, addr)
+	}
+}
+
+func (p *kafkaPublisher) close() {
+	for addr := range p.conns {
+		p.drop(addr)
+	}
+}
+
+// kafkaConn is a connection to one broker.
+type kafkaConn struct {
+	net.Conn
+	r           *bufio.Reader
+	correlation int32
+}
+
+// roundTrip sends one request and returns a reader over its response body.
+func (c *kafkaConn) roundTrip(ctx context.Context, apiKey, version int16, body []byte) (*kafkaReader, error) {
+	deadline, _ := ctx.Deadline()
+	c.SetDeadline(deadline)
+	c.correlation++
+
+	var w kafkaWriter
+	w.int32(0) // size, set below
+	w.int16(apiKey)
+	w.int16(version)
+	w.int32(c.correlation)
+	w.string(kafkaClientID)
+	w.b = append(w.b, body...)
+	binary.BigEndian.PutUint32(w.b, uint32(len(w.b)-4))
+	if _, err := c.Write(w.b); err != nil {
+		return nil, err
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(c.r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > kafkaMaxResponse {
+		return nil, fmt.Errorf("invalid response size %d", n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(c.r, resp); err != nil {
+		return nil, err
+	}
+	r := &kafkaReader{b: resp}
+	if id := r.int32(); id != c.correlation {
+		return nil, fmt.Errorf("response to request %d, want %d", id, c.correlation)
+	}
+	return r, nil
+}
+
+// metadata returns the topic's partitions that have a leader.
+func (c *kafkaConn) metadata(ctx context.Context, topic string) ([]kafkaPartition, error) {
+	var w kafkaWriter
+	w.int32(1)
+	w.string(topic)
+	w.int8(0) // don't create the topic
+	r, err := c.roundTrip(ctx, kafkaMetadata, kafkaMetadataVersion, w.b)
+	if err != nil {
+		return nil, err
+	}
+
+	r.int32() // throttle time
+	brokers := make(map[int32]string)
+	for range r.arrayLen() {
+		node := r.int32()
+		host := r.string()
+		port := r.int32()
+		r.string() // rack
+		brokers[node] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.string() // cluster ID
+	r.int32()  // controller
+	var partitions []kafkaPartition
+	var topicErr kafkaError
+	for range r.arrayLen() {
+		code := kafkaError(r.int16())
+		name := r.string()
+		r.int8() // internal
+		for range r.arrayLen() {
+			r.int16() // partition error: a partition without a leader is skipped
+			id := r.int32()
+			leader := r.int32()
+			r.skipInt32s() // replicas
+			r.skipInt32s() // in-sync replicas
+			if addr, ok := brokers[leader]; ok && name == topic {
+				partitions = append(partitions, kafkaPartition{id: id, leader: addr})
+			}
+		}
+		if name == topic {
+			topicErr = code
+		}
+	}
+	switch {
+	case r.err != nil:
+		return nil, r.err
+	case topicErr != 0:
+		return nil, fmt.Errorf("topic %q: %w", topic, topicErr)
+	case len(partitions) == 0:
+		return nil, fmt.Errorf("topic %q has no partition with a leader", topic)
+	}
+	return partitions, nil
+}
+
+// produce writes a record batch to a partition the broker leads.
+func (c *kafkaConn) produce(ctx context.Context, topic string, partition int32, records []byte) error {
+	timeout := eventPublishTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	var w kafkaWriter
+	w.int16(-1) // no transactional ID
+	w.int16(-1) // acks from every in-sync replica
+	w.int32(int32(timeout.Milliseconds()))
+	w.int32(1)
+	w.string(topic)
+	w.int32(1)
+	w.int32(partition)
+	w.bytes(records)
+	r, err := c.roundTrip(ctx, kafkaProduce, kafkaProduceVersion, w.b)
+	if err != nil {
+		return err
+	}
+
+	for range r.arrayLen() {
+		r.string() // topic
+		for range r.arrayLen() {
+			r.int32() // partition
+			if code := kafkaError(r.int16()); code != 0 && r.err == nil {
+				return code
+			}
+			r.int64() // base offset
+			r.int64() // log append time
+		}
+	}
+	return r.err
+}
+
+// authenticate runs the SASL exchange for s's mechanism.
+func (c *kafkaConn) authenticate(ctx context.Context, s *kafkaSASL) error {
+	var w kafkaWriter
+	w.string(s.mechanism)
+	r, err := c.roundTrip(ctx, kafkaSASLHandshake, kafkaSASLHandshakeVersion, w.b)
+	if err != nil {
+		return err
+	}
+	if code := kafkaError(r.int16()); code != 0 {
+		return code
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	if s.mechanism == "PLAIN" {
+		_, err := c.saslAuthenticate(ctx, []byte("\x00"+s.username+"\x00"+s.password))
+		return err
+	}
+	newHash := sha256.New
+	if s.mechanism == "SCRAM-SHA-512" {
+		newHash = sha512.New
+	}
+	scram, first, err := newSCRAM(newHash, s.username, s.password)
+	if err != nil {
+		return err
+	}
+	serverFirst, err := c.saslAuthenticate(ctx, first)
+	if err != nil {
+		return err
+	}
+	final, err := scram.final(serverFirst)
+	if err != nil {
+		return err
+	}
+	serverFinal, err := c.saslAuthenticate(ctx, final)
+	if err != nil {
+		return err
+	}
+	return scram.verify(serverFinal)
+}
+
+// saslAuthenticate sends one SASL message and returns the broker's reply.
+func (c *kafkaConn) saslAuthenticate(ctx context.Context, message []byte) ([]byte, error) {
+	var w kafkaWriter
+	w.bytes(message)
+	r, err := c.roundTrip(ctx, kafkaSASLAuthenticate, kafkaSASLAuthenticateVersion, w.b)
+	if err != nil {
+		return nil, err
+	}
+	code := kafkaError(r.int16())
+	msg := r.string()
+	reply := r.bytesField()
+	r.int64() // session lifetime
+	switch {
+	case r.err != nil:
+		return nil, r.err
+	case code != 0 && msg != "":
+		return nil, fmt.Errorf("%w: %s", code, msg)
+	case code != 0:
+		return nil, code
+	}
+	return reply, nil
+}
+
+// scramClient is the client side of a SCRAM exchange (RFC 5802), without
+// channel binding.
+type scramClient struct {
+	newHash   func() hash.Hash
+	password  string
+	nonce     string
+	firstBare string
+
+	serverSignature []byte
+}
+
+// newSCRAM returns a SCRAM exchange and its client-first message.
+func newSCRAM(newHash func() hash.Hash, username, password string) (*scramClient, []byte, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	s := &scramClient{newHash: newHash, password: password, nonce: base64.RawStdEncoding.EncodeToString(nonce)}
+	username = strings.NewReplacer("=", "=3D", ",", "=2C").Replace(username)
+	s.firstBare = "n=" + username + ",r=" + s.nonce
+	return s, []byte("n,," + s.firstBare), nil
+}
+
+// final answers the server-first message with the client's proof.
+func (s *scramClient) final(serverFirst []byte) ([]byte, error) {
+	attrs := scramAttrs(string(serverFirst))
+	if e, ok := attrs["e"]; ok {
+		return nil, fmt.Errorf("SCRAM: %s", e)
+	}
+	nonce := attrs["r"]
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	iterations, iterErr := strconv.Atoi(attrs["i"])
+	if !strings.HasPrefix(nonce, s.nonce) || err != nil || iterErr != nil || iterations <= 0 {
+		return nil, errors.New("SCRAM: invalid server-first message")
+	}
+
+	salted, err := pbkdf2.Key(s.newHash, s.password, salt, iterations, s.newHash().Size())
+	if err != nil {
+		return nil, err
+	}
+	clientKey := s.hmac(salted, "Client Key")
+	h := s.newHash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := s.firstBare + "," + string(serverFirst) + "," + withoutProof
+	proof := s.hmac(storedKey, authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	s.serverSignature = s.hmac(s.hmac(salted, "Server Key"), authMessage)
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verify checks the server-final message proves the server knows the
+// password too.
+func (s *scramClient) verify(serverFinal []byte) error {
+	attrs := scramAttrs(string(serverFinal))
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("SCRAM: %s", e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || !hmac.Equal(signature, s.serverSignature) {
+		return errors.New("SCRAM: invalid server signature")
+	}
+	return nil
+}
+
+func (s *scramClient) hmac(key []byte, message string) []byte {
+	mac := hmac.New(s.newHash, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// scramAttrs parses a SCRAM message's comma-separated k=v attributes.
+func scramAttrs(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(msg, ",") {
+		if k, v, ok := strings.Cut(attr, "="); ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+// kafkaRecordBatch encodes values as an uncompressed, keyless record batch
+// (magic 2), timestamped now.
+func kafkaRecordBatch(values [][]byte, now time.Time) []byte {
+	var records []byte
+	for i, v := range values {
+		var rec []byte
+		rec = append(rec, 0)                     // attributes
+		rec = binary.AppendVarint(rec, 0)        // timestamp delta
+		rec = binary.AppendVarint(rec, int64(i)) // offset delta
+		rec = binary.AppendVarint(rec, -1)       // no key
+		rec = binary.AppendVarint(rec, int64(len(v)))
+		rec = append(rec, v...)
+		rec = binary.AppendVarint(rec, 0) // headers
+		records = binary.AppendVarint(records, int64(len(rec)))
+		records = append(records, rec...)
+	}
+
+	// The part of the batch its CRC covers
+	var w kafkaWriter
+	w.int16(0) // attributes: no compression
+	w.int32(int32(len(values) - 1))
+	w.int64(now.UnixMilli())
+	w.int64(now.UnixMilli())
+	w.int64(-1) // producer ID
+	w.int16(-1) // producer epoch
+	w.int32(-1) // base sequence
+	w.int32(int32(len(values)))
+	w.b = append(w.b, records...)
+
+	var batch kafkaWriter
+	batch.int64(0)                           // base offset
+	batch.int32(int32(4 + 1 + 4 + len(w.b))) // length of what follows
+	batch.int32(-1)                          // partition leader epoch
+	batch.int8(2)                            // magic
+	batch.int32(int32(crc32.Checksum(w.b, castagnoli)))
+	return append(batch.b, w.b...)
+}
+
+// kafkaWriter encodes the fixed-width, big-endian fields of Kafka requests.
+type kafkaWriter struct {
+	b []byte
+}
+
+func (w *kafkaWriter) int8(v int8)   { w.b = append(w.b, byte(v)) }
+func (w *kafkaWriter) int16(v int16) { w.b = binary.BigEndian.AppendUint16(w.b, uint16(v)) }
+func (w *kafkaWriter) int32(v int32) { w.b = binary.BigEndian.AppendUint32(w.b, uint32(v)) }
+func (w *kafkaWriter) int64(v int64) { w.b = binary.BigEndian.AppendUint64(w.b, uint64(v)) }
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.b = append(w.b, s...)
+}
+
+func (w *kafkaWriter) bytes(b []byte) {
+	w.int32(int32(len(b)))
+	w.b = append(w.b, b...)
+}
+
+// kafkaReader decodes Kafka responses. The first short read sets err, and
+// every read after it returns zero values.
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.b) {
+		r.err = errors.New("truncated kafka response")
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *kafkaReader) int8() int8 {
+	if b := r.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int64() int64 {
+	if b := r.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a string, or a null one as "".
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.take(int(n)))
+}
+
+func (r *kafkaReader) bytesField() []byte {
+	n := r.int32()
+	if n < 0 {
+		return nil
+	}
+	return r.take(int(n))
+}
+
+// arrayLen reads an array's length, or 0 for a null array. A length longer
+// than the rest of the response sets err.
+func (r *kafkaReader) arrayLen() int {
+	n := int(r.int32())
+	if n < 0 || r.err != nil {
+		return 0
+	}
+	if n > len(r.b) {
+		r.err = errors.New("truncated kafka response")
+		return 0
+	}
+	return n
+}
+
+func (r *kafkaReader) skipInt32s() {
+	r.take(4 * r.arrayLen())
+}
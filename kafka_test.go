@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// produceRequest is a Produce v3 request for the records "a" and "bc" to
+// partition 2 of topic events, as the Kafka protocol guide lays it out.
+var produceRequest = strings.Join([]string{
+	"0000008c",     // size
+	"0000", "0003", // Produce v3
+	"00000001",                                        // correlation ID
+	"0014", hex.EncodeToString([]byte(kafkaClientID)), // client ID
+	"ffff",     // no transactional ID
+	"ffff",     // acks: all
+	"00002710", // timeout: 10s
+	"00000001", "0006", hex.EncodeToString([]byte("events")),
+	"00000001", "00000002", // partition 2
+	"0000004e", // record batch size
+	// Record batch: base offset, length, leader epoch, magic, CRC-32C
+	"0000000000000000", "00000042", "ffffffff", "02", "af2b6054",
+	"0000",                                 // attributes
+	"00000001",                             // last offset delta
+	"0000018bcfe56800",                     // first timestamp
+	"0000018bcfe56800",                     // max timestamp
+	"ffffffffffffffff", "ffff", "ffffffff", // no producer ID, epoch, sequence
+	"00000002", // records
+	// Record: length 7, attributes, timestamp delta, offset delta, null
+	// key, value "a", no headers
+	"0e", "00", "00", "00", "01", "0261", "00",
+	"10", "00", "00", "02", "01", "046263", "00",
+}, "")
+
+func TestKafkaProduceRequestBytes(t *testing.T) {
+	broker, client := net.Pipe()
+	defer broker.Close()
+	c := &kafkaConn{Conn: client, r: bufio.NewReader(client)}
+
+	got := make(chan []byte, 1)
+	go func() {
+		req, _ := readKafkaFrame(broker)
+		got <- req
+		// partition 2 accepted at offset 7
+		var w kafkaWriter
+		w.int32(1)
+		w.int32(1)
+		w.string("events")
+		w.int32(1)
+		w.int32(2)
+		w.int16(0)
+		w.int64(7)
+		w.int64(-1)
+		w.int32(0)
+		writeKafkaFrame(broker, w.b)
+	}()
+	records := kafkaRecordBatch([][]byte{[]byte("a"), []byte("bc")}, time.UnixMilli(1_700_000_000_000))
+	if err := c.produce(context.Background(), "events", 2, records); err != nil {
+		t.Fatalf("produce = %v", err)
+	}
+	want, _ := hex.DecodeString(produceRequest)
+	if req := <-got; !bytes.Equal(req, want) {
+		t.Errorf("request =\n%x\nwant\n%x", req, want)
+	}
+}
+
+func TestKafkaRecordBatchRoundTrip(t *testing.T) {
+	values := [][]byte{[]byte(`{"type":"request.completed"}`), {}, bytes.Repeat([]byte("x"), 300)}
+	now := time.UnixMilli(1_700_000_000_123)
+	got, ts, err := decodeRecordBatch(kafkaRecordBatch(values, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ts.Equal(now) || len(got) != len(values) {
+		t.Fatalf("decoded %d records at %v, want %d at %v", len(got), ts, len(values), now)
+	}
+	for i := range values {
+		if !bytes.Equal(got[i], values[i]) {
+			t.Errorf("record %d = %q, want %q", i, got[i], values[i])
+		}
+	}
+
+	corrupt := kafkaRecordBatch(values, now)
+	corrupt[len(corrupt)-2] ^= 1
+	if _, _, err := decodeRecordBatch(corrupt); err == nil {
+		t.Error("corrupt batch passed its CRC")
+	}
+}
+
+func TestKafkaReaderStopsAtTruncation(t *testing.T) {
+	r := &kafkaReader{b: []byte{0, 0, 0, 9, 0}}
+	if n := r.arrayLen(); n != 0 || r.err == nil {
+		t.Errorf("arrayLen = %d, %v; want a truncation error", n, r.err)
+	}
+	if r.int32() != 0 || r.string() != "" {
+		t.Error("reads after the error returned values")
+	}
+}
+
+func TestKafkaPublisherRoundRobinsPartitions(t *testing.T) {
+	b := startFakeBroker(t, "events", 2)
+	p := b.publisher()
+	defer p.close()
+	for _, batch := range []string{"one", "two", "three"} {
+		if err := p.publish(context.Background(), [][]byte{[]byte(batch)}); err != nil {
+			t.Fatalf("publish %s = %v", batch, err)
+		}
+	}
+	if got := b.records(0); got != "one,three" {
+		t.Errorf("partition 0 has %q, want one,three", got)
+	}
+	if got := b.records(1); got != "two" {
+		t.Errorf("partition 1 has %q, want two", got)
+	}
+	if b.requests(kafkaMetadata) != 1 {
+		t.Errorf("metadata requested %d times, want once", b.requests(kafkaMetadata))
+	}
+}
+
+func TestKafkaPublisherRefreshesLeadersAfterError(t *testing.T) {
+	b := startFakeBroker(t, "events", 1)
+	p := b.publisher()
+	defer p.close()
+
+	b.setProduceError(6)
+	err := p.publish(context.Background(), [][]byte{[]byte("lost")})
+	if !errors.Is(err, kafkaError(6)) || !strings.Contains(err.Error(), "NOT_LEADER_OR_FOLLOWER") {
+		t.Fatalf("publish = %v, want NOT_LEADER_OR_FOLLOWER", err)
+	}
+	b.setProduceError(0)
+	if err := p.publish(context.Background(), [][]byte{[]byte("kept")}); err != nil {
+		t.Fatalf("publish after the error = %v", err)
+	}
+	if b.requests(kafkaMetadata) != 2 || b.records(0) != "kept" {
+		t.Errorf("metadata requests = %d, records %q; want 2 and kept", b.requests(kafkaMetadata), b.records(0))
+	}
+}
+
+func TestKafkaPublisherReconnectsAfterDroppedConnection(t *testing.T) {
+	b := startFakeBroker(t, "events", 1)
+	p := b.publisher()
+	defer p.close()
+	if err := p.publish(context.Background(), [][]byte{[]byte("first")}); err != nil {
+		t.Fatal(err)
+	}
+
+	b.dropConnections()
+	if err := p.publish(context.Background(), [][]byte{[]byte("lost")}); err == nil {
+		t.Fatal("publish over a dropped connection succeeded")
+	}
+	if len(p.conns) != 0 {
+		t.Errorf("dropped connection kept: %v", p.conns)
+	}
+	if err := p.publish(context.Background(), [][]byte{[]byte("second")}); err != nil {
+		t.Fatalf("publish after reconnecting = %v", err)
+	}
+	if got := b.records(0); got != "first,second" {
+		t.Errorf("records = %q, want first,second", got)
+	}
+}
+
+func TestKafkaPublisherFailsWhenBrokerDown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	p := &kafkaPublisher{brokers: []string{addr}, topic: "events", conns: map[string]*kafkaConn{}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.publish(ctx, [][]byte{[]byte("x")}); err == nil {
+		t.Error("publish to a stopped broker succeeded")
+	}
+}
+
+func TestKafkaPublisherRejectsUnknownTopic(t *testing.T) {
+	b := startFakeBroker(t, "events", 1)
+	p := b.publisher()
+	p.topic = "other"
+	defer p.close()
+	if err := p.publish(context.Background(), [][]byte{[]byte("x")}); !errors.Is(err, kafkaError(3)) {
+		t.Errorf("publish = %v, want UNKNOWN_TOPIC_OR_PARTITION", err)
+	}
+}
+
+// fakeBroker is a single Kafka broker leading every partition of one topic.
+// It answers Metadata v4 and Produce v3 and keeps the records produced.
+type fakeBroker struct {
+	ln         net.Listener
+	topic      string
+	partitions int32
+
+	mu         sync.Mutex
+	conns      []net.Conn
+	produced   map[int32][]string
+	counts     map[int16]int
+	produceErr kafkaError
+}
+
+func startFakeBroker(t *testing.T, topic string, partitions int32) *fakeBroker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{ln: ln, topic: topic, partitions: partitions, produced: map[int32][]string{}, counts: map[int16]int{}}
+	t.Cleanup(func() {
+		ln.Close()
+		b.dropConnections()
+	})
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.conns = append(b.conns, c)
+			b.mu.Unlock()
+			go b.serve(c)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) publisher() *kafkaPublisher {
+	return &kafkaPublisher{brokers: []string{b.ln.Addr().String()}, topic: b.topic, conns: map[string]*kafkaConn{}}
+}
+
+func (b *fakeBroker) serve(c net.Conn) {
+	defer c.Close()
+	for {
+		req, err := readKafkaFrame(c)
+		if err != nil {
+			return
+		}
+		r := &kafkaReader{b: req[4:]}
+		apiKey, version, correlation := r.int16(), r.int16(), r.int32()
+		r.string() // client ID
+
+		b.mu.Lock()
+		b.counts[apiKey]++
+		b.mu.Unlock()
+		var w kafkaWriter
+		w.int32(correlation)
+		switch {
+		case apiKey == kafkaMetadata && version == kafkaMetadataVersion:
+			b.metadata(r, &w)
+		case apiKey == kafkaProduce && version == kafkaProduceVersion:
+			if err := b.produce(r, &w); err != nil {
+				return
+			}
+		default:
+			return
+		}
+		if err := writeKafkaFrame(c, w.b); err != nil {
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) metadata(r *kafkaReader, w *kafkaWriter) {
+	host, port, _ := net.SplitHostPort(b.ln.Addr().String())
+	n, _ := strconv.Atoi(port)
+	w.int32(0) // throttle time
+	w.int32(1)
+	w.int32(1)
+	w.string(host)
+	w.int32(int32(n))
+	w.int16(-1) // rack
+	w.string("cluster")
+	w.int32(1) // controller
+
+	topics := r.arrayLen()
+	w.int32(int32(topics))
+	for range topics {
+		name := r.string()
+		if name != b.topic {
+			w.int16(3)
+			w.string(name)
+			w.int8(0)
+			w.int32(0)
+			continue
+		}
+		w.int16(0)
+		w.string(name)
+		w.int8(0)
+		w.int32(b.partitions)
+		for id := range b.partitions {
+			w.int16(0)
+			w.int32(id)
+			w.int32(1) // leader
+			w.int32(1)
+			w.int32(1) // replicas
+			w.int32(1)
+			w.int32(1) // in-sync replicas
+		}
+	}
+}
+
+func (b *fakeBroker) produce(r *kafkaReader, w *kafkaWriter) error {
+	r.string() // transactional ID
+	if acks := r.int16(); acks != -1 {
+		return fmt.Errorf("acks = %d, want -1", acks)
+	}
+	r.int32() // timeout
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	topics := r.arrayLen()
+	w.int32(int32(topics))
+	for range topics {
+		w.string(r.string())
+		partitions := r.arrayLen()
+		w.int32(int32(partitions))
+		for range partitions {
+			id := r.int32()
+			values, _, err := decodeRecordBatch(r.bytesField())
+			if err != nil {
+				return err
+			}
+			if b.produceErr == 0 {
+				for _, v := range values {
+					b.produced[id] = append(b.produced[id], string(v))
+				}
+			}
+			w.int32(id)
+			w.int16(int16(b.produceErr))
+			w.int64(int64(len(b.produced[id])))
+			w.int64(-1)
+		}
+	}
+	w.int32(0) // throttle time
+	return r.err
+}
+
+func (b *fakeBroker) records(partition int32) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Join(b.produced[partition], ",")
+}
+
+func (b *fakeBroker) requests(apiKey int16) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.counts[apiKey]
+}
+
+func (b *fakeBroker) setProduceError(code kafkaError) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.produceErr = code
+}
+
+func (b *fakeBroker) dropConnections() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.conns {
+		c.Close()
+	}
+	b.conns = nil
+}
+
+// readKafkaFrame reads one size-prefixed request or response, with its
+// size.
+func readKafkaFrame(r io.Reader) ([]byte, error) {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, 4+binary.BigEndian.Uint32(size))
+	copy(frame, size)
+	_, err := io.ReadFull(r, frame[4:])
+	return frame, err
+}
+
+func writeKafkaFrame(w io.Writer, b []byte) error {
+	_, err := w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(b))))
+	if err == nil {
+		_, err = w.Write(b)
+	}
+	return err
+}
+
+// decodeRecordBatch checks a magic 2 record batch's length and CRC and
+// returns its values and first timestamp.
+func decodeRecordBatch(batch []byte) ([][]byte, time.Time, error) {
+	r := &kafkaReader{b: batch}
+	r.int64() // base offset
+	length := r.int32()
+	r.int32() // leader epoch
+	magic := r.int8()
+	crc := uint32(r.int32())
+	if r.err != nil || magic != 2 || int(length) != len(batch)-12 {
+		return nil, time.Time{}, fmt.Errorf("invalid batch header: length %d of %d, magic %d", length, len(batch), magic)
+	}
+	if crc32.Checksum(r.b, castagnoli) != crc {
+		return nil, time.Time{}, errors.New("batch CRC mismatch")
+	}
+	r.int16() // attributes
+	r.int32() // last offset delta
+	ts := time.UnixMilli(r.int64())
+	r.int64()
+	r.int64()
+	r.int16()
+	r.int32()
+	count := r.int32()
+	if r.err != nil {
+		return nil, time.Time{}, r.err
+	}
+
+	rest := r.b
+	varint := func() int64 {
+		v, n := binary.Varint(rest)
+		if n <= 0 {
+			return -2
+		}
+		rest = rest[n:]
+		return v
+	}
+	values := make([][]byte, 0, count)
+	for range count {
+		if varint() < 0 { // record length
+			return nil, ts, errors.New("invalid record length")
+		}
+		rest = rest[1:] // attributes
+		varint()        // timestamp delta
+		varint()        // offset delta
+		if varint() != -1 {
+			return nil, ts, errors.New("record has a key")
+		}
+		n := varint()
+		if n < 0 || int(n) > len(rest) {
+			return nil, ts, errors.New("invalid value length")
+		}
+		values = append(values, rest[:n])
+		rest = rest[n:]
+		varint() // headers
+	}
+	return values, ts, nil
+}
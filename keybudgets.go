@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vinayhpandya/ai_inference_gateway/client"
+)
+
+const budgetFlushInterval = 10 * time.Second
+
+// budgetWarnings counts requests let through with BUDGET_PRECHECK=warn
+// whose estimate didn't fit their budget.
+var budgetWarnings = expvar.NewInt("gateway_budget_warnings_total")
+
+func validBudgetPeriod(p string) bool {
+	return p == "" || p == "month" || p == "day"
+}
+
+// budgetPeriod names the UTC period k's budget currently covers, such as
+// 2026-10 or 2026-10-14.
+func budgetPeriod(k *APIKey, now time.Time) string {
+	if k.BudgetPeriod == "day" {
+		return now.UTC().Format(usageDateLayout)
+	}
+	return now.UTC().Format("2006-01")
+}
+
+// keySpend is a key's token use in its current budget period. A parent's
+// spend includes its children's.
+type keySpend struct {
+	Period string `json:"period"`
+	Tokens int64  `json:"tokens"`
+
+	// reserved is held by requests still running
+	reserved int64
+}
+
+// budgetLedger tracks token use against key budgets. It is persisted next
+// to the key store (keys.json keeps its spend in keys.usage.json) every
+// budgetFlushInterval and at shutdown, so a restart loses at most that
+// much usage.
+type budgetLedger struct {
+	path string
+	now  func() time.Time
+
+	mu    sync.Mutex
+	spend map[string]*keySpend
+	dirty bool
+	// flushing serializes flushes so an older snapshot never lands last
+	flushing sync.Mutex
+}
+
+func loadBudgetLedger(storePath string) (*budgetLedger, error) {
+	if v := os.Getenv("BUDGET_PRECHECK"); v != "" && v != "reject" && v != "warn" {
+		return nil, fmt.Errorf("invalid BUDGET_PRECHECK %q: want reject or warn", v)
+	}
+	l := &budgetLedger{
+		path:  strings.TrimSuffix(storePath, filepath.Ext(storePath)) + ".usage.json",
+		now:   time.Now,
+		spend: make(map[string]*keySpend),
+	}
+	data, err := os.ReadFile(l.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &l.spend); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", l.path, err)
+		}
+	}
+	go l.run()
+	return l, nil
+}
+
+// current returns k's spend, starting afresh when a new period begins.
+// Callers hold mu.
+func (l *budgetLedger) current(k *APIKey) *keySpend {
+	period := budgetPeriod(k, l.now())
+	sp, ok := l.spend[k.ID]
+	if !ok {
+		sp = &keySpend{Period: period}
+		l.spend[k.ID] = sp
+	}
+	if sp.Period != period {
+		sp.Period, sp.Tokens = period, 0
+		l.dirty = true
+	}
+	return sp
+}
+
+func (l *budgetLedger) run() {
+	ticker := time.NewTicker(budgetFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		l.flush()
+	}
+}
+
+// flush writes the ledger if it changed since the last flush.
+func (l *budgetLedger) flush() {
+	l.flushing.Lock()
+	defer l.flushing.Unlock()
+	l.mu.Lock()
+	if !l.dirty {
+		l.mu.Unlock()
+		return
+	}
+	data, err := json.Marshal(l.spend)
+	l.dirty = false
+	l.mu.Unlock()
+
+	if err == nil {
+		err = writeFileAtomic(l.path, data)
+	}
+	if err != nil {
+		log.Printf("Writing key budget usage failed: %v", err)
+		l.mu.Lock()
+		l.dirty = true
+		l.mu.Unlock()
+	}
+}
+
+// forget drops the spend of deleted keys.
+func (l *budgetLedger) forget(ids ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range ids {
+		delete(l.spend, id)
+	}
+	l.dirty = true
+}
+
+// budgetReservation holds a request's estimated tokens against its key's
+// budget, and its parent's, until the request finishes.
+type budgetReservation struct {
+	ledger *budgetLedger
+	keys   []*APIKey
+	tokens int64
+}
+
+// budgetShortfall is a budget with too little left for a request's
+// estimate.
+type budgetShortfall struct {
+	key       *APIKey
+	remaining int64
+	estimate  int64
+}
+
+// reserveBudget checks a request that may use up to estimate tokens, and
+// is sure to use need, against the budgets of key id and its parent, and
+// reserves the estimate on both in one step, so concurrent requests from
+// sibling keys can't overrun the parent's budget together. A request that
+// doesn't fit need is refused with a nil reservation and the shortfall;
+// one that fits need but not its estimate is reserved and the shortfall
+// returned as a warning. Callers without a stored key get neither.
+func (s *apiKeyStore) reserveBudget(id string, need, estimate int64) (*budgetReservation, *budgetShortfall) {
+	if s == nil {
+		return nil, nil
+	}
+	keys := s.index.Load().lineage(id)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	l := s.budgets
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var short *budgetShortfall
+	for _, k := range keys {
+		if k.TokenBudget == 0 {
+			continue
+		}
+		sp := l.current(k)
+		remaining := max(k.TokenBudget-sp.Tokens-sp.reserved, 0)
+		if need > remaining {
+			return nil, &budgetShortfall{key: k, remaining: remaining, estimate: estimate}
+		}
+		if estimate > remaining && short == nil {
+			short = &budgetShortfall{key: k, remaining: remaining, estimate: estimate}
+		}
+	}
+	for _, k := range keys {
+		l.current(k).reserved += estimate
+	}
+	return &budgetReservation{ledger: l, keys: keys, tokens: estimate}, short
+}
+
+// budgeted reports whether key id or its parent has a token budget.
+func (s *apiKeyStore) budgeted(id string) bool {
+	if s == nil {
+		return false
+	}
+	return slices.ContainsFunc(s.index.Load().lineage(id), func(k *APIKey) bool { return k.TokenBudget > 0 })
+}
+
+// settle releases the reservation and charges the request's actual usage
+// to the key and its parent. Dry runs and requests that produced no usage
+// are free.
+func (r *budgetReservation) settle(rec *requestRecord) {
+	if r == nil {
+		return
+	}
+	var used int64
+	if rec.Usage != nil && !rec.DryRun {
+		used = int64(rec.Usage.TotalTokens)
+	}
+	r.ledger.mu.Lock()
+	defer r.ledger.mu.Unlock()
+	for _, k := range r.keys {
+		sp := r.ledger.current(k)
+		sp.reserved -= r.tokens
+		sp.Tokens += used
+	}
+	if used > 0 {
+		r.ledger.dirty = true
+	}
+}
+
+// requestTokenBounds returns the tokens a request of key id is sure to
+// use, its prompt, and the most it may use: the prompt plus max_tokens or,
+// without it, the model's max_output_tokens. The prompt is counted with
+// the model's tokenizer when the key has a budget and the model is served
+// by vLLM, and estimated otherwise.
+func requestTokenBounds(ctx context.Context, id string, req ChatCompletionRequest) (prompt, estimate int64) {
+	n, exact := 0, false
+	if apiKeys.budgeted(id) {
+		n, exact = countPromptTokens(ctx, req.Model, req.Messages)
+	}
+	if !exact {
+		n = estimatePromptTokens(req.Messages)
+	}
+	prompt, estimate = int64(n), int64(n)
+	if req.MaxTokens != nil {
+		estimate += int64(*req.MaxTokens)
+	} else if m, ok := requestCatalog(ctx).lookup(req.Model); ok {
+		estimate += int64(m.MaxOutputTokens)
+	}
+	return prompt, estimate
+}
+
+// budgetNeed is how much of a request's budget estimate must fit before
+// it is sent: all of it, or with BUDGET_PRECHECK=warn only the prompt, the
+// rest being reported in X-Gateway-Warning. The estimate is pessimistic,
+// since few completions run to their limit.
+func budgetNeed(prompt, estimate int64) int64 {
+	if os.Getenv("BUDGET_PRECHECK") == "warn" {
+		return prompt
+	}
+	return estimate
+}
+
+// flushBudgets persists key budget usage; called at shutdown.
+func (s *apiKeyStore) flushBudgets() {
+	if s != nil {
+		s.budgets.flush()
+	}
+}
+
+// keyUsage is a key's budget status. For a parent, UsedTokens includes its
+// children, which are broken down under Children.
+type keyUsage = client.KeyUsage
+
+func (l *budgetLedger) usage(k APIKey) keyUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sp := l.current(&k)
+	u := keyUsage{
+		KeyID:          k.ID,
+		Name:           k.Name,
+		Period:         sp.Period,
+		TokenBudget:    k.TokenBudget,
+		UsedTokens:     sp.Tokens,
+		ReservedTokens: sp.reserved,
+	}
+	if k.TokenBudget > 0 {
+		remaining := max(k.TokenBudget-sp.Tokens-sp.reserved, 0)
+		u.RemainingTokens = &remaining
+	}
+	return u
+}
+
+// keyUsageHandler implements GET /admin/keys/{id}/usage: the key's budget
+// status in its current period, with a breakdown by child for team keys.
+func keyUsageHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	apiKeys.mu.Lock()
+	k, ok := apiKeys.keys[id]
+	apiKeys.mu.Unlock()
+	if !ok {
+		writeKeyError(w, errKeyNotFound)
+		return
+	}
+	u := apiKeys.budgets.usage(k.APIKey)
+	for _, child := range apiKeys.children(id) {
+		u.Children = append(u.Children, apiKeys.budgets.usage(child))
+	}
+	sort.Slice(u.Children, func(i, j int) bool { return u.Children[i].UsedTokens > u.Children[j].UsedTokens })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
+
+// writeBudgetHeaders states the short budget's remaining tokens and the
+// request's estimate.
+func writeBudgetHeaders(w http.ResponseWriter, short *budgetShortfall) {
+	w.Header().Set("X-Gateway-Budget-Remaining", strconv.FormatInt(short.remaining, 10))
+	w.Header().Set("X-Gateway-Budget-Estimate", strconv.FormatInt(short.estimate, 10))
+}
+
+// writeBudgetExceeded rejects a request whose key, or whose key's parent,
+// has no budget left for it.
+func writeBudgetExceeded(w http.ResponseWriter, keyID string, short *budgetShortfall) {
+	gatewayRateLimited.Add("budget_exceeded", 1)
+	writeBudgetHeaders(w, short)
+	writeJSONError(w, http.StatusTooManyRequests, "insufficient_quota", "budget_exceeded",
+		fmt.Sprintf("The token budget of %s for %s has %d tokens left; this request may use up to %d",
+			budgetOwner(keyID, short.key), budgetPeriod(short.key, time.Now()), short.remaining, short.estimate))
+}
+
+// warnBudgetShort lets a request whose estimate doesn't fit its budget
+// through, saying so in X-Gateway-Warning.
+func warnBudgetShort(w http.ResponseWriter, keyID string, short *budgetShortfall) {
+	budgetWarnings.Add(1)
+	writeBudgetHeaders(w, short)
+	w.Header().Add("X-Gateway-Warning", fmt.Sprintf("the token budget of %s has %d tokens left; this request may use up to %d",
+		budgetOwner(keyID, short.key), short.remaining, short.estimate))
+}
+
+func budgetOwner(keyID string, k *APIKey) string {
+	if k.ID != keyID {
+		return "the parent key"
+	}
+	return "this key"
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vinayhpandya/ai_inference_gateway/client"
+	"github.com/vinayhpandya/ai_inference_gateway/fakeback"
+)
+
+// Children of one team key reserving at once never overrun the team's
+// budget, however their requests interleave. Run with -race.
+func TestSiblingKeysCannotOverrunParent(t *testing.T) {
+	s := useAPIKeys(t,
+		APIKey{ID: "team", TokenBudget: 1000},
+		APIKey{ID: "a", ParentID: "team"},
+		APIKey{ID: "b", ParentID: "team"},
+		APIKey{ID: "c", ParentID: "team"},
+	)
+	team := s.index.Load().lineage("team")[0]
+
+	var (
+		wg       sync.WaitGroup
+		admitted atomic.Int64
+		held     sync.Mutex
+		pending  []*budgetReservation
+	)
+	for i := range 60 {
+		wg.Go(func() {
+			id := []string{"a", "b", "c"}[i%3]
+			res, short := s.reserveBudget(id, 100, 100)
+			if res == nil {
+				if short == nil || short.key.ID != "team" {
+					t.Errorf("%s refused with shortfall %+v, want the team's", id, short)
+				}
+				return
+			}
+			admitted.Add(1)
+			if u := s.budgets.usage(*team); u.UsedTokens+u.ReservedTokens > 1000 {
+				t.Errorf("team has %d used and %d reserved, over its 1000 budget", u.UsedTokens, u.ReservedTokens)
+			}
+			held.Lock()
+			pending = append(pending, res)
+			held.Unlock()
+		})
+	}
+	wg.Wait()
+	if n := admitted.Load(); n != 10 {
+		t.Errorf("%d requests admitted, want the 10 the team's budget holds", n)
+	}
+
+	for _, res := range pending {
+		wg.Go(func() { res.settle(&requestRecord{Usage: &Usage{TotalTokens: 100}}) })
+	}
+	wg.Wait()
+	if u := s.budgets.usage(*team); u.UsedTokens != 1000 || u.ReservedTokens != 0 {
+		t.Errorf("team used %d, reserved %d; want 1000, 0", u.UsedTokens, u.ReservedTokens)
+	}
+	if res, short := s.reserveBudget("a", 1, 1); res != nil || short == nil || short.remaining != 0 {
+		t.Errorf("after the budget is spent: %v, %+v; want refused with 0 left", res, short)
+	}
+}
+
+// What a child spends counts against its own budget and its parent's, and
+// the parent's usage breaks it down by child.
+func TestChildUsageRollsUpToParent(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	back.SetDefault(fakeback.Behavior{Content: "ok", Usage: &fakeback.Usage{PromptTokens: 10, CompletionTokens: 20, TotalTokens: 30}})
+	useAPIKeys(t,
+		APIKey{ID: "team", TokenBudget: 10000},
+		APIKey{ID: "open", ParentID: "team"},
+		APIKey{ID: "capped", ParentID: "team", TokenBudget: 50},
+	)
+	body := `{"model":"m","max_tokens":5,"messages":[{"role":"user","content":"hi"}]}`
+	for _, id := range []string{"open", "open", "capped"} {
+		if w := chatAs(id, body); w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", id, w.Code, w.Body)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/admin/keys/team/usage", nil)
+	r.SetPathValue("id", "team")
+	w := httptest.NewRecorder()
+	keyUsageHandler(w, r)
+	var u keyUsage
+	if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if u.UsedTokens != 90 || u.RemainingTokens == nil || *u.RemainingTokens != 9910 {
+		t.Errorf("team usage = %+v, want 90 used of 10000", u)
+	}
+	if len(u.Children) != 2 || u.Children[0].KeyID != "open" || u.Children[0].UsedTokens != 60 ||
+		u.Children[1].KeyID != "capped" || u.Children[1].UsedTokens != 30 {
+		t.Errorf("children = %+v, want open 60 then capped 30", u.Children)
+	}
+
+	// The child's own budget still applies, with the parent's to spare
+	over := `{"model":"m","max_tokens":25,"messages":[{"role":"user","content":"hi"}]}`
+	w = chatAs("capped", over)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("X-Gateway-Budget-Remaining") != "20" {
+		t.Errorf("capped over its own budget: %d, remaining %q; want 429, 20", w.Code, w.Header().Get("X-Gateway-Budget-Remaining"))
+	}
+	if w := chatAs("open", over); w.Code != http.StatusOK {
+		t.Errorf("open: %d %s", w.Code, w.Body)
+	}
+}
+
+// Disabling a team key locks out its children until it is enabled again.
+func TestRevokedParentRejectsChildren(t *testing.T) {
+	captureLog(t)
+	s := useAPIKeys(t, APIKey{ID: "team", TokenBudget: 1000}, APIKey{ID: "child", ParentID: "team"})
+	s.path = filepath.Join(t.TempDir(), "keys.json")
+	handler := requireAuth(nil, func(w http.ResponseWriter, r *http.Request) {})
+	status := func(token string) int {
+		r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+	if got := status("child"); got != http.StatusOK {
+		t.Fatalf("child before revoking = %d", got)
+	}
+
+	if _, err := s.update("team", apiKeyRequest{Disabled: client.Ptr(true)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"team", "child"} {
+		if got := status(id); got != http.StatusUnauthorized {
+			t.Errorf("%s with the team revoked = %d, want 401", id, got)
+		}
+		if res, short := s.reserveBudget(id, 1, 1); res != nil || short != nil {
+			t.Errorf("%s reserved budget with the team revoked", id)
+		}
+	}
+
+	if _, err := s.update("team", apiKeyRequest{Disabled: client.Ptr(false)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := status("child"); got != http.StatusOK {
+		t.Errorf("child with the team enabled again = %d", got)
+	}
+}
+
+func TestRequestTokenBounds(t *testing.T) {
+	useCatalog(t, &ModelInfo{ID: "m", MaxOutputTokens: 500})
+	messages := []Message{{Role: "user", Content: "How many tokens is this prompt?"}}
+	p := int64(estimatePromptTokens(messages))
+	tests := []struct {
+		model     string
+		maxTokens *int
+		estimate  int64
+	}{
+		{"m", client.Ptr(100), p + 100},
+		// Without max_tokens the model may run to max_output_tokens
+		{"m", nil, p + 500},
+		{"unknown", client.Ptr(100), p + 100},
+		{"unknown", nil, p},
+	}
+	for _, tt := range tests {
+		prompt, estimate := requestTokenBounds(context.Background(), "", ChatCompletionRequest{Model: tt.model, Messages: messages, MaxTokens: tt.maxTokens})
+		if prompt != p || estimate != tt.estimate {
+			t.Errorf("%s with max_tokens %v: %d, %d; want %d, %d", tt.model, tt.maxTokens, prompt, estimate, p, tt.estimate)
+		}
+	}
+}
+
+// Requests are checked against the budget before they are sent: one whose
+// estimate doesn't fit is refused, or with BUDGET_PRECHECK=warn let
+// through as long as its prompt fits.
+func TestBudgetPrecheck(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	back.SetDefault(fakeback.Behavior{Content: "ok", Usage: &fakeback.Usage{TotalTokens: 10}})
+	useCatalog(t, &ModelInfo{ID: "m", MaxOutputTokens: 500})
+	useAPIKeys(t,
+		APIKey{ID: "k", TokenBudget: 300},
+		APIKey{ID: "team", TokenBudget: 300},
+		APIKey{ID: "child", ParentID: "team"},
+		APIKey{ID: "tiny", TokenBudget: 2},
+	)
+	const prompt = "How many tokens is this prompt?"
+	p := int64(estimatePromptTokens([]Message{{Content: prompt}}))
+	body := func(maxTokens string) string {
+		return `{"model":"m",` + maxTokens + `"messages":[{"role":"user","content":"` + prompt + `"}]}`
+	}
+
+	tests := []struct {
+		name, mode, key, body string
+		status                int
+		// remaining and estimate are the budget headers, when set
+		remaining, estimate int64
+		owner               string
+	}{
+		{"fits", "", "k", body(`"max_tokens":100,`), http.StatusOK, 0, 0, ""},
+		{"max_tokens over the budget", "", "k", body(`"max_tokens":400,`), http.StatusTooManyRequests, 290, p + 400, "this key"},
+		{"max_output_tokens over the budget", "", "k", body(""), http.StatusTooManyRequests, 290, p + 500, "this key"},
+		{"over the parent's budget", "", "child", body(""), http.StatusTooManyRequests, 300, p + 500, "the parent key"},
+		{"warned", "warn", "k", body(""), http.StatusOK, 290, p + 500, "this key"},
+		{"warned over the parent's budget", "warn", "child", body(""), http.StatusOK, 300, p + 500, "the parent key"},
+		// Warn mode still needs room for the prompt
+		{"prompt over the budget", "warn", "tiny", body(`"max_tokens":1,`), http.StatusTooManyRequests, 2, p + 1, "this key"},
+	}
+	for _, tt := range tests {
+		t.Setenv("BUDGET_PRECHECK", tt.mode)
+		sent, warned := len(back.Requests()), budgetWarnings.Value()
+		w := chatAs(tt.key, tt.body)
+		if w.Code != tt.status {
+			t.Errorf("%s: %d %s, want %d", tt.name, w.Code, w.Body, tt.status)
+			continue
+		}
+		if tt.estimate == 0 {
+			if h := w.Header().Get("X-Gateway-Budget-Estimate"); h != "" {
+				t.Errorf("%s: estimate header %q on a request that fits", tt.name, h)
+			}
+			continue
+		}
+		if got, want := w.Header().Get("X-Gateway-Budget-Remaining"), strconv.FormatInt(tt.remaining, 10); got != want {
+			t.Errorf("%s: X-Gateway-Budget-Remaining = %q, want %q", tt.name, got, want)
+		}
+		if got, want := w.Header().Get("X-Gateway-Budget-Estimate"), strconv.FormatInt(tt.estimate, 10); got != want {
+			t.Errorf("%s: X-Gateway-Budget-Estimate = %q, want %q", tt.name, got, want)
+		}
+
+		if tt.status == http.StatusTooManyRequests {
+			var resp ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("%s: %v: %s", tt.name, err, w.Body)
+			}
+			if e := resp.Error; e.Type != "insufficient_quota" || e.Code != "budget_exceeded" || !strings.Contains(e.Message, tt.owner) {
+				t.Errorf("%s: error = %+v, want insufficient_quota budget_exceeded naming %s", tt.name, e, tt.owner)
+			}
+			if n := len(back.Requests()); n != sent {
+				t.Errorf("%s: refused request reached the backend", tt.name)
+			}
+			continue
+		}
+		if warning := w.Header().Get("X-Gateway-Warning"); !strings.Contains(warning, tt.owner) {
+			t.Errorf("%s: X-Gateway-Warning = %q, want it naming %s", tt.name, warning, tt.owner)
+		}
+		if got := budgetWarnings.Value() - warned; got != 1 {
+			t.Errorf("%s: budget warnings went up %d, want 1", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/vinayhpandya/ai_inference_gateway/client"
+)
+
+// maxSystemPromptLength bounds a key's system prompt, in bytes.
+const maxSystemPromptLength = 32 << 10
+
+// KeyDefaults are sampling parameters a key's requests get when they don't
+// set them themselves.
+type KeyDefaults = client.KeyDefaults
+
+var (
+	errInvalidDefaults     = errors.New("defaults: temperature must be 0 to 2, top_p 0 to 1 and max_tokens positive")
+	errSystemPromptTooLong = fmt.Errorf("system_prompt must be at most %d bytes", maxSystemPromptLength)
+)
+
+func validateKeyDefaults(d *KeyDefaults) error {
+	switch {
+	case d.Temperature != nil && (*d.Temperature < 0 || *d.Temperature > 2),
+		d.TopP != nil && (*d.TopP < 0 || *d.TopP > 1),
+		d.MaxTokens != nil && *d.MaxTokens <= 0:
+		return errInvalidDefaults
+	}
+	return nil
+}
+
+// emptyKeyDefaults reports whether d sets nothing, so the key can drop it.
+func emptyKeyDefaults(d *KeyDefaults) bool {
+	return d.Temperature == nil && d.TopP == nil && d.MaxTokens == nil
+}
+
+// requestDefaults merges the defaults and system prompt of a key and its
+// parent. Each default, and the system prompt, is the key's own if it sets
+// one and its parent's otherwise.
+func (s *apiKeyStore) requestDefaults(id string) (KeyDefaults, string) {
+	var d KeyDefaults
+	var prompt string
+	if s == nil {
+		return d, prompt
+	}
+	for _, k := range s.index.Load().lineage(id) {
+		if prompt == "" {
+			prompt = k.SystemPrompt
+		}
+		if k.Defaults == nil {
+			continue
+		}
+		if d.Temperature == nil {
+			d.Temperature = k.Defaults.Temperature
+		}
+		if d.TopP == nil {
+			d.TopP = k.Defaults.TopP
+		}
+		if d.MaxTokens == nil {
+			d.MaxTokens = k.Defaults.MaxTokens
+		}
+	}
+	return d, prompt
+}
+
+// Where an effective parameter came from, as reported by dry runs.
+const (
+	paramFromRequest = "request"
+	paramFromKey     = "key"
+	// paramFromModelLimit is a key default cut down to the model's limit
+	paramFromModelLimit = "model_limit"
+)
+
+// applyKeyDefaults fills the parameters a request leaves unset from its
+// key's defaults and puts the key's system prompt first. Parameters the
+// client set always win over key defaults, and the model's limits in c win over
+// both: a client's max_tokens above max_output_tokens is still rejected,
+// while a key default above it is lowered to it. It returns the changes
+// made, for dry runs, the source of each sampling parameter that is set, and
+// whether a system prompt was prepended.
+func applyKeyDefaults(c *modelCatalog, req *ChatCompletionRequest, keyID string) (transforms []string, sources map[string]string, prompted bool) {
+	d, prompt := apiKeys.requestDefaults(keyID)
+	sources = make(map[string]string)
+	if req.Temperature != nil {
+		sources["temperature"] = paramFromRequest
+	} else if d.Temperature != nil {
+		req.Temperature = d.Temperature
+		sources["temperature"] = paramFromKey
+		transforms = append(transforms, fmt.Sprintf("temperature %g from key defaults", *d.Temperature))
+	}
+	if req.TopP != nil {
+		sources["top_p"] = paramFromRequest
+	} else if d.TopP != nil {
+		req.TopP = d.TopP
+		sources["top_p"] = paramFromKey
+		transforms = append(transforms, fmt.Sprintf("top_p %g from key defaults", *d.TopP))
+	}
+	if req.MaxTokens != nil {
+		sources["max_tokens"] = paramFromRequest
+	} else if d.MaxTokens != nil {
+		n := *d.MaxTokens
+		sources["max_tokens"] = paramFromKey
+		if m, ok := c.lookup(req.Model); ok && m.MaxOutputTokens > 0 && n > m.MaxOutputTokens {
+			transforms = append(transforms, fmt.Sprintf("max_tokens %d from key defaults lowered to the model's limit of %d", n, m.MaxOutputTokens))
+			n = m.MaxOutputTokens
+			sources["max_tokens"] = paramFromModelLimit
+		} else {
+			transforms = append(transforms, fmt.Sprintf("max_tokens %d from key defaults", n))
+		}
+		req.MaxTokens = &n
+	}
+	if prompt != "" {
+		req.Messages = append([]Message{{Role: "system", Content: prompt}}, req.Messages...)
+		transforms = append(transforms, "key system prompt prepended")
+	}
+	if len(sources) == 0 {
+		sources = nil
+	}
+	if os.Getenv("KEY_DEFAULTS_DEBUG") == "true" && len(transforms) > 0 {
+		log.Printf("Effective parameters for key %s: %s", keyID, describeParams(req, sources))
+	}
+	return transforms, sources, prompt != ""
+}
+
+// describeParams formats the sampling parameters of req with their sources,
+// for the debug log. Message content is never included.
+func describeParams(req *ChatCompletionRequest, sources map[string]string) string {
+	var parts []string
+	if req.Temperature != nil {
+		parts = append(parts, fmt.Sprintf("temperature=%g (%s)", *req.Temperature, sources["temperature"]))
+	}
+	if req.TopP != nil {
+		parts = append(parts, fmt.Sprintf("top_p=%g (%s)", *req.TopP, sources["top_p"]))
+	}
+	if req.MaxTokens != nil {
+		parts = append(parts, fmt.Sprintf("max_tokens=%d (%s)", *req.MaxTokens, sources["max_tokens"]))
+	}
+	parts = append(parts, fmt.Sprintf("messages=%d", len(req.Messages)))
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWarmupFactor = 2
+	// maxRateBuckets is how many buckets are kept before full ones, which
+	// are the same as none, are dropped
+	maxRateBuckets = 10000
+)
+
+// rateLimits is nil unless RATE_LIMIT_RPM, KEY_RATE_LIMITS or API_KEY_STORE
+// is set.
+var rateLimits *rateLimiter
+
+// rateLimit is a token bucket's shape: it refills at rpm tokens a minute up
+// to burst, and each request takes one.
+type rateLimit struct {
+	rpm   float64
+	burst float64
+}
+
+// rateLimiter limits each caller key's request rate with a token bucket.
+// Buckets start full, so a key may send burst requests at once, then rpm a
+// minute. During the warm-up after the gateway starts, or after a key is
+// created, both are multiplied by warmupFactor so clients reconnecting
+// after a deploy aren't turned away together.
+type rateLimiter struct {
+	def    rateLimit
+	perKey map[string]rateLimit
+
+	started      time.Time
+	warmup       time.Duration
+	warmupFactor float64
+	// now is the limiter's clock; tests may replace it
+	now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// tokenBucket holds a key's tokens as of updated.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// loadRateLimiter reads RATE_LIMIT_RPM and RATE_LIMIT_BURST (the default
+// per key), KEY_RATE_LIMITS ("id:rpm/burst,id2:rpm") overrides,
+// RATE_LIMIT_WARMUP and RATE_LIMIT_WARMUP_FACTOR. Without a burst, a key
+// may send a minute's worth of requests at once.
+func loadRateLimiter() (*rateLimiter, error) {
+	l := &rateLimiter{
+		perKey:       make(map[string]rateLimit),
+		warmupFactor: defaultWarmupFactor,
+		now:          time.Now,
+		buckets:      make(map[string]*tokenBucket),
+	}
+	rpm, err := envInt("RATE_LIMIT_RPM")
+	if err != nil {
+		return nil, err
+	}
+	burst, err := envInt("RATE_LIMIT_BURST")
+	if err != nil {
+		return nil, err
+	}
+	if burst > 0 && rpm == 0 {
+		return nil, fmt.Errorf("RATE_LIMIT_BURST needs RATE_LIMIT_RPM")
+	}
+	l.def = newRateLimit(rpm, burst)
+
+	if raw := os.Getenv("KEY_RATE_LIMITS"); raw != "" {
+		for _, pair := range strings.Split(raw, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			rpmText, burstText, hasBurst := strings.Cut(value, "/")
+			rpm, err := strconv.Atoi(rpmText)
+			burst := 0
+			if err == nil && hasBurst {
+				burst, err = strconv.Atoi(burstText)
+			}
+			if !ok || err != nil || rpm <= 0 || burst < 0 {
+				return nil, fmt.Errorf("invalid KEY_RATE_LIMITS entry %q: want id:rpm or id:rpm/burst", pair)
+			}
+			l.perKey[key] = newRateLimit(rpm, burst)
+		}
+	}
+
+	if v := os.Getenv("RATE_LIMIT_WARMUP"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_WARMUP %q", v)
+		}
+		l.warmup = d
+	}
+	if v := os.Getenv("RATE_LIMIT_WARMUP_FACTOR"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 1 || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_WARMUP_FACTOR %q: want a number of at least 1", v)
+		}
+		l.warmupFactor = f
+	}
+
+	if l.def.rpm == 0 && len(l.perKey) == 0 && apiKeys == nil {
+		return nil, nil
+	}
+	l.started = l.now()
+	return l, nil
+}
+
+func newRateLimit(rpm, burst int) rateLimit {
+	if burst == 0 {
+		burst = rpm
+	}
+	return rateLimit{rpm: float64(rpm), burst: float64(burst)}
+}
+
+// limit returns key's rate limit at now, relaxed during warm-up. A zero
+// rpm is unlimited.
+func (l *rateLimiter) limit(key string, now time.Time) rateLimit {
+	lim, ok := l.perKey[key]
+	rpm, burst, createdAt, stored := apiKeys.rateLimit(key)
+	switch {
+	case ok:
+	case stored:
+		lim = newRateLimit(rpm, burst)
+	default:
+		lim = l.def
+	}
+	warmFrom := l.started
+	if created := time.Unix(createdAt, 0); createdAt != 0 && created.After(warmFrom) {
+		warmFrom = created
+	}
+	if now.Sub(warmFrom) < l.warmup {
+		lim.rpm *= l.warmupFactor
+		lim.burst *= l.warmupFactor
+	}
+	return lim
+}
+
+// allow takes a token for key. When there is none it returns false, with
+// how long until there will be one.
+func (l *rateLimiter) allow(key string) (bool, time.Duration, rateLimit) {
+	if l == nil {
+		return true, 0, rateLimit{}
+	}
+	now := l.now()
+	lim := l.limit(key, now)
+	if lim.rpm <= 0 {
+		return true, 0, lim
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.bucket(key, lim, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, lim
+	}
+	perSecond := lim.rpm / 60
+	return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second)), lim
+}
+
+// bucket returns key's bucket refilled up to now. Must be called with l.mu
+// held.
+func (l *rateLimiter) bucket(key string, lim rateLimit, now time.Time) *tokenBucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateBuckets {
+			l.dropFull(now)
+		}
+		b = &tokenBucket{tokens: lim.burst, updated: now}
+		l.buckets[key] = b
+		return b
+	}
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * lim.rpm / 60
+		b.updated = now
+	}
+	b.tokens = min(b.tokens, lim.burst)
+	return b
+}
+
+// dropFull forgets the buckets that have refilled by now: a new bucket
+// starts full anyway. Must be called with l.mu held.
+func (l *rateLimiter) dropFull(now time.Time) {
+	for key, b := range l.buckets {
+		lim := l.limit(key, now)
+		if lim.rpm <= 0 || b.tokens+now.Sub(b.updated).Seconds()*lim.rpm/60 >= lim.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// level returns the tokens key has at now, and false when it is
+// unlimited. Must be called with l.mu held.
+func (l *rateLimiter) level(key string, now time.Time) (float64, bool) {
+	lim := l.limit(key, now)
+	if lim.rpm <= 0 {
+		return 0, false
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		return lim.burst, true
+	}
+	return min(b.tokens+max(now.Sub(b.updated).Seconds(), 0)*lim.rpm/60, lim.burst), true
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testRateLimiter(def rateLimit) (*rateLimiter, *time.Time) {
+	now := time.Unix(1_700_000_000, 0)
+	l := &rateLimiter{
+		def:          def,
+		perKey:       map[string]rateLimit{},
+		warmupFactor: defaultWarmupFactor,
+		now:          func() time.Time { return now },
+		buckets:      map[string]*tokenBucket{},
+	}
+	l.started = now
+	return l, &now
+}
+
+// takeAll takes tokens for key until it is refused and returns how many it
+// got and how long the refusal said to wait.
+func takeAll(l *rateLimiter, key string) (int, time.Duration) {
+	for n := 0; ; n++ {
+		if ok, retryAfter, _ := l.allow(key); !ok {
+			return n, retryAfter
+		}
+	}
+}
+
+func TestRateLimitBurstThenRefill(t *testing.T) {
+	l, now := testRateLimiter(newRateLimit(60, 3))
+	if n, retryAfter := takeAll(l, "k"); n != 3 || retryAfter != time.Second {
+		t.Fatalf("took %d, retry after %v; want the burst of 3, then 1s", n, retryAfter)
+	}
+	*now = now.Add(500 * time.Millisecond)
+	if ok, retryAfter, _ := l.allow("k"); ok || retryAfter != 500*time.Millisecond {
+		t.Errorf("half a token: allowed %t, retry after %v", ok, retryAfter)
+	}
+	*now = now.Add(500 * time.Millisecond)
+	if n, _ := takeAll(l, "k"); n != 1 {
+		t.Errorf("took %d after a second, want 1", n)
+	}
+	// Refilling stops at the burst
+	*now = now.Add(time.Hour)
+	if n, _ := takeAll(l, "k"); n != 3 {
+		t.Errorf("took %d after an hour, want the burst of 3", n)
+	}
+	// Other keys have their own buckets
+	if n, _ := takeAll(l, "other"); n != 3 {
+		t.Errorf("other key took %d, want 3", n)
+	}
+}
+
+func TestRateLimitBurstDefaultsToRPM(t *testing.T) {
+	l, _ := testRateLimiter(newRateLimit(5, 0))
+	if n, _ := takeAll(l, "k"); n != 5 {
+		t.Errorf("took %d, want a minute's worth of 5", n)
+	}
+}
+
+func TestRateLimitPerKey(t *testing.T) {
+	l, _ := testRateLimiter(newRateLimit(60, 1))
+	l.perKey["big"] = newRateLimit(60, 4)
+	useAPIKeys(t, APIKey{ID: "stored", RateLimitRPM: 60, RateLimitBurst: 2}, APIKey{ID: "child", ParentID: "stored"})
+	for key, want := range map[string]int{"anyone": 1, "big": 4, "stored": 2, "child": 2} {
+		if n, _ := takeAll(l, key); n != want {
+			t.Errorf("%s took %d, want %d", key, n, want)
+		}
+	}
+	if ok, _, lim := (*rateLimiter)(nil).allow("k"); !ok || lim.rpm != 0 {
+		t.Error("nil limiter limited a request")
+	}
+}
+
+func TestRateLimitWarmup(t *testing.T) {
+	l, now := testRateLimiter(newRateLimit(60, 2))
+	l.warmup = time.Minute
+	if n, _ := takeAll(l, "early"); n != 4 {
+		t.Errorf("during warm-up took %d, want twice the burst", n)
+	}
+	if _, retryAfter := takeAll(l, "early"); retryAfter != time.Second/2 {
+		t.Errorf("during warm-up retry after %v, want tokens at twice the rate", retryAfter)
+	}
+	*now = now.Add(time.Minute)
+	if n, _ := takeAll(l, "late"); n != 2 {
+		t.Errorf("after warm-up took %d, want the burst of 2", n)
+	}
+	if n, _ := takeAll(l, "early"); n != 2 {
+		t.Errorf("warmed-up bucket took %d after warm-up, want it capped at the burst", n)
+	}
+}
+
+func TestRateLimitWarmupAfterKeyCreated(t *testing.T) {
+	l, now := testRateLimiter(rateLimit{})
+	l.warmup = time.Minute
+	l.warmupFactor = 3
+	created := now.Add(time.Hour)
+	useAPIKeys(t, APIKey{ID: "new", RateLimitRPM: 60, RateLimitBurst: 1, CreatedAt: created.Unix()})
+
+	*now = created.Add(30 * time.Second)
+	if n, _ := takeAll(l, "new"); n != 3 {
+		t.Errorf("just after creation took %d, want 3", n)
+	}
+	*now = created.Add(time.Minute + time.Hour)
+	if n, _ := takeAll(l, "new"); n != 1 {
+		t.Errorf("after the key's warm-up took %d, want 1", n)
+	}
+}
+
+func TestRateLimitDropsFullBuckets(t *testing.T) {
+	l, now := testRateLimiter(newRateLimit(60, 2))
+	for i := range maxRateBuckets / 2 {
+		l.allow(fmt.Sprintf("old-%d", i))
+	}
+	*now = now.Add(time.Second)
+	for i := range maxRateBuckets / 2 {
+		l.allow(fmt.Sprintf("new-%d", i))
+	}
+	if len(l.buckets) != maxRateBuckets {
+		t.Fatalf("%d buckets, want %d", len(l.buckets), maxRateBuckets)
+	}
+
+	// The old buckets have refilled and go; the new ones are still short
+	l.allow("one-more")
+	if len(l.buckets) != maxRateBuckets/2+1 {
+		t.Errorf("%d buckets after dropping full ones, want %d", len(l.buckets), maxRateBuckets/2+1)
+	}
+	if _, ok := l.buckets["old-0"]; ok {
+		t.Error("full bucket kept")
+	}
+	l.mu.Lock()
+	tokens, _ := l.level("new-0", *now)
+	l.mu.Unlock()
+	if tokens != 1 {
+		t.Errorf("kept bucket has %v tokens, want 1", tokens)
+	}
+	// A dropped key starts over full, as it would have been
+	if n, _ := takeAll(l, "old-0"); n != 2 {
+		t.Errorf("dropped key took %d, want 2", n)
+	}
+}
+
+func TestLoadRateLimiter(t *testing.T) {
+	prev := apiKeys
+	apiKeys = nil
+	t.Cleanup(func() { apiKeys = prev })
+
+	t.Setenv("RATE_LIMIT_RPM", "")
+	if l, err := loadRateLimiter(); l != nil || err != nil {
+		t.Errorf("unset: limiter = %v, %v; want none", l, err)
+	}
+
+	t.Setenv("RATE_LIMIT_RPM", "120")
+	t.Setenv("RATE_LIMIT_BURST", "10")
+	t.Setenv("KEY_RATE_LIMITS", "a:30, b:60/5")
+	t.Setenv("RATE_LIMIT_WARMUP", "30s")
+	t.Setenv("RATE_LIMIT_WARMUP_FACTOR", "1.5")
+	l, err := loadRateLimiter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.def != (rateLimit{120, 10}) || l.perKey["a"] != (rateLimit{30, 30}) || l.perKey["b"] != (rateLimit{60, 5}) ||
+		l.warmup != 30*time.Second || l.warmupFactor != 1.5 {
+		t.Errorf("limiter = %+v", l)
+	}
+
+	for env, bad := range map[string]string{
+		"KEY_RATE_LIMITS":          "a:0",
+		"RATE_LIMIT_WARMUP":        "-1s",
+		"RATE_LIMIT_WARMUP_FACTOR": "0.5",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, bad)
+			if _, err := loadRateLimiter(); err == nil {
+				t.Errorf("%s=%s accepted", env, bad)
+			}
+		})
+	}
+	t.Setenv("RATE_LIMIT_RPM", "")
+	t.Setenv("KEY_RATE_LIMITS", "")
+	if _, err := loadRateLimiter(); err == nil {
+		t.Error("RATE_LIMIT_BURST without RATE_LIMIT_RPM accepted")
+	}
+}
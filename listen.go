@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Zero-downtime restarts rely on systemd socket activation. The listening
+// socket belongs to a .socket unit rather than to the gateway, so it stays
+// open across restarts:
+//
+//  1. systemd starts the gateway with the socket as fd 3 and sets
+//     LISTEN_PID/LISTEN_FDS; listen picks it up instead of binding PORT.
+//  2. On restart systemd sends SIGTERM. The gateway stops accepting, lets
+//     in-flight requests and streams finish (up to SHUTDOWN_TIMEOUT),
+//     ending streams that run past the cutoff with a restart event, and
+//     exits. New connections wait in the kernel accept backlog meanwhile.
+//  3. The new process inherits the same socket and drains the backlog, so
+//     no connection is refused during the swap.
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// listen returns the socket inherited via systemd socket activation when
+// present, otherwise a fresh TCP listener on port.
+func listen(port string) (net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || fds < 1 {
+		return net.Listen("tcp", ":"+port)
+	}
+
+	// Don't pass the activation variables on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(uintptr(listenFDsStart), "listener")
+	ln, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to use inherited listener: %w", err)
+	}
+	log.Printf("Using inherited listener on %s", ln.Addr())
+	return ln, nil
+}
+
+// shutdownTimeout reads SHUTDOWN_TIMEOUT, the drain window for in-flight
+// requests (default 30s).
+func shutdownTimeout() time.Duration {
+	return envDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+}
+
+// streamCutoff is how long after the shutdown signal open streams are ended
+// with a restart event, from STREAM_SHUTDOWN_CUTOFF. It defaults to 5s
+// before the drain window closes, or halfway through short windows. ok is
+// false when STREAM_DRAIN=complete lets streams run to the end of the window.
+func streamCutoff(timeout time.Duration) (cutoff time.Duration, ok bool) {
+	if os.Getenv("STREAM_DRAIN") == "complete" {
+		return 0, false
+	}
+	return envDuration("STREAM_SHUTDOWN_CUTOFF", timeout-min(5*time.Second, timeout/2)), true
+}
+
+// serve runs srv on ln until SIGTERM or SIGINT, then drains in-flight
+// requests before returning. Streams still open at the cutoff are ended
+// with a restart event rather than dropped when the window closes.
+func serve(srv *http.Server, ln net.Listener) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(ln)
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-errCh:
+		return err
+	case sig := <-stop:
+		log.Printf("Received %v, draining connections", sig)
+	}
+
+	timeout := shutdownTimeout()
+	if cutoff, ok := streamCutoff(timeout); ok {
+		t := time.AfterFunc(cutoff, func() {
+			if n := activeStreams.cancelAll(errGatewayRestart); n > 0 {
+				log.Printf("Ending %d open streams for restart", n)
+			}
+		})
+		defer t.Stop()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("drain incomplete: %w", err)
+	}
+	log.Printf("Shutdown complete")
+	return nil
+}
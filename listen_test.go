@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vinayhpandya/ai_inference_gateway/fakeback"
+)
+
+// TestListenHelperProcess is the gateway as systemd starts it, run by
+// TestListenInheritsSocket: it serves on the listener listen picks up.
+func TestListenHelperProcess(t *testing.T) {
+	if os.Getenv("GATEWAY_LISTEN_HELPER") == "" {
+		return
+	}
+	// systemd sets LISTEN_PID to the process it starts
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	ln, err := listen("0")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%d %s LISTEN_FDS=%s", os.Getpid(), ln.Addr(), os.Getenv("LISTEN_FDS"))
+	}))
+	os.Exit(0)
+}
+
+// A connection made before the new process starts waits in the backlog of
+// the socket it inherits, and is answered by it.
+func TestListenInheritsSocket(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	// The old process is gone: only the copy handed on stays open
+	ln.Close()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET / HTTP/1.0\r\n\r\n")
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestListenHelperProcess$")
+	cmd.Env = append(os.Environ(), "GATEWAY_LISTEN_HELPER=1", "LISTEN_FDS=1")
+	cmd.ExtraFiles = []*os.File{f}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if want := fmt.Sprintf("%d %s LISTEN_FDS=", cmd.Process.Pid, addr); string(body) != want {
+		t.Errorf("response = %q, want %q", body, want)
+	}
+}
+
+func TestListenWithoutActivation(t *testing.T) {
+	// Variables meant for another process are left alone
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	ln, err := listen("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if ln.Addr().(*net.TCPAddr).Port == 0 || os.Getenv("LISTEN_FDS") != "1" {
+		t.Errorf("listener on %s, LISTEN_FDS=%q", ln.Addr(), os.Getenv("LISTEN_FDS"))
+	}
+}
+
+// slowStreams makes the fake backend stream n chunks 50ms apart.
+func slowStreams(t *testing.T, n int) string {
+	t.Helper()
+	back := useFakeBackend(t)
+	chunks := make([]string, n)
+	for i := range chunks {
+		chunks[i] = strconv.Itoa(i) + " "
+	}
+	back.SetDefault(fakeback.Behavior{Chunks: chunks, ChunkDelay: 50 * time.Millisecond})
+	return strings.Join(chunks, "")
+}
+
+// serveGateway runs serve on ln in the background and returns its result.
+// SIGTERM is also caught here, so a signal never kills the test binary.
+func serveGateway(t *testing.T, ln net.Listener) <-chan error {
+	t.Helper()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	t.Cleanup(func() { signal.Stop(sigs) })
+	done := make(chan error, 1)
+	srv := &http.Server{Handler: accessLog(http.HandlerFunc(chatCompletionsHandler))}
+	go func() { done <- serve(srv, ln) }()
+	t.Cleanup(func() { srv.Close() })
+	return done
+}
+
+// openStream starts a streaming request and returns once its first chunk
+// has arrived.
+func openStream(t *testing.T, addr string) (*bufio.Reader, string) {
+	t.Helper()
+	resp, err := http.Post("http://"+addr+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	r := bufio.NewReader(resp.Body)
+	first, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(first, "data: ") {
+		t.Fatalf("first line %q, %v", first, err)
+	}
+	return r, first
+}
+
+// finishStream reads the rest of a stream opened by openStream and returns
+// its events.
+func finishStream(t *testing.T, r *bufio.Reader, first string) []string {
+	t.Helper()
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("stream broken: %v", err)
+	}
+	return sseEvents(first + string(rest))
+}
+
+func waitServe(t *testing.T, done <-chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serve = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve still draining after 5s")
+	}
+}
+
+func TestServeDrainsStreamsOnSIGTERM(t *testing.T) {
+	captureLog(t)
+	want := slowStreams(t, 8)
+	t.Setenv("SHUTDOWN_TIMEOUT", "5s")
+	t.Setenv("STREAM_DRAIN", "complete")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	done := serveGateway(t, ln)
+	r, first := openStream(t, addr)
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("still accepting connections 2s after SIGTERM")
+		}
+	}
+
+	events := finishStream(t, r, first)
+	if events[len(events)-1] != "[DONE]" {
+		t.Errorf("stream ended with %q, want [DONE]", events[len(events)-1])
+	}
+	if got := choiceText(t, events)[0]; got != want {
+		t.Errorf("stream content = %q, want %q", got, want)
+	}
+	waitServe(t, done)
+}
+
+func TestServeEndsStreamsAtCutoff(t *testing.T) {
+	captureLog(t)
+	slowStreams(t, 40)
+	t.Setenv("SHUTDOWN_TIMEOUT", "5s")
+	t.Setenv("STREAM_SHUTDOWN_CUTOFF", "100ms")
+	t.Setenv("STREAM_RESTART_EVENT", "")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := serveGateway(t, ln)
+	r, first := openStream(t, ln.Addr().String())
+
+	start := time.Now()
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	events := finishStream(t, r, first)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("stream ran %v past SIGTERM, want it ended at the cutoff", elapsed)
+	}
+	if events[len(events)-1] != "[DONE]" || !strings.Contains(strings.Join(events, "\n"), `"finish_reason":"gateway_restart"`) {
+		t.Errorf("events = %q, want a gateway_restart finish and [DONE]", events)
+	}
+	waitServe(t, done)
+}
+
+// The whole swap: old and new process share one socket. After SIGTERM
+// the old one finishes its stream while every new connection is served by
+// the new one.
+func TestSocketHandoffKeepsStreamsAlive(t *testing.T) {
+	captureLog(t)
+	want := slowStreams(t, 8)
+	t.Setenv("SHUTDOWN_TIMEOUT", "5s")
+	t.Setenv("STREAM_DRAIN", "complete")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inherited, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := serveGateway(t, ln)
+	r, first := openStream(t, addr)
+
+	next := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "new")
+	})}
+	go next.Serve(inherited)
+	t.Cleanup(func() { next.Close() })
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	get := func() (string, error) {
+		resp, err := client.Get("http://" + addr + "/")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+	// Until the old process stops accepting, either may answer
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if body, _ := get(); body == "new" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("new process not answering 2s after SIGTERM")
+		}
+	}
+	for i := range 20 {
+		if body, err := get(); err != nil || body != "new" {
+			t.Fatalf("request %d during the drain: %q, %v", i, body, err)
+		}
+	}
+
+	events := finishStream(t, r, first)
+	if events[len(events)-1] != "[DONE]" {
+		t.Errorf("stream ended with %q, want [DONE]", events[len(events)-1])
+	}
+	if got := choiceText(t, events)[0]; got != want {
+		t.Errorf("stream content = %q, want %q", got, want)
+	}
+	waitServe(t, done)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vinayhpandya/ai_inference_gateway/fakeback"
+)
+
+// vllmLogprobs reads the vLLM fixtures: a completion with logprobs: true
+// and top_logprobs: 2, and the same completion streamed.
+func vllmLogprobs(t *testing.T) (response, stream string) {
+	t.Helper()
+	resp, err := os.ReadFile("testdata/vllm_logprobs.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := os.ReadFile("testdata/vllm_logprobs_stream.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(resp), string(chunks)
+}
+
+// choiceLogprobs returns each choice's logprobs object in body, decoded
+// generically so no field is lost to the gateway's types.
+func choiceLogprobs(t *testing.T, body string) []any {
+	t.Helper()
+	var resp struct {
+		Choices []struct {
+			Logprobs any `json:"logprobs"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	var out []any
+	for _, c := range resp.Choices {
+		out = append(out, c.Logprobs)
+	}
+	return out
+}
+
+func TestLogprobsReachBackend(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	for _, stream := range []bool{false, true} {
+		back.Enqueue(fakeback.Behavior{Content: "ok"})
+		body := `{"model":"m","logprobs":true,"top_logprobs":2,"messages":[{"role":"user","content":"hi"}]}`
+		if stream {
+			body = strings.Replace(body, `"model":"m"`, `"model":"m","stream":true`, 1)
+		}
+		if w := chatAs("", body); w.Code != http.StatusOK {
+			t.Fatalf("stream %t: status = %d: %s", stream, w.Code, w.Body)
+		}
+		reqs := back.Requests()
+		var sent map[string]json.RawMessage
+		if err := reqs[len(reqs)-1].Decode(&sent); err != nil {
+			t.Fatal(err)
+		}
+		if string(sent["logprobs"]) != "true" || string(sent["top_logprobs"]) != "2" {
+			t.Errorf("stream %t: backend got logprobs %s, top_logprobs %s", stream, sent["logprobs"], sent["top_logprobs"])
+		}
+	}
+}
+
+func TestLogprobsSurviveResponseTypes(t *testing.T) {
+	fixture, _ := vllmLogprobs(t)
+	var resp ChatCompletionResponse
+	if err := json.Unmarshal([]byte(fixture), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if lp := resp.Choices[0].Logprobs; lp == nil || len(lp.Content) != 3 || lp.Content[2].Token != " world" || len(lp.Content[2].TopLogprobs) != 2 {
+		t.Fatalf("decoded logprobs = %+v", resp.Choices[0].Logprobs)
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := choiceLogprobs(t, string(data)), choiceLogprobs(t, fixture); !reflect.DeepEqual(got, want) {
+		t.Errorf("re-encoded logprobs = %v\nwant %v", got, want)
+	}
+}
+
+func TestLogprobsSurvivePassthrough(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	fixture, _ := vllmLogprobs(t)
+	back.Enqueue(fakeback.Behavior{Body: fixture})
+	w := chatAs("", `{"model":"m","logprobs":true,"top_logprobs":2,"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if got, want := choiceLogprobs(t, w.Body.String()), choiceLogprobs(t, fixture); !reflect.DeepEqual(got, want) {
+		t.Errorf("client got logprobs %v\nwant %v", got, want)
+	}
+}
+
+func TestStreamedLogprobsConcatenateInOrder(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	fixture, stream := vllmLogprobs(t)
+	back.Enqueue(fakeback.Behavior{Body: stream})
+	w := chatAs("", `{"model":"m","stream":true,"logprobs":true,"top_logprobs":2,"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	// Joining every chunk's logprobs.content gives the unstreamed
+	// response's, token for token
+	var joined []any
+	for _, e := range sseEvents(w.Body.String()) {
+		if e == "[DONE]" || !strings.Contains(e, `"choices"`) {
+			continue
+		}
+		for _, lp := range choiceLogprobs(t, e) {
+			if lp, ok := lp.(map[string]any); ok {
+				joined = append(joined, lp["content"].([]any)...)
+			}
+		}
+	}
+	want := choiceLogprobs(t, fixture)[0].(map[string]any)["content"]
+	if !reflect.DeepEqual(joined, want) {
+		t.Errorf("streamed logprobs joined = %v\nwant %v", joined, want)
+	}
+	if text := choiceText(t, sseEvents(w.Body.String()))[0]; text != "Hello, world" {
+		t.Errorf("text = %q", text)
+	}
+}
+
+func TestCoalescingKeepsLogprobChunks(t *testing.T) {
+	_, stream := vllmLogprobs(t)
+	c := newDeltaCoalescer(&StreamCoalesce{MaxChars: 1 << 10, interval: time.Hour})
+	var sent int
+	for _, e := range sseEvents(stream) {
+		if e != "[DONE]" {
+			sent += len(c.add([]byte(e)))
+		}
+	}
+	if sent != 4 {
+		t.Errorf("sent %d events of 4: chunks with logprobs were merged", sent)
+	}
+}
@@ -2,28 +2,40 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
-	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
-
-	"github.com/google/uuid"
 )
 
+// httpTransport is the connection pool for the gateway's own calls, such as
+// credential refreshes and model discovery. Backend requests use a pool per
+// backend (see poolFor) cloned from it. It dials through HTTPS_PROXY or
+// HTTP_PROXY, except for hosts in NO_PROXY.
+var httpTransport = &http.Transport{
+	Proxy:               http.ProxyFromEnvironment,
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 10,
+	IdleConnTimeout:     90 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+	DisableKeepAlives:   false,
+}
+
 // httpClient is a shared HTTP client with sensible timeouts and connection limits.
 var httpClient = &http.Client{
-	Timeout: 30 * time.Second,
-	Transport: &http.Transport{
-		MaxIdleConns:        100,
-		MaxIdleConnsPerHost: 10,
-		IdleConnTimeout:     90 * time.Second,
-		TLSHandshakeTimeout: 10 * time.Second,
-		DisableKeepAlives:   false,
-	},
+	Timeout:   30 * time.Second,
+	Transport: httpTransport,
 }
 
 // Request types (OpenAI-style)
@@ -33,174 +45,999 @@ type Message struct {
 }
 
 type ChatCompletionRequest struct {
-	Messages []Message `json:"messages"`
-	Stream   bool      `json:"stream,omitempty"`
+	Model               string            `json:"model,omitempty"`
+	Messages            []Message         `json:"messages"`
+	Stream              bool              `json:"stream,omitempty"`
+	StreamOptions       *StreamOptions    `json:"stream_options,omitempty"`
+	MaxTokens           *int              `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int              `json:"max_completion_tokens,omitempty"`
+	N                   *int              `json:"n,omitempty"`
+	Temperature         *float64          `json:"temperature,omitempty"`
+	TopP                *float64          `json:"top_p,omitempty"`
+	Stop                StopSequences     `json:"stop,omitempty"`
+	Tools               []json.RawMessage `json:"tools,omitempty"`
+	ResponseFormat      *ResponseFormat   `json:"response_format,omitempty"`
+	User                string            `json:"user,omitempty"`
+	Logprobs            *bool             `json:"logprobs,omitempty"`
+	TopLogprobs         *int              `json:"top_logprobs,omitempty"`
+	Seed                *int64            `json:"seed,omitempty"`
+
+	// Extensions holds vendor-specific fields forwarded verbatim
+	Extensions map[string]json.RawMessage `json:"-"`
+}
+
+// StreamOptions asks for extras in a stream. With IncludeUsage the last
+// chunk before [DONE] carries the request's usage.
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type ResponseFormat struct {
+	Type string `json:"type"`
 }
 
 // Response types (OpenAI-style)
 type ChatCompletionResponse struct {
-	ID      string   `json:"id"`
-	Object  string   `json:"object"`
-	Choices []Choice `json:"choices"`
-	Usage   Usage    `json:"usage"`
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created,omitempty"`
+	Model   string `json:"model,omitempty"`
+	// SystemFingerprint identifies the backend configuration that
+	// generated the response, when the backend reports one
+	SystemFingerprint string   `json:"system_fingerprint,omitempty"`
+	Choices           []Choice `json:"choices"`
+	Usage             Usage    `json:"usage"`
+
+	// Ensemble reports the member calls behind an ensemble model's response
+	Ensemble *EnsembleResult `json:"ensemble,omitempty"`
+	// Gateway carries extras the client asked for, such as a token breakdown
+	Gateway *GatewayInfo `json:"gateway,omitempty"`
 }
 
 type Choice struct {
 	Index        int     `json:"index"`
 	Message      Message `json:"message"`
 	FinishReason string  `json:"finish_reason"`
+
+	// ContentFilter explains a content_filter finish reported by the provider
+	ContentFilter *ContentFilter `json:"content_filter,omitempty"`
+	// Logprobs is returned by OpenAI-format backends for logprobs: true
+	Logprobs *Logprobs `json:"logprobs,omitempty"`
+}
+
+// Logprobs holds per-token log probabilities of a choice's content.
+type Logprobs struct {
+	Content []TokenLogprob `json:"content"`
+	Refusal []TokenLogprob `json:"refusal,omitempty"`
+}
+
+// TokenLogprob is one generated token and the top_logprobs most likely
+// alternatives at its position.
+type TokenLogprob struct {
+	TopLogprob
+	TopLogprobs []TopLogprob `json:"top_logprobs"`
+}
+
+// TopLogprob is a token with its log probability. Bytes is null for tokens
+// that are not valid UTF-8 on their own.
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
+type ContentFilter struct {
+	Provider   string   `json:"provider"`
+	Categories []string `json:"categories"`
 }
 
 type Usage struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
 	TotalTokens      int `json:"total_tokens"`
+
+	// Estimated marks usage computed by the gateway rather than reported by the backend
+	Estimated bool `json:"estimated,omitempty"`
 }
 
 func main() {
+	log.SetOutput(redactingWriter{os.Stderr})
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replayMain(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "logcat" {
+		logcatMain(os.Args[2:])
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	http.HandleFunc("/v1/chat/completions", chatCompletionsHandler)
+	auth, err := loadHMACAuth()
+	if err != nil {
+		log.Fatalf("Invalid auth config: %v", err)
+	}
+
+	apiKeys, err = loadAPIKeyStore()
+	if err != nil {
+		log.Fatalf("Invalid API key store: %v", err)
+	}
+
+	conversations, err = loadConversationStore()
+	if err != nil {
+		log.Fatalf("Invalid conversation config: %v", err)
+	}
+
+	limiter, err := loadConcurrencyLimiter()
+	if err != nil {
+		log.Fatalf("Invalid concurrency config: %v", err)
+	}
+
+	rateLimits, err = loadRateLimiter()
+	if err != nil {
+		log.Fatalf("Invalid rate limit config: %v", err)
+	}
+
+	models, err := loadCatalog()
+	if err != nil {
+		log.Fatalf("Invalid model catalog: %v", err)
+	}
+	catalog.Store(models)
+	warmCatalog(nil, models, "startup")
+	shedCatalog(models)
+	selfTests, err = loadSelfTest(models)
+	if err != nil {
+		log.Fatalf("Invalid self-test config: %v", err)
+	}
+	selfTests.start(models)
+	go reloadOnSIGHUP()
+
+	// Loaded after the catalog: resumed batches start routing immediately
+	batches, err = loadBatchStore(chatCompletionsHandler)
+	if err != nil {
+		log.Fatalf("Invalid batch config: %v", err)
+	}
+
+	trustedProxies, err = loadTrustedProxies()
+	if err != nil {
+		log.Fatalf("Invalid trusted proxies: %v", err)
+	}
+
+	webhooks, err = loadWebhooks()
+	if err != nil {
+		log.Fatalf("Invalid webhook config: %v", err)
+	}
+
+	eventBus, err = loadEventBus()
+	if err != nil {
+		log.Fatalf("Invalid event publisher config: %v", err)
+	}
+
+	accessLogs, err = loadAccessLogWriter()
+	if err != nil {
+		log.Fatalf("Invalid access log config: %v", err)
+	}
+
+	responseCache, err = loadResponseCache()
+	if err != nil {
+		log.Fatalf("Invalid response cache config: %v", err)
+	}
+
+	routingTokens, err = loadRoutingTokens()
+	if err != nil {
+		log.Fatalf("Invalid routing token config: %v", err)
+	}
+
+	requestRouter, requestRouterName, err = loadRouter()
+	if err != nil {
+		log.Fatalf("Invalid router config: %v", err)
+	}
+
+	guardrails, err = loadGuardrails()
+	if err != nil {
+		log.Fatalf("Invalid guardrail config: %v", err)
+	}
+
+	slos, err = loadSLOs()
+	if err != nil {
+		log.Fatalf("Invalid SLO config: %v", err)
+	}
+
+	finishReasons, err = loadFinishReasons()
+	if err != nil {
+		log.Fatalf("Invalid finish reason config: %v", err)
+	}
+
+	usageExport, err = loadUsageExport()
+	if err != nil {
+		log.Fatalf("Invalid usage export config: %v", err)
+	}
+
+	journal, err = loadRequestJournal()
+	if err != nil {
+		log.Fatalf("Invalid request journal config: %v", err)
+	}
+
+	dataCollection, err = loadDataCollection()
+	if err != nil {
+		log.Fatalf("Invalid data collection config: %v", err)
+	}
+
+	comparisons, err = loadComparisons()
+	if err != nil {
+		log.Fatalf("Invalid comparison config: %v", err)
+	}
+
+	streamCoalescing, err = loadStreamCoalescing()
+	if err != nil {
+		log.Fatalf("Invalid stream coalescing config: %v", err)
+	}
+
+	responseProcessing, err = loadResponseProcessing()
+	if err != nil {
+		log.Fatalf("Invalid response processing config: %v", err)
+	}
+
+	staleRejection, err = loadStaleRejection()
+	if err != nil {
+		log.Fatalf("Invalid stale request config: %v", err)
+	}
+
+	requestLimits, err = loadRequestLimits()
+	if err != nil {
+		log.Fatalf("Invalid request limits: %v", err)
+	}
+
+	if err := loadAPIVersionDefault(); err != nil {
+		log.Fatalf("Invalid API version config: %v", err)
+	}
+
+	promptExperiments, err = loadPromptExperiments()
+	if err != nil {
+		log.Fatalf("Invalid prompt experiments config: %v", err)
+	}
+
+	playgroundAccess, err = loadPlayground()
+	if err != nil {
+		log.Fatalf("Invalid playground config: %v", err)
+	}
+
+	// Loaded last: it checks the features above don't need bodies
+	transparentRoutes, err = loadTransparentProxy()
+	if err != nil {
+		log.Fatalf("Invalid transparent route config: %v", err)
+	}
 
-	log.Printf("Starting inference gateway on port %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	rt := newRouter()
+	rt.handle("POST /v1/chat/completions", requestLimits.wrap("POST /v1/chat/completions", requireAuth(auth, limitConcurrency(limiter, transparentRoutes.wrap("/v1/chat/completions", chatCompletionsHandler)))))
+	rt.handle("POST /v1/responses", requestLimits.wrap("POST /v1/responses", requireAuth(auth, limitConcurrency(limiter, transparentRoutes.wrap("/v1/responses", responsesHandler)))))
+	rt.handle("DELETE /v1/conversations/{id}", requireAuth(auth, deleteConversationHandler))
+	rt.handle("POST /v1/requests/{id}/cancel", requireAuth(auth, cancelRequestHandler))
+	rt.handle("GET /v1/models", requireAuth(auth, modelsHandler))
+	rt.handle("GET /version", versionHandler)
+	rt.handle("GET /debug/vars", requireMetrics(expvar.Handler().ServeHTTP))
+	rt.handle("GET /metrics", requireMetrics(metricsHandler))
+	rt.handle("GET /readyz", readyzHandler)
+	rt.handle("GET /openapi.json", openAPIHandler)
+	rt.handle("GET /playground", requirePlayground(auth, playgroundHandler))
+	rt.handle("GET /playground/{file}", requirePlayground(auth, playgroundHandler))
+	rt.handle("POST /v1/tokenize", requestLimits.wrap("POST /v1/tokenize", requireAuth(auth, limitConcurrency(limiter, tokenizeHandler))))
+	rt.handle("POST /v1/detokenize", requireAuth(auth, limitConcurrency(limiter, detokenizeHandler)))
+	rt.handle("POST /v1/files", requireBatches(requireAuth(auth, uploadFileHandler)))
+	rt.handle("GET /v1/files/{id}", requireBatches(requireAuth(auth, getFileHandler)))
+	rt.handle("GET /v1/files/{id}/content", requireBatches(requireAuth(auth, fileContentHandler)))
+	rt.handle("POST /v1/batches", requireBatches(requireAuth(auth, createBatchHandler)))
+	rt.handle("GET /v1/batches/{id}", requireBatches(requireAuth(auth, getBatchHandler)))
+	rt.handle("POST /v1/batches/{id}/cancel", requireBatches(requireAuth(auth, cancelBatchHandler)))
+	rt.handle("GET /admin/concurrency", requireAdmin(concurrencyAdminHandler(limiter)))
+	rt.handle("GET /admin/state", requireAdmin(stateAdminHandler(limiter)))
+	rt.handle("GET /admin/routes", requireAdmin(routesAdminHandler(rt, auth, limiter)))
+	rt.handle("POST /admin/keys", requireAdmin(requireAPIKeys(createKeyHandler)))
+	rt.handle("GET /admin/keys", requireAdmin(requireAPIKeys(listKeysHandler)))
+	rt.handle("PATCH /admin/keys/{id}", requireAdmin(requireAPIKeys(updateKeyHandler)))
+	rt.handle("DELETE /admin/keys/{id}", requireAdmin(requireAPIKeys(deleteKeyHandler)))
+	rt.handle("GET /admin/keys/{id}/usage", requireAdmin(requireAPIKeys(keyUsageHandler)))
+	rt.handle("POST /admin/routing-tokens", requireAdmin(requireRoutingTokens(issueRoutingTokenHandler)))
+	rt.handle("GET /admin/slos", requireAdmin(sloAdminHandler))
+	rt.handle("GET /admin/comparisons", requireAdmin(comparisonAdminHandler))
+	rt.handle("GET /admin/experiments", requireAdmin(experimentsAdminHandler))
+	rt.handle("GET /admin/finish-reasons", requireAdmin(finishReasonsAdminHandler))
+	rt.handle("GET /admin/queues", requireAdmin(queuesAdminHandler))
+	rt.handle("GET /admin/regions", requireAdmin(regionsAdminHandler))
+	rt.handle("PATCH /admin/regions/{backend}", requireAdmin(updateRegionHandler))
+	rt.handle("GET /admin/balancing", requireAdmin(balancingAdminHandler))
+	rt.handle("PATCH /admin/balancing/{backend}", requireAdmin(updateBalancingHandler))
+	rt.handle("GET /admin/ignored-fields", requireAdmin(ignoredFieldsAdminHandler))
+	rt.handle("GET /admin/api-versions", requireAdmin(apiVersionsAdminHandler))
+	rt.handle("GET /admin/journal", requireAdmin(requireJournal(journalAdminHandler)))
+	rt.handle("GET /admin/usage/export", requireAdmin(requireUsageExport(usageExportHandler)))
+	if transparentRoutes != nil {
+		for _, path := range transparentRoutes.paths {
+			if !slices.Contains(rt.patterns, "POST "+path) {
+				rt.handle("POST "+path, requireAuth(auth, limitConcurrency(limiter, transparentHandler)))
+			}
+		}
+	}
+	if err := slos.checkRoutes(rt.patterns); err != nil {
+		log.Fatalf("Invalid SLO config: %v", err)
+	}
+	if err := checkGatewayTimingRoutes(rt.patterns); err != nil {
+		log.Fatalf("Invalid gateway timing config: %v", err)
+	}
+	if err := dataCollection.checkRoutes(rt.patterns); err != nil {
+		log.Fatalf("Invalid data collection config: %v", err)
+	}
+	if err := comparisons.checkRoutes(rt.patterns); err != nil {
+		log.Fatalf("Invalid comparison config: %v", err)
+	}
+	if err := streamCoalescing.checkRoutes(rt.patterns); err != nil {
+		log.Fatalf("Invalid stream coalescing config: %v", err)
+	}
+	if err := responseProcessing.checkRoutes(rt.patterns); err != nil {
+		log.Fatalf("Invalid response processing config: %v", err)
+	}
+	if err := staleRejection.checkRoutes(rt.patterns); err != nil {
+		log.Fatalf("Invalid stale request config: %v", err)
+	}
+	if err := requestLimits.checkRoutes(rt.patterns); err != nil {
+		log.Fatalf("Invalid request limits: %v", err)
+	}
+	if err := promptExperiments.checkRoutes(rt.patterns); err != nil {
+		log.Fatalf("Invalid prompt experiments config: %v", err)
+	}
+	if err := deterministicRoutes.checkRoutes(rt.patterns); err != nil {
+		log.Fatalf("Invalid deterministic routes: %v", err)
+	}
+	// Built last, once every route is registered
+	if openAPIDocument, err = buildOpenAPI(rt.patterns); err != nil {
+		log.Fatalf("Invalid OpenAPI document: %v", err)
+	}
+
+	ln, err := listen(port)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	ln, err = limitConnections(ln)
+	if err != nil {
+		log.Fatalf("Invalid connection limits: %v", err)
+	}
+
+	log.Printf("Starting inference gateway %s (commit %s, built %s) on %s", buildInfo.Version, buildInfo.Commit, buildInfo.BuildDate, ln.Addr())
+	if os.Getenv("USER_HASH_SALT") == "" {
+		log.Printf("USER_HASH_SALT is not set; user hashes in logs are unsalted")
+	}
+
+	err = serve(&http.Server{Handler: withVersionHeader(accessLog(recoverPanics(withClientInfo(rt))))}, ln)
+	// Flush before exiting, even when the drain timed out
+	journal.close()
+	dataCollection.close()
+	comparisons.close()
+	usageExport.flush()
+	eventBus.close()
+	apiKeys.flushBudgets()
+	accessLogs.close()
+	if err != nil {
 		log.Fatalf("Server failed: %v", err)
 	}
 }
 
-func chatCompletionsHandler(w http.ResponseWriter, r *http.Request) {
-	// Only accept POST
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// reloadOnSIGHUP reloads hot-reloadable configuration on each SIGHUP.
+func reloadOnSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Printf("SIGHUP received, reloading configuration")
+		reloadCatalog()
+		promptExperiments.reload()
 	}
+}
+
+func chatCompletionsHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 
 	// Get or generate request ID
-	requestID := r.Header.Get("X-Request-ID")
-	if requestID == "" {
-		requestID = r.Header.Get("Request-Id")
-	}
-	if requestID == "" {
-		requestID = uuid.New().String()
-	}
+	requestID := requestIDFrom(r)
 
 	// Set request ID in response header
 	w.Header().Set("X-Request-ID", requestID)
 	w.Header().Set("Content-Type", "application/json")
 
 	// Parse request body
+	var body json.RawMessage
 	var req ChatCompletionRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if rejectOverLimit(w, err) {
 		return
 	}
+	if err != nil {
+		writeVersionedError(w, r, http.StatusBadRequest, "invalid_request_error", "invalid_json", "Invalid JSON: "+describeJSONError(err))
+		return
+	}
+	if requestAPIVersion(r).Flags.StrictRequests || strictRequests(identityFromContext(r.Context()).KeyID) {
+		if err := checkUnknownFields(body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "unknown_field", err.Error())
+			return
+		}
+	} else {
+		noteUnknownFields(body)
+	}
+	if responsesCallFrom(r.Context()) == nil {
+		warnDeprecatedFields(w, r, body)
+	}
 
-	// Extract the last user message as the prompt
-	prompt := extractLastUserMessage(req.Messages)
+	rec := recordFromContext(r.Context())
+	rec.RequestID = requestID
+	rec.KeyID = identityFromContext(r.Context()).KeyID
+	models := rec.admittedCatalog()
+	resolved, steps := models.resolveName(req.Model)
+	if resolved != req.Model {
+		rec.ClientModel, req.Model = req.Model, resolved
+	}
+	rec.Model = req.Model
+	rec.UserHash = hashUser(req.User)
 
-	// Check if backend is configured
-	backendURL := os.Getenv("BACKEND_URL")
+	dryRun := isDryRun(r)
+	if dryRun {
+		if !dryRunAllowed(rec.KeyID) {
+			writeJSONError(w, http.StatusForbidden, "permission_error", "dry_run_not_allowed", "This key may not send dry-run requests")
+			return
+		}
+		rec.DryRun = true
+		r = r.WithContext(context.WithValue(r.Context(), dryRunKey{}, true))
+	}
+	report := dryRunReport{RequestID: requestID, Route: rec.Route, RequestedModel: rec.ClientModel}
+	if len(steps) > 0 {
+		report.Transforms = append(report.Transforms, fmt.Sprintf("model %q resolved to %q: %s", rec.ClientModel, req.Model, strings.Join(steps, ", ")))
+	}
+
+	if req.User == "" && apiKeys.requiresUser(rec.KeyID) {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "missing_user", "This key requires the user field")
+		return
+	}
+	if models.requiresUserMessage(req.Model) && !hasUserMessage(req.Messages) {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "missing_user_message",
+			"messages must include at least one message with role \"user\"")
+		return
+	}
+
+	if !apiKeys.allowsModel(rec.KeyID, req.Model) {
+		writeJSONError(w, http.StatusForbidden, "permission_error", "model_not_allowed", fmt.Sprintf("This key may not use model %q", req.Model))
+		return
+	}
+
+	if err := models.checkDeprecation(w, req.Model); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "model_sunset", err.Error())
+		return
+	}
+
+	if err := normalizeMaxTokens(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "conflicting_parameters", err.Error())
+		return
+	}
+
+	applied, sources, prompted := applyKeyDefaults(models, &req, rec.KeyID)
+	report.Transforms = append(report.Transforms, applied...)
+	report.ParameterSources = sources
+	if rej := deterministicRoutes.checkRequest(rec.Route, &req); rej != nil {
+		writeJSONError(w, rej.Status, rej.Type, rej.Code, rej.Message)
+		return
+	}
+
+	if err := models.checkModelCapabilities(req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "unsupported_feature", err.Error())
+		return
+	}
+
+	rewrote, rej := guardrails.checkRequest(r.Context(), &RequestContext{
+		RequestID: requestID,
+		KeyID:     rec.KeyID,
+		Header:    r.Header,
+		Request:   &req,
+	})
+	if rej != nil {
+		writeJSONError(w, rej.Status, rej.Type, rej.Code, rej.Message)
+		return
+	}
+	for _, name := range rewrote {
+		report.Transforms = append(report.Transforms, fmt.Sprintf("messages rewritten by guardrail %s", name))
+	}
+
+	promptTokens, estimate := requestTokenBounds(r.Context(), rec.KeyID, req)
+	reservation, short := apiKeys.reserveBudget(rec.KeyID, budgetNeed(promptTokens, estimate), estimate)
+	if short != nil && reservation == nil {
+		writeBudgetExceeded(w, rec.KeyID, short)
+		return
+	}
+	if short != nil {
+		warnBudgetShort(w, rec.KeyID, short)
+	}
+	defer reservation.settle(rec)
+
+	call := responsesCallFrom(r.Context())
+	if e := models.ensembleFor(req.Model); e != nil {
+		if err := call.route(nil); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "unsupported_parameter", err.Error())
+			return
+		}
+		if dryRun {
+			ensembleDryRun(w, req, e, report)
+			return
+		}
+		serveEnsemble(w, r, req, e, requestID)
+		return
+	}
+
+	decision, err := requestRouter.Route(r.Context(), &RequestContext{
+		RequestID: requestID,
+		KeyID:     rec.KeyID,
+		Header:    r.Header,
+		Request:   &req,
+	})
+	if err == nil && len(decision.Targets) == 0 {
+		err = fmt.Errorf("router %s returned no backend for model %q", requestRouterName, req.Model)
+	}
+	if err != nil {
+		var routeErr *RouteError
+		if errors.As(err, &routeErr) {
+			writeJSONError(w, routeErr.Status, routeErr.Type, routeErr.Code, routeErr.Message)
+			return
+		}
+		log.Printf("Routing %s failed: %v", requestID, err)
+		writeJSONError(w, http.StatusBadGateway, "server_error", "routing_failed", "No backend is available for this request")
+		return
+	}
+	overridden, rej := overrideRoute(r, rec.KeyID, req.Model, requestID, &decision)
+	if rej != nil {
+		writeJSONError(w, rej.Status, rej.Type, rej.Code, rej.Message)
+		return
+	}
+	target := decision.Targets[0]
+	backend := target.Backend
+	rec.Backend = backend.Name
+	report.Backend, report.BackendType = backend.Name, backend.Type
+	report.RoutingToken = decision.Pin
+	for _, t := range decision.Targets[1:] {
+		report.Fallbacks = append(report.Fallbacks, t.Backend.Name)
+	}
+	if overridden {
+		report.Transforms = append(report.Transforms, fmt.Sprintf("routed to backend %q by %s", backend.Name, targetBackendHeader))
+	}
+	if err := call.route(backend); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "unsupported_parameter", err.Error())
+		return
+	}
+	if call.isNative() {
+		report.Transforms = append(report.Transforms, "sent to the backend's Responses API as received, with the model replaced")
+	} else if t := promptExperiments.apply(&req, rec, req.User); t != "" {
+		report.Transforms = append(report.Transforms, t)
+	}
+
+	applyBackendExtensions(w, r, &req, backend)
+	model := req.Model
+	if target.Model != "" {
+		req.Model = target.Model
+		report.UpstreamModel = req.Model
+	}
+	if p, ok := req.Extensions["priority"]; ok && backend.Type == "vllm" {
+		report.Transforms = append(report.Transforms, "X-Priority-Class mapped to vLLM priority "+string(p))
+	}
+
+	// Prepend stored history for session requests
+	conversationID := r.Header.Get("X-Conversation-ID")
+	if conversationID != "" && !safeClientToken(conversationID, maxRequestIDLength) {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_conversation_id",
+			fmt.Sprintf("X-Conversation-ID must be at most %d characters from [A-Za-z0-9._:-]", maxRequestIDLength))
+		return
+	}
+	owner := identityFromContext(r.Context()).KeyID
+	newMessages := req.Messages
+	if prompted {
+		// The key's system prompt isn't stored, and stays ahead of history
+		newMessages = req.Messages[1:]
+	}
+	var history []Message
+	if conversationID != "" && conversations != nil {
+		history = conversations.Load(owner, conversationID)
+		req.Messages = append(append(slices.Clip(req.Messages[:len(req.Messages)-len(newMessages)]), history...), newMessages...)
+		if len(history) > 0 {
+			report.Transforms = append(report.Transforms, fmt.Sprintf("prepended %d stored conversation messages", len(history)))
+		}
+	}
+	before := len(req.Messages)
+	req.Messages = fitContext(r.Context(), model, owner, req)
+	if len(req.Messages) != before {
+		report.Transforms = append(report.Transforms, fmt.Sprintf("context fitted from %d to %d messages", before, len(req.Messages)))
+	}
+	if !call.isNative() {
+		report.Transforms = append(report.Transforms, normalizeForBackend(&req, backend, requestID)...)
+	}
+
+	// Computed only when asked for, from the messages actually sent
+	var gateway *GatewayInfo
+	if wantsTokenBreakdown(r) {
+		gateway = tokenBreakdown(req, newMessages, history)
+	}
+	if wantsGatewayTiming(r) {
+		if gateway == nil {
+			gateway = &GatewayInfo{}
+		}
+		gateway.timed = rec
+	}
+	if rec.Experiment != "" {
+		if gateway == nil {
+			gateway = &GatewayInfo{}
+		}
+		gateway.Experiment = &ExperimentAssignment{Name: rec.Experiment, Variant: rec.Variant}
+	}
+	if d := deterministicRoutes.determinism(rec.Route, backend, req); d != nil {
+		if gateway == nil {
+			gateway = &GatewayInfo{}
+		}
+		gateway.Determinism = d
+	}
+
+	// Extract the message echo mode replies to
+	prompt := extractPrompt(req.Messages)
+	if backend == echoBackend {
+		if rej := validateEchoRequest(req); rej != nil {
+			writeJSONError(w, rej.Status, rej.Type, rej.Code, rej.Message)
+			return
+		}
+	}
+
+	rec.Timings.set(&rec.Timings.validate, time.Since(start))
+
+	if dryRun {
+		writeDryRun(w, model, req, report)
+		return
+	}
+
+	// Pinned and overridden requests are experiments against a specific
+	// backend: never cached
+	var cached *cacheLookup
+	if decision.Pin == "" && !overridden && !call.isNative() {
+		cached = responseCache.lookup(owner, model, req)
+	}
+	if cached != nil && cached.entry != nil {
+		rec.Backend = "cache"
+		w.Header().Set("X-Gateway-Cache", "hit")
+	} else {
+		if !selfTests.healthy(backend) {
+			writeJSONError(w, http.StatusServiceUnavailable, "server_error", "backend_unhealthy",
+				fmt.Sprintf("Backend for model %q is failing its self-test", model))
+			return
+		}
+		if retryAfter, shed := shouldShed(backend, r.Header.Get("X-Priority-Class")); shed {
+			shedRequests.Add(backend.Name, 1)
+			gatewayRateLimited.Add("backend_overloaded", 1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, "rate_limit_error", "backend_overloaded",
+				fmt.Sprintf("Backend for model %q is overloaded; retry later", model))
+			return
+		}
+		// A warming backend isn't eligible yet; the client gave up if this fails
+		if err := awaitWarmup(r.Context(), backend); err != nil {
+			return
+		}
+		queued := time.Now()
+		release, status, err := queueFor(backend).acquire(r.Context())
+		rec.Timings.add(&rec.Timings.queue, time.Since(queued))
+		if err != nil {
+			if status != nil {
+				writeQueueRejection(w, model, backend, status, err)
+			}
+			return
+		}
+		defer release()
+		backendRequests.Add(backend.Name, 1)
+	}
+
+	if call.isNative() {
+		serveNativeResponses(w, r, backend, call, req.Model, requestID)
+		return
+	}
+
+	// Only fresh backend completions are training data, not echoes or
+	// cache hits
+	var sample *trainingRecord
+	var compared *comparison
+	if backend != echoBackend && (cached == nil || cached.entry == nil) {
+		sample = dataCollection.sample(r, req, model, requestID)
+		compared = comparisons.start(r, req, model, backend, requestID)
+	}
+
+	if req.Stream {
+		content, ok := streamChatCompletion(w, r, req, requestID, backend, prompt, cached, gateway)
+		if ok {
+			sample.finish(content, rec.FinishReason)
+			compared.finish(content, rec.FinishReason, rec.Usage)
+		}
+		if ok && conversationID != "" && conversations != nil {
+			conversations.Append(owner, conversationID, append(newMessages, Message{Role: "assistant", Content: content})...)
+		}
+		return
+	}
 
 	var response ChatCompletionResponse
-	var err error
+	// Set once a fresh, non-degraded response is in hand
+	cacheable := false
 
-	if backendURL != "" {
-		response, err = forwardToBackend(backendURL, req, requestID)
+	if cached != nil && cached.entry != nil {
+		response = *cached.entry.response
+		response.Choices = slices.Clone(response.Choices)
+	} else if backend != echoBackend {
+		// Cacheable requests are decoded so the response can be stored,
+		// token breakdowns so it can be added, guarded and processed
+		// responses so they can be checked and rewritten, and renamed models
+		// so the name can be put back
+		if cached == nil && gateway == nil && !guardrails.checksResponses() && responseProcessing.forRequest(r) == nil &&
+			responseModel(rec) == "" && canPassthrough(backend, models.stopEnforced(model, req)) {
+			var resp *http.Response
+			if resp, err = sendToBackend(r.Context(), backend, req, requestID); err == nil {
+				setServerTiming(w, r)
+				// The message is kept for history, and for sampled and
+				// compared completions; usage is always recorded
+				persist := conversationID != "" && conversations != nil
+				if msg, ok := relayResponse(w, resp, requestID, rec, persist || sample != nil || compared != nil); ok {
+					sample.finish(msg.Content, rec.FinishReason)
+					compared.finish(msg.Content, rec.FinishReason, rec.Usage)
+					if persist {
+						conversations.Append(owner, conversationID, append(newMessages, msg)...)
+					}
+				}
+				return
+			}
+		} else {
+			response, err = forwardToBackend(r.Context(), backend, req, requestID)
+			cacheable = cached != nil && err == nil
+		}
 		if err != nil {
 			log.Printf("Backend error: %v", err)
-			http.Error(w, fmt.Sprintf("Backend error: %v", err), http.StatusBadGateway)
-			return
+			noteBackendFailure(backend, err)
+			degraded := models.degradedResponse(model)
+			if degraded == "" || !isBackendUnavailable(err) {
+				writeBackendError(w, err, backend)
+				return
+			}
+			// Opted in: serve a canned completion instead of a 502
+			degradedResponses.Add(1)
+			w.Header().Set("X-Gateway-Degraded", "true")
+			response = createDegradedResponse(requestID, req.Messages, degraded)
+			sample, compared = nil, nil
 		}
 	} else {
 		// Echo mode
-		response = createEchoResponse(requestID, prompt)
+		response = createEchoResponse(requestID, req, prompt)
+		cacheable = cached != nil
 	}
 
+	postStart := time.Now()
+
 	// Ensure the response ID matches our request ID
 	response.ID = requestID
 
+	if deterministicRoutes.covers(rec.Route) && response.SystemFingerprint == "" {
+		// The backend did the work, so it's billed
+		rec.Usage = &response.Usage
+		rej := missingFingerprint(backend)
+		writeJSONError(w, rej.Status, rej.Type, rej.Code, rej.Message)
+		return
+	}
+
+	if models.stopEnforced(model, req) {
+		enforceStop(&response, req.Stop)
+	}
+	responseProcessing.forRequest(r).processResponse(&response)
+
+	if rej := guardrails.guardResponse(r.Context(), &RequestContext{RequestID: requestID, KeyID: owner, Header: r.Header, Request: &req}, &response); rej != nil {
+		// The backend did the work, so it's billed
+		rec.Usage = &response.Usage
+		writeJSONError(w, rej.Status, rej.Type, rej.Code, rej.Message)
+		return
+	}
+
+	if len(response.Choices) > 0 {
+		sample.finish(response.Choices[0].Message.Content, response.Choices[0].FinishReason)
+		compared.finish(response.Choices[0].Message.Content, response.Choices[0].FinishReason, &response.Usage)
+	}
+
+	if cacheable && len(response.Choices) > 0 {
+		stored := response
+		responseCache.store(cached, &cacheEntry{response: &stored})
+	}
+
+	// Persist this turn so the client only has to send new messages next time
+	if conversationID != "" && conversations != nil && len(response.Choices) > 0 {
+		conversations.Append(owner, conversationID, append(newMessages, response.Choices[0].Message)...)
+	}
+
+	gateway.stampTiming()
+	response.Gateway = gateway
+	if name := responseModel(rec); name != "" {
+		response.Model = name
+	}
+
+	rec.Usage = &response.Usage
+	if len(response.Choices) > 0 {
+		rec.FinishReason = response.Choices[0].FinishReason
+	}
+	rec.Timings.set(&rec.Timings.post, time.Since(postStart))
+	setServerTiming(w, r)
+
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		log.Printf("Error encoding response: %v", err)
 	}
 }
 
-func extractLastUserMessage(messages []Message) string {
+// extractPrompt returns the message echo mode answers: the last user
+// message, or with PROMPT_SOURCE=last the last non-system message of any
+// role, so assistant continuations and tool results get a reply of their
+// own. It returns a zero Message when there is none.
+func extractPrompt(messages []Message) Message {
+	last := os.Getenv("PROMPT_SOURCE") == "last"
 	for i := len(messages) - 1; i >= 0; i-- {
-		if messages[i].Role == "user" {
-			return messages[i].Content
+		if role := messages[i].Role; role == "user" || (last && role != "system") {
+			return messages[i]
 		}
 	}
-	return ""
+	return Message{}
 }
 
-func createEchoResponse(requestID, prompt string) ChatCompletionResponse {
-	replyContent := fmt.Sprintf("Echo: %s", prompt)
+// requiresUserMessage reports whether the catalog has model reject
+// conversations without a user turn.
+func (c *modelCatalog) requiresUserMessage(model string) bool {
+	m, ok := c.lookup(model)
+	return ok && m.RequireUserMessage
+}
+
+// hasUserMessage reports whether messages include a user turn.
+func hasUserMessage(messages []Message) bool {
+	return slices.ContainsFunc(messages, func(m Message) bool { return m.Role == "user" })
+}
 
-	// Approximate token count (roughly 4 chars per token)
-	promptTokens := approximateTokens(prompt)
-	completionTokens := approximateTokens(replyContent)
+// echoReply is echo mode's answer to prompt. Requests without a message to
+// answer say so instead of echoing nothing.
+func echoReply(prompt Message) string {
+	switch prompt.Role {
+	case "":
+		return "Echo: (no user message to echo)"
+	case "user":
+		return fmt.Sprintf("Echo: %s", prompt.Content)
+	}
+	return fmt.Sprintf("Echo (continuing after %s message): %s", prompt.Role, prompt.Content)
+}
 
+// createEchoResponse is echo mode's answer to req: n identical choices
+// replying to prompt, limited by stop and max_tokens.
+func createEchoResponse(requestID string, req ChatCompletionRequest, prompt Message) ChatCompletionResponse {
+	content, finishReason := echoCompletion(req, prompt)
+	choices := make([]Choice, echoChoices(req))
+	for i := range choices {
+		choices[i] = Choice{
+			Index:        i,
+			Message:      Message{Role: "assistant", Content: content},
+			FinishReason: finishReason,
+		}
+	}
 	return ChatCompletionResponse{
-		ID:     requestID,
-		Object: "chat.completion",
-		Choices: []Choice{
-			{
-				Index: 0,
-				Message: Message{
-					Role:    "assistant",
-					Content: replyContent,
-				},
-				FinishReason: "stop",
-			},
-		},
-		Usage: Usage{
-			PromptTokens:     promptTokens,
-			CompletionTokens: completionTokens,
-			TotalTokens:      promptTokens + completionTokens,
-		},
-	}
-}
-
-func forwardToBackend(backendURL string, req ChatCompletionRequest, requestID string) (ChatCompletionResponse, error) {
+		ID:                requestID,
+		Object:            "chat.completion",
+		Created:           time.Now().Unix(),
+		Model:             req.Model,
+		SystemFingerprint: echoSystemFingerprint,
+		Choices:           choices,
+		Usage:             echoUsage(req, content),
+	}
+}
+
+func forwardToBackend(ctx context.Context, backend *Backend, req ChatCompletionRequest, requestID string) (ChatCompletionResponse, error) {
+	resp, err := sendToBackend(ctx, backend, req, requestID)
+	if err != nil {
+		return ChatCompletionResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	transferStart := time.Now()
+	response, err := adapterFor(backend).decodeResponse(resp.Body)
+	if err != nil {
+		return ChatCompletionResponse{}, fmt.Errorf("failed to decode backend response: %w", err)
+	}
+	rec := recordFromContext(ctx)
+	rec.Timings.set(&rec.Timings.transfer, time.Since(transferStart))
+
+	return response, nil
+}
+
+// sendToBackend issues a non-streaming request and returns the backend's 200
+// response for the caller to read and close. Other statuses are returned as
+// *backendStatusError.
+func sendToBackend(ctx context.Context, backend *Backend, req ChatCompletionRequest, requestID string) (*http.Response, error) {
 	// Ensure we're not requesting streaming from backend
 	req.Stream = false
+	resp, err := doBackendRequest(ctx, poolFor(backend).client, backend, req, requestID)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = newUTF8Reader(resp.Body, backend.Name)
+	return resp, nil
+}
 
+// newBackendRequest builds the chat completions request sent to the backend,
+// in the backend's own wire format.
+func newBackendRequest(ctx context.Context, backend *Backend, req ChatCompletionRequest, requestID string) (*http.Request, error) {
+	httpReq, err := adapterFor(backend).newRequest(withBackendTrace(ctx), backend, req, requestID)
+	if err != nil {
+		return nil, err
+	}
+	setForwardingHeaders(ctx, httpReq, backend)
+	setAcceptEncoding(httpReq, backend)
+	return httpReq, nil
+}
+
+// newOpenAIRequest builds an OpenAI-format chat completions request.
+func newOpenAIRequest(ctx context.Context, backend *Backend, req ChatCompletionRequest, requestID string) (*http.Request, error) {
+	applyMaxTokensField(backend, &req)
+	// Streams always ask for usage, which billing needs; the relay hides it
+	// from clients that didn't ask for it
+	req.StreamOptions = nil
+	if req.Stream {
+		req.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
 	reqBody, err := json.Marshal(req)
 	if err != nil {
-		return ChatCompletionResponse{}, fmt.Errorf("failed to marshal request: %w", err)
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
 	// Build the full URL
-	url := strings.TrimSuffix(backendURL, "/") + "/v1/chat/completions"
+	url := backendURL(backend.URL, backend.chatPath())
 
-	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(reqBody))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqBody))
 	if err != nil {
-		return ChatCompletionResponse{}, fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	httpReq.Header.Set("Content-Type", "application/json")
 	httpReq.Header.Set("X-Request-ID", requestID)
+	return httpReq, nil
+}
 
-	resp, err := httpClient.Do(httpReq)
-	if err != nil {
-		return ChatCompletionResponse{}, fmt.Errorf("failed to forward request: %w", err)
-	}
-	defer resp.Body.Close()
+// backendStatusError is returned when the backend answers with a non-200 status.
+type backendStatusError struct {
+	StatusCode int
+	Body       string
+	Header     http.Header
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return ChatCompletionResponse{}, fmt.Errorf("backend returned status %d: %s", resp.StatusCode, string(body))
-	}
+func (e *backendStatusError) Error() string {
+	return fmt.Sprintf("backend returned status %d: %s", e.StatusCode, truncateExcerpt(describeErrorBody(e.Header, []byte(e.Body)), errorExcerptLimit()))
+}
 
-	var response ChatCompletionResponse
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return ChatCompletionResponse{}, fmt.Errorf("failed to decode backend response: %w", err)
+// envDuration reads a duration from the environment, falling back to def
+// when the variable is unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
 	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Invalid %s %q, using default %s", name, v, def)
+		return def
+	}
+	return d
+}
 
-	return response, nil
+// estimatePromptTokens approximates the prompt size of a whole conversation.
+func estimatePromptTokens(messages []Message) int {
+	var prompt strings.Builder
+	for _, m := range messages {
+		prompt.WriteString(m.Content)
+	}
+	return approximateTokens(prompt.String())
 }
 
 func approximateTokens(text string) int {
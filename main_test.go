@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/vinayhpandya/ai_inference_gateway/fakeback"
+)
+
+// useCatalog makes a catalog of models the active one for the test.
+func useCatalog(t *testing.T, models ...*ModelInfo) *modelCatalog {
+	t.Helper()
+	c := &modelCatalog{models: map[string]*ModelInfo{}, backends: map[string]*Backend{}}
+	for _, m := range models {
+		c.models[m.ID] = m
+	}
+	prev := catalog.Load()
+	catalog.Store(c)
+	t.Cleanup(func() { catalog.Store(prev) })
+	return c
+}
+
+func TestHasUserMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []Message
+		want     bool
+	}{
+		{"none", nil, false},
+		{"system only", []Message{{Role: "system", Content: "be brief"}}, false},
+		{"assistant only", []Message{{Role: "assistant", Content: "Hello! How can I help?"}}, false},
+		{"tool results", []Message{{Role: "system", Content: "s"}, {Role: "assistant", Content: "a"}, {Role: "tool", Content: "42"}}, false},
+		{"user turn", []Message{{Role: "system", Content: "s"}, {Role: "user", Content: "hi"}}, true},
+	}
+	for _, tt := range tests {
+		if got := hasUserMessage(tt.messages); got != tt.want {
+			t.Errorf("%s: hasUserMessage = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRequireUserMessageIsPerModel(t *testing.T) {
+	captureLog(t)
+	useCatalog(t,
+		&ModelInfo{ID: "strict", Backend: "echo", RequireUserMessage: true},
+		&ModelInfo{ID: "lenient", Backend: "echo"},
+	)
+	tests := []struct {
+		model, messages string
+		want            int
+	}{
+		{"strict", `[{"role":"system","content":"be brief"}]`, http.StatusBadRequest},
+		{"strict", `[{"role":"assistant","content":"Hello!"}]`, http.StatusBadRequest},
+		{"strict", `[{"role":"system","content":"be brief"},{"role":"user","content":"hi"}]`, http.StatusOK},
+		{"lenient", `[{"role":"system","content":"be brief"}]`, http.StatusOK},
+		{"lenient", `[{"role":"assistant","content":"Hello!"}]`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := chatAs("", `{"model":"`+tt.model+`","messages":`+tt.messages+`}`)
+		if w.Code != tt.want || (tt.want == http.StatusBadRequest && !strings.Contains(w.Body.String(), `"missing_user_message"`)) {
+			t.Errorf("%s %s: response = %d %s, want %d", tt.model, tt.messages, w.Code, w.Body, tt.want)
+		}
+	}
+}
+
+func TestTransparentRoutesRefuseRequireUserMessage(t *testing.T) {
+	p := &transparentProxy{paths: []string{"/v1/chat/completions"}}
+	c := useCatalog(t, &ModelInfo{ID: "strict", RequireUserMessage: true})
+	if err := p.checkCatalog(c); err == nil {
+		t.Error("catalog with require_user_message accepted")
+	}
+}
+
+// useFakeBackend points the default backend at a fakeback server for the
+// test.
+func useFakeBackend(t *testing.T) *fakeback.Server {
+	t.Helper()
+	back := fakeback.New()
+	t.Cleanup(back.Close)
+	t.Setenv("BACKEND_URL", back.URL)
+	t.Setenv("BACKEND_TYPE", "openai")
+	return back
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// maxTokensFields are the names OpenAI-compatible servers use for the
+// completion token limit. OpenAI deprecated max_tokens in favor of
+// max_completion_tokens, but many servers understand only one of them.
+var maxTokensFields = []string{"max_tokens", "max_completion_tokens"}
+
+// normalizeMaxTokens folds max_completion_tokens into MaxTokens, which is
+// the gateway's one completion limit from here until the request is sent.
+// Clients may set either field, or both with the same value.
+func normalizeMaxTokens(req *ChatCompletionRequest) error {
+	if req.MaxCompletionTokens == nil {
+		return nil
+	}
+	if req.MaxTokens != nil && *req.MaxTokens != *req.MaxCompletionTokens {
+		return fmt.Errorf("max_tokens (%d) and max_completion_tokens (%d) conflict; set only one",
+			*req.MaxTokens, *req.MaxCompletionTokens)
+	}
+	req.MaxTokens, req.MaxCompletionTokens = req.MaxCompletionTokens, nil
+	return nil
+}
+
+// applyMaxTokensField renames the completion limit to the field an
+// OpenAI-compatible backend expects.
+func applyMaxTokensField(backend *Backend, req *ChatCompletionRequest) {
+	if backend.MaxTokensField == "max_completion_tokens" {
+		req.MaxTokens, req.MaxCompletionTokens = nil, req.MaxTokens
+	}
+}
+
+func validMaxTokensField(field string) bool {
+	return field == "" || slices.Contains(maxTokensFields, field)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeMaxTokens(t *testing.T) {
+	n := func(v int) *int { return &v }
+	tests := []struct {
+		name                  string
+		maxTokens, completion *int
+		want                  *int
+		err                   bool
+	}{
+		{"neither", nil, nil, nil, false},
+		{"old field", n(50), nil, n(50), false},
+		{"new field", nil, n(50), n(50), false},
+		{"both alike", n(50), n(50), n(50), false},
+		{"conflict", n(50), n(60), nil, true},
+	}
+	for _, tt := range tests {
+		req := ChatCompletionRequest{MaxTokens: tt.maxTokens, MaxCompletionTokens: tt.completion}
+		err := normalizeMaxTokens(&req)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: err = %v", tt.name, err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		if req.MaxCompletionTokens != nil || (req.MaxTokens == nil) != (tt.want == nil) || (tt.want != nil && *req.MaxTokens != *tt.want) {
+			t.Errorf("%s: max_tokens %v, max_completion_tokens %v; want max_tokens %v", tt.name, req.MaxTokens, req.MaxCompletionTokens, tt.want)
+		}
+	}
+}
+
+func TestMaxTokensTranslatedPerBackend(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	t.Setenv("BACKEND_URL", "")
+	c := useCatalog(t, &ModelInfo{ID: "old", Backend: "old"}, &ModelInfo{ID: "new", Backend: "new"})
+	c.backends["old"] = &Backend{Name: "old", Type: "vllm", URL: back.URL}
+	c.backends["new"] = &Backend{Name: "new", Type: "openai", URL: back.URL, MaxTokensField: "max_completion_tokens"}
+
+	tests := []struct {
+		name, model, limit, want, absent string
+	}{
+		{"old client to old backend", "old", `"max_tokens":50`, "max_tokens", "max_completion_tokens"},
+		{"new client to old backend", "old", `"max_completion_tokens":50`, "max_tokens", "max_completion_tokens"},
+		{"old client to new backend", "new", `"max_tokens":50`, "max_completion_tokens", "max_tokens"},
+		{"new client to new backend", "new", `"max_completion_tokens":50`, "max_completion_tokens", "max_tokens"},
+		{"both to new backend", "new", `"max_tokens":50,"max_completion_tokens":50`, "max_completion_tokens", "max_tokens"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := chatAs("", `{"model":"`+tt.model+`",`+tt.limit+`,"messages":[{"role":"user","content":"hi"}]}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			reqs := back.Requests()
+			var sent map[string]json.RawMessage
+			if err := reqs[len(reqs)-1].Decode(&sent); err != nil {
+				t.Fatal(err)
+			}
+			if string(sent[tt.want]) != "50" {
+				t.Errorf("backend got %s = %s, want 50", tt.want, sent[tt.want])
+			}
+			if v, ok := sent[tt.absent]; ok {
+				t.Errorf("backend also got %s = %s", tt.absent, v)
+			}
+		})
+	}
+}
+
+func TestMaxTokensConflict(t *testing.T) {
+	captureLog(t)
+	useFakeBackend(t)
+	w := chatAs("", `{"model":"m","max_tokens":50,"max_completion_tokens":60,"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"code":"conflicting_parameters"`) {
+		t.Errorf("response = %d %s, want 400 conflicting_parameters", w.Code, w.Body)
+	}
+}
+
+func TestModelLimitAppliesToEitherField(t *testing.T) {
+	captureLog(t)
+	useFakeBackend(t)
+	useCatalog(t, &ModelInfo{ID: "m", MaxOutputTokens: 100})
+	for _, field := range maxTokensFields {
+		w := chatAs("", `{"model":"m","`+field+`":500,"messages":[{"role":"user","content":"hi"}]}`)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "exceeds the 100 output tokens") {
+			t.Errorf("%s over the model's limit: response = %d %s", field, w.Code, w.Body)
+		}
+		if w := chatAs("", `{"model":"m","`+field+`":100,"messages":[{"role":"user","content":"hi"}]}`); w.Code != http.StatusOK {
+			t.Errorf("%s at the model's limit: response = %d %s", field, w.Code, w.Body)
+		}
+	}
+}
+
+func TestValidMaxTokensField(t *testing.T) {
+	for field, want := range map[string]bool{"": true, "max_tokens": true, "max_completion_tokens": true, "max_new_tokens": false} {
+		if got := validMaxTokensField(field); got != want {
+			t.Errorf("validMaxTokensField(%q) = %t", field, got)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultMessageSeparator   = "\n\n"
+	defaultMessagePlaceholder = "(continued)"
+)
+
+// MessageNormalization reshapes conversations for backends that reject
+// some message orders: two user messages in a row, a leading assistant
+// message, several system messages. Unset fields keep the backend type's
+// default: everything on for bedrock and gemini, whose APIs require
+// alternating turns, and off for the rest.
+type MessageNormalization struct {
+	// DropEmpty drops messages with no content but whitespace
+	DropEmpty *bool `json:"drop_empty,omitempty"`
+	// SingleSystem moves system messages to the front, merged into one
+	SingleSystem *bool `json:"single_system,omitempty"`
+	// MergeConsecutive merges messages in a row from the same role
+	MergeConsecutive *bool `json:"merge_consecutive,omitempty"`
+	// Alternate makes turns alternate starting with user: roles other
+	// than system and assistant count as user, and a conversation that
+	// would start with assistant, or has no turns, gets Placeholder as a
+	// user message first
+	Alternate *bool `json:"alternate,omitempty"`
+	// Separator joins merged contents (default a blank line)
+	Separator *string `json:"separator,omitempty"`
+	// Placeholder is the content of added user messages (default
+	// "(continued)")
+	Placeholder string `json:"placeholder,omitempty"`
+}
+
+// messageRules is a backend's effective normalization.
+type messageRules struct {
+	dropEmpty, singleSystem, merge, alternate bool
+	separator, placeholder                    string
+}
+
+func (r messageRules) any() bool {
+	return r.dropEmpty || r.singleSystem || r.merge || r.alternate
+}
+
+// strictTurnTypes are the backend types that require alternating turns.
+var strictTurnTypes = map[string]bool{"bedrock": true, "gemini": true}
+
+// messageRules resolves b's normalization against its type's defaults.
+func (b *Backend) messageRules() messageRules {
+	strict := strictTurnTypes[b.Type]
+	r := messageRules{dropEmpty: strict, singleSystem: strict, merge: strict, alternate: strict,
+		separator: defaultMessageSeparator, placeholder: defaultMessagePlaceholder}
+	n := b.MessageNormalization
+	if n == nil {
+		return r
+	}
+	for _, f := range []struct {
+		set *bool
+		dst *bool
+	}{{n.DropEmpty, &r.dropEmpty}, {n.SingleSystem, &r.singleSystem}, {n.MergeConsecutive, &r.merge}, {n.Alternate, &r.alternate}} {
+		if f.set != nil {
+			*f.dst = *f.set
+		}
+	}
+	if n.Separator != nil {
+		r.separator = *n.Separator
+	}
+	if n.Placeholder != "" {
+		r.placeholder = n.Placeholder
+	}
+	return r
+}
+
+// normalizeMessages applies rules to messages, returning the result and a
+// description of each change made. messages itself is left as it was.
+func normalizeMessages(messages []Message, rules messageRules) ([]Message, []string) {
+	if !rules.any() || len(messages) == 0 && !rules.alternate {
+		return messages, nil
+	}
+	var applied []string
+	out := make([]Message, 0, len(messages))
+
+	dropped := 0
+	for _, m := range messages {
+		if rules.dropEmpty && strings.TrimSpace(m.Content) == "" {
+			dropped++
+			continue
+		}
+		out = append(out, m)
+	}
+	if dropped > 0 {
+		applied = append(applied, fmt.Sprintf("dropped %d empty messages", dropped))
+	}
+
+	if rules.singleSystem {
+		var system []string
+		rest := out[:0:0]
+		moved := false
+		for i, m := range out {
+			if m.Role == "system" {
+				system = append(system, m.Content)
+				moved = moved || i >= len(system)
+				continue
+			}
+			rest = append(rest, m)
+		}
+		switch {
+		case len(system) > 1:
+			applied = append(applied, fmt.Sprintf("merged %d system messages into one at the front", len(system)))
+		case moved:
+			applied = append(applied, "moved the system message to the front")
+		}
+		if len(system) > 0 {
+			out = append([]Message{{Role: "system", Content: strings.Join(system, rules.separator)}}, rest...)
+		}
+	}
+
+	if rules.alternate {
+		mapped := map[string]bool{}
+		for i, m := range out {
+			if m.Role != "system" && m.Role != "assistant" && m.Role != "user" {
+				mapped[m.Role] = true
+				out[i].Role = "user"
+			}
+		}
+		for _, role := range sortedKeys(mapped) {
+			applied = append(applied, fmt.Sprintf("sent %s messages as user", role))
+		}
+	}
+
+	if rules.merge || rules.alternate {
+		// merged counts every message folded into a run, the first included
+		merged := map[string]int{}
+		kept := out[:0]
+		inRun := false
+		for _, m := range out {
+			// Alternation alone leaves system messages as they are
+			if n := len(kept); n > 0 && kept[n-1].Role == m.Role && (m.Role != "system" || rules.merge) {
+				kept[n-1].Content += rules.separator + m.Content
+				if !inRun {
+					merged[m.Role]++
+				}
+				merged[m.Role]++
+				inRun = true
+				continue
+			}
+			kept = append(kept, m)
+			inRun = false
+		}
+		out = kept
+		for _, role := range sortedKeys(merged) {
+			applied = append(applied, fmt.Sprintf("merged %d consecutive %s messages", merged[role], role))
+		}
+	}
+
+	if rules.alternate {
+		first := 0
+		for first < len(out) && out[first].Role == "system" {
+			first++
+		}
+		if first == len(out) || out[first].Role != "user" {
+			out = append(out[:first], append([]Message{{Role: "user", Content: rules.placeholder}}, out[first:]...)...)
+			if first+1 == len(out) {
+				applied = append(applied, "added a placeholder user message to a conversation with none")
+			} else {
+				applied = append(applied, "added a placeholder user message before the leading assistant message")
+			}
+		}
+	}
+	return out, applied
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// normalizeForBackend applies backend's message normalization and request
+// field policy to req and returns the changes made. With
+// MESSAGE_NORMALIZATION_DEBUG=true message changes are logged.
+func normalizeForBackend(req *ChatCompletionRequest, backend *Backend, requestID string) []string {
+	messages, applied := normalizeMessages(req.Messages, backend.messageRules())
+	if len(applied) > 0 {
+		req.Messages = messages
+		if os.Getenv("MESSAGE_NORMALIZATION_DEBUG") == "true" {
+			log.Printf("Normalized messages for request %s (backend %s): %s", requestID, backend.Name, strings.Join(applied, "; "))
+		}
+	}
+	return append(applied, shapeRequest(req, backend)...)
+}
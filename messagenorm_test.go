@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// convo builds messages from "role:content" strings.
+func convo(turns ...string) []Message {
+	messages := make([]Message, 0, len(turns))
+	for _, turn := range turns {
+		role, content, _ := strings.Cut(turn, ":")
+		messages = append(messages, Message{Role: role, Content: content})
+	}
+	return messages
+}
+
+// Golden conversations as Anthropic models on Bedrock require them: one
+// leading system prompt, then user and assistant strictly alternating,
+// starting with user.
+func TestNormalizeMessagesGolden(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []Message
+		want    []Message
+		applied []string
+	}{
+		{"already alternating",
+			convo("system:Be brief.", "user:hi", "assistant:hello", "user:bye"),
+			convo("system:Be brief.", "user:hi", "assistant:hello", "user:bye"),
+			nil},
+		{"consecutive user turns",
+			convo("user:first", "user:second", "assistant:ok"),
+			convo("user:first\n\nsecond", "assistant:ok"),
+			[]string{"merged 2 consecutive user messages"}},
+		{"consecutive assistant turns",
+			convo("user:q", "assistant:a1", "assistant:a2", "assistant:a3"),
+			convo("user:q", "assistant:a1\n\na2\n\na3"),
+			[]string{"merged 3 consecutive assistant messages"}},
+		{"leading assistant",
+			convo("assistant:How can I help?", "user:hi"),
+			convo("user:(continued)", "assistant:How can I help?", "user:hi"),
+			[]string{"added a placeholder user message before the leading assistant message"}},
+		{"leading assistant after system",
+			convo("system:s", "assistant:greeting", "user:hi"),
+			convo("system:s", "user:(continued)", "assistant:greeting", "user:hi"),
+			[]string{"added a placeholder user message before the leading assistant message"}},
+		{"scattered system messages",
+			convo("system:one", "user:hi", "system:two", "assistant:ok", "system:three"),
+			convo("system:one\n\ntwo\n\nthree", "user:hi", "assistant:ok"),
+			[]string{"merged 3 system messages into one at the front"}},
+		{"late system message",
+			convo("user:hi", "system:rules", "assistant:ok"),
+			convo("system:rules", "user:hi", "assistant:ok"),
+			[]string{"moved the system message to the front"}},
+		{"hoisting joins user turns",
+			convo("user:a", "system:s", "user:b"),
+			convo("system:s", "user:a\n\nb"),
+			[]string{"moved the system message to the front", "merged 2 consecutive user messages"}},
+		{"empty messages",
+			convo("user:a", "assistant: \n", "user:b", "assistant:"),
+			convo("user:a\n\nb"),
+			[]string{"dropped 2 empty messages", "merged 2 consecutive user messages"}},
+		{"tool and developer roles",
+			convo("developer:d", "user:q", "assistant:calling", "tool:42", "user:thanks"),
+			convo("user:d\n\nq", "assistant:calling", "user:42\n\nthanks"),
+			[]string{"sent developer messages as user", "sent tool messages as user", "merged 4 consecutive user messages"}},
+		{"system only",
+			convo("system:s"),
+			convo("system:s", "user:(continued)"),
+			[]string{"added a placeholder user message to a conversation with none"}},
+		{"no messages",
+			nil,
+			convo("user:(continued)"),
+			[]string{"added a placeholder user message to a conversation with none"}},
+		{"everything at once",
+			convo("assistant:hi", "system:a", "assistant:again", "user:", "tool:t", "user:u", "system:b"),
+			convo("system:a\n\nb", "user:(continued)", "assistant:hi\n\nagain", "user:t\n\nu"),
+			[]string{
+				"dropped 1 empty messages",
+				"merged 2 system messages into one at the front",
+				"sent tool messages as user",
+				"merged 2 consecutive assistant messages",
+				"merged 2 consecutive user messages",
+				"added a placeholder user message before the leading assistant message",
+			}},
+	}
+	rules := (&Backend{Type: "bedrock"}).messageRules()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := slices.Clone(tt.in)
+			got, applied := normalizeMessages(tt.in, rules)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("messages = %q\nwant %q", got, tt.want)
+			}
+			if !slices.Equal(applied, tt.applied) {
+				t.Errorf("applied = %q\nwant %q", applied, tt.applied)
+			}
+			if !slices.Equal(tt.in, in) {
+				t.Errorf("input changed to %q", tt.in)
+			}
+			// Normalized conversations are a fixed point
+			if again, applied := normalizeMessages(got, rules); !slices.Equal(again, got) || applied != nil {
+				t.Errorf("normalizing again gave %q, %q", again, applied)
+			}
+		})
+	}
+}
+
+func TestMessageRulesPerBackend(t *testing.T) {
+	on, off := true, false
+	newline := "\n"
+	input := convo("assistant:a", "user:u1", "user:u2", "system:s")
+	tests := []struct {
+		name    string
+		backend *Backend
+		want    []Message
+	}{
+		{"openai default", &Backend{Type: "openai"}, input},
+		{"vllm default", &Backend{Type: "vllm"}, input},
+		{"gemini default", &Backend{Type: "gemini"},
+			convo("system:s", "user:(continued)", "assistant:a", "user:u1\n\nu2")},
+		{"vllm merging with a newline", &Backend{Type: "vllm", MessageNormalization: &MessageNormalization{MergeConsecutive: &on, Separator: &newline}},
+			convo("assistant:a", "user:u1\nu2", "system:s")},
+		{"bedrock without alternation", &Backend{Type: "bedrock", MessageNormalization: &MessageNormalization{Alternate: &off}},
+			convo("system:s", "assistant:a", "user:u1\n\nu2")},
+		{"bedrock with its own placeholder", &Backend{Type: "bedrock", MessageNormalization: &MessageNormalization{Placeholder: "Continue."}},
+			convo("system:s", "user:Continue.", "assistant:a", "user:u1\n\nu2")},
+		{"alternation alone", &Backend{Type: "openai", MessageNormalization: &MessageNormalization{Alternate: &on}},
+			convo("user:(continued)", "assistant:a", "user:u1\n\nu2", "system:s")},
+	}
+	for _, tt := range tests {
+		got, _ := normalizeMessages(input, tt.backend.messageRules())
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Alternation alone merges turns but leaves system messages apart
+	got, _ := normalizeMessages(convo("system:a", "system:b", "user:u"), (&Backend{MessageNormalization: &MessageNormalization{Alternate: &on}}).messageRules())
+	if want := convo("system:a", "system:b", "user:u"); !slices.Equal(got, want) {
+		t.Errorf("alternation alone: %q, want %q", got, want)
+	}
+}
+
+func TestMessageNormalizationInDryRun(t *testing.T) {
+	logs := captureLog(t)
+	t.Setenv("DRY_RUN_KEYS", "*")
+	t.Setenv("MESSAGE_NORMALIZATION_DEBUG", "true")
+	back := useFakeBackend(t)
+	t.Setenv("BACKEND_URL", "")
+	c := useCatalog(t, &ModelInfo{ID: "m", Backend: "strict"})
+	c.backends["strict"] = &Backend{Name: "strict", Type: "gemini", URL: back.URL}
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"m","messages":[{"role":"assistant","content":"secret greeting"},{"role":"user","content":"a"},{"role":"user","content":"b"}]}`))
+	r.Header.Set(dryRunHeader, "true")
+	w := httptest.NewRecorder()
+	accessLog(http.HandlerFunc(chatCompletionsHandler)).ServeHTTP(w, r)
+	var report dryRunReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	for _, want := range []string{"merged 2 consecutive user messages", "added a placeholder user message before the leading assistant message"} {
+		if !slices.Contains(report.Transforms, want) {
+			t.Errorf("transforms = %q, want %q", report.Transforms, want)
+		}
+	}
+	var sent ChatCompletionRequest
+	json.Unmarshal(report.Request, &sent)
+	if want := convo("user:(continued)", "assistant:secret greeting", "user:a\n\nb"); !slices.Equal(sent.Messages, want) {
+		t.Errorf("request as sent = %q, want %q", sent.Messages, want)
+	}
+	if !strings.Contains(logs.String(), "Normalized messages for request") || strings.Contains(logs.String(), "secret greeting") {
+		t.Errorf("debug log = %s", logs)
+	}
+}
+
+// benchConversation is a long agent transcript with the problems strict
+// backends reject: repeated roles, tool turns and a late system message.
+func benchConversation(turns int) []Message {
+	messages := convo("system:You are a coding agent.")
+	for i := range turns {
+		messages = append(messages,
+			Message{Role: "user", Content: fmt.Sprintf("step %d", i)},
+			Message{Role: "assistant", Content: strings.Repeat("thinking ", 40)},
+			Message{Role: "tool", Content: strings.Repeat("output ", 80)},
+			Message{Role: "tool", Content: ""},
+		)
+	}
+	return append(messages, Message{Role: "system", Content: "Wrap up."})
+}
+
+func BenchmarkNormalizeMessages(b *testing.B) {
+	messages := benchConversation(50)
+	rules := (&Backend{Type: "bedrock"}).messageRules()
+	for b.Loop() {
+		normalizeMessages(messages, rules)
+	}
+}
+
+// Backends without rules, the common case, must not pay for them.
+func BenchmarkNormalizeMessagesOff(b *testing.B) {
+	messages := benchConversation(50)
+	rules := (&Backend{Type: "openai"}).messageRules()
+	b.ReportAllocs()
+	for b.Loop() {
+		normalizeMessages(messages, rules)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// histogram is a fixed-bucket latency histogram published through expvar in
+// Prometheus style: cumulative bucket counts keyed by upper bound.
+type histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []int64
+	count   int64
+	sum     float64
+}
+
+// latencyBuckets are upper bounds in seconds for request-latency histograms.
+var latencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+func newHistogram(name string, bounds []float64) *histogram {
+	h := &histogram{bounds: bounds, buckets: make([]int64, len(bounds))}
+	expvar.Publish(name, expvar.Func(h.snapshot))
+	return h
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) snapshot() any {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets := make(map[string]int64, len(h.bounds)+1)
+	for i, bound := range h.bounds {
+		buckets[fmt.Sprintf("%g", bound)] = h.buckets[i]
+	}
+	buckets["+Inf"] = h.count
+	return map[string]any{"buckets": buckets, "count": h.count, "sum": h.sum}
+}
+
+// requireMetrics guards /debug/vars and /metrics with ADMIN_TOKEN, as the
+// admin endpoints are, unless METRICS_PUBLIC=true opens them to anyone who
+// can reach the gateway.
+func requireMetrics(next http.HandlerFunc) http.HandlerFunc {
+	if os.Getenv("METRICS_PUBLIC") == "true" {
+		return next
+	}
+	return requireAdmin(next)
+}
+
+// metricsHandler implements GET /metrics: the SLO series, in the
+// OpenMetrics text format for scraping. Everything else is in /debug/vars.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", usageContentType("openmetrics"))
+	slos.writeOpenMetrics(w)
+}
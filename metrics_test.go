@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsNeedAdminToken(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "adm")
+	h := requireMetrics(metricsHandler)
+	for token, want := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "adm": http.StatusOK} {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != want {
+			t.Errorf("token %q: status = %d, want %d", token, w.Code, want)
+		}
+	}
+}
+
+func TestMetricsPublicOptIn(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "adm")
+	t.Setenv("METRICS_PUBLIC", "true")
+	w := httptest.NewRecorder()
+	requireMetrics(metricsHandler)(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/openmetrics-text; version=1.0.0; charset=utf-8" {
+		t.Errorf("status = %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+}
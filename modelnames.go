@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// modelNameRules are how client-supplied model names are normalized before
+// they are looked up, so GPT-4o, openai/gpt-4o and gpt-4o name one model.
+type modelNameRules struct {
+	// fold trims whitespace and lowercases, from MODEL_NAME_NORMALIZE=true
+	fold bool
+	// prefixes are vendor prefixes to strip, from MODEL_NAME_STRIP_PREFIXES
+	prefixes []string
+}
+
+// loadModelNameRules reads MODEL_NAME_NORMALIZE and the comma-separated
+// MODEL_NAME_STRIP_PREFIXES, such as "openai/,anthropic/".
+func loadModelNameRules() modelNameRules {
+	r := modelNameRules{fold: os.Getenv("MODEL_NAME_NORMALIZE") == "true"}
+	for _, p := range strings.Split(os.Getenv("MODEL_NAME_STRIP_PREFIXES"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			if r.fold {
+				p = strings.ToLower(p)
+			}
+			r.prefixes = append(r.prefixes, p)
+		}
+	}
+	return r
+}
+
+// normalize applies the rules to name, describing each step that changed it.
+func (r modelNameRules) normalize(name string) (string, []string) {
+	var steps []string
+	if r.fold {
+		if trimmed := strings.TrimSpace(name); trimmed != name {
+			name = trimmed
+			steps = append(steps, "trimmed whitespace")
+		}
+		if lower := strings.ToLower(name); lower != name {
+			name = lower
+			steps = append(steps, "lowercased")
+		}
+	}
+	for _, p := range r.prefixes {
+		if rest, ok := strings.CutPrefix(name, p); ok && rest != "" {
+			name = rest
+			steps = append(steps, fmt.Sprintf("stripped prefix %q", p))
+			break
+		}
+	}
+	return name, steps
+}
+
+// indexNames maps the normalized form of every model ID and alias to its
+// model, rejecting names that would be ambiguous.
+func (c *modelCatalog) indexNames() error {
+	c.nameRules = loadModelNameRules()
+	c.names = make(map[string]string)
+	add := func(name, id string) error {
+		key, _ := c.nameRules.normalize(name)
+		if other, ok := c.names[key]; ok && other != id {
+			return fmt.Errorf("model name %q of %q normalizes to %q, which already names %q", name, id, key, other)
+		}
+		c.names[key] = id
+		return nil
+	}
+	ids := make([]string, 0, len(c.models))
+	for id := range c.models {
+		ids = append(ids, id)
+	}
+	// In order, so which conflict is reported doesn't vary
+	sort.Strings(ids)
+	for _, id := range ids {
+		if err := add(id, id); err != nil {
+			return err
+		}
+	}
+	for _, id := range ids {
+		for _, alias := range c.models[id].Aliases {
+			if _, ok := c.models[alias]; ok {
+				return fmt.Errorf("model %q has alias %q, which is a model ID", id, alias)
+			}
+			if err := add(alias, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolveName maps a client-supplied model name to a catalog ID: an exact
+// ID as is, otherwise its normalized form, then the alias table. Names
+// that resolve to nothing are returned unchanged for the default backend.
+// steps describes how the name was resolved.
+func (c *modelCatalog) resolveName(name string) (string, []string) {
+	if _, ok := c.models[name]; ok {
+		return name, nil
+	}
+	key, steps := c.nameRules.normalize(name)
+	id, ok := c.names[key]
+	if !ok {
+		return name, nil
+	}
+	if id != key {
+		steps = append(steps, fmt.Sprintf("alias %q", key))
+	}
+	return id, steps
+}
+
+// responseModel is the model name a response reports, or "" to keep the
+// backend's. A name the gateway resolved is reported as the client sent it,
+// unless the model sets reveal_resolved_name.
+func responseModel(rec *requestRecord) string {
+	if rec.ClientModel == "" {
+		return ""
+	}
+	if m, ok := rec.admittedCatalog().lookup(rec.Model); ok && m.RevealResolvedName {
+		return rec.Model
+	}
+	return rec.ClientModel
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/vinayhpandya/ai_inference_gateway/fakeback"
+)
+
+func TestNormalizeModelName(t *testing.T) {
+	tests := []struct {
+		name     string
+		fold     bool
+		prefixes string
+		in, want string
+		steps    []string
+	}{
+		{"off", false, "", " GPT-4o ", " GPT-4o ", nil},
+		{"already normal", true, "openai/", "gpt-4o", "gpt-4o", nil},
+		{"case", true, "", "GPT-4o", "gpt-4o", []string{"lowercased"}},
+		{"whitespace", true, "", " gpt-4o\t", "gpt-4o", []string{"trimmed whitespace"}},
+		{"vendor prefix", false, "openai/", "openai/gpt-4o", "gpt-4o", []string{`stripped prefix "openai/"`}},
+		{"prefix case needs folding", false, "openai/", "OpenAI/gpt-4o", "OpenAI/gpt-4o", nil},
+		{"everything", true, "OpenAI/, anthropic/", "  OpenAI/GPT-4o ", "gpt-4o", []string{"trimmed whitespace", "lowercased", `stripped prefix "openai/"`}},
+		{"first prefix only", true, "openai/,azure/", "openai/azure/gpt-4o", "azure/gpt-4o", []string{`stripped prefix "openai/"`}},
+		{"second prefix", true, "openai/,anthropic/", "anthropic/claude-3", "claude-3", []string{`stripped prefix "anthropic/"`}},
+		{"prefix is the whole name", true, "openai/", "openai/", "openai/", nil},
+		{"prefix mid-name", true, "openai/", "my-openai/gpt-4o", "my-openai/gpt-4o", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MODEL_NAME_NORMALIZE", map[bool]string{true: "true", false: ""}[tt.fold])
+			t.Setenv("MODEL_NAME_STRIP_PREFIXES", tt.prefixes)
+			got, steps := loadModelNameRules().normalize(tt.in)
+			if got != tt.want || !slices.Equal(steps, tt.steps) {
+				t.Errorf("normalize(%q) = %q %q, want %q %q", tt.in, got, steps, tt.want, tt.steps)
+			}
+		})
+	}
+}
+
+// useNamedCatalog makes models the active catalog with names indexed under
+// MODEL_NAME_NORMALIZE=true and the openai/ prefix stripped.
+func useNamedCatalog(t *testing.T, models ...*ModelInfo) *modelCatalog {
+	t.Helper()
+	t.Setenv("MODEL_NAME_NORMALIZE", "true")
+	t.Setenv("MODEL_NAME_STRIP_PREFIXES", "openai/")
+	c := useCatalog(t, models...)
+	if err := c.indexNames(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestResolveModelName(t *testing.T) {
+	c := useNamedCatalog(t, &ModelInfo{ID: "gpt-4o", Aliases: []string{"4o", "GPT4o"}}, &ModelInfo{ID: "Llama-3-70B"})
+	tests := []struct {
+		in, want string
+		steps    []string
+	}{
+		{"gpt-4o", "gpt-4o", nil},
+		{"Llama-3-70B", "Llama-3-70B", nil},
+		{"llama-3-70b", "Llama-3-70B", []string{`alias "llama-3-70b"`}},
+		{"GPT-4o", "gpt-4o", []string{"lowercased"}},
+		{"openai/gpt-4o", "gpt-4o", []string{`stripped prefix "openai/"`}},
+		{" OPENAI/GPT-4O", "gpt-4o", []string{"trimmed whitespace", "lowercased", `stripped prefix "openai/"`}},
+		{"4o", "gpt-4o", []string{`alias "4o"`}},
+		{"openai/GPT4O", "gpt-4o", []string{"lowercased", `stripped prefix "openai/"`, `alias "gpt4o"`}},
+		{"GPT-5", "GPT-5", nil},
+	}
+	for _, tt := range tests {
+		got, steps := c.resolveName(tt.in)
+		if got != tt.want || !slices.Equal(steps, tt.steps) {
+			t.Errorf("resolveName(%q) = %q %q, want %q %q", tt.in, got, steps, tt.want, tt.steps)
+		}
+	}
+}
+
+func TestAmbiguousModelNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		models []*ModelInfo
+		err    string
+	}{
+		{"ids differ by case", []*ModelInfo{{ID: "GPT-4o"}, {ID: "gpt-4o"}},
+			`model name "gpt-4o" of "gpt-4o" normalizes to "gpt-4o", which already names "GPT-4o"`},
+		{"alias is a model ID", []*ModelInfo{{ID: "a", Aliases: []string{"b"}}, {ID: "b"}},
+			`model "a" has alias "b", which is a model ID`},
+		{"alias matches another model", []*ModelInfo{{ID: "a", Aliases: []string{"openai/B"}}, {ID: "b"}},
+			`model name "openai/B" of "a" normalizes to "b", which already names "b"`},
+		{"shared alias", []*ModelInfo{{ID: "a", Aliases: []string{"x"}}, {ID: "b", Aliases: []string{"X"}}},
+			`model name "X" of "b" normalizes to "x", which already names "a"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MODEL_NAME_NORMALIZE", "true")
+			t.Setenv("MODEL_NAME_STRIP_PREFIXES", "openai/")
+			c := &modelCatalog{models: map[string]*ModelInfo{}}
+			for _, m := range tt.models {
+				c.models[m.ID] = m
+			}
+			if err := c.indexNames(); err == nil || err.Error() != tt.err {
+				t.Errorf("err = %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestResolvedModelNameInDryRun(t *testing.T) {
+	captureLog(t)
+	t.Setenv("DRY_RUN_KEYS", "*")
+	useFakeBackend(t)
+	useNamedCatalog(t, &ModelInfo{ID: "gpt-4o", Aliases: []string{"4o"}})
+
+	tests := []struct {
+		requested, transform string
+	}{
+		{"OpenAI/GPT-4o", `model "OpenAI/GPT-4o" resolved to "gpt-4o": lowercased, stripped prefix "openai/"`},
+		{"4o", `model "4o" resolved to "gpt-4o": alias "4o"`},
+		{"gpt-4o", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"`+tt.requested+`","messages":[{"role":"user","content":"hi"}]}`))
+		r.Header.Set(dryRunHeader, "true")
+		w := httptest.NewRecorder()
+		accessLog(http.HandlerFunc(chatCompletionsHandler)).ServeHTTP(w, r)
+		var report dryRunReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("%v: %s", err, w.Body)
+		}
+		wantRequested := tt.requested
+		if tt.transform == "" {
+			wantRequested = ""
+		}
+		if report.Model != "gpt-4o" || report.RequestedModel != wantRequested {
+			t.Errorf("%s: model %q, requested_model %q", tt.requested, report.Model, report.RequestedModel)
+		}
+		if got := slices.Contains(report.Transforms, tt.transform); got != (tt.transform != "") {
+			t.Errorf("%s: transforms = %q, want %q", tt.requested, report.Transforms, tt.transform)
+		}
+	}
+}
+
+func TestResponsesReportRequestedModel(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	c := useNamedCatalog(t, &ModelInfo{ID: "gpt-4o", Aliases: []string{"4o"}}, &ModelInfo{ID: "llama", Aliases: []string{"meta-llama"}, RevealResolvedName: true})
+
+	for _, tt := range []struct {
+		requested, want string
+	}{
+		{"GPT-4o", "GPT-4o"},
+		{"4o", "4o"},
+		{"gpt-4o", "gpt-4o"},
+		{"meta-llama", "llama"},
+	} {
+		for _, stream := range []bool{false, true} {
+			back.Enqueue(fakeback.Behavior{Chunks: []string{"a", "b"}})
+			body := `{"model":"` + tt.requested + `","messages":[{"role":"user","content":"hi"}]}`
+			if stream {
+				body = strings.Replace(body, `{`, `{"stream":true,`, 1)
+			}
+			w := chatAs("", body)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: status = %d: %s", tt.requested, w.Code, w.Body)
+			}
+			last, _ := back.Last()
+			var sent ChatCompletionRequest
+			last.Decode(&sent)
+			want, _ := c.resolveName(tt.requested)
+			if sent.Model != want {
+				t.Errorf("%s: backend got model %q, want %q", tt.requested, sent.Model, want)
+			}
+
+			var models []string
+			if stream {
+				for _, e := range sseEvents(w.Body.String()) {
+					var chunk ChatCompletionChunk
+					if json.Unmarshal([]byte(e), &chunk) == nil && chunk.Model != "" {
+						models = append(models, chunk.Model)
+					}
+				}
+			} else {
+				var resp ChatCompletionResponse
+				json.Unmarshal(w.Body.Bytes(), &resp)
+				models = []string{resp.Model}
+			}
+			if len(models) == 0 {
+				t.Fatalf("%s stream %t: no model in %s", tt.requested, stream, w.Body)
+			}
+			for _, m := range models {
+				if m != tt.want {
+					t.Errorf("%s stream %t: response model %q, want %q", tt.requested, stream, m, tt.want)
+				}
+			}
+		}
+	}
+}
+
+func TestRewriteChunkField(t *testing.T) {
+	tests := []struct {
+		data, field, to, want string
+	}{
+		{`{"id":"x","model":"gpt-4o","choices":[]}`, "model", "GPT-4o", `{"id":"x","model":"GPT-4o","choices":[]}`},
+		{`{"id": "x", "model" : "m"}`, "model", "n", `{"id": "x", "model" : "n"}`},
+		{`{"choices":[{"model":"inner"}],"model":"m"}`, "model", "n", `{"choices":[{"model":"inner"}],"model":"n"}`},
+		{`{"id":"x"}`, "model", "n", `{"id":"x"}`},
+		{`not json`, "model", "n", `not json`},
+	}
+	for _, tt := range tests {
+		if got := string(rewriteChunkField([]byte(tt.data), tt.field, tt.to)); got != tt.want {
+			t.Errorf("rewriteChunkField(%s, %s) = %s, want %s", tt.data, tt.field, got, tt.want)
+		}
+	}
+}
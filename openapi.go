@@ -0,0 +1,479 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/vinayhpandya/ai_inference_gateway/client"
+)
+
+// Who may call an operation, as the document's security requirements.
+const (
+	apiAuth   = "api"
+	adminAuth = "admin"
+)
+
+// apiOperation describes a route for GET /openapi.json. Request and
+// Response are values of the Go types the route decodes and encodes, from
+// which the schemas are generated; a map[string]any is used as a schema
+// as it is. Every registered route needs one: the gateway won't start
+// with a route missing from apiOperations.
+type apiOperation struct {
+	Summary string
+	Tag     string
+	Auth    string
+	Request any
+	// RequestType is the request body's media type (default JSON)
+	RequestType string
+	// Status is the success status (default 200)
+	Status   int
+	Response any
+	// ResponseType is the success body's media type (default JSON)
+	ResponseType string
+	// Stream is the event type sent as text/event-stream for stream: true
+	Stream any
+	// Query names the query parameters the route reads
+	Query []string
+	// Headers names the apiHeaders the route honors
+	Headers []string
+}
+
+// apiList is the {"object": "list", "data": [...]} envelope the admin
+// endpoints answer with.
+type apiList struct{ item any }
+
+func listOf(item any) apiList { return apiList{item: item} }
+
+// apiOneOf is a body that is exactly one of several types.
+type apiOneOf []any
+
+func oneOf(alternatives ...any) apiOneOf { return alternatives }
+
+// anyObject is the schema of bodies without a fixed shape.
+var anyObject = map[string]any{"type": "object"}
+
+// apiHeaders describes the request headers the gateway reads.
+var apiHeaders = map[string]string{
+	"X-Request-ID":              "Request ID to use instead of a generated one; echoed on the response",
+	"X-Conversation-ID":         "Stored conversation to continue; only the new messages need to be sent",
+	"X-Gateway-Dry-Run":         "true returns a gateway.dry_run report instead of calling the backend; needs dry-run permission",
+	"X-Gateway-Tags":            "Comma-separated name=value tags recorded with collected training data",
+	"X-Gateway-Token-Breakdown": "true adds gateway.token_breakdown to the response",
+	"X-Gateway-Timing":          "true adds gateway.queue_ms, backend_ms and overhead_ms to the response; false turns them off on routes that have them on",
+	"X-Gateway-Target-Backend":  "Backend to send the request to, for keys allowed to override routing",
+	"X-Gateway-Stream-Cadence":  "raw turns off stream coalescing",
+	"X-Gateway-Replay":          "true marks replayed traffic, which is not reported to webhooks or the message bus",
+	"X-Routing-Token":           "Signed token from POST /admin/routing-tokens pinning the request to a backend",
+	"X-Resume-Token":            "Token from an interrupted stream's error event; the retried stream skips what was delivered",
+	"X-Priority-Class":          "Priority class for load shedding and backend queues",
+	"X-Request-Start":           "When the request was first accepted upstream, in Unix milliseconds; routes with a max age reject older requests with 408 stale_request",
+	"X-API-Version":             "API version to serve the request under, from GET /admin/api-versions; defaults to the key's, then API_VERSION_DEFAULT",
+}
+
+// chatHeaders are the headers chat completions, and the Responses API on
+// top of them, honor.
+var chatHeaders = []string{"X-Request-ID", "X-Conversation-ID", "X-Gateway-Dry-Run", "X-Gateway-Tags", "X-Gateway-Token-Breakdown",
+	"X-Gateway-Timing", "X-Gateway-Target-Backend", "X-Gateway-Stream-Cadence", "X-Gateway-Replay", "X-Routing-Token", "X-Resume-Token", "X-Priority-Class", "X-Request-Start",
+	"X-API-Version"}
+
+// apiOperations describes every route the gateway registers, by pattern.
+var apiOperations = map[string]apiOperation{
+	"POST /v1/chat/completions": {Summary: "Create a chat completion", Tag: "chat", Auth: apiAuth,
+		Request: ChatCompletionRequest{}, Response: oneOf(ChatCompletionResponse{}, dryRunReport{}), Stream: ChatCompletionChunk{}, Headers: chatHeaders},
+	"POST /v1/responses": {Summary: "Create a response with the OpenAI Responses API, translated to chat completions", Tag: "chat", Auth: apiAuth,
+		Request: responsesRequest{}, Response: oneOf(responseObject{}, dryRunReport{}), Stream: anyObject, Headers: chatHeaders},
+	"DELETE /v1/conversations/{id}":    {Summary: "Clear a stored conversation", Tag: "chat", Auth: apiAuth, Status: http.StatusNoContent},
+	"POST /v1/requests/{id}/cancel":    {Summary: "Cancel an in-flight stream started by the same key", Tag: "chat", Auth: apiAuth, Status: http.StatusAccepted},
+	"GET /v1/models":                   {Summary: "List the catalog's models with their capabilities and pricing", Tag: "models", Auth: apiAuth, Response: ModelList{}},
+	"POST /v1/tokenize":                {Summary: "Count a prompt's tokens with the model's tokenizer", Tag: "models", Auth: apiAuth, Request: TokenizeRequest{}, Response: TokenizeResponse{}},
+	"POST /v1/detokenize":              {Summary: "Turn token IDs back into text", Tag: "models", Auth: apiAuth, Request: DetokenizeRequest{}, Response: DetokenizeResponse{}},
+	"POST /v1/files":                   {Summary: "Upload a batch input file", Tag: "batches", Auth: apiAuth, RequestType: "multipart/form-data", Request: fileUploadSchema, Response: File{}},
+	"GET /v1/files/{id}":               {Summary: "Get a file's metadata", Tag: "batches", Auth: apiAuth, Response: File{}},
+	"GET /v1/files/{id}/content":       {Summary: "Download a file's contents", Tag: "batches", Auth: apiAuth, ResponseType: "application/jsonl", Response: map[string]any{"type": "string"}},
+	"POST /v1/batches":                 {Summary: "Start a batch over an uploaded file", Tag: "batches", Auth: apiAuth, Request: client.CreateBatchRequest{}, Response: Batch{}},
+	"GET /v1/batches/{id}":             {Summary: "Get a batch's status", Tag: "batches", Auth: apiAuth, Response: Batch{}},
+	"POST /v1/batches/{id}/cancel":     {Summary: "Cancel a batch", Tag: "batches", Auth: apiAuth, Response: Batch{}},
+	"GET /version":                     {Summary: "Build version", Tag: "gateway", Response: BuildInfo{}},
+	"GET /debug/vars":                  {Summary: "Gateway metrics (expvar); open to all with METRICS_PUBLIC", Tag: "gateway", Auth: adminAuth, Response: anyObject},
+	"GET /metrics":                     {Summary: "SLO series in the OpenMetrics text format; open to all with METRICS_PUBLIC", Tag: "gateway", Auth: adminAuth, ResponseType: "application/openmetrics-text", Response: map[string]any{"type": "string"}},
+	"GET /readyz":                      {Summary: "Readiness, with each backend's self-test result", Tag: "gateway", Response: anyObject},
+	"GET /openapi.json":                {Summary: "This document", Tag: "gateway", Response: anyObject},
+	"GET /playground":                  {Summary: "Browser playground", Tag: "gateway", ResponseType: "text/html", Response: map[string]any{"type": "string"}},
+	"GET /playground/{file}":           {Summary: "Playground asset", Tag: "gateway", ResponseType: "application/octet-stream", Response: map[string]any{"type": "string"}},
+	"GET /admin/concurrency":           {Summary: "In-flight requests per key", Tag: "admin", Auth: adminAuth, Response: map[string]int{}},
+	"GET /admin/state":                 {Summary: "Snapshot of the gateway's runtime state", Tag: "admin", Auth: adminAuth, Response: gatewayState{}, Query: []string{"keys", "format"}},
+	"GET /admin/routes":                {Summary: "Effective configuration per route", Tag: "admin", Auth: adminAuth, Response: map[string]any{"type": "object", "properties": map[string]any{"build": map[string]any{"$ref": "#/components/schemas/BuildInfo"}, "routes": map[string]any{"type": "array", "items": anyObject}}}},
+	"POST /admin/keys":                 {Summary: "Create an API key", Tag: "keys", Auth: adminAuth, Request: apiKeyRequest{}, Status: http.StatusCreated, Response: client.CreatedKey{}},
+	"GET /admin/keys":                  {Summary: "List API keys", Tag: "keys", Auth: adminAuth, Response: listOf(APIKey{})},
+	"PATCH /admin/keys/{id}":           {Summary: "Update an API key", Tag: "keys", Auth: adminAuth, Request: apiKeyRequest{}, Response: APIKey{}},
+	"DELETE /admin/keys/{id}":          {Summary: "Delete an API key and its child keys", Tag: "keys", Auth: adminAuth, Status: http.StatusNoContent},
+	"GET /admin/keys/{id}/usage":       {Summary: "A key's budget usage", Tag: "keys", Auth: adminAuth, Response: keyUsage{}},
+	"POST /admin/routing-tokens":       {Summary: "Issue a routing token", Tag: "admin", Auth: adminAuth, Request: routingTokenRequest{}, Status: http.StatusCreated, Response: issuedRoutingToken{}},
+	"GET /admin/slos":                  {Summary: "SLO compliance per route", Tag: "admin", Auth: adminAuth, Response: listOf(sloStatus{})},
+	"GET /admin/comparisons":           {Summary: "Backend comparison summaries", Tag: "admin", Auth: adminAuth, Response: listOf(comparisonSummary{})},
+	"GET /admin/experiments":           {Summary: "Prompt experiment results per variant", Tag: "admin", Auth: adminAuth, Response: listOf(experimentSummary{})},
+	"GET /admin/finish-reasons":        {Summary: "Finish reason shares and alerts", Tag: "admin", Auth: adminAuth, Response: listOf(finishReasonSummary{})},
+	"GET /admin/queues":                {Summary: "Backend queue status", Tag: "admin", Auth: adminAuth, Response: listOf(queueStatus{})},
+	"GET /admin/regions":               {Summary: "Endpoint regions per backend", Tag: "admin", Auth: adminAuth, Response: listOf(backendRegions{})},
+	"PATCH /admin/regions/{backend}":   {Summary: "Set a backend's force_cross_region override", Tag: "admin", Auth: adminAuth, Request: map[string]any{"type": "object", "properties": map[string]any{"force_cross_region": map[string]any{"type": "boolean"}}}, Response: backendRegions{}},
+	"GET /admin/balancing":             {Summary: "Endpoint weights per balanced backend", Tag: "admin", Auth: adminAuth, Response: listOf(backendBalancing{})},
+	"PATCH /admin/balancing/{backend}": {Summary: "Set a backend's pin_static override", Tag: "admin", Auth: adminAuth, Request: map[string]any{"type": "object", "properties": map[string]any{"pin_static": map[string]any{"type": "boolean"}}}, Response: backendBalancing{}},
+	"GET /admin/ignored-fields":        {Summary: "Request fields dropped since startup", Tag: "admin", Auth: adminAuth, Response: listOf(ignoredField{})},
+	"GET /admin/api-versions":          {Summary: "Supported API versions and how their behavior differs", Tag: "admin", Auth: adminAuth, Response: listOf(apiVersionInfo{})},
+	"GET /admin/journal":               {Summary: "Request journal status", Tag: "admin", Auth: adminAuth, Response: journalStatus{}},
+	"GET /admin/usage/export":          {Summary: "Daily usage per key and model", Tag: "admin", Auth: adminAuth, ResponseType: "text/csv", Response: map[string]any{"type": "string"}, Query: []string{"from", "to", "format", "parent"}},
+}
+
+// issuedRoutingToken is POST /admin/routing-tokens' response.
+type issuedRoutingToken struct {
+	routingClaims
+	Token string `json:"token"`
+}
+
+var fileUploadSchema = map[string]any{
+	"type":     "object",
+	"required": []string{"file", "purpose"},
+	"properties": map[string]any{
+		"file":    map[string]any{"type": "string", "format": "binary"},
+		"purpose": map[string]any{"type": "string", "enum": []string{"batch"}},
+	},
+}
+
+// schemaOverrides are schemas for types whose JSON isn't their Go shape.
+var schemaOverrides = map[reflect.Type]map[string]any{
+	reflect.TypeFor[StopSequences](): {"oneOf": []any{
+		map[string]any{"type": "string"},
+		map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+	}},
+	reflect.TypeFor[time.Time]():       {"type": "string", "format": "date-time"},
+	reflect.TypeFor[time.Duration]():   {"type": "integer", "description": "nanoseconds"},
+	reflect.TypeFor[json.RawMessage](): {},
+}
+
+// openAPIDocument is served at GET /openapi.json; it is built once the
+// routes are registered.
+var openAPIDocument []byte
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+// buildOpenAPI generates the OpenAPI 3.1 document for the registered
+// routes. It fails for a route without an apiOperation and for schema
+// references that don't resolve, so a route can't go undocumented.
+func buildOpenAPI(patterns []string) ([]byte, error) {
+	b := &schemaBuilder{components: map[string]any{}, names: map[reflect.Type]string{}}
+	paths := map[string]map[string]any{}
+	for _, pattern := range patterns {
+		method, path, _ := strings.Cut(pattern, " ")
+		op, ok := apiOperations[pattern]
+		if !ok {
+			if !transparentRoutes.covers(path) {
+				return nil, fmt.Errorf("route %q has no apiOperation", pattern)
+			}
+			op = apiOperation{Summary: "Relayed to the backend unchanged (transparent route)", Tag: "transparent", Auth: apiAuth,
+				Request: anyObject, Response: anyObject}
+		}
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path][strings.ToLower(method)] = b.operation(pattern, op)
+	}
+	tags := []map[string]any{}
+	for _, t := range []string{"chat", "models", "batches", "keys", "admin", "gateway", "transparent"} {
+		tags = append(tags, map[string]any{"name": t})
+	}
+
+	doc := map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":       "AI inference gateway",
+			"version":     buildInfo.Version,
+			"description": "OpenAI-compatible inference gateway. Request and response schemas include the gateway's extension fields.",
+		},
+		"tags":  tags,
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": b.components,
+			"securitySchemes": map[string]any{
+				"apiKey":     map[string]any{"type": "http", "scheme": "bearer", "description": "API key from POST /admin/keys"},
+				"hmac":       map[string]any{"type": "apiKey", "in": "header", "name": "X-Signature", "description": "sha256=<hex HMAC of \"<X-Timestamp>.<body>\">, with X-Key-ID and X-Timestamp"},
+				"adminToken": map[string]any{"type": "http", "scheme": "bearer", "description": "ADMIN_TOKEN"},
+			},
+		},
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSchemaRefs(data, b.components); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// operation builds the OpenAPI operation object for one route.
+func (b *schemaBuilder) operation(pattern string, op apiOperation) map[string]any {
+	_, path, _ := strings.Cut(pattern, " ")
+	out := map[string]any{
+		"operationId": operationID(pattern),
+		"summary":     op.Summary,
+		"tags":        []string{op.Tag},
+	}
+	switch op.Auth {
+	case apiAuth:
+		// Empty when the gateway is configured without authentication
+		out["security"] = []map[string][]string{{"apiKey": {}}, {"hmac": {}}, {}}
+	case adminAuth:
+		out["security"] = []map[string][]string{{"adminToken": {}}}
+	default:
+		out["security"] = []map[string][]string{}
+	}
+
+	var params []map[string]any
+	for _, seg := range strings.Split(path, "/") {
+		if name, ok := strings.CutPrefix(seg, "{"); ok {
+			name = strings.TrimSuffix(strings.TrimSuffix(name, "}"), "...")
+			params = append(params, map[string]any{"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+		}
+	}
+	for _, q := range op.Query {
+		params = append(params, map[string]any{"name": q, "in": "query", "schema": map[string]any{"type": "string"}})
+	}
+	for _, h := range op.Headers {
+		params = append(params, map[string]any{"name": h, "in": "header", "description": apiHeaders[h], "schema": map[string]any{"type": "string"}})
+	}
+	if params != nil {
+		out["parameters"] = params
+	}
+
+	if op.Request != nil {
+		ct := op.RequestType
+		if ct == "" {
+			ct = "application/json"
+		}
+		out["requestBody"] = map[string]any{"required": true, "content": map[string]any{ct: map[string]any{"schema": b.value(op.Request)}}}
+	}
+
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]any{"description": http.StatusText(status)}
+	content := map[string]any{}
+	if op.Response != nil {
+		ct := op.ResponseType
+		if ct == "" {
+			ct = "application/json"
+		}
+		content[ct] = map[string]any{"schema": b.value(op.Response)}
+	}
+	if op.Stream != nil {
+		content["text/event-stream"] = map[string]any{
+			"description": "With stream: true, data: events of this schema, ending with data: [DONE]",
+			"schema":      b.value(op.Stream),
+		}
+	}
+	if len(content) > 0 {
+		success["content"] = content
+	}
+	errorContent := map[string]any{"application/json": map[string]any{"schema": b.value(ErrorResponse{})}}
+	if slices.Contains(op.Headers, "X-API-Version") {
+		// API version 2024-06 answers some errors in plain text
+		errorContent["text/plain"] = map[string]any{"schema": map[string]any{"type": "string"}}
+	}
+	out["responses"] = map[string]any{
+		fmt.Sprint(status): success,
+		"default":          map[string]any{"description": "Error", "content": errorContent},
+	}
+	return out
+}
+
+// operationID turns "GET /v1/files/{id}/content" into getV1FilesIdContent.
+func operationID(pattern string) string {
+	method, path, _ := strings.Cut(pattern, " ")
+	id := strings.ToLower(method)
+	for _, word := range strings.FieldsFunc(path, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		id += strings.ToUpper(word[:1]) + word[1:]
+	}
+	return id
+}
+
+// schemaBuilder generates JSON Schemas from Go types by their json tags.
+// Named struct types become components, referenced by name.
+type schemaBuilder struct {
+	components map[string]any
+	names      map[reflect.Type]string
+}
+
+// value returns the schema of v's type, or v itself when it is a schema.
+func (b *schemaBuilder) value(v any) map[string]any {
+	switch v := v.(type) {
+	case map[string]any:
+		return v
+	case apiList:
+		return map[string]any{
+			"type":     "object",
+			"required": []string{"object", "data"},
+			"properties": map[string]any{
+				"object": map[string]any{"const": "list"},
+				"data":   map[string]any{"type": "array", "items": b.value(v.item)},
+			},
+		}
+	case apiOneOf:
+		var alternatives []any
+		for _, alt := range v {
+			alternatives = append(alternatives, b.value(alt))
+		}
+		return map[string]any{"oneOf": alternatives}
+	}
+	return b.schema(reflect.TypeOf(v))
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	if s, ok := schemaOverrides[t]; ok {
+		return s
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		name, ok := b.names[t]
+		if !ok {
+			name = b.componentName(t)
+			b.names[t] = name
+			// Registered before it is built, for types that refer to themselves
+			b.components[name] = map[string]any{}
+			b.components[name] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	// Interfaces and anything else: any JSON value
+	return map[string]any{}
+}
+
+// componentName is t's name, exported; types of the same name from
+// different packages are told apart by the package's.
+func (b *schemaBuilder) componentName(t reflect.Type) string {
+	name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+	if _, taken := b.components[name]; taken {
+		pkg := t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]
+		name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+	}
+	return name
+}
+
+// object builds a struct's schema from its exported fields' json tags.
+// Fields without omitempty are always encoded, so they are required;
+// embedded structs contribute their fields.
+func (b *schemaBuilder) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+	b.fields(t, props, &required)
+	s := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		sort.Strings(required)
+		s["required"] = required
+	}
+	return s
+}
+
+func (b *schemaBuilder) fields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft, embeddedRequired := f.Type, required
+			if ft.Kind() == reflect.Pointer {
+				// A nil embedded pointer leaves all its fields out
+				ft, embeddedRequired = ft.Elem(), new([]string)
+			}
+			if ft.Kind() == reflect.Struct {
+				b.fields(ft, props, embeddedRequired)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s := b.schema(f.Type)
+		if strings.Contains(opts, "string") {
+			s = map[string]any{"type": "string"}
+		}
+		omitted := strings.Contains(opts, "omitempty") || strings.Contains(opts, "omitzero")
+		// A nil pointer that isn't omitted is encoded as null, such as a
+		// stream chunk's finish_reason
+		if f.Type.Kind() == reflect.Pointer && !omitted {
+			s = nullable(s)
+		}
+		props[name] = s
+		if !omitted {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// nullable returns s also allowing null.
+func nullable(s map[string]any) map[string]any {
+	if len(s) == 0 {
+		return s
+	}
+	typ, ok := s["type"].(string)
+	if !ok {
+		return map[string]any{"anyOf": []any{s, map[string]any{"type": "null"}}}
+	}
+	out := maps.Clone(s)
+	out["type"] = []string{typ, "null"}
+	return out
+}
+
+// checkSchemaRefs fails for a $ref in data that names no component.
+func checkSchemaRefs(data []byte, components map[string]any) error {
+	const prefix = `"$ref": "#/components/schemas/`
+	for rest := string(data); ; {
+		i := strings.Index(rest, prefix)
+		if i < 0 {
+			return nil
+		}
+		rest = rest[i+len(prefix):]
+		name, _, _ := strings.Cut(rest, `"`)
+		if _, ok := components[name]; !ok {
+			return fmt.Errorf("schema reference to unknown component %q", name)
+		}
+	}
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/vinayhpandya/ai_inference_gateway/client"
+)
+
+// registeredRoutes returns the patterns main registers with rt.handle,
+// read from its source so a route added there without an apiOperation
+// fails here and not only at startup.
+func registeredRoutes(t testing.TB) []string {
+	t.Helper()
+	file, err := parser.ParseFile(token.NewFileSet(), "main.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var patterns []string
+	ast.Inspect(file, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) == 0 {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "handle" {
+			return true
+		}
+		// Transparent routes are registered from config, by variable
+		if lit, ok := call.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			pattern, _ := strconv.Unquote(lit.Value)
+			patterns = append(patterns, pattern)
+		}
+		return true
+	})
+	if len(patterns) < 10 {
+		t.Fatalf("found only %d routes in main.go: %q", len(patterns), patterns)
+	}
+	return patterns
+}
+
+// openAPIDoc builds the document for the registered routes and decodes it.
+func openAPIDoc(t *testing.T) map[string]any {
+	t.Helper()
+	data, err := buildOpenAPI(registeredRoutes(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestOpenAPICoversRegisteredRoutes(t *testing.T) {
+	patterns := registeredRoutes(t)
+	paths := openAPIDoc(t)["paths"].(map[string]any)
+	for _, pattern := range patterns {
+		method, path, _ := strings.Cut(pattern, " ")
+		item, _ := paths[path].(map[string]any)
+		if _, ok := item[strings.ToLower(method)]; !ok {
+			t.Errorf("document lacks %s", pattern)
+		}
+	}
+	// And describes nothing that isn't served
+	for pattern := range apiOperations {
+		if !slices.Contains(patterns, pattern) {
+			t.Errorf("apiOperations describes unregistered route %s", pattern)
+		}
+	}
+}
+
+func TestOpenAPIDocumentValidates(t *testing.T) {
+	doc := openAPIDoc(t)
+	if doc["openapi"] != "3.1.0" {
+		t.Errorf("openapi = %v", doc["openapi"])
+	}
+	info := doc["info"].(map[string]any)
+	if info["title"] == "" || info["version"] == nil {
+		t.Errorf("info = %v", info)
+	}
+	components := doc["components"].(map[string]any)
+	schemas := components["schemas"].(map[string]any)
+	schemes := components["securitySchemes"].(map[string]any)
+	tags := map[string]bool{}
+	for _, tag := range doc["tags"].([]any) {
+		tags[tag.(map[string]any)["name"].(string)] = true
+	}
+
+	ids := map[string]string{}
+	for path, item := range doc["paths"].(map[string]any) {
+		if !strings.HasPrefix(path, "/") {
+			t.Errorf("path %q doesn't start with /", path)
+		}
+		for method, v := range item.(map[string]any) {
+			op := v.(map[string]any)
+			where := strings.ToUpper(method) + " " + path
+			if !slices.Contains([]string{"get", "post", "patch", "put", "delete"}, method) {
+				t.Errorf("%s: unknown method", where)
+			}
+			id, _ := op["operationId"].(string)
+			if prev, dup := ids[id]; id == "" || dup {
+				t.Errorf("%s: operationId %q, also used by %s", where, id, prev)
+			}
+			ids[id] = where
+			if op["summary"] == "" {
+				t.Errorf("%s: no summary", where)
+			}
+			for _, tag := range op["tags"].([]any) {
+				if !tags[tag.(string)] {
+					t.Errorf("%s: undeclared tag %v", where, tag)
+				}
+			}
+			for _, req := range op["security"].([]any) {
+				for name := range req.(map[string]any) {
+					if schemes[name] == nil {
+						t.Errorf("%s: unknown security scheme %s", where, name)
+					}
+				}
+			}
+
+			// Path parameters are exactly the template's
+			var inPath []string
+			seen := map[string]bool{}
+			params, _ := op["parameters"].([]any)
+			for _, p := range params {
+				p := p.(map[string]any)
+				name, in := p["name"].(string), p["in"].(string)
+				if seen[in+" "+name] || !slices.Contains([]string{"path", "query", "header"}, in) || p["schema"] == nil {
+					t.Errorf("%s: bad or duplicate parameter %v", where, p)
+				}
+				seen[in+" "+name] = true
+				if in == "path" {
+					inPath = append(inPath, name)
+					if p["required"] != true {
+						t.Errorf("%s: path parameter %s not required", where, name)
+					}
+				}
+				if in == "header" && p["description"] == "" {
+					t.Errorf("%s: header %s has no description", where, name)
+				}
+			}
+			var template []string
+			for _, m := range regexp.MustCompile(`\{([^}]+)\}`).FindAllStringSubmatch(path, -1) {
+				template = append(template, m[1])
+			}
+			if !slices.Equal(inPath, template) {
+				t.Errorf("%s: path parameters %q, template has %q", where, inPath, template)
+			}
+
+			responses := op["responses"].(map[string]any)
+			if responses["default"] == nil || len(responses) < 2 {
+				t.Errorf("%s: responses %v", where, responses)
+			}
+			for status, r := range responses {
+				if r.(map[string]any)["description"] == "" {
+					t.Errorf("%s: response %s has no description", where, status)
+				}
+			}
+			walkSchemas(op, func(s map[string]any) { checkSchemaShape(t, where, s, schemas) })
+		}
+	}
+	for name, s := range schemas {
+		checkSchemaShape(t, "component "+name, s.(map[string]any), schemas)
+	}
+}
+
+// walkSchemas calls f with every "schema" object under v.
+func walkSchemas(v any, f func(map[string]any)) {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, child := range v {
+			if s, ok := child.(map[string]any); ok && key == "schema" {
+				f(s)
+			}
+			walkSchemas(child, f)
+		}
+	case []any:
+		for _, child := range v {
+			walkSchemas(child, f)
+		}
+	}
+}
+
+// checkSchemaShape fails for unknown types, required properties that
+// aren't declared and references that don't resolve, in s and below.
+func checkSchemaShape(t *testing.T, where string, s map[string]any, schemas map[string]any) {
+	t.Helper()
+	if ref, ok := s["$ref"].(string); ok {
+		if schemas[strings.TrimPrefix(ref, "#/components/schemas/")] == nil {
+			t.Errorf("%s: unresolved %s", where, ref)
+		}
+	}
+	types, _ := s["type"].([]any)
+	if typ, ok := s["type"].(string); ok {
+		types = []any{typ}
+	}
+	for _, typ := range types {
+		if !slices.Contains([]any{"object", "array", "string", "integer", "number", "boolean", "null"}, typ) {
+			t.Errorf("%s: type %v", where, typ)
+		}
+	}
+	props, _ := s["properties"].(map[string]any)
+	if req, ok := s["required"].([]any); ok {
+		for _, name := range req {
+			if _, ok := props[name.(string)]; !ok {
+				t.Errorf("%s: required %v isn't a property", where, name)
+			}
+		}
+	}
+	for _, key := range []string{"items", "additionalProperties"} {
+		if child, ok := s[key].(map[string]any); ok {
+			checkSchemaShape(t, where, child, schemas)
+		}
+	}
+	for name, p := range props {
+		checkSchemaShape(t, where+"."+name, p.(map[string]any), schemas)
+	}
+	for _, key := range []string{"oneOf", "anyOf"} {
+		alts, _ := s[key].([]any)
+		for _, alt := range alts {
+			checkSchemaShape(t, where, alt.(map[string]any), schemas)
+		}
+	}
+}
+
+// schemaChecker validates JSON values against the document's schemas.
+// It is strict about objects: a field a struct schema doesn't declare is
+// an error, so the schemas can't fall behind the types.
+type schemaChecker map[string]any
+
+func (c schemaChecker) check(s map[string]any, v any, at string) []string {
+	if ref, ok := s["$ref"].(string); ok {
+		return c.check(c[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]any), v, at)
+	}
+	for _, key := range []string{"oneOf", "anyOf"} {
+		alts, ok := s[key].([]any)
+		if !ok {
+			continue
+		}
+		var matched int
+		var errs []string
+		for _, alt := range alts {
+			e := c.check(alt.(map[string]any), v, at)
+			if e == nil {
+				matched++
+			}
+			errs = append(errs, e...)
+		}
+		if matched == 0 || key == "oneOf" && matched > 1 {
+			return append(errs, fmt.Sprintf("%s: matches %d of %s", at, matched, key))
+		}
+		return nil
+	}
+	if types, ok := s["type"].([]any); ok {
+		// A list of types matches any of them
+		for _, typ := range types {
+			if typ == "null" && v == nil || typ != "null" && c.check(map[string]any{"type": typ}, v, at) == nil {
+				return c.check(withoutType(s), v, at)
+			}
+		}
+		return []string{fmt.Sprintf("%s: %v isn't one of %v", at, v, types)}
+	}
+	if want, ok := s["const"]; ok && v != want {
+		return []string{fmt.Sprintf("%s: %v, want %v", at, v, want)}
+	}
+	if enum, ok := s["enum"].([]any); ok && !slices.Contains(enum, v) {
+		return []string{fmt.Sprintf("%s: %v not in %v", at, v, enum)}
+	}
+	var errs []string
+	switch s["type"] {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s: %T, want an object", at, v)}
+		}
+		props, _ := s["properties"].(map[string]any)
+		required, _ := s["required"].([]any)
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing required %v", at, name))
+			}
+		}
+		extra, hasExtra := s["additionalProperties"].(map[string]any)
+		for name, fv := range obj {
+			switch p, ok := props[name].(map[string]any); {
+			case ok:
+				errs = append(errs, c.check(p, fv, at+"."+name)...)
+			case hasExtra:
+				errs = append(errs, c.check(extra, fv, at+"."+name)...)
+			case props != nil:
+				errs = append(errs, fmt.Sprintf("%s: undocumented field %q", at, name))
+			}
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s: %T, want an array", at, v)}
+		}
+		for i, item := range arr {
+			errs = append(errs, c.check(s["items"].(map[string]any), item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			errs = append(errs, fmt.Sprintf("%s: %T, want a string", at, v))
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			errs = append(errs, fmt.Sprintf("%s: %T, want a boolean", at, v))
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			errs = append(errs, fmt.Sprintf("%s: %T, want a number", at, v))
+		}
+	case "integer":
+		if f, ok := v.(float64); !ok || f != math.Trunc(f) {
+			errs = append(errs, fmt.Sprintf("%s: %v, want an integer", at, v))
+		}
+	}
+	return errs
+}
+
+func withoutType(s map[string]any) map[string]any {
+	out := maps.Clone(s)
+	delete(out, "type")
+	return out
+}
+
+// checkBody validates body as the schema of pattern's response with
+// status, in media type ct.
+func checkBody(t *testing.T, doc map[string]any, pattern string, status int, ct, body string) {
+	t.Helper()
+	method, path, _ := strings.Cut(pattern, " ")
+	op := doc["paths"].(map[string]any)[path].(map[string]any)[strings.ToLower(method)].(map[string]any)
+	responses := op["responses"].(map[string]any)
+	r, ok := responses[strconv.Itoa(status)].(map[string]any)
+	if !ok {
+		r = responses["default"].(map[string]any)
+	}
+	schema := r["content"].(map[string]any)[ct].(map[string]any)["schema"].(map[string]any)
+	var v any
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		t.Fatalf("%s: %v: %s", pattern, err, body)
+	}
+	checker := schemaChecker(doc["components"].(map[string]any)["schemas"].(map[string]any))
+	for _, e := range checker.check(schema, v, "body") {
+		t.Errorf("%s %d: %s", pattern, status, e)
+	}
+}
+
+func TestOpenAPISchemasMatchResponses(t *testing.T) {
+	captureLog(t)
+	useFakeBackend(t)
+	doc := openAPIDoc(t)
+	const chat = "POST /v1/chat/completions"
+	send := func(body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		accessLog(http.HandlerFunc(chatCompletionsHandler)).ServeHTTP(w, r)
+		return w
+	}
+
+	// With the gateway's extensions asked for
+	w := send(`{"model":"m","messages":[{"role":"system","content":"s"},{"role":"user","content":"hi"}],"stop":"x"}`,
+		gatewayTimingHeader, "true", "X-Gateway-Token-Breakdown", "true")
+	if !strings.Contains(w.Body.String(), `"overhead_ms"`) || !strings.Contains(w.Body.String(), `"token_breakdown"`) {
+		t.Fatalf("response lacks the gateway extensions: %s", w.Body)
+	}
+	checkBody(t, doc, chat, w.Code, "application/json", w.Body.String())
+
+	w = send(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`, "X-Gateway-Token-Breakdown", "true")
+	checkBody(t, doc, chat, w.Code, "application/json", w.Body.String())
+
+	w = send(`{"model":"m","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`, gatewayTimingHeader, "true")
+	for _, e := range sseEvents(w.Body.String()) {
+		if e != "[DONE]" {
+			checkBody(t, doc, chat, w.Code, "text/event-stream", e)
+		}
+	}
+
+	t.Setenv("DRY_RUN_KEYS", "*")
+	w = send(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`, dryRunHeader, "true")
+	if !strings.Contains(w.Body.String(), `"gateway.dry_run"`) {
+		t.Fatalf("dry run = %s", w.Body)
+	}
+	checkBody(t, doc, chat, w.Code, "application/json", w.Body.String())
+
+	w = send(`{"model":"m","messages":"hi"}`, "X-API-Version", "2024-11")
+	checkBody(t, doc, chat, w.Code, "application/json", w.Body.String())
+	// Under 2024-06 the same error is plain text, as documented
+	w = send(`{"model":"m","messages":"hi"}`, "X-API-Version", "2024-06")
+	errors := doc["paths"].(map[string]any)["/v1/chat/completions"].(map[string]any)["post"].(map[string]any)["responses"].(map[string]any)["default"].(map[string]any)
+	if _, ok := errors["content"].(map[string]any)["text/plain"]; w.Code != http.StatusBadRequest || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") || !ok {
+		t.Errorf("2024-06 error %d %s, documented as %v", w.Code, w.Header().Get("Content-Type"), errors["content"])
+	}
+
+	w = httptest.NewRecorder()
+	versionHandler(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	checkBody(t, doc, "GET /version", w.Code, "application/json", w.Body.String())
+}
+
+func TestOpenAPIRequestSchemas(t *testing.T) {
+	doc := openAPIDoc(t)
+	op := doc["paths"].(map[string]any)["/v1/chat/completions"].(map[string]any)["post"].(map[string]any)
+	schema := op["requestBody"].(map[string]any)["content"].(map[string]any)["application/json"].(map[string]any)["schema"].(map[string]any)
+	checker := schemaChecker(doc["components"].(map[string]any)["schemas"].(map[string]any))
+	for _, body := range []string{
+		`{"model":"m","messages":[{"role":"user","content":"hi"}]}`,
+		`{"model":"m","messages":[],"stop":"x","stream":true,"stream_options":{"include_usage":true},"max_tokens":5}`,
+		`{"model":"m","messages":[],"stop":["a","b"],"temperature":0.5,"seed":7}`,
+	} {
+		var v any
+		json.Unmarshal([]byte(body), &v)
+		if errs := checker.check(schema, v, "body"); errs != nil {
+			t.Errorf("%s: %q", body, errs)
+		}
+	}
+	for body, want := range map[string]string{
+		`{"model":"m"}`:                              "missing required messages",
+		`{"messages":[],"stop":7}`:                   "matches 0 of oneOf",
+		`{"messages":[],"max_tokens":1.5}`:           "want an integer",
+		`{"messages":[{"role":"user","content":1}]}`: "want a string",
+	} {
+		var v any
+		json.Unmarshal([]byte(body), &v)
+		if errs := checker.check(schema, v, "body"); !strings.Contains(strings.Join(errs, "; "), want) {
+			t.Errorf("%s: %q, want %s", body, errs, want)
+		}
+	}
+}
+
+func TestBuildOpenAPIRejectsUndocumentedRoutes(t *testing.T) {
+	if _, err := buildOpenAPI([]string{"GET /version", "GET /v1/secret"}); err == nil || err.Error() != `route "GET /v1/secret" has no apiOperation` {
+		t.Errorf("err = %v", err)
+	}
+
+	// Transparent routes are documented as relayed
+	prev := transparentRoutes
+	transparentRoutes = &transparentProxy{paths: []string{"/v1/embeddings"}}
+	t.Cleanup(func() { transparentRoutes = prev })
+	data, err := buildOpenAPI([]string{"POST /v1/embeddings"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Paths map[string]map[string]struct {
+			Tags []string `json:"tags"`
+		} `json:"paths"`
+	}
+	json.Unmarshal(data, &doc)
+	if tags := doc.Paths["/v1/embeddings"]["post"].Tags; !slices.Equal(tags, []string{"transparent"}) {
+		t.Errorf("tags = %q", tags)
+	}
+
+	if err := checkSchemaRefs([]byte(`{"$ref": "#/components/schemas/Gone"}`), map[string]any{}); err == nil {
+		t.Error("dangling reference accepted")
+	}
+}
+
+func TestOperationID(t *testing.T) {
+	for pattern, want := range map[string]string{
+		"GET /v1/files/{id}/content":       "getV1FilesIdContent",
+		"POST /v1/chat/completions":        "postV1ChatCompletions",
+		"PATCH /admin/balancing/{backend}": "patchAdminBalancingBackend",
+		"GET /admin/finish-reasons":        "getAdminFinishReasons",
+		"GET /openapi.json":                "getOpenapiJson",
+	} {
+		if got := operationID(pattern); got != want {
+			t.Errorf("operationID(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
+
+type schemaNode struct {
+	Name     string        `json:"name"`
+	Children []*schemaNode `json:"children,omitempty"`
+}
+
+type schemaSample struct {
+	Plain    string         `json:"plain"`
+	Optional *int           `json:"optional,omitempty"`
+	Counts   map[string]int `json:"counts,omitzero"`
+	Raw      []byte         `json:"raw,omitempty"`
+	Quoted   int64          `json:"quoted,string"`
+	Untagged bool
+	Skipped  string `json:"-"`
+	hidden   string
+	Tree     schemaNode  `json:"tree"`
+	Reason   *string     `json:"reason"`
+	Parent   *schemaNode `json:"parent"`
+	*GatewayTiming
+}
+
+// CreatedKey has the name of a client type, for the components to tell
+// apart.
+type CreatedKey struct {
+	Key string `json:"key"`
+}
+
+func TestSchemaBuilder(t *testing.T) {
+	b := &schemaBuilder{components: map[string]any{}, names: map[reflect.Type]string{}}
+	if ref := b.value(schemaSample{}); ref["$ref"] != "#/components/schemas/SchemaSample" {
+		t.Fatalf("ref = %v", ref)
+	}
+	got, _ := json.Marshal(b.components["SchemaSample"])
+	want := `{"properties":{"Untagged":{"type":"boolean"},"backend_ms":{"type":"number"},"counts":{"additionalProperties":{"type":"integer"},"type":"object"},` +
+		`"optional":{"type":"integer"},"overhead_ms":{"type":"number"},"parent":{"anyOf":[{"$ref":"#/components/schemas/SchemaNode"},{"type":"null"}]},` +
+		`"plain":{"type":"string"},"queue_ms":{"type":"number"},"quoted":{"type":"string"},"raw":{"contentEncoding":"base64","type":"string"},` +
+		`"reason":{"type":["string","null"]},"tree":{"$ref":"#/components/schemas/SchemaNode"}},` +
+		`"required":["Untagged","parent","plain","quoted","reason","tree"],"type":"object"}`
+	if string(got) != want {
+		t.Errorf("schema = %s\nwant %s", got, want)
+	}
+	// Self-reference resolves to the component being built
+	node, _ := json.Marshal(b.components["SchemaNode"])
+	if !strings.Contains(string(node), `"children":{"items":{"$ref":"#/components/schemas/SchemaNode"},"type":"array"}`) {
+		t.Errorf("node schema = %s", node)
+	}
+
+	// Types of the same name from different packages both get components
+	b.value(CreatedKey{})
+	b.value(client.CreatedKey{})
+	var names []string
+	for name := range b.components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if !slices.Contains(names, "CreatedKey") || !slices.Contains(names, "ClientCreatedKey") {
+		t.Errorf("components = %q", names)
+	}
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	prev := openAPIDocument
+	t.Cleanup(func() { openAPIDocument = prev })
+	var err error
+	if openAPIDocument, err = buildOpenAPI(registeredRoutes(t)); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	openAPIHandler(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if w.Header().Get("Content-Type") != "application/json" || !json.Valid(w.Body.Bytes()) || !strings.Contains(w.Body.String(), `"3.1.0"`) {
+		t.Errorf("response = %s %.100s", w.Header().Get("Content-Type"), w.Body)
+	}
+}
+
+func BenchmarkBuildOpenAPI(b *testing.B) {
+	patterns := registeredRoutes(b)
+	for b.Loop() {
+		if _, err := buildOpenAPI(patterns); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
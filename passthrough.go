@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// maxInspectBytes caps how much of a passed-through body is kept for
+// inspection (conversation history). Larger bodies are still relayed in
+// full, just not inspected.
+const maxInspectBytes = 1 << 20
+
+// tailBytes is how much of the end of a body is kept to find its usage and
+// finish reason when it is too long to decode whole. OpenAI-compatible
+// servers put both after the message content.
+const tailBytes = 8 << 10
+
+// idPrefixBytes is how far into a body the top-level "id" is looked for.
+// OpenAI-compatible servers put it first.
+const idPrefixBytes = 4 << 10
+
+// passthroughHeaders are the backend response headers relayed to clients.
+var passthroughHeaders = []string{"Content-Type", "Openai-Processing-Ms", "Openai-Version"}
+
+// canPassthrough reports whether a non-streaming response can be copied to
+// the client as-is instead of decoded and re-encoded: the backend must
+// already speak OpenAI format and the gateway must not rewrite the content,
+// as enforcing stop sequences does.
+func canPassthrough(backend *Backend, stopEnforced bool) bool {
+	_, openai := adapterFor(backend).(openaiAdapter)
+	return openai && !stopEnforced
+}
+
+// relayResponse copies a backend's 200 response to w, keeping memory flat
+// and bytes unchanged apart from the top-level id, which becomes requestID.
+// It records the usage and finish reason, which every response is counted
+// by. When inspect is set it also returns the assistant message, provided
+// the body fit within maxInspectBytes.
+func relayResponse(w http.ResponseWriter, resp *http.Response, requestID string, rec *requestRecord, inspect bool) (Message, bool) {
+	defer resp.Body.Close()
+	transferStart := time.Now()
+
+	for _, name := range passthroughHeaders {
+		if v := resp.Header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+
+	body := bufio.NewReaderSize(resp.Body, idPrefixBytes)
+	prefix, _ := body.Peek(idPrefixBytes)
+	head := rewriteChunkID(prefix, requestID)
+	// head may alias the reader's buffer; it is written before the next read
+	body.Discard(len(prefix))
+
+	tail := &tailBuffer{max: tailBytes}
+	tail.Write(head)
+	var src io.Reader = io.TeeReader(body, tail)
+	var captured *cappedBuffer
+	if inspect {
+		captured = &cappedBuffer{max: maxInspectBytes}
+		captured.Write(head)
+		src = io.TeeReader(body, io.MultiWriter(tail, captured))
+	}
+
+	if _, err := w.Write(head); err != nil {
+		log.Printf("Error relaying response: %v", err)
+		return Message{}, false
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		log.Printf("Error relaying response: %v", err)
+		return Message{}, false
+	}
+	rec.Timings.set(&rec.Timings.transfer, time.Since(transferStart))
+
+	var data []byte
+	switch {
+	case inspect && !captured.overflow:
+		data = captured.buf.Bytes()
+	case !inspect && !tail.dropped:
+		data = tail.buf
+	default:
+		if inspect {
+			log.Printf("Response for %s exceeds %d bytes; not stored in conversation history", requestID, maxInspectBytes)
+		}
+		rec.Usage, rec.FinishReason = tailFields(tail.buf)
+		return Message{}, false
+	}
+	var response ChatCompletionResponse
+	if err := json.Unmarshal(data, &response); err != nil || len(response.Choices) == 0 {
+		return Message{}, false
+	}
+	rec.Usage = &response.Usage
+	rec.FinishReason = response.Choices[0].FinishReason
+	return response.Choices[0].Message, inspect
+}
+
+var (
+	tailUsageKey  = regexp.MustCompile(`"usage"\s*:`)
+	tailFinishKey = regexp.MustCompile(`"finish_reason"\s*:`)
+)
+
+// tailFields finds the top-level usage, and the last choice's finish
+// reason, in the end of a response body. Keys inside strings have their
+// quotes escaped, so a match preceded by a backslash is skipped.
+func tailFields(tail []byte) (*Usage, string) {
+	var usage *Usage
+	if v := lastValue(tail, tailUsageKey); v != nil {
+		var u Usage
+		if json.NewDecoder(bytes.NewReader(v)).Decode(&u) == nil {
+			usage = &u
+		}
+	}
+	var reason string
+	if v := lastValue(tail, tailFinishKey); v != nil {
+		json.NewDecoder(bytes.NewReader(v)).Decode(&reason)
+	}
+	return usage, reason
+}
+
+// lastValue returns what follows the last unescaped match of key in data.
+func lastValue(data []byte, key *regexp.Regexp) []byte {
+	matches := key.FindAllIndex(data, -1)
+	for i := len(matches) - 1; i >= 0; i-- {
+		if start := matches[i][0]; start == 0 || data[start-1] != '\\' {
+			return data[matches[i][1]:]
+		}
+	}
+	return nil
+}
+
+// tailBuffer keeps the last max bytes written, noting when it dropped
+// any before them.
+type tailBuffer struct {
+	buf     []byte
+	max     int
+	dropped bool
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	if len(p) >= t.max {
+		t.dropped = t.dropped || len(t.buf) > 0 || len(p) > t.max
+		t.buf = append(t.buf[:0], p[len(p)-t.max:]...)
+		return len(p), nil
+	}
+	if over := len(t.buf) + len(p) - t.max; over > 0 {
+		t.dropped = true
+		t.buf = t.buf[:copy(t.buf, t.buf[over:])]
+	}
+	t.buf = append(t.buf, p...)
+	return len(p), nil
+}
+
+// cappedBuffer keeps the first max bytes written and notes any overflow.
+// Writes always succeed so it can sit behind an io.TeeReader.
+type cappedBuffer struct {
+	buf      bytes.Buffer
+	max      int
+	overflow bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	keep := p
+	if room := c.max - c.buf.Len(); len(keep) > room {
+		c.overflow = true
+		keep = keep[:max(room, 0)]
+	}
+	c.buf.Write(keep)
+	return len(p), nil
+}
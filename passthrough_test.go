@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vinayhpandya/ai_inference_gateway/fakeback"
+)
+
+func backendResponse(body string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func completionBody(content string) string {
+	data, _ := json.Marshal(content)
+	return `{"id":"chatcmpl-up","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":` + string(data) +
+		`},"logprobs":null,"finish_reason":"length"}],"usage":{"prompt_tokens":12,"completion_tokens":34,"total_tokens":46},"system_fingerprint":"fp"}`
+}
+
+func TestRelayResponseRecordsUsageWithoutInspecting(t *testing.T) {
+	w := httptest.NewRecorder()
+	rec := &requestRecord{}
+	if _, ok := relayResponse(w, backendResponse(completionBody("hi")), "req-1", rec, false); ok {
+		t.Error("message returned without inspect")
+	}
+	if want := strings.Replace(completionBody("hi"), "chatcmpl-up", "req-1", 1); w.Body.String() != want {
+		t.Errorf("body = %s, want %s", w.Body, want)
+	}
+	if rec.Usage == nil || rec.Usage.TotalTokens != 46 || rec.FinishReason != "length" {
+		t.Errorf("usage, finish = %+v, %q", rec.Usage, rec.FinishReason)
+	}
+}
+
+func TestRelayResponseInspectsMessage(t *testing.T) {
+	rec := &requestRecord{}
+	msg, ok := relayResponse(httptest.NewRecorder(), backendResponse(completionBody("hi")), "req-1", rec, true)
+	if !ok || msg.Content != "hi" || msg.Role != "assistant" {
+		t.Errorf("message = %+v, %t", msg, ok)
+	}
+	if rec.Usage == nil || rec.Usage.PromptTokens != 12 {
+		t.Errorf("usage = %+v", rec.Usage)
+	}
+}
+
+func TestRelayResponseFindsUsageOfLargeBody(t *testing.T) {
+	// Longer than maxInspectBytes, with usage-like text in the content
+	content := strings.Repeat("x", maxInspectBytes) + `"usage":{"total_tokens":1},"finish_reason":"stop"`
+	body := completionBody(content)
+	for _, inspect := range []bool{false, true} {
+		w := httptest.NewRecorder()
+		rec := &requestRecord{}
+		if _, ok := relayResponse(w, backendResponse(body), "req-1", rec, inspect); ok {
+			t.Errorf("inspect %t: message of an oversized body returned", inspect)
+		}
+		if w.Body.Len() != len(body)-len("chatcmpl-up")+len("req-1") {
+			t.Errorf("inspect %t: relayed %d bytes of %d", inspect, w.Body.Len(), len(body))
+		}
+		if rec.Usage == nil || *rec.Usage != (Usage{PromptTokens: 12, CompletionTokens: 34, TotalTokens: 46}) || rec.FinishReason != "length" {
+			t.Errorf("inspect %t: usage, finish = %+v, %q", inspect, rec.Usage, rec.FinishReason)
+		}
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	tail := &tailBuffer{max: 4}
+	tail.Write([]byte("ab"))
+	tail.Write([]byte("cd"))
+	if string(tail.buf) != "abcd" || tail.dropped {
+		t.Fatalf("tail = %q, dropped %t", tail.buf, tail.dropped)
+	}
+	tail.Write([]byte("e"))
+	if string(tail.buf) != "bcde" || !tail.dropped {
+		t.Errorf("tail = %q, dropped %t", tail.buf, tail.dropped)
+	}
+	tail.Write([]byte("123456"))
+	if string(tail.buf) != "3456" {
+		t.Errorf("tail = %q", tail.buf)
+	}
+}
+
+func TestPassthroughFromFakeBackend(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	back.Enqueue(fakeback.Behavior{Content: "hello there", FinishReason: "length"})
+	w := chatAs("", `{"model":"m","max_tokens":5,"messages":[{"role":"system","content":"be brief"},{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var resp ChatCompletionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != w.Header().Get("X-Request-ID") || len(resp.Choices) != 1 || resp.Choices[0].Message.Content != "hello there" || resp.Choices[0].FinishReason != "length" {
+		t.Errorf("response = %+v", resp)
+	}
+
+	reqs := back.Requests()
+	var sent ChatCompletionRequest
+	if len(reqs) != 1 || reqs[0].Path != "/v1/chat/completions" || reqs[0].Decode(&sent) != nil {
+		t.Fatalf("backend got %+v", reqs)
+	}
+	if len(sent.Messages) != 2 || sent.Messages[1].Content != "hi" || sent.MaxTokens == nil || *sent.MaxTokens != 5 {
+		t.Errorf("backend got %+v", sent)
+	}
+}
+
+func TestPassthroughFromFakeBackendFailures(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	tests := []struct {
+		name     string
+		behavior fakeback.Behavior
+		want     int
+		code     string
+	}{
+		{"unavailable", fakeback.Error(http.StatusServiceUnavailable, "overloaded"), http.StatusBadGateway, "backend_unavailable"},
+		{"dropped", fakeback.Drop(), http.StatusBadGateway, "backend_unavailable"},
+		{"bad request", fakeback.Error(http.StatusBadRequest, "bad"), http.StatusBadRequest, "invalid_request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			back.Enqueue(tt.behavior)
+			w := chatAs("", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`)
+			if w.Code != tt.want || !strings.Contains(w.Body.String(), `"code":"`+tt.code+`"`) {
+				t.Errorf("response = %d %s, want %d %s", w.Code, w.Body, tt.want, tt.code)
+			}
+		})
+	}
+}
+
+// largeCompletion is a 20 MB backend response, for comparing relaying it
+// with the decode and re-encode path it replaces.
+var largeCompletion = sync.OnceValue(func() string { return completionBody(strings.Repeat("x", 20<<20)) })
+
+func BenchmarkRelayResponseLarge(b *testing.B) {
+	body := largeCompletion()
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	for b.Loop() {
+		relayResponse(discardWriter{http.Header{}}, backendResponse(body), "req-1", &requestRecord{}, false)
+	}
+}
+
+// BenchmarkDecodeResponseLarge is the same response through the path taken
+// when the gateway has to edit it: decoded by forwardToBackend, then
+// encoded for the client.
+func BenchmarkDecodeResponseLarge(b *testing.B) {
+	adapter := adapterFor(&Backend{Type: "openai"})
+	body := largeCompletion()
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	for b.Loop() {
+		response, err := adapter.decodeResponse(backendResponse(body).Body)
+		if err != nil {
+			b.Fatal(err)
+		}
+		response.ID = "req-1"
+		json.NewEncoder(discardWriter{http.Header{}}).Encode(response)
+	}
+}
+
+type discardWriter struct{ header http.Header }
+
+func (d discardWriter) Header() http.Header         { return d.header }
+func (d discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d discardWriter) WriteHeader(int)             {}
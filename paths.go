@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	defaultChatPath   = "/v1/chat/completions"
+	defaultModelsPath = "/v1/models"
+	defaultHealthPath = "/health"
+)
+
+// BackendPaths moves the routes the gateway calls under a backend's URL,
+// for servers that mount the OpenAI API elsewhere:
+//
+//	"paths": {"chat": "/api/v2/chat", "models": "/api/v2/models", "health": "/api/v2/ping"}
+type BackendPaths struct {
+	// Chat replaces /v1/chat/completions; openai and vllm only
+	Chat string `json:"chat,omitempty"`
+	// Models replaces /v1/models, which also serves as the openai health probe
+	Models string `json:"models,omitempty"`
+	// Responses replaces /v1/responses, for backends with responses set
+	Responses string `json:"responses,omitempty"`
+	// Health is what the self-test probes: /health for vllm and tgi, the
+	// models path for openai, and the base URL for other types
+	Health string `json:"health,omitempty"`
+}
+
+func (p *BackendPaths) validate(backendType string) error {
+	if p.Chat != "" && backendType != "openai" && backendType != "vllm" {
+		return fmt.Errorf("paths.chat is not supported for %s backends", backendType)
+	}
+	for name, path := range map[string]string{"chat": p.Chat, "models": p.Models, "responses": p.Responses, "health": p.Health} {
+		if path == "" {
+			continue
+		}
+		u, err := url.Parse(path)
+		if err != nil || u.Scheme != "" || u.Host != "" || u.Fragment != "" {
+			return fmt.Errorf("paths.%s %q must be a path, optionally with a query", name, path)
+		}
+	}
+	return nil
+}
+
+// chatPath is where OpenAI-format chat completions are posted.
+func (b *Backend) chatPath() string {
+	if b.Paths != nil && b.Paths.Chat != "" {
+		return b.Paths.Chat
+	}
+	return defaultChatPath
+}
+
+func (b *Backend) modelsPath() string {
+	if b.Paths != nil && b.Paths.Models != "" {
+		return b.Paths.Models
+	}
+	return defaultModelsPath
+}
+
+func (b *Backend) responsesPath() string {
+	if b.Paths != nil && b.Paths.Responses != "" {
+		return b.Paths.Responses
+	}
+	return defaultResponsesPath
+}
+
+// healthPath is the self-test probe's path; "" probes the base URL, where
+// any answer below 500 will do.
+func (b *Backend) healthPath() string {
+	if b.Paths != nil && b.Paths.Health != "" {
+		return b.Paths.Health
+	}
+	switch b.Type {
+	case "vllm", "tgi":
+		return defaultHealthPath
+	case "openai":
+		return b.modelsPath()
+	}
+	return ""
+}
+
+// backendURL joins path, which may carry a query, onto a backend's base
+// URL. The base URL's own path stays as a prefix, with exactly one slash
+// at the join however either side is written, and its query parameters
+// (such as ?deployment=) are kept ahead of the path's. An empty path
+// leaves the base URL as it is.
+func backendURL(base, path string) string {
+	u, err := url.Parse(base)
+	if err != nil {
+		// Unparseable URLs fail when the request is built
+		return strings.TrimSuffix(base, "/") + path
+	}
+	path, query, _ := strings.Cut(path, "?")
+	if path != "" {
+		u = u.JoinPath(path)
+	}
+	if query != "" {
+		if u.RawQuery != "" {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += query
+	}
+	return u.String()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestBackendURL(t *testing.T) {
+	tests := []struct {
+		base, path, want string
+	}{
+		{"http://vllm:8000", "/v1/chat/completions", "http://vllm:8000/v1/chat/completions"},
+		{"http://vllm:8000/", "/v1/chat/completions", "http://vllm:8000/v1/chat/completions"},
+		{"http://vllm:8000", "v1/chat/completions", "http://vllm:8000/v1/chat/completions"},
+		{"http://vllm:8000//", "//v1/chat/completions", "http://vllm:8000/v1/chat/completions"},
+		{"http://proxy/llm", "/v1/chat/completions", "http://proxy/llm/v1/chat/completions"},
+		{"http://proxy/llm/", "/v1/models", "http://proxy/llm/v1/models"},
+		{"http://proxy//llm//", "/v1//models", "http://proxy/llm/v1/models"},
+		{"http://proxy/llm/", "/health/", "http://proxy/llm/health/"},
+		{"http://azure/openai?deployment=gpt4&api-version=2024-06-01", "/v1/chat/completions", "http://azure/openai/v1/chat/completions?deployment=gpt4&api-version=2024-06-01"},
+		{"http://gemini/v1beta", "/models/gemini-pro:streamGenerateContent?alt=sse", "http://gemini/v1beta/models/gemini-pro:streamGenerateContent?alt=sse"},
+		{"http://gemini/v1beta?key=k", "/models/g:streamGenerateContent?alt=sse", "http://gemini/v1beta/models/g:streamGenerateContent?key=k&alt=sse"},
+		{"http://vllm:8000/?x=1", "", "http://vllm:8000/?x=1"},
+		{"http://vllm:8000", "?probe=1", "http://vllm:8000?probe=1"},
+		{"http://bad host", "/v1/models", "http://bad host/v1/models"},
+	}
+	for _, tt := range tests {
+		if got := backendURL(tt.base, tt.path); got != tt.want {
+			t.Errorf("backendURL(%q, %q) = %q, want %q", tt.base, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestBackendPathDefaults(t *testing.T) {
+	custom := &BackendPaths{Chat: "/api/chat", Models: "/api/models", Responses: "/api/responses", Health: "/api/ping"}
+	tests := []struct {
+		typ                             string
+		paths                           *BackendPaths
+		chat, models, responses, health string
+	}{
+		{"openai", nil, defaultChatPath, defaultModelsPath, defaultResponsesPath, defaultModelsPath},
+		{"vllm", nil, defaultChatPath, defaultModelsPath, defaultResponsesPath, defaultHealthPath},
+		{"tgi", nil, defaultChatPath, defaultModelsPath, defaultResponsesPath, defaultHealthPath},
+		{"gemini", nil, defaultChatPath, defaultModelsPath, defaultResponsesPath, ""},
+		{"openai", &BackendPaths{Models: "/api/models"}, defaultChatPath, "/api/models", defaultResponsesPath, "/api/models"},
+		{"vllm", custom, "/api/chat", "/api/models", "/api/responses", "/api/ping"},
+	}
+	for _, tt := range tests {
+		b := &Backend{Type: tt.typ, Paths: tt.paths}
+		if b.chatPath() != tt.chat || b.modelsPath() != tt.models || b.responsesPath() != tt.responses || b.healthPath() != tt.health {
+			t.Errorf("%s %+v: paths %q %q %q %q", tt.typ, tt.paths, b.chatPath(), b.modelsPath(), b.responsesPath(), b.healthPath())
+		}
+	}
+}
+
+func TestBackendPathsValidate(t *testing.T) {
+	tests := []struct {
+		typ   string
+		paths BackendPaths
+		ok    bool
+	}{
+		{"openai", BackendPaths{Chat: "/api/v2/chat?deployment=a"}, true},
+		{"vllm", BackendPaths{Chat: "/chat", Models: "/models", Health: "/ping"}, true},
+		{"tgi", BackendPaths{Health: "/healthz"}, true},
+		{"tgi", BackendPaths{Chat: "/chat"}, false},
+		{"gemini", BackendPaths{Chat: "/chat"}, false},
+		{"openai", BackendPaths{Chat: "http://other/chat"}, false},
+		{"openai", BackendPaths{Models: "//other/models"}, false},
+		{"openai", BackendPaths{Health: "/ping#frag"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.paths.validate(tt.typ); (err == nil) != tt.ok {
+			t.Errorf("%s %+v: err = %v", tt.typ, tt.paths, err)
+		}
+	}
+}
+
+// recordingBackend serves OpenAI-style answers from a sub-path and records
+// the request URI of each request.
+func recordingBackend(t *testing.T) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var uris []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		uris = append(uris, r.URL.RequestURI())
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`{"object":"list","data":[{"id":"m","object":"model"}]}`))
+			return
+		}
+		w.Write([]byte(`{"id":"x","object":"chat.completion","model":"m","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), uris...)
+	}
+}
+
+func TestBackendPathsReachBackend(t *testing.T) {
+	captureLog(t)
+	srv, uris := recordingBackend(t)
+	t.Setenv("BACKEND_URL", "")
+	tests := []struct {
+		name  string
+		url   string
+		paths *BackendPaths
+		want  string
+	}{
+		{"default", srv.URL, nil, "/v1/chat/completions"},
+		{"trailing slash", srv.URL + "/", nil, "/v1/chat/completions"},
+		{"prefix", srv.URL + "/llm/", nil, "/llm/v1/chat/completions"},
+		{"double slashes", srv.URL + "//llm//", &BackendPaths{Chat: "//api//chat"}, "/llm/api/chat"},
+		{"query in url", srv.URL + "/openai?deployment=gpt4", nil, "/openai/v1/chat/completions?deployment=gpt4"},
+		{"query on both", srv.URL + "/openai?deployment=gpt4", &BackendPaths{Chat: "/chat?api-version=2024-06-01"}, "/openai/chat?deployment=gpt4&api-version=2024-06-01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := useCatalog(t, &ModelInfo{ID: "m", Backend: "b"})
+			c.backends["b"] = &Backend{Name: "b", Type: "openai", URL: tt.url, Paths: tt.paths}
+			if w := chatAs("", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`); w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			got := uris()
+			if got[len(got)-1] != tt.want {
+				t.Errorf("backend got %s, want %s", got[len(got)-1], tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeAndDiscoveryPaths(t *testing.T) {
+	srv, uris := recordingBackend(t)
+	b := &Backend{Name: t.Name(), Type: "openai", URL: srv.URL + "/llm?deployment=a", Paths: &BackendPaths{Health: "/ping"}}
+	if _, err := probeEndpoint(t.Context(), b, b.URL); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := discoverModels(srv.URL + "/llm/?deployment=a")
+	if err != nil || len(ids) != 1 || ids[0] != "m" {
+		t.Fatalf("discovered %v, %v", ids, err)
+	}
+	if got := uris(); len(got) != 2 || got[0] != "/llm/ping?deployment=a" || got[1] != "/llm/v1/models?deployment=a" {
+		t.Errorf("backend got %q", got)
+	}
+}
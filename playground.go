@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/hmac"
+	"embed"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// playgroundFiles is the playground page with its script and styles. No
+// asset is loaded from anywhere else.
+//
+//go:embed playground
+var playgroundFiles embed.FS
+
+// playgroundAccess is PLAYGROUND: "" when the playground is off, "admin"
+// or "key".
+var playgroundAccess string
+
+// loadPlayground reads PLAYGROUND, who may open /playground: "admin" for
+// holders of ADMIN_TOKEN, "key" for any caller the gateway would serve.
+func loadPlayground() (string, error) {
+	switch v := os.Getenv("PLAYGROUND"); v {
+	case "", "key":
+		return v, nil
+	case "admin":
+		if os.Getenv("ADMIN_TOKEN") == "" {
+			return "", fmt.Errorf("PLAYGROUND=admin needs ADMIN_TOKEN")
+		}
+		return v, nil
+	default:
+		return "", fmt.Errorf("invalid PLAYGROUND %q: want admin or key", v)
+	}
+}
+
+// requirePlayground serves next to callers PLAYGROUND lets in. Browsers
+// can't send a bearer token when opening a page, so the credential is also
+// taken as the password of HTTP basic auth, with an HMAC key's ID as the
+// user name.
+func requirePlayground(auth *hmacAuth, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if playgroundAccess == "" {
+			writeJSONError(w, http.StatusNotFound, "invalid_request_error", "not_found", "The playground is not enabled on this gateway")
+			return
+		}
+		if !playgroundAllowed(auth, r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gateway playground", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// playgroundAllowed reports whether r's credential opens the playground.
+// With PLAYGROUND=key and no authentication configured, anyone may.
+func playgroundAllowed(auth *hmacAuth, r *http.Request) bool {
+	user, secret, ok := r.BasicAuth()
+	if !ok {
+		secret, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if playgroundAccess == "admin" {
+		return hmac.Equal([]byte(secret), []byte(os.Getenv("ADMIN_TOKEN")))
+	}
+	if auth == nil && apiKeys == nil {
+		return true
+	}
+	if secret == "" {
+		return false
+	}
+	if apiKeys != nil {
+		if _, ok := apiKeys.authenticate(secret); ok {
+			return true
+		}
+	}
+	if auth != nil {
+		if want, ok := auth.secrets[user]; ok && hmac.Equal([]byte(secret), want) {
+			return true
+		}
+	}
+	return false
+}
+
+// playgroundHandler serves GET /playground and its assets under
+// /playground/{file}.
+func playgroundHandler(w http.ResponseWriter, r *http.Request) {
+	name := "index.html"
+	if file := r.PathValue("file"); file != "" {
+		name = file
+	}
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'self'; style-src 'self'; connect-src 'self'; form-action 'none'; frame-ancestors 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFileFS(w, r, playgroundFiles, "playground/"+name)
+}
@@ -0,0 +1,218 @@
+"use strict";
+
+// The playground talks to the gateway it is served from, with the same
+// credentials any client would use: an API key as a bearer token, or an
+// HMAC signature over the body.
+
+const $ = (id) => document.getElementById(id);
+const messages = [];
+
+function credentials() {
+  return JSON.parse(sessionStorage.getItem("playground-credentials") || "{}");
+}
+
+async function hmacHeaders(keyID, secret, body) {
+  const enc = new TextEncoder();
+  const key = await crypto.subtle.importKey("raw", enc.encode(secret), { name: "HMAC", hash: "SHA-256" }, false, ["sign"]);
+  const timestamp = Math.floor(Date.now() / 1000).toString();
+  const sig = await crypto.subtle.sign("HMAC", key, enc.encode(timestamp + "." + body));
+  const hex = Array.from(new Uint8Array(sig), (b) => b.toString(16).padStart(2, "0")).join("");
+  return { "X-Key-ID": keyID, "X-Timestamp": timestamp, "X-Signature": "sha256=" + hex };
+}
+
+async function call(method, path, body = "") {
+  const headers = {};
+  const creds = credentials();
+  if (creds.hmacID) {
+    Object.assign(headers, await hmacHeaders(creds.hmacID, creds.hmacSecret || "", body));
+  } else if (creds.apiKey) {
+    headers["Authorization"] = "Bearer " + creds.apiKey;
+  }
+  if (body) {
+    headers["Content-Type"] = "application/json";
+  }
+  return fetch(path, { method, headers, body: body || undefined });
+}
+
+async function loadModels() {
+  const list = $("models");
+  list.replaceChildren();
+  try {
+    const resp = await call("GET", "/v1/models");
+    if (!resp.ok) {
+      throw new Error(resp.status + " " + (await resp.text()));
+    }
+    const { data } = await resp.json();
+    for (const model of data) {
+      list.append(new Option(model.id));
+    }
+    if (!$("model").value && data.length > 0) {
+      $("model").value = data[0].id;
+    }
+  } catch (err) {
+    addMessage("error", "Could not list models: " + err.message);
+  }
+}
+
+function addMessage(role, text) {
+  const div = document.createElement("div");
+  div.className = "message " + role;
+  const label = document.createElement("span");
+  label.className = "role";
+  label.textContent = role;
+  const content = document.createElement("span");
+  content.textContent = text;
+  div.append(label, content);
+  $("conversation").append(div);
+  div.scrollIntoView({ block: "end" });
+  return content;
+}
+
+function showResponse(resp, started) {
+  $("status").textContent = resp.status + " " + resp.statusText;
+  $("request-id").textContent = resp.headers.get("X-Request-ID") || "–";
+  $("latency").textContent = Math.round(performance.now() - started) + " ms to headers";
+  $("usage").textContent = "–";
+  const rows = $("headers").tBodies[0];
+  rows.replaceChildren();
+  for (const [name, value] of resp.headers) {
+    if (name.startsWith("x-") || name === "server-timing" || name === "retry-after") {
+      const row = rows.insertRow();
+      row.insertCell().textContent = name;
+      row.insertCell().textContent = value;
+    }
+  }
+}
+
+function showUsage(usage) {
+  if (!usage) {
+    return;
+  }
+  let text = `prompt ${usage.prompt_tokens}, completion ${usage.completion_tokens}, total ${usage.total_tokens}`;
+  if (usage.estimated) {
+    text += " (estimated)";
+  }
+  $("usage").textContent = text;
+}
+
+// readStream appends the streamed content to out and returns the usage
+// chunk, if any.
+async function readStream(resp, out, started) {
+  const reader = resp.body.pipeThrough(new TextDecoderStream()).getReader();
+  let buffered = "";
+  let usage = null;
+  let firstToken = 0;
+  for (;;) {
+    const { value, done } = await reader.read();
+    if (done) {
+      break;
+    }
+    buffered += value;
+    const events = buffered.split("\n\n");
+    buffered = events.pop();
+    for (const event of events) {
+      const data = event.replace(/^data:\s*/, "");
+      if (data === "[DONE]") {
+        continue;
+      }
+      const chunk = JSON.parse(data);
+      if (chunk.error) {
+        throw new Error(chunk.error.message);
+      }
+      if (chunk.usage) {
+        usage = chunk.usage;
+      }
+      const delta = chunk.choices?.[0]?.delta?.content;
+      if (delta) {
+        firstToken ||= performance.now();
+        out.textContent += delta;
+      }
+    }
+  }
+  if (firstToken) {
+    $("latency").textContent += `, ${Math.round(firstToken - started)} ms to first token`;
+  }
+  return usage;
+}
+
+async function send(event) {
+  event.preventDefault();
+  const text = $("input").value.trim();
+  if (!text) {
+    return;
+  }
+  $("input").value = "";
+  messages.push({ role: "user", content: text });
+  addMessage("user", text);
+
+  const stream = $("stream").checked;
+  const req = { model: $("model").value, messages: [...messages], stream };
+  const system = $("system").value.trim();
+  if (system) {
+    req.messages.unshift({ role: "system", content: system });
+  }
+  const maxTokens = parseInt($("max-tokens").value, 10);
+  if (maxTokens > 0) {
+    req.max_tokens = maxTokens;
+  }
+  if (stream) {
+    req.stream_options = { include_usage: true };
+  }
+
+  $("send").disabled = true;
+  const started = performance.now();
+  try {
+    const resp = await call("POST", "/v1/chat/completions", JSON.stringify(req));
+    showResponse(resp, started);
+    if (!resp.ok) {
+      const body = await resp.text();
+      let message = body;
+      try {
+        message = JSON.parse(body).error.message;
+      } catch {}
+      throw new Error(message);
+    }
+    const out = addMessage("assistant", "");
+    let usage;
+    if (stream) {
+      usage = await readStream(resp, out, started);
+    } else {
+      const body = await resp.json();
+      out.textContent = body.choices?.[0]?.message?.content ?? "";
+      usage = body.usage;
+    }
+    $("latency").textContent += `, ${Math.round(performance.now() - started)} ms total`;
+    showUsage(usage);
+    messages.push({ role: "assistant", content: out.textContent });
+  } catch (err) {
+    addMessage("error", err.message);
+  } finally {
+    $("send").disabled = false;
+  }
+}
+
+document.addEventListener("DOMContentLoaded", () => {
+  const creds = credentials();
+  $("api-key").value = creds.apiKey || "";
+  $("hmac-id").value = creds.hmacID || "";
+  $("hmac-secret").value = creds.hmacSecret || "";
+  $("save-credentials").addEventListener("click", () => {
+    sessionStorage.setItem("playground-credentials", JSON.stringify({
+      apiKey: $("api-key").value.trim(),
+      hmacID: $("hmac-id").value.trim(),
+      hmacSecret: $("hmac-secret").value,
+    }));
+    loadModels();
+  });
+  $("clear").addEventListener("click", () => {
+    messages.length = 0;
+    $("conversation").replaceChildren();
+  });
+  $("composer").addEventListener("submit", send);
+  $("input").addEventListener("keydown", (e) => {
+    if (e.key === "Enter" && (e.ctrlKey || e.metaKey)) {
+      $("composer").requestSubmit();
+    }
+  });
+  loadModels();
+});
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultPoolMaxIdleConnsPerHost = 10
+	defaultPoolIdleTimeout         = 90 * time.Second
+	defaultPoolWaitWarning         = 500 * time.Millisecond
+)
+
+// PoolConfig sizes a backend's connection pool. Each backend has a pool of
+// its own, so a busy backend can't starve the others of connections.
+type PoolConfig struct {
+	// MaxIdleConnsPerHost is how many idle connections are kept (default 10)
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host,omitempty"`
+	// MaxConnsPerHost caps open connections; requests beyond it wait for one
+	// to free up (default 0, unlimited)
+	MaxConnsPerHost int `json:"max_conns_per_host,omitempty"`
+	// IdleTimeout closes connections idle this long (default 90s)
+	IdleTimeout string `json:"idle_timeout,omitempty"`
+
+	idleTimeout time.Duration
+}
+
+// validate fills in defaults once the catalog entry is parsed.
+func (p *PoolConfig) validate() error {
+	if p.MaxIdleConnsPerHost < 0 || p.MaxConnsPerHost < 0 {
+		return fmt.Errorf("pool connection limits must not be negative")
+	}
+	if p.MaxIdleConnsPerHost == 0 {
+		p.MaxIdleConnsPerHost = defaultPoolMaxIdleConnsPerHost
+	}
+	p.idleTimeout = defaultPoolIdleTimeout
+	if p.IdleTimeout != "" {
+		d, err := time.ParseDuration(p.IdleTimeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid pool idle_timeout %q", p.IdleTimeout)
+		}
+		p.idleTimeout = d
+	}
+	return nil
+}
+
+// poolStats is a snapshot of a backend's connection pool. Waits counts
+// requests that found no idle connection and had to dial or queue for one.
+type poolStats struct {
+	Open        int64   `json:"open"`
+	Idle        int64   `json:"idle"`
+	InUse       int64   `json:"in_use"`
+	Waits       int64   `json:"waits"`
+	WaitSeconds float64 `json:"wait_seconds_total"`
+
+	MaxIdleConnsPerHost int    `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int    `json:"max_conns_per_host"`
+	IdleTimeout         string `json:"idle_timeout"`
+}
+
+// backendPool is a backend's transport, wrapped to count its connections.
+type backendPool struct {
+	config    PoolConfig
+	proxy     string
+	transport *http.Transport
+	client    *http.Client
+	// stream has no overall timeout, since a stream legitimately outlives
+	// any fixed deadline; streams end via their context
+	stream *http.Client
+
+	open      atomic.Int64
+	inUse     atomic.Int64
+	waits     atomic.Int64
+	waitNanos atomic.Int64
+
+	// latency is an EWMA of time to response headers
+	mu      sync.Mutex
+	latency time.Duration
+}
+
+// latencyWeight is the weight of each new sample in the latency EWMA.
+const latencyWeight = 0.2
+
+func (p *backendPool) observeLatency(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.latency == 0 {
+		p.latency = d
+		return
+	}
+	p.latency = time.Duration(latencyWeight*float64(d) + (1-latencyWeight)*float64(p.latency))
+}
+
+func (p *backendPool) latencyEWMA() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.latency
+}
+
+// backendPools holds each backend's pool, by backend name.
+var backendPools = struct {
+	sync.Mutex
+	byName map[string]*backendPool
+}{byName: make(map[string]*backendPool)}
+
+func init() {
+	expvar.Publish("gateway_backend_pool", expvar.Func(func() any {
+		backendPools.Lock()
+		defer backendPools.Unlock()
+		stats := make(map[string]poolStats, len(backendPools.byName))
+		for name, p := range backendPools.byName {
+			stats[name] = p.stats()
+		}
+		return stats
+	}))
+}
+
+// poolFor returns backend's pool, creating it on first use. A catalog
+// reload that changes the pool or proxy config replaces the pool; the old one's
+// idle connections are closed and its busy ones finish undisturbed.
+func poolFor(backend *Backend) *backendPool {
+	config := PoolConfig{MaxIdleConnsPerHost: defaultPoolMaxIdleConnsPerHost, idleTimeout: defaultPoolIdleTimeout}
+	if backend.Pool != nil {
+		config = *backend.Pool
+	}
+	backendPools.Lock()
+	defer backendPools.Unlock()
+	p, ok := backendPools.byName[backend.Name]
+	if ok && p.config == config && p.proxy == backend.Proxy.key() {
+		return p
+	}
+	if ok {
+		p.transport.CloseIdleConnections()
+	}
+	p = newBackendPool(backend.Name, config, backend.Proxy)
+	backendPools.byName[backend.Name] = p
+	return p
+}
+
+// poolStatsFor reports backend's pool, or nil if it hasn't been used.
+func poolStatsFor(name string) *poolStats {
+	backendPools.Lock()
+	p, ok := backendPools.byName[name]
+	backendPools.Unlock()
+	if !ok {
+		return nil
+	}
+	s := p.stats()
+	return &s
+}
+
+func newBackendPool(name string, config PoolConfig, proxy *ProxyConfig) *backendPool {
+	p := &backendPool{config: config, proxy: proxy.key()}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+	p.transport = httpTransport.Clone()
+	p.transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	p.transport.MaxConnsPerHost = config.MaxConnsPerHost
+	p.transport.IdleConnTimeout = config.idleTimeout
+	configureProxy(p.transport, name, proxy)
+	p.transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		p.open.Add(1)
+		return &pooledConn{Conn: conn, release: sync.OnceFunc(func() { p.open.Add(-1) })}, nil
+	}
+
+	rt := &poolRoundTripper{pool: p, name: name}
+	p.client = &http.Client{Timeout: httpClient.Timeout, Transport: rt}
+	p.stream = &http.Client{Transport: rt}
+	return p
+}
+
+func (p *backendPool) stats() poolStats {
+	open, inUse := p.open.Load(), p.inUse.Load()
+	return poolStats{
+		Open:                open,
+		Idle:                max(open-inUse, 0),
+		InUse:               inUse,
+		Waits:               p.waits.Load(),
+		WaitSeconds:         time.Duration(p.waitNanos.Load()).Seconds(),
+		MaxIdleConnsPerHost: p.config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     p.config.MaxConnsPerHost,
+		IdleTimeout:         p.config.idleTimeout.String(),
+	}
+}
+
+// pooledConn counts itself out of the pool when closed.
+type pooledConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *pooledConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+// poolRoundTripper counts a connection as in use from when a request gets
+// it until the response body is closed, and times how long requests wait
+// for a connection. Waits over BACKEND_POOL_WAIT_WARNING (default 500ms)
+// are logged, since they usually mean the pool is exhausted.
+type poolRoundTripper struct {
+	pool *backendPool
+	name string
+}
+
+func (rt *poolRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	p := rt.pool
+	start := time.Now()
+	var got atomic.Bool
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			got.Store(true)
+			p.inUse.Add(1)
+			if info.Reused && info.WasIdle {
+				return
+			}
+			wait := time.Since(start)
+			p.waits.Add(1)
+			p.waitNanos.Add(int64(wait))
+			if threshold := envDuration("BACKEND_POOL_WAIT_WARNING", defaultPoolWaitWarning); wait > threshold {
+				s := p.stats()
+				log.Printf("Warning: waited %s for a connection to backend %s (open=%d in_use=%d max_conns_per_host=%d); the pool may be exhausted",
+					wait.Round(time.Millisecond), rt.name, s.Open, s.InUse, s.MaxConnsPerHost)
+			}
+		},
+	}
+	resp, err := p.transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		if got.Load() {
+			p.inUse.Add(-1)
+		}
+		return nil, asProxyError(err, rt.name, p.transport, req)
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		// Plain-HTTP requests go through the proxy without CONNECT, so its
+		// refusal arrives as the response
+		if proxy := proxyFor(p.transport, req); proxy != "" {
+			resp.Body.Close()
+			p.inUse.Add(-1)
+			proxyErrors.Add(rt.name, 1)
+			return nil, &proxyError{backend: rt.name, proxy: proxy, err: errors.New(resp.Status)}
+		}
+	}
+	p.observeLatency(time.Since(start))
+	resp.Body = &pooledBody{ReadCloser: resp.Body, release: sync.OnceFunc(func() { p.inUse.Add(-1) })}
+	return resp, nil
+}
+
+// pooledBody releases its connection from the in-use count when closed.
+type pooledBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *pooledBody) Close() error {
+	b.release()
+	return b.ReadCloser.Close()
+}
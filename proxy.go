@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// proxyErrors counts backend requests that failed at the outbound proxy
+// rather than at the backend, by backend name.
+var proxyErrors = expvar.NewMap("gateway_proxy_errors_total")
+
+// ProxyConfig routes a backend's connections through an outbound proxy.
+// Backends without one follow HTTPS_PROXY, HTTP_PROXY and NO_PROXY.
+type ProxyConfig struct {
+	// URL is an http://, https:// or socks5:// proxy. Credentials may be
+	// given as user:password@, sent as basic auth or SOCKS5 login
+	URL string `json:"url,omitempty"`
+	// Username and Password are credentials kept out of URL; Password may
+	// be a secret reference (env://, file:// or exec://)
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Direct connects without a proxy, whatever the environment says
+	Direct bool `json:"direct,omitempty"`
+
+	proxyURL *url.URL
+}
+
+// validate parses the proxy URL and resolves its password.
+func (p *ProxyConfig) validate() error {
+	if p.Direct {
+		if p.URL != "" {
+			return errors.New("proxy sets both url and direct")
+		}
+		return nil
+	}
+	if p.URL == "" {
+		return errors.New("proxy needs url or direct")
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("proxy url scheme %q is not http, https or socks5", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("proxy url %q has no host", u.Redacted())
+	}
+	if p.Username != "" || p.Password != "" {
+		if u.User != nil {
+			return errors.New("proxy credentials are in both url and username/password")
+		}
+		var password string
+		if p.Password != "" {
+			if password, err = resolveSecret(p.Password); err != nil {
+				return fmt.Errorf("proxy password: %w", err)
+			}
+		}
+		u.User = url.UserPassword(p.Username, password)
+	} else if password, ok := u.User.Password(); ok {
+		redactor.add(password)
+	}
+	p.proxyURL = u
+	return nil
+}
+
+// key identifies the proxy a pool dials through: "" for the environment's.
+func (p *ProxyConfig) key() string {
+	switch {
+	case p == nil:
+		return ""
+	case p.Direct:
+		return "direct"
+	}
+	return p.proxyURL.String()
+}
+
+// configureProxy points transport at backend's proxy. Failures to reach or
+// be let through the proxy become proxyErrors, so they are reported apart
+// from the backend's own. A proxy answering CONNECT with 502 or 504
+// reached the proxy but not the backend, so those stay backend errors.
+func configureProxy(transport *http.Transport, backend string, p *ProxyConfig) {
+	switch {
+	case p == nil:
+		// Cloned from httpTransport, which follows the environment
+	case p.Direct:
+		transport.Proxy = nil
+	default:
+		transport.Proxy = http.ProxyURL(p.proxyURL)
+	}
+	transport.OnProxyConnectResponse = func(ctx context.Context, proxyURL *url.URL, req *http.Request, resp *http.Response) error {
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusBadGateway, http.StatusGatewayTimeout:
+			return nil
+		}
+		return &proxyError{backend: backend, proxy: proxyURL.Redacted(), err: fmt.Errorf("CONNECT refused: %s", resp.Status)}
+	}
+}
+
+// proxyError is a backend request that failed at the outbound proxy.
+type proxyError struct {
+	backend string
+	proxy   string
+	err     error
+}
+
+func (e *proxyError) Error() string {
+	return fmt.Sprintf("proxy %s for backend %s: %v", e.proxy, e.backend, e.err)
+}
+
+func (e *proxyError) Unwrap() error { return e.err }
+
+// socksTargetFailures are the SOCKS5 replies of a proxy that is up but
+// couldn't reach the backend, as net/http words them.
+var socksTargetFailures = []string{"network unreachable", "host unreachable", "connection refused", "TTL expired"}
+
+// asProxyError recognizes transport errors from the proxy hop: the proxy
+// couldn't be dialed, its TLS failed, or a SOCKS5 handshake failed for a
+// reason other than the backend being unreachable.
+func asProxyError(err error, backend string, transport *http.Transport, req *http.Request) error {
+	var pe *proxyError
+	if errors.As(err, &pe) {
+		proxyErrors.Add(backend, 1)
+		return err
+	}
+	var op *net.OpError
+	if !errors.As(err, &op) {
+		return err
+	}
+	switch op.Op {
+	case "proxyconnect":
+	case "socks connect":
+		msg := op.Err.Error()
+		if slices.ContainsFunc(socksTargetFailures, func(s string) bool { return strings.HasSuffix(msg, s) }) {
+			return err
+		}
+	default:
+		return err
+	}
+	proxyErrors.Add(backend, 1)
+	return &proxyError{backend: backend, proxy: proxyFor(transport, req), err: err}
+}
+
+// proxyFor names the proxy transport uses for req, credentials redacted.
+func proxyFor(transport *http.Transport, req *http.Request) string {
+	if transport.Proxy == nil {
+		return ""
+	}
+	u, err := transport.Proxy(req)
+	if err != nil || u == nil {
+		return ""
+	}
+	return u.Redacted()
+}
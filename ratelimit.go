@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// backendRateLimited counts 429s from backends that reached the client,
+	// by backend; gatewayRateLimited counts 429s the gateway itself issued,
+	// by error code
+	backendRateLimited = expvar.NewMap("gateway_backend_rate_limited_total")
+	backendRateRetries = expvar.NewMap("gateway_backend_rate_limit_retries_total")
+	gatewayRateLimited = expvar.NewMap("gateway_rate_limited_total")
+)
+
+// doBackendRequest sends req to backend and returns its 200 response for the
+// caller to read and close; other statuses become *backendStatusError. A 429
+// is retried after the backend's advertised delay while that fits within
+// RATE_LIMIT_RETRY_BUDGET (default 0, never retry). For backends with
+// several endpoints, a connection that fails before reaching the backend is
+// retried on an endpoint this request hasn't tried yet. A compressed body
+// the backend couldn't read is resent uncompressed.
+func doBackendRequest(ctx context.Context, client *http.Client, backend *Backend, req ChatCompletionRequest, requestID string) (*http.Response, error) {
+	budget := envDuration("RATE_LIMIT_RETRY_BUDGET", 0)
+	timings := &recordFromContext(ctx).Timings
+	var tried []string
+	for {
+		endpoint := pickEndpoint(backend, tried)
+		httpReq, err := newBackendRequest(ctx, backend.atEndpoint(endpoint), req, requestID)
+		if err != nil {
+			return nil, err
+		}
+		compressed := compressRequest(httpReq, backend, requestID)
+		sent := time.Now()
+		endpointDone := startEndpointRequest(endpoint)
+		// The backend's time runs until its response is read and closed
+		backendDone := timings.backendCall(sent)
+		done := func() { endpointDone(); backendDone() }
+		resp, err := client.Do(httpReq)
+		noteEndpointRequest(backend, endpoint, time.Since(sent), err == nil)
+		observeEndpoint(backend, endpoint, time.Since(sent), err != nil || resp.StatusCode >= http.StatusInternalServerError)
+		if err != nil {
+			done()
+			noteEndpointError(endpoint, err)
+			tried = append(tried, endpoint)
+			if isDialError(err) && len(tried) < len(eligibleEndpoints(backend, 0)) && ctx.Err() == nil {
+				endpointFailovers.Add(backend.Name, 1)
+				log.Printf("Endpoint %s of backend %s unreachable for request %s: %v; failing over", endpoint, backend.Name, requestID, err)
+				continue
+			}
+			return nil, fmt.Errorf("failed to forward request: %w", err)
+		}
+		resp.Body = &endpointBody{ReadCloser: resp.Body, done: done}
+		if err := decodeBackendBody(resp); err != nil && resp.StatusCode == http.StatusOK {
+			resp.Body.Close()
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+
+		data := readErrorBody(resp, backend, requestID)
+		resp.Body.Close()
+		if compressed && rejectedCompression(backend, resp.StatusCode, data) {
+			log.Printf("Backend %s rejected compressed request %s with %d; retrying uncompressed", backend.Name, requestID, resp.StatusCode)
+			continue
+		}
+		statusErr := &backendStatusError{StatusCode: resp.StatusCode, Body: string(data), Header: resp.Header}
+
+		delay, ok := backendRetryAfter(resp.Header)
+		if resp.StatusCode != http.StatusTooManyRequests || !ok || delay > budget {
+			return nil, statusErr
+		}
+		budget -= delay
+		backendRateRetries.Add(backend.Name, 1)
+		log.Printf("Backend %s rate limited request %s; retrying in %s", backend.Name, requestID, delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, statusErr
+		case <-timer.C:
+			// Waiting out the backend's rate limit is its time, not ours
+			timings.add(&timings.backend, delay)
+		}
+	}
+}
+
+// backendRetryAfter reads how long a rate-limited backend asks us to wait:
+// Retry-After (seconds or HTTP date), retry-after-ms, or the later of
+// OpenAI's x-ratelimit-reset-requests and x-ratelimit-reset-tokens.
+func backendRetryAfter(h http.Header) (time.Duration, bool) {
+	if v := h.Get("Retry-After-Ms"); v != "" {
+		if ms, err := strconv.ParseFloat(v, 64); err == nil && ms >= 0 {
+			return time.Duration(ms * float64(time.Millisecond)), true
+		}
+	}
+	if v := h.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second, true
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return max(time.Until(t), 0), true
+		}
+	}
+
+	var delay time.Duration
+	found := false
+	for _, name := range []string{"X-Ratelimit-Reset-Requests", "X-Ratelimit-Reset-Tokens"} {
+		if d, err := time.ParseDuration(h.Get(name)); err == nil {
+			delay = max(delay, d)
+			found = true
+		}
+	}
+	return delay, found
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"time"
+)
+
+// policyPreferLocalRegion sends a backend's requests to endpoints in the
+// gateway's own region, failing over to other regions only once every local
+// endpoint has failed.
+const policyPreferLocalRegion = "prefer-local-region"
+
+// crossRegionRequests counts requests sent to an endpoint outside the
+// gateway's region, by backend. They cost more and are slower.
+var crossRegionRequests = expvar.NewMap("gateway_cross_region_requests_total")
+
+// gatewayRegion is the region this gateway runs in, from GATEWAY_REGION.
+func gatewayRegion() string {
+	return os.Getenv("GATEWAY_REGION")
+}
+
+// validateRegions checks a backend's region config once its endpoints are
+// known.
+func (b *Backend) validateRegions() error {
+	switch b.EndpointPolicy {
+	case "", policyPreferLocalRegion:
+	default:
+		return fmt.Errorf("unknown endpoint_policy %q: want %s", b.EndpointPolicy, policyPreferLocalRegion)
+	}
+	eps := b.endpoints()
+	for ep := range b.EndpointRegions {
+		if !slices.Contains(eps, ep) {
+			return fmt.Errorf("endpoint_regions names %q, which is not one of the backend's urls", ep)
+		}
+	}
+	return nil
+}
+
+// isLocal reports whether endpoint is in the gateway's region. Endpoints
+// without a region, and every endpoint of a gateway without one, are.
+func (b *Backend) isLocal(endpoint string) bool {
+	region, here := b.EndpointRegions[endpoint], gatewayRegion()
+	return region == "" || here == "" || region == here
+}
+
+// regionOrder reorders eps, rotated for balancing, for the
+// prefer-local-region policy: local endpoints first in rotation order, then
+// remote ones fastest first. A backend forced cross-region gets only its
+// remote endpoints.
+func regionOrder(b *Backend, eps []string) []string {
+	var local, remote []string
+	for _, ep := range eps {
+		if b.isLocal(ep) {
+			local = append(local, ep)
+		} else {
+			remote = append(remote, ep)
+		}
+	}
+	endpointBalancer.mu.Lock()
+	forced := endpointBalancer.forceRemote[b.Name]
+	latency := make([]time.Duration, len(remote))
+	for i, ep := range remote {
+		latency[i] = endpointBalancer.latency[ep]
+	}
+	endpointBalancer.mu.Unlock()
+	// Endpoints without a measurement sort first, so they get one
+	sort.Stable(byLatency{remote, latency})
+	if forced && len(remote) > 0 {
+		return remote
+	}
+	return append(local, remote...)
+}
+
+type byLatency struct {
+	eps     []string
+	latency []time.Duration
+}
+
+func (s byLatency) Len() int           { return len(s.eps) }
+func (s byLatency) Less(i, j int) bool { return s.latency[i] < s.latency[j] }
+func (s byLatency) Swap(i, j int) {
+	s.eps[i], s.eps[j] = s.eps[j], s.eps[i]
+	s.latency[i], s.latency[j] = s.latency[j], s.latency[i]
+}
+
+// noteEndpointRequest records a request sent to endpoint: cross-region
+// requests are counted, and the time to response headers goes into the
+// endpoint's latency EWMA.
+func noteEndpointRequest(b *Backend, endpoint string, d time.Duration, ok bool) {
+	if !b.isLocal(endpoint) {
+		crossRegionRequests.Add(b.Name, 1)
+	}
+	if !ok {
+		return
+	}
+	endpointBalancer.mu.Lock()
+	defer endpointBalancer.mu.Unlock()
+	if prev := endpointBalancer.latency[endpoint]; prev > 0 {
+		d = time.Duration(latencyWeight*float64(d) + (1-latencyWeight)*float64(prev))
+	}
+	endpointBalancer.latency[endpoint] = d
+}
+
+type regionEndpoint struct {
+	URL       string  `json:"url"`
+	Region    string  `json:"region,omitempty"`
+	Local     bool    `json:"local"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+}
+
+type backendRegions struct {
+	Backend          string           `json:"backend"`
+	Policy           string           `json:"endpoint_policy,omitempty"`
+	ForceCrossRegion bool             `json:"force_cross_region"`
+	Endpoints        []regionEndpoint `json:"endpoints"`
+}
+
+func regionsOf(b *Backend) backendRegions {
+	endpointBalancer.mu.Lock()
+	defer endpointBalancer.mu.Unlock()
+	br := backendRegions{Backend: b.Name, Policy: b.EndpointPolicy, ForceCrossRegion: endpointBalancer.forceRemote[b.Name]}
+	for _, ep := range b.endpoints() {
+		br.Endpoints = append(br.Endpoints, regionEndpoint{
+			URL:       ep,
+			Region:    b.EndpointRegions[ep],
+			Local:     b.isLocal(ep),
+			LatencyMS: float64(endpointBalancer.latency[ep].Microseconds()) / 1000,
+		})
+	}
+	return br
+}
+
+// regionsAdminHandler implements GET /admin/regions: the gateway's region
+// and each backend's endpoints with their regions and latency.
+func regionsAdminHandler(w http.ResponseWriter, r *http.Request) {
+	c := catalog.Load()
+	data := []backendRegions{}
+	for _, b := range c.backends {
+		data = append(data, regionsOf(b))
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].Backend < data[j].Backend })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"object": "list", "region": gatewayRegion(), "data": data})
+}
+
+// updateRegionHandler implements PATCH /admin/regions/{backend}. With
+// {"force_cross_region": true} the backend's local endpoints get no traffic,
+// e.g. during regional maintenance. The override is kept in memory: it
+// survives catalog reloads but not a restart.
+func updateRegionHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("backend")
+	b, ok := catalog.Load().backends[name]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "invalid_request_error", "backend_not_found", fmt.Sprintf("No backend %q in the catalog", name))
+		return
+	}
+	var req struct {
+		ForceCrossRegion *bool `json:"force_cross_region"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_json", "Invalid JSON: "+describeJSONError(err))
+		return
+	}
+	if req.ForceCrossRegion == nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_value", "force_cross_region is required")
+		return
+	}
+	if *req.ForceCrossRegion {
+		if b.EndpointPolicy != policyPreferLocalRegion {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_value",
+				fmt.Sprintf("Backend %q does not use endpoint_policy %s", name, policyPreferLocalRegion))
+			return
+		}
+		if !slices.ContainsFunc(b.endpoints(), func(ep string) bool { return !b.isLocal(ep) }) {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_value",
+				fmt.Sprintf("Backend %q has no endpoints outside region %q", name, gatewayRegion()))
+			return
+		}
+	}
+
+	endpointBalancer.mu.Lock()
+	if *req.ForceCrossRegion {
+		endpointBalancer.forceRemote[name] = true
+	} else {
+		delete(endpointBalancer.forceRemote, name)
+	}
+	endpointBalancer.mu.Unlock()
+	log.Printf("Admin set force_cross_region=%t for backend %s", *req.ForceCrossRegion, name)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(regionsOf(b))
+}
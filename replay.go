@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replayHeader marks requests sent by the replayer. Gateways started with
+// ACCEPT_REPLAY=true leave them out of webhook billing events.
+const replayHeader = "X-Gateway-Replay"
+
+// isReplay reports whether r is a replayed request the gateway should not bill.
+func isReplay(r *http.Request) bool {
+	return r.Header.Get(replayHeader) == "true" && os.Getenv("ACCEPT_REPLAY") == "true"
+}
+
+// replayRecord is one captured request and the response it got, one per
+// line of the input file.
+type replayRecord struct {
+	RequestID string          `json:"request_id"`
+	Request   json.RawMessage `json:"request"`
+	Status    int             `json:"status"`
+	Response  json.RawMessage `json:"response"`
+}
+
+// replayResult compares a replayed request with its recording.
+type replayResult struct {
+	RequestID string `json:"request_id"`
+	Error     string `json:"error,omitempty"`
+
+	RecordedStatus int `json:"recorded_status"`
+	ReplayedStatus int `json:"replayed_status"`
+
+	RecordedFinishReason string `json:"recorded_finish_reason,omitempty"`
+	ReplayedFinishReason string `json:"replayed_finish_reason,omitempty"`
+
+	RecordedTokens int `json:"recorded_completion_tokens"`
+	ReplayedTokens int `json:"replayed_completion_tokens"`
+
+	// Similarity is the word-level Jaccard similarity of the contents, 0..1
+	Similarity *float64 `json:"similarity,omitempty"`
+}
+
+// replaySummary totals the differences across a replay.
+type replaySummary struct {
+	Requests           int      `json:"requests"`
+	Errors             int      `json:"errors"`
+	StatusMismatches   int      `json:"status_mismatches"`
+	FinishMismatches   int      `json:"finish_reason_mismatches"`
+	MeanTokenDelta     float64  `json:"mean_completion_token_delta"`
+	MeanSimilarity     *float64 `json:"mean_similarity,omitempty"`
+	MismatchedRequests []string `json:"mismatched_requests,omitempty"`
+}
+
+type replayer struct {
+	target     string
+	key        string
+	similarity bool
+	client     *http.Client
+}
+
+// runReplay implements the replay subcommand: it sends captured requests to
+// a gateway and writes a JSON report of how the responses differ.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	input := fs.String("input", "", "JSONL file of captured {request_id, request, status, response} records")
+	target := fs.String("target", "http://localhost:8080", "base URL of the gateway to replay against")
+	key := fs.String("key", "", "bearer API key for the target gateway")
+	rate := fs.Float64("rate", 0, "requests per second (0 = unlimited)")
+	concurrency := fs.Int("concurrency", 4, "requests in flight at once")
+	report := fs.String("report", "", "report file (default stdout)")
+	similarity := fs.Bool("similarity", false, "compare response content")
+	fs.Parse(args)
+	if *input == "" {
+		return fmt.Errorf("-input is required")
+	}
+	if *concurrency < 1 {
+		return fmt.Errorf("-concurrency must be at least 1")
+	}
+
+	f, err := os.Open(*input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rp := &replayer{
+		target:     strings.TrimSuffix(*target, "/"),
+		key:        *key,
+		similarity: *similarity,
+		client:     &http.Client{Timeout: 5 * time.Minute},
+	}
+
+	var tick <-chan time.Time
+	if *rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var (
+		results []replayResult
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, *concurrency)
+	)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxBatchFileBytes)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var rec replayRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("%s line %d: %w", *input, line, err)
+		}
+		if rec.RequestID == "" {
+			rec.RequestID = fmt.Sprintf("line-%d", line)
+		}
+		if tick != nil {
+			<-tick
+		}
+		sem <- struct{}{}
+		// Results keep input order whatever order requests finish in
+		mu.Lock()
+		i := len(results)
+		results = append(results, replayResult{})
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			res := rp.replay(rec)
+			mu.Lock()
+			results[i] = res
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	out := io.Writer(os.Stdout)
+	if *report != "" {
+		rf, err := os.Create(*report)
+		if err != nil {
+			return err
+		}
+		defer rf.Close()
+		out = rf
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]any{"summary": summarizeReplay(results), "results": results})
+}
+
+// replay sends one recorded request, without streaming so the whole
+// response can be compared.
+func (rp *replayer) replay(rec replayRecord) replayResult {
+	res := replayResult{RequestID: rec.RequestID, RecordedStatus: rec.Status}
+	recorded := parseReplayResponse(rec.Response)
+	res.RecordedFinishReason, res.RecordedTokens = recorded.finishReason, recorded.tokens
+
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Request, &body); err != nil {
+		res.Error = "invalid recorded request: " + err.Error()
+		return res
+	}
+	delete(body, "stream")
+	delete(body, "stream_options")
+	data, _ := json.Marshal(body)
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, rp.target+"/v1/chat/completions", bytes.NewReader(data))
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(replayHeader, "true")
+	req.Header.Set("X-Request-ID", rec.RequestID)
+	if rp.key != "" {
+		req.Header.Set("Authorization", "Bearer "+rp.key)
+	}
+
+	resp, err := rp.client.Do(req)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.ReplayedStatus = resp.StatusCode
+	replayed := parseReplayResponse(respBody)
+	res.ReplayedFinishReason, res.ReplayedTokens = replayed.finishReason, replayed.tokens
+
+	if rp.similarity && recorded.ok && replayed.ok {
+		s := wordSimilarity(recorded.content, replayed.content)
+		res.Similarity = &s
+	}
+	return res
+}
+
+type replayResponse struct {
+	ok           bool
+	content      string
+	finishReason string
+	tokens       int
+}
+
+func parseReplayResponse(data []byte) replayResponse {
+	var resp ChatCompletionResponse
+	if len(data) == 0 || json.Unmarshal(data, &resp) != nil || len(resp.Choices) == 0 {
+		return replayResponse{}
+	}
+	return replayResponse{
+		ok:           true,
+		content:      resp.Choices[0].Message.Content,
+		finishReason: resp.Choices[0].FinishReason,
+		tokens:       resp.Usage.CompletionTokens,
+	}
+}
+
+// wordSimilarity is the Jaccard similarity of the word sets of a and b.
+func wordSimilarity(a, b string) float64 {
+	words := func(s string) map[string]bool {
+		set := make(map[string]bool)
+		for _, w := range strings.Fields(strings.ToLower(s)) {
+			set[w] = true
+		}
+		return set
+	}
+	wa, wb := words(a), words(b)
+	if len(wa) == 0 && len(wb) == 0 {
+		return 1
+	}
+	shared := 0
+	for w := range wa {
+		if wb[w] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(wa)+len(wb)-shared)
+}
+
+func summarizeReplay(results []replayResult) replaySummary {
+	s := replaySummary{Requests: len(results)}
+	var tokenDelta, similarity float64
+	compared, scored := 0, 0
+	for _, r := range results {
+		if r.Error != "" {
+			s.Errors++
+			s.MismatchedRequests = append(s.MismatchedRequests, r.RequestID)
+			continue
+		}
+		mismatch := false
+		if r.RecordedStatus != 0 && r.RecordedStatus != r.ReplayedStatus {
+			s.StatusMismatches++
+			mismatch = true
+		}
+		if r.RecordedFinishReason != r.ReplayedFinishReason {
+			s.FinishMismatches++
+			mismatch = true
+		}
+		if mismatch {
+			s.MismatchedRequests = append(s.MismatchedRequests, r.RequestID)
+		}
+		tokenDelta += math.Abs(float64(r.ReplayedTokens - r.RecordedTokens))
+		compared++
+		if r.Similarity != nil {
+			similarity += *r.Similarity
+			scored++
+		}
+	}
+	if compared > 0 {
+		s.MeanTokenDelta = tokenDelta / float64(compared)
+	}
+	if scored > 0 {
+		mean := similarity / float64(scored)
+		s.MeanSimilarity = &mean
+	}
+	return s
+}
+
+// replayMain runs the replay subcommand and exits.
+func replayMain(args []string) {
+	if err := runReplay(args); err != nil {
+		log.Fatalf("replay: %v", err)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestStartHeader carries when a client, or a queue in front of the
+// gateway, first accepted the request, in Unix milliseconds.
+const requestStartHeader = "X-Request-Start"
+
+const defaultRequestStartSkew = time.Second
+
+var (
+	// requestAges is how old requests carrying X-Request-Start were on
+	// arrival
+	requestAges = newHistogram("gateway_request_age_seconds", []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300})
+	// staleRequests counts requests rejected as too old, by route
+	staleRequests = expvar.NewMap("gateway_stale_requests_total")
+)
+
+// requestAge returns how old r was when it arrived at start, by its
+// X-Request-Start header, and false when it has none or it doesn't parse.
+// A start in the future, from a client clock running ahead, is age zero.
+func requestAge(r *http.Request, start time.Time) (time.Duration, bool) {
+	v := r.Header.Get(requestStartHeader)
+	if v == "" {
+		return 0, false
+	}
+	ms, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, false
+	}
+	return max(start.Sub(time.UnixMilli(ms)), 0), true
+}
+
+// staleRejection is nil unless STALE_REQUEST_CONFIG is set.
+var staleRejection *staleRequestPolicy
+
+// StaleRequests is a route's request age limit, as configured in
+// STALE_REQUEST_CONFIG:
+//
+//	{"POST /v1/chat/completions": {"max_age": "30s"}}
+type StaleRequests struct {
+	// MaxAge is the oldest X-Request-Start the route serves
+	MaxAge string `json:"max_age"`
+
+	maxAge time.Duration
+}
+
+func (s *StaleRequests) validate() error {
+	d, err := time.ParseDuration(s.MaxAge)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid max_age %q", s.MaxAge)
+	}
+	s.maxAge = d
+	return nil
+}
+
+// staleRequestPolicy holds each configured route's age limit.
+type staleRequestPolicy struct {
+	routes map[string]*StaleRequests
+	// skew is how far the client's clock may be behind the gateway's
+	// before its requests count as stale
+	skew time.Duration
+}
+
+// loadStaleRejection reads the per-route age limits in the JSON file named
+// by STALE_REQUEST_CONFIG, allowing REQUEST_START_SKEW (default 1s) of
+// clock skew. It returns nil when none are configured.
+func loadStaleRejection() (*staleRequestPolicy, error) {
+	path := os.Getenv("STALE_REQUEST_CONFIG")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string]*StaleRequests
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	for route, s := range file {
+		if err := s.validate(); err != nil {
+			return nil, fmt.Errorf("stale requests for %q: %w", route, err)
+		}
+	}
+	skew := envDuration("REQUEST_START_SKEW", defaultRequestStartSkew)
+	if skew < 0 {
+		return nil, fmt.Errorf("REQUEST_START_SKEW must not be negative")
+	}
+	return &staleRequestPolicy{routes: file, skew: skew}, nil
+}
+
+// checkRoutes fails for limits naming routes that aren't registered.
+func (p *staleRequestPolicy) checkRoutes(patterns []string) error {
+	if p == nil {
+		return nil
+	}
+	for route := range p.routes {
+		if !slices.Contains(patterns, route) {
+			return fmt.Errorf("stale requests for unknown route %q", route)
+		}
+	}
+	return nil
+}
+
+// route returns the limit configured for route, or nil.
+func (p *staleRequestPolicy) route(route string) *StaleRequests {
+	if p == nil {
+		return nil
+	}
+	return p.routes[route]
+}
+
+// reject answers 408 stale_request, and reports true, when rec's request
+// is older than its route allows.
+func (p *staleRequestPolicy) reject(w http.ResponseWriter, rec *requestRecord) bool {
+	s := p.route(rec.Route)
+	if s == nil || !rec.HasAge || rec.Age <= s.maxAge+p.skew {
+		return false
+	}
+	staleRequests.Add(rec.Route, 1)
+	writeJSONError(w, http.StatusRequestTimeout, "invalid_request_error", "stale_request",
+		fmt.Sprintf("Request is %s old, older than the %s this endpoint accepts", rec.Age.Round(time.Millisecond), s.MaxAge))
+	return true
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCompressMinBytes = 64 << 10
+	// compressionBackoff is how long a backend that rejected a compressed
+	// request is sent uncompressed ones
+	compressionBackoff = 10 * time.Minute
+)
+
+var (
+	// requestCompressionBytes counts compressed request bodies' bytes per
+	// backend, before ("<backend>:uncompressed") and after
+	// ("<backend>:compressed") compression; their ratio is the saving
+	requestCompressionBytes = expvar.NewMap("gateway_request_compression_bytes_total")
+	// requestCompressionFallbacks counts compressed requests a backend
+	// rejected and that were resent uncompressed
+	requestCompressionFallbacks = expvar.NewMap("gateway_request_compression_fallbacks_total")
+)
+
+// RequestCompression gzips chat completions request bodies of at least
+// MinBytes to a backend known to accept Content-Encoding: gzip.
+type RequestCompression struct {
+	// MinBytes is the smallest body compressed (default 64 KiB)
+	MinBytes int `json:"min_bytes,omitempty"`
+	// Level is the gzip level, 1 (fastest) to 9 (smallest); default 6
+	Level int `json:"level,omitempty"`
+}
+
+// validate fills in defaults once the catalog entry is parsed.
+func (c *RequestCompression) validate(backendType string) error {
+	if backendType != "openai" && backendType != "vllm" {
+		return fmt.Errorf("request_compression is not supported for %s backends", backendType)
+	}
+	if c.MinBytes < 0 {
+		return errors.New("request_compression min_bytes must not be negative")
+	}
+	if c.MinBytes == 0 {
+		c.MinBytes = defaultCompressMinBytes
+	}
+	if c.Level == 0 {
+		c.Level = gzip.DefaultCompression
+	}
+	if c.Level != gzip.DefaultCompression && (c.Level < gzip.BestSpeed || c.Level > gzip.BestCompression) {
+		return fmt.Errorf("request_compression level must be 1 to 9")
+	}
+	return nil
+}
+
+// compressionRejected remembers when each backend last rejected a
+// compressed request.
+var compressionRejected sync.Map
+
+// compressRequest gzips httpReq's body in place when backend is configured
+// for it and the body is large enough. It reports whether it did.
+func compressRequest(httpReq *http.Request, backend *Backend, requestID string) bool {
+	c := backend.RequestCompression
+	if c == nil || httpReq.GetBody == nil || httpReq.ContentLength < int64(c.MinBytes) {
+		return false
+	}
+	if at, ok := compressionRejected.Load(backend.Name); ok && time.Since(at.(time.Time)) < compressionBackoff {
+		return false
+	}
+	body, err := httpReq.GetBody()
+	if err != nil {
+		return false
+	}
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, c.Level)
+	n, err := io.Copy(zw, body)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		log.Printf("Request %s to backend %s sent uncompressed: %v", requestID, backend.Name, err)
+		return false
+	}
+
+	compressed := buf.Bytes()
+	httpReq.Body = io.NopCloser(bytes.NewReader(compressed))
+	httpReq.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(compressed)), nil }
+	httpReq.ContentLength = int64(len(compressed))
+	httpReq.Header.Set("Content-Encoding", "gzip")
+	requestCompressionBytes.Add(backend.Name+":uncompressed", n)
+	requestCompressionBytes.Add(backend.Name+":compressed", int64(len(compressed)))
+	log.Printf("Compressed request %s to backend %s: %d to %d bytes (%.1fx)", requestID, backend.Name, n, len(compressed), float64(n)/float64(max(len(compressed), 1)))
+	return true
+}
+
+// rejectedCompression reports whether a backend's error response to a
+// compressed request means it couldn't read the body: a 415, or a 400
+// about the encoding or unparseable JSON. The backend is then sent
+// uncompressed requests for compressionBackoff.
+func rejectedCompression(backend *Backend, status int, body []byte) bool {
+	switch status {
+	case http.StatusUnsupportedMediaType:
+	case http.StatusBadRequest:
+		text := strings.ToLower(string(body))
+		if !strings.Contains(text, "encoding") && !strings.Contains(text, "gzip") && !strings.Contains(text, "json") {
+			return false
+		}
+	default:
+		return false
+	}
+	compressionRejected.Store(backend.Name, time.Now())
+	requestCompressionFallbacks.Add(backend.Name, 1)
+	return true
+}
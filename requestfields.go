@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// shapeProtectedFields can't be stripped or renamed: the gateway routes and
+// relays by them.
+var shapeProtectedFields = []string{"model", "messages", "stream"}
+
+// RequestFields shapes the top-level fields of chat completions requests
+// sent to one backend, for servers that reject fields others need. Strip
+// runs first, then Rename, then Require.
+type RequestFields struct {
+	// Strip lists fields removed from requests to the backend
+	Strip []string `json:"strip,omitempty"`
+	// Rename maps fields to the name the backend knows them by
+	Rename map[string]string `json:"rename,omitempty"`
+	// Require sets fields requests lack to a default (e.g. {"max_tokens": 1024})
+	Require map[string]json.RawMessage `json:"require,omitempty"`
+}
+
+// validate checks the fields a backend of backendType can be sent. The
+// translated types (bedrock, gemini, tgi) only read the request fields
+// they translate, so renaming to or requiring any other field would do
+// nothing there.
+func (f *RequestFields) validate(backendType string) error {
+	forwarded := backendType == "openai" || backendType == "vllm"
+	known := requestFields()
+	for _, field := range f.Strip {
+		if slices.Contains(shapeProtectedFields, field) {
+			return fmt.Errorf("request_fields can't strip %q", field)
+		}
+	}
+	for from, to := range f.Rename {
+		switch {
+		case slices.Contains(shapeProtectedFields, from) || slices.Contains(shapeProtectedFields, to):
+			return fmt.Errorf("request_fields can't rename %q to %q", from, to)
+		case slices.Contains(f.Strip, from):
+			return fmt.Errorf("request_fields strips and renames %q", from)
+		case to == "" || to == from:
+			return fmt.Errorf("request_fields renames %q to %q", from, to)
+		case !forwarded && !slices.Contains(known, to):
+			return fmt.Errorf("request_fields renames %q to %q, which %s backends don't read", from, to, backendType)
+		}
+	}
+	for field, value := range f.Require {
+		switch {
+		case slices.Contains(shapeProtectedFields, field):
+			return fmt.Errorf("request_fields can't require %q", field)
+		case !json.Valid(value):
+			return fmt.Errorf("request_fields require %q has an invalid default", field)
+		case !forwarded && !slices.Contains(known, field):
+			return fmt.Errorf("request_fields requires %q, which %s backends don't read", field, backendType)
+		}
+		var into ChatCompletionRequest
+		if err := json.Unmarshal(fmt.Appendf(nil, `{%q: %s}`, field, value), &into); err != nil {
+			return fmt.Errorf("request_fields require %q: %s", field, describeJSONError(err))
+		}
+	}
+	return nil
+}
+
+// shapeRequest applies b's request field policy to req and returns the
+// changes made, for dry-run reports. Fields outside the request type are
+// carried in Extensions, which are merged into the body sent.
+func shapeRequest(req *ChatCompletionRequest, b *Backend) []string {
+	f := b.RequestFields
+	if f == nil {
+		return nil
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) != nil {
+		return nil
+	}
+
+	var applied []string
+	for _, field := range f.Strip {
+		if _, ok := fields[field]; ok {
+			delete(fields, field)
+			noteIgnoredField(field, "stripped")
+			applied = append(applied, fmt.Sprintf("stripped %s for backend %s", field, b.Name))
+		}
+	}
+	for _, from := range sortedKeys(f.Rename) {
+		if v, ok := fields[from]; ok {
+			delete(fields, from)
+			fields[f.Rename[from]] = v
+			applied = append(applied, fmt.Sprintf("renamed %s to %s for backend %s", from, f.Rename[from], b.Name))
+		}
+	}
+	for _, field := range sortedKeys(f.Require) {
+		if _, ok := fields[field]; !ok {
+			fields[field] = f.Require[field]
+			applied = append(applied, fmt.Sprintf("set %s to %s for backend %s", field, f.Require[field], b.Name))
+		}
+	}
+	if len(applied) == 0 {
+		return nil
+	}
+
+	data, _ = json.Marshal(fields)
+	var shaped ChatCompletionRequest
+	if err := json.Unmarshal(data, &shaped); err != nil {
+		return nil
+	}
+	known := requestFields()
+	for k, v := range fields {
+		if !slices.Contains(known, k) {
+			if shaped.Extensions == nil {
+				shaped.Extensions = make(map[string]json.RawMessage)
+			}
+			shaped.Extensions[k] = v
+		}
+	}
+	*req = shaped
+	return applied
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// wireField returns the JSON at a dotted path in body, or "" when absent.
+func wireField(t *testing.T, body []byte, path string) string {
+	t.Helper()
+	v := json.RawMessage(body)
+	for _, key := range strings.Split(path, ".") {
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(v, &obj) != nil {
+			return ""
+		}
+		var ok bool
+		if v, ok = obj[key]; !ok {
+			return ""
+		}
+	}
+	return string(v)
+}
+
+// Each built-in backend type gets its policy in the body it is sent, in
+// its own wire format.
+func TestShapeRequestPerBackendType(t *testing.T) {
+	captureLog(t)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	useCatalog(t)
+	tests := []struct {
+		typ     string
+		fields  RequestFields
+		request string
+		applied []string
+		// wire maps dotted paths in the body sent to their JSON; "" is absent
+		wire map[string]string
+	}{
+		{"openai",
+			RequestFields{Strip: []string{"user"}, Rename: map[string]string{"max_tokens": "max_completion_tokens"},
+				Require: map[string]json.RawMessage{"store": json.RawMessage(`false`), "parallel_tool_calls": json.RawMessage(`true`)}},
+			`{"model":"m","messages":[{"role":"user","content":"hi"}],"user":"u-1","max_tokens":5}`,
+			[]string{"stripped user for backend b", "renamed max_tokens to max_completion_tokens for backend b",
+				"set parallel_tool_calls to true for backend b", "set store to false for backend b"},
+			map[string]string{"user": "", "max_tokens": "", "max_completion_tokens": "5", "store": "false", "parallel_tool_calls": "true"}},
+		// llama.cpp and other strict servers behind the vllm type
+		{"vllm",
+			RequestFields{Strip: []string{"top_k", "logprobs"}, Require: map[string]json.RawMessage{"repetition_penalty": json.RawMessage(`1.1`)}},
+			`{"model":"m","messages":[{"role":"user","content":"hi"}],"top_k":40,"logprobs":true,"min_p":0.1}`,
+			[]string{"stripped top_k for backend b", "stripped logprobs for backend b", "set repetition_penalty to 1.1 for backend b"},
+			map[string]string{"top_k": "", "logprobs": "", "min_p": "0.1", "repetition_penalty": "1.1"}},
+		{"tgi",
+			RequestFields{Strip: []string{"temperature"}, Require: map[string]json.RawMessage{"max_tokens": json.RawMessage(`256`)}},
+			`{"model":"m","messages":[{"role":"user","content":"hi"}],"temperature":0.5}`,
+			[]string{"stripped temperature for backend b", "set max_tokens to 256 for backend b"},
+			map[string]string{"parameters.temperature": "", "parameters.max_new_tokens": "256"}},
+		{"gemini",
+			RequestFields{Strip: []string{"seed"}, Rename: map[string]string{"max_completion_tokens": "max_tokens"}},
+			`{"model":"m","messages":[{"role":"user","content":"hi"}],"seed":7,"max_completion_tokens":100}`,
+			[]string{"stripped seed for backend b", "renamed max_completion_tokens to max_tokens for backend b"},
+			map[string]string{"generationConfig.seed": "", "generationConfig.maxOutputTokens": "100"}},
+		// Anthropic models on Bedrock need max_tokens
+		{"bedrock",
+			RequestFields{Require: map[string]json.RawMessage{"max_tokens": json.RawMessage(`1024`)}},
+			`{"model":"m","messages":[{"role":"user","content":"hi"}]}`,
+			[]string{"set max_tokens to 1024 for backend b"},
+			map[string]string{"inferenceConfig.maxTokens": "1024"}},
+		{"bedrock",
+			RequestFields{Require: map[string]json.RawMessage{"max_tokens": json.RawMessage(`1024`)}},
+			`{"model":"m","messages":[{"role":"user","content":"hi"}],"max_tokens":10}`,
+			nil,
+			map[string]string{"inferenceConfig.maxTokens": "10"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typ, func(t *testing.T) {
+			if err := tt.fields.validate(tt.typ); err != nil {
+				t.Fatal(err)
+			}
+			backend := &Backend{Name: "b", Type: tt.typ, URL: "http://backend", Region: "us-east-1", APIKey: "k", RequestFields: &tt.fields}
+			var req ChatCompletionRequest
+			if err := json.Unmarshal([]byte(tt.request), &req); err != nil {
+				t.Fatal(err)
+			}
+			if applied := shapeRequest(&req, backend); !slices.Equal(applied, tt.applied) {
+				t.Errorf("applied = %q\nwant %q", applied, tt.applied)
+			}
+			httpReq, err := adapterFor(backend).newRequest(context.Background(), backend, req, "req-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(httpReq.Body)
+			for path, want := range tt.wire {
+				if got := wireField(t, body, path); got != want {
+					t.Errorf("%s = %q, want %q in %s", path, got, want, body)
+				}
+			}
+		})
+	}
+}
+
+func TestShapeRequestWithoutPolicy(t *testing.T) {
+	req := ChatCompletionRequest{Model: "m", User: "u"}
+	if applied := shapeRequest(&req, &Backend{Name: "b"}); applied != nil || req.User != "u" {
+		t.Errorf("applied %q, user %q", applied, req.User)
+	}
+	// A policy naming fields the request doesn't have changes nothing
+	f := &RequestFields{Strip: []string{"seed"}, Rename: map[string]string{"top_p": "nucleus"}}
+	if applied := shapeRequest(&req, &Backend{Name: "b", RequestFields: f}); applied != nil || req.User != "u" {
+		t.Errorf("applied %q, user %q", applied, req.User)
+	}
+}
+
+func TestShapeRequestCountsStrippedFields(t *testing.T) {
+	captureLog(t)
+	before := expvarInt(ignoredFieldsTotal, "user")
+	req := ChatCompletionRequest{Model: "m", User: "u"}
+	shapeRequest(&req, &Backend{Name: "b", RequestFields: &RequestFields{Strip: []string{"user"}}})
+	if got := expvarInt(ignoredFieldsTotal, "user") - before; got != 1 || req.User != "" {
+		t.Errorf("counted %d, user %q", got, req.User)
+	}
+}
+
+func TestRequestFieldsValidate(t *testing.T) {
+	raw := func(s string) map[string]json.RawMessage {
+		return map[string]json.RawMessage{"max_tokens": json.RawMessage(s)}
+	}
+	tests := []struct {
+		typ    string
+		fields RequestFields
+		err    string
+	}{
+		{"openai", RequestFields{Strip: []string{"user"}, Rename: map[string]string{"foo": "bar"}, Require: map[string]json.RawMessage{"store": json.RawMessage(`false`)}}, ""},
+		{"openai", RequestFields{Strip: []string{"model"}}, `request_fields can't strip "model"`},
+		{"vllm", RequestFields{Rename: map[string]string{"stream": "streaming"}}, `request_fields can't rename "stream" to "streaming"`},
+		{"vllm", RequestFields{Rename: map[string]string{"n": "messages"}}, `request_fields can't rename "n" to "messages"`},
+		{"openai", RequestFields{Strip: []string{"user"}, Rename: map[string]string{"user": "end_user"}}, `request_fields strips and renames "user"`},
+		{"openai", RequestFields{Rename: map[string]string{"user": "user"}}, `request_fields renames "user" to "user"`},
+		{"openai", RequestFields{Require: map[string]json.RawMessage{"messages": json.RawMessage(`[]`)}}, `request_fields can't require "messages"`},
+		{"openai", RequestFields{Require: raw(`{`)}, `request_fields require "max_tokens" has an invalid default`},
+		{"openai", RequestFields{Require: raw(`"many"`)}, `request_fields require "max_tokens": field "max_tokens" must be an integer, not a string`},
+		// Translated types only read chat completions fields
+		{"bedrock", RequestFields{Require: raw(`1024`)}, ""},
+		{"bedrock", RequestFields{Require: map[string]json.RawMessage{"anthropic_version": json.RawMessage(`"x"`)}}, `request_fields requires "anthropic_version", which bedrock backends don't read`},
+		{"gemini", RequestFields{Rename: map[string]string{"max_completion_tokens": "max_output_tokens"}}, `request_fields renames "max_completion_tokens" to "max_output_tokens", which gemini backends don't read`},
+		{"tgi", RequestFields{Strip: []string{"top_p"}, Rename: map[string]string{"max_completion_tokens": "max_tokens"}}, ""},
+	}
+	for _, tt := range tests {
+		var got string
+		if err := tt.fields.validate(tt.typ); err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("%s %+v: err = %q, want %q", tt.typ, tt.fields, got, tt.err)
+		}
+	}
+}
+
+func TestCatalogRejectsBadRequestFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "catalog.json")
+	os.WriteFile(path, []byte(`{"backends":{"strict":{"type":"openai","url":"http://strict:8000","request_fields":{"strip":["messages"]}}},"models":[{"id":"m","backend":"strict"}]}`), 0o600)
+	t.Setenv("MODEL_CATALOG", path)
+	if _, err := loadCatalog(); err == nil || err.Error() != `backend "strict": request_fields can't strip "messages"` {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestRequestFieldsInDryRunAndOnTheWire(t *testing.T) {
+	captureLog(t)
+	t.Setenv("DRY_RUN_KEYS", "*")
+	back := useFakeBackend(t)
+	t.Setenv("BACKEND_URL", "")
+	c := useCatalog(t, &ModelInfo{ID: "m", Backend: "llamacpp"})
+	c.backends["llamacpp"] = &Backend{Name: "llamacpp", Type: "vllm", URL: back.URL, RequestFields: &RequestFields{
+		Strip:   []string{"user", "top_k"},
+		Require: map[string]json.RawMessage{"temperature": json.RawMessage(`0.2`)},
+	}}
+	body := `{"model":"m","messages":[{"role":"user","content":"hi"}],"user":"u-1","top_k":5}`
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	r.Header.Set(dryRunHeader, "true")
+	w := httptest.NewRecorder()
+	accessLog(http.HandlerFunc(chatCompletionsHandler)).ServeHTTP(w, r)
+	var report dryRunReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	for _, want := range []string{"stripped user for backend llamacpp", "stripped top_k for backend llamacpp", "set temperature to 0.2 for backend llamacpp"} {
+		if !slices.Contains(report.Transforms, want) {
+			t.Errorf("transforms = %q, want %q", report.Transforms, want)
+		}
+	}
+	if wireField(t, report.Request, "user") != "" || wireField(t, report.Request, "top_k") != "" || wireField(t, report.Request, "temperature") != "0.2" {
+		t.Errorf("dry-run request = %s", report.Request)
+	}
+	if len(back.Requests()) != 0 {
+		t.Fatal("dry run reached the backend")
+	}
+
+	// The request sent matches the report
+	if w := chatAs("", body); w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	last, _ := back.Last()
+	if wireField(t, last.Body, "user") != "" || wireField(t, last.Body, "top_k") != "" || wireField(t, last.Body, "temperature") != "0.2" {
+		t.Errorf("backend got %s", last.Body)
+	}
+}
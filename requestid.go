@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// maxRequestIDLength bounds client-supplied request IDs, which are echoed in
+// a response header and on every log line for the request.
+const maxRequestIDLength = 128
+
+// safeClientToken reports whether a client-supplied identifier is safe to
+// echo into headers and logs: 1 to max characters from [A-Za-z0-9._:-].
+func safeClientToken(s string, max int) bool {
+	if s == "" || len(s) > max {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == ':', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFrom returns the client's X-Request-ID (or Request-Id) when it is
+// safe to echo, and a fresh UUID otherwise.
+func requestIDFrom(r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" {
+		id = r.Header.Get("Request-Id")
+	}
+	if id == "" {
+		return uuid.New().String()
+	}
+	if !safeClientToken(id, maxRequestIDLength) {
+		log.Printf("Replacing invalid client request ID (%d bytes): %q", len(id), truncateForLog(id))
+		return uuid.New().String()
+	}
+	return id
+}
+
+// truncateForLog shortens a rejected value so it can't bloat the log line.
+func truncateForLog(s string) string {
+	if len(s) > 64 {
+		return s[:64] + "..."
+	}
+	return s
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/vinayhpandya/ai_inference_gateway/fakeback"
+)
+
+func TestSafeClientToken(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"req-123", true},
+		{"trace:abc.DEF_9", true},
+		{strings.Repeat("a", maxRequestIDLength), true},
+		{"", false},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+		{"abc\r\nSet-Cookie: x=1", false},
+		{"abc\n", false},
+		{"tab\there", false},
+		{"nul\x00", false},
+		{"space here", false},
+		{`quote"`, false},
+		{"héllo", false},
+	}
+	for _, tt := range tests {
+		if got := safeClientToken(tt.in, maxRequestIDLength); got != tt.want {
+			t.Errorf("safeClientToken(%q) = %t, want %t", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRequestIDFrom(t *testing.T) {
+	logs := captureLog(t)
+	tests := []struct {
+		name, header, value string
+		keep                bool
+	}{
+		{"client id", "X-Request-ID", "req-123", true},
+		{"request-id header", "Request-Id", "req-456", true},
+		{"none", "", "", false},
+		{"crlf", "X-Request-ID", "req\r\nX-Injected: 1", false},
+		{"10 KB", "X-Request-ID", strings.Repeat("a", 10<<10), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			got := requestIDFrom(r)
+			if tt.keep {
+				if got != tt.value {
+					t.Errorf("id = %q, want the client's %q", got, tt.value)
+				}
+				return
+			}
+			if _, err := uuid.Parse(got); err != nil {
+				t.Errorf("id = %q, want a fresh UUID", got)
+			}
+			if tt.value == "" {
+				return
+			}
+			line := logs.String()
+			if !strings.Contains(line, "Replacing invalid client request ID") || strings.Count(line, "\n") != 1 || strings.ContainsRune(line, '\r') || len(line) > 200 {
+				t.Errorf("logged %q, want one short line", line)
+			}
+		})
+	}
+}
+
+func TestChatReplacesUnsafeRequestID(t *testing.T) {
+	logs := captureLog(t)
+	back := useFakeBackend(t)
+	for _, id := range []string{"req\r\nX-Injected: 1", strings.Repeat("a", 10<<10)} {
+		logs.Reset()
+		back.Enqueue(fakeback.Behavior{Content: "ok"})
+		r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+		r.Header.Set("X-Request-ID", id)
+		w := httptest.NewRecorder()
+		accessLog(http.HandlerFunc(chatCompletionsHandler)).ServeHTTP(w, r)
+
+		got := w.Header().Get("X-Request-ID")
+		if _, err := uuid.Parse(got); err != nil {
+			t.Errorf("X-Request-ID = %q, want a fresh UUID", got)
+		}
+		if strings.Contains(w.Body.String(), id) {
+			t.Error("response echoes the client's request ID")
+		}
+		if reqs := back.Requests(); reqs[len(reqs)-1].Header.Get("X-Request-ID") != got {
+			t.Errorf("backend got X-Request-ID %q, want %q", reqs[len(reqs)-1].Header.Get("X-Request-ID"), got)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			if strings.Contains(line, "X-Injected") && !strings.Contains(line, `\r\n`) || len(line) > 1<<10 {
+				t.Errorf("log line %.200q", line)
+			}
+		}
+	}
+}
+
+func TestAccessLogQuotesPath(t *testing.T) {
+	logs := captureLog(t)
+	r := httptest.NewRequest(http.MethodGet, "/v1/models%0D%0Aaccess%20method=FAKE", nil)
+	accessLog(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), r)
+	if lines := strings.Split(strings.TrimSpace(logs.String()), "\n"); len(lines) != 1 || !strings.Contains(lines[0], `path="/v1/models\r\naccess method=FAKE"`) {
+		t.Errorf("logged %q, want the path quoted on one line", logs)
+	}
+}
+
+func TestUnsafeConversationIDRejected(t *testing.T) {
+	captureLog(t)
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+	r = r.WithContext(context.WithValue(r.Context(), identityContextKey{}, identity{KeyID: "k"}))
+	r.Header.Set("X-Conversation-ID", "c1\r\nX-Injected: 1")
+	w := httptest.NewRecorder()
+	accessLog(http.HandlerFunc(chatCompletionsHandler)).ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"code":"invalid_conversation_id"`) {
+		t.Errorf("response = %d %s, want 400 invalid_conversation_id", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	defaultMaxMessages     = 2048
+	defaultMaxMessageBytes = 1 << 20
+	defaultMaxContentBytes = 16 << 20
+)
+
+// limitedRoutes are the routes whose bodies the gateway decodes, with the
+// field holding their messages.
+var limitedRoutes = map[string]string{
+	"POST /v1/chat/completions": "messages",
+	"POST /v1/responses":        "input",
+	"POST /v1/tokenize":         "messages",
+}
+
+// requestLimitRejections counts requests over a limit, by limit.
+var requestLimitRejections = expvar.NewMap("gateway_request_limit_rejections_total")
+
+// requestLimits is loaded at startup; the defaults always apply.
+var requestLimits *requestLimitPolicy
+
+// RequestLimits bounds a request body, as REQUEST_MAX_MESSAGES,
+// REQUEST_MAX_MESSAGE_BYTES and REQUEST_MAX_CONTENT_BYTES set for every
+// route and REQUEST_LIMITS_CONFIG overrides per route:
+//
+//	{"POST /v1/responses": {"max_message_bytes": 8388608, "max_content_bytes": 67108864}}
+type RequestLimits struct {
+	// MaxMessages is how many entries the messages array may have
+	MaxMessages int `json:"max_messages,omitempty"`
+	// MaxMessageBytes is how long one message may be, as JSON
+	MaxMessageBytes int64 `json:"max_message_bytes,omitempty"`
+	// MaxContentBytes is how long the whole body may be
+	MaxContentBytes int64 `json:"max_content_bytes,omitempty"`
+}
+
+// requestLimitPolicy holds the default limits and each configured route's.
+// A route's limits left out fall back to the defaults.
+type requestLimitPolicy struct {
+	defaults RequestLimits
+	routes   map[string]RequestLimits
+}
+
+// loadRequestLimits reads the default limits, and the per-route ones in the
+// JSON file named by REQUEST_LIMITS_CONFIG.
+func loadRequestLimits() (*requestLimitPolicy, error) {
+	p := &requestLimitPolicy{
+		defaults: RequestLimits{MaxMessages: defaultMaxMessages, MaxMessageBytes: defaultMaxMessageBytes, MaxContentBytes: defaultMaxContentBytes},
+		routes:   map[string]RequestLimits{},
+	}
+	for name, set := range map[string]func(int){
+		"REQUEST_MAX_MESSAGES":      func(n int) { p.defaults.MaxMessages = n },
+		"REQUEST_MAX_MESSAGE_BYTES": func(n int) { p.defaults.MaxMessageBytes = int64(n) },
+		"REQUEST_MAX_CONTENT_BYTES": func(n int) { p.defaults.MaxContentBytes = int64(n) },
+	} {
+		n, err := envInt(name)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			set(n)
+		}
+	}
+	path := os.Getenv("REQUEST_LIMITS_CONFIG")
+	if path == "" {
+		return p, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &p.routes); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	for route, l := range p.routes {
+		if l.MaxMessages < 0 || l.MaxMessageBytes < 0 || l.MaxContentBytes < 0 {
+			return nil, fmt.Errorf("request limits for %q: limits must be positive", route)
+		}
+		if l.MaxMessages == 0 {
+			l.MaxMessages = p.defaults.MaxMessages
+		}
+		if l.MaxMessageBytes == 0 {
+			l.MaxMessageBytes = p.defaults.MaxMessageBytes
+		}
+		if l.MaxContentBytes == 0 {
+			l.MaxContentBytes = p.defaults.MaxContentBytes
+		}
+		p.routes[route] = l
+	}
+	return p, nil
+}
+
+// checkRoutes fails for limits naming routes whose bodies the gateway
+// doesn't decode.
+func (p *requestLimitPolicy) checkRoutes(patterns []string) error {
+	for route := range p.routes {
+		if !slices.Contains(patterns, route) {
+			return fmt.Errorf("request limits for unknown route %q", route)
+		}
+		_, path, _ := strings.Cut(route, " ")
+		if _, ok := limitedRoutes[route]; !ok || transparentRoutes.covers(path) {
+			return fmt.Errorf("request limits for %q: only chat completions, responses and tokenize, when not transparent, can be limited", route)
+		}
+	}
+	return nil
+}
+
+// route returns the limits that apply to route.
+func (p *requestLimitPolicy) route(route string) RequestLimits {
+	if l, ok := p.routes[route]; ok {
+		return l
+	}
+	return p.defaults
+}
+
+// wrap limits the body of the requests next serves on route as they are
+// read, so a request over a limit is rejected without reading the rest.
+// It goes outside authentication, which may read the body to check a
+// signature. Transparent routes aren't decoded, and aren't limited.
+func (p *requestLimitPolicy) wrap(route string, next http.HandlerFunc) http.HandlerFunc {
+	if _, path, _ := strings.Cut(route, " "); transparentRoutes.covers(path) {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = p.body(route, r.Body)
+		next(w, r)
+	}
+}
+
+// body returns body, failing its reads with a *requestLimitError once it
+// goes over route's limits.
+func (p *requestLimitPolicy) body(route string, body io.ReadCloser) io.ReadCloser {
+	if p == nil {
+		return body
+	}
+	return &limitedBody{ReadCloser: body, s: limitScanner{limits: p.route(route), field: limitedRoutes[route]}}
+}
+
+// requestLimitError is the read error for a body over one of its limits.
+type requestLimitError struct {
+	code    string
+	message string
+}
+
+func (e *requestLimitError) Error() string { return e.message }
+
+// rejectOverLimit answers 400 with the limit err reports, when it reports
+// one.
+func rejectOverLimit(w http.ResponseWriter, err error) bool {
+	var le *requestLimitError
+	if !errors.As(err, &le) {
+		return false
+	}
+	requestLimitRejections.Add(le.code, 1)
+	writeJSONError(w, http.StatusBadRequest, "invalid_request_error", le.code, le.message)
+	return true
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	s   limitScanner
+	err error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.err = b.s.scan(p[:n]); b.err != nil {
+		return 0, b.err
+	}
+	return n, err
+}
+
+// limitScanner follows a JSON body byte by byte, just far enough to count
+// the entries of its top-level messages field and their lengths. A field
+// that isn't an array counts as one message. Keys match as encoding/json
+// matches them, escapes and case included.
+type limitScanner struct {
+	limits RequestLimits
+	field  string
+
+	total            int64
+	depth            int
+	inString, escape bool
+	// key is the raw top-level key being read, up to maxKeyBytes
+	key       []byte
+	inKey     bool
+	expectKey bool
+
+	mode      int
+	inMessage bool
+	messages  int
+	size      int64
+}
+
+// maxKeyBytes is longer than any spelling of a messages field.
+const maxKeyBytes = 64
+
+const (
+	scanOutside = iota
+	// scanValue is before the messages field's value
+	scanValue
+	// scanArray is inside the messages array
+	scanArray
+	// scanSingle is inside a messages field that isn't an array
+	scanSingle
+)
+
+func (s *limitScanner) scan(p []byte) error {
+	for _, c := range p {
+		if s.total++; s.total > s.limits.MaxContentBytes {
+			return &requestLimitError{"request_too_large", fmt.Sprintf("The request body is longer than the %d bytes this endpoint accepts", s.limits.MaxContentBytes)}
+		}
+		if s.inString {
+			switch {
+			case s.escape:
+				s.escape = false
+			case c == '\\':
+				s.escape = true
+			case c == '"':
+				s.inString = false
+			}
+			if s.inKey && s.inString && len(s.key) <= maxKeyBytes {
+				s.key = append(s.key, c)
+			}
+		} else if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			if s.mode == scanValue {
+				if c == '[' {
+					s.mode = scanArray
+				} else {
+					s.mode = scanSingle
+					s.startMessage()
+				}
+			} else if s.mode == scanArray && s.depth == 2 && !s.inMessage && c != ',' && c != ']' {
+				s.startMessage()
+			}
+			if s.messages > s.limits.MaxMessages {
+				return &requestLimitError{"too_many_messages", fmt.Sprintf("%s has more than the %d messages this endpoint accepts", s.field, s.limits.MaxMessages)}
+			}
+			s.structural(c)
+		}
+		if s.inMessage {
+			if s.size++; s.size > s.limits.MaxMessageBytes {
+				return &requestLimitError{"message_too_large", fmt.Sprintf("%s[%d] is longer than the %d bytes this endpoint accepts for one message", s.field, s.messages-1, s.limits.MaxMessageBytes)}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *limitScanner) startMessage() {
+	s.messages++
+	s.inMessage, s.size = true, 0
+}
+
+// structural follows c, a byte outside any string.
+func (s *limitScanner) structural(c byte) {
+	switch c {
+	case '"':
+		s.inString = true
+		s.inKey = s.depth == 1 && s.expectKey
+		if s.inKey {
+			s.key, s.expectKey = s.key[:0], false
+		}
+	case '{', '[':
+		s.depth++
+		s.expectKey = s.depth == 1 && c == '{'
+	case '}', ']':
+		if (s.mode == scanArray && s.depth == 2) || (s.mode == scanSingle && s.depth == 1) {
+			s.mode, s.inMessage = scanOutside, false
+		}
+		s.depth--
+	case ',':
+		switch {
+		case s.mode == scanArray && s.depth == 2:
+			s.inMessage = false
+		case s.mode == scanSingle && s.depth == 1:
+			s.mode, s.inMessage = scanOutside, false
+		}
+		s.expectKey = s.depth == 1
+	case ':':
+		if s.depth == 1 && s.isField() {
+			s.mode = scanValue
+		}
+	}
+}
+
+// isField reports whether the key just read names the messages field.
+func (s *limitScanner) isField() bool {
+	if len(s.key) > maxKeyBytes {
+		return false
+	}
+	key := string(s.key)
+	if strings.IndexByte(key, '\\') >= 0 && json.Unmarshal([]byte(`"`+key+`"`), &key) != nil {
+		return false
+	}
+	return strings.EqualFold(key, s.field)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testLimits(l RequestLimits) *requestLimitPolicy {
+	return &requestLimitPolicy{defaults: l, routes: map[string]RequestLimits{}}
+}
+
+// readLimited reads body through route's limits and returns the limit it
+// crossed, or "".
+func readLimited(p *requestLimitPolicy, route, body string) string {
+	_, err := io.ReadAll(p.body(route, io.NopCloser(strings.NewReader(body))))
+	if le, ok := err.(*requestLimitError); ok {
+		return le.code
+	}
+	return ""
+}
+
+func messagesBody(n, size int) string {
+	msgs := make([]string, n)
+	for i := range msgs {
+		msgs[i] = fmt.Sprintf(`{"role":"user","content":%q}`, strings.Repeat("a", size))
+	}
+	return `{"model":"m","messages":[` + strings.Join(msgs, ",") + `]}`
+}
+
+func TestRequestLimits(t *testing.T) {
+	p := testLimits(RequestLimits{MaxMessages: 3, MaxMessageBytes: 64, MaxContentBytes: 1 << 10})
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"within limits", messagesBody(3, 10), ""},
+		{"too many messages", messagesBody(4, 1), "too_many_messages"},
+		{"message too large", messagesBody(1, 60), "message_too_large"},
+		{"body too large", `{"model":"m","messages":[],"metadata":"` + strings.Repeat("x", 2<<10) + `"}`, "request_too_large"},
+		// Nested arrays and strings holding brackets don't count as messages
+		{"nested", `{"messages":[{"content":[{"t":"[]"},{"t":"],["}]},{"content":"x"}]}`, ""},
+		{"key spelled with an escape", `{"messag\u0065s":[{},{},{},{}]}`, "too_many_messages"},
+		{"key in other case", `{"Messages":[{},{},{},{}]}`, "too_many_messages"},
+		{"other field", `{"tools":[{},{},{},{}]}`, ""},
+		{"not an array", `{"messages":"` + strings.Repeat("a", 70) + `"}`, "message_too_large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readLimited(p, "POST /v1/chat/completions", tt.body); got != tt.want {
+				t.Errorf("limit = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestLimitsPerRoute(t *testing.T) {
+	p := testLimits(RequestLimits{MaxMessages: 2, MaxMessageBytes: 1 << 10, MaxContentBytes: 1 << 20})
+	p.routes["POST /v1/responses"] = RequestLimits{MaxMessages: 10, MaxMessageBytes: 1 << 10, MaxContentBytes: 1 << 20}
+
+	body := `{"input":[{},{},{},{}]}`
+	if got := readLimited(p, "POST /v1/responses", body); got != "" {
+		t.Errorf("responses: limit = %q, want none", got)
+	}
+	if got := readLimited(p, "POST /v1/chat/completions", `{"messages":[{},{},{}]}`); got != "too_many_messages" {
+		t.Errorf("chat completions: limit = %q, want too_many_messages", got)
+	}
+}
+
+func TestRequestLimitsRejectOverLimit(t *testing.T) {
+	p := testLimits(RequestLimits{MaxMessages: 1, MaxMessageBytes: 1 << 10, MaxContentBytes: 1 << 20})
+	h := p.wrap("POST /v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		var req ChatCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); rejectOverLimit(w, err) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(messagesBody(2, 1))))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"too_many_messages"`) {
+		t.Errorf("response = %d %s, want 400 too_many_messages", w.Code, w.Body)
+	}
+}
+
+func TestRequestLimitsApplyBeforeSignatureCheck(t *testing.T) {
+	// The limits are tighter than HMAC's own bound: the body the signature
+	// check reads is cut off at the request limit, not buffered whole
+	p := testLimits(RequestLimits{MaxMessages: 2, MaxMessageBytes: 1 << 10, MaxContentBytes: 1 << 20})
+	a := testHMACAuth()
+	a.maxBody = 1 << 20
+	reached := false
+	h := p.wrap("POST /v1/chat/completions", requireAuth(a, func(w http.ResponseWriter, r *http.Request) { reached = true }))
+
+	w := httptest.NewRecorder()
+	h(w, signedRequest("svc", "s3cret", testHMACNow, messagesBody(5000, 1)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"too_many_messages"`) || reached {
+		t.Errorf("response = %d %s, reached = %t; want 400 too_many_messages", w.Code, w.Body, reached)
+	}
+
+	w = httptest.NewRecorder()
+	h(w, signedRequest("svc", "s3cret", testHMACNow.Add(time.Second), messagesBody(2, 1)))
+	if w.Code != http.StatusOK || !reached {
+		t.Errorf("within limits: status = %d, reached = %t", w.Code, reached)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// processorBuckets are upper bounds in seconds for response processor
+// latency histograms; processors are string rewrites, so microseconds.
+var processorBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05}
+
+// responseProcessing is nil unless RESPONSE_PROCESSING_CONFIG is set.
+var responseProcessing *responseProcessors
+
+// ResponseProcessing is a route's post-processing, as configured in
+// RESPONSE_PROCESSING_CONFIG. Processors run in the order listed:
+//
+//	{"POST /v1/chat/completions": {"processors": [{"name": "trim_whitespace"}, {"name": "max_chars", "max_chars": 2000}]}}
+type ResponseProcessing struct {
+	Processors []*ProcessorConfig `json:"processors"`
+}
+
+// ProcessorConfig is one processor in a route's pipeline.
+type ProcessorConfig struct {
+	Name string `json:"name"`
+	// MaxChars is the most characters max_chars lets through, ellipsis
+	// included
+	MaxChars int `json:"max_chars,omitempty"`
+	// Ellipsis ends content max_chars cut short (default "…")
+	Ellipsis *string `json:"ellipsis,omitempty"`
+}
+
+// textProcessor rewrites one choice's content a piece at a time: feed takes
+// the next piece and returns what can be sent on, flush returns what it
+// held back once the content is complete.
+type textProcessor interface {
+	feed(s string) string
+	flush() string
+}
+
+type responseProcessorKind struct {
+	// streamSafe processors rewrite streams as they go. The others need the
+	// whole content, so on a stream they see it, and the client gets it,
+	// only once the stream ends
+	streamSafe bool
+	new        func(cfg *ProcessorConfig) textProcessor
+}
+
+// responseProcessorKinds are the built-in processors, by name.
+var responseProcessorKinds = map[string]responseProcessorKind{
+	"strip_code_fences":    {streamSafe: false, new: func(*ProcessorConfig) textProcessor { return fenceStripper{} }},
+	"trim_whitespace":      {streamSafe: true, new: func(*ProcessorConfig) textProcessor { return &whitespaceTrimmer{} }},
+	"collapse_blank_lines": {streamSafe: true, new: func(*ProcessorConfig) textProcessor { return &blankLineCollapser{} }},
+	"max_chars": {streamSafe: true, new: func(cfg *ProcessorConfig) textProcessor {
+		return &charLimiter{keep: cfg.MaxChars - utf8.RuneCountInString(*cfg.Ellipsis), ellipsis: *cfg.Ellipsis}
+	}},
+}
+
+func (c *ProcessorConfig) validate() error {
+	if _, ok := responseProcessorKinds[c.Name]; !ok {
+		names := make([]string, 0, len(responseProcessorKinds))
+		for n := range responseProcessorKinds {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown processor %q: want one of %s", c.Name, strings.Join(names, ", "))
+	}
+	if c.Name != "max_chars" {
+		if c.MaxChars != 0 || c.Ellipsis != nil {
+			return fmt.Errorf("max_chars and ellipsis only apply to the max_chars processor")
+		}
+		return nil
+	}
+	if c.Ellipsis == nil {
+		ellipsis := "…"
+		c.Ellipsis = &ellipsis
+	}
+	if c.MaxChars <= utf8.RuneCountInString(*c.Ellipsis) {
+		return fmt.Errorf("max_chars must be longer than its ellipsis")
+	}
+	return nil
+}
+
+// responseProcessors holds the pipeline of each configured route.
+type responseProcessors struct {
+	routes    map[string]*ResponseProcessing
+	pipelines map[string]*responsePipeline
+}
+
+// responsePipeline is a route's processors, ready to run.
+type responsePipeline struct {
+	entries []*processorEntry
+}
+
+type processorEntry struct {
+	cfg     *ProcessorConfig
+	kind    responseProcessorKind
+	latency *histogram
+}
+
+// loadResponseProcessing reads the per-route pipelines in the JSON file
+// named by RESPONSE_PROCESSING_CONFIG. It returns nil when none is
+// configured.
+func loadResponseProcessing() (*responseProcessors, error) {
+	path := os.Getenv("RESPONSE_PROCESSING_CONFIG")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string]*ResponseProcessing
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	p := &responseProcessors{routes: file, pipelines: map[string]*responsePipeline{}}
+	// Shared by routes, as expvar names must be unique
+	latency := map[string]*histogram{}
+	for route, cfg := range file {
+		if cfg == nil || len(cfg.Processors) == 0 {
+			return nil, fmt.Errorf("response processing for %q: no processors", route)
+		}
+		pipeline := &responsePipeline{}
+		for i, pc := range cfg.Processors {
+			if err := pc.validate(); err != nil {
+				return nil, fmt.Errorf("response processing for %q, processor %d: %w", route, i, err)
+			}
+			if latency[pc.Name] == nil {
+				latency[pc.Name] = newHistogram("gateway_response_processor_"+pc.Name+"_seconds", processorBuckets)
+			}
+			pipeline.entries = append(pipeline.entries, &processorEntry{cfg: pc, kind: responseProcessorKinds[pc.Name], latency: latency[pc.Name]})
+		}
+		p.pipelines[route] = pipeline
+	}
+	return p, nil
+}
+
+// checkRoutes fails for pipelines naming routes other than those whose
+// completions the gateway relays itself.
+func (p *responseProcessors) checkRoutes(patterns []string) error {
+	if p == nil {
+		return nil
+	}
+	for route := range p.routes {
+		if !slices.Contains(patterns, route) {
+			return fmt.Errorf("response processing for unknown route %q", route)
+		}
+		_, path, _ := strings.Cut(route, " ")
+		if (route != "POST /v1/chat/completions" && route != "POST /v1/responses") || transparentRoutes.covers(path) {
+			return fmt.Errorf("response processing for %q: only POST /v1/chat/completions and POST /v1/responses, when not transparent, can be processed", route)
+		}
+	}
+	return nil
+}
+
+// route returns the processing configured for route, or nil.
+func (p *responseProcessors) route(route string) *ResponseProcessing {
+	if p == nil {
+		return nil
+	}
+	return p.routes[route]
+}
+
+// forRequest returns the pipeline for r's route, or nil.
+func (p *responseProcessors) forRequest(r *http.Request) *responsePipeline {
+	if p == nil {
+		return nil
+	}
+	return p.pipelines[recordFromContext(r.Context()).Route]
+}
+
+// processResponse rewrites each choice of a complete response in place.
+func (p *responsePipeline) processResponse(response *ChatCompletionResponse) {
+	if p == nil {
+		return
+	}
+	for i := range response.Choices {
+		if content := response.Choices[i].Message.Content; content != "" {
+			response.Choices[i].Message.Content = p.start().end(content)
+		}
+	}
+}
+
+// start returns a run of the pipeline over one choice's content.
+func (p *responsePipeline) start() *processorRun {
+	if p == nil {
+		return nil
+	}
+	run := &processorRun{entries: p.entries, spent: make([]time.Duration, len(p.entries))}
+	for _, e := range p.entries {
+		tp := e.kind.new(e.cfg)
+		if !e.kind.streamSafe {
+			tp = &heldText{p: tp}
+		}
+		run.procs = append(run.procs, tp)
+	}
+	return run
+}
+
+// processorRun passes one choice's content through a pipeline, each
+// processor seeing what the one before it let through. Each processor's
+// time is observed once, when the run ends.
+type processorRun struct {
+	entries []*processorEntry
+	procs   []textProcessor
+	spent   []time.Duration
+	ended   bool
+}
+
+// feed returns what of s, the next piece of content, can be sent now.
+func (r *processorRun) feed(s string) string {
+	if r == nil || r.ended {
+		return s
+	}
+	for i, tp := range r.procs {
+		if s == "" {
+			break
+		}
+		start := time.Now()
+		s = tp.feed(s)
+		r.spent[i] += time.Since(start)
+	}
+	return s
+}
+
+// end feeds the last piece of content and returns it with everything the
+// processors held back. Content after the end passes unchanged.
+func (r *processorRun) end(s string) string {
+	if r == nil || r.ended {
+		return s
+	}
+	r.ended = true
+	for i, tp := range r.procs {
+		start := time.Now()
+		if s != "" {
+			s = tp.feed(s)
+		}
+		s += tp.flush()
+		r.spent[i] += time.Since(start)
+		r.entries[i].latency.observe(r.spent[i])
+	}
+	return s
+}
+
+// heldText gives a processor that isn't stream-safe the whole content at
+// once.
+type heldText struct {
+	p   textProcessor
+	buf strings.Builder
+}
+
+func (h *heldText) feed(s string) string {
+	h.buf.WriteString(s)
+	return ""
+}
+
+func (h *heldText) flush() string {
+	s := h.p.feed(h.buf.String()) + h.p.flush()
+	h.buf.Reset()
+	return s
+}
+
+// fenceStripper unwraps content that is a single fenced code block, as
+// models often fence the JSON or code they were asked for bare. Anything
+// else is left alone.
+type fenceStripper struct{}
+
+func (fenceStripper) feed(s string) string {
+	t := strings.TrimSpace(s)
+	if !strings.HasPrefix(t, "```") {
+		return s
+	}
+	info, body, ok := strings.Cut(t, "\n")
+	if !ok || strings.Contains(info[3:], "`") {
+		return s
+	}
+	body, ok = strings.CutSuffix(body, "```")
+	if !ok || strings.Contains(body, "```") {
+		return s
+	}
+	return strings.TrimSuffix(body, "\n")
+}
+
+func (fenceStripper) flush() string { return "" }
+
+// whitespaceTrimmer drops leading and trailing whitespace. Whitespace is
+// held back until text follows it.
+type whitespaceTrimmer struct {
+	started bool
+	held    string
+}
+
+func (t *whitespaceTrimmer) feed(s string) string {
+	if !t.started {
+		if s = strings.TrimLeftFunc(s, unicode.IsSpace); s == "" {
+			return ""
+		}
+		t.started = true
+	}
+	s = t.held + s
+	text := strings.TrimRightFunc(s, unicode.IsSpace)
+	t.held = s[len(text):]
+	return text
+}
+
+func (t *whitespaceTrimmer) flush() string {
+	t.held = ""
+	return ""
+}
+
+// blankLines matches two or more blank lines in a row.
+var blankLines = regexp.MustCompile(`\n(?:[ \t\r\f\v]*\n){2,}`)
+
+// blankLineCollapser collapses runs of blank lines into one, keeping
+// paragraph breaks. Trailing whitespace is held back, since the run it
+// might start isn't over.
+type blankLineCollapser struct {
+	held string
+}
+
+func (c *blankLineCollapser) feed(s string) string {
+	s = c.held + s
+	text := strings.TrimRightFunc(s, unicode.IsSpace)
+	c.held = s[len(text):]
+	return blankLines.ReplaceAllString(text, "\n\n")
+}
+
+func (c *blankLineCollapser) flush() string {
+	s := blankLines.ReplaceAllString(c.held, "\n\n")
+	c.held = ""
+	return s
+}
+
+// charLimiter cuts content longer than max_chars to keep characters and
+// the ellipsis. The characters past keep are held back until it is known
+// whether the content fits.
+type charLimiter struct {
+	keep     int
+	ellipsis string
+
+	sent  int
+	held  strings.Builder
+	nheld int
+	cut   bool
+}
+
+func (c *charLimiter) feed(s string) string {
+	if c.cut {
+		return ""
+	}
+	var out strings.Builder
+	for _, r := range s {
+		if c.sent < c.keep {
+			out.WriteRune(r)
+			c.sent++
+			continue
+		}
+		c.held.WriteRune(r)
+		if c.nheld++; c.nheld > utf8.RuneCountInString(c.ellipsis) {
+			c.cut = true
+			c.held.Reset()
+			out.WriteString(c.ellipsis)
+			break
+		}
+	}
+	return out.String()
+}
+
+func (c *charLimiter) flush() string {
+	s := c.held.String()
+	c.held.Reset()
+	return s
+}
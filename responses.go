@@ -0,0 +1,639 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultResponsesPath = "/v1/responses"
+
+// responsesRequest is the part of an OpenAI Responses API request the
+// gateway translates to a chat completion.
+type responsesRequest struct {
+	Model string `json:"model"`
+	// Input is a string, taken as one user message, or a list of messages
+	Input           json.RawMessage   `json:"input"`
+	Instructions    string            `json:"instructions,omitempty"`
+	MaxOutputTokens *int              `json:"max_output_tokens,omitempty"`
+	Temperature     *float64          `json:"temperature,omitempty"`
+	TopP            *float64          `json:"top_p,omitempty"`
+	Stream          bool              `json:"stream,omitempty"`
+	User            string            `json:"user,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+
+	// Translation doesn't support these; backends with responses set do
+	Tools              []json.RawMessage `json:"tools,omitempty"`
+	PreviousResponseID string            `json:"previous_response_id,omitempty"`
+	Text               *struct {
+		Format *ResponseFormat `json:"format"`
+	} `json:"text,omitempty"`
+}
+
+// responsesInputItem is one message of a list input. Content is a string or
+// a list of parts.
+type responsesInputItem struct {
+	Type    string          `json:"type"`
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+type responsesInputPart struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// chatRequest translates r to a chat completion. The error reports what the
+// translation can't carry; the request keeps its model either way, so it
+// can still be routed to a backend that takes it as it is.
+func (r *responsesRequest) chatRequest() (ChatCompletionRequest, error) {
+	req := ChatCompletionRequest{
+		Model:       r.Model,
+		MaxTokens:   r.MaxOutputTokens,
+		Temperature: r.Temperature,
+		TopP:        r.TopP,
+		Stream:      r.Stream,
+		User:        r.User,
+	}
+	if r.Stream {
+		// Usage ends up in response.completed
+		req.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
+	switch {
+	case len(r.Tools) > 0:
+		return req, errors.New("tools are not supported for this model")
+	case r.PreviousResponseID != "":
+		return req, errors.New("previous_response_id is not supported: the gateway does not store responses")
+	case r.Text != nil && r.Text.Format != nil && r.Text.Format.Type == "json_schema":
+		return req, errors.New("text.format json_schema is not supported for this model")
+	case r.Text != nil && r.Text.Format != nil && r.Text.Format.Type == "json_object":
+		req.ResponseFormat = &ResponseFormat{Type: "json_object"}
+	}
+
+	if r.Instructions != "" {
+		req.Messages = append(req.Messages, Message{Role: "system", Content: r.Instructions})
+	}
+	var text string
+	if json.Unmarshal(r.Input, &text) == nil {
+		req.Messages = append(req.Messages, Message{Role: "user", Content: text})
+		return req, nil
+	}
+	var items []responsesInputItem
+	if err := json.Unmarshal(r.Input, &items); err != nil {
+		return req, errors.New("input must be a string or a list of messages")
+	}
+	for i, item := range items {
+		if item.Type != "" && item.Type != "message" {
+			return req, fmt.Errorf("input[%d]: item type %q is not supported for this model", i, item.Type)
+		}
+		role := item.Role
+		if role == "developer" {
+			role = "system"
+		}
+		content, err := inputText(item.Content)
+		if err != nil {
+			return req, fmt.Errorf("input[%d]: %w", i, err)
+		}
+		req.Messages = append(req.Messages, Message{Role: role, Content: content})
+	}
+	return req, nil
+}
+
+// inputText flattens a message's content to text, one line per part.
+func inputText(content json.RawMessage) (string, error) {
+	var text string
+	if json.Unmarshal(content, &text) == nil {
+		return text, nil
+	}
+	var parts []responsesInputPart
+	if err := json.Unmarshal(content, &parts); err != nil {
+		return "", errors.New("content must be a string or a list of parts")
+	}
+	texts := make([]string, 0, len(parts))
+	for _, p := range parts {
+		switch p.Type {
+		case "input_text", "output_text", "text":
+			texts = append(texts, p.Text)
+		default:
+			return "", fmt.Errorf("content part type %q is not supported for this model", p.Type)
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// responseObject is an OpenAI Responses API response.
+type responseObject struct {
+	ID                string               `json:"id"`
+	Object            string               `json:"object"`
+	CreatedAt         int64                `json:"created_at"`
+	Status            string               `json:"status"`
+	Model             string               `json:"model"`
+	Output            []responseOutputItem `json:"output"`
+	Usage             *responseUsage       `json:"usage,omitempty"`
+	IncompleteDetails *responseIncomplete  `json:"incomplete_details,omitempty"`
+	Error             *responseError       `json:"error,omitempty"`
+	Instructions      string               `json:"instructions,omitempty"`
+	MaxOutputTokens   *int                 `json:"max_output_tokens,omitempty"`
+	Metadata          map[string]string    `json:"metadata,omitempty"`
+}
+
+type responseOutputItem struct {
+	Type    string            `json:"type"`
+	ID      string            `json:"id"`
+	Status  string            `json:"status"`
+	Role    string            `json:"role"`
+	Content []responseContent `json:"content"`
+}
+
+type responseContent struct {
+	Type        string            `json:"type"`
+	Text        string            `json:"text"`
+	Annotations []json.RawMessage `json:"annotations"`
+}
+
+type responseUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+type responseIncomplete struct {
+	Reason string `json:"reason"`
+}
+
+type responseError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// newResponseObject starts a response to r for the request the gateway
+// knows as requestID.
+func newResponseObject(r *responsesRequest, requestID, status string) responseObject {
+	return responseObject{
+		ID:              "resp_" + requestID,
+		Object:          "response",
+		CreatedAt:       time.Now().Unix(),
+		Status:          status,
+		Model:           r.Model,
+		Output:          []responseOutputItem{},
+		Instructions:    r.Instructions,
+		MaxOutputTokens: r.MaxOutputTokens,
+		Metadata:        r.Metadata,
+	}
+}
+
+// finish completes the response with its assistant message: status
+// incomplete for the finish reasons that cut the message short.
+func (o *responseObject) finish(requestID, text, finishReason string, usage *Usage) {
+	o.Status = "completed"
+	switch finishReason {
+	case "length":
+		o.Status, o.IncompleteDetails = "incomplete", &responseIncomplete{Reason: "max_output_tokens"}
+	case "content_filter":
+		o.Status, o.IncompleteDetails = "incomplete", &responseIncomplete{Reason: "content_filter"}
+	}
+	o.Output = []responseOutputItem{outputMessage(requestID, o.Status, text)}
+	if usage != nil {
+		o.Usage = &responseUsage{InputTokens: usage.PromptTokens, OutputTokens: usage.CompletionTokens, TotalTokens: usage.TotalTokens}
+	}
+}
+
+func outputMessage(requestID, status, text string) responseOutputItem {
+	item := responseOutputItem{Type: "message", ID: "msg_" + requestID, Status: status, Role: "assistant", Content: []responseContent{}}
+	if status != "in_progress" {
+		item.Content = append(item.Content, outputText(text))
+	}
+	return item
+}
+
+func outputText(text string) responseContent {
+	return responseContent{Type: "output_text", Text: text, Annotations: []json.RawMessage{}}
+}
+
+// chatFinishReason maps a Responses status back to a chat finish reason,
+// for finish reason tracking.
+func (o *responseObject) chatFinishReason() string {
+	switch {
+	case o.Status == "completed":
+		return "stop"
+	case o.IncompleteDetails != nil && o.IncompleteDetails.Reason == "max_output_tokens":
+		return "length"
+	case o.IncompleteDetails != nil:
+		return o.IncompleteDetails.Reason
+	}
+	return o.Status
+}
+
+// responsesCall rides in the context of a Responses API request while it
+// runs through the chat completions handler.
+type responsesCall struct {
+	// body is the request as the client sent it
+	body []byte
+	// unsupported is why the request can't be translated, if it can't
+	unsupported error
+	// native is set once the request is routed to a backend with responses
+	// set, which gets body instead of the translation
+	native bool
+}
+
+type responsesCallKey struct{}
+
+func responsesCallFrom(ctx context.Context) *responsesCall {
+	c, _ := ctx.Value(responsesCallKey{}).(*responsesCall)
+	return c
+}
+
+// route settles how the request reaches backend, nil for an ensemble:
+// as it is when the backend speaks the Responses API, and otherwise
+// translated, which fails when the translation can't carry it.
+func (c *responsesCall) route(backend *Backend) error {
+	if c == nil {
+		return nil
+	}
+	if backend != nil && backend.Responses {
+		c.native = true
+		return nil
+	}
+	return c.unsupported
+}
+
+func (c *responsesCall) isNative() bool {
+	return c != nil && c.native
+}
+
+// responsesHandler implements POST /v1/responses by translating to a chat
+// completion, so routing, limits and every other stage apply unchanged, and
+// translating the result back.
+func responsesHandler(w http.ResponseWriter, r *http.Request) {
+	var body json.RawMessage
+	var rr responsesRequest
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err == nil {
+		err = json.Unmarshal(body, &rr)
+	}
+	if rejectOverLimit(w, err) {
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_json", "Invalid JSON: "+describeJSONError(err))
+		return
+	}
+	if len(rr.Input) == 0 || string(rr.Input) == "null" {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "missing_input", "input is required")
+		return
+	}
+
+	req, unsupported := rr.chatRequest()
+	call := &responsesCall{body: body, unsupported: unsupported}
+	chatBody, err := json.Marshal(req)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "internal_error", err.Error())
+		return
+	}
+	inner := r.Clone(context.WithValue(r.Context(), responsesCallKey{}, call))
+	inner.Body = io.NopCloser(bytes.NewReader(chatBody))
+	inner.ContentLength = int64(len(chatBody))
+	// The translation reads the stream as SSE
+	inner.Header.Del("Accept")
+
+	if !rr.Stream || isDryRun(r) {
+		buf := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+		chatCompletionsHandler(buf, inner)
+		writeResponse(w, buf, call, &rr)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeVersionedError(w, r, http.StatusInternalServerError, "server_error", "streaming_unsupported", "Streaming not supported")
+		return
+	}
+	rs := &responsesStream{w: w, flusher: flusher, call: call, req: &rr}
+	chatCompletionsHandler(rs, inner)
+	rs.end()
+}
+
+// writeResponse translates a buffered chat completion to a Responses API
+// response. Errors, dry-run reports and native responses are written as
+// they are.
+func writeResponse(w http.ResponseWriter, buf *bufferedResponse, call *responsesCall, rr *responsesRequest) {
+	for name, values := range buf.header {
+		w.Header()[name] = values
+	}
+	w.Header().Del("Content-Length")
+	var chat ChatCompletionResponse
+	if buf.status != http.StatusOK || call.native || buf.header.Get("Content-Type") != "application/json" ||
+		json.Unmarshal(buf.body.Bytes(), &chat) != nil || chat.Object == "gateway.dry_run" {
+		w.WriteHeader(buf.status)
+		w.Write(buf.body.Bytes())
+		return
+	}
+
+	requestID := w.Header().Get("X-Request-ID")
+	resp := newResponseObject(rr, requestID, "completed")
+	if chat.Model != "" {
+		resp.Model = chat.Model
+	}
+	var text, finishReason string
+	if len(chat.Choices) > 0 {
+		text, finishReason = chat.Choices[0].Message.Content, chat.Choices[0].FinishReason
+	}
+	resp.finish(requestID, text, finishReason, &chat.Usage)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// responsesStream translates a chat completions stream into Responses API
+// events as the chat handler writes it. Anything but a translated stream,
+// such as an error before the stream starts, passes through unchanged.
+type responsesStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	call    *responsesCall
+	req     *responsesRequest
+
+	decided, translate bool
+	// pending holds the start of an event not yet written completely
+	pending []byte
+	seq     int
+
+	resp         responseObject
+	requestID    string
+	text         strings.Builder
+	finishReason string
+	usage        *Usage
+	failure      *ErrorDetail
+	ended        bool
+}
+
+func (s *responsesStream) Header() http.Header { return s.w.Header() }
+
+// Unwrap lets http.ResponseController reach the connection.
+func (s *responsesStream) Unwrap() http.ResponseWriter { return s.w }
+
+func (s *responsesStream) WriteHeader(status int) {
+	if s.decided {
+		return
+	}
+	s.decided = true
+	s.translate = status == http.StatusOK && !s.call.native &&
+		strings.HasPrefix(s.Header().Get("Content-Type"), "text/event-stream")
+	s.w.WriteHeader(status)
+	if !s.translate {
+		return
+	}
+	s.requestID = s.Header().Get("X-Request-ID")
+	s.resp = newResponseObject(s.req, s.requestID, "in_progress")
+	s.emit("response.created", map[string]any{"response": s.resp})
+	s.emit("response.in_progress", map[string]any{"response": s.resp})
+	s.emit("response.output_item.added", map[string]any{"output_index": 0, "item": outputMessage(s.requestID, "in_progress", "")})
+	s.emit("response.content_part.added", s.partFields(map[string]any{"part": outputText("")}))
+	s.flusher.Flush()
+}
+
+func (s *responsesStream) Write(p []byte) (int, error) {
+	if !s.decided {
+		s.WriteHeader(http.StatusOK)
+	}
+	if !s.translate {
+		return s.w.Write(p)
+	}
+	s.pending = append(s.pending, p...)
+	for {
+		i := bytes.Index(s.pending, []byte("\n\n"))
+		if i < 0 {
+			break
+		}
+		s.event(s.pending[:i])
+		s.pending = s.pending[i+2:]
+	}
+	return len(p), nil
+}
+
+func (s *responsesStream) Flush() {
+	if !s.translate {
+		s.flusher.Flush()
+	}
+}
+
+// event translates one chat stream event.
+func (s *responsesStream) event(block []byte) {
+	var data []byte
+	for _, line := range bytes.Split(block, []byte("\n")) {
+		if d, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			data = append(data, bytes.TrimSpace(d)...)
+		}
+	}
+	if len(data) == 0 {
+		return
+	}
+	if string(data) == "[DONE]" {
+		s.end()
+		return
+	}
+	var errBody ErrorResponse
+	if json.Unmarshal(data, &errBody) == nil && errBody.Error.Message != "" {
+		s.failure = &errBody.Error
+		return
+	}
+	var chunk ChatCompletionChunk
+	if json.Unmarshal(data, &chunk) != nil {
+		return
+	}
+	if chunk.Model != "" {
+		s.resp.Model = chunk.Model
+	}
+	if chunk.Usage != nil {
+		s.usage = chunk.Usage
+	}
+	if len(chunk.Choices) == 0 {
+		return
+	}
+	if c := chunk.Choices[0]; c.Delta.Content != "" {
+		s.text.WriteString(c.Delta.Content)
+		s.emit("response.output_text.delta", s.partFields(map[string]any{"delta": c.Delta.Content}))
+		s.flusher.Flush()
+	}
+	if c := chunk.Choices[0]; c.FinishReason != nil {
+		s.finishReason = *c.FinishReason
+	}
+}
+
+// end closes the translated stream: response.completed, or
+// response.incomplete when the message was cut short, after the done
+// events for the message; or response.failed after an error event.
+func (s *responsesStream) end() {
+	if !s.translate || s.ended {
+		return
+	}
+	s.ended = true
+	text := s.text.String()
+	if s.failure != nil {
+		s.resp.Status = "failed"
+		s.resp.Error = &responseError{Code: s.failure.Code, Message: s.failure.Message}
+		if s.resp.Error.Code == "" {
+			s.resp.Error.Code = s.failure.Type
+		}
+		s.resp.Output = []responseOutputItem{outputMessage(s.requestID, "incomplete", text)}
+		s.emit("response.failed", map[string]any{"response": s.resp})
+		s.flusher.Flush()
+		return
+	}
+	s.resp.finish(s.requestID, text, s.finishReason, s.usage)
+	s.emit("response.output_text.done", s.partFields(map[string]any{"text": text}))
+	s.emit("response.content_part.done", s.partFields(map[string]any{"part": outputText(text)}))
+	s.emit("response.output_item.done", map[string]any{"output_index": 0, "item": s.resp.Output[0]})
+	event := "response.completed"
+	if s.resp.Status == "incomplete" {
+		event = "response.incomplete"
+	}
+	s.emit(event, map[string]any{"response": s.resp})
+	s.flusher.Flush()
+}
+
+// partFields adds the coordinates of the one output text part to fields.
+func (s *responsesStream) partFields(fields map[string]any) map[string]any {
+	fields["item_id"] = "msg_" + s.requestID
+	fields["output_index"] = 0
+	fields["content_index"] = 0
+	return fields
+}
+
+// emit writes one Responses API event; flushing is left to the caller.
+func (s *responsesStream) emit(event string, fields map[string]any) {
+	fields["type"] = event
+	fields["sequence_number"] = s.seq
+	s.seq++
+	data, err := json.Marshal(fields)
+	if err != nil {
+		log.Printf("Error encoding %s event: %v", event, err)
+		return
+	}
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+// serveNativeResponses relays a Responses API request to a backend that
+// speaks it, with only the model replaced by the backend's name for it.
+// Usage and the finish reason are read from the response, or from a
+// stream's final event, for billing and metrics.
+func serveNativeResponses(w http.ResponseWriter, r *http.Request, backend *Backend, call *responsesCall, model, requestID string) {
+	var fields map[string]json.RawMessage
+	json.Unmarshal(call.body, &fields)
+	fields["model"], _ = json.Marshal(model)
+	body, err := json.Marshal(fields)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "internal_error", err.Error())
+		return
+	}
+	var stream bool
+	json.Unmarshal(fields["stream"], &stream)
+
+	endpoint := backend.atEndpoint(pickEndpoint(backend, nil))
+	httpReq, err := http.NewRequestWithContext(withBackendTrace(r.Context()), http.MethodPost, backendURL(endpoint.URL, endpoint.responsesPath()), bytes.NewReader(body))
+	if err != nil {
+		writeBackendError(w, fmt.Errorf("failed to create request: %w", err), backend)
+		return
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-Request-ID", requestID)
+	setForwardingHeaders(r.Context(), httpReq, backend)
+	setAcceptEncoding(httpReq, backend)
+
+	client := poolFor(backend).client
+	if stream {
+		client = poolFor(backend).stream
+	}
+	defer startEndpointRequest(endpoint.URL)()
+	defer recordFromContext(r.Context()).Timings.backendCall(time.Now())()
+	resp, err := client.Do(httpReq)
+	if err == nil {
+		if err = decodeBackendBody(resp); err != nil {
+			resp.Body.Close()
+		}
+	}
+	if err == nil && resp.StatusCode != http.StatusOK {
+		data := readErrorBody(resp, backend, requestID)
+		resp.Body.Close()
+		err = &backendStatusError{StatusCode: resp.StatusCode, Body: string(data), Header: resp.Header}
+	}
+	if err != nil {
+		log.Printf("Backend error: %v", err)
+		noteBackendFailure(backend, err)
+		writeBackendError(w, err, backend)
+		return
+	}
+	defer resp.Body.Close()
+
+	rec := recordFromContext(r.Context())
+	for _, name := range passthroughHeaders {
+		if v := resp.Header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	transferStart := time.Now()
+	defer func() { rec.Timings.set(&rec.Timings.transfer, time.Since(transferStart)) }()
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		captured := &cappedBuffer{max: maxInspectBytes}
+		if _, err := io.Copy(w, io.TeeReader(resp.Body, captured)); err != nil {
+			log.Printf("Error relaying response: %v", err)
+			return
+		}
+		var out responseObject
+		if !captured.overflow && json.Unmarshal(captured.buf.Bytes(), &out) == nil {
+			recordResponseUsage(rec, &out)
+		}
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	events := bufio.NewReader(resp.Body)
+	for {
+		line, err := events.ReadBytes('\n')
+		if len(line) > 0 {
+			if _, werr := w.Write(line); werr != nil {
+				log.Printf("Error relaying response: %v", werr)
+				return
+			}
+			if data, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+				var event struct {
+					Response *responseObject `json:"response"`
+				}
+				if json.Unmarshal(data, &event) == nil && event.Response != nil {
+					recordResponseUsage(rec, event.Response)
+				}
+			}
+			if flusher != nil && len(bytes.TrimSpace(line)) == 0 {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error relaying response: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// recordResponseUsage notes a final Responses API response's usage and
+// finish reason; responses still in progress are skipped.
+func recordResponseUsage(rec *requestRecord, out *responseObject) {
+	if out.Status == "" || out.Status == "in_progress" || out.Status == "queued" {
+		return
+	}
+	rec.FinishReason = out.chatFinishReason()
+	if out.Usage != nil {
+		rec.Usage = &Usage{PromptTokens: out.Usage.InputTokens, CompletionTokens: out.Usage.OutputTokens, TotalTokens: out.Usage.TotalTokens}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	resumeTokenHeader  = "X-Resume-Token"
+	resumeOffsetHeader = "X-Resume-Offset"
+)
+
+// streamResumes counts resumed streams: matched or diverged, by whether
+// what they skipped was what the failed stream delivered, and ignored for
+// tokens that didn't match the request.
+var streamResumes = expvar.NewMap("gateway_stream_resumes_total")
+
+// resumeToken is what a client needs to resume a failed stream. It travels
+// base64url-encoded JSON in the stream's final error event.
+type resumeToken struct {
+	RequestID string `json:"r"`
+	// Hash identifies the request; a retry must hash the same
+	Hash string `json:"h"`
+	// Delivered counts the content characters (Unicode code points) the
+	// client already has
+	Delivered int `json:"n"`
+	// Prefix hashes that content; what a resumed stream skips must hash
+	// the same
+	Prefix string `json:"p"`
+}
+
+func (t resumeToken) encode() string {
+	data, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeResumeToken(s string) (resumeToken, bool) {
+	var t resumeToken
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(data, &t) != nil || t.Delivered < 0 || t.Hash == "" || t.Prefix == "" {
+		return resumeToken{}, false
+	}
+	return t, true
+}
+
+// streamRequestHash identifies a streaming request as sent upstream and
+// whose key sent it.
+func streamRequestHash(owner string, req ChatCompletionRequest) string {
+	data, _ := json.Marshal(req)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00", owner)
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// newResumeToken returns the token that resumes a failed stream which
+// delivered content.
+func newResumeToken(requestID, hash, delivered string) string {
+	return resumeToken{RequestID: requestID, Hash: hash, Delivered: utf8.RuneCountInString(delivered), Prefix: prefixHash(delivered)}.encode()
+}
+
+// prefixHash identifies the content a stream delivered.
+func prefixHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:16])
+}
+
+// resumeFor checks a retry's X-Resume-Token against the request's hash. It
+// returns the skip to apply, or nil when there is no token or it doesn't
+// match, in which case the stream is served in full.
+func resumeFor(token, requestID, hash string) *resumeSkip {
+	if token == "" {
+		return nil
+	}
+	t, ok := decodeResumeToken(token)
+	if !ok || t.Hash != hash {
+		streamResumes.Add("ignored", 1)
+		log.Printf("Ignoring resume token on %s: it doesn't match the request", requestID)
+		return nil
+	}
+	return &resumeSkip{remaining: t.Delivered, from: t.RequestID, prefix: t.Prefix}
+}
+
+// errResumeDiverged ends a resumed stream whose regenerated content isn't
+// what the failed stream delivered: skipping it would leave the client
+// with text the answer never had.
+var errResumeDiverged = errors.New("resumed stream diverged")
+
+// resumeDivergedError is the event a diverged stream ends with.
+var resumeDivergedError = &RouteError{Type: "invalid_request_error", Code: "resume_diverged",
+	Message: "The regenerated response differs from the content already delivered; retry without X-Resume-Token for the full response"}
+
+// resumeSkip drops the content a resumed stream's client already has.
+type resumeSkip struct {
+	remaining int
+	from      string
+	// prefix is the hash of the content the failed stream delivered
+	prefix string
+	// skipped is what was dropped so far
+	skipped strings.Builder
+	counted bool
+}
+
+// skip returns the part of delta past what the client already has. Once
+// all of that is skipped it fails with errResumeDiverged if it isn't what
+// was delivered.
+func (s *resumeSkip) skip(delta string) (string, error) {
+	if s == nil || s.remaining == 0 || delta == "" {
+		return delta, nil
+	}
+	i := 0
+	for ; i < len(delta) && s.remaining > 0; s.remaining-- {
+		_, size := utf8.DecodeRuneInString(delta[i:])
+		i += size
+	}
+	s.skipped.WriteString(delta[:i])
+	if s.remaining == 0 {
+		return delta[i:], s.done()
+	}
+	return delta[i:], nil
+}
+
+// done checks the skipped content against what was delivered, once,
+// failing with errResumeDiverged when it differs. A regenerated response
+// shorter than that has diverged.
+func (s *resumeSkip) done() error {
+	if s == nil || s.counted {
+		return nil
+	}
+	s.counted = true
+	if s.remaining == 0 && prefixHash(s.skipped.String()) == s.prefix {
+		streamResumes.Add("matched", 1)
+		return nil
+	}
+	streamResumes.Add("diverged", 1)
+	log.Printf("Stream resumed from %s diverged from the content that stream delivered", s.from)
+	return errResumeDiverged
+}
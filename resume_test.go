@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func contentChunks(parts ...string) string {
+	events := make([]string, len(parts))
+	for i, p := range parts {
+		data, _ := json.Marshal(ChatCompletionChunk{ID: "x", Object: "chat.completion.chunk", Choices: []ChunkChoice{{Index: 0, Delta: Delta{Content: p}}}})
+		events[i] = string(data)
+	}
+	return sseBody(events...)
+}
+
+// resumedRelay returns a relay resuming the stream that delivered
+// delivered.
+func resumedRelay(t *testing.T, delivered string) *streamRelay {
+	t.Helper()
+	token := newResumeToken("req-1", "h", delivered)
+	skip := resumeFor(token, "req-2", "h")
+	if skip == nil {
+		t.Fatal("resume token not accepted")
+	}
+	return &streamRelay{requestID: "req-2", n: 1, resume: skip}
+}
+
+func TestResumeTokenRoundTrip(t *testing.T) {
+	tok, ok := decodeResumeToken(newResumeToken("req-1", "h", "héllo"))
+	if !ok || tok.RequestID != "req-1" || tok.Hash != "h" || tok.Delivered != 5 || tok.Prefix != prefixHash("héllo") {
+		t.Errorf("token = %+v, %t", tok, ok)
+	}
+	for _, bad := range []string{"", "not base64!", "e30"} {
+		if _, ok := decodeResumeToken(bad); ok {
+			t.Errorf("decodeResumeToken(%q) accepted", bad)
+		}
+	}
+}
+
+func TestResumeIgnoresTokenForOtherRequest(t *testing.T) {
+	if skip := resumeFor(newResumeToken("req-1", "h", "abc"), "req-2", "other"); skip != nil {
+		t.Errorf("skip = %+v, want nil", skip)
+	}
+}
+
+func TestResumeSkipsMatchingPrefix(t *testing.T) {
+	s := resumedRelay(t, "Hello, wor")
+	events := relayEvents(t, s, contentChunks("Hello", ", world", "!"))
+
+	if text := choiceText(t, events)[0]; text != "ld!" {
+		t.Errorf("client got %q, want the rest after the delivered prefix", text)
+	}
+	if s.text() != "Hello, world!" {
+		t.Errorf("relay content = %q, want all of it", s.text())
+	}
+	for _, e := range events {
+		if strings.Contains(e, "resume_diverged") {
+			t.Errorf("matching resume ended with %s", e)
+		}
+	}
+}
+
+func TestResumeFailsOnDivergedPrefix(t *testing.T) {
+	s := resumedRelay(t, "Hello, wor")
+	events, err := relayEnding(s, contentChunks("Howdy, partner", "!"))
+	if !errors.Is(err, errResumeDiverged) {
+		t.Fatalf("relay = %v, want errResumeDiverged", err)
+	}
+	if text := choiceText(t, events)[0]; text != "" {
+		t.Errorf("client got %q after a diverged resume, want nothing", text)
+	}
+	if len(events) < 2 || !strings.Contains(events[0], `"code":"resume_diverged"`) || events[len(events)-1] != "[DONE]" {
+		t.Errorf("events = %q, want a resume_diverged error then [DONE]", events)
+	}
+}
+
+func TestResumeFailsWhenRegeneratedShorter(t *testing.T) {
+	s := resumedRelay(t, "Hello, wor")
+	events, err := relayEnding(s, contentChunks("Hello"))
+	if !errors.Is(err, errResumeDiverged) {
+		t.Fatalf("relay = %v, want errResumeDiverged", err)
+	}
+	if len(events) < 2 || !strings.Contains(events[0], `"code":"resume_diverged"`) {
+		t.Errorf("events = %q, want a resume_diverged error", events)
+	}
+}
+
+func TestResumeSkipReportsDivergenceOnce(t *testing.T) {
+	skip := &resumeSkip{remaining: 3, prefix: prefixHash("abc")}
+	if rest, err := skip.skip("abX"); rest != "" || !errors.Is(err, errResumeDiverged) {
+		t.Errorf("skip = %q, %v; want errResumeDiverged", rest, err)
+	}
+	if err := skip.done(); err != nil {
+		t.Errorf("done after divergence = %v, want nil", err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// router wraps a pattern-based ServeMux with trailing-slash normalization and
+// OpenAI-style JSON bodies for 404 and 405 responses.
+type router struct {
+	mux *http.ServeMux
+
+	// patterns lists registered routes for /admin/routes
+	patterns []string
+}
+
+func newRouter() *router {
+	return &router{mux: http.NewServeMux()}
+}
+
+// handle registers h for a "METHOD /path/{param}" pattern.
+func (rt *router) handle(pattern string, h http.HandlerFunc) {
+	rt.mux.HandleFunc(pattern, h)
+	rt.patterns = append(rt.patterns, pattern)
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Treat /v1/chat/completions/ the same as /v1/chat/completions
+	if len(r.URL.Path) > 1 && strings.HasSuffix(r.URL.Path, "/") {
+		r.URL.Path = strings.TrimRight(r.URL.Path, "/")
+		r.URL.RawPath = ""
+	}
+
+	if _, pattern := rt.mux.Handler(r); pattern != "" {
+		rec := recordFromContext(r.Context())
+		rec.Route = pattern
+		// Before any work, so abandoned requests cost nothing
+		if staleRejection.reject(w, rec) {
+			return
+		}
+		rt.mux.ServeHTTP(w, r)
+		return
+	}
+
+	// No route matched: let the mux decide between 404 and 405 (it computes
+	// the Allow header), then replace its plain-text body with JSON
+	probe := &probeWriter{header: make(http.Header)}
+	rt.mux.ServeHTTP(probe, r)
+	if probe.status == http.StatusMethodNotAllowed {
+		w.Header().Set("Allow", probe.header.Get("Allow"))
+		writeJSONError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method_not_allowed",
+			fmt.Sprintf("Method %s is not allowed for %s", r.Method, r.URL.Path))
+		return
+	}
+	writeJSONError(w, http.StatusNotFound, "invalid_request_error", "not_found",
+		fmt.Sprintf("Unknown endpoint %s", r.URL.Path))
+}
+
+// probeWriter records the status and headers of a response and discards the body.
+type probeWriter struct {
+	header http.Header
+	status int
+}
+
+func (p *probeWriter) Header() http.Header         { return p.header }
+func (p *probeWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (p *probeWriter) WriteHeader(status int)      { p.status = status }
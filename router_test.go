@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testRouter() *router {
+	rt := newRouter()
+	named := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.PathValue("id")))
+		}
+	}
+	rt.handle("POST /v1/chat/completions", named("chat"))
+	rt.handle("GET /v1/batches/{id}", named("batch"))
+	rt.handle("POST /v1/batches/{id}/cancel", named("cancel"))
+	rt.handle("PATCH /admin/keys/{id}", named("update"))
+	rt.handle("DELETE /admin/keys/{id}", named("delete"))
+	return rt
+}
+
+func TestRouterServesRoutes(t *testing.T) {
+	rt := testRouter()
+	tests := []struct {
+		method, path, want string
+	}{
+		{"POST", "/v1/chat/completions", "chat "},
+		{"POST", "/v1/chat/completions/", "chat "},
+		{"POST", "/v1/chat/completions//", "chat "},
+		{"GET", "/v1/batches/batch-1", "batch batch-1"},
+		{"GET", "/v1/batches/batch-1/", "batch batch-1"},
+		{"POST", "/v1/batches/batch-1/cancel", "cancel batch-1"},
+		{"DELETE", "/admin/keys/k1", "delete k1"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		rt.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != tt.want {
+			t.Errorf("%s %s = %d %q, want %q", tt.method, tt.path, w.Code, w.Body, tt.want)
+		}
+	}
+}
+
+func TestRouterRecordsRoutePattern(t *testing.T) {
+	rt := testRouter()
+	rec := &requestRecord{}
+	r := httptest.NewRequest(http.MethodGet, "/v1/batches/batch-1/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), requestRecordKey{}, rec))
+	rt.ServeHTTP(httptest.NewRecorder(), r)
+	if rec.Route != "GET /v1/batches/{id}" {
+		t.Errorf("route = %q", rec.Route)
+	}
+}
+
+func TestRouterErrors(t *testing.T) {
+	rt := testRouter()
+	tests := []struct {
+		method, path string
+		status       int
+		code, allow  string
+	}{
+		{"GET", "/v1/chat/completions", http.StatusMethodNotAllowed, "method_not_allowed", "POST"},
+		{"GET", "/v1/chat/completions/", http.StatusMethodNotAllowed, "method_not_allowed", "POST"},
+		{"POST", "/admin/keys/k1", http.StatusMethodNotAllowed, "method_not_allowed", "DELETE, PATCH"},
+		{"POST", "/v1/embeddings", http.StatusNotFound, "not_found", ""},
+		{"GET", "/v1/batches", http.StatusNotFound, "not_found", ""},
+		{"GET", "/", http.StatusNotFound, "not_found", ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		var body struct {
+			Error struct {
+				Type, Code string
+			}
+		}
+		if w.Code != tt.status || json.Unmarshal(w.Body.Bytes(), &body) != nil || body.Error.Code != tt.code || body.Error.Type != "invalid_request_error" {
+			t.Errorf("%s %s = %d %s, want %d %s", tt.method, tt.path, w.Code, w.Body, tt.status, tt.code)
+		}
+		if got := w.Header().Get("Allow"); got != tt.allow {
+			t.Errorf("%s %s: Allow = %q, want %q", tt.method, tt.path, got, tt.allow)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: Content-Type = %q", tt.method, tt.path, ct)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// setting is one resolved configuration value and where it came from:
+// "default", "env" (an environment variable) or "file" (MODEL_CATALOG).
+type setting struct {
+	Value  any    `json:"value"`
+	Source string `json:"source"`
+}
+
+// envSetting attributes value to the environment when name is set.
+func envSetting(name string, value any) setting {
+	if _, ok := os.LookupEnv(name); ok {
+		return setting{Value: value, Source: "env"}
+	}
+	return setting{Value: value, Source: "default"}
+}
+
+// secretSetting reports whether a secret is configured without its value.
+func secretSetting(name string) setting {
+	if os.Getenv(name) != "" {
+		return setting{Value: "[redacted]", Source: "env"}
+	}
+	return setting{Value: "", Source: "default"}
+}
+
+// routeConfig is the effective configuration of one registered route.
+type routeConfig struct {
+	Route      string             `json:"route"`
+	Models     []routeModel       `json:"models,omitempty"`
+	Backends   []routeBackendInfo `json:"backends,omitempty"`
+	Stages     []routeStage       `json:"stages"`
+	SLO        *SLO               `json:"slo,omitempty"`
+	Comparison *Comparison        `json:"comparison,omitempty"`
+	// StreamCoalesce is how the route's streams are coalesced
+	StreamCoalesce *StreamCoalesce `json:"stream_coalesce,omitempty"`
+	// ResponseProcessing is the route's response post-processing
+	ResponseProcessing *ResponseProcessing `json:"response_processing,omitempty"`
+	// StaleRequests is the route's X-Request-Start age limit
+	StaleRequests *StaleRequests `json:"stale_requests,omitempty"`
+	// PromptExperiment is the route's system prompt experiment
+	PromptExperiment *PromptExperiment `json:"prompt_experiment,omitempty"`
+}
+
+type routeModel struct {
+	ID            string `json:"id"`
+	Backend       string `json:"backend"`
+	UpstreamModel string `json:"upstream_model,omitempty"`
+	Source        string `json:"source"`
+}
+
+type routeBackendInfo struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	URL  string `json:"url,omitempty"`
+	// APIKey is the api_key reference as configured; literal keys are redacted
+	APIKey string `json:"api_key,omitempty"`
+	Source string `json:"source"`
+	// Pool is the backend's connection pool, once it has been used
+	Pool *poolStats `json:"pool,omitempty"`
+}
+
+// routeStage is a middleware or handler stage. Settings holds its key
+// parameters; map keys are sorted when encoded, so output diffs cleanly.
+type routeStage struct {
+	Name     string             `json:"name"`
+	Enabled  bool               `json:"enabled"`
+	Settings map[string]setting `json:"settings,omitempty"`
+}
+
+// routesAdminHandler serves GET /admin/routes: every registered route with
+// its models, backends, enabled stages and their parameters, each value
+// tagged with its source. Secrets are never included.
+func routesAdminHandler(rt *router, auth *hmacAuth, limiter *concurrencyLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		patterns := append([]string(nil), rt.patterns...)
+		sort.Strings(patterns)
+
+		routes := make([]routeConfig, 0, len(patterns))
+		for _, pattern := range patterns {
+			rc := routeConfig{Route: pattern}
+			if slos != nil {
+				if sr, ok := slos.routes[pattern]; ok {
+					rc.SLO = sr.slo
+				}
+			}
+			if comparisons != nil {
+				if cr, ok := comparisons.routes[pattern]; ok {
+					rc.Comparison = cr.cfg
+				}
+			}
+			rc.StreamCoalesce = streamCoalescing.route(pattern)
+			rc.ResponseProcessing = responseProcessing.route(pattern)
+			rc.StaleRequests = staleRejection.route(pattern)
+			rc.PromptExperiment = promptExperiments.route(pattern)
+			_, path, _ := strings.Cut(pattern, " ")
+
+			switch {
+			case strings.HasPrefix(path, "/admin/"):
+				rc.Stages = append(rc.Stages, routeStage{
+					Name:     "admin_auth",
+					Enabled:  os.Getenv("ADMIN_TOKEN") != "",
+					Settings: map[string]setting{"token": secretSetting("ADMIN_TOKEN")},
+				})
+			case strings.HasPrefix(path, "/v1/"):
+				rc.Stages = append(rc.Stages, authStage(auth), apiKeyStage())
+			}
+
+			switch {
+			case transparentRoutes.covers(path):
+				rc.Models, rc.Backends = routeModels()
+				rc.Stages = append(rc.Stages, routeStage{
+					Name:     "transparent",
+					Enabled:  true,
+					Settings: map[string]setting{"routes": envSetting("TRANSPARENT_ROUTES", transparentRoutes.paths)},
+				})
+			case pattern == "POST /v1/chat/completions":
+				rc.Models, rc.Backends = routeModels()
+				rc.Stages = append(rc.Stages, chatStages(limiter)...)
+			case pattern == "GET /v1/models":
+				rc.Models, _ = routeModels()
+			}
+			if slices.Contains(collectableRoutes, pattern) && !transparentRoutes.covers(path) {
+				rc.Stages = append(rc.Stages, dataCollection.stage(pattern))
+			}
+			routes = append(routes, rc)
+		}
+
+		// Scrubbed as a whole too, so no field can leak a resolved secret
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		enc.Encode(map[string]any{"build": buildInfo, "routes": routes})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(redactor.redact(buf.Bytes()))
+	}
+}
+
+func authStage(auth *hmacAuth) routeStage {
+	stage := routeStage{Name: "hmac_auth", Enabled: auth != nil}
+	if auth != nil {
+		stage.Settings = map[string]setting{
+			"keys":           envSetting("HMAC_KEYS", len(auth.secrets)),
+			"max_skew":       envSetting("HMAC_MAX_SKEW", auth.maxSkew.String()),
+			"max_body_bytes": envSetting("HMAC_MAX_BODY_BYTES", auth.maxBody),
+			"replay_cache":   envSetting("HMAC_REPLAY_CACHE", auth.maxSeen),
+		}
+	}
+	return stage
+}
+
+func apiKeyStage() routeStage {
+	stage := routeStage{Name: "api_key_auth", Enabled: apiKeys != nil}
+	if apiKeys != nil {
+		stage.Settings = map[string]setting{
+			"store": envSetting("API_KEY_STORE", apiKeys.path),
+			"keys":  envSetting("API_KEY_STORE", len(apiKeys.index.Load().byID)),
+		}
+	}
+	return stage
+}
+
+// routeModels lists the catalog's models with the backend each resolves to,
+// plus the backends in play, starting with the default.
+func routeModels() ([]routeModel, []routeBackendInfo) {
+	c := catalog.Load()
+
+	def := defaultBackend()
+	defSource := "default"
+	if def != echoBackend {
+		defSource = "env"
+	}
+	backends := []routeBackendInfo{{Name: def.Name, Type: def.Type, URL: def.URL, Source: defSource, Pool: poolStatsFor(def.Name)}}
+	names := make([]string, 0, len(c.backends))
+	for name := range c.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b := c.backends[name]
+		backends = append(backends, routeBackendInfo{Name: b.Name, Type: b.Type, URL: b.URL, APIKey: describeSecret(b.apiKeyRef), Source: "file", Pool: poolStatsFor(b.Name)})
+	}
+
+	var models []routeModel
+	for _, m := range c.sorted() {
+		models = append(models, routeModel{
+			ID:            m.ID,
+			Backend:       c.routeBackend(m.ID).Name,
+			UpstreamModel: m.UpstreamModel,
+			Source:        m.source,
+		})
+	}
+	return models, backends
+}
+
+// chatStages describes the chat completions pipeline in execution order.
+func chatStages(limiter *concurrencyLimiter) []routeStage {
+	conversationTTL := "30m0s"
+	if v := os.Getenv("CONVERSATION_TTL"); v != "" {
+		conversationTTL = v
+	}
+	perKey := make(map[string]int, len(limiter.perKey))
+	for k, v := range limiter.perKey {
+		perKey[k] = v
+	}
+
+	c := catalog.Load()
+	rules := c.nameRules
+	// Models opted into degraded responses and stop enforcement, and those
+	// requiring a user turn
+	degraded, stops, userMessage := []string{}, []string{}, []string{}
+	for _, m := range c.sorted() {
+		if m.DegradedResponse != "" {
+			degraded = append(degraded, m.ID)
+		}
+		if m.EnforceStop {
+			stops = append(stops, m.ID)
+		}
+		if m.RequireUserMessage {
+			userMessage = append(userMessage, m.ID)
+		}
+	}
+	// Keys that set require_user themselves; their children inherit it
+	userKeys := []string{}
+	if apiKeys != nil {
+		for _, k := range apiKeys.list() {
+			if k.RequireUser {
+				userKeys = append(userKeys, k.ID)
+			}
+		}
+	}
+	rates := rateLimits
+	if rates == nil {
+		rates = &rateLimiter{warmupFactor: defaultWarmupFactor}
+	}
+	rateOverrides := make(map[string]string, len(rates.perKey))
+	for k, v := range rates.perKey {
+		rateOverrides[k] = fmt.Sprintf("%g/%g", v.rpm, v.burst)
+	}
+	return []routeStage{
+		{
+			Name:    "rate_limit",
+			Enabled: rateLimits != nil,
+			Settings: map[string]setting{
+				"rpm":           envSetting("RATE_LIMIT_RPM", rates.def.rpm),
+				"burst":         envSetting("RATE_LIMIT_BURST", rates.def.burst),
+				"key_overrides": envSetting("KEY_RATE_LIMITS", rateOverrides),
+				"warmup":        envSetting("RATE_LIMIT_WARMUP", rates.warmup.String()),
+				"warmup_factor": envSetting("RATE_LIMIT_WARMUP_FACTOR", rates.warmupFactor),
+			},
+		},
+		{
+			Name:    "concurrency_limit",
+			Enabled: limiter.def > 0 || len(limiter.perKey) > 0,
+			Settings: map[string]setting{
+				"default_per_key": envSetting("MAX_CONCURRENT_REQUESTS", limiter.def),
+				"key_overrides":   envSetting("KEY_MAX_CONCURRENT", perKey),
+			},
+		},
+		{
+			Name:    "model_names",
+			Enabled: rules.fold || len(rules.prefixes) > 0,
+			Settings: map[string]setting{
+				"normalize":      envSetting("MODEL_NAME_NORMALIZE", rules.fold),
+				"strip_prefixes": envSetting("MODEL_NAME_STRIP_PREFIXES", rules.prefixes),
+			},
+		},
+		{
+			Name:    "require_user",
+			Enabled: len(userKeys) > 0,
+			Settings: map[string]setting{
+				"keys":           {Value: userKeys, Source: "file"},
+				"user_hash_salt": secretSetting("USER_HASH_SALT"),
+			},
+		},
+		{
+			Name:     "require_user_message",
+			Enabled:  len(userMessage) > 0,
+			Settings: map[string]setting{"models": {Value: userMessage, Source: "file"}},
+		},
+		{Name: "capability_check", Enabled: true},
+		{
+			Name:    "guardrails",
+			Enabled: guardrails != nil,
+			Settings: map[string]setting{
+				"guardrails": envSetting("GUARDRAILS", guardrails.names()),
+				"fail_open":  envSetting("GUARDRAIL_FAIL_OPEN", guardrails.failOpenNames()),
+				"timeout":    envSetting("GUARDRAIL_TIMEOUT", envDuration("GUARDRAIL_TIMEOUT", defaultGuardrailTimeout).String()),
+			},
+		},
+		{
+			Name:     "routing",
+			Enabled:  true,
+			Settings: map[string]setting{"router": envSetting("ROUTER", requestRouterName)},
+		},
+		{
+			Name:     "vllm_priority",
+			Enabled:  len(vllmPriorityClasses()) > 0,
+			Settings: map[string]setting{"classes": envSetting("VLLM_PRIORITY_CLASSES", vllmPriorityClasses())},
+		},
+		{
+			Name:     "conversations",
+			Enabled:  conversations != nil,
+			Settings: conversationSettings(conversationTTL),
+		},
+		{
+			Name:     "stop_enforcement",
+			Enabled:  len(stops) > 0,
+			Settings: map[string]setting{"models": {Value: stops, Source: "file"}},
+		},
+		{
+			Name:     "degraded_response",
+			Enabled:  len(degraded) > 0,
+			Settings: map[string]setting{"models": {Value: degraded, Source: "file"}},
+		},
+		{
+			Name:    "stream_backpressure",
+			Enabled: true,
+			Settings: map[string]setting{
+				"buffer":            envSetting("STREAM_BUFFER", streamBufferSize()),
+				"slow_client_grace": envSetting("STREAM_SLOW_CLIENT_GRACE", envDuration("STREAM_SLOW_CLIENT_GRACE", defaultSlowClientGrace).String()),
+				"write_timeout":     envSetting("STREAM_WRITE_TIMEOUT", envDuration("STREAM_WRITE_TIMEOUT", defaultStreamWriteTimeout).String()),
+			},
+		},
+		{
+			Name:     "server_timing",
+			Enabled:  os.Getenv("SERVER_TIMING") == "true" || os.Getenv("SERVER_TIMING") == "keys",
+			Settings: map[string]setting{"shown_to": envSetting("SERVER_TIMING", serverTimingAudience())},
+		},
+	}
+}
+
+func conversationSettings(ttl string) map[string]setting {
+	settings := map[string]setting{"ttl": envSetting("CONVERSATION_TTL", ttl)}
+	if s, ok := conversations.(*memoryConversationStore); ok {
+		settings["max_sessions"] = envSetting("CONVERSATION_MAX_SESSIONS", s.maxSessions)
+		settings["max_bytes"] = envSetting("CONVERSATION_MAX_BYTES", s.maxBytes)
+	}
+	return settings
+}
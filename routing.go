@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// defaultRouterName is the Router used unless ROUTER names another.
+const defaultRouterName = "catalog"
+
+// Router decides where a chat completion request goes. The handler does the
+// sending; a Router only chooses. Ensemble models are expanded before
+// routing, so a Router sees each request for a concrete model.
+type Router interface {
+	Route(ctx context.Context, rc *RequestContext) (RouteDecision, error)
+}
+
+// RequestContext is what a Router sees of a request. Request must be
+// treated as read-only; changes to the request belong in the decision.
+type RequestContext struct {
+	RequestID string
+	KeyID     string
+	Header    http.Header
+	// Request is the parsed body; Request.Model is the public model alias
+	Request *ChatCompletionRequest
+}
+
+// RouteDecision is a Router's answer.
+type RouteDecision struct {
+	// Targets are the backends for the request in order of preference. The
+	// handler sends to the first; the rest are listed in dry-run reports
+	Targets []RouteTarget
+	// Pin, when set, names what forced the choice (such as a routing token
+	// ID); pinned requests bypass the response cache
+	Pin string
+}
+
+// RouteTarget is one backend a request may be sent to.
+type RouteTarget struct {
+	Backend *Backend
+	// Model rewrites the model ID sent to this backend; empty keeps the
+	// public alias
+	Model string
+}
+
+// RouteError rejects a request with a client-facing status and error.
+type RouteError struct {
+	Status  int
+	Type    string
+	Code    string
+	Message string
+}
+
+func (e *RouteError) Error() string { return e.Message }
+
+// routers are the Router implementations compiled into the gateway, by the
+// name ROUTER selects. Forks add their own with registerRouter from an init
+// function; see _examples/placementrouter.
+var routers = map[string]func() (Router, error){
+	defaultRouterName: func() (Router, error) { return catalogRouter{}, nil },
+}
+
+func registerRouter(name string, factory func() (Router, error)) {
+	if _, ok := routers[name]; ok {
+		panic(fmt.Sprintf("router %q registered twice", name))
+	}
+	routers[name] = factory
+}
+
+// requestRouter routes chat completions; requestRouterName is its ROUTER name.
+var (
+	requestRouter     Router = catalogRouter{}
+	requestRouterName        = defaultRouterName
+)
+
+// loadRouter builds the Router named by ROUTER (default catalog).
+func loadRouter() (Router, string, error) {
+	name := os.Getenv("ROUTER")
+	if name == "" {
+		name = defaultRouterName
+	}
+	factory, ok := routers[name]
+	if !ok {
+		names := make([]string, 0, len(routers))
+		for n := range routers {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, "", fmt.Errorf("unknown ROUTER %q: want one of %s", name, strings.Join(names, ", "))
+	}
+	r, err := factory()
+	if err != nil {
+		return nil, "", fmt.Errorf("router %q: %w", name, err)
+	}
+	return r, name, nil
+}
+
+// catalogRouter routes by the model catalog, honoring routing tokens.
+type catalogRouter struct{}
+
+func (catalogRouter) Route(ctx context.Context, rc *RequestContext) (RouteDecision, error) {
+	model := rc.Request.Model
+	c := requestCatalog(ctx)
+	target := RouteTarget{Backend: c.routeBackend(model), Model: c.upstreamModel(model)}
+	if target.Model == model {
+		target.Model = ""
+	}
+	d := RouteDecision{Targets: []RouteTarget{target}}
+
+	pinned, claims, err := routingTokens.override(c, rc.Header.Get(routingTokenHeader), model)
+	if err != nil {
+		if routingTokens.reject {
+			return RouteDecision{}, &RouteError{Status: http.StatusForbidden, Type: "permission_error", Code: "invalid_routing_token", Message: err.Error()}
+		}
+		log.Printf("Ignoring routing token on %s: %v", rc.RequestID, err)
+	} else if pinned != nil {
+		log.Printf("Routing token %s pins %s to backend %q", claims.ID, rc.RequestID, pinned.Name)
+		d.Targets[0].Backend = pinned
+		d.Pin = claims.ID
+	}
+	return d, nil
+}
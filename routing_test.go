@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// stubRouter is a custom Router that records what it was asked, copying the
+// request as it was at routing time, and answers with a fixed decision.
+type stubRouter struct {
+	decision RouteDecision
+	err      error
+	seen     []RequestContext
+}
+
+func (s *stubRouter) Route(ctx context.Context, rc *RequestContext) (RouteDecision, error) {
+	req := *rc.Request
+	seen := *rc
+	seen.Request = &req
+	s.seen = append(s.seen, seen)
+	return s.decision, s.err
+}
+
+func useRouter(t *testing.T, r Router) {
+	t.Helper()
+	prev, prevName := requestRouter, requestRouterName
+	requestRouter, requestRouterName = r, t.Name()
+	t.Cleanup(func() { requestRouter, requestRouterName = prev, prevName })
+}
+
+func TestCustomRouterPicksBackend(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	t.Setenv("BACKEND_URL", "")
+	useCatalog(t, &ModelInfo{ID: "m"})
+	chosen := &Backend{Name: "chosen", Type: "openai", URL: back.URL}
+	router := &stubRouter{decision: RouteDecision{Targets: []RouteTarget{{Backend: chosen, Model: "upstream-m"}}}}
+	useRouter(t, router)
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+	r.Header.Set("X-Request-ID", "req-1")
+	r.Header.Set("X-Placement-Hint", "gpu-a")
+	r = r.WithContext(context.WithValue(r.Context(), identityContextKey{}, identity{KeyID: "team", Method: "api_key"}))
+	w := httptest.NewRecorder()
+	accessLog(http.HandlerFunc(chatCompletionsHandler)).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	if len(router.seen) != 1 {
+		t.Fatalf("router called %d times, want 1", len(router.seen))
+	}
+	rc := router.seen[0]
+	if rc.RequestID != "req-1" || rc.KeyID != "team" || rc.Header.Get("X-Placement-Hint") != "gpu-a" || rc.Request.Model != "m" {
+		t.Errorf("router saw %+v", rc)
+	}
+	last, _ := back.Last()
+	var sent ChatCompletionRequest
+	if err := last.Decode(&sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent.Model != "upstream-m" {
+		t.Errorf("backend got model %q, want the router's rewrite", sent.Model)
+	}
+}
+
+func TestRouteErrors(t *testing.T) {
+	captureLog(t)
+	useFakeBackend(t)
+	tests := []struct {
+		name         string
+		router       *stubRouter
+		status       int
+		code, errMsg string
+	}{
+		{
+			"route error",
+			&stubRouter{err: &RouteError{Status: http.StatusTooManyRequests, Type: "rate_limit_error", Code: "placement_full", Message: "No capacity"}},
+			http.StatusTooManyRequests, "placement_full", "No capacity",
+		},
+		{
+			"wrapped route error",
+			&stubRouter{err: errors.Join(errors.New("placement"), &RouteError{Status: http.StatusForbidden, Type: "permission_error", Code: "denied", Message: "Denied"})},
+			http.StatusForbidden, "denied", "Denied",
+		},
+		{
+			"other error",
+			&stubRouter{err: errors.New("dial tcp 10.0.0.7:9000: connection refused")},
+			http.StatusBadGateway, "routing_failed", "No backend is available for this request",
+		},
+		{"no targets", &stubRouter{}, http.StatusBadGateway, "routing_failed", "No backend is available for this request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useRouter(t, tt.router)
+			w := chatAs("", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`)
+			var body struct {
+				Error struct{ Code, Message string }
+			}
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if w.Code != tt.status || body.Error.Code != tt.code || body.Error.Message != tt.errMsg {
+				t.Errorf("response = %d %s, want %d %s", w.Code, w.Body, tt.status, tt.code)
+			}
+			// Internal addresses from router errors stay in the log
+			if strings.Contains(w.Body.String(), "10.0.0.7") {
+				t.Errorf("response leaks the router error: %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestRouterFallbacksInDryRun(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	t.Setenv("DRY_RUN_KEYS", "*")
+	useRouter(t, &stubRouter{decision: RouteDecision{
+		Targets: []RouteTarget{
+			{Backend: &Backend{Name: "primary", Type: "vllm", URL: back.URL}},
+			{Backend: &Backend{Name: "second", Type: "openai"}},
+			{Backend: &Backend{Name: "third", Type: "openai"}},
+		},
+		Pin: "tok-1",
+	}})
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+	r.Header.Set(dryRunHeader, "true")
+	w := httptest.NewRecorder()
+	accessLog(http.HandlerFunc(chatCompletionsHandler)).ServeHTTP(w, r)
+	var report dryRunReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if report.Backend != "primary" || report.BackendType != "vllm" || report.RoutingToken != "tok-1" || strings.Join(report.Fallbacks, ",") != "second,third" {
+		t.Errorf("report = %+v", report)
+	}
+	if n := len(back.Requests()); n != 0 {
+		t.Errorf("dry run sent %d requests to the backend", n)
+	}
+}
+
+func TestCatalogRouter(t *testing.T) {
+	c := useCatalog(t, &ModelInfo{ID: "m", Backend: "b"}, &ModelInfo{ID: "alias", Backend: "b", UpstreamModel: "real"})
+	c.backends["b"] = &Backend{Name: "b", Type: "vllm", URL: "http://b"}
+	for model, upstream := range map[string]string{"m": "", "alias": "real"} {
+		rc := &RequestContext{Header: http.Header{}, Request: &ChatCompletionRequest{Model: model}}
+		d, err := catalogRouter{}.Route(t.Context(), rc)
+		if err != nil || len(d.Targets) != 1 || d.Pin != "" {
+			t.Fatalf("%s: decision = %+v, %v", model, d, err)
+		}
+		if d.Targets[0].Backend.Name != "b" || d.Targets[0].Model != upstream {
+			t.Errorf("%s: target = %s %q, want b %q", model, d.Targets[0].Backend.Name, d.Targets[0].Model, upstream)
+		}
+	}
+}
+
+func TestLoadRouter(t *testing.T) {
+	t.Cleanup(func() {
+		delete(routers, "test-ok")
+		delete(routers, "test-broken")
+	})
+	custom := &stubRouter{}
+	registerRouter("test-ok", func() (Router, error) { return custom, nil })
+	registerRouter("test-broken", func() (Router, error) { return nil, errors.New("PLACEMENT_URL is not set") })
+
+	tests := []struct {
+		env, name string
+		want      Router
+		err       string
+	}{
+		{"", "catalog", catalogRouter{}, ""},
+		{"catalog", "catalog", catalogRouter{}, ""},
+		{"test-ok", "test-ok", custom, ""},
+		{"test-broken", "", nil, `router "test-broken": PLACEMENT_URL is not set`},
+		{"nope", "", nil, `unknown ROUTER "nope": want one of catalog, test-broken, test-ok`},
+	}
+	for _, tt := range tests {
+		t.Setenv("ROUTER", tt.env)
+		r, name, err := loadRouter()
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("ROUTER=%s: err = %v, want %s", tt.env, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || name != tt.name || r != tt.want {
+			t.Errorf("ROUTER=%s: %T %q %v, want %T %q", tt.env, r, name, err, tt.want, tt.name)
+		}
+	}
+}
+
+func TestRegisterRouterTwicePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering catalog again didn't panic")
+		}
+	}()
+	registerRouter(defaultRouterName, func() (Router, error) { return catalogRouter{}, nil })
+}
+
+func TestRouterShownInRoutes(t *testing.T) {
+	useRouter(t, &stubRouter{})
+	for _, s := range chatStages(&concurrencyLimiter{}) {
+		if s.Name == "routing" {
+			if got := s.Settings["router"].Value; got != t.Name() {
+				t.Errorf("routing stage router = %v, want %s", got, t.Name())
+			}
+			return
+		}
+	}
+	t.Error("no routing stage")
+}
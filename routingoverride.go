@@ -0,0 +1,95 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// targetBackendHeader names the backend a request should go to, in place
+// of the one routing picks. Only keys allowed to override routing may use
+// it; for other callers it is ignored.
+const targetBackendHeader = "X-Gateway-Target-Backend"
+
+// routingOverrides counts X-Gateway-Target-Backend requests by outcome:
+// applied, ignored (the key may not override routing) and rejected.
+var routingOverrides = expvar.NewMap("gateway_routing_overrides_total")
+
+// routingOverrideAllowed reports whether keyID may send
+// X-Gateway-Target-Backend: it is listed in ROUTING_OVERRIDE_KEYS ("*"
+// for every caller) or is a stored key with can_override_routing.
+func routingOverrideAllowed(keyID string) bool {
+	for _, k := range strings.Split(os.Getenv("ROUTING_OVERRIDE_KEYS"), ",") {
+		if k = strings.TrimSpace(k); k == "*" || (k != "" && k == keyID) {
+			return true
+		}
+	}
+	return apiKeys.keyAllows(keyID, func(k *APIKey) bool { return k.CanOverrideRouting })
+}
+
+// overrideRoute sends the request to the backend r names in
+// X-Gateway-Target-Backend, replacing d's targets, when the caller may.
+// The backend must serve model. It reports whether d was overridden.
+func overrideRoute(r *http.Request, keyID, model, requestID string, d *RouteDecision) (bool, *RouteError) {
+	name := r.Header.Get(targetBackendHeader)
+	if name == "" {
+		return false, nil
+	}
+	if !routingOverrideAllowed(keyID) {
+		routingOverrides.Add("ignored", 1)
+		log.Printf("audit action=routing.override_ignored key=%q backend=%q model=%q request=%s remote=%s",
+			keyID, truncateForLog(name), model, requestID, r.RemoteAddr)
+		return false, nil
+	}
+	c := requestCatalog(r.Context())
+	b, ok := c.lookupBackend(name)
+	if !ok {
+		routingOverrides.Add("rejected", 1)
+		return false, &RouteError{Status: http.StatusBadRequest, Type: "invalid_request_error", Code: "unknown_backend",
+			Message: fmt.Sprintf("%s names unknown backend %q", targetBackendHeader, name)}
+	}
+	if !backendServes(c, b, model) {
+		routingOverrides.Add("rejected", 1)
+		return false, &RouteError{Status: http.StatusBadRequest, Type: "invalid_request_error", Code: "model_not_served",
+			Message: fmt.Sprintf("Backend %q does not serve model %q", name, model)}
+	}
+
+	target := RouteTarget{Backend: b, Model: c.upstreamModel(model)}
+	if target.Model == model {
+		target.Model = ""
+	}
+	d.Targets = []RouteTarget{target}
+	routingOverrides.Add("applied", 1)
+	log.Printf("audit action=routing.override key=%q backend=%q model=%q request=%s remote=%s",
+		keyID, b.Name, model, requestID, r.RemoteAddr)
+	return true, nil
+}
+
+// backendServes reports whether b can answer requests for model: the
+// catalog routes model to it or lists model in its models. Echo answers
+// every model.
+func backendServes(c *modelCatalog, b *Backend, model string) bool {
+	if b == echoBackend {
+		return true
+	}
+	if m, ok := c.lookup(model); ok && m.Backend == b.Name {
+		return true
+	}
+	return slices.Contains(b.Models, model)
+}
+
+// checkBackendModels rejects backends listing models the catalog lacks.
+func checkBackendModels(c *modelCatalog) error {
+	for name, b := range c.backends {
+		for _, id := range b.Models {
+			if _, ok := c.models[id]; !ok {
+				return fmt.Errorf("backend %q lists unknown model %q", name, id)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// routingTokenHeader carries a signed backend override.
+const routingTokenHeader = "X-Routing-Token"
+
+const (
+	defaultRoutingTokenTTL = 5 * time.Minute
+	maxRoutingTokenTTL     = 24 * time.Hour
+)
+
+// routingTokens is nil unless ROUTING_TOKEN_SECRET is set. While it is nil,
+// X-Routing-Token headers are ignored.
+var routingTokens *routingTokenSigner
+
+// routingClaims is the signed payload of a routing token.
+type routingClaims struct {
+	ID      string `json:"id"`
+	Backend string `json:"backend"`
+	// Model, when set, limits the override to requests for that model
+	Model     string `json:"model,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// routingTokenSigner issues and verifies routing tokens of the form
+// base64url(claims) "." base64url(HMAC-SHA256(secret, base64url(claims))).
+type routingTokenSigner struct {
+	secret []byte
+	// reject makes invalid tokens fail the request instead of being ignored
+	reject bool
+	now    func() time.Time
+}
+
+// loadRoutingTokens reads ROUTING_TOKEN_SECRET and ROUTING_TOKEN_INVALID
+// (ignore, the default, or reject). It returns nil when routing tokens are
+// not configured.
+func loadRoutingTokens() (*routingTokenSigner, error) {
+	secret := os.Getenv("ROUTING_TOKEN_SECRET")
+	if secret == "" {
+		return nil, nil
+	}
+	s := &routingTokenSigner{secret: []byte(secret), now: time.Now}
+	switch v := os.Getenv("ROUTING_TOKEN_INVALID"); v {
+	case "", "ignore":
+	case "reject":
+		s.reject = true
+	default:
+		return nil, fmt.Errorf("invalid ROUTING_TOKEN_INVALID %q: want ignore or reject", v)
+	}
+	return s, nil
+}
+
+func (s *routingTokenSigner) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issue signs claims for backend, valid for ttl.
+func (s *routingTokenSigner) issue(backend, model string, ttl time.Duration) (string, routingClaims) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	claims := routingClaims{
+		ID:        "rt_" + hex.EncodeToString(id),
+		Backend:   backend,
+		Model:     model,
+		ExpiresAt: s.now().Add(ttl).Unix(),
+	}
+	data, _ := json.Marshal(claims)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + s.sign(payload), claims
+}
+
+var (
+	errMalformedRoutingToken = errors.New("malformed routing token")
+	errRoutingTokenSignature = errors.New("routing token signature mismatch")
+	errRoutingTokenExpired   = errors.New("routing token expired")
+)
+
+// verify checks a token's signature and expiry and returns its claims.
+func (s *routingTokenSigner) verify(token string) (routingClaims, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return routingClaims{}, errMalformedRoutingToken
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.sign(payload))) {
+		return routingClaims{}, errRoutingTokenSignature
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return routingClaims{}, errMalformedRoutingToken
+	}
+	var claims routingClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return routingClaims{}, errMalformedRoutingToken
+	}
+	if s.now().Unix() >= claims.ExpiresAt {
+		return routingClaims{}, errRoutingTokenExpired
+	}
+	return claims, nil
+}
+
+// override returns the backend in c a request's routing token pins it to.
+// It returns a nil backend when there is no token or tokens are disabled.
+func (s *routingTokenSigner) override(c *modelCatalog, token, model string) (*Backend, routingClaims, error) {
+	if s == nil || token == "" {
+		return nil, routingClaims{}, nil
+	}
+	claims, err := s.verify(token)
+	if err != nil {
+		return nil, claims, err
+	}
+	if claims.Model != "" && claims.Model != model {
+		return nil, claims, fmt.Errorf("routing token %s is for model %q", claims.ID, claims.Model)
+	}
+	b, ok := c.lookupBackend(claims.Backend)
+	if !ok {
+		return nil, claims, fmt.Errorf("routing token %s names unknown backend %q", claims.ID, claims.Backend)
+	}
+	return b, claims, nil
+}
+
+// lookupBackend finds a backend by catalog name.
+func (c *modelCatalog) lookupBackend(name string) (*Backend, bool) {
+	if name == echoBackend.Name {
+		return echoBackend, true
+	}
+	b, ok := c.backends[name]
+	return b, ok
+}
+
+// requireRoutingTokens returns 404 for the token endpoint when tokens are
+// not configured.
+func requireRoutingTokens(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if routingTokens == nil {
+			writeJSONError(w, http.StatusNotFound, "invalid_request_error", "not_found", "Routing tokens are not enabled on this gateway")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// routingTokenRequest is the body of POST /admin/routing-tokens. TTL is a
+// Go duration, default 5m, at most 24h.
+type routingTokenRequest struct {
+	Backend string `json:"backend"`
+	Model   string `json:"model"`
+	TTL     string `json:"ttl"`
+}
+
+// issueRoutingTokenHandler implements POST /admin/routing-tokens.
+func issueRoutingTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req routingTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_json", "Invalid JSON: "+describeJSONError(err))
+		return
+	}
+	if _, ok := catalog.Load().lookupBackend(req.Backend); !ok {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "unknown_backend", fmt.Sprintf("No backend named %q", req.Backend))
+		return
+	}
+	ttl := defaultRoutingTokenTTL
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 || d > maxRoutingTokenTTL {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_value",
+				fmt.Sprintf("ttl must be a duration between 0 and %s", maxRoutingTokenTTL))
+			return
+		}
+		ttl = d
+	}
+
+	token, claims := routingTokens.issue(req.Backend, req.Model, ttl)
+	auditRoutingToken(r, claims)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		routingClaims
+		Token string `json:"token"`
+	}{claims, token})
+}
+
+func auditRoutingToken(r *http.Request, c routingClaims) {
+	log.Printf("audit action=routing_token.issue token=%q backend=%q model=%q expires_at=%d remote=%s",
+		c.ID, c.Backend, c.Model, c.ExpiresAt, r.RemoteAddr)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"strings"
+)
+
+// How much clients are told about failures inside the gateway.
+const (
+	detailBackend = "backend" // logical backend names only (default)
+	detailNone    = "none"    // not even which backend
+	detailVerbose = "verbose" // everything, for development
+)
+
+// errorDetail reads ERROR_DETAIL. Outside verbose mode, client-facing
+// errors never carry backend URLs, addresses or Go internals; the full
+// detail is logged under the request ID instead.
+func errorDetail() string {
+	switch d := os.Getenv("ERROR_DETAIL"); d {
+	case detailNone, detailVerbose:
+		return d
+	}
+	return detailBackend
+}
+
+// ipAddress matches IPv4 addresses, with a port if any, which clients have
+// no use for and which map the internal network.
+var ipAddress = regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b`)
+
+// scrubTopology replaces backend endpoints named in msg, with any path
+// after them, by the logical backend name, or "the backend" with
+// ERROR_DETAIL=none, and IP addresses by a placeholder. It leaves msg alone
+// in verbose mode.
+func scrubTopology(msg string, backend *Backend) string {
+	detail := errorDetail()
+	if detail == detailVerbose || msg == "" {
+		return msg
+	}
+	name := "the backend"
+	if detail == detailBackend && backend != nil {
+		name = backend.Name
+	}
+	endpoints := []string{}
+	for _, b := range catalog.Load().backends {
+		endpoints = append(endpoints, b.endpoints()...)
+	}
+	if backend != nil && backend.URL != "" {
+		// The default backend isn't in the catalog
+		endpoints = append(endpoints, backend.URL)
+	}
+	var urls, hosts []string
+	for _, ep := range endpoints {
+		u, err := url.Parse(ep)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		urls = append(urls, regexp.QuoteMeta(u.Scheme+"://"+u.Host))
+		hosts = append(hosts, u.Host, name)
+		// A bare hostname like "vllm" could be an ordinary word
+		if host := u.Hostname(); host != u.Host && strings.Contains(host, ".") {
+			hosts = append(hosts, host, name)
+		}
+	}
+	if len(urls) > 0 {
+		// The path runs to whitespace or a delimiter, leaving the punctuation
+		// of the sentence around it
+		msg = regexp.MustCompile(`(`+strings.Join(urls, "|")+`)([^\s"'<>)]*[^\s"'<>).,:;])?`).ReplaceAllString(msg, name)
+		msg = strings.NewReplacer(hosts...).Replace(msg)
+	}
+	return ipAddress.ReplaceAllString(msg, "[internal address]")
+}
+
+// withheldDetail stands in for an error message kept from the client,
+// pointing at the log line that has it.
+func withheldDetail(summary, requestID string) string {
+	if requestID == "" {
+		return summary
+	}
+	return fmt.Sprintf("%s (request ID %s)", summary, requestID)
+}
+
+// describeJSONError explains a request body that failed to decode without
+// exposing Go type names, such as "field \"messages\" must be an array,
+// not a string". Verbose mode gives the decoder's own message.
+func describeJSONError(err error) string {
+	if errorDetail() == detailVerbose {
+		return err.Error()
+	}
+	var syntax *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntax):
+		return fmt.Sprintf("malformed JSON at byte %d", syntax.Offset)
+	case errors.As(err, &typ):
+		if typ.Field == "" {
+			return fmt.Sprintf("body must be %s, not %s", jsonKind(typ.Type), anArticle(typ.Value))
+		}
+		return fmt.Sprintf("field %q must be %s, not %s", typ.Field, jsonKind(typ.Type), anArticle(typ.Value))
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "body is empty or cut off"
+	}
+	return "body is not valid JSON"
+}
+
+// jsonKind names the JSON value a Go type decodes from.
+func jsonKind(t reflect.Type) string {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil {
+		return "a valid value"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+	return "a valid value"
+}
+
+// anArticle prefixes a JSON value kind, as the decoder reports it, with
+// its article.
+func anArticle(kind string) string {
+	if kind == "" {
+		return "that"
+	}
+	if strings.ContainsRune("aeiou", rune(kind[0])) {
+		return "an " + kind
+	}
+	return "a " + kind
+}
+
+// recoverPanics turns a handler panic into a 500 that names only the
+// request ID, logging the panic and its stack. Verbose mode includes the
+// panic value in the response.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			requestID := w.Header().Get("X-Request-ID")
+			log.Printf("Panic serving %s %s (request %s): %v\n%s", r.Method, r.URL.Path, requestID, v, debug.Stack())
+			if sw.status != 0 {
+				// Too late for an error response; drop the connection
+				panic(http.ErrAbortHandler)
+			}
+			msg := withheldDetail("Internal gateway error", requestID)
+			if errorDetail() == detailVerbose {
+				msg = fmt.Sprintf("Internal gateway error: %v", v)
+			}
+			writeJSONError(w, http.StatusInternalServerError, "server_error", "internal_error", msg)
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/vinayhpandya/ai_inference_gateway/fakeback"
+)
+
+func TestScrubTopology(t *testing.T) {
+	c := useCatalog(t)
+	c.backends["vllm-a"] = &Backend{Name: "vllm-a", URL: "http://vllm-a.svc.cluster.local:8000", URLs: []string{"http://10.0.4.2:8000"}}
+	c.backends["tgi"] = &Backend{Name: "tgi", URL: "http://tgi:8080"}
+	backend := c.backends["vllm-a"]
+
+	tests := []struct {
+		detail, msg, want string
+	}{
+		{"", "", ""},
+		{"", "Post http://vllm-a.svc.cluster.local:8000/v1/chat/completions: EOF", "Post vllm-a: EOF"},
+		{"", "upstream vllm-a.svc.cluster.local:8000 reset", "upstream vllm-a reset"},
+		{"", "from vllm-a.svc.cluster.local, not tgi:8080", "from vllm-a, not vllm-a"},
+		{"", `Post "http://10.0.4.2:8000/v1/chat/completions": EOF`, `Post "vllm-a": EOF`},
+		{"", "see http://vllm-a.svc.cluster.local:8000/health.", "see vllm-a."},
+		{"", `dial tcp 10.0.4.2:8000: connect: connection refused`, "dial tcp vllm-a: connect: connection refused"},
+		{"", "peer 192.168.7.7 closed", "peer [internal address] closed"},
+		// A bare "tgi" could be an ordinary word; only its host:port goes
+		{"", "tgi is overloaded", "tgi is overloaded"},
+		{"none", "Post http://vllm-a.svc.cluster.local:8000/v1/chat/completions: EOF", "Post the backend: EOF"},
+		{"none", "peer 192.168.7.7 closed", "peer [internal address] closed"},
+		{"verbose", "Post http://vllm-a.svc.cluster.local:8000/v1: EOF from 10.0.4.2", "Post http://vllm-a.svc.cluster.local:8000/v1: EOF from 10.0.4.2"},
+	}
+	for _, tt := range tests {
+		t.Setenv("ERROR_DETAIL", tt.detail)
+		if got := scrubTopology(tt.msg, backend); got != tt.want {
+			t.Errorf("ERROR_DETAIL=%s: scrubTopology(%q) = %q, want %q", tt.detail, tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestErrorDetail(t *testing.T) {
+	for env, want := range map[string]string{"": detailBackend, "backend": detailBackend, "none": detailNone, "verbose": detailVerbose, "loud": detailBackend} {
+		t.Setenv("ERROR_DETAIL", env)
+		if got := errorDetail(); got != want {
+			t.Errorf("ERROR_DETAIL=%s: %s, want %s", env, got, want)
+		}
+	}
+}
+
+func TestDescribeJSONError(t *testing.T) {
+	tests := []struct {
+		body, want string
+	}{
+		{`{"model":`, "body is empty or cut off"},
+		{``, "body is empty or cut off"},
+		{`{"model": nope}`, "malformed JSON at byte 12"},
+		{`{"messages":"hi"}`, `field "messages" must be an array, not a string`},
+		{`{"model":7}`, `field "model" must be a string, not a number`},
+		{`{"stream":"yes"}`, `field "stream" must be a boolean, not a string`},
+		{`{"max_tokens":1.5}`, `field "max_tokens" must be an integer, not a number 1.5`},
+		{`[1]`, "body must be an object, not an array"},
+	}
+	for _, tt := range tests {
+		var req ChatCompletionRequest
+		err := json.NewDecoder(strings.NewReader(tt.body)).Decode(&req)
+		if err == nil {
+			t.Fatalf("%s decoded", tt.body)
+		}
+		got := describeJSONError(err)
+		if got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.body, got, tt.want)
+		}
+		if strings.Contains(got, "main.") || strings.Contains(got, "Go value") {
+			t.Errorf("%s: %q names Go types", tt.body, got)
+		}
+	}
+
+	t.Setenv("ERROR_DETAIL", "verbose")
+	var req ChatCompletionRequest
+	err := json.Unmarshal([]byte(`{"messages":"hi"}`), &req)
+	if got := describeJSONError(err); got != err.Error() {
+		t.Errorf("verbose: %q, want the decoder's message", got)
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	logs := captureLog(t)
+	panicky := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-ID", "req-9")
+		panic("nil map write in backend 10.0.0.5")
+	}))
+	w := httptest.NewRecorder()
+	panicky.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil))
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), `"Internal gateway error (request ID req-9)"`) {
+		t.Errorf("response = %d %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "10.0.0.5") || strings.Contains(w.Body.String(), "goroutine") {
+		t.Errorf("response leaks the panic: %s", w.Body)
+	}
+	if !strings.Contains(logs.String(), "nil map write in backend 10.0.0.5") || !strings.Contains(logs.String(), "goroutine") {
+		t.Errorf("log lacks the panic and stack: %.300s", logs)
+	}
+
+	t.Setenv("ERROR_DETAIL", "verbose")
+	w = httptest.NewRecorder()
+	panicky.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil))
+	if !strings.Contains(w.Body.String(), "Internal gateway error: nil map write") {
+		t.Errorf("verbose response = %s", w.Body)
+	}
+
+	// Once the response has started, the connection is dropped instead
+	started := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		panic("late")
+	}))
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", v)
+		}
+	}()
+	started.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+// internalTopology holds what production clients must never see: every
+// catalog endpoint's host and IP.
+type internalTopology struct {
+	secrets []string
+}
+
+func (top internalTopology) check(t *testing.T, what, body string) {
+	t.Helper()
+	for _, s := range top.secrets {
+		if strings.Contains(body, s) {
+			t.Errorf("%s reveals %s: %s", what, s, body)
+		}
+	}
+	if ipAddress.MatchString(body) {
+		t.Errorf("%s reveals an IP address: %s", what, body)
+	}
+}
+
+// useInternalTopology routes model m to a fake backend and lists another
+// backend on an internal hostname, as a production catalog would.
+func useInternalTopology(t *testing.T) (*fakeback.Server, internalTopology) {
+	t.Helper()
+	back := useFakeBackend(t)
+	t.Setenv("BACKEND_URL", "")
+	c := useCatalog(t, &ModelInfo{ID: "m", Backend: "primary"}, &ModelInfo{ID: "down", Backend: "gone"})
+	c.backends["primary"] = &Backend{Name: "primary", Type: "openai", URL: back.URL}
+	c.backends["peer"] = &Backend{Name: "peer", Type: "openai", URL: "http://vllm-b.prod.internal.example:8000"}
+	down := downEndpoint(t)
+	c.backends["gone"] = &Backend{Name: "gone", Type: "openai", URL: down}
+	u, _ := url.Parse(back.URL)
+	d, _ := url.Parse(down)
+	return back, internalTopology{secrets: []string{u.Host, d.Host, "vllm-b.prod.internal.example", "127.0.0.1"}}
+}
+
+func TestNoTopologyInClientErrors(t *testing.T) {
+	for _, detail := range []string{"", "none"} {
+		t.Run("ERROR_DETAIL="+detail, func(t *testing.T) {
+			captureLog(t)
+			t.Setenv("ERROR_DETAIL", detail)
+			back, top := useInternalTopology(t)
+			chat := func(model string) string {
+				return chatAs("", `{"model":"`+model+`","messages":[{"role":"user","content":"hi"}]}`).Body.String()
+			}
+
+			back.Enqueue(fakeback.Error(http.StatusBadGateway, "upstream "+back.URL+"/v1/chat/completions failed; peer vllm-b.prod.internal.example:8000 and 10.0.9.9 unreachable"))
+			top.check(t, "echoed upstream error", chat("m"))
+
+			back.Enqueue(fakeback.Behavior{Status: http.StatusServiceUnavailable, Body: `<html><body><h1>503</h1><p>no healthy upstream at 10.0.9.9:8000 (vllm-b.prod.internal.example)</p></body></html>`})
+			top.check(t, "proxy error page", chat("m"))
+
+			body := chat("down")
+			top.check(t, "connection refused", body)
+			if !strings.Contains(body, "The backend is unavailable (request ID ") {
+				t.Errorf("connection refused: %s, want a summary with the request ID", body)
+			}
+			if detail == "none" && strings.Contains(body, `"backend"`) {
+				t.Errorf("ERROR_DETAIL=none names the backend: %s", body)
+			}
+
+			back.Enqueue(fakeback.Malformed())
+			top.check(t, "malformed backend response", chat("m"))
+
+			invalid := chatAs("", `{"model":"m","messages":"hi"}`).Body.String()
+			top.check(t, "invalid request JSON", invalid)
+			if strings.Contains(invalid, "main.") || !strings.Contains(invalid, `field "messages" must be an array`) {
+				t.Errorf("invalid request JSON: %s", invalid)
+			}
+		})
+	}
+}
+
+func TestNoTopologyInTransportErrors(t *testing.T) {
+	captureLog(t)
+	backend := &Backend{Name: "primary", Type: "openai", URL: "http://10.0.0.5:8000"}
+	for _, err := range []error{
+		&url.Error{Op: "Post", URL: "http://10.0.0.5:8000/v1/chat/completions", Err: context.DeadlineExceeded},
+		&url.Error{Op: "Post", URL: "http://10.0.0.5:8000/v1/chat/completions", Err: io.ErrUnexpectedEOF},
+		errors.New("dial tcp: lookup vllm-a.prod.internal.example: no such host"),
+	} {
+		w := httptest.NewRecorder()
+		w.Header().Set("X-Request-ID", "req-3")
+		writeBackendError(w, err, backend)
+		internalTopology{secrets: []string{"10.0.0.5", "vllm-a.prod.internal.example", "/v1/chat/completions"}}.check(t, err.Error(), w.Body.String())
+		if !strings.Contains(w.Body.String(), "(request ID req-3)") {
+			t.Errorf("%v: %s, want the request ID", err, w.Body)
+		}
+	}
+}
+
+func TestVerboseErrorsKeepDetail(t *testing.T) {
+	captureLog(t)
+	t.Setenv("ERROR_DETAIL", "verbose")
+	back, _ := useInternalTopology(t)
+	back.Enqueue(fakeback.Error(http.StatusBadGateway, "peer vllm-b.prod.internal.example:8000 unreachable"))
+	w := chatAs("", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`)
+	if !strings.Contains(w.Body.String(), "vllm-b.prod.internal.example:8000") {
+		t.Errorf("verbose response = %s, want the upstream message as sent", w.Body)
+	}
+}
+
+func TestReadyzScrubsSelfTestErrors(t *testing.T) {
+	c := useCatalog(t)
+	c.backends["peer"] = &Backend{Name: "peer", Type: "openai", URL: "http://vllm-b.prod.internal.example:8000"}
+	prev := selfTests
+	selfTests = &selfTester{action: "warn", results: map[string]*selfTestResult{
+		"peer": {Status: "failed", OnFailure: "warn", Error: "Get http://vllm-b.prod.internal.example:8000/health: dial tcp 10.0.9.9:8000: connect: connection refused"},
+	}}
+	t.Cleanup(func() { selfTests = prev })
+
+	w := httptest.NewRecorder()
+	readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	internalTopology{secrets: []string{"vllm-b.prod.internal.example"}}.check(t, "/readyz", w.Body.String())
+	if !strings.Contains(w.Body.String(), "Get peer: dial tcp [internal address]: connect: connection refused") {
+		t.Errorf("/readyz = %s", w.Body)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	secretExecTimeout = 10 * time.Second
+	redactedSecret    = "[redacted]"
+	// minRedactedLength keeps short values, which could be ordinary words,
+	// from being redacted out of every log line
+	minRedactedLength = 6
+)
+
+// isSecretRef reports whether a config value refers to a secret rather than
+// holding it.
+func isSecretRef(v string) bool {
+	for _, scheme := range []string{"env://", "file://", "exec://"} {
+		if strings.HasPrefix(v, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSecret returns the secret a config value names:
+//
+//	env://OPENAI_KEY              the environment variable
+//	file:///run/secrets/openai    the file's content, without trailing newlines
+//	exec://./get-secret openai    the command's output; needs ALLOW_EXEC_SECRETS=true
+//
+// Any other value is a literal secret and returned as is. Resolved values
+// are redacted from the log from then on.
+func resolveSecret(v string) (string, error) {
+	var secret string
+	switch {
+	case strings.HasPrefix(v, "env://"):
+		name := strings.TrimPrefix(v, "env://")
+		var ok bool
+		if secret, ok = os.LookupEnv(name); !ok {
+			return "", fmt.Errorf("secret %s: environment variable %s is not set", v, name)
+		}
+	case strings.HasPrefix(v, "file://"):
+		data, err := os.ReadFile(strings.TrimPrefix(v, "file://"))
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %w", v, err)
+		}
+		secret = strings.TrimRight(string(data), "\r\n")
+	case strings.HasPrefix(v, "exec://"):
+		if os.Getenv("ALLOW_EXEC_SECRETS") != "true" {
+			return "", fmt.Errorf("secret %s: exec:// secrets are disabled; set ALLOW_EXEC_SECRETS=true", v)
+		}
+		args := strings.Fields(strings.TrimPrefix(v, "exec://"))
+		if len(args) == 0 {
+			return "", fmt.Errorf("secret %s: no command", v)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), secretExecTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %w", v, err)
+		}
+		secret = strings.TrimRight(string(out), "\r\n")
+	default:
+		secret = v
+	}
+	if secret == "" {
+		return "", fmt.Errorf("secret %s is empty", describeSecret(v))
+	}
+	redactor.add(secret)
+	return secret, nil
+}
+
+// describeSecret shows a secret config value safely: references as written,
+// literal secrets redacted.
+func describeSecret(v string) string {
+	if v == "" || isSecretRef(v) {
+		return v
+	}
+	return redactedSecret
+}
+
+// resolveSecrets replaces the backend's secret references with their
+// values, keeping the references for display.
+func (b *Backend) resolveSecrets() error {
+	if b.APIKey == "" {
+		return nil
+	}
+	b.apiKeyRef = b.APIKey
+	key, err := resolveSecret(b.APIKey)
+	if err != nil {
+		return fmt.Errorf("api_key: %w", err)
+	}
+	b.APIKey = key
+	return nil
+}
+
+// redactor holds every secret resolved so far. Secrets rotated away stay
+// on the list; they are still secrets.
+var redactor = &secretRedactor{}
+
+type secretRedactor struct {
+	mu       sync.RWMutex
+	secrets  map[string]bool
+	replacer *strings.Replacer
+}
+
+func (r *secretRedactor) add(secret string) {
+	if len(secret) < minRedactedLength {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.secrets[secret] {
+		return
+	}
+	if r.secrets == nil {
+		r.secrets = make(map[string]bool)
+	}
+	r.secrets[secret] = true
+	pairs := make([]string, 0, 2*len(r.secrets))
+	for s := range r.secrets {
+		pairs = append(pairs, s, redactedSecret)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+// redact replaces every known secret in b.
+func (r *secretRedactor) redact(b []byte) []byte {
+	r.mu.RLock()
+	replacer := r.replacer
+	r.mu.RUnlock()
+	if replacer == nil {
+		return b
+	}
+	return []byte(replacer.Replace(string(b)))
+}
+
+func (r *secretRedactor) redactString(s string) string {
+	return string(r.redact([]byte(s)))
+}
+
+// redactingWriter scrubs resolved secrets from everything written to w,
+// such as the log.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (rw redactingWriter) Write(p []byte) (int, error) {
+	if _, err := rw.w.Write(redactor.redact(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "openai")
+	os.WriteFile(file, []byte("sk-from-file-1234\r\n"), 0o600)
+	empty := filepath.Join(dir, "empty")
+	os.WriteFile(empty, []byte("\n"), 0o600)
+	t.Setenv("TEST_SECRET_KEY", "sk-from-env-1234")
+	t.Setenv("TEST_SECRET_EMPTY", "")
+
+	tests := []struct {
+		ref, want string
+		err       bool
+	}{
+		{"sk-literal-1234", "sk-literal-1234", false},
+		{"env://TEST_SECRET_KEY", "sk-from-env-1234", false},
+		{"env://TEST_SECRET_UNSET", "", true},
+		{"env://TEST_SECRET_EMPTY", "", true},
+		{"file://" + file, "sk-from-file-1234", false},
+		{"file://" + filepath.Join(dir, "missing"), "", true},
+		{"file://" + empty, "", true},
+		{"exec://echo sk-from-exec-1234", "", true},
+	}
+	for _, tt := range tests {
+		got, err := resolveSecret(tt.ref)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("resolveSecret(%q) = %q, %v; want %q", tt.ref, got, err, tt.want)
+		}
+	}
+}
+
+func TestResolveExecSecret(t *testing.T) {
+	t.Setenv("ALLOW_EXEC_SECRETS", "true")
+	if got, err := resolveSecret("exec://echo sk-from-exec-1234"); err != nil || got != "sk-from-exec-1234" {
+		t.Errorf("exec secret = %q, %v", got, err)
+	}
+	for _, ref := range []string{"exec://", "exec://false"} {
+		if _, err := resolveSecret(ref); err == nil {
+			t.Errorf("resolveSecret(%q) succeeded", ref)
+		}
+	}
+}
+
+func TestSecretErrorsDontLeakLiterals(t *testing.T) {
+	// A literal that resolves to nothing usable is described, not quoted
+	if _, err := resolveSecret(""); err == nil || err.Error() != "secret  is empty" {
+		t.Errorf("empty literal: %v", err)
+	}
+	if got := describeSecret("sk-literal-5678"); got != redactedSecret {
+		t.Errorf("describeSecret(literal) = %q", got)
+	}
+	for _, ref := range []string{"", "env://OPENAI_KEY", "file:///run/secrets/openai", "exec://./get-secret openai"} {
+		if got := describeSecret(ref); got != ref {
+			t.Errorf("describeSecret(%q) = %q", ref, got)
+		}
+	}
+}
+
+func TestSecretRedactor(t *testing.T) {
+	var r secretRedactor
+	if got := r.redactString("nothing known yet"); got != "nothing known yet" {
+		t.Errorf("empty redactor changed %q", got)
+	}
+	r.add("hunter2-secret")
+	r.add("short")
+	r.add("hunter2-secret")
+	if got := r.redactString("key hunter2-secret, short word"); got != "key [redacted], short word" {
+		t.Errorf("redacted = %q", got)
+	}
+	// Rotated secrets stay redacted
+	r.add("hunter3-secret")
+	if got := r.redactString("hunter2-secret hunter3-secret"); got != "[redacted] [redacted]" {
+		t.Errorf("redacted = %q", got)
+	}
+}
+
+func TestRedactingLogWriter(t *testing.T) {
+	var buf bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(redactingWriter{&buf})
+	t.Cleanup(func() { log.SetOutput(prev) })
+
+	t.Setenv("TEST_SECRET_KEY", "sk-logged-abcdef")
+	if _, err := resolveSecret("env://TEST_SECRET_KEY"); err != nil {
+		t.Fatal(err)
+	}
+	log.Printf("Backend rejected key sk-logged-abcdef")
+	if strings.Contains(buf.String(), "sk-logged-abcdef") || !strings.Contains(buf.String(), "rejected key [redacted]") {
+		t.Errorf("log = %q", buf.String())
+	}
+}
+
+// writeSecretCatalog writes a catalog with one backend per api_key and
+// makes it MODEL_CATALOG.
+func writeSecretCatalog(t *testing.T, keys map[string]string) {
+	t.Helper()
+	backends := map[string]any{}
+	models := []any{}
+	for name, key := range keys {
+		backends[name] = map[string]any{"type": "openai", "url": "http://" + name + ":8000", "api_key": key}
+		models = append(models, map[string]any{"id": name + "-model", "backend": name})
+	}
+	data, _ := json.Marshal(map[string]any{"backends": backends, "models": models})
+	path := filepath.Join(t.TempDir(), "catalog.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MODEL_CATALOG", path)
+}
+
+// dumpRoutes returns /admin/routes for the chat completions route.
+func dumpRoutes(t *testing.T) string {
+	t.Helper()
+	rt := newRouter()
+	rt.handle("POST /v1/chat/completions", chatCompletionsHandler)
+	w := httptest.NewRecorder()
+	routesAdminHandler(rt, nil, &concurrencyLimiter{})(w, httptest.NewRequest(http.MethodGet, "/admin/routes", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	return w.Body.String()
+}
+
+func TestRoutesDumpNeverShowsSecrets(t *testing.T) {
+	captureLog(t)
+	useCatalog(t)
+	secretFile := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(secretFile, []byte("sk-dump-file-0001\n"), 0o600)
+	t.Setenv("TEST_DUMP_KEY", "sk-dump-env-0001")
+	writeSecretCatalog(t, map[string]string{
+		"from-env":  "env://TEST_DUMP_KEY",
+		"from-file": "file://" + secretFile,
+		"literal":   "sk-dump-literal-0001",
+	})
+	if err := reloadSecretCatalog(t); err != nil {
+		t.Fatal(err)
+	}
+	c := catalog.Load()
+	if c.backends["from-env"].APIKey != "sk-dump-env-0001" || c.backends["from-file"].APIKey != "sk-dump-file-0001" {
+		t.Fatalf("keys resolved to %q and %q", c.backends["from-env"].APIKey, c.backends["from-file"].APIKey)
+	}
+
+	dump := dumpRoutes(t)
+	for _, secret := range []string{"sk-dump-env-0001", "sk-dump-file-0001", "sk-dump-literal-0001"} {
+		if strings.Contains(dump, secret) {
+			t.Errorf("/admin/routes shows %s", secret)
+		}
+	}
+	var routes struct {
+		Routes []struct {
+			Backends []routeBackendInfo `json:"backends"`
+		} `json:"routes"`
+	}
+	json.Unmarshal([]byte(dump), &routes)
+	want := map[string]string{"from-env": "env://TEST_DUMP_KEY", "from-file": "file://" + secretFile, "literal": redactedSecret}
+	seen := map[string]bool{}
+	for _, r := range routes.Routes {
+		for _, b := range r.Backends {
+			if b.APIKey != want[b.Name] {
+				t.Errorf("backend %s api_key = %q, want %q", b.Name, b.APIKey, want[b.Name])
+			}
+			seen[b.Name] = true
+		}
+	}
+	for name := range want {
+		if !seen[name] {
+			t.Errorf("dump doesn't list backend %s", name)
+		}
+	}
+}
+
+// reloadSecretCatalog loads MODEL_CATALOG the way a SIGHUP does, keeping
+// the active catalog when the load fails.
+func reloadSecretCatalog(t *testing.T) error {
+	t.Helper()
+	c, err := loadCatalog()
+	if err == nil {
+		catalog.Store(c)
+	}
+	return err
+}
+
+func TestSIGHUPReresolvesSecrets(t *testing.T) {
+	captureLog(t)
+	useCatalog(t)
+	secretFile := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(secretFile, []byte("sk-rotate-before-01\n"), 0o600)
+	writeSecretCatalog(t, map[string]string{"rotating": "file://" + secretFile})
+	if err := reloadSecretCatalog(t); err != nil {
+		t.Fatal(err)
+	}
+	if got := catalog.Load().backends["rotating"].APIKey; got != "sk-rotate-before-01" {
+		t.Fatalf("key = %q", got)
+	}
+
+	// A rotated file takes effect on reload
+	os.WriteFile(secretFile, []byte("sk-rotate-after-02\n"), 0o600)
+	if err := reloadSecretCatalog(t); err != nil {
+		t.Fatal(err)
+	}
+	if got := catalog.Load().backends["rotating"].APIKey; got != "sk-rotate-after-02" {
+		t.Errorf("key after rotation = %q", got)
+	}
+	if got := redactor.redactString("sk-rotate-before-01 sk-rotate-after-02"); got != "[redacted] [redacted]" {
+		t.Errorf("old and new keys redact to %q", got)
+	}
+
+	// A reference that no longer resolves keeps the previous catalog
+	os.Remove(secretFile)
+	if err := reloadSecretCatalog(t); err == nil || !strings.Contains(err.Error(), `backend "rotating": api_key: secret file://`) {
+		t.Errorf("reload with the secret file gone: %v", err)
+	}
+	if got := catalog.Load().backends["rotating"].APIKey; got != "sk-rotate-after-02" {
+		t.Errorf("key after a failed reload = %q, want the previous one", got)
+	}
+	if dump := dumpRoutes(t); strings.Contains(dump, "sk-rotate") {
+		t.Errorf("/admin/routes shows a resolved key")
+	}
+}
+
+func TestBackendErrorEchoingKeyIsRedacted(t *testing.T) {
+	captureLog(t)
+	t.Setenv("TEST_ECHO_KEY", "sk-echoed-back-0001")
+	key, err := resolveSecret("env://TEST_ECHO_KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	writeBackendError(w, &backendStatusError{StatusCode: 401, Header: http.Header{},
+		Body: `{"error":{"message":"Incorrect API key provided: ` + key + `","code":"invalid_api_key"}}`}, &Backend{Name: "b", Type: "openai"})
+	if strings.Contains(w.Body.String(), key) || !strings.Contains(w.Body.String(), "Incorrect API key provided: [redacted]") {
+		t.Errorf("response = %s", w.Body)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	defaultSelfTestRetry = 15 * time.Second
+	selfTestTimeout      = 10 * time.Second
+)
+
+// What happens while a backend is failing its self-test.
+const (
+	selfTestWarn      = "warn"      // log it and keep routing to the backend
+	selfTestUnhealthy = "unhealthy" // answer its requests with 503
+	selfTestNotReady  = "not_ready" // /readyz fails until it passes
+)
+
+// selfTests is nil unless SELF_TEST is set or a backend has self_test.
+var selfTests *selfTester
+
+// SelfTest checks a backend when the gateway starts, so a stale or
+// decommissioned URL shows up at deploy time rather than in user reports.
+type SelfTest struct {
+	// OnFailure is warn, unhealthy or not_ready; it defaults to SELF_TEST,
+	// or warn
+	OnFailure string `json:"on_failure,omitempty"`
+	// Model, when set, is sent a one-token completion once the health probe
+	// passes; pick the backend's cheapest model
+	Model string `json:"model,omitempty"`
+}
+
+func validSelfTestAction(a string) bool {
+	return a == selfTestWarn || a == selfTestUnhealthy || a == selfTestNotReady
+}
+
+// validate checks the config once the catalog entry is parsed.
+func (t *SelfTest) validate() error {
+	if t.OnFailure != "" && !validSelfTestAction(t.OnFailure) {
+		return fmt.Errorf("unknown self_test on_failure %q: want warn, unhealthy or not_ready", t.OnFailure)
+	}
+	return nil
+}
+
+// selfTestResult is a backend's latest self-test outcome.
+type selfTestResult struct {
+	// Status is pending, passed or failed
+	Status     string `json:"status"`
+	OnFailure  string `json:"on_failure"`
+	Probe      string `json:"probe,omitempty"`
+	Completion string `json:"completion,omitempty"`
+	Error      string `json:"error,omitempty"`
+	CheckedAt  string `json:"checked_at,omitempty"`
+}
+
+// selfTester runs the startup self-test and retries failed backends every
+// SELF_TEST_RETRY_INTERVAL until they pass. Passed backends aren't tested
+// again.
+type selfTester struct {
+	action string
+	retry  time.Duration
+
+	mu      sync.Mutex
+	results map[string]*selfTestResult
+}
+
+// loadSelfTest reads SELF_TEST, the action for backends without their own
+// self_test config. It returns nil when no backend is to be tested.
+func loadSelfTest(c *modelCatalog) (*selfTester, error) {
+	action := os.Getenv("SELF_TEST")
+	if action != "" && !validSelfTestAction(action) {
+		return nil, fmt.Errorf("invalid SELF_TEST %q: want warn, unhealthy or not_ready", action)
+	}
+	t := &selfTester{action: action, retry: envDuration("SELF_TEST_RETRY_INTERVAL", defaultSelfTestRetry), results: make(map[string]*selfTestResult)}
+	for name, b := range c.backends {
+		if b.SelfTest == nil && action == "" {
+			continue
+		}
+		t.results[name] = &selfTestResult{Status: "pending", OnFailure: t.onFailure(b)}
+	}
+	if len(t.results) == 0 {
+		return nil, nil
+	}
+	return t, nil
+}
+
+func (t *selfTester) onFailure(b *Backend) string {
+	switch {
+	case b.SelfTest != nil && b.SelfTest.OnFailure != "":
+		return b.SelfTest.OnFailure
+	case t.action != "":
+		return t.action
+	}
+	return selfTestWarn
+}
+
+// start tests every backend in the background, logs a summary table, and
+// keeps retrying the ones that failed.
+func (t *selfTester) start(c *modelCatalog) {
+	if t == nil {
+		return
+	}
+	go func() {
+		var wg sync.WaitGroup
+		for name := range t.results {
+			b := c.backends[name]
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t.test(b)
+			}()
+		}
+		wg.Wait()
+		t.logSummary()
+
+		for name, res := range t.snapshot() {
+			if res.Status == "failed" {
+				go t.retryUntilPassed(name)
+			}
+		}
+	}()
+}
+
+// test probes b and, if configured, sends it a tiny completion.
+func (t *selfTester) test(b *Backend) bool {
+	res := selfTestResult{Status: "passed", OnFailure: t.onFailure(b), CheckedAt: time.Now().UTC().Format(time.RFC3339)}
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+
+	var probes []string
+	var err error
+	for _, ep := range b.endpoints() {
+		var d time.Duration
+		if d, err = probeEndpoint(ctx, b, ep); err != nil {
+			err = fmt.Errorf("%s: %w", ep, err)
+			break
+		}
+		probes = append(probes, "ok "+d.Round(time.Millisecond).String())
+	}
+	res.Probe = strings.Join(probes, ", ")
+	if err == nil && b.SelfTest != nil && b.SelfTest.Model != "" {
+		var d time.Duration
+		if d, err = selfTestCompletion(ctx, b, b.SelfTest.Model); err == nil {
+			res.Completion = "ok " + d.Round(time.Millisecond).String()
+		}
+	}
+	if err != nil {
+		res.Status = "failed"
+		res.Error = err.Error()
+		if res.Probe == "" {
+			res.Probe = "failed"
+		} else if b.SelfTest != nil && b.SelfTest.Model != "" {
+			res.Completion = "failed"
+		}
+	}
+
+	t.mu.Lock()
+	t.results[b.Name] = &res
+	t.mu.Unlock()
+	return err == nil
+}
+
+// retryUntilPassed retests a failed backend with its latest catalog
+// config, so a reload that fixes its URL takes effect.
+func (t *selfTester) retryUntilPassed(name string) {
+	for {
+		time.Sleep(t.retry)
+		b, ok := catalog.Load().backends[name]
+		if !ok {
+			return
+		}
+		if t.test(b) {
+			log.Printf("Backend %q passed its self-test", name)
+			return
+		}
+	}
+}
+
+// probeEndpoint checks one endpoint's health: /health for vllm and tgi,
+// /v1/models for openai, or the backend's paths.health, each of which must
+// answer 200. Other types have no unauthenticated health route, so any
+// answer below 500 from the base URL shows the endpoint is reachable.
+func probeEndpoint(ctx context.Context, b *Backend, endpoint string) (time.Duration, error) {
+	path := b.healthPath()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, backendURL(endpoint, path), nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	resp, err := poolFor(b).client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if (path != "" && resp.StatusCode != http.StatusOK) || resp.StatusCode >= http.StatusInternalServerError {
+		return 0, fmt.Errorf("GET %s returned status %d", req.URL.Path, resp.StatusCode)
+	}
+	return time.Since(start), nil
+}
+
+// selfTestCompletion sends model a one-token completion through b.
+func selfTestCompletion(ctx context.Context, b *Backend, model string) (time.Duration, error) {
+	// Self-test requests get a record of their own, never logged
+	ctx = context.WithValue(ctx, requestRecordKey{}, &requestRecord{})
+	maxTokens := 1
+	req := ChatCompletionRequest{
+		Model:     catalog.Load().upstreamModel(model),
+		Messages:  []Message{{Role: "user", Content: "ping"}},
+		MaxTokens: &maxTokens,
+	}
+	start := time.Now()
+	if _, err := forwardToBackend(ctx, b, req, "selftest-"+b.Name); err != nil {
+		return 0, fmt.Errorf("completion with model %q: %w", model, err)
+	}
+	return time.Since(start), nil
+}
+
+func (t *selfTester) snapshot() map[string]selfTestResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string]selfTestResult, len(t.results))
+	for name, res := range t.results {
+		out[name] = *res
+	}
+	return out
+}
+
+// logSummary logs the startup results as a table, one row per backend.
+func (t *selfTester) logSummary() {
+	results := t.snapshot()
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "BACKEND\tSTATUS\tPROBE\tCOMPLETION\tON FAILURE\tERROR")
+	failed := 0
+	for _, name := range names {
+		res := results[name]
+		if res.Status == "failed" {
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", name, res.Status, dashIfEmpty(res.Probe), dashIfEmpty(res.Completion), res.OnFailure, dashIfEmpty(res.Error))
+	}
+	tw.Flush()
+
+	log.Printf("Startup self-test: %d of %d backends passed", len(names)-failed, len(names))
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		log.Printf("  %s", line)
+	}
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// healthy reports whether requests may go to backend: false only while it
+// is failing a self-test whose on_failure is unhealthy.
+func (t *selfTester) healthy(backend *Backend) bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.results[backend.Name].healthy()
+}
+
+// healthy reports whether a backend with result r takes requests; one
+// without a result always does.
+func (r *selfTestResult) healthy() bool {
+	return r == nil || r.Status != "failed" || r.OnFailure != selfTestUnhealthy
+}
+
+// unready lists the backends in c, sorted, holding up readiness: those
+// with on_failure not_ready that haven't passed yet.
+func (t *selfTester) unready(c *modelCatalog) []string {
+	var names []string
+	for name, res := range t.snapshot() {
+		if _, ok := c.backends[name]; ok && res.OnFailure == selfTestNotReady && res.Status != "passed" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readyzHandler implements GET /readyz: 200 once the gateway is ready for
+// traffic, 503 while a not_ready backend hasn't passed its self-test. The
+// body carries each backend's self-test result.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	body := map[string]any{"status": "ready"}
+	status := http.StatusOK
+	if selfTests != nil {
+		c := catalog.Load()
+		results := selfTests.snapshot()
+		// /readyz is unauthenticated: failures mustn't map the network
+		for name, res := range results {
+			res.Error = scrubTopology(res.Error, c.backends[name])
+			results[name] = res
+		}
+		body["self_test"] = results
+		if waiting := selfTests.unready(c); len(waiting) > 0 {
+			status = http.StatusServiceUnavailable
+			body["status"] = "not_ready"
+			body["error"] = "Backends have not passed their self-test: " + strings.Join(waiting, ", ")
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
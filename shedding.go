@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultShedMetric       = "vllm:num_requests_waiting"
+	defaultShedPollInterval = 2 * time.Second
+	defaultShedRetryAfter   = time.Second
+	defaultShedMaxRate      = 0.9
+)
+
+// shedRequests counts requests rejected by load shedding, by backend.
+var shedRequests = expvar.NewMap("gateway_shed_requests_total")
+
+// Shedding rejects part of a backend's traffic while it is overloaded, since
+// queueing more requests on a saturated backend only slows every request:
+//
+//	"shedding": {"signal": "queue", "threshold": 16, "saturation": 64,
+//	             "exempt_priorities": ["interactive"]}
+//
+// Below Threshold nothing is shed. Above it the shed rate ramps linearly,
+// reaching MaxRate at Saturation.
+type Shedding struct {
+	// Signal measures overload: queue (default) polls MetricsURL for Metric,
+	// inflight counts the gateway's own open requests to the backend, and
+	// latency is an EWMA of backend response times in milliseconds
+	Signal     string `json:"signal,omitempty"`
+	MetricsURL string `json:"metrics_url,omitempty"`
+	Metric     string `json:"metric,omitempty"`
+	// PollInterval is how often the signal is sampled (default 2s)
+	PollInterval string  `json:"poll_interval,omitempty"`
+	Threshold    float64 `json:"threshold"`
+	// Saturation defaults to twice Threshold
+	Saturation float64 `json:"saturation,omitempty"`
+	// MaxRate is the largest fraction of traffic shed (default 0.9). Some
+	// traffic always gets through, so the signal can show recovery
+	MaxRate float64 `json:"max_rate,omitempty"`
+	// ExemptPriorities are X-Priority-Class values never shed; requests
+	// without a class can be
+	ExemptPriorities []string `json:"exempt_priorities,omitempty"`
+	// RetryAfter is sent with shed requests' 429 (default 1s)
+	RetryAfter string `json:"retry_after,omitempty"`
+
+	pollInterval time.Duration
+	retryAfter   time.Duration
+}
+
+// validate fills in defaults once the catalog entry is parsed. MetricsURL
+// defaults to /metrics under base, the backend's URL.
+func (s *Shedding) validate(base string) error {
+	switch s.Signal {
+	case "":
+		s.Signal = "queue"
+	case "queue", "inflight", "latency":
+	default:
+		return fmt.Errorf("unknown shedding signal %q: want queue, inflight or latency", s.Signal)
+	}
+	if s.Signal == "queue" {
+		if s.MetricsURL == "" {
+			s.MetricsURL = backendURL(base, "/metrics")
+		}
+		if s.Metric == "" {
+			s.Metric = defaultShedMetric
+		}
+	}
+	if s.Threshold <= 0 {
+		return errors.New("shedding threshold must be positive")
+	}
+	if s.Saturation == 0 {
+		s.Saturation = 2 * s.Threshold
+	}
+	if s.Saturation <= s.Threshold {
+		return errors.New("shedding saturation must be above threshold")
+	}
+	if s.MaxRate == 0 {
+		s.MaxRate = defaultShedMaxRate
+	}
+	if s.MaxRate < 0 || s.MaxRate > 1 {
+		return errors.New("shedding max_rate must be between 0 and 1")
+	}
+	var err error
+	if s.pollInterval, err = positiveDuration(s.PollInterval, defaultShedPollInterval); err != nil {
+		return fmt.Errorf("invalid shedding poll_interval: %w", err)
+	}
+	if s.retryAfter, err = positiveDuration(s.RetryAfter, defaultShedRetryAfter); err != nil {
+		return fmt.Errorf("invalid shedding retry_after: %w", err)
+	}
+	return nil
+}
+
+func positiveDuration(v string, def time.Duration) (time.Duration, error) {
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("%q is not positive", v)
+	}
+	return d, err
+}
+
+// rate maps a signal sample to the fraction of traffic to shed.
+func (s *Shedding) rate(signal float64) float64 {
+	if signal <= s.Threshold {
+		return 0
+	}
+	return s.MaxRate * min((signal-s.Threshold)/(s.Saturation-s.Threshold), 1)
+}
+
+// shedder samples one backend's overload signal and holds its shed rate.
+type shedder struct {
+	backend *Backend
+	cfg     *Shedding
+	rate    atomic.Uint64 // math.Float64bits of the shed rate
+	stop    chan struct{}
+}
+
+// shedders runs a shedder per backend with shedding configured, by name.
+var shedders = struct {
+	sync.Mutex
+	byName map[string]*shedder
+}{byName: make(map[string]*shedder)}
+
+func init() {
+	expvar.Publish("gateway_shed_rate", expvar.Func(func() any {
+		shedders.Lock()
+		defer shedders.Unlock()
+		rates := make(map[string]float64, len(shedders.byName))
+		for name, s := range shedders.byName {
+			rates[name] = s.currentRate()
+		}
+		return rates
+	}))
+}
+
+// shedCatalog restarts the shedders for c's backends. Called whenever the
+// catalog is loaded, so reloaded thresholds apply at once.
+func shedCatalog(c *modelCatalog) {
+	shedders.Lock()
+	defer shedders.Unlock()
+	for name, s := range shedders.byName {
+		close(s.stop)
+		delete(shedders.byName, name)
+	}
+	for name, b := range c.backends {
+		if b.Shedding == nil {
+			continue
+		}
+		s := &shedder{backend: b, cfg: b.Shedding, stop: make(chan struct{})}
+		shedders.byName[name] = s
+		go s.run()
+	}
+}
+
+func (s *shedder) currentRate() float64 {
+	return math.Float64frombits(s.rate.Load())
+}
+
+func (s *shedder) run() {
+	ticker := time.NewTicker(s.cfg.pollInterval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		signal, err := s.sample()
+		if err != nil {
+			// Fail open: an unreadable signal never sheds traffic
+			if !failing {
+				log.Printf("Shedding signal for backend %s unavailable: %v", s.backend.Name, err)
+			}
+			failing = true
+			signal = 0
+		} else if failing {
+			log.Printf("Shedding signal for backend %s recovered", s.backend.Name)
+			failing = false
+		}
+		rate := s.cfg.rate(signal)
+		if prev := s.currentRate(); (prev == 0) != (rate == 0) {
+			log.Printf("Backend %s %s signal at %.1f: shedding %.0f%% of sheddable traffic", s.backend.Name, s.cfg.Signal, signal, rate*100)
+		}
+		s.rate.Store(math.Float64bits(rate))
+
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *shedder) sample() (float64, error) {
+	switch s.cfg.Signal {
+	case "inflight":
+		if st := poolStatsFor(s.backend.Name); st != nil {
+			return float64(st.InUse), nil
+		}
+		return 0, nil
+	case "latency":
+		return poolFor(s.backend).latencyEWMA().Seconds() * 1000, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.pollInterval)
+	defer cancel()
+	return scrapeMetric(ctx, s.cfg.MetricsURL, s.cfg.Metric)
+}
+
+// scrapeMetric sums every series of a metric in Prometheus text format,
+// such as vllm:num_requests_waiting across a server's models.
+func scrapeMetric(ctx context.Context, url, metric string) (float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+
+	var sum float64
+	found := false
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		rest, ok := strings.CutPrefix(scanner.Text(), metric)
+		if !ok || (rest != "" && rest[0] != '{' && rest[0] != ' ') {
+			continue
+		}
+		if i := strings.LastIndexByte(rest, '}'); i >= 0 {
+			rest = rest[i+1:]
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		if v, err := strconv.ParseFloat(fields[0], 64); err == nil {
+			sum += v
+			found = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("metric %s not found at %s", metric, url)
+	}
+	return sum, nil
+}
+
+// shouldShed picks whether to reject a request for backend, which is not
+// exempt by its priority class, at the backend's current shed rate. It
+// returns the Retry-After to send.
+func shouldShed(backend *Backend, priorityClass string) (time.Duration, bool) {
+	shedders.Lock()
+	s, ok := shedders.byName[backend.Name]
+	shedders.Unlock()
+	if !ok || slices.Contains(s.cfg.ExemptPriorities, priorityClass) {
+		return 0, false
+	}
+	rate := s.currentRate()
+	if rate == 0 || rand.Float64() >= rate {
+		return 0, false
+	}
+	return s.cfg.retryAfter, true
+}
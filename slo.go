@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSLOPercentile = 95
+	defaultSLOWindow     = time.Hour
+	defaultSLOAlertBurn  = 1
+)
+
+// slos is nil unless SLO_CONFIG is set.
+var slos *sloTracker
+
+// SLO is a route's objective, as configured in SLO_CONFIG:
+//
+//	{"POST /v1/chat/completions": {"latency_target": "3s", "latency_percentile": 95,
+//	                               "availability_target": 99.5, "window": "1h"}}
+type SLO struct {
+	// LatencyTarget is the time to response headers that LatencyPercentile
+	// percent of requests must beat (default 95); streams are measured to
+	// their first byte
+	LatencyTarget     string  `json:"latency_target,omitempty"`
+	LatencyPercentile float64 `json:"latency_percentile,omitempty"`
+	// AvailabilityTarget is the percentage of requests that must not fail
+	// with a 5xx status
+	AvailabilityTarget float64 `json:"availability_target,omitempty"`
+	// Window is the rolling compliance window, in whole minutes (default 1h)
+	Window string `json:"window,omitempty"`
+	// AlertBurnRate sets burn_alert once either budget burns at least this
+	// fast; 1 spends exactly the budget over the window (default 1)
+	AlertBurnRate float64 `json:"alert_burn_rate,omitempty"`
+
+	latencyTarget time.Duration
+	window        time.Duration
+}
+
+func (s *SLO) validate() error {
+	if s.LatencyTarget != "" {
+		d, err := time.ParseDuration(s.LatencyTarget)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid latency_target %q", s.LatencyTarget)
+		}
+		s.latencyTarget = d
+		if s.LatencyPercentile == 0 {
+			s.LatencyPercentile = defaultSLOPercentile
+		}
+		if s.LatencyPercentile <= 0 || s.LatencyPercentile >= 100 {
+			return fmt.Errorf("latency_percentile must be between 0 and 100")
+		}
+	}
+	if s.AvailabilityTarget < 0 || s.AvailabilityTarget >= 100 {
+		return fmt.Errorf("availability_target must be between 0 and 100")
+	}
+	if s.latencyTarget == 0 && s.AvailabilityTarget == 0 {
+		return errors.New("needs a latency_target or an availability_target")
+	}
+	s.window = defaultSLOWindow
+	if s.Window != "" {
+		d, err := time.ParseDuration(s.Window)
+		if err != nil || d < time.Minute {
+			return fmt.Errorf("invalid window %q: want at least 1m", s.Window)
+		}
+		s.window = d.Truncate(time.Minute)
+	}
+	if s.AlertBurnRate == 0 {
+		s.AlertBurnRate = defaultSLOAlertBurn
+	}
+	return nil
+}
+
+// sloBucket counts one minute of a route's requests.
+type sloBucket struct {
+	minute int64
+	total  int64
+	errors int64
+	slow   int64
+}
+
+// sloRoute keeps a ring of per-minute buckets spanning the window.
+type sloRoute struct {
+	slo     *SLO
+	mu      sync.Mutex
+	buckets []sloBucket
+}
+
+// sloTracker computes rolling SLO compliance from the access log's view of
+// each request.
+type sloTracker struct {
+	routes map[string]*sloRoute
+	now    func() time.Time
+}
+
+// loadSLOs reads the per-route objectives in the JSON file named by
+// SLO_CONFIG. It returns nil when SLOs are not configured.
+func loadSLOs() (*sloTracker, error) {
+	path := os.Getenv("SLO_CONFIG")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string]*SLO
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	t := &sloTracker{routes: make(map[string]*sloRoute), now: time.Now}
+	for route, s := range file {
+		if err := s.validate(); err != nil {
+			return nil, fmt.Errorf("SLO for %q: %w", route, err)
+		}
+		t.routes[route] = &sloRoute{slo: s, buckets: make([]sloBucket, int(s.window/time.Minute))}
+	}
+	expvar.Publish("gateway_slo", expvar.Func(t.gauges))
+	return t, nil
+}
+
+// checkRoutes fails for SLOs naming routes that aren't registered.
+func (t *sloTracker) checkRoutes(patterns []string) error {
+	if t == nil {
+		return nil
+	}
+	for route := range t.routes {
+		if !slices.Contains(patterns, route) {
+			return fmt.Errorf("SLO for unknown route %q", route)
+		}
+	}
+	return nil
+}
+
+// observe records a finished request against its route's SLO. Server
+// errors count against availability; latency is time to response headers.
+func (t *sloTracker) observe(route string, status int, latency time.Duration) {
+	if t == nil {
+		return
+	}
+	sr, ok := t.routes[route]
+	if !ok {
+		return
+	}
+	minute := t.now().Unix() / 60
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	b := &sr.buckets[minute%int64(len(sr.buckets))]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	if status >= http.StatusInternalServerError {
+		b.errors++
+	}
+	if sr.slo.latencyTarget > 0 && latency > sr.slo.latencyTarget {
+		b.slow++
+	}
+}
+
+// sloStatus is a route's compliance over its window. Rates are fractions;
+// a burn rate of 1 spends the error budget exactly over the window.
+type sloStatus struct {
+	Route     string `json:"route"`
+	SLO       *SLO   `json:"slo"`
+	Requests  int64  `json:"requests"`
+	Errors    int64  `json:"errors"`
+	SlowCount int64  `json:"slow"`
+
+	Availability      *float64 `json:"availability,omitempty"`
+	AvailabilityBurn  *float64 `json:"error_budget_burn_rate,omitempty"`
+	LatencyCompliance *float64 `json:"latency_compliance,omitempty"`
+	LatencyBurn       *float64 `json:"latency_budget_burn_rate,omitempty"`
+	Compliant         bool     `json:"compliant"`
+	BurnAlert         bool     `json:"burn_alert"`
+}
+
+func (sr *sloRoute) status(route string, now time.Time) sloStatus {
+	st := sloStatus{Route: route, SLO: sr.slo, Compliant: true}
+	oldest := now.Unix()/60 - int64(len(sr.buckets)) + 1
+	sr.mu.Lock()
+	for _, b := range sr.buckets {
+		if b.minute >= oldest {
+			st.Requests += b.total
+			st.Errors += b.errors
+			st.SlowCount += b.slow
+		}
+	}
+	sr.mu.Unlock()
+	if st.Requests == 0 {
+		return st
+	}
+
+	// rate returns the share of good requests and how fast the bad ones spend
+	// a budget of 1-target
+	rate := func(bad int64, target float64) (*float64, *float64) {
+		good := 1 - float64(bad)/float64(st.Requests)
+		burn := (1 - good) / (1 - target/100)
+		return &good, &burn
+	}
+	if sr.slo.AvailabilityTarget > 0 {
+		st.Availability, st.AvailabilityBurn = rate(st.Errors, sr.slo.AvailabilityTarget)
+		st.Compliant = *st.Availability*100 >= sr.slo.AvailabilityTarget
+		st.BurnAlert = *st.AvailabilityBurn >= sr.slo.AlertBurnRate
+	}
+	if sr.slo.latencyTarget > 0 {
+		st.LatencyCompliance, st.LatencyBurn = rate(st.SlowCount, sr.slo.LatencyPercentile)
+		st.Compliant = st.Compliant && *st.LatencyCompliance*100 >= sr.slo.LatencyPercentile
+		st.BurnAlert = st.BurnAlert || *st.LatencyBurn >= sr.slo.AlertBurnRate
+	}
+	return st
+}
+
+// summary reports every route's status, sorted by route.
+func (t *sloTracker) summary() []sloStatus {
+	now := t.now()
+	out := make([]sloStatus, 0, len(t.routes))
+	for route, sr := range t.routes {
+		out = append(out, sr.status(route, now))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Route < out[j].Route })
+	return out
+}
+
+// gauges publishes the summary as flat numeric gauges per route.
+func (t *sloTracker) gauges() any {
+	g := make(map[string]map[string]float64, len(t.routes))
+	for _, st := range t.summary() {
+		m := map[string]float64{"requests": float64(st.Requests), "compliant": 0, "burn_alert": 0}
+		if st.Compliant {
+			m["compliant"] = 1
+		}
+		if st.BurnAlert {
+			m["burn_alert"] = 1
+		}
+		for name, v := range map[string]*float64{
+			"availability":             st.Availability,
+			"error_budget_burn_rate":   st.AvailabilityBurn,
+			"latency_compliance":       st.LatencyCompliance,
+			"latency_budget_burn_rate": st.LatencyBurn,
+		} {
+			if v != nil {
+				m[name] = *v
+			}
+		}
+		g[st.Route] = m
+	}
+	return g
+}
+
+// sloSeries are the OpenMetrics gauges a route's status is rendered as.
+var sloSeries = []struct {
+	name, help string
+	value      func(sloStatus) *float64
+}{
+	{"requests", "Requests in the window", func(st sloStatus) *float64 { return ptrTo(float64(st.Requests)) }},
+	{"errors", "Requests in the window that failed with a 5xx status", func(st sloStatus) *float64 { return ptrTo(float64(st.Errors)) }},
+	{"slow", "Requests in the window slower than the latency target", func(st sloStatus) *float64 { return ptrTo(float64(st.SlowCount)) }},
+	{"availability", "Share of requests in the window that didn't fail", func(st sloStatus) *float64 { return st.Availability }},
+	{"error_budget_burn_rate", "How fast failures spend the availability budget; 1 spends it over the window", func(st sloStatus) *float64 { return st.AvailabilityBurn }},
+	{"latency_compliance", "Share of requests in the window within the latency target", func(st sloStatus) *float64 { return st.LatencyCompliance }},
+	{"latency_budget_burn_rate", "How fast slow requests spend the latency budget; 1 spends it over the window", func(st sloStatus) *float64 { return st.LatencyBurn }},
+	{"compliant", "1 while the route meets its objectives", func(st sloStatus) *float64 { return ptrTo(boolGauge(st.Compliant)) }},
+	{"burn_alert", "1 while a budget burns at least as fast as alert_burn_rate", func(st sloStatus) *float64 { return ptrTo(boolGauge(st.BurnAlert)) }},
+	{"availability_target", "Configured availability target, as a share", func(st sloStatus) *float64 {
+		if st.SLO.AvailabilityTarget == 0 {
+			return nil
+		}
+		return ptrTo(st.SLO.AvailabilityTarget / 100)
+	}},
+	{"latency_target_seconds", "Configured latency target", func(st sloStatus) *float64 {
+		if st.SLO.latencyTarget == 0 {
+			return nil
+		}
+		return ptrTo(st.SLO.latencyTarget.Seconds())
+	}},
+}
+
+func ptrTo(v float64) *float64 { return &v }
+
+func boolGauge(v bool) float64 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// writeOpenMetrics writes every route's status as gateway_slo_* gauges
+// labelled by route, in the OpenMetrics text format.
+func (t *sloTracker) writeOpenMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if t != nil {
+		summary := t.summary()
+		for _, m := range sloSeries {
+			fmt.Fprintf(bw, "# TYPE gateway_slo_%s gauge\n# HELP gateway_slo_%s %s\n", m.name, m.name, m.help)
+			for _, st := range summary {
+				if v := m.value(st); v != nil {
+					fmt.Fprintf(bw, "gateway_slo_%s{route=\"%s\"} %s\n", m.name, openMetricsLabelEscaper.Replace(st.Route), strconv.FormatFloat(*v, 'f', -1, 64))
+				}
+			}
+		}
+	}
+	bw.WriteString("# EOF\n")
+	return bw.Flush()
+}
+
+// sloAdminHandler implements GET /admin/slos.
+func sloAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if slos == nil {
+		writeJSONError(w, http.StatusNotFound, "invalid_request_error", "not_found", "No SLOs are configured on this gateway")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": slos.summary()})
+}
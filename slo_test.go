@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSLOTracker(t *testing.T, slo *SLO) (*sloTracker, *time.Time) {
+	t.Helper()
+	if err := slo.validate(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	tr := &sloTracker{
+		routes: map[string]*sloRoute{"POST /v1/chat/completions": {slo: slo, buckets: make([]sloBucket, int(slo.window/time.Minute))}},
+		now:    func() time.Time { return now },
+	}
+	return tr, &now
+}
+
+func TestSLOStatus(t *testing.T) {
+	tr, _ := testSLOTracker(t, &SLO{AvailabilityTarget: 99, LatencyTarget: "1s", LatencyPercentile: 90})
+	for i := range 100 {
+		status, latency := 200, 100*time.Millisecond
+		if i < 2 {
+			status = 503
+		}
+		if i%20 == 0 {
+			latency = 2 * time.Second
+		}
+		tr.observe("POST /v1/chat/completions", status, latency)
+	}
+	tr.observe("GET /v1/models", 500, time.Minute)
+
+	st := tr.summary()[0]
+	if st.Requests != 100 || st.Errors != 2 || st.SlowCount != 5 {
+		t.Fatalf("counts = %d requests, %d errors, %d slow", st.Requests, st.Errors, st.SlowCount)
+	}
+	if *st.Availability != 0.98 || *st.LatencyCompliance != 0.95 {
+		t.Errorf("availability %v, latency compliance %v", *st.Availability, *st.LatencyCompliance)
+	}
+	// 2% errors against a 1% budget burns twice as fast as allowed
+	if burn := *st.AvailabilityBurn; burn < 1.99 || burn > 2.01 || st.Compliant || !st.BurnAlert {
+		t.Errorf("burn %v, compliant %t, alert %t", burn, st.Compliant, st.BurnAlert)
+	}
+}
+
+func TestSLOWindowRolls(t *testing.T) {
+	tr, now := testSLOTracker(t, &SLO{AvailabilityTarget: 99, Window: "5m"})
+	tr.observe("POST /v1/chat/completions", 500, 0)
+	*now = now.Add(4 * time.Minute)
+	tr.observe("POST /v1/chat/completions", 200, 0)
+	if st := tr.summary()[0]; st.Requests != 2 {
+		t.Fatalf("requests = %d, want 2 within the window", st.Requests)
+	}
+	*now = now.Add(2 * time.Minute)
+	if st := tr.summary()[0]; st.Requests != 1 || st.Errors != 0 {
+		t.Errorf("requests, errors = %d, %d; want the old minute gone", st.Requests, st.Errors)
+	}
+}
+
+func TestSLOOpenMetrics(t *testing.T) {
+	tr, _ := testSLOTracker(t, &SLO{AvailabilityTarget: 99.5, LatencyTarget: "3s"})
+	tr.observe("POST /v1/chat/completions", 200, time.Second)
+
+	var buf bytes.Buffer
+	if err := tr.writeOpenMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE gateway_slo_availability gauge\n",
+		`gateway_slo_requests{route="POST /v1/chat/completions"} 1` + "\n",
+		`gateway_slo_availability{route="POST /v1/chat/completions"} 1` + "\n",
+		`gateway_slo_compliant{route="POST /v1/chat/completions"} 1` + "\n",
+		`gateway_slo_availability_target{route="POST /v1/chat/completions"} 0.995` + "\n",
+		`gateway_slo_latency_target_seconds{route="POST /v1/chat/completions"} 3` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Errorf("output doesn't end with # EOF:\n%s", out)
+	}
+
+	buf.Reset()
+	(*sloTracker)(nil).writeOpenMetrics(&buf)
+	if buf.String() != "# EOF\n" {
+		t.Errorf("without SLOs = %q", buf.String())
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gatewayState is the GET /admin/state snapshot: what the admin endpoints
+// report separately, taken at one moment so the numbers agree.
+type gatewayState struct {
+	Object   string         `json:"object"`
+	TakenAt  int64          `json:"taken_at"`
+	Build    BuildInfo      `json:"build"`
+	Config   configState    `json:"config"`
+	Backends []backendState `json:"backends"`
+	Keys     keysState      `json:"keys"`
+	// Cache is null unless RESPONSE_CACHE_TTL is set
+	Cache *cacheState `json:"cache"`
+}
+
+type configState struct {
+	// Generation counts the catalogs loaded since startup: 1 until the
+	// first successful reload
+	Generation int64 `json:"generation"`
+	LoadedAt   int64 `json:"loaded_at"`
+	Models     int   `json:"models"`
+	Backends   int   `json:"backends"`
+	// Generations counts requests by the generation they were admitted
+	// under, newest first: the current and previous generations, and any
+	// older one still draining
+	Generations []generationState `json:"generations"`
+}
+
+type backendState struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Healthy is false while the backend fails a self-test whose
+	// on_failure is unhealthy, which keeps requests off it
+	Healthy  bool            `json:"healthy"`
+	SelfTest *selfTestResult `json:"self_test,omitempty"`
+	// ShedRate is the share of sheddable traffic being rejected, for
+	// backends with shedding
+	ShedRate  *float64        `json:"shed_rate,omitempty"`
+	Pool      *poolStats      `json:"pool,omitempty"`
+	Queue     *queueStatus    `json:"queue,omitempty"`
+	Endpoints []endpointState `json:"endpoints"`
+}
+
+type endpointState struct {
+	URL      string `json:"url"`
+	Region   string `json:"region,omitempty"`
+	InFlight int    `json:"in_flight"`
+	// Share is the fraction of requests the endpoint is picked for, for
+	// backends with balancing
+	Share     *float64 `json:"share,omitempty"`
+	LatencyMS float64  `json:"latency_ms,omitempty"`
+	ErrorRate *float64 `json:"error_rate,omitempty"`
+	// RefusedUntil is when an endpoint that refused a connection may be
+	// picked again
+	RefusedUntil int64 `json:"refused_until,omitempty"`
+}
+
+type keysState struct {
+	// InFlight counts every key's requests, not only the listed ones
+	InFlight int        `json:"in_flight"`
+	Top      []keyState `json:"top"`
+}
+
+type keyState struct {
+	KeyID    string `json:"key_id"`
+	InFlight int    `json:"in_flight"`
+	// Limit is the key's concurrency limit; 0 is unlimited
+	Limit int `json:"limit"`
+	// RateTokens is what is left in the key's rate limit bucket, for keys
+	// with a rate limit
+	RateTokens *float64 `json:"rate_tokens,omitempty"`
+}
+
+type cacheState struct {
+	Entries  int      `json:"entries"`
+	Hits     int64    `json:"hits"`
+	Misses   int64    `json:"misses"`
+	HitRatio *float64 `json:"hit_ratio,omitempty"`
+}
+
+// takeState snapshots the gateway with the topKeys busiest keys. Every lock
+// the numbers live under is held at once, so nothing moves while they are
+// read. Each of those locks is otherwise only ever held alone, so taking
+// them together can't deadlock.
+func takeState(l *concurrencyLimiter, topKeys int) *gatewayState {
+	c := catalog.Load()
+	names := make([]string, 0, len(c.backends))
+	for name := range c.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	queues := make(map[string]*backendQueue)
+	for _, name := range names {
+		if q := queueFor(c.backends[name]); q != nil {
+			queues[name] = q
+		}
+	}
+
+	shedders.Lock()
+	defer shedders.Unlock()
+	for _, name := range names {
+		if q := queues[name]; q != nil {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+		}
+	}
+	endpointBalancer.mu.Lock()
+	defer endpointBalancer.mu.Unlock()
+	generations.mu.Lock()
+	defer generations.mu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rateLimits != nil {
+		rateLimits.mu.Lock()
+		defer rateLimits.mu.Unlock()
+	}
+	if responseCache != nil {
+		responseCache.mu.Lock()
+		defer responseCache.mu.Unlock()
+	}
+	if selfTests != nil {
+		selfTests.mu.Lock()
+		defer selfTests.mu.Unlock()
+	}
+	now := time.Now()
+
+	st := &gatewayState{
+		Object:  "gateway.state",
+		TakenAt: now.Unix(),
+		Build:   buildInfo,
+		Config: configState{Generation: c.generation, LoadedAt: c.loadedAt.Unix(), Models: len(c.models), Backends: len(c.backends),
+			Generations: generations.snapshot(c.generation, false)},
+	}
+	for _, name := range names {
+		b := c.backends[name]
+		bs := backendState{Name: name, Type: b.Type, Healthy: true, Pool: poolStatsFor(name), Endpoints: []endpointState{}}
+		if selfTests != nil {
+			if res := selfTests.results[name]; res != nil {
+				copied := *res
+				bs.SelfTest, bs.Healthy = &copied, res.healthy()
+			}
+		}
+		if s := shedders.byName[name]; s != nil {
+			rate := round3(s.currentRate())
+			bs.ShedRate = &rate
+		}
+		if q := queues[name]; q != nil {
+			bs.Queue = q.status(len(q.waiting) + 1)
+			bs.Queue.Position = 0
+			bs.Queue.Reservations = q.reservations()
+		}
+		eps := b.endpoints()
+		var weights []float64
+		total := 0.0
+		if b.Balancing != nil {
+			weights = effectiveWeights(b, eps)
+			for _, w := range weights {
+				total += w
+			}
+		}
+		for i, ep := range eps {
+			es := endpointState{
+				URL:       ep,
+				Region:    b.EndpointRegions[ep],
+				InFlight:  endpointBalancer.inflight[ep],
+				LatencyMS: float64(endpointBalancer.latency[ep].Microseconds()) / 1000,
+			}
+			if weights != nil {
+				share := round3(weights[i] / total)
+				es.Share = &share
+			}
+			if h := endpointBalancer.health[ep]; h != nil {
+				errRate := round3(h.errors)
+				es.ErrorRate = &errRate
+			}
+			if until := endpointBalancer.refused[ep]; now.Before(until) {
+				es.RefusedUntil = until.Unix()
+			}
+			bs.Endpoints = append(bs.Endpoints, es)
+		}
+		st.Backends = append(st.Backends, bs)
+	}
+
+	// Keys in flight, then keys that have drawn on their rate limit, the
+	// emptiest bucket first
+	st.Keys.Top = []keyState{}
+	for key, n := range l.inflight {
+		st.Keys.InFlight += n
+		st.Keys.Top = append(st.Keys.Top, keyState{KeyID: key, InFlight: n})
+	}
+	if rateLimits != nil {
+		for key := range rateLimits.buckets {
+			if _, ok := l.inflight[key]; !ok {
+				st.Keys.Top = append(st.Keys.Top, keyState{KeyID: key})
+			}
+		}
+		for i, k := range st.Keys.Top {
+			if tokens, ok := rateLimits.level(k.KeyID, now); ok {
+				tokens = round3(tokens)
+				st.Keys.Top[i].RateTokens = &tokens
+			}
+		}
+	}
+	sort.Slice(st.Keys.Top, func(i, j int) bool {
+		a, b := st.Keys.Top[i], st.Keys.Top[j]
+		if a.InFlight != b.InFlight {
+			return a.InFlight > b.InFlight
+		}
+		if at, bt := tokensOrInf(a.RateTokens), tokensOrInf(b.RateTokens); at != bt {
+			return at < bt
+		}
+		return a.KeyID < b.KeyID
+	})
+	if len(st.Keys.Top) > topKeys {
+		st.Keys.Top = st.Keys.Top[:topKeys]
+	}
+	for i := range st.Keys.Top {
+		st.Keys.Top[i].Limit = l.limit(st.Keys.Top[i].KeyID)
+	}
+
+	if responseCache != nil {
+		cs := &cacheState{Entries: len(responseCache.entries), Hits: expvarInt(cacheLookups, "hit"), Misses: expvarInt(cacheLookups, "miss")}
+		if lookups := cs.Hits + cs.Misses; lookups > 0 {
+			ratio := round3(float64(cs.Hits) / float64(lookups))
+			cs.HitRatio = &ratio
+		}
+		st.Cache = cs
+	}
+	return st
+}
+
+func tokensOrInf(tokens *float64) float64 {
+	if tokens == nil {
+		return math.Inf(1)
+	}
+	return *tokens
+}
+
+// expvarInt reads counter key of m, or 0 before it is first added to.
+func expvarInt(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// stateAdminHandler implements GET /admin/state: the snapshot as JSON, or
+// with ?format=prometheus as gauges in the Prometheus text format. ?keys=N
+// lists N keys (default 20).
+func stateAdminHandler(l *concurrencyLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		topKeys := topConcurrencyKeys
+		if v := r.URL.Query().Get("keys"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_parameter", "keys must be a non-negative integer")
+				return
+			}
+			topKeys = n
+		}
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "json" && format != "prometheus" {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_parameter",
+				fmt.Sprintf("Unknown format %q: want json or prometheus", format))
+			return
+		}
+		st := takeState(l, topKeys)
+		if format == "prometheus" {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+			st.writePrometheus(w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	}
+}
+
+// writePrometheus writes the snapshot as gauges named gateway_state_*.
+func (st *gatewayState) writePrometheus(w http.ResponseWriter) {
+	var b strings.Builder
+	gauge := func(name, help string) {
+		fmt.Fprintf(&b, "# HELP gateway_state_%s %s\n# TYPE gateway_state_%s gauge\n", name, help, name)
+	}
+	sample := func(name string, value float64, labels ...string) {
+		b.WriteString("gateway_state_" + name)
+		if len(labels) > 0 {
+			b.WriteByte('{')
+			for i := 0; i < len(labels); i += 2 {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				fmt.Fprintf(&b, `%s="%s"`, labels[i], openMetricsLabelEscaper.Replace(labels[i+1]))
+			}
+			b.WriteByte('}')
+		}
+		b.WriteString(" " + strconv.FormatFloat(value, 'f', -1, 64) + "\n")
+	}
+	boolValue := func(v bool) float64 {
+		if v {
+			return 1
+		}
+		return 0
+	}
+
+	gauge("build_info", "Build of the running gateway, always 1")
+	sample("build_info", 1, "version", st.Build.Version, "commit", st.Build.Commit)
+	gauge("config_generation", "Catalogs loaded since startup")
+	sample("config_generation", float64(st.Config.Generation))
+	gauge("config_loaded_timestamp_seconds", "When the active catalog was loaded")
+	sample("config_loaded_timestamp_seconds", float64(st.Config.LoadedAt))
+	// The two newest are the current and previous generations; older ones
+	// are left out so labels stay bounded
+	gauge("config_generation_in_flight", "Requests in flight by the catalog generation they were admitted under")
+	for _, g := range st.Config.Generations[:min(2, len(st.Config.Generations))] {
+		sample("config_generation_in_flight", float64(g.InFlight), "generation", strconv.FormatInt(g.Generation, 10))
+	}
+
+	gauge("backend_healthy", "1 unless the backend fails a self-test that marks it unhealthy")
+	for _, bs := range st.Backends {
+		sample("backend_healthy", boolValue(bs.Healthy), "backend", bs.Name)
+	}
+	gauge("backend_shed_rate", "Share of sheddable traffic being rejected")
+	for _, bs := range st.Backends {
+		if bs.ShedRate != nil {
+			sample("backend_shed_rate", *bs.ShedRate, "backend", bs.Name)
+		}
+	}
+	gauge("backend_connections_in_use", "Pooled connections carrying a request")
+	for _, bs := range st.Backends {
+		if bs.Pool != nil {
+			sample("backend_connections_in_use", float64(bs.Pool.InUse), "backend", bs.Name)
+		}
+	}
+	gauge("backend_queue_depth", "Requests waiting in the backend's queue")
+	for _, bs := range st.Backends {
+		if bs.Queue != nil {
+			sample("backend_queue_depth", float64(bs.Queue.Depth), "backend", bs.Name)
+		}
+	}
+	gauge("backend_queue_in_flight", "Requests holding a slot of the backend's queue")
+	for _, bs := range st.Backends {
+		if bs.Queue != nil {
+			sample("backend_queue_in_flight", float64(bs.Queue.InFlight), "backend", bs.Name)
+		}
+	}
+	gauge("backend_reservation_in_use", "Requests of the reserving key in its reserved slots")
+	for _, bs := range st.Backends {
+		if bs.Queue != nil {
+			for _, r := range bs.Queue.Reservations {
+				sample("backend_reservation_in_use", float64(r.InUse), "backend", bs.Name, "key", r.Key)
+			}
+		}
+	}
+	gauge("backend_reservation_lent", "Other keys' requests in the slots a reservation lends")
+	for _, bs := range st.Backends {
+		if bs.Queue != nil {
+			for _, r := range bs.Queue.Reservations {
+				sample("backend_reservation_lent", float64(r.Lent), "backend", bs.Name, "key", r.Key)
+			}
+		}
+	}
+	gauge("backend_reservation_utilization", "Share of a reservation's slots its key is using")
+	for _, bs := range st.Backends {
+		if bs.Queue != nil {
+			for _, r := range bs.Queue.Reservations {
+				sample("backend_reservation_utilization", r.Utilization, "backend", bs.Name, "key", r.Key)
+			}
+		}
+	}
+	gauge("endpoint_in_flight", "Requests open at the endpoint, streams included")
+	for _, bs := range st.Backends {
+		for _, es := range bs.Endpoints {
+			sample("endpoint_in_flight", float64(es.InFlight), "backend", bs.Name, "endpoint", es.URL)
+		}
+	}
+	gauge("endpoint_share", "Fraction of the balanced backend's requests the endpoint is picked for")
+	for _, bs := range st.Backends {
+		for _, es := range bs.Endpoints {
+			if es.Share != nil {
+				sample("endpoint_share", *es.Share, "backend", bs.Name, "endpoint", es.URL)
+			}
+		}
+	}
+
+	gauge("keys_in_flight", "Requests in flight across all keys")
+	sample("keys_in_flight", float64(st.Keys.InFlight))
+	gauge("key_in_flight", "Requests in flight for one of the listed keys")
+	for _, k := range st.Keys.Top {
+		sample("key_in_flight", float64(k.InFlight), "key", k.KeyID)
+	}
+	gauge("key_rate_tokens", "Tokens left in the rate limit bucket of one of the listed keys")
+	for _, k := range st.Keys.Top {
+		if k.RateTokens != nil {
+			sample("key_rate_tokens", *k.RateTokens, "key", k.KeyID)
+		}
+	}
+	gauge("key_concurrency_limit", "Concurrency limit of one of the listed keys; 0 is unlimited")
+	for _, k := range st.Keys.Top {
+		sample("key_concurrency_limit", float64(k.Limit), "key", k.KeyID)
+	}
+
+	if st.Cache != nil {
+		gauge("cache_entries", "Responses held by the response cache")
+		sample("cache_entries", float64(st.Cache.Entries))
+		if st.Cache.HitRatio != nil {
+			gauge("cache_hit_ratio", "Share of cacheable requests served from the cache since startup")
+			sample("cache_hit_ratio", *st.Cache.HitRatio)
+		}
+	}
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestStateIsConsistentSnapshot runs requests that are admitted, take a
+// key's concurrency slot, then open a request at an endpoint, and undo
+// those in reverse. In any one moment each count covers the next, so a
+// snapshot that read them at different moments could show an endpoint
+// busier than its key, or a key busier than the generation.
+func TestStateIsConsistentSnapshot(t *testing.T) {
+	c := useCatalog(t, &ModelInfo{ID: "m", Backend: "b1"})
+	c.backends["b1"] = &Backend{Name: "b1", Type: "openai", URL: "http://ep-1"}
+	c.generation = 42
+	l := &concurrencyLimiter{perKey: map[string]int{}, inflight: map[string]int{}}
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				done := generations.admit(&requestRecord{})
+				l.acquire("k")
+				end := startEndpointRequest("http://ep-1")
+				end()
+				l.release("k")
+				done(http.StatusOK)
+			}
+		}()
+	}
+	defer func() {
+		stop.Store(true)
+		wg.Wait()
+	}()
+
+	for range 2000 {
+		st := takeState(l, 10)
+		var gen int
+		for _, g := range st.Config.Generations {
+			if g.Generation == 42 {
+				gen = g.InFlight
+			}
+		}
+		ep := st.Backends[0].Endpoints[0].InFlight
+		if ep > st.Keys.InFlight || st.Keys.InFlight > gen {
+			t.Fatalf("endpoint %d, key %d, generation %d in flight: the snapshot isn't consistent", ep, st.Keys.InFlight, gen)
+		}
+	}
+}
+
+func TestStateAdminHandler(t *testing.T) {
+	c := useCatalog(t)
+	c.backends["b1"] = &Backend{Name: "b1", Type: "openai", URL: "http://ep-1"}
+	l := &concurrencyLimiter{perKey: map[string]int{"busy": 4}, inflight: map[string]int{"busy": 2, "idle": 1}}
+	h := stateAdminHandler(l)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/admin/state?keys=1", nil))
+	var st gatewayState
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatalf("state %s: %v", w.Body, err)
+	}
+	if st.Object != "gateway.state" || st.Keys.InFlight != 3 || len(st.Keys.Top) != 1 || st.Keys.Top[0] != (keyState{KeyID: "busy", InFlight: 2, Limit: 4}) {
+		t.Errorf("keys = %+v", st.Keys)
+	}
+	if len(st.Backends) != 1 || st.Backends[0].Name != "b1" || !st.Backends[0].Healthy || len(st.Backends[0].Endpoints) != 1 {
+		t.Errorf("backends = %+v", st.Backends)
+	}
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/admin/state?format=prometheus", nil))
+	for _, want := range []string{
+		`gateway_state_backend_healthy{backend="b1"} 1`,
+		`gateway_state_key_in_flight{key="busy"} 2`,
+		`gateway_state_key_concurrency_limit{key="busy"} 4`,
+		"gateway_state_keys_in_flight 3",
+	} {
+		if !strings.Contains(w.Body.String(), want+"\n") {
+			t.Errorf("prometheus output lacks %s:\n%s", want, w.Body)
+		}
+	}
+
+	for _, query := range []string{"keys=-1", "keys=x", "format=xml"} {
+		w = httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/admin/state?"+query, nil))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"invalid_parameter"`) {
+			t.Errorf("%s: response = %d %s", query, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// StopSequences accepts the OpenAI `stop` parameter as a string or a list.
+type StopSequences []string
+
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = StopSequences{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*s = list
+	return nil
+}
+
+// stopEnforced reports whether the gateway should apply req's stop
+// sequences itself: the catalog sets enforce_stop on model, served by a
+// backend that ignores the parameter.
+func (c *modelCatalog) stopEnforced(model string, req ChatCompletionRequest) bool {
+	m, ok := c.lookup(model)
+	return ok && m.EnforceStop && len(req.Stop) > 0
+}
+
+// truncateAtStop cuts content at the earliest stop sequence, reporting
+// whether one was found.
+func truncateAtStop(content string, stops []string) (string, bool) {
+	cut := -1
+	for _, stop := range stops {
+		if stop == "" {
+			continue
+		}
+		if i := strings.Index(content, stop); i >= 0 && (cut < 0 || i < cut) {
+			cut = i
+		}
+	}
+	if cut < 0 {
+		return content, false
+	}
+	return content[:cut], true
+}
+
+// enforceStop applies stop sequences to every choice of a full response.
+func enforceStop(response *ChatCompletionResponse, stops []string) {
+	for i := range response.Choices {
+		choice := &response.Choices[i]
+		if content, found := truncateAtStop(choice.Message.Content, stops); found {
+			choice.Message.Content = content
+			choice.FinishReason = "stop"
+		}
+	}
+}
+
+// stopScanner finds stop sequences in streamed content, including ones split
+// across chunks. It holds back any trailing text that could be the start of a
+// stop sequence until the next delta decides it.
+type stopScanner struct {
+	stops   []string
+	pending string
+}
+
+// feed consumes a delta and returns the text that is safe to emit, and
+// whether a stop sequence was reached (in which case the stream should end).
+func (s *stopScanner) feed(delta string) (string, bool) {
+	buf := s.pending + delta
+	if content, found := truncateAtStop(buf, s.stops); found {
+		s.pending = ""
+		return content, true
+	}
+
+	hold := 0
+	for _, stop := range s.stops {
+		for n := min(len(stop)-1, len(buf)); n > hold; n-- {
+			if strings.HasSuffix(buf, stop[:n]) {
+				hold = n
+				break
+			}
+		}
+	}
+	s.pending = buf[len(buf)-hold:]
+	return buf[:len(buf)-hold], false
+}
+
+// flush returns text held back when the stream ends without a stop.
+func (s *stopScanner) flush() string {
+	pending := s.pending
+	s.pending = ""
+	return pending
+}
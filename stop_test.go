@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/vinayhpandya/ai_inference_gateway/fakeback"
+)
+
+func TestStopScanner(t *testing.T) {
+	tests := []struct {
+		name   string
+		stops  []string
+		deltas []string
+		// emitted is what each feed returns, up to the one that stops
+		emitted []string
+		stopped bool
+		// flushed is what flush returns after the last delta
+		flushed string
+	}{
+		{"no stop", []string{"STOP"}, []string{"one ", "two"}, []string{"one ", "two"}, false, ""},
+		{"within a delta", []string{"STOP"}, []string{"one STOP two"}, []string{"one "}, true, ""},
+		{"split across 2 deltas", []string{"STOP"}, []string{"abc ST", "OP def"}, []string{"abc ", ""}, true, ""},
+		{"split across 3 deltas", []string{"STOP"}, []string{"xx S", "T", "OPyy"}, []string{"xx ", "", ""}, true, ""},
+		{"a false start is released", []string{"STOP"}, []string{"S", "TO", "AD"}, []string{"", "", "STOAD"}, false, ""},
+		// "ab" could start abcd and "b" bcx: the longer is held, and bcx
+		// ends it inside what was held
+		{"overlapping prefixes", []string{"abcd", "bcx"}, []string{"zab", "c", "x"}, []string{"z", "", "a"}, true, ""},
+		{"the earliest stop wins", []string{"world", "lo"}, []string{"hello world"}, []string{"hel"}, true, ""},
+		{"one stop the prefix of another", []string{"END", "ENDING"}, []string{"the EN", "DING"}, []string{"the ", ""}, true, ""},
+		{"held text flushed at the end", []string{"STOP"}, []string{"almost ST"}, []string{"almost "}, false, "ST"},
+		{"held text from several deltas", []string{"</answer>"}, []string{"42</", "ans"}, []string{"42", ""}, false, "</ans"},
+		{"empty stops ignored", []string{"", "x"}, []string{"abc"}, []string{"abc"}, false, ""},
+		{"multibyte stop", []string{"終わり"}, []string{"これで終", "わり"}, []string{"これで", ""}, true, ""},
+	}
+	for _, tt := range tests {
+		s := &stopScanner{stops: tt.stops}
+		var emitted []string
+		stopped := false
+		for _, d := range tt.deltas {
+			out, found := s.feed(d)
+			emitted = append(emitted, out)
+			if found {
+				stopped = true
+				break
+			}
+		}
+		if !slices.Equal(emitted, tt.emitted) || stopped != tt.stopped {
+			t.Errorf("%s: emitted %q, stopped %v; want %q, %v", tt.name, emitted, stopped, tt.emitted, tt.stopped)
+		}
+		if got := s.flush(); got != tt.flushed {
+			t.Errorf("%s: flush = %q, want %q", tt.name, got, tt.flushed)
+		}
+		if got := s.flush(); got != "" {
+			t.Errorf("%s: second flush = %q", tt.name, got)
+		}
+	}
+}
+
+func TestTruncateAtStop(t *testing.T) {
+	tests := []struct {
+		content string
+		stops   []string
+		want    string
+		found   bool
+	}{
+		{"hello world", nil, "hello world", false},
+		{"hello world", []string{"xyz"}, "hello world", false},
+		{"hello world", []string{"world", "o"}, "hell", true},
+		{"hello world", []string{""}, "hello world", false},
+		{"STOP at once", []string{"STOP"}, "", true},
+	}
+	for _, tt := range tests {
+		if got, found := truncateAtStop(tt.content, tt.stops); got != tt.want || found != tt.found {
+			t.Errorf("truncateAtStop(%q, %q) = %q, %v; want %q, %v", tt.content, tt.stops, got, found, tt.want, tt.found)
+		}
+	}
+}
+
+// A relayed stream cut at a stop sequence, split across chunks, ends with
+// finish_reason stop and [DONE], whatever the backend sends after it.
+func TestRelayCutsAtSplitStop(t *testing.T) {
+	chunk := func(content, finish string) string {
+		reason := "null"
+		if finish != "" {
+			reason = `"` + finish + `"`
+		}
+		return `{"id":"x","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"content":"` + content + `"},"finish_reason":` + reason + `}]}`
+	}
+	body := sseBody(chunk("The answer", ""), chunk(" is 42.</ans", ""), chunk("wer> and more", ""), chunk(" text", ""), chunk("", "length"))
+	s := &streamRelay{requestID: "req-1", n: 1, stops: []string{"</answer>"}}
+	events := relayEvents(t, s, body)
+
+	if text := choiceText(t, events)[0]; text != "The answer is 42." {
+		t.Errorf("content = %q, want it cut at the stop", text)
+	}
+	if reasons := choiceFinishes(t, events)[0]; !slices.Equal(reasons, []string{"stop"}) {
+		t.Errorf("finish reasons = %q, want just stop", reasons)
+	}
+	if events[len(events)-1] != "[DONE]" {
+		t.Errorf("stream ends with %q, want [DONE]", events[len(events)-1])
+	}
+
+	// Ending on what could have begun a stop sends it, with the backend's
+	// finish reason
+	body = sseBody(chunk("The answer is 42.</ans", ""), chunk("", "length"))
+	s = &streamRelay{requestID: "req-1", n: 1, stops: []string{"</answer>"}}
+	events = relayEvents(t, s, body)
+	if text := choiceText(t, events)[0]; text != "The answer is 42.</ans" {
+		t.Errorf("content = %q, want the held text flushed", text)
+	}
+	if reasons := choiceFinishes(t, events)[0]; !slices.Equal(reasons, []string{"length"}) {
+		t.Errorf("finish reasons = %q, want just length", reasons)
+	}
+}
+
+// Only models the catalog sets enforce_stop on get stop sequences applied
+// by the gateway.
+func TestStopEnforcedPerModel(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	c := useCatalog(t, &ModelInfo{ID: "strict", EnforceStop: true}, &ModelInfo{ID: "plain"})
+	back.SetDefault(fakeback.Behavior{Content: "Hello world, and more", Chunks: []string{"Hello ", "wo", "rld, and more"}, FinishReason: "length"})
+
+	if !c.stopEnforced("strict", ChatCompletionRequest{Stop: StopSequences{"world"}}) ||
+		c.stopEnforced("strict", ChatCompletionRequest{}) || c.stopEnforced("plain", ChatCompletionRequest{Stop: StopSequences{"world"}}) ||
+		c.stopEnforced("unknown", ChatCompletionRequest{Stop: StopSequences{"world"}}) {
+		t.Error("stopEnforced doesn't follow the catalog")
+	}
+
+	tests := []struct {
+		model, want, finish string
+	}{
+		{"strict", "Hello ", "stop"},
+		// The backend is trusted with the parameter
+		{"plain", "Hello world, and more", "length"},
+	}
+	for _, tt := range tests {
+		w := chatAs("", `{"model":"`+tt.model+`","stream":true,"stop":"world","messages":[{"role":"user","content":"hi"}]}`)
+		events := sseEvents(w.Body.String())
+		if text := choiceText(t, events)[0]; text != tt.want {
+			t.Errorf("%s stream: content = %q, want %q", tt.model, text, tt.want)
+		}
+		if reasons := choiceFinishes(t, events)[0]; !slices.Equal(reasons, []string{tt.finish}) {
+			t.Errorf("%s stream: finish reasons = %q, want [%s]", tt.model, reasons, tt.finish)
+		}
+
+		w = chatAs("", `{"model":"`+tt.model+`","stop":["world"],"messages":[{"role":"user","content":"hi"}]}`)
+		var resp ChatCompletionResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", tt.model, w.Code, w.Body)
+		}
+		if c := resp.Choices[0]; c.Message.Content != tt.want || c.FinishReason != tt.finish {
+			t.Errorf("%s: %q, %s; want %q, %s", tt.model, c.Message.Content, c.FinishReason, tt.want, tt.finish)
+		}
+	}
+
+	// Enforced stops are in the dry run, and keep the response from being
+	// passed through undecoded
+	t.Setenv("DRY_RUN_KEYS", "*")
+	for model, enforced := range map[string]bool{"strict": true, "plain": false} {
+		r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"`+model+`","stop":"world","messages":[{"role":"user","content":"hi"}]}`))
+		r.Header.Set(dryRunHeader, "true")
+		w := httptest.NewRecorder()
+		accessLog(http.HandlerFunc(chatCompletionsHandler)).ServeHTTP(w, r)
+		if got := strings.Contains(w.Body.String(), "stop sequences enforced by the gateway"); got != enforced {
+			t.Errorf("%s dry run: %s", model, w.Body)
+		}
+	}
+	if canPassthrough(&Backend{Type: "openai"}, true) || !canPassthrough(&Backend{Type: "openai"}, false) {
+		t.Error("canPassthrough ignores stop enforcement")
+	}
+}
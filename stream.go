@@ -0,0 +1,823 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Streaming response types (OpenAI-style)
+type ChatCompletionChunk struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created,omitempty"`
+	Model   string `json:"model,omitempty"`
+	// SystemFingerprint identifies the backend configuration that
+	// generated the chunk, when the backend reports one
+	SystemFingerprint string        `json:"system_fingerprint,omitempty"`
+	Choices           []ChunkChoice `json:"choices"`
+	Usage             *Usage        `json:"usage,omitempty"`
+	// Gateway rides on the usage chunk when the client asked for extras
+	Gateway *GatewayInfo `json:"gateway,omitempty"`
+}
+
+type ChunkChoice struct {
+	Index        int     `json:"index"`
+	Delta        Delta   `json:"delta"`
+	FinishReason *string `json:"finish_reason"`
+	// Logprobs covers this chunk's tokens; kept verbatim when the gateway
+	// rewrites a chunk
+	Logprobs json.RawMessage `json:"logprobs,omitempty"`
+}
+
+type Delta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+// errStreamCancelled is the cancellation cause used by the cancel endpoint.
+var errStreamCancelled = errors.New("stream cancelled by caller")
+
+// errGatewayRestart is the cancellation cause for streams ended at the
+// shutdown cutoff.
+var errGatewayRestart = errors.New("gateway restarting")
+
+const defaultRestartMessage = "The gateway is restarting; retry the request"
+
+// maxTrackedStreams bounds the cancellation registry.
+const maxTrackedStreams = 10000
+
+// activeStreams tracks in-flight streams so they can be cancelled by ID.
+var activeStreams = &streamRegistry{streams: make(map[string]inflightStream)}
+
+type inflightStream struct {
+	owner  string
+	cancel context.CancelCauseFunc
+}
+
+// streamRegistry maps request IDs of in-flight streams to their cancel funcs.
+type streamRegistry struct {
+	mu      sync.Mutex
+	streams map[string]inflightStream
+}
+
+// register records a stream. It returns false, leaving the stream
+// uncancellable, if the ID is already in use or the registry is full.
+func (s *streamRegistry) register(requestID, owner string, cancel context.CancelCauseFunc) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.streams[requestID]; exists || len(s.streams) >= maxTrackedStreams {
+		return false
+	}
+	s.streams[requestID] = inflightStream{owner: owner, cancel: cancel}
+	return true
+}
+
+func (s *streamRegistry) unregister(requestID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, requestID)
+}
+
+// cancel stops the stream if it exists and belongs to owner.
+func (s *streamRegistry) cancel(requestID, owner string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream, ok := s.streams[requestID]
+	if !ok || stream.owner != owner {
+		return false
+	}
+	stream.cancel(errStreamCancelled)
+	delete(s.streams, requestID)
+	return true
+}
+
+// cancelAll stops every registered stream with cause and returns how many
+// there were.
+func (s *streamRegistry) cancelAll(cause error) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.streams)
+	for id, stream := range s.streams {
+		stream.cancel(cause)
+		delete(s.streams, id)
+	}
+	return n
+}
+
+func cancelRequestHandler(w http.ResponseWriter, r *http.Request) {
+	owner := identityFromContext(r.Context()).KeyID
+	id := r.PathValue("id")
+
+	// Streams owned by another key are reported as missing so their IDs don't leak
+	if !activeStreams.cancel(id, owner) {
+		writeVersionedError(w, r, http.StatusNotFound, "invalid_request_error", "request_not_found", "Request not found")
+		return
+	}
+
+	log.Printf("Cancelled stream %s", id)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sseWriter writes stream events and flushes after each one. When a queue
+// is attached (see startQueue) writes are buffered and delivered by a
+// separate goroutine instead.
+type sseWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+	// enc frames events for the client; nil writes SSE
+	enc   streamEncoder
+	queue *eventQueue
+	// record, when set, keeps every event for the response cache
+	record *streamRecording
+	// events counts the events written, [DONE] aside
+	events int
+	// coalesce, when set, merges content chunks on their way to the client;
+	// it needs a queue
+	coalesce *StreamCoalesce
+}
+
+func (s *sseWriter) writeEvent(data []byte) error {
+	if string(data) != "[DONE]" {
+		s.events++
+	}
+	if s.record != nil {
+		s.record.add(data)
+	}
+	if s.queue != nil {
+		return s.queue.push(data)
+	}
+	return s.writeNow(data)
+}
+
+func (s *sseWriter) writeNow(data []byte) error {
+	enc := s.enc
+	if enc == nil {
+		enc = sseEncoder{}
+	}
+	if err := enc.encode(s.w, data); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *sseWriter) writeChunk(chunk ChatCompletionChunk) error {
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return err
+	}
+	return s.writeEvent(data)
+}
+
+func (s *sseWriter) writeDone() error {
+	return s.writeEvent([]byte("[DONE]"))
+}
+
+// finishChunk builds a content-less chunk carrying only a finish reason.
+func finishChunk(requestID, reason string) ChatCompletionChunk {
+	return ChatCompletionChunk{
+		ID:      requestID,
+		Object:  "chat.completion.chunk",
+		Choices: []ChunkChoice{{Index: 0, FinishReason: &reason}},
+	}
+}
+
+// streamChatCompletion serves a stream=true request from the backend or echo
+// mode, or replays it from the response cache on a hit. It returns the
+// assistant content delivered and whether the stream completed normally.
+func streamChatCompletion(w http.ResponseWriter, r *http.Request, req ChatCompletionRequest, requestID string, backend *Backend, prompt Message, cached *cacheLookup, gateway *GatewayInfo) (string, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeVersionedError(w, r, http.StatusInternalServerError, "server_error", "streaming_unsupported", "Streaming not supported")
+		return "", false
+	}
+
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+
+	owner := identityFromContext(ctx).KeyID
+	if activeStreams.register(requestID, owner, cancel) {
+		defer activeStreams.unregister(requestID)
+	} else {
+		log.Printf("Stream %s is not cancellable: ID in use or registry full", requestID)
+	}
+
+	var body io.ReadCloser
+	if cached != nil && cached.entry != nil {
+		body = responseCache.replay(ctx, cached.entry)
+	} else if backend != echoBackend {
+		resp, err := doBackendRequest(ctx, poolFor(backend).stream, backend, req, requestID)
+		if err != nil {
+			log.Printf("Backend error: %v", err)
+			noteBackendFailure(backend, err)
+			writeBackendError(w, err, backend)
+			return "", false
+		}
+		body = adapterFor(backend).streamBody(resp.Body, requestID)
+	} else {
+		body = io.NopCloser(echoStream(requestID, req, prompt))
+	}
+	defer body.Close()
+
+	rec := recordFromContext(ctx)
+	enc := negotiateStreamEncoder(r)
+	w.Header().Set("Content-Type", enc.contentType())
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Cache-Control", "no-cache")
+	setServerTiming(w, r)
+	hash := streamRequestHash(owner, req)
+	n := 1
+	if req.N != nil && *req.N > 1 {
+		n = *req.N
+	}
+	// What a resume skips is counted in one choice's content
+	var resume *resumeSkip
+	if n == 1 {
+		resume = resumeFor(r.Header.Get(resumeTokenHeader), requestID, hash)
+	}
+	if resume != nil {
+		w.Header().Set(resumeOffsetHeader, strconv.Itoa(resume.remaining))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	sse := &sseWriter{w: w, flusher: flusher, enc: enc, coalesce: streamCoalescing.forRequest(r)}
+	sse.startQueue(http.NewResponseController(w), requestID)
+	defer sse.queue.close()
+	// Streams carrying a token breakdown aren't recorded: it's per request.
+	// Nor are resumed ones, which are missing their start
+	if cached != nil && cached.entry == nil && gateway == nil && resume == nil {
+		sse.record = &streamRecording{start: time.Now()}
+	}
+
+	relay := &streamRelay{requestID: requestID, promptTokens: estimatePromptTokens(req.Messages), n: n, backend: backend.Name, gateway: gateway,
+		resume: resume, resumeHash: hash, model: responseModel(rec),
+		// A token breakdown rides on the usage chunk, so asking for one
+		// shows it
+		includeUsage: (req.StreamOptions != nil && req.StreamOptions.IncludeUsage) || gateway != nil,
+		processing:   responseProcessing.forRequest(r),
+	}
+	if rec.admittedCatalog().stopEnforced(rec.Model, req) {
+		relay.stops = req.Stop
+	}
+	if deterministicRoutes.covers(rec.Route) {
+		relay.fingerprint = backend
+	}
+	if guardrails != nil {
+		relay.guard = &streamGuard{ctx: ctx, chain: guardrails, rc: &RequestContext{RequestID: requestID, KeyID: owner, Header: r.Header, Request: &req}}
+	}
+	transferStart := time.Now()
+	err := relay.relay(ctx, body, sse)
+	rec.Timings.set(&rec.Timings.transfer, time.Since(transferStart))
+	rec.Usage = relay.usage
+	rec.FinishReason = relay.finishReason
+
+	if errors.Is(context.Cause(ctx), errStreamCancelled) {
+		// End the stream cleanly so the client knows it was stopped on purpose
+		streamClientCancels.Add(1)
+		rec.FinishReason = "cancelled"
+		relay.finishOpen(sse, "cancelled")
+		sse.writeDone()
+		return relay.text(), false
+	}
+	if err != nil && errors.Is(context.Cause(ctx), errGatewayRestart) {
+		endForRestart(sse, relay)
+		rec.Usage, rec.FinishReason = relay.usage, "gateway_restart"
+		return relay.text(), false
+	}
+	if errors.Is(err, errGuardrailBlocked) || errors.Is(err, errMissingFingerprint) || errors.Is(err, errResumeDiverged) {
+		// The client was told; returning cancels the backend request
+		return relay.text(), false
+	}
+	if errors.Is(err, errSlowClient) {
+		// Dropping the client; returning cancels the backend request
+		slowClientStreams.Add(1)
+		log.Printf("Stream %s dropped: client not keeping up", requestID)
+		return relay.text(), false
+	}
+	if err != nil && r.Context().Err() != nil {
+		streamClientCancels.Add(1)
+		log.Printf("Stream %s ended: client disconnected", requestID)
+		return relay.text(), false
+	}
+	if err != nil {
+		endIncomplete(ctx, sse, relay, backend, err)
+		return relay.text(), false
+	}
+	if sse.record != nil {
+		responseCache.store(cached, &cacheEntry{events: sse.record.events})
+	}
+	return relay.text(), true
+}
+
+// endForRestart closes a stream cut off by shutdown so the client can retry:
+// with a gateway_restart finish reason and usage, or with a retryable
+// error event when STREAM_RESTART_EVENT=error. Either way [DONE] follows.
+func endForRestart(sse *sseWriter, relay *streamRelay) {
+	if os.Getenv("STREAM_RESTART_EVENT") == "error" {
+		message := os.Getenv("STREAM_RESTART_MESSAGE")
+		if message == "" {
+			message = defaultRestartMessage
+		}
+		data, _ := json.Marshal(ErrorResponse{Error: ErrorDetail{
+			Message:     message,
+			Type:        "server_error",
+			Code:        "gateway_restart",
+			ResumeToken: relay.resumeToken(),
+		}})
+		sse.writeEvent(data)
+		sse.writeDone()
+		return
+	}
+	if relay.flushChoices(sse) != nil {
+		return
+	}
+	if relay.finishOpen(sse, "gateway_restart") != nil {
+		return
+	}
+	relay.finish(sse)
+}
+
+// streamRelay copies SSE events from the backend to the client. Each chunk's
+// id is rewritten to the gateway request ID; everything else passes through
+// byte-for-byte, and chunks that fail to parse are forwarded untouched.
+// Chunks the gateway has to change are edited as raw JSON, so fields it
+// doesn't model, such as tool_calls, are kept. Each choice, by its index,
+// keeps its own stop, processing and guardrail state.
+type streamRelay struct {
+	requestID    string
+	promptTokens int
+	// n is how many choices the stream has
+	n        int
+	choices  map[int]*choiceRelay
+	sawUsage bool
+	usage    *Usage
+	// finishReason is the first choice's finish_reason as sent to the client
+	finishReason string
+
+	// stops are the stop sequences the gateway enforces itself, if any
+	stops []string
+	// backend names the backend whose split characters each choice's
+	// utf8Carry repairs
+	backend string
+	// gateway, when set, is added to the usage chunk
+	gateway *GatewayInfo
+	// includeUsage is whether the client sees the usage chunk. Usage is
+	// tracked for billing either way
+	includeUsage bool
+	// processing, when set, is the route's response processors, run on each
+	// choice's text
+	processing *responsePipeline
+	// guard, when set, runs response guardrails on the text before it is sent
+	guard *streamGuard
+	// resume, when set, drops the content a resumed stream's client already
+	// has; the first choice's content still holds all of it. Streams with
+	// more than one choice aren't resumable
+	resume     *resumeSkip
+	resumeHash string
+	// model, when set, replaces the model each chunk reports
+	model string
+	// fingerprint, on deterministic routes, is the backend whose first
+	// chunk must carry a system_fingerprint, until it has
+	fingerprint *Backend
+}
+
+// choiceRelay is one choice's part of a relayed stream.
+type choiceRelay struct {
+	// content is the choice's text as sent to the client
+	content strings.Builder
+	// utf8 holds back multibyte characters split across chunks
+	utf8 utf8Carry
+	// stop is set when the gateway enforces stop sequences itself
+	stop *stopScanner
+	// process, when set, runs the route's response processors on the text
+	process *processorRun
+	// finished is set once the client has the choice's finish_reason
+	finished bool
+	// stopped is set once the gateway ended the choice at a stop sequence;
+	// what the backend sends for it after that is dropped
+	stopped bool
+}
+
+// choice returns the state of the choice with index, starting it on its
+// first chunk.
+func (s *streamRelay) choice(index int) *choiceRelay {
+	c := s.choices[index]
+	if c == nil {
+		c = &choiceRelay{utf8: utf8Carry{backend: s.backend}, process: s.processing.start()}
+		if len(s.stops) > 0 {
+			c.stop = &stopScanner{stops: s.stops}
+		}
+		if s.choices == nil {
+			s.choices = make(map[int]*choiceRelay)
+		}
+		s.choices[index] = c
+	}
+	return c
+}
+
+// indexes returns the indexes of the choices seen, in order, or just the
+// first choice's when none were.
+func (s *streamRelay) indexes() []int {
+	if len(s.choices) == 0 {
+		return []int{0}
+	}
+	return slices.Sorted(maps.Keys(s.choices))
+}
+
+// text returns the first choice's content as sent to the client, which is
+// what conversations, training data and comparisons keep.
+func (s *streamRelay) text() string {
+	if c := s.choices[0]; c != nil {
+		return c.content.String()
+	}
+	return ""
+}
+
+// relay runs until the backend sends [DONE], or the gateway has stopped
+// every choice. If no chunk carried usage it is estimated, so billing
+// always has one.
+func (s *streamRelay) relay(ctx context.Context, body io.Reader, sse *sseWriter) error {
+	reader := bufio.NewReader(body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			// A body may end without a newline after its last line, such
+			// as a closing [DONE]; the next read reports the EOF
+			err = nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		data, ok := bytes.CutPrefix(bytes.TrimRight(line, "\r\n"), []byte("data:"))
+		if !ok {
+			continue
+		}
+		data = bytes.TrimSpace(data)
+
+		if string(data) == "[DONE]" {
+			if err := s.flushChoices(sse); err != nil {
+				return err
+			}
+			return s.finish(sse)
+		}
+
+		var chunk ChatCompletionChunk
+		if json.Unmarshal(data, &chunk) == nil {
+			if err := asStreamError(data, &chunk); err != nil {
+				return err
+			}
+			if s.fingerprint != nil {
+				if chunk.SystemFingerprint == "" {
+					return s.block(sse, missingFingerprint(s.fingerprint), errMissingFingerprint)
+				}
+				s.fingerprint = nil
+			}
+			if chunk.Usage != nil {
+				s.sawUsage = true
+				s.usage = chunk.Usage
+			}
+			data = rewriteChunkID(data, s.requestID)
+			if s.model != "" && chunk.Model != "" {
+				data = rewriteChunkField(data, "model", s.model)
+			}
+			edit := &chunkEdit{data: data}
+			showUsage := chunk.Usage != nil && s.includeUsage
+			if chunk.Usage != nil && !s.includeUsage {
+				// Counted above; the client didn't ask to see it
+				if len(chunk.Choices) == 0 {
+					continue
+				}
+				edit.dropField("usage")
+			}
+
+			for i, choice := range chunk.Choices {
+				delta, err := s.relayChoice(sse, edit, i, choice)
+				if err != nil {
+					return err
+				}
+				if choice.Index == 0 {
+					emit, err := s.resume.skip(delta)
+					if err != nil {
+						return s.block(sse, resumeDivergedError, err)
+					}
+					if emit != delta {
+						edit.setContent(i, emit)
+					}
+				}
+			}
+			if !showUsage && edit.empty() {
+				continue
+			}
+			data = edit.bytes()
+			if showUsage && s.gateway != nil {
+				s.gateway.stampTiming()
+				data = withGatewayField(data, s.gateway)
+			}
+		}
+
+		if err := sse.writeEvent(repairUTF8(data, s.backend)); err != nil {
+			return err
+		}
+		if s.allStopped() {
+			// Every choice reached a stop sequence; returning cancels the
+			// backend request
+			return s.finish(sse)
+		}
+	}
+}
+
+// relayChoice passes the choice at position i of a chunk through its
+// choice's UTF-8 repair, stop sequences, response processors and
+// guardrails, editing the chunk where they change it. It returns the
+// choice's content as the client is to get it, before any resume skip.
+func (s *streamRelay) relayChoice(sse *sseWriter, edit *chunkEdit, i int, choice ChunkChoice) (string, error) {
+	c := s.choice(choice.Index)
+	if c.stopped {
+		edit.dropChoice(i)
+		return "", nil
+	}
+	final := choice.FinishReason != nil
+	delta, changed := c.utf8.content(edit.data, i, choice.Delta.Content)
+	if final {
+		delta += c.utf8.flush()
+	}
+	stopped := false
+	if c.stop != nil {
+		var emit string
+		// Deliver what precedes a stop sequence, then end the choice
+		emit, stopped = c.stop.feed(delta)
+		if final && !stopped {
+			emit += c.stop.flush()
+		}
+		delta = emit
+	}
+	final = final || stopped
+	if final {
+		delta = c.process.end(delta)
+	} else {
+		delta = c.process.feed(delta)
+	}
+	delta, rej := s.guard.check(choice.Index, c.content.String(), delta, final)
+	if rej != nil {
+		return "", s.block(sse, rej, errGuardrailBlocked)
+	}
+	c.content.WriteString(delta)
+	if changed || delta != choice.Delta.Content {
+		edit.setContent(i, delta)
+	}
+	if final {
+		c.finished = true
+		reason := "stop"
+		if stopped {
+			c.stopped = true
+			edit.setFinishReason(i, reason)
+		} else {
+			reason = *choice.FinishReason
+		}
+		if choice.Index == 0 {
+			s.finishReason = reason
+		}
+	}
+	return delta, nil
+}
+
+// allStopped reports whether the gateway ended every choice at a stop
+// sequence.
+func (s *streamRelay) allStopped() bool {
+	if s.stops == nil {
+		return false
+	}
+	stopped := 0
+	for _, c := range s.choices {
+		if c.stopped {
+			stopped++
+		}
+	}
+	return stopped >= max(s.n, 1)
+}
+
+// flushChoices sends what each choice still holds back at the end of the
+// stream: text that could have begun a stop sequence, what the processors
+// kept and split characters.
+func (s *streamRelay) flushChoices(sse *sseWriter) error {
+	for _, i := range s.indexes() {
+		c := s.choice(i)
+		if c.stopped {
+			continue
+		}
+		var held string
+		if c.stop != nil {
+			held = c.stop.flush()
+		}
+		if err := s.writeContent(sse, i, c.process.end(held+c.utf8.flush())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finishOpen ends each choice the client has no finish_reason for with
+// reason.
+func (s *streamRelay) finishOpen(sse *sseWriter, reason string) error {
+	for _, i := range s.indexes() {
+		c := s.choice(i)
+		if c.finished {
+			continue
+		}
+		c.finished = true
+		chunk := finishChunk(s.requestID, reason)
+		chunk.Choices[0].Index = i
+		if err := sse.writeChunk(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeContent emits a gateway-built content chunk for the choice with
+// index, skipping empty text.
+func (s *streamRelay) writeContent(sse *sseWriter, index int, content string) error {
+	if content == "" {
+		return nil
+	}
+	c := s.choice(index)
+	content, rej := s.guard.check(index, c.content.String(), content, false)
+	if rej != nil {
+		return s.block(sse, rej, errGuardrailBlocked)
+	}
+	c.content.WriteString(content)
+	if index == 0 {
+		var err error
+		if content, err = s.resume.skip(content); err != nil {
+			return s.block(sse, resumeDivergedError, err)
+		}
+	}
+	if content == "" {
+		return nil
+	}
+	return sse.writeChunk(ChatCompletionChunk{
+		ID:      s.requestID,
+		Object:  "chat.completion.chunk",
+		Choices: []ChunkChoice{{Index: index, Delta: Delta{Content: content}}},
+	})
+}
+
+// block ends a stream the gateway stopped part way, a guardrail or a
+// missing fingerprint, with rej as an event, then usage and [DONE] as
+// usual. It returns cause.
+func (s *streamRelay) block(sse *sseWriter, rej *RouteError, cause error) error {
+	data, _ := json.Marshal(ErrorResponse{Error: ErrorDetail{Message: rej.Message, Type: rej.Type, Code: rej.Code}})
+	if err := sse.writeEvent(data); err != nil {
+		return err
+	}
+	if err := s.finish(sse); err != nil {
+		return err
+	}
+	return cause
+}
+
+// finish ends the stream. If the backend sent no usage it is estimated,
+// and sent on to clients that asked for it.
+func (s *streamRelay) finish(sse *sseWriter) error {
+	if err := s.resume.done(); err != nil {
+		return s.block(sse, resumeDivergedError, err)
+	}
+	if !s.sawUsage {
+		chunk := s.estimatedUsageChunk()
+		s.usage = chunk.Usage
+		if !s.includeUsage {
+			return sse.writeDone()
+		}
+		if err := sse.writeChunk(chunk); err != nil {
+			return err
+		}
+	}
+	return sse.writeDone()
+}
+
+// estimatedUsageChunk builds a final usage-only chunk from gateway-side
+// token estimates, counting every choice's completion.
+func (s *streamRelay) estimatedUsageChunk() ChatCompletionChunk {
+	s.gateway.stampTiming()
+	completionTokens := 0
+	for _, c := range s.choices {
+		completionTokens += approximateTokens(c.content.String())
+	}
+	return ChatCompletionChunk{
+		ID:      s.requestID,
+		Object:  "chat.completion.chunk",
+		Choices: []ChunkChoice{},
+		Usage: &Usage{
+			PromptTokens:     s.promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      s.promptTokens + completionTokens,
+			Estimated:        true,
+		},
+		Gateway: s.gateway,
+	}
+}
+
+// resumeToken returns the token a retry resumes the stream with, or "" for
+// streams with more than one choice.
+func (s *streamRelay) resumeToken() string {
+	if s.n > 1 {
+		return ""
+	}
+	return newResumeToken(s.requestID, s.resumeHash, s.text())
+}
+
+// rewriteChunkID replaces the value of the top-level "id" field in place,
+// leaving the rest of the chunk's bytes untouched. It returns data unchanged
+// if the chunk has no id or cannot be scanned.
+func rewriteChunkID(data []byte, id string) []byte {
+	return rewriteChunkField(data, "id", id)
+}
+
+// rewriteChunkField replaces the value of a top-level string field in
+// place, as rewriteChunkID does for "id".
+func rewriteChunkField(data []byte, field, to string) []byte {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return data
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return data
+		}
+		keyEnd := dec.InputOffset()
+
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return data
+		}
+		if tok != field {
+			continue
+		}
+
+		// The value starts after the colon and any whitespace following the key
+		valueEnd := int(dec.InputOffset())
+		valueStart := valueEnd - len(value)
+		if valueStart < int(keyEnd) {
+			return data
+		}
+		quoted, _ := json.Marshal(to)
+		out := make([]byte, 0, len(data)-len(value)+len(quoted))
+		out = append(out, data[:valueStart]...)
+		out = append(out, quoted...)
+		return append(out, data[valueEnd:]...)
+	}
+	return data
+}
+
+// echoStream renders the echo reply as an SSE body, one word per chunk
+// for each of the n choices in turn, then a usage chunk.
+func echoStream(requestID string, req ChatCompletionRequest, prompt Message) io.Reader {
+	var buf bytes.Buffer
+	sse := &sseWriter{w: &buf, flusher: nopFlusher{}}
+	content, finishReason := echoCompletion(req, prompt)
+	created := time.Now().Unix()
+	chunk := func(choice ChunkChoice) ChatCompletionChunk {
+		return ChatCompletionChunk{ID: requestID, Object: "chat.completion.chunk", Created: created, Model: req.Model, SystemFingerprint: echoSystemFingerprint, Choices: []ChunkChoice{choice}}
+	}
+
+	for i := range echoChoices(req) {
+		sse.writeChunk(chunk(ChunkChoice{Index: i, Delta: Delta{Role: "assistant"}}))
+		for _, word := range echoWords(content) {
+			sse.writeChunk(chunk(ChunkChoice{Index: i, Delta: Delta{Content: word}}))
+		}
+		sse.writeChunk(chunk(ChunkChoice{Index: i, FinishReason: &finishReason}))
+	}
+	usage := echoUsage(req, content)
+	sse.writeChunk(ChatCompletionChunk{ID: requestID, Object: "chat.completion.chunk", Created: created, Model: req.Model, SystemFingerprint: echoSystemFingerprint, Choices: []ChunkChoice{}, Usage: &usage})
+	sse.writeDone()
+	return &buf
+}
+
+type nopFlusher struct{}
+
+func (nopFlusher) Flush() {}
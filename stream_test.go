@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/vinayhpandya/ai_inference_gateway/fakeback"
+)
+
+// sseBody renders events as a backend's SSE body, ending with [DONE].
+func sseBody(events ...string) string {
+	var b strings.Builder
+	for _, e := range events {
+		b.WriteString("data: " + e + "\n\n")
+	}
+	b.WriteString("data: [DONE]\n\n")
+	return b.String()
+}
+
+// relayEvents runs body through s and returns the events the client got,
+// [DONE] included.
+func relayEvents(t *testing.T, s *streamRelay, body string) []string {
+	t.Helper()
+	events, err := relayEnding(s, body)
+	if err != nil {
+		t.Fatalf("relay: %v", err)
+	}
+	return events
+}
+
+// relayEnding is relayEvents for streams the relay ends with an error.
+func relayEnding(s *streamRelay, body string) ([]string, error) {
+	var buf bytes.Buffer
+	sse := &sseWriter{w: &buf, flusher: nopFlusher{}}
+	err := s.relay(context.Background(), strings.NewReader(body), sse)
+	return sseEvents(buf.String()), err
+}
+
+// sseEvents splits an SSE body into its events' data.
+func sseEvents(body string) []string {
+	var events []string
+	for _, e := range strings.Split(body, "\n\n") {
+		if e != "" {
+			events = append(events, strings.TrimPrefix(e, "data: "))
+		}
+	}
+	return events
+}
+
+// choiceText joins the content each choice index got across events.
+func choiceText(t *testing.T, events []string) map[int]string {
+	t.Helper()
+	text := map[int]string{}
+	for _, e := range events {
+		if e == "[DONE]" {
+			continue
+		}
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(e), &chunk); err != nil {
+			t.Fatalf("event %s: %v", e, err)
+		}
+		for _, c := range chunk.Choices {
+			text[c.Index] += c.Delta.Content
+		}
+	}
+	return text
+}
+
+// choiceFinishes collects the finish reasons each choice index got.
+func choiceFinishes(t *testing.T, events []string) map[int][]string {
+	t.Helper()
+	reasons := map[int][]string{}
+	for _, e := range events {
+		var chunk ChatCompletionChunk
+		if json.Unmarshal([]byte(e), &chunk) != nil {
+			continue
+		}
+		for _, c := range chunk.Choices {
+			if c.FinishReason != nil {
+				reasons[c.Index] = append(reasons[c.Index], *c.FinishReason)
+			}
+		}
+	}
+	return reasons
+}
+
+func TestRelayRewritesChunkID(t *testing.T) {
+	event := `{"id":"chatcmpl-upstream","object":"chat.completion.chunk","service_tier":"default","choices":[{"index":0,"delta":{"content":"hi"},"finish_reason":null}]}`
+	s := &streamRelay{requestID: "req-1", n: 1}
+	events := relayEvents(t, s, sseBody(event))
+
+	want := strings.Replace(event, "chatcmpl-upstream", "req-1", 1)
+	if len(events) != 2 || events[0] != want || events[1] != "[DONE]" {
+		t.Fatalf("events = %q, want %q then [DONE]", events, want)
+	}
+}
+
+// A final line without a newline is still read: a [DONE] ends the stream,
+// anything else leaves it truncated.
+func TestRelayReadsFinalLineWithoutNewline(t *testing.T) {
+	event := `{"id":"x","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"content":"hi"},"finish_reason":"stop"}]}`
+	tests := []struct {
+		name, body, want string
+		err              error
+	}{
+		{"[DONE]", "data: " + event + "\n\ndata: [DONE]", "hi", nil},
+		{"[DONE] ending in CR", "data: " + event + "\r\n\r\ndata: [DONE]\r", "hi", nil},
+		{"chunk", "data: " + event, "hi", io.ErrUnexpectedEOF},
+		{"nothing", "", "", io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		events, err := relayEnding(&streamRelay{requestID: "req-1", n: 1}, tt.body)
+		if err != tt.err {
+			t.Errorf("%s: relay = %v, want %v", tt.name, err, tt.err)
+		}
+		if got := choiceText(t, events)[0]; got != tt.want {
+			t.Errorf("%s: content = %q, want %q", tt.name, got, tt.want)
+		}
+		if done := len(events) > 0 && events[len(events)-1] == "[DONE]"; done != (tt.err == nil) {
+			t.Errorf("%s: events = %q", tt.name, events)
+		}
+	}
+}
+
+func TestRelayEditsKeepUnmodeledFields(t *testing.T) {
+	// Stop enforcement holds back "Hel", which could begin "Hello", so
+	// the first chunk is edited; everything but its content must survive
+	event := `{"id":"x","object":"chat.completion.chunk","system_fingerprint":"fp_1","service_tier":"default",` +
+		`"choices":[{"index":0,"delta":{"role":"assistant","content":"Hel","refusal":null,"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"f","arguments":"{}"}}]},` +
+		`"logprobs":{"content":[{"token":"Hel","logprob":-0.1}]},"finish_reason":null}]}`
+	s := &streamRelay{requestID: "req-1", n: 1, stops: []string{"Hello"}}
+	events := relayEvents(t, s, sseBody(event))
+
+	var got map[string]any
+	if err := json.Unmarshal([]byte(events[0]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["id"] != "req-1" || got["system_fingerprint"] != "fp_1" || got["service_tier"] != "default" {
+		t.Errorf("top-level fields = %v", got)
+	}
+	choice := got["choices"].([]any)[0].(map[string]any)
+	delta := choice["delta"].(map[string]any)
+	if _, ok := delta["content"]; ok {
+		t.Errorf("held back content was sent: %v", delta)
+	}
+	if _, ok := delta["tool_calls"]; !ok || delta["role"] != "assistant" {
+		t.Errorf("delta lost fields: %v", delta)
+	}
+	if _, ok := delta["refusal"]; !ok {
+		t.Errorf("delta lost refusal: %v", delta)
+	}
+	if choice["logprobs"] == nil {
+		t.Errorf("choice lost logprobs: %v", choice)
+	}
+	// The held text goes out when the stream ends without a stop
+	if text := choiceText(t, events)[0]; text != "Hel" {
+		t.Errorf("content = %q, want Hel", text)
+	}
+}
+
+func TestRelayKeepsChoicesApart(t *testing.T) {
+	chunk := func(index int, content, finish string) string {
+		reason := "null"
+		if finish != "" {
+			reason = `"` + finish + `"`
+		}
+		return `{"id":"x","object":"chat.completion.chunk","choices":[{"index":` + string(rune('0'+index)) + `,"delta":{"content":"` + content + `"},"finish_reason":` + reason + `}]}`
+	}
+	body := sseBody(
+		chunk(0, "one ", ""), chunk(1, "two ", ""),
+		chunk(0, "END more", ""), chunk(1, "three", ""),
+		chunk(0, "", "length"), chunk(1, "", "length"),
+	)
+	s := &streamRelay{requestID: "req-1", n: 2, stops: []string{"END"}}
+	events := relayEvents(t, s, body)
+
+	text := choiceText(t, events)
+	if text[0] != "one " || text[1] != "two three" {
+		t.Errorf("content = %q, want choice 0 cut at the stop and choice 1 whole", text)
+	}
+	reasons := choiceFinishes(t, events)
+	if len(reasons[0]) != 1 || reasons[0][0] != "stop" {
+		t.Errorf("choice 0 finish reasons = %q, want just stop", reasons[0])
+	}
+	if len(reasons[1]) != 1 || reasons[1][0] != "length" {
+		t.Errorf("choice 1 finish reasons = %q, want just length", reasons[1])
+	}
+	if s.finishReason != "stop" || s.text() != "one " {
+		t.Errorf("first choice = %q, %q", s.finishReason, s.text())
+	}
+}
+
+func TestRelayEndsWhenEveryChoiceStops(t *testing.T) {
+	body := `data: {"id":"x","choices":[{"index":0,"delta":{"content":"a STOP"},"finish_reason":null},{"index":1,"delta":{"content":"b STOP"},"finish_reason":null}]}` + "\n\n"
+	// No [DONE]: the relay must end on its own once both choices stop
+	s := &streamRelay{requestID: "req-1", n: 2, stops: []string{"STOP"}}
+	events := relayEvents(t, s, body)
+
+	if events[len(events)-1] != "[DONE]" {
+		t.Fatalf("events = %q, want [DONE] last", events)
+	}
+	if text := choiceText(t, events); text[0] != "a " || text[1] != "b " {
+		t.Errorf("content = %q", text)
+	}
+}
+
+func TestRelayInjectsEstimatedUsage(t *testing.T) {
+	body := sseBody(`{"id":"x","choices":[{"index":0,"delta":{"content":"abcdefgh"},"finish_reason":"stop"}]}`)
+
+	s := &streamRelay{requestID: "req-1", n: 1, promptTokens: 5, includeUsage: true}
+	events := relayEvents(t, s, body)
+	if len(events) != 3 {
+		t.Fatalf("events = %q, want content, usage, [DONE]", events)
+	}
+	var usage ChatCompletionChunk
+	if err := json.Unmarshal([]byte(events[1]), &usage); err != nil {
+		t.Fatal(err)
+	}
+	want := Usage{PromptTokens: 5, CompletionTokens: 2, TotalTokens: 7, Estimated: true}
+	if usage.ID != "req-1" || usage.Usage == nil || *usage.Usage != want || len(usage.Choices) != 0 {
+		t.Errorf("usage chunk = %s, want %+v", events[1], want)
+	}
+
+	// Not shown unless asked for, but still counted for billing
+	s = &streamRelay{requestID: "req-1", n: 1, promptTokens: 5}
+	events = relayEvents(t, s, body)
+	if len(events) != 2 {
+		t.Errorf("events = %q, want content then [DONE]", events)
+	}
+	if s.usage == nil || *s.usage != want {
+		t.Errorf("tracked usage = %+v, want %+v", s.usage, want)
+	}
+}
+
+func TestRelayHidesBackendUsageUnlessAsked(t *testing.T) {
+	body := sseBody(
+		`{"id":"x","choices":[{"index":0,"delta":{"content":"hi"},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`,
+		`{"id":"x","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`,
+	)
+	s := &streamRelay{requestID: "req-1", n: 1}
+	events := relayEvents(t, s, body)
+
+	if len(events) != 2 || strings.Contains(events[0], "usage") || !strings.Contains(events[0], `"content":"hi"`) {
+		t.Errorf("events = %q, want the content chunk without usage, then [DONE]", events)
+	}
+	if s.usage == nil || s.usage.TotalTokens != 4 || s.usage.Estimated {
+		t.Errorf("tracked usage = %+v, want the backend's", s.usage)
+	}
+
+	s = &streamRelay{requestID: "req-1", n: 1, includeUsage: true}
+	if events := relayEvents(t, s, body); len(events) != 3 || !strings.Contains(events[1], `"total_tokens":4`) {
+		t.Errorf("events = %q, want the backend's usage chunk", events)
+	}
+}
+
+func TestEchoStreamKeepsChoicesApart(t *testing.T) {
+	n := 2
+	req := ChatCompletionRequest{Model: "m", N: &n, Messages: []Message{{Role: "user", Content: "say this twice"}}}
+	prompt := req.Messages[0]
+	content, finish := echoCompletion(req, prompt)
+
+	body := echoStream("req-1", req, prompt)
+	s := &streamRelay{requestID: "req-1", n: n, stops: []string{"never appears"}}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(body); err != nil {
+		t.Fatal(err)
+	}
+	events := relayEvents(t, s, buf.String())
+
+	text := choiceText(t, events)
+	reasons := choiceFinishes(t, events)
+	for i := range n {
+		if text[i] != content {
+			t.Errorf("choice %d content = %q, want %q", i, text[i], content)
+		}
+		if len(reasons[i]) != 1 || reasons[i][0] != finish {
+			t.Errorf("choice %d finish reasons = %q, want [%s]", i, reasons[i], finish)
+		}
+	}
+	if len(text) != n {
+		t.Errorf("got choices %v, want %d", text, n)
+	}
+}
+
+func TestStreamFromFakeBackend(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	back.Enqueue(fakeback.Behavior{Chunks: []string{"Hello", ", ", "world"}, Usage: &fakeback.Usage{PromptTokens: 3, CompletionTokens: 5, TotalTokens: 8}})
+	w := chatAs("", `{"model":"m","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("response = %d %s", w.Code, w.Header())
+	}
+
+	events := sseEvents(w.Body.String())
+	if text := choiceText(t, events)[0]; text != "Hello, world" {
+		t.Errorf("content = %q", text)
+	}
+	if reasons := choiceFinishes(t, events)[0]; len(reasons) != 1 || reasons[0] != "stop" {
+		t.Errorf("finish reasons = %q", reasons)
+	}
+	var usage *Usage
+	for _, e := range events {
+		var chunk ChatCompletionChunk
+		if json.Unmarshal([]byte(e), &chunk) == nil {
+			if chunk.ID != w.Header().Get("X-Request-ID") {
+				t.Errorf("chunk ID %q, want the request ID %q", chunk.ID, w.Header().Get("X-Request-ID"))
+			}
+			if chunk.Usage != nil {
+				usage = chunk.Usage
+			}
+		}
+	}
+	if usage == nil || usage.TotalTokens != 8 {
+		t.Errorf("usage = %+v, want the backend's", usage)
+	}
+	if events[len(events)-1] != "[DONE]" {
+		t.Errorf("last event = %s", events[len(events)-1])
+	}
+
+	var sent ChatCompletionRequest
+	if req, ok := back.Last(); !ok || req.Decode(&sent) != nil || !sent.Stream || sent.Model != "m" {
+		t.Errorf("backend got %+v", sent)
+	}
+}
+
+func TestStreamCutByFakeBackend(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	back.Enqueue(fakeback.CutAfter(2, "one two three four"))
+	w := chatAs("", `{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+
+	events := sseEvents(w.Body.String())
+	if text := choiceText(t, events[:len(events)-2])[0]; text != "one two" {
+		t.Errorf("content before the cut = %q", text)
+	}
+	var cut struct {
+		Error struct {
+			Type        string `json:"type"`
+			ResumeToken string `json:"resume_token"`
+		} `json:"error"`
+	}
+	if len(events) < 2 || json.Unmarshal([]byte(events[len(events)-2]), &cut) != nil || cut.Error.Type != "stream_incomplete" || cut.Error.ResumeToken == "" {
+		t.Fatalf("events = %q, want stream_incomplete with a resume token", events)
+	}
+	if tok, ok := decodeResumeToken(cut.Error.ResumeToken); !ok || tok.Delivered != len("one two") {
+		t.Errorf("resume token = %+v, %t", tok, ok)
+	}
+}
+
+func TestStreamFromFakeBackendError(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	back.Enqueue(fakeback.Error(http.StatusServiceUnavailable, "overloaded"))
+	w := chatAs("", `{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), `"backend_unavailable"`) || !strings.Contains(w.Body.String(), `"overloaded"`) {
+		t.Errorf("response = %d %s, want 502 backend_unavailable", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// streamEncoder frames stream events for the client. The relay produces
+// each event once, as a JSON object or the [DONE] sentinel, and the encoder
+// chosen for the response decides how it goes on the wire.
+type streamEncoder interface {
+	contentType() string
+	encode(w io.Writer, data []byte) error
+}
+
+// sseEncoder writes server-sent events, the OpenAI streaming format.
+type sseEncoder struct{}
+
+func (sseEncoder) contentType() string { return "text/event-stream" }
+
+func (sseEncoder) encode(w io.Writer, data []byte) error {
+	_, err := fmt.Fprintf(w, "data: %s\n\n", data)
+	return err
+}
+
+// ndjsonEncoder writes one JSON object per line. There is no [DONE]
+// sentinel; the end of the body ends the stream.
+type ndjsonEncoder struct{}
+
+func (ndjsonEncoder) contentType() string { return "application/x-ndjson" }
+
+func (ndjsonEncoder) encode(w io.Writer, data []byte) error {
+	if string(data) == "[DONE]" {
+		return nil
+	}
+	_, err := fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// streamEncoders are the stream formats clients may ask for in Accept.
+var streamEncoders = []streamEncoder{sseEncoder{}, ndjsonEncoder{}}
+
+// negotiateStreamEncoder picks the first stream format listed in r's Accept
+// header, skipping any with q=0. Anything else gets SSE.
+func negotiateStreamEncoder(r *http.Request) streamEncoder {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		for _, enc := range streamEncoders {
+			if mediaType == enc.contentType() {
+				return enc
+			}
+		}
+	}
+	return sseEncoder{}
+}
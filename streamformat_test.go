@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vinayhpandya/ai_inference_gateway/fakeback"
+)
+
+func chatAccepting(accept, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	r.Header.Set("Accept", accept)
+	w := httptest.NewRecorder()
+	accessLog(http.HandlerFunc(chatCompletionsHandler)).ServeHTTP(w, r)
+	return w
+}
+
+// ndjsonLines splits an NDJSON body into its lines, failing on any that
+// isn't a JSON object.
+func ndjsonLines(t *testing.T, body string) []string {
+	t.Helper()
+	if !strings.HasSuffix(body, "\n") {
+		t.Errorf("body doesn't end in a newline: %q", body)
+	}
+	lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	for _, line := range lines {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(line), &obj); err != nil {
+			t.Fatalf("line %q is not a JSON object: %v", line, err)
+		}
+	}
+	return lines
+}
+
+func TestNegotiateStreamEncoder(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   streamEncoder
+	}{
+		{"", sseEncoder{}},
+		{"*/*", sseEncoder{}},
+		{"application/json", sseEncoder{}},
+		{"text/event-stream", sseEncoder{}},
+		{"application/x-ndjson", ndjsonEncoder{}},
+		{"application/json, application/x-ndjson;q=0.9", ndjsonEncoder{}},
+		{"text/event-stream, application/x-ndjson", sseEncoder{}},
+		{"application/x-ndjson;q=0, text/event-stream", sseEncoder{}},
+		{"application/x-ndjson;q=0", sseEncoder{}},
+		{"not a media type;;, application/x-ndjson", ndjsonEncoder{}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		r.Header.Set("Accept", tt.accept)
+		if got := negotiateStreamEncoder(r); got != tt.want {
+			t.Errorf("Accept %q: %T, want %T", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestStreamEncoders(t *testing.T) {
+	chunk := []byte(`{"id":"x","choices":[]}`)
+	tests := []struct {
+		enc        streamEncoder
+		chunk, end string
+	}{
+		{sseEncoder{}, "data: " + string(chunk) + "\n\n", "data: [DONE]\n\n"},
+		{ndjsonEncoder{}, string(chunk) + "\n", ""},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		tt.enc.encode(&buf, chunk)
+		if buf.String() != tt.chunk {
+			t.Errorf("%T chunk = %q, want %q", tt.enc, buf.String(), tt.chunk)
+		}
+		buf.Reset()
+		tt.enc.encode(&buf, []byte("[DONE]"))
+		if buf.String() != tt.end {
+			t.Errorf("%T end = %q, want %q", tt.enc, buf.String(), tt.end)
+		}
+	}
+}
+
+func TestNDJSONStream(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	back.Enqueue(fakeback.Behavior{Chunks: []string{"Hello", ", ", "world"}})
+	w := chatAccepting("application/x-ndjson", `{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("response = %d %v", w.Code, w.Header())
+	}
+	lines := ndjsonLines(t, w.Body.String())
+	for _, line := range lines {
+		if strings.HasPrefix(line, "data:") || line == "[DONE]" {
+			t.Errorf("SSE framing in an NDJSON stream: %q", line)
+		}
+	}
+	if text := choiceText(t, lines)[0]; text != "Hello, world" {
+		t.Errorf("content = %q", text)
+	}
+	if reasons := choiceFinishes(t, lines)[0]; len(reasons) != 1 || reasons[0] != "stop" {
+		t.Errorf("finish reasons = %q", reasons)
+	}
+}
+
+func TestNDJSONAndSSECarryTheSameEvents(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	body := `{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	back.Enqueue(fakeback.Behavior{Chunks: []string{"a", "b"}})
+	sse := sseEvents(chatAccepting("text/event-stream", body).Body.String())
+	back.Enqueue(fakeback.Behavior{Chunks: []string{"a", "b"}})
+	ndjson := ndjsonLines(t, chatAccepting("application/x-ndjson", body).Body.String())
+
+	if len(sse) == 0 || sse[len(sse)-1] != "[DONE]" {
+		t.Fatalf("SSE events = %q", sse)
+	}
+	if len(ndjson) != len(sse)-1 {
+		t.Fatalf("%d NDJSON lines for %d SSE events", len(ndjson), len(sse))
+	}
+	// Only the chunk IDs, which are the request IDs, differ
+	for i := range ndjson {
+		var a, b ChatCompletionChunk
+		json.Unmarshal([]byte(sse[i]), &a)
+		json.Unmarshal([]byte(ndjson[i]), &b)
+		a.ID, b.ID = "", ""
+		x, _ := json.Marshal(a)
+		y, _ := json.Marshal(b)
+		if !bytes.Equal(x, y) {
+			t.Errorf("event %d: SSE %s, NDJSON %s", i, x, y)
+		}
+	}
+}
+
+func TestNDJSONErrorEvent(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	back.Enqueue(fakeback.CutAfter(2, "one two three four"))
+	w := chatAccepting("application/x-ndjson", `{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	lines := ndjsonLines(t, w.Body.String())
+	var cut struct {
+		Error struct {
+			Type        string `json:"type"`
+			ResumeToken string `json:"resume_token"`
+		} `json:"error"`
+	}
+	if json.Unmarshal([]byte(lines[len(lines)-1]), &cut) != nil || cut.Error.Type != "stream_incomplete" || cut.Error.ResumeToken == "" {
+		t.Errorf("last line = %s, want a stream_incomplete error", lines[len(lines)-1])
+	}
+	if text := choiceText(t, lines[:len(lines)-1])[0]; text != "one two" {
+		t.Errorf("content before the cut = %q", text)
+	}
+}
+
+func TestNDJSONBackendErrorIsJSON(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	back.Enqueue(fakeback.Error(http.StatusServiceUnavailable, "overloaded"))
+	w := chatAccepting("application/x-ndjson", `{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusBadGateway || w.Header().Get("Content-Type") != "application/json" || !strings.Contains(w.Body.String(), `"backend_unavailable"`) {
+		t.Errorf("response = %d %s %s, want a 502 JSON error before the stream starts", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+}
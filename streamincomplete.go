@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"slices"
+)
+
+var (
+	// streamsIncomplete counts streams the backend side ended abnormally,
+	// by backend and taxonomy category, keyed "backend:category"
+	streamsIncomplete = expvar.NewMap("gateway_stream_incomplete_total")
+	// streamClientCancels counts streams the client ended, by disconnecting
+	// or through the cancel endpoint; they are not failures
+	streamClientCancels = expvar.NewInt("gateway_stream_client_cancels_total")
+)
+
+// retryableCategories are the failures a retry can get past. The rest would
+// fail the same way again.
+var retryableCategories = []string{errBackendUnavailable, errProxyUnavailable, errTimeout, errRateLimited, errInternal}
+
+// streamBackendError is an error event a backend sent in place of a chunk.
+type streamBackendError struct {
+	classifiedError
+}
+
+func (e *streamBackendError) Error() string {
+	return "backend error event: " + e.Message
+}
+
+// asStreamError recognizes a chunk that is really an error event: an
+// object with an "error" key and none of a chunk's. Streams reach the relay
+// in OpenAI format whatever the backend, so OpenAI's error mapping applies;
+// a category the event doesn't identify is taken as the backend's fault.
+func asStreamError(data []byte, chunk *ChatCompletionChunk) error {
+	if chunk.ID != "" || len(chunk.Choices) > 0 || chunk.Usage != nil {
+		return nil
+	}
+	var probe struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(data, &probe) != nil || len(probe.Error) == 0 || string(probe.Error) == "null" {
+		return nil
+	}
+	c := openaiAdapter{}.parseError(0, nil, data)
+	if c.Type == "" && c.Code == "" {
+		c.category = errBackendUnavailable
+	}
+	return &streamBackendError{c}
+}
+
+// streamFailureCategory places an abnormal stream ending in the gateway
+// taxonomy: the backend's own error event, a timeout, or otherwise a
+// connection that broke or closed without [DONE].
+func streamFailureCategory(ctx context.Context, err error) string {
+	var be *streamBackendError
+	switch {
+	case errors.As(err, &be):
+		return be.category
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(context.Cause(ctx), context.DeadlineExceeded):
+		return errTimeout
+	}
+	return errBackendUnavailable
+}
+
+// endIncomplete closes a stream the backend side ended abnormally with an
+// error event saying so, then [DONE]. The event gives the failure's
+// taxonomy code, how many events the client got before it, and whether a
+// retry is safe: whether it can get past the failure. A retry with the
+// event's resume token doesn't repeat what the client already has.
+func endIncomplete(ctx context.Context, sse *sseWriter, relay *streamRelay, backend *Backend, err error) {
+	category := streamFailureCategory(ctx, err)
+	streamsIncomplete.Add(backend.Name+":"+category, 1)
+	backendErrors.Add(category, 1)
+
+	token := relay.resumeToken()
+	delivered := sse.events
+	retrySafe := slices.Contains(retryableCategories, category)
+	log.Printf("stream_incomplete request_id=%q backend=%q category=%s chunks_delivered=%d retry_safe=%t error=%q",
+		relay.requestID, backend.Name, category, delivered, retrySafe, redactor.redactString(err.Error()))
+
+	message := "The stream ended before it was complete"
+	if retrySafe && token != "" {
+		message += "; retry with X-Resume-Token to continue"
+	}
+	data, _ := json.Marshal(ErrorResponse{Error: ErrorDetail{
+		Message:         message,
+		Type:            "stream_incomplete",
+		Code:            category,
+		ResumeToken:     token,
+		ChunksDelivered: &delivered,
+		RetrySafe:       &retrySafe,
+	}})
+	sse.writeEvent(data)
+	sse.writeDone()
+}
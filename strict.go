@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// strictRequests reports whether request bodies from keyID must not carry
+// unknown fields. STRICT_REQUESTS=true applies to every caller;
+// STRICT_REQUEST_KEYS ("id1,id2") opts in individual HMAC keys.
+func strictRequests(keyID string) bool {
+	if os.Getenv("STRICT_REQUESTS") == "true" {
+		return true
+	}
+	if keyID == "" {
+		return false
+	}
+	for _, id := range strings.Split(os.Getenv("STRICT_REQUEST_KEYS"), ",") {
+		if strings.TrimSpace(id) == keyID {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUnknownFields rejects top-level keys that are neither request fields
+// nor forwarded vendor extensions. Values are replaced with null before
+// decoding so DisallowUnknownFields only sees the top level; message and
+// tool objects are left to the backend.
+func checkUnknownFields(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	top := make(map[string]json.RawMessage, len(raw))
+	for k := range raw {
+		if !slices.Contains(vllmExtensionFields, k) {
+			top[k] = json.RawMessage("null")
+		}
+	}
+	stripped, err := json.Marshal(top)
+	if err != nil {
+		return err
+	}
+
+	type plain ChatCompletionRequest
+	dec := json.NewDecoder(bytes.NewReader(stripped))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(new(plain))
+	quoted, ok := strings.CutPrefix(fmt.Sprint(err), "json: unknown field ")
+	if !ok {
+		return nil
+	}
+	field, _ := strconv.Unquote(quoted)
+	if near := nearestField(field); near != "" {
+		return fmt.Errorf("unknown field %q; did you mean %q?", field, near)
+	}
+	return fmt.Errorf("unknown field %q", field)
+}
+
+// requestFields lists the accepted top-level keys.
+func requestFields() []string {
+	fields := slices.Clone(vllmExtensionFields)
+	t := reflect.TypeFor[ChatCompletionRequest]()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// nearestField suggests the accepted field closest to a misspelled one, or
+// "" when nothing is within a third of its length.
+func nearestField(field string) string {
+	best, bestDist := "", max(len(field)/3, 1)+1
+	for _, known := range requestFields() {
+		if d := editDistance(strings.ToLower(field), known); d < bestDist {
+			best, bestDist = known, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
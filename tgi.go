@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// tgiAdapter translates chat completions to HuggingFace Text Generation
+// Inference's /generate and /generate_stream. TGI takes a single prompt
+// string, so messages are rendered through the model's chat template.
+type tgiAdapter struct{}
+
+// builtinChatTemplates are the chat formats usable by name in a catalog
+// entry's chat_template; anything else is parsed as a Go text/template
+// executed with .Messages.
+var builtinChatTemplates = map[string]string{
+	"llama-3": "<|begin_of_text|>{{range .Messages}}<|start_header_id|>{{.Role}}<|end_header_id|>\n\n{{.Content}}<|eot_id|>{{end}}" +
+		"<|start_header_id|>assistant<|end_header_id|>\n\n",
+	"chatml": "{{range .Messages}}<|im_start|>{{.Role}}\n{{.Content}}<|im_end|>\n{{end}}<|im_start|>assistant\n",
+}
+
+// defaultChatTemplate applies to TGI models without a chat_template.
+const defaultChatTemplate = "chatml"
+
+// parseChatTemplate resolves a built-in name or parses a custom template.
+func parseChatTemplate(name string) (*template.Template, error) {
+	text, ok := builtinChatTemplates[name]
+	if !ok {
+		text = name
+	}
+	return template.New("chat").Option("missingkey=error").Parse(text)
+}
+
+// renderChatTemplate renders messages into a TGI prompt.
+func renderChatTemplate(tmpl *template.Template, messages []Message) (string, error) {
+	var prompt strings.Builder
+	if err := tmpl.Execute(&prompt, struct{ Messages []Message }{messages}); err != nil {
+		return "", err
+	}
+	return prompt.String(), nil
+}
+
+// chatTemplateFor returns the template for a model, looked up by public ID
+// or upstream ID since aliases are resolved before the adapter runs.
+func (c *modelCatalog) chatTemplateFor(model string) *template.Template {
+	m, ok := c.lookup(model)
+	if !ok {
+		m, ok = c.lookupUpstream(model)
+	}
+	if ok && m.chatTemplate != nil {
+		return m.chatTemplate
+	}
+	tmpl, _ := parseChatTemplate(defaultChatTemplate)
+	return tmpl
+}
+
+// TGI request types
+type tgiRequest struct {
+	Inputs     string        `json:"inputs"`
+	Parameters tgiParameters `json:"parameters"`
+}
+
+type tgiParameters struct {
+	MaxNewTokens        *int     `json:"max_new_tokens,omitempty"`
+	Temperature         *float64 `json:"temperature,omitempty"`
+	TopP                *float64 `json:"top_p,omitempty"`
+	Stop                []string `json:"stop,omitempty"`
+	Seed                *int64   `json:"seed,omitempty"`
+	Details             bool     `json:"details"`
+	DecoderInputDetails bool     `json:"decoder_input_details,omitempty"`
+	ReturnFullText      bool     `json:"return_full_text"`
+}
+
+// TGI response types
+type tgiResponse struct {
+	GeneratedText string      `json:"generated_text"`
+	Details       *tgiDetails `json:"details"`
+}
+
+type tgiDetails struct {
+	FinishReason    string            `json:"finish_reason"`
+	GeneratedTokens int               `json:"generated_tokens"`
+	Prefill         []json.RawMessage `json:"prefill"`
+	InputLength     int               `json:"input_length"`
+}
+
+type tgiStreamEvent struct {
+	Token struct {
+		Text    string `json:"text"`
+		Special bool   `json:"special"`
+	} `json:"token"`
+	Details *tgiDetails `json:"details"`
+	Error   string      `json:"error"`
+}
+
+func (tgiAdapter) newRequest(ctx context.Context, backend *Backend, req ChatCompletionRequest, requestID string) (*http.Request, error) {
+	prompt, err := renderChatTemplate(requestCatalog(ctx).chatTemplateFor(req.Model), req.Messages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render chat template: %w", err)
+	}
+
+	body := tgiRequest{
+		Inputs: prompt,
+		Parameters: tgiParameters{
+			MaxNewTokens: req.MaxTokens,
+			Stop:         req.Stop,
+			Seed:         req.Seed,
+			Details:      true,
+			// Prefill tokens are the only prompt count TGI reports outside
+			// of streaming
+			DecoderInputDetails: !req.Stream,
+		},
+	}
+	// TGI rejects temperature 0 and top_p 1; both mean "no sampling
+	// adjustment", which is its default
+	if req.Temperature != nil && *req.Temperature > 0 {
+		body.Parameters.Temperature = req.Temperature
+	}
+	if req.TopP != nil && *req.TopP < 1 {
+		body.Parameters.TopP = req.TopP
+	}
+
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	url := backendURL(backend.URL, "/generate")
+	if req.Stream {
+		url = backendURL(backend.URL, "/generate_stream")
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-Request-ID", requestID)
+	if backend.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+backend.APIKey)
+	}
+	return httpReq, nil
+}
+
+func (tgiAdapter) decodeResponse(body io.Reader) (ChatCompletionResponse, error) {
+	var resp tgiResponse
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return ChatCompletionResponse{}, err
+	}
+
+	response := ChatCompletionResponse{
+		Object: "chat.completion",
+		Choices: []Choice{{
+			Index:        0,
+			Message:      Message{Role: "assistant", Content: resp.GeneratedText},
+			FinishReason: "stop",
+		}},
+	}
+	if d := resp.Details; d != nil {
+		response.Choices[0].FinishReason = tgiFinishReason(d.FinishReason)
+		response.Usage = Usage{
+			PromptTokens:     len(d.Prefill),
+			CompletionTokens: d.GeneratedTokens,
+			TotalTokens:      len(d.Prefill) + d.GeneratedTokens,
+		}
+	}
+	return response, nil
+}
+
+// streamBody converts TGI's token stream into OpenAI chat completion chunks.
+// The final event carries details, which become the finish reason and usage.
+func (tgiAdapter) streamBody(body io.ReadCloser, requestID string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		sse := &sseWriter{w: pw, flusher: nopFlusher{}}
+		sse.writeChunk(ChatCompletionChunk{
+			ID:      requestID,
+			Object:  "chat.completion.chunk",
+			Choices: []ChunkChoice{{Index: 0, Delta: Delta{Role: "assistant"}}},
+		})
+
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data:")
+			if !ok {
+				continue
+			}
+			var event tgiStreamEvent
+			if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &event); err != nil {
+				pw.CloseWithError(fmt.Errorf("invalid tgi stream event: %w", err))
+				return
+			}
+			if event.Error != "" {
+				pw.CloseWithError(fmt.Errorf("tgi: %s", event.Error))
+				return
+			}
+
+			if !event.Token.Special && event.Token.Text != "" {
+				sse.writeChunk(ChatCompletionChunk{
+					ID:      requestID,
+					Object:  "chat.completion.chunk",
+					Choices: []ChunkChoice{{Index: 0, Delta: Delta{Content: event.Token.Text}}},
+				})
+			}
+			if d := event.Details; d != nil {
+				sse.writeChunk(finishChunk(requestID, tgiFinishReason(d.FinishReason)))
+				sse.writeChunk(ChatCompletionChunk{
+					ID:      requestID,
+					Object:  "chat.completion.chunk",
+					Choices: []ChunkChoice{},
+					Usage: &Usage{
+						PromptTokens:     d.InputLength,
+						CompletionTokens: d.GeneratedTokens,
+						TotalTokens:      d.InputLength + d.GeneratedTokens,
+					},
+				})
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		sse.writeDone()
+		pw.Close()
+	}()
+	return &translatedStream{Reader: pr, pipe: pr, upstream: body}
+}
+
+// tgiFinishReason maps TGI finish reasons onto OpenAI's.
+func tgiFinishReason(reason string) string {
+	switch reason {
+	case "length":
+		return "length"
+	default:
+		// eos_token and stop_sequence
+		return "stop"
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+var tgiConversation = []Message{
+	{Role: "system", Content: "Be brief."},
+	{Role: "user", Content: "Hi!"},
+	{Role: "assistant", Content: "Hello."},
+	{Role: "user", Content: "What is 2+2?"},
+}
+
+func TestChatTemplatesGolden(t *testing.T) {
+	golden := map[string]string{
+		"llama-3": "<|begin_of_text|>" +
+			"<|start_header_id|>system<|end_header_id|>\n\nBe brief.<|eot_id|>" +
+			"<|start_header_id|>user<|end_header_id|>\n\nHi!<|eot_id|>" +
+			"<|start_header_id|>assistant<|end_header_id|>\n\nHello.<|eot_id|>" +
+			"<|start_header_id|>user<|end_header_id|>\n\nWhat is 2+2?<|eot_id|>" +
+			"<|start_header_id|>assistant<|end_header_id|>\n\n",
+		"chatml": "<|im_start|>system\nBe brief.<|im_end|>\n" +
+			"<|im_start|>user\nHi!<|im_end|>\n" +
+			"<|im_start|>assistant\nHello.<|im_end|>\n" +
+			"<|im_start|>user\nWhat is 2+2?<|im_end|>\n" +
+			"<|im_start|>assistant\n",
+		"{{range .Messages}}[{{.Role}}] {{.Content}}\n{{end}}[assistant] ": "[system] Be brief.\n[user] Hi!\n[assistant] Hello.\n[user] What is 2+2?\n[assistant] ",
+	}
+	if len(golden) != len(builtinChatTemplates)+1 {
+		t.Fatalf("%d golden prompts for %d built-in templates", len(golden)-1, len(builtinChatTemplates))
+	}
+	for name, want := range golden {
+		tmpl, err := parseChatTemplate(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := renderChatTemplate(tmpl, tgiConversation)
+		if err != nil || got != want {
+			t.Errorf("%s rendered\n%q, %v\nwant\n%q", name, got, err, want)
+		}
+	}
+}
+
+func TestChatTemplateErrors(t *testing.T) {
+	if _, err := parseChatTemplate("{{range .Messages}"); err == nil {
+		t.Error("unclosed action parsed")
+	}
+	tmpl, err := parseChatTemplate("{{.Prompt}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := renderChatTemplate(tmpl, tgiConversation); err == nil {
+		t.Error("template of an unknown field rendered")
+	}
+}
+
+func TestChatTemplateForModel(t *testing.T) {
+	llama, _ := parseChatTemplate("llama-3")
+	c := useCatalog(t, &ModelInfo{ID: "llama", UpstreamModel: "meta-llama/Llama-3-8B", ChatTemplate: "llama-3", chatTemplate: llama})
+	for _, model := range []string{"llama", "meta-llama/Llama-3-8B"} {
+		if got := c.chatTemplateFor(model); got != llama {
+			t.Errorf("%s: not the model's template", model)
+		}
+	}
+	prompt, _ := renderChatTemplate(c.chatTemplateFor("other"), tgiConversation[:1])
+	if prompt != "<|im_start|>system\nBe brief.<|im_end|>\n<|im_start|>assistant\n" {
+		t.Errorf("model without a template rendered %q, want chatml", prompt)
+	}
+}
+
+func TestTGIRequest(t *testing.T) {
+	useCatalog(t)
+	maxTokens, temp, zero, topP, one, seed := 64, 0.7, 0.0, 0.9, 1.0, int64(7)
+	backend := &Backend{Name: "tgi", URL: "http://tgi:8080/", APIKey: "hf-secret"}
+	tests := []struct {
+		name   string
+		req    ChatCompletionRequest
+		path   string
+		params tgiParameters
+	}{
+		{"mapped", ChatCompletionRequest{Model: "m", Messages: tgiConversation[1:2], MaxTokens: &maxTokens, Temperature: &temp, TopP: &topP, Stop: []string{"\n"}, Seed: &seed},
+			"/generate", tgiParameters{MaxNewTokens: &maxTokens, Temperature: &temp, TopP: &topP, Stop: []string{"\n"}, Seed: &seed, Details: true, DecoderInputDetails: true}},
+		{"no sampling", ChatCompletionRequest{Model: "m", Messages: tgiConversation[1:2], Temperature: &zero, TopP: &one},
+			"/generate", tgiParameters{Details: true, DecoderInputDetails: true}},
+		{"stream", ChatCompletionRequest{Model: "m", Messages: tgiConversation[1:2], Stream: true},
+			"/generate_stream", tgiParameters{Details: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := tgiAdapter{}.newRequest(context.Background(), backend, tt.req, "req-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.URL.String() != "http://tgi:8080"+tt.path || r.Header.Get("Authorization") != "Bearer hf-secret" || r.Header.Get("X-Request-ID") != "req-1" {
+				t.Errorf("request = %s %v", r.URL, r.Header)
+			}
+			var body tgiRequest
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Inputs != "<|im_start|>user\nHi!<|im_end|>\n<|im_start|>assistant\n" {
+				t.Errorf("inputs = %q", body.Inputs)
+			}
+			got, _ := json.Marshal(body.Parameters)
+			want, _ := json.Marshal(tt.params)
+			if string(got) != string(want) {
+				t.Errorf("parameters = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestTGIDecodeResponse(t *testing.T) {
+	body := `{"generated_text":"4","details":{"finish_reason":"length","generated_tokens":1,"prefill":[{"id":1},{"id":2},{"id":3}]}}`
+	resp, err := tgiAdapter{}.decodeResponse(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Choices) != 1 || resp.Choices[0].Message != (Message{Role: "assistant", Content: "4"}) || resp.Choices[0].FinishReason != "length" {
+		t.Errorf("choices = %+v", resp.Choices)
+	}
+	if resp.Usage != (Usage{PromptTokens: 3, CompletionTokens: 1, TotalTokens: 4}) {
+		t.Errorf("usage = %+v", resp.Usage)
+	}
+
+	resp, err = tgiAdapter{}.decodeResponse(strings.NewReader(`{"generated_text":"4"}`))
+	if err != nil || resp.Choices[0].FinishReason != "stop" || resp.Usage != (Usage{}) {
+		t.Errorf("without details: %+v, %v", resp, err)
+	}
+}
+
+func TestTGIStream(t *testing.T) {
+	upstream := "data:{\"token\":{\"text\":\"2+2\",\"special\":false}}\n\n" +
+		"data:{\"token\":{\"text\":\" is 4\",\"special\":false}}\n\n" +
+		"data:{\"token\":{\"text\":\"</s>\",\"special\":true},\"details\":{\"finish_reason\":\"eos_token\",\"generated_tokens\":3,\"input_length\":9}}\n\n"
+	out, err := io.ReadAll(tgiAdapter{}.streamBody(io.NopCloser(strings.NewReader(upstream)), "req-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := sseEvents(string(out))
+	if text := choiceText(t, events)[0]; text != "2+2 is 4" {
+		t.Errorf("text = %q", text)
+	}
+	if reasons := choiceFinishes(t, events)[0]; len(reasons) != 1 || reasons[0] != "stop" {
+		t.Errorf("finish reasons = %q", reasons)
+	}
+	var usage ChatCompletionChunk
+	if len(events) < 2 || json.Unmarshal([]byte(events[len(events)-2]), &usage) != nil || usage.Usage == nil ||
+		*usage.Usage != (Usage{PromptTokens: 9, CompletionTokens: 3, TotalTokens: 12}) {
+		t.Errorf("usage chunk = %v", events)
+	}
+	if events[len(events)-1] != "[DONE]" || !strings.Contains(events[0], `"role":"assistant"`) || !strings.Contains(events[0], `"id":"req-1"`) {
+		t.Errorf("events = %q", events)
+	}
+}
+
+func TestTGIStreamError(t *testing.T) {
+	upstream := "data:{\"token\":{\"text\":\"2\",\"special\":false}}\n\ndata:{\"error\":\"Request failed during generation\"}\n\n"
+	_, err := io.ReadAll(tgiAdapter{}.streamBody(io.NopCloser(strings.NewReader(upstream)), "req-1"))
+	if err == nil || !strings.Contains(err.Error(), "Request failed during generation") {
+		t.Errorf("err = %v, want TGI's error", err)
+	}
+}
+
+func TestTGIFinishReason(t *testing.T) {
+	for in, want := range map[string]string{"length": "length", "eos_token": "stop", "stop_sequence": "stop"} {
+		if got := tgiFinishReason(in); got != want {
+			t.Errorf("tgiFinishReason(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backendTTFB tracks time from requesting a backend connection to the first
+// response byte.
+var backendTTFB = newHistogram("gateway_backend_ttfb_seconds", latencyBuckets)
+
+// gatewayTimingHeader opts a request into the split of its time between
+// queueing, the backend and the gateway in the response's gateway field.
+const gatewayTimingHeader = "X-Gateway-Timing"
+
+// timings is the per-request latency breakdown. Trace callbacks can fire on
+// the transport's dial goroutines, so all access goes through mu.
+type timings struct {
+	mu sync.Mutex
+	// queue is time waiting for a concurrency slot and in backend queues
+	queue    time.Duration
+	validate time.Duration
+	dns      time.Duration
+	connect  time.Duration
+	tls      time.Duration
+	ttfb     time.Duration
+	transfer time.Duration
+	post     time.Duration
+	// backend is time in backend calls, from sending each request until
+	// its response was read, plus delays the backend asked for
+	backend time.Duration
+	// backendSince is when the running backend call was sent, if any
+	backendSince time.Time
+	reused       bool
+}
+
+func (t *timings) set(field *time.Duration, d time.Duration) {
+	t.mu.Lock()
+	*field = d
+	t.mu.Unlock()
+}
+
+// add adds d to field, for stages that can happen more than once.
+func (t *timings) add(field *time.Duration, d time.Duration) {
+	t.mu.Lock()
+	*field += d
+	t.mu.Unlock()
+}
+
+// backendCall starts counting a backend call sent at sent. The returned
+// func stops it; it is safe to call more than once.
+func (t *timings) backendCall(sent time.Time) func() {
+	t.mu.Lock()
+	t.backendSince = sent
+	t.mu.Unlock()
+	return sync.OnceFunc(func() {
+		t.mu.Lock()
+		t.backend += time.Since(sent)
+		t.backendSince = time.Time{}
+		t.mu.Unlock()
+	})
+}
+
+// GatewayTiming splits a request's wall time: queue and backend time, and
+// the gateway's own overhead, which is the rest.
+type GatewayTiming struct {
+	QueueMS    float64 `json:"queue_ms"`
+	BackendMS  float64 `json:"backend_ms"`
+	OverheadMS float64 `json:"overhead_ms"`
+}
+
+// split divides the time since start, when the request arrived, by the
+// stages seen so far, a running backend call included.
+func (t *timings) split(start time.Time) *GatewayTiming {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	backend := t.backend
+	if !t.backendSince.IsZero() {
+		backend += now.Sub(t.backendSince)
+	}
+	overhead := max(now.Sub(start)-t.queue-backend, 0)
+	return &GatewayTiming{
+		QueueMS:    ms(t.queue.Round(time.Microsecond)),
+		BackendMS:  ms(backend.Round(time.Microsecond)),
+		OverheadMS: ms(overhead.Round(time.Microsecond)),
+	}
+}
+
+// stampTiming sets the time split in g as of now, when it was asked for.
+func (g *GatewayInfo) stampTiming() {
+	if g != nil && g.timed != nil {
+		g.GatewayTiming = g.timed.Timings.split(g.timed.Start)
+	}
+}
+
+// wantsGatewayTiming reports whether r gets the split in its response:
+// asked for with X-Gateway-Timing, or on by default for its route.
+func wantsGatewayTiming(r *http.Request) bool {
+	if v := r.Header.Get(gatewayTimingHeader); v != "" {
+		return v == "true"
+	}
+	return slices.Contains(gatewayTimingRoutes(), recordFromContext(r.Context()).Route)
+}
+
+// gatewayTimingRoutes lists the GATEWAY_TIMING_ROUTES patterns.
+func gatewayTimingRoutes() []string {
+	var routes []string
+	for _, route := range strings.Split(os.Getenv("GATEWAY_TIMING_ROUTES"), ",") {
+		if route = strings.TrimSpace(route); route != "" {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// checkGatewayTimingRoutes rejects GATEWAY_TIMING_ROUTES patterns that
+// aren't registered.
+func checkGatewayTimingRoutes(patterns []string) error {
+	for _, route := range gatewayTimingRoutes() {
+		if !slices.Contains(patterns, route) {
+			return fmt.Errorf("GATEWAY_TIMING_ROUTES names unknown route %q", route)
+		}
+	}
+	return nil
+}
+
+// trace returns an httptrace hook recording connection and TTFB timings.
+// The trace is attached per request, so it is safe with the shared transport
+// and with reused connections (which simply report no DNS/connect/TLS time).
+func (t *timings) trace() *httptrace.ClientTrace {
+	var getConn, dnsStart, connectStart, tlsStart time.Time
+	return &httptrace.ClientTrace{
+		GetConn: func(string) { getConn = time.Now() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.reused = info.Reused
+			t.mu.Unlock()
+		},
+		DNSStart:          func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:           func(httptrace.DNSDoneInfo) { t.set(&t.dns, time.Since(dnsStart)) },
+		ConnectStart:      func(string, string) { connectStart = time.Now() },
+		ConnectDone:       func(string, string, error) { t.set(&t.connect, time.Since(connectStart)) },
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { t.set(&t.tls, time.Since(tlsStart)) },
+		GotFirstResponseByte: func() {
+			d := time.Since(getConn)
+			t.set(&t.ttfb, d)
+			backendTTFB.observe(d)
+		},
+	}
+}
+
+// withBackendTrace attaches the request's timing trace to ctx.
+func withBackendTrace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, recordFromContext(ctx).Timings.trace())
+}
+
+// stageTimings is a copy of a request's breakdown, taken for the access
+// log, with the split of its time since it arrived.
+type stageTimings struct {
+	queue, validate, dns, connect, tls, ttfb, transfer, post time.Duration
+	backend, overhead                                        time.Duration
+	reused                                                   bool
+}
+
+// stages copies the breakdown, with the split of the time since start.
+func (t *timings) stages(start time.Time) stageTimings {
+	split := t.split(start)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return stageTimings{
+		queue: t.queue, validate: t.validate, dns: t.dns, connect: t.connect, tls: t.tls,
+		ttfb: t.ttfb, transfer: t.transfer, post: t.post, reused: t.reused,
+		backend:  time.Duration(split.BackendMS * float64(time.Millisecond)),
+		overhead: time.Duration(split.OverheadMS * float64(time.Millisecond)),
+	}
+}
+
+// logFields renders the breakdown for the access log.
+func (s stageTimings) logFields() string {
+	return fmt.Sprintf("queue_ms=%.1f validate_ms=%.1f dns_ms=%.1f connect_ms=%.1f tls_ms=%.1f ttfb_ms=%.1f transfer_ms=%.1f post_ms=%.1f backend_ms=%.1f overhead_ms=%.1f conn_reused=%t",
+		ms(s.queue), ms(s.validate), ms(s.dns), ms(s.connect), ms(s.tls), ms(s.ttfb), ms(s.transfer), ms(s.post), ms(s.backend), ms(s.overhead), s.reused)
+}
+
+// setServerTiming adds the Server-Timing header to r's response, for the
+// callers SERVER_TIMING shows it to. The breakdown tells whether the
+// backend connection was new, and how far away it is, so it is only shown
+// to every caller with SERVER_TIMING=true; with SERVER_TIMING=keys only
+// keys allowed server_timing get it.
+func setServerTiming(w http.ResponseWriter, r *http.Request) {
+	switch os.Getenv("SERVER_TIMING") {
+	case "true":
+	case "keys":
+		if !apiKeys.keyAllows(identityFromContext(r.Context()).KeyID, func(k *APIKey) bool { return k.ServerTiming }) {
+			return
+		}
+	default:
+		return
+	}
+	if st := recordFromContext(r.Context()).Timings.serverTiming(); st != "" {
+		w.Header().Set("Server-Timing", st)
+	}
+}
+
+// serverTimingAudience names who SERVER_TIMING shows the header to.
+func serverTimingAudience() string {
+	switch os.Getenv("SERVER_TIMING") {
+	case "true":
+		return "all"
+	case "keys":
+		return "keys"
+	}
+	return "none"
+}
+
+// serverTiming renders a Server-Timing header value. Stages that haven't
+// happened are omitted.
+func (t *timings) serverTiming() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var parts []string
+	for _, stage := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"queue", t.queue}, {"validate", t.validate}, {"dns", t.dns}, {"connect", t.connect},
+		{"tls", t.tls}, {"ttfb", t.ttfb}, {"transfer", t.transfer}, {"post", t.post},
+	} {
+		if stage.d > 0 {
+			parts = append(parts, fmt.Sprintf("%s;dur=%.1f", stage.name, ms(stage.d)))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vinayhpandya/ai_inference_gateway/fakeback"
+)
+
+func testTimings() *timings {
+	return &timings{
+		queue: 2 * time.Millisecond, validate: 500 * time.Microsecond, connect: 3 * time.Millisecond,
+		tls: 4 * time.Millisecond, ttfb: 120 * time.Millisecond, transfer: 10 * time.Millisecond, post: time.Millisecond,
+	}
+}
+
+func TestServerTimingStages(t *testing.T) {
+	// DNS didn't happen, so it's left out
+	want := "queue;dur=2.0, validate;dur=0.5, connect;dur=3.0, tls;dur=4.0, ttfb;dur=120.0, transfer;dur=10.0, post;dur=1.0"
+	if got := testTimings().serverTiming(); got != want {
+		t.Errorf("serverTiming() = %q, want %q", got, want)
+	}
+	if got := (&timings{}).serverTiming(); got != "" {
+		t.Errorf("serverTiming() with no stages = %q", got)
+	}
+}
+
+func TestTimingLogFields(t *testing.T) {
+	tm := testTimings()
+	tm.reused = true
+	fields := tm.stages(time.Now()).logFields()
+	var names []string
+	for _, f := range strings.Fields(fields) {
+		name, value, ok := strings.Cut(f, "=")
+		if !ok || value == "" {
+			t.Fatalf("malformed field %q in %q", f, fields)
+		}
+		names = append(names, name)
+	}
+	want := "queue_ms validate_ms dns_ms connect_ms tls_ms ttfb_ms transfer_ms post_ms backend_ms overhead_ms conn_reused"
+	if strings.Join(names, " ") != want {
+		t.Errorf("fields = %q, want %q", names, want)
+	}
+	for _, want := range []string{"ttfb_ms=120.0", "dns_ms=0.0", "conn_reused=true"} {
+		if !strings.Contains(fields, want) {
+			t.Errorf("fields %q lack %s", fields, want)
+		}
+	}
+	if !regexp.MustCompile(`overhead_ms=\d+\.\d`).MatchString(fields) {
+		t.Errorf("fields %q lack overhead", fields)
+	}
+}
+
+func TestServerTimingIsGated(t *testing.T) {
+	useAPIKeys(t, APIKey{ID: "debugger", ServerTiming: true}, APIKey{ID: "client"})
+	request := func(keyID string) *http.Request {
+		rec := &requestRecord{}
+		rec.Timings.ttfb = 5 * time.Millisecond
+		ctx := context.WithValue(context.Background(), requestRecordKey{}, rec)
+		ctx = context.WithValue(ctx, identityContextKey{}, identity{KeyID: keyID, Method: "api_key"})
+		return httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil).WithContext(ctx)
+	}
+	tests := []struct {
+		mode, key string
+		want      bool
+	}{
+		{"", "debugger", false},
+		{"false", "debugger", false},
+		{"true", "client", true},
+		{"keys", "debugger", true},
+		{"keys", "client", false},
+		{"keys", "", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("SERVER_TIMING", tt.mode)
+		w := httptest.NewRecorder()
+		setServerTiming(w, request(tt.key))
+		if got := w.Header().Get("Server-Timing") != ""; got != tt.want {
+			t.Errorf("SERVER_TIMING=%q, key %q: header set = %t, want %t", tt.mode, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestTimingSplit(t *testing.T) {
+	start := time.Now().Add(-100 * time.Millisecond)
+	tm := &timings{queue: 20 * time.Millisecond, backend: 30 * time.Millisecond}
+	// A call still running counts up to now
+	tm.backendCall(time.Now().Add(-40 * time.Millisecond))
+	split := tm.split(start)
+	wall := ms(time.Since(start))
+	if split.QueueMS != 20 || split.BackendMS < 70 || split.BackendMS > 75 {
+		t.Errorf("split = %+v, want queue 20 and backend about 70", split)
+	}
+	// Each part is rounded to the microsecond
+	if sum := split.QueueMS + split.BackendMS + split.OverheadMS; sum > wall+0.01 || wall-sum > 1 {
+		t.Errorf("split %+v adds up to %.3fms, wall %.3fms", split, sum, wall)
+	}
+
+	// Stopping a call is idempotent
+	tm = &timings{}
+	done := tm.backendCall(time.Now().Add(-10 * time.Millisecond))
+	done()
+	done()
+	if tm.backend < 10*time.Millisecond || tm.backend > 15*time.Millisecond || !tm.backendSince.IsZero() {
+		t.Errorf("backend = %s after stopping twice", tm.backend)
+	}
+
+	// Overhead never goes negative, even with more queue time than wall
+	tm = &timings{queue: time.Second}
+	if split := tm.split(time.Now()); split.OverheadMS != 0 {
+		t.Errorf("overhead = %v, want 0", split.OverheadMS)
+	}
+}
+
+// timedChat sends body as a chat completion asking for the gateway timing,
+// and returns the response with the wall time the handler took.
+func timedChat(t *testing.T, body string) (*httptest.ResponseRecorder, float64) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	r.Header.Set(gatewayTimingHeader, "true")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	accessLog(http.HandlerFunc(chatCompletionsHandler)).ServeHTTP(w, r)
+	wall := ms(time.Since(start))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	return w, wall
+}
+
+// checkAccounting fails unless split adds up to wall, it having been taken
+// at most slack before the response was done, and backend took at least
+// backend.
+func checkAccounting(t *testing.T, split *GatewayTiming, wall float64, backend time.Duration) {
+	t.Helper()
+	if split == nil {
+		t.Fatal("response has no gateway timing")
+	}
+	const slack = 25.0
+	sum := split.QueueMS + split.BackendMS + split.OverheadMS
+	if sum > wall+0.01 || wall-sum > slack {
+		t.Errorf("split %+v adds up to %.1fms, wall %.1fms", split, sum, wall)
+	}
+	if split.BackendMS < ms(backend) || split.BackendMS > ms(backend)+slack {
+		t.Errorf("backend_ms = %.1f, want about %.1f", split.BackendMS, ms(backend))
+	}
+	if split.OverheadMS < 0 || split.OverheadMS > slack {
+		t.Errorf("overhead_ms = %.1f, want a few milliseconds", split.OverheadMS)
+	}
+}
+
+// accessLogSplit returns the duration and timing split of the last
+// access log line.
+func accessLogSplit(t *testing.T, logs string) (duration, queue, backend, overhead float64) {
+	t.Helper()
+	lines := strings.Split(strings.TrimSpace(logs), "\n")
+	line := lines[len(lines)-1]
+	field := func(pattern string) float64 {
+		m := regexp.MustCompile(pattern).FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("access log %q lacks %s", line, pattern)
+		}
+		v, _ := strconv.ParseFloat(m[1], 64)
+		return v
+	}
+	d, err := time.ParseDuration(regexp.MustCompile(`duration=(\S+)`).FindStringSubmatch(line)[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ms(d), field(`queue_ms=([\d.]+)`), field(`backend_ms=([\d.]+)`), field(`overhead_ms=([\d.]+)`)
+}
+
+func TestGatewayTimingAddsUpToWallTime(t *testing.T) {
+	logs := captureLog(t)
+	back := useFakeBackend(t)
+	const latency = 150 * time.Millisecond
+	back.Enqueue(fakeback.Slow(latency, "ok"))
+
+	w, wall := timedChat(t, `{"model":"m","messages":[{"role":"user","content":"hi"}]}`)
+	var resp ChatCompletionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	checkAccounting(t, resp.Gateway.GatewayTiming, wall, latency)
+	if resp.Gateway.QueueMS > 1 {
+		t.Errorf("queue_ms = %v with nothing queued", resp.Gateway.QueueMS)
+	}
+
+	// The access log splits the same way, whether asked for or not
+	duration, queue, backend, overhead := accessLogSplit(t, logs.String())
+	if sum := queue + backend + overhead; sum < duration-1 || sum > duration+1 {
+		t.Errorf("logged split %.1f+%.1f+%.1f, duration %.0fms", queue, backend, overhead, duration)
+	}
+	if backend < ms(latency) {
+		t.Errorf("logged backend_ms = %.1f, want at least %.1f", backend, ms(latency))
+	}
+}
+
+func TestGatewayTimingInFinalStreamChunk(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	const latency, chunkDelay = 50 * time.Millisecond, 40 * time.Millisecond
+	back.Enqueue(fakeback.Behavior{Latency: latency, ChunkDelay: chunkDelay, Chunks: []string{"a", "b", "c"}})
+
+	w, wall := timedChat(t, `{"model":"m","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`)
+	var timed []ChatCompletionChunk
+	for _, e := range sseEvents(w.Body.String()) {
+		var chunk ChatCompletionChunk
+		if json.Unmarshal([]byte(e), &chunk) == nil && chunk.Gateway != nil {
+			timed = append(timed, chunk)
+		}
+	}
+	if len(timed) != 1 || timed[0].Usage == nil {
+		t.Fatalf("gateway timing in %d chunks, want only the usage chunk: %s", len(timed), w.Body)
+	}
+	// The backend is still sending [DONE] when the usage chunk is stamped
+	checkAccounting(t, timed[0].Gateway.GatewayTiming, wall, latency+2*chunkDelay)
+}
+
+func TestGatewayTimingCountsBackendQueue(t *testing.T) {
+	captureLog(t)
+	back := useFakeBackend(t)
+	t.Setenv("BACKEND_URL", "")
+	queue := &BackendQueue{MaxConcurrent: 1, Timeout: "5s"}
+	if err := queue.validate(); err != nil {
+		t.Fatal(err)
+	}
+	c := useCatalog(t, &ModelInfo{ID: "m", Backend: t.Name()})
+	c.backends[t.Name()] = &Backend{Name: t.Name(), Type: "openai", URL: back.URL, Queue: queue}
+	const latency = 100 * time.Millisecond
+	back.SetDefault(fakeback.Slow(latency, "ok"))
+
+	// The first request holds the backend's one slot while the second waits
+	var wg sync.WaitGroup
+	wg.Go(func() { chatAs("", `{"model":"m","messages":[{"role":"user","content":"first"}]}`) })
+	for len(back.Requests()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	w, wall := timedChat(t, `{"model":"m","messages":[{"role":"user","content":"second"}]}`)
+	wg.Wait()
+
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	checkAccounting(t, resp.Gateway.GatewayTiming, wall, latency)
+	if q := resp.Gateway.QueueMS; q < ms(latency)/2 || q > ms(latency)+25 {
+		t.Errorf("queue_ms = %.1f, want most of the first request's %.0fms", q, ms(latency))
+	}
+}
+
+func TestWantsGatewayTiming(t *testing.T) {
+	t.Setenv("GATEWAY_TIMING_ROUTES", "POST /v1/chat/completions, POST /v1/responses")
+	tests := []struct {
+		route, header string
+		want          bool
+	}{
+		{"POST /v1/chat/completions", "", true},
+		{"POST /v1/chat/completions", "false", false},
+		{"POST /v1/embeddings", "", false},
+		{"POST /v1/embeddings", "true", true},
+		{"POST /v1/embeddings", "yes", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), requestRecordKey{}, &requestRecord{Route: tt.route}))
+		if tt.header != "" {
+			r.Header.Set(gatewayTimingHeader, tt.header)
+		}
+		if got := wantsGatewayTiming(r); got != tt.want {
+			t.Errorf("%s with %s=%q: %t, want %t", tt.route, gatewayTimingHeader, tt.header, got, tt.want)
+		}
+	}
+
+	patterns := []string{"POST /v1/chat/completions", "POST /v1/responses"}
+	if err := checkGatewayTimingRoutes(patterns); err != nil {
+		t.Error(err)
+	}
+	t.Setenv("GATEWAY_TIMING_ROUTES", "POST /v1/chat")
+	if err := checkGatewayTimingRoutes(patterns); err == nil {
+		t.Error("unknown route accepted")
+	}
+}
+
+func TestNoGatewayTimingUnlessAsked(t *testing.T) {
+	captureLog(t)
+	useFakeBackend(t)
+	w := chatAs("", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`)
+	if strings.Contains(w.Body.String(), "overhead_ms") {
+		t.Errorf("response = %s, want no gateway timing", w.Body)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"slices"
+)
+
+// tokenBreakdownHeader opts a request into a per-message prompt token
+// breakdown in the response's gateway field.
+const tokenBreakdownHeader = "X-Gateway-Token-Breakdown"
+
+// GatewayInfo holds extras the gateway adds to a response when asked, or
+// when the request took part in a prompt experiment or was sent to a
+// deterministic route.
+type GatewayInfo struct {
+	TokenBreakdown *TokenBreakdown       `json:"token_breakdown,omitempty"`
+	Experiment     *ExperimentAssignment `json:"experiment,omitempty"`
+	Determinism    *Determinism          `json:"determinism,omitempty"`
+	// GatewayTiming, with X-Gateway-Timing, is set by stampTiming from
+	// timed as the response is written
+	*GatewayTiming
+	timed *requestRecord
+}
+
+// TokenBreakdown attributes the prompt's estimated tokens to the messages
+// sent to the backend, after stored history was prepended and the
+// conversation fitted to the context window.
+type TokenBreakdown struct {
+	Messages []MessageTokens `json:"messages"`
+	// Tools counts the tool definitions
+	Tools int `json:"tools"`
+	// InjectedSystem counts system messages the gateway added, such as a
+	// summary of truncated history
+	InjectedSystem int `json:"injected_system"`
+	Total          int `json:"total"`
+	// Method is how tokens were counted; "estimate" is the gateway's
+	// ~4 characters per token, the same estimate used for missing usage
+	Method string `json:"method"`
+}
+
+// MessageTokens is one message's share of the prompt.
+type MessageTokens struct {
+	Index int    `json:"index"`
+	Role  string `json:"role"`
+	// Source is request, history (from X-Conversation-ID) or gateway
+	Source string `json:"source"`
+	Tokens int    `json:"tokens"`
+}
+
+func wantsTokenBreakdown(r *http.Request) bool {
+	return r.Header.Get(tokenBreakdownHeader) == "true"
+}
+
+// tokenBreakdown attributes req's prompt to its messages. sent are the
+// messages the client sent with this request and history those loaded from
+// the conversation store; anything else was added by the gateway.
+func tokenBreakdown(req ChatCompletionRequest, sent, history []Message) *GatewayInfo {
+	b := &TokenBreakdown{Messages: make([]MessageTokens, len(req.Messages)), Method: "estimate"}
+	for i, m := range req.Messages {
+		source := "gateway"
+		switch {
+		case slices.Contains(sent, m):
+			source = "request"
+		case slices.Contains(history, m):
+			source = "history"
+		}
+		n := approximateTokens(m.Content)
+		b.Messages[i] = MessageTokens{Index: i, Role: m.Role, Source: source, Tokens: n}
+		b.Total += n
+		if source == "gateway" && m.Role == "system" {
+			b.InjectedSystem += n
+		}
+	}
+	for _, tool := range req.Tools {
+		b.Tools += approximateTokens(string(tool))
+	}
+	b.Total += b.Tools
+	return &GatewayInfo{TokenBreakdown: b}
+}
+
+// withGatewayField appends a "gateway" field to an encoded JSON object,
+// leaving its other bytes as they were.
+func withGatewayField(data []byte, info *GatewayInfo) []byte {
+	i := bytes.LastIndexByte(data, '}')
+	field, err := json.Marshal(info)
+	if i < 0 || err != nil {
+		return data
+	}
+	out := make([]byte, 0, len(data)+len(field)+12)
+	out = append(out, bytes.TrimRight(data[:i], " \t\r\n")...)
+	if out[len(out)-1] != '{' {
+		out = append(out, ',')
+	}
+	out = append(out, `"gateway":`...)
+	out = append(out, field...)
+	return append(out, data[i:]...)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// TokenizeRequest is the body of POST /v1/tokenize: either text or chat
+// messages (rendered with the model's chat template by the backend).
+type TokenizeRequest struct {
+	Model          string    `json:"model"`
+	Text           *string   `json:"text,omitempty"`
+	Messages       []Message `json:"messages,omitempty"`
+	ReturnTokenIDs bool      `json:"return_token_ids,omitempty"`
+}
+
+type TokenizeResponse struct {
+	Model       string `json:"model"`
+	Count       int    `json:"count"`
+	MaxModelLen int    `json:"max_model_len,omitempty"`
+	Tokens      []int  `json:"tokens,omitempty"`
+}
+
+type DetokenizeRequest struct {
+	Model  string `json:"model"`
+	Tokens []int  `json:"tokens"`
+}
+
+type DetokenizeResponse struct {
+	Model string `json:"model"`
+	Text  string `json:"text"`
+}
+
+// tokenizerBackend resolves the vLLM backend in c that can tokenize for
+// model, writing a 404 listing the tokenizable models when there is none.
+func tokenizerBackend(w http.ResponseWriter, c *modelCatalog, model string) (*Backend, bool) {
+	if model == "" {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "missing_model", "model is required")
+		return nil, false
+	}
+	if b := c.routeBackend(model); b.Type == "vllm" {
+		return b, true
+	}
+
+	var tokenizable []string
+	for _, m := range c.sorted() {
+		if c.routeBackend(m.ID).Type == "vllm" {
+			tokenizable = append(tokenizable, m.ID)
+		}
+	}
+	msg := fmt.Sprintf("Model %q has no tokenizer; tokenizable models: %s", model, strings.Join(tokenizable, ", "))
+	if len(tokenizable) == 0 {
+		msg = fmt.Sprintf("Model %q has no tokenizer; no tokenizable models are configured", model)
+	}
+	writeJSONError(w, http.StatusNotFound, "invalid_request_error", "model_not_tokenizable", msg)
+	return nil, false
+}
+
+// countPromptTokens counts messages with model's vLLM tokenizer, as
+// /v1/tokenize does. It reports false for models without one, or when the
+// backend can't count them, so callers can fall back to an estimate.
+func countPromptTokens(ctx context.Context, model string, messages []Message) (int, bool) {
+	c := requestCatalog(ctx)
+	backend := c.routeBackend(model)
+	if backend.Type != "vllm" {
+		return 0, false
+	}
+	body, err := json.Marshal(map[string]any{"model": c.upstreamModel(model), "messages": messages, "add_generation_prompt": true})
+	if err != nil {
+		return 0, false
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, backendURL(backend.URL, "/tokenize"), bytes.NewReader(body))
+	if err != nil {
+		return 0, false
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := poolFor(backend).client.Do(httpReq)
+	if err != nil {
+		log.Printf("Counting prompt tokens for %s failed: %v", model, err)
+		return 0, false
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Count int `json:"count"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&out) != nil {
+		return 0, false
+	}
+	return out.Count, true
+}
+
+// tokenizeHandler counts tokens for text or messages using the model's
+// vLLM backend's /tokenize, so clients can budget prompts exactly.
+func tokenizeHandler(w http.ResponseWriter, r *http.Request) {
+	var req TokenizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if rejectOverLimit(w, err) {
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_json", "Invalid JSON: "+describeJSONError(err))
+		return
+	}
+	if (req.Text == nil) == (len(req.Messages) == 0) {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_tokenize_input", "Provide exactly one of text or messages")
+		return
+	}
+	c := requestCatalog(r.Context())
+	backend, ok := tokenizerBackend(w, c, req.Model)
+	if !ok {
+		return
+	}
+
+	upstream := map[string]any{"model": c.upstreamModel(req.Model)}
+	if req.Text != nil {
+		upstream["prompt"] = *req.Text
+	} else {
+		upstream["messages"] = req.Messages
+		upstream["add_generation_prompt"] = true
+	}
+	var resp struct {
+		Count       int   `json:"count"`
+		MaxModelLen int   `json:"max_model_len"`
+		Tokens      []int `json:"tokens"`
+	}
+	if !vllmCall(r.Context(), w, backend, "/tokenize", upstream, &resp) {
+		return
+	}
+
+	out := TokenizeResponse{Model: req.Model, Count: resp.Count, MaxModelLen: resp.MaxModelLen}
+	if req.ReturnTokenIDs {
+		out.Tokens = resp.Tokens
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// detokenizeHandler turns token IDs back into text via /detokenize.
+func detokenizeHandler(w http.ResponseWriter, r *http.Request) {
+	var req DetokenizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_json", "Invalid JSON: "+describeJSONError(err))
+		return
+	}
+	c := requestCatalog(r.Context())
+	backend, ok := tokenizerBackend(w, c, req.Model)
+	if !ok {
+		return
+	}
+
+	upstream := map[string]any{"model": c.upstreamModel(req.Model), "tokens": req.Tokens}
+	var resp struct {
+		Prompt string `json:"prompt"`
+	}
+	if !vllmCall(r.Context(), w, backend, "/detokenize", upstream, &resp) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DetokenizeResponse{Model: req.Model, Text: resp.Prompt})
+}
+
+// vllmCall posts body to a vLLM utility endpoint and decodes the reply into
+// out. Failures are written to w and reported as false; backend 4xx bodies
+// are relayed so clients see vLLM's validation message.
+func vllmCall(ctx context.Context, w http.ResponseWriter, backend *Backend, path string, body, out any) bool {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "internal_error", "Failed to encode request")
+		return false
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, backendURL(backend.URL, path), bytes.NewReader(reqBody))
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, "server_error", "backend_error", fmt.Sprintf("Backend error: %v", err))
+		return false
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := poolFor(backend).client.Do(httpReq)
+	if err != nil {
+		log.Printf("Backend error: %v", err)
+		writeJSONError(w, http.StatusBadGateway, "server_error", "backend_error", fmt.Sprintf("Backend error: %v", err))
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return false
+	}
+	if resp.StatusCode != http.StatusOK {
+		writeJSONError(w, http.StatusBadGateway, "server_error", "backend_error", fmt.Sprintf("Backend returned status %d", resp.StatusCode))
+		return false
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		writeJSONError(w, http.StatusBadGateway, "server_error", "backend_error", fmt.Sprintf("Invalid backend response: %v", err))
+		return false
+	}
+	return true
+}
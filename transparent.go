@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transparentModelHeader names the model of a transparent request, which
+// the gateway never reads from the body.
+const transparentModelHeader = "X-Gateway-Model"
+
+// transparentRequests counts requests relayed by transparent routes, by path.
+var transparentRequests = expvar.NewMap("gateway_transparent_requests_total")
+
+// transparentRoutes is nil unless TRANSPARENT_ROUTES is set.
+var transparentRoutes *transparentProxy
+
+// transparentProxy relays the bodies of its routes to backends byte for
+// byte. Only headers are read: auth, the request ID and the model to route
+// by, from X-Gateway-Model.
+type transparentProxy struct {
+	paths []string
+}
+
+// gatewayOnlyPaths are served by the gateway itself and can't be relayed.
+var gatewayOnlyPaths = []string{"/v1/models", "/v1/tokenize", "/v1/detokenize", "/v1/files", "/v1/batches"}
+
+// loadTransparentProxy reads TRANSPARENT_ROUTES, a comma-separated list of
+// POST paths under /v1/, such as /v1/chat/completions,/v1/embeddings. It
+// fails when a configured feature needs to read request bodies, since
+// transparent routes would silently bypass it.
+func loadTransparentProxy() (*transparentProxy, error) {
+	raw := os.Getenv("TRANSPARENT_ROUTES")
+	if raw == "" {
+		return nil, nil
+	}
+	p := &transparentProxy{}
+	for _, path := range strings.Split(raw, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		if !strings.HasPrefix(path, "/v1/") || strings.ContainsAny(path, "{}?# ") || strings.HasSuffix(path, "/") {
+			return nil, fmt.Errorf("invalid TRANSPARENT_ROUTES path %q: want a path under /v1/, such as /v1/chat/completions", path)
+		}
+		for _, own := range gatewayOnlyPaths {
+			if path == own || strings.HasPrefix(path, own+"/") {
+				return nil, fmt.Errorf("TRANSPARENT_ROUTES path %q is served by the gateway itself", path)
+			}
+		}
+		if !slices.Contains(p.paths, path) {
+			p.paths = append(p.paths, path)
+		}
+	}
+	if len(p.paths) == 0 {
+		return nil, nil
+	}
+
+	for _, f := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"RESPONSE_CACHE_TTL (the response cache)", responseCache != nil},
+		{"GUARDRAILS", guardrails != nil},
+		{"STRICT_REQUESTS", os.Getenv("STRICT_REQUESTS") == "true" || os.Getenv("STRICT_REQUEST_KEYS") != ""},
+		{"CONTEXT_TRUNCATION", os.Getenv("CONTEXT_TRUNCATION") != ""},
+	} {
+		if f.enabled {
+			return nil, fmt.Errorf("TRANSPARENT_ROUTES can't be combined with %s, which reads request bodies", f.name)
+		}
+	}
+	if err := p.checkCatalog(catalog.Load()); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// checkCatalog rejects catalogs whose models set max_output_tokens or
+// require_user_message: neither can be applied without reading the body.
+func (p *transparentProxy) checkCatalog(c *modelCatalog) error {
+	if p == nil {
+		return nil
+	}
+	for _, m := range c.sorted() {
+		if m.MaxOutputTokens > 0 {
+			return fmt.Errorf("model %q sets max_output_tokens, which TRANSPARENT_ROUTES can't enforce", m.ID)
+		}
+		if m.RequireUserMessage {
+			return fmt.Errorf("model %q sets require_user_message, which TRANSPARENT_ROUTES can't enforce", m.ID)
+		}
+	}
+	return nil
+}
+
+func (p *transparentProxy) covers(path string) bool {
+	return p != nil && slices.Contains(p.paths, path)
+}
+
+// wrap serves path transparently when it is one of p's routes, and with h
+// otherwise.
+func (p *transparentProxy) wrap(path string, h http.HandlerFunc) http.HandlerFunc {
+	if p.covers(path) {
+		return transparentHandler
+	}
+	return h
+}
+
+// bodySetting names a setting of key id, or its parent, that needs the
+// request body to apply, or returns "" when there is none.
+func (s *apiKeyStore) bodySetting(id string) string {
+	if s == nil {
+		return ""
+	}
+	for _, k := range s.index.Load().lineage(id) {
+		switch {
+		case k.TokenBudget > 0:
+			return "token_budget"
+		case k.Defaults != nil:
+			return "defaults"
+		case k.SystemPrompt != "":
+			return "system_prompt"
+		case k.RequireUser:
+			return "require_user"
+		}
+	}
+	return ""
+}
+
+// transparentHandler relays a request to the backend for the model named
+// in X-Gateway-Model, or the default backend without one, and relays the
+// response back as it comes. Usage isn't known, so nothing is billed or
+// counted by token.
+func transparentHandler(w http.ResponseWriter, r *http.Request) {
+	requestID := requestIDFrom(r)
+	w.Header().Set("X-Request-ID", requestID)
+
+	rec := recordFromContext(r.Context())
+	rec.RequestID = requestID
+	rec.KeyID = identityFromContext(r.Context()).KeyID
+	models := rec.admittedCatalog()
+	model, _ := models.resolveName(r.Header.Get(transparentModelHeader))
+	rec.Model = model
+
+	if setting := apiKeys.bodySetting(rec.KeyID); setting != "" {
+		writeJSONError(w, http.StatusForbidden, "permission_error", "transparent_not_allowed",
+			fmt.Sprintf("This key's %s can't be applied on transparent route %s", setting, r.URL.Path))
+		return
+	}
+	if !apiKeys.allowsModel(rec.KeyID, model) {
+		writeJSONError(w, http.StatusForbidden, "permission_error", "model_not_allowed", fmt.Sprintf("This key may not use model %q", model))
+		return
+	}
+	if err := models.checkDeprecation(w, model); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "model_sunset", err.Error())
+		return
+	}
+	if models.ensembleFor(model) != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "unsupported_model",
+			fmt.Sprintf("Ensemble model %q can't be used on transparent route %s", model, r.URL.Path))
+		return
+	}
+
+	decision, err := requestRouter.Route(r.Context(), &RequestContext{
+		RequestID: requestID,
+		KeyID:     rec.KeyID,
+		Header:    r.Header,
+		Request:   &ChatCompletionRequest{Model: model},
+	})
+	if err == nil && len(decision.Targets) == 0 {
+		err = fmt.Errorf("router %s returned no backend for model %q", requestRouterName, model)
+	}
+	if err != nil {
+		var routeErr *RouteError
+		if errors.As(err, &routeErr) {
+			writeJSONError(w, routeErr.Status, routeErr.Type, routeErr.Code, routeErr.Message)
+			return
+		}
+		log.Printf("Routing %s failed: %v", requestID, err)
+		writeJSONError(w, http.StatusBadGateway, "server_error", "routing_failed", "No backend is available for this request")
+		return
+	}
+	backend := decision.Targets[0].Backend
+	rec.Backend = backend.Name
+	if backend == echoBackend {
+		writeJSONError(w, http.StatusBadGateway, "server_error", "no_backend",
+			fmt.Sprintf("Transparent route %s has no backend for model %q: set %s to a catalog model, or BACKEND_URL", r.URL.Path, model, transparentModelHeader))
+		return
+	}
+	if backend.Type != "openai" && backend.Type != "vllm" {
+		writeJSONError(w, http.StatusBadGateway, "server_error", "unsupported_backend",
+			fmt.Sprintf("Backend for model %q is not OpenAI-compatible, which transparent routes need", model))
+		return
+	}
+	if !selfTests.healthy(backend) {
+		writeJSONError(w, http.StatusServiceUnavailable, "server_error", "backend_unhealthy",
+			fmt.Sprintf("Backend for model %q is failing its self-test", model))
+		return
+	}
+	if retryAfter, shed := shouldShed(backend, r.Header.Get("X-Priority-Class")); shed {
+		shedRequests.Add(backend.Name, 1)
+		gatewayRateLimited.Add("backend_overloaded", 1)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		writeJSONError(w, http.StatusTooManyRequests, "rate_limit_error", "backend_overloaded",
+			fmt.Sprintf("Backend for model %q is overloaded; retry later", model))
+		return
+	}
+	release, status, err := queueFor(backend).acquire(r.Context())
+	if err != nil {
+		if status != nil {
+			writeQueueRejection(w, model, backend, status, err)
+		}
+		return
+	}
+	defer release()
+	backendRequests.Add(backend.Name, 1)
+	transparentRequests.Add(r.URL.Path, 1)
+
+	endpoint := backend.atEndpoint(pickEndpoint(backend, nil))
+	path := r.URL.Path
+	switch path {
+	case defaultChatPath:
+		path = endpoint.chatPath()
+	case defaultResponsesPath:
+		path = endpoint.responsesPath()
+	}
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	upstream, err := http.NewRequestWithContext(withBackendTrace(r.Context()), r.Method, backendURL(endpoint.URL, path), r.Body)
+	if err != nil {
+		writeBackendError(w, fmt.Errorf("failed to create request: %w", err), backend)
+		return
+	}
+	upstream.ContentLength = r.ContentLength
+	copyHeaders(upstream.Header, r.Header)
+	// The gateway's own credentials and routing header stay here
+	upstream.Header.Del("Authorization")
+	upstream.Header.Del(transparentModelHeader)
+	upstream.Header.Set("X-Request-ID", requestID)
+	setForwardingHeaders(r.Context(), upstream, backend)
+	// An explicit Accept-Encoding also keeps the transport from decoding
+	// the response
+	if upstream.Header.Get("Accept-Encoding") == "" {
+		upstream.Header.Set("Accept-Encoding", "identity")
+	}
+
+	defer startEndpointRequest(endpoint.URL)()
+	defer rec.Timings.backendCall(time.Now())()
+	resp, err := poolFor(backend).stream.Do(upstream)
+	if err != nil {
+		log.Printf("Backend error: %v", err)
+		noteBackendFailure(backend, fmt.Errorf("failed to forward request: %w", err))
+		writeBackendError(w, fmt.Errorf("failed to forward request: %w", err), backend)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		backendErrors.Add(errBackendUnavailable, 1)
+	}
+
+	copyHeaders(w.Header(), resp.Header)
+	w.Header().Set("X-Request-ID", requestID)
+	w.WriteHeader(resp.StatusCode)
+	transferStart := time.Now()
+	if err := copyFlushing(w, resp.Body); err != nil {
+		log.Printf("Error relaying transparent response for %s: %v", requestID, err)
+	}
+	rec.Timings.set(&rec.Timings.transfer, time.Since(transferStart))
+}
+
+// hopHeaders apply to one connection and are never relayed.
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// copyHeaders adds src's end-to-end headers to dst.
+func copyHeaders(dst, src http.Header) {
+	for name, values := range src {
+		if slices.Contains(hopHeaders, name) {
+			continue
+		}
+		for _, v := range values {
+			dst.Add(name, v)
+		}
+	}
+	for _, token := range strings.Split(src.Get("Connection"), ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			dst.Del(token)
+		}
+	}
+}
+
+// copyFlushing copies src to w, flushing after every read so streams reach
+// the client as the backend sends them.
+func copyFlushing(w http.ResponseWriter, src io.Reader) error {
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			rc.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
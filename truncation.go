@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Context truncation applies when a model's catalog context_window is set
+// and CONTEXT_TRUNCATION selects a strategy:
+//
+//	drop       remove the oldest non-system messages until the prompt fits
+//	summarize  replace the oldest SUMMARIZE_MESSAGES messages with a system
+//	           note written by SUMMARIZER_MODEL, then drop if still too long
+//
+// The last message and leading system messages are always kept. Prompt
+// size uses the gateway's token estimate, leaving room for max_tokens.
+
+// summarizerTokens counts tokens spent on summaries, by the key whose
+// request triggered them.
+var summarizerTokens = expvar.NewMap("gateway_summarizer_tokens_total")
+
+// maxSummaryCacheEntries bounds the summary cache; it is cleared when full.
+const maxSummaryCacheEntries = 1000
+
+var summaryCache = struct {
+	sync.Mutex
+	entries map[string]string
+}{entries: make(map[string]string)}
+
+const summarizerInstruction = "Summarize the following conversation excerpt for use as context in the rest of the conversation. " +
+	"Keep every fact, name, number, decision and open question; omit pleasantries. Reply with the summary only."
+
+// fitContext trims messages to the model's context window using the
+// configured strategy. owner is the key charged for summarizer usage.
+func fitContext(ctx context.Context, model, owner string, req ChatCompletionRequest) []Message {
+	strategy := os.Getenv("CONTEXT_TRUNCATION")
+	m, ok := requestCatalog(ctx).lookup(model)
+	if strategy == "" || !ok || m.ContextWindow == 0 {
+		return req.Messages
+	}
+	budget := m.ContextWindow
+	if req.MaxTokens != nil {
+		budget -= *req.MaxTokens
+	}
+
+	messages := req.Messages
+	if estimatePromptTokens(messages) <= budget {
+		return messages
+	}
+	// A dry run must not call the summarizer; it reports plain truncation
+	if strategy == "summarize" && !inDryRun(ctx) {
+		if summarized, err := summarizeOldest(ctx, owner, messages); err != nil {
+			log.Printf("Summarization failed, falling back to truncation: %v", err)
+		} else {
+			messages = summarized
+		}
+	}
+	return dropOldest(messages, budget)
+}
+
+// leadingSystem counts the system messages at the start of messages.
+func leadingSystem(messages []Message) int {
+	n := 0
+	for n < len(messages) && messages[n].Role == "system" {
+		n++
+	}
+	return n
+}
+
+// dropOldest removes the oldest messages after the leading system messages
+// until the estimate fits budget or only the last message remains.
+func dropOldest(messages []Message, budget int) []Message {
+	head := leadingSystem(messages)
+	out := append([]Message(nil), messages...)
+	for estimatePromptTokens(out) > budget && len(out)-head > 1 {
+		out = append(out[:head], out[head+1:]...)
+	}
+	return out
+}
+
+// summarizeOldest replaces up to SUMMARIZE_MESSAGES (default 10) of the
+// oldest non-system messages with a summary, reusing a cached summary when
+// the same messages were summarized before.
+func summarizeOldest(ctx context.Context, owner string, messages []Message) ([]Message, error) {
+	model := os.Getenv("SUMMARIZER_MODEL")
+	if model == "" {
+		return nil, fmt.Errorf("SUMMARIZER_MODEL is not set")
+	}
+	k := 10
+	if v, err := strconv.Atoi(os.Getenv("SUMMARIZE_MESSAGES")); err == nil && v > 1 {
+		k = v
+	}
+
+	head := leadingSystem(messages)
+	end := min(head+k, len(messages)-1)
+	if end-head < 2 {
+		return nil, fmt.Errorf("too few messages to summarize")
+	}
+	oldest := messages[head:end]
+
+	hash := sha256.New()
+	for _, msg := range oldest {
+		fmt.Fprintf(hash, "%s\x00%s\x00", msg.Role, msg.Content)
+	}
+	key := model + ":" + hex.EncodeToString(hash.Sum(nil))
+
+	summaryCache.Lock()
+	summary, cached := summaryCache.entries[key]
+	summaryCache.Unlock()
+
+	if !cached {
+		var err error
+		summary, err = summarize(ctx, model, owner, oldest)
+		if err != nil {
+			return nil, err
+		}
+		summaryCache.Lock()
+		if len(summaryCache.entries) >= maxSummaryCacheEntries {
+			summaryCache.entries = make(map[string]string)
+		}
+		summaryCache.entries[key] = summary
+		summaryCache.Unlock()
+	}
+
+	out := make([]Message, 0, len(messages)-len(oldest)+1)
+	out = append(out, messages[:head]...)
+	out = append(out, Message{Role: "system", Content: "Summary of the earlier conversation: " + summary})
+	return append(out, messages[end:]...), nil
+}
+
+// summarize asks model, routed like any other request, to summarize
+// messages within SUMMARIZER_TIMEOUT (default 10s).
+func summarize(ctx context.Context, model, owner string, messages []Message) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, envDuration("SUMMARIZER_TIMEOUT", 10*time.Second))
+	defer cancel()
+
+	var transcript strings.Builder
+	for _, msg := range messages {
+		fmt.Fprintf(&transcript, "%s: %s\n", msg.Role, msg.Content)
+	}
+	c := requestCatalog(ctx)
+	req := ChatCompletionRequest{
+		Model: c.upstreamModel(model),
+		Messages: []Message{
+			{Role: "system", Content: summarizerInstruction},
+			{Role: "user", Content: transcript.String()},
+		},
+	}
+
+	backend := c.routeBackend(model)
+	var response ChatCompletionResponse
+	if backend == echoBackend {
+		response = createEchoResponse("summary", req, extractPrompt(req.Messages))
+	} else {
+		// A detached record keeps the summary call out of the caller's timings
+		var err error
+		response, err = forwardToBackend(context.WithValue(ctx, requestRecordKey{}, &requestRecord{catalog: c}), backend, req, "summary")
+		if err != nil {
+			return "", err
+		}
+	}
+	if len(response.Choices) == 0 || response.Choices[0].Message.Content == "" {
+		return "", fmt.Errorf("summarizer returned no content")
+	}
+
+	tokens := response.Usage.TotalTokens
+	if tokens == 0 {
+		tokens = estimatePromptTokens(req.Messages) + approximateTokens(response.Choices[0].Message.Content)
+	}
+	summarizerTokens.Add(owner, int64(tokens))
+	log.Printf("Summarized %d messages with %s for key %q (%d tokens)", len(messages), model, owner, tokens)
+	return response.Choices[0].Message.Content, nil
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vinayhpandya/ai_inference_gateway/client"
+)
+
+const (
+	defaultUsageExportInterval = 5 * time.Minute
+	maxUsageExportDays         = 366
+	usageDateLayout            = "2006-01-02"
+)
+
+// usageExport is nil unless USAGE_EXPORT_DIR is set.
+var usageExport *usageExporter
+
+// usageRow is one day's usage for a key and model. Cost is priced when each
+// request completes, so later pricing changes don't rewrite history.
+type usageRow = client.UsageRow
+
+var usageCSVHeader = []string{"date", "key_id", "model", "requests", "prompt_tokens", "completion_tokens", "total_tokens", "cost_usd"}
+
+type usageKey struct{ keyID, model string }
+
+// usageExporter aggregates completed requests' usage per UTC day, key and
+// model, and writes each day to its own file (usage-YYYY-MM-DD.csv or
+// .jsonl) in dir. Files are replaced atomically on every flush, so readers
+// never see a partial file. It lives for the whole process; SIGHUP reloads
+// leave it and its in-memory days alone.
+type usageExporter struct {
+	dir      string
+	format   string
+	s3URL    string
+	s3Region string
+	now      func() time.Time
+
+	mu    sync.Mutex
+	days  map[string]map[usageKey]*usageRow
+	dirty map[string]bool
+	// journalSeq is the newest request journal record aggregated so far
+	journalSeq int64
+	// flushing serializes flushes so an older snapshot never lands last
+	flushing sync.Mutex
+}
+
+// loadUsageExport reads USAGE_EXPORT_DIR, USAGE_EXPORT_FORMAT (csv or
+// jsonl), USAGE_EXPORT_INTERVAL and the optional S3 mirror settings, and
+// resumes today's aggregate from disk. It returns nil when export is off.
+func loadUsageExport() (*usageExporter, error) {
+	dir := os.Getenv("USAGE_EXPORT_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+	e := &usageExporter{
+		dir:      dir,
+		format:   os.Getenv("USAGE_EXPORT_FORMAT"),
+		s3URL:    strings.TrimSuffix(os.Getenv("USAGE_EXPORT_S3_URL"), "/"),
+		s3Region: os.Getenv("USAGE_EXPORT_S3_REGION"),
+		now:      time.Now,
+		days:     make(map[string]map[usageKey]*usageRow),
+		dirty:    make(map[string]bool),
+	}
+	switch e.format {
+	case "":
+		e.format = "csv"
+	case "csv", "jsonl":
+	default:
+		return nil, fmt.Errorf("invalid USAGE_EXPORT_FORMAT %q: want csv or jsonl", e.format)
+	}
+	if e.s3Region == "" {
+		e.s3Region = "us-east-1"
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	// Resume today so a restart doesn't truncate the day's file
+	if err := e.resumeDay(e.today()); err != nil {
+		return nil, err
+	}
+
+	go e.run(envDuration("USAGE_EXPORT_INTERVAL", defaultUsageExportInterval))
+	return e, nil
+}
+
+func (e *usageExporter) today() string {
+	return e.now().UTC().Format(usageDateLayout)
+}
+
+// resumeDay loads a day's file into memory unless the day is already there,
+// so adding to it doesn't overwrite what was written before.
+func (e *usageExporter) resumeDay(day string) error {
+	e.mu.Lock()
+	_, ok := e.days[day]
+	e.mu.Unlock()
+	if ok {
+		return nil
+	}
+	rows, err := e.readDay(day)
+	if err != nil {
+		return fmt.Errorf("resuming %s usage: %w", day, err)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.days[day] = make(map[usageKey]*usageRow, len(rows))
+	for _, row := range rows {
+		e.days[day][usageKey{row.KeyID, row.Model}] = &row
+	}
+	return nil
+}
+
+// record adds a finished request's usage to today's aggregate. seq is the
+// request's journal record, or 0 without a journal.
+func (e *usageExporter) record(rec *requestRecord, seq int64) {
+	if e == nil || rec.Usage == nil || rec.DryRun {
+		return
+	}
+	e.add(e.today(), rec.KeyID, rec.Model, rec.Usage, usageCost(rec.Model, rec.Usage), seq)
+}
+
+func (e *usageExporter) add(day, keyID, model string, u *Usage, cost float64, seq int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	rows, ok := e.days[day]
+	if !ok {
+		rows = make(map[usageKey]*usageRow)
+		e.days[day] = rows
+	}
+	k := usageKey{keyID, model}
+	row, ok := rows[k]
+	if !ok {
+		row = &usageRow{Date: day, KeyID: keyID, Model: model}
+		rows[k] = row
+	}
+	row.Requests++
+	row.PromptTokens += int64(u.PromptTokens)
+	row.CompletionTokens += int64(u.CompletionTokens)
+	row.TotalTokens += int64(u.TotalTokens)
+	row.CostUSD += cost
+	e.dirty[day] = true
+	e.journalSeq = max(e.journalSeq, seq)
+}
+
+// usageCost prices usage at model's current catalog pricing.
+func usageCost(model string, u *Usage) float64 {
+	m, ok := catalog.Load().lookup(model)
+	if !ok {
+		return 0
+	}
+	return float64(u.PromptTokens)/1000*m.Pricing.PromptPer1K +
+		float64(u.CompletionTokens)/1000*m.Pricing.CompletionPer1K
+}
+
+func (e *usageExporter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		e.flush()
+	}
+}
+
+// flush writes every day that changed since the last flush, then tells
+// the request journal how far its records are aggregated.
+func (e *usageExporter) flush() {
+	if e == nil {
+		return
+	}
+	if seq, ok := e.write(); ok {
+		journal.checkpoint(seq)
+	}
+}
+
+// write writes every day that changed since the last flush, then forgets
+// past days that are safely on disk. Failed days stay dirty for the next
+// flush. It returns the newest journal record the files now include and
+// whether every day was written.
+func (e *usageExporter) write() (int64, bool) {
+	e.flushing.Lock()
+	defer e.flushing.Unlock()
+	e.mu.Lock()
+	pending := make(map[string][]usageRow, len(e.dirty))
+	for day := range e.dirty {
+		pending[day] = sortedUsageRows(e.days[day])
+	}
+	e.dirty = make(map[string]bool)
+	seq := e.journalSeq
+	e.mu.Unlock()
+
+	ok := true
+	for day, rows := range pending {
+		if err := e.writeDay(day, rows); err != nil {
+			log.Printf("Writing %s usage export failed: %v", day, err)
+			ok = false
+			e.mu.Lock()
+			e.dirty[day] = true
+			e.mu.Unlock()
+		}
+	}
+
+	today := e.today()
+	e.mu.Lock()
+	for day := range e.days {
+		if day < today && !e.dirty[day] {
+			delete(e.days, day)
+		}
+	}
+	e.mu.Unlock()
+	return seq, ok
+}
+
+func sortedUsageRows(rows map[usageKey]*usageRow) []usageRow {
+	out := make([]usageRow, 0, len(rows))
+	for _, row := range rows {
+		out = append(out, *row)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].KeyID != out[j].KeyID {
+			return out[i].KeyID < out[j].KeyID
+		}
+		return out[i].Model < out[j].Model
+	})
+	return out
+}
+
+func (e *usageExporter) path(day string) string {
+	return filepath.Join(e.dir, "usage-"+day+"."+e.format)
+}
+
+func (e *usageExporter) writeDay(day string, rows []usageRow) error {
+	var buf bytes.Buffer
+	if err := encodeUsage(&buf, e.format, rows); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(e.path(day), buf.Bytes()); err != nil {
+		return err
+	}
+	if e.s3URL != "" {
+		return uploadS3(e.s3URL, e.s3Region, filepath.Base(e.path(day)), usageContentType(e.format), buf.Bytes())
+	}
+	return nil
+}
+
+// uploadS3 puts data as name under bucketURL, a bucket URL with an
+// optional key prefix on any S3-compatible store.
+func uploadS3(bucketURL, region, name, contentType string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	creds, err := loadAWSCredentials(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, bucketURL+"/"+name, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	signSigV4(req, data, creds, region, "s3", time.Now())
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("S3 upload of %s returned status %d: %s", name, resp.StatusCode, body)
+	}
+	return nil
+}
+
+// readDay loads a day's file, returning no rows if it doesn't exist.
+func (e *usageExporter) readDay(day string) ([]usageRow, error) {
+	f, err := os.Open(e.path(day))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodeUsage(f, e.format)
+}
+
+// export returns every row from from to to, inclusive. Days still held in
+// memory are newer than their files and replace them.
+func (e *usageExporter) export(from, to time.Time) ([]usageRow, error) {
+	var out []usageRow
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		day := d.Format(usageDateLayout)
+		e.mu.Lock()
+		rows, ok := e.days[day]
+		var mem []usageRow
+		if ok {
+			mem = sortedUsageRows(rows)
+		}
+		e.mu.Unlock()
+		if ok {
+			out = append(out, mem...)
+			continue
+		}
+		disk, err := e.readDay(day)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", day, err)
+		}
+		out = append(out, disk...)
+	}
+	return out, nil
+}
+
+func usageContentType(format string) string {
+	switch format {
+	case "jsonl":
+		return "application/x-ndjson"
+	case "openmetrics":
+		return "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	}
+	return "text/csv"
+}
+
+// usageMetrics are the OpenMetrics gauges an export is rendered as, one
+// sample per row, labelled by date, key and model.
+var usageMetrics = []struct {
+	name  string
+	value func(usageRow) string
+}{
+	{"gateway_usage_requests", func(r usageRow) string { return strconv.FormatInt(r.Requests, 10) }},
+	{"gateway_usage_prompt_tokens", func(r usageRow) string { return strconv.FormatInt(r.PromptTokens, 10) }},
+	{"gateway_usage_completion_tokens", func(r usageRow) string { return strconv.FormatInt(r.CompletionTokens, 10) }},
+	{"gateway_usage_total_tokens", func(r usageRow) string { return strconv.FormatInt(r.TotalTokens, 10) }},
+	{"gateway_usage_cost_usd", func(r usageRow) string { return strconv.FormatFloat(r.CostUSD, 'f', -1, 64) }},
+}
+
+var openMetricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func encodeUsage(w io.Writer, format string, rows []usageRow) error {
+	if format == "openmetrics" {
+		bw := bufio.NewWriter(w)
+		for _, m := range usageMetrics {
+			fmt.Fprintf(bw, "# TYPE %s gauge\n", m.name)
+			for _, row := range rows {
+				fmt.Fprintf(bw, "%s{date=\"%s\",key_id=\"%s\",model=\"%s\"} %s\n", m.name, row.Date,
+					openMetricsLabelEscaper.Replace(row.KeyID), openMetricsLabelEscaper.Replace(row.Model), m.value(row))
+			}
+		}
+		bw.WriteString("# EOF\n")
+		return bw.Flush()
+	}
+	if format == "jsonl" {
+		enc := json.NewEncoder(w)
+		for _, row := range rows {
+			if err := enc.Encode(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	cw := csv.NewWriter(w)
+	cw.Write(usageCSVHeader)
+	for _, row := range rows {
+		cw.Write([]string{
+			row.Date, row.KeyID, row.Model,
+			strconv.FormatInt(row.Requests, 10),
+			strconv.FormatInt(row.PromptTokens, 10),
+			strconv.FormatInt(row.CompletionTokens, 10),
+			strconv.FormatInt(row.TotalTokens, 10),
+			strconv.FormatFloat(row.CostUSD, 'f', -1, 64),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func decodeUsage(r io.Reader, format string) ([]usageRow, error) {
+	var rows []usageRow
+	if format == "jsonl" {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			var row usageRow
+			if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+				return nil, err
+			}
+			rows = append(rows, row)
+		}
+		return rows, scanner.Err()
+	}
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	for i, rec := range records {
+		if i == 0 || len(rec) != len(usageCSVHeader) {
+			continue
+		}
+		row := usageRow{Date: rec[0], KeyID: rec[1], Model: rec[2]}
+		row.Requests, _ = strconv.ParseInt(rec[3], 10, 64)
+		row.PromptTokens, _ = strconv.ParseInt(rec[4], 10, 64)
+		row.CompletionTokens, _ = strconv.ParseInt(rec[5], 10, 64)
+		row.TotalTokens, _ = strconv.ParseInt(rec[6], 10, 64)
+		row.CostUSD, _ = strconv.ParseFloat(rec[7], 64)
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// requireUsageExport returns 404 for the export endpoint when usage export
+// is not configured.
+func requireUsageExport(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if usageExport == nil {
+			writeJSONError(w, http.StatusNotFound, "invalid_request_error", "not_found", "Usage export is not enabled on this gateway")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// usageExportHandler implements GET /admin/usage/export?from=&to=&format=.
+// Dates are UTC days as YYYY-MM-DD and both default to today; format is
+// csv (default), jsonl or openmetrics. parent= limits the rows to a team
+// key and its children, one row per key.
+func usageExportHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	today := usageExport.today()
+	parse := func(name string) (time.Time, bool) {
+		v := q.Get(name)
+		if v == "" {
+			v = today
+		}
+		t, err := time.Parse(usageDateLayout, v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_value",
+				fmt.Sprintf("%s must be a date as YYYY-MM-DD", name))
+			return time.Time{}, false
+		}
+		return t, true
+	}
+	from, ok := parse("from")
+	if !ok {
+		return
+	}
+	to, ok := parse("to")
+	if !ok {
+		return
+	}
+	if to.Before(from) || to.Sub(from) >= maxUsageExportDays*24*time.Hour {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_value",
+			fmt.Sprintf("to must not be before from, and the range must be at most %d days", maxUsageExportDays))
+		return
+	}
+	format := q.Get("format")
+	switch format {
+	case "":
+		format = "csv"
+	case "csv", "jsonl", "openmetrics":
+	default:
+		writeJSONError(w, http.StatusBadRequest, "invalid_request_error", "invalid_value", "format must be csv, jsonl or openmetrics")
+		return
+	}
+
+	rows, err := usageExport.export(from, to)
+	if err != nil {
+		log.Printf("Usage export failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error", "internal_error", "Failed to read usage files")
+		return
+	}
+	if parent := q.Get("parent"); parent != "" {
+		ids := []string{parent}
+		if apiKeys != nil {
+			for _, child := range apiKeys.children(parent) {
+				ids = append(ids, child.ID)
+			}
+		}
+		rows = slices.DeleteFunc(rows, func(row usageRow) bool { return !slices.Contains(ids, row.KeyID) })
+	}
+	w.Header().Set("Content-Type", usageContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"usage-%s-%s.%s\"",
+		from.Format(usageDateLayout), to.Format(usageDateLayout), format))
+	encodeUsage(w, format, rows)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"os"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// utf8Repairs counts invalid UTF-8 sequences repaired in backend output,
+// by backend.
+var utf8Repairs = expvar.NewMap("gateway_utf8_repairs_total")
+
+// repairUTF8 replaces each run of invalid UTF-8 in b with U+FFFD, or drops
+// it when UTF8_REPAIR=strip. Valid input is returned unchanged.
+func repairUTF8(b []byte, backend string) []byte {
+	if utf8.Valid(b) {
+		return b
+	}
+	replacement := "\uFFFD"
+	if os.Getenv("UTF8_REPAIR") == "strip" {
+		replacement = ""
+	}
+	out := make([]byte, 0, len(b))
+	invalid := false
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if r == utf8.RuneError && size == 1 {
+			if !invalid {
+				out = append(out, replacement...)
+				utf8Repairs.Add(backend, 1)
+			}
+			invalid = true
+		} else {
+			out = append(out, b[:size]...)
+			invalid = false
+		}
+		b = b[size:]
+	}
+	return out
+}
+
+// incompleteSuffix is the length of a truncated multibyte sequence at the
+// end of b that more input could still complete.
+func incompleteSuffix(b []byte) int {
+	for i := 1; i <= utf8.UTFMax-1 && i <= len(b); i++ {
+		if utf8.RuneStart(b[len(b)-i]) {
+			if utf8.FullRune(b[len(b)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+// utf8Reader repairs a backend body as it is read. A sequence split across
+// reads is held back until the rest arrives; one still incomplete at EOF is
+// repaired like any other invalid sequence.
+type utf8Reader struct {
+	io.ReadCloser
+	backend string
+	buf     []byte
+	pending []byte // repaired output not yet returned
+	tail    []byte // trailing bytes of an unfinished rune
+	err     error
+}
+
+func newUTF8Reader(body io.ReadCloser, backend string) *utf8Reader {
+	return &utf8Reader{ReadCloser: body, backend: backend, buf: make([]byte, 32*1024)}
+}
+
+func (u *utf8Reader) Read(p []byte) (int, error) {
+	for len(u.pending) == 0 {
+		if u.err != nil {
+			return 0, u.err
+		}
+		var n int
+		n, u.err = u.ReadCloser.Read(u.buf)
+		chunk := append(u.tail, u.buf[:n]...)
+		u.tail = nil
+		if u.err == nil {
+			if k := incompleteSuffix(chunk); k > 0 {
+				u.tail = append([]byte(nil), chunk[len(chunk)-k:]...)
+				chunk = chunk[:len(chunk)-k]
+			}
+		}
+		u.pending = repairUTF8(chunk, u.backend)
+	}
+	n := copy(p, u.pending)
+	u.pending = u.pending[n:]
+	return n, nil
+}
+
+// utf8Carry reassembles streamed delta content whose multibyte characters
+// are split across chunks. Decoding JSON replaces such bytes with U+FFFD,
+// so the delta is re-read from the raw event.
+type utf8Carry struct {
+	backend string
+	tail    []byte
+}
+
+// content returns the delta text of the choice at position choice in event
+// data to emit now, holding back an unfinished trailing rune. ok is false
+// when the raw delta is valid and decoded needs no change.
+func (c *utf8Carry) content(data []byte, choice int, decoded string) (text string, ok bool) {
+	if len(c.tail) == 0 && utf8.Valid(data) {
+		return decoded, false
+	}
+	raw := []byte(decoded)
+	var event struct {
+		Choices []struct {
+			Delta struct {
+				Content json.RawMessage `json:"content"`
+			} `json:"delta"`
+		} `json:"choices"`
+	}
+	if json.Unmarshal(data, &event) == nil && choice < len(event.Choices) {
+		if s, valid := unquoteRaw(event.Choices[choice].Delta.Content); valid {
+			raw = s
+		}
+	}
+	raw = append(c.tail, raw...)
+	c.tail = nil
+	if k := incompleteSuffix(raw); k > 0 {
+		c.tail = append([]byte(nil), raw[len(raw)-k:]...)
+		raw = raw[:len(raw)-k]
+	}
+	return string(repairUTF8(raw, c.backend)), true
+}
+
+// flush repairs and returns any held-back bytes at the end of the stream.
+func (c *utf8Carry) flush() string {
+	tail := c.tail
+	c.tail = nil
+	return string(repairUTF8(tail, c.backend))
+}
+
+// unquoteRaw decodes a JSON string like json.Unmarshal but keeps invalid
+// UTF-8 bytes as they are instead of replacing them.
+func unquoteRaw(s []byte) ([]byte, bool) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return nil, false
+	}
+	s = s[1 : len(s)-1]
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			out = append(out, s[i])
+			continue
+		}
+		if i++; i >= len(s) {
+			return nil, false
+		}
+		switch s[i] {
+		case '"', '\\', '/':
+			out = append(out, s[i])
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'u':
+			r, ok := hex4(s[i+1:])
+			if !ok {
+				return nil, false
+			}
+			i += 4
+			if utf16.IsSurrogate(r) && i+2 < len(s) && s[i+1] == '\\' && s[i+2] == 'u' {
+				if lo, ok := hex4(s[i+3:]); ok {
+					if dec := utf16.DecodeRune(r, lo); dec != utf8.RuneError {
+						r = dec
+						i += 6
+					}
+				}
+			}
+			out = utf8.AppendRune(out, r)
+		default:
+			return nil, false
+		}
+	}
+	return out, true
+}
+
+// hex4 parses the four hex digits of a \u escape.
+func hex4(s []byte) (rune, bool) {
+	if len(s) < 4 {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(string(s[:4]), 16, 32)
+	return rune(n), err == nil
+}
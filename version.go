@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build metadata, set at build time:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Without ldflags the commit and date fall back to the VCS stamp Go embeds
+// when building from a checkout.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// BuildInfo identifies the running gateway build.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// buildInfo is resolved once at startup.
+var buildInfo = func() BuildInfo {
+	b := BuildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value
+			case s.Key == "vcs.time" && b.BuildDate == "":
+				b.BuildDate = s.Value
+			}
+		}
+	}
+	if b.Commit == "" {
+		b.Commit = "unknown"
+	}
+	if b.BuildDate == "" {
+		b.BuildDate = "unknown"
+	}
+	return b
+}()
+
+func init() {
+	expvar.Publish("gateway_build_info", expvar.Func(func() any {
+		return map[string]any{
+			"version":    buildInfo.Version,
+			"commit":     buildInfo.Commit,
+			"build_date": buildInfo.BuildDate,
+			"go_version": buildInfo.GoVersion,
+			"value":      1,
+		}
+	}))
+}
+
+// gatewayUserAgent identifies the gateway to backends.
+func gatewayUserAgent() string {
+	return "ai-inference-gateway/" + buildInfo.Version
+}
+
+// versionHandler implements GET /version.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildInfo)
+}
+
+// withVersionHeader adds X-Gateway-Version to every response when
+// VERSION_HEADER=true.
+func withVersionHeader(next http.Handler) http.Handler {
+	if os.Getenv("VERSION_HEADER") != "true" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Gateway-Version", buildInfo.Version)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// vllmExtensionFields are the non-OpenAI request fields vLLM understands.
+// They are forwarded to vllm backends and stripped for everything else.
+var vllmExtensionFields = []string{
+	"best_of",
+	"use_beam_search",
+	"top_k",
+	"min_p",
+	"repetition_penalty",
+	"guided_json",
+}
+
+// UnmarshalJSON decodes the OpenAI fields and captures known vendor
+// extensions so they can be forwarded to backends that support them.
+func (r *ChatCompletionRequest) UnmarshalJSON(data []byte) error {
+	type plain ChatCompletionRequest
+	if err := json.Unmarshal(data, (*plain)(r)); err != nil {
+		return err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for _, field := range vllmExtensionFields {
+		if v, ok := raw[field]; ok {
+			if r.Extensions == nil {
+				r.Extensions = make(map[string]json.RawMessage)
+			}
+			r.Extensions[field] = v
+		}
+	}
+	return nil
+}
+
+// MarshalJSON encodes the request with its extension fields merged in.
+func (r ChatCompletionRequest) MarshalJSON() ([]byte, error) {
+	type plain ChatCompletionRequest
+	data, err := json.Marshal(plain(r))
+	if err != nil || len(r.Extensions) == 0 {
+		return data, err
+	}
+
+	var merged map[string]json.RawMessage
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return nil, err
+	}
+	for k, v := range r.Extensions {
+		if _, exists := merged[k]; !exists {
+			merged[k] = v
+		}
+	}
+	return json.Marshal(merged)
+}
+
+// applyBackendExtensions adapts vendor extensions to the backend type. For
+// vLLM it maps X-Priority-Class onto vLLM's priority field; for any other
+// backend the extensions are dropped and reported in X-Gateway-Warning.
+func applyBackendExtensions(w http.ResponseWriter, r *http.Request, req *ChatCompletionRequest, backend *Backend) {
+	if backend.Type == "vllm" {
+		class := r.Header.Get("X-Priority-Class")
+		if class == "" {
+			return
+		}
+		priority, ok := vllmPriorityClasses()[class]
+		if !ok {
+			log.Printf("Unknown priority class %q", truncateForLog(class))
+			return
+		}
+		if req.Extensions == nil {
+			req.Extensions = make(map[string]json.RawMessage)
+		}
+		req.Extensions["priority"] = json.RawMessage(strconv.Itoa(priority))
+		return
+	}
+
+	if len(req.Extensions) == 0 {
+		return
+	}
+	stripped := make([]string, 0, len(req.Extensions))
+	for field := range req.Extensions {
+		stripped = append(stripped, field)
+		noteIgnoredField(field, "stripped")
+	}
+	sort.Strings(stripped)
+	req.Extensions = nil
+	w.Header().Add("X-Gateway-Warning", "stripped unsupported fields: "+strings.Join(stripped, ","))
+}
+
+// vllmPriorityClasses parses VLLM_PRIORITY_CLASSES ("interactive:0,batch:10").
+// Lower values are scheduled first by vLLM.
+func vllmPriorityClasses() map[string]int {
+	classes := make(map[string]int)
+	for _, pair := range strings.Split(os.Getenv("VLLM_PRIORITY_CLASSES"), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(value); err == nil {
+			classes[name] = n
+		}
+	}
+	return classes
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWarmupPrompt      = "Hello"
+	defaultWarmupMaxTokens   = 8
+	defaultWarmupMaxDuration = time.Minute
+	warmupRetryDelay         = 2 * time.Second
+)
+
+// Warm-up requests are kept out of gateway_backend_requests_total, access
+// logs, webhooks and conversation history; they are counted only here, by
+// backend.
+var (
+	warmupRequests = expvar.NewMap("gateway_warmup_requests_total")
+	warmupFailures = expvar.NewMap("gateway_warmup_failures_total")
+)
+
+// Warmup primes a cold backend before it takes traffic, e.g. so a vLLM
+// replica's graph capture doesn't land on a real request.
+type Warmup struct {
+	// Requests is how many warm-up requests must succeed per model (default 1)
+	Requests int `json:"requests,omitempty"`
+	// Prompt is the canned user message sent (default "Hello")
+	Prompt    string `json:"prompt,omitempty"`
+	MaxTokens int    `json:"max_tokens,omitempty"`
+	// MaxDuration bounds warm-up; the backend takes traffic once it passes
+	// even if requests are still failing (default 1m)
+	MaxDuration string `json:"max_duration,omitempty"`
+
+	maxDuration time.Duration
+}
+
+// validate fills in defaults once the catalog entry is parsed.
+func (w *Warmup) validate() error {
+	if w.Requests < 0 || w.MaxTokens < 0 {
+		return errors.New("warmup requests and max_tokens must not be negative")
+	}
+	if w.Requests == 0 {
+		w.Requests = 1
+	}
+	if w.Prompt == "" {
+		w.Prompt = defaultWarmupPrompt
+	}
+	if w.MaxTokens == 0 {
+		w.MaxTokens = defaultWarmupMaxTokens
+	}
+	w.maxDuration = defaultWarmupMaxDuration
+	if w.MaxDuration != "" {
+		d, err := time.ParseDuration(w.MaxDuration)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid warmup max_duration %q", w.MaxDuration)
+		}
+		w.maxDuration = d
+	}
+	return nil
+}
+
+// warmups tracks backends currently warming up, by name. Requests routed
+// to one wait for it to become eligible.
+var warmups = struct {
+	sync.Mutex
+	running map[string]chan struct{}
+}{running: make(map[string]chan struct{})}
+
+// startWarmup warms backend in the background unless it is already
+// warming or has no warm-up config.
+func startWarmup(backend *Backend, reason string) {
+	if backend.Warmup == nil {
+		return
+	}
+	warmups.Lock()
+	defer warmups.Unlock()
+	if _, ok := warmups.running[backend.Name]; ok {
+		return
+	}
+	done := make(chan struct{})
+	warmups.running[backend.Name] = done
+
+	go func() {
+		warmBackend(backend, reason)
+		warmups.Lock()
+		delete(warmups.running, backend.Name)
+		warmups.Unlock()
+		close(done)
+	}()
+}
+
+// awaitWarmup blocks while backend is warming up, or until ctx ends.
+func awaitWarmup(ctx context.Context, backend *Backend) error {
+	warmups.Lock()
+	done, ok := warmups.running[backend.Name]
+	warmups.Unlock()
+	if !ok {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// warmBackend sends the configured warm-up requests for every model the
+// backend serves, retrying failures until MaxDuration runs out.
+func warmBackend(backend *Backend, reason string) {
+	w := backend.Warmup
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), w.maxDuration)
+	defer cancel()
+	// Warm-up requests get a record of their own, never logged
+	c := catalog.Load()
+	ctx = context.WithValue(ctx, requestRecordKey{}, &requestRecord{catalog: c})
+
+	models := c.modelsOn(backend.Name)
+	log.Printf("Warming up backend %q (%s): %d requests for each of %d models", backend.Name, reason, w.Requests, len(models))
+	for _, model := range models {
+		req := ChatCompletionRequest{
+			Model:     c.upstreamModel(model),
+			Messages:  []Message{{Role: "user", Content: w.Prompt}},
+			MaxTokens: &w.MaxTokens,
+		}
+		for ok := 0; ok < w.Requests; {
+			requestID := fmt.Sprintf("warmup-%s-%d", backend.Name, ok)
+			warmupRequests.Add(backend.Name, 1)
+			if _, err := forwardToBackend(ctx, backend, req, requestID); err != nil {
+				warmupFailures.Add(backend.Name, 1)
+				if ctx.Err() != nil {
+					log.Printf("Warm-up of backend %q incomplete after %s; taking traffic anyway", backend.Name, w.maxDuration)
+					return
+				}
+				log.Printf("Warm-up request to backend %q failed: %v", backend.Name, err)
+				select {
+				case <-time.After(warmupRetryDelay):
+				case <-ctx.Done():
+				}
+				continue
+			}
+			ok++
+		}
+	}
+	log.Printf("Backend %q warmed up in %s", backend.Name, time.Since(start).Round(time.Millisecond))
+}
+
+// warmCatalog warms backends that are new in c, or changed since prev.
+func warmCatalog(prev, c *modelCatalog, reason string) {
+	for name, b := range c.backends {
+		if prev != nil {
+			if old, ok := prev.backends[name]; ok && old.URL == b.URL && slices.Equal(old.URLs, b.URLs) && old.Type == b.Type {
+				continue
+			}
+		}
+		startWarmup(b, reason)
+	}
+}
+
+// noteBackendFailure starts a recovery warm-up when a backend could not be
+// reached at all. Traffic waits until the backend answers warm-up requests
+// again, so the first request after recovery is not the cold one.
+func noteBackendFailure(backend *Backend, err error) {
+	var statusErr *backendStatusError
+	if backend.Warmup == nil || errors.As(err, &statusErr) || errors.Is(err, context.Canceled) {
+		return
+	}
+	startWarmup(backend, "recovery")
+}
+
+// modelsOn lists the models routed to backend.
+func (c *modelCatalog) modelsOn(backend string) []string {
+	var ids []string
+	for id, m := range c.models {
+		if m.Backend == backend && m.Ensemble == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
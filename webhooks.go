@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Webhook event types. Only request.completed is sent unless WEBHOOK_EVENTS
+// asks for more.
+const (
+	eventCompleted   = "request.completed"
+	eventFailed      = "request.failed"
+	eventRateLimited = "request.rate_limited"
+)
+
+const (
+	defaultWebhookQueue    = 1000
+	defaultWebhookAttempts = 3
+	webhookTimeout         = 10 * time.Second
+)
+
+var (
+	webhookDropped    = expvar.NewMap("gateway_webhook_dropped_total")
+	webhookDeliveries = expvar.NewMap("gateway_webhook_deliveries_total")
+)
+
+// webhooks is nil unless WEBHOOK_URLS is set.
+var webhooks *webhookNotifier
+
+// webhookEvent describes a finished request. It never carries message
+// content. Events published to a message bus have the same schema.
+type webhookEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	KeyID     string    `json:"key,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	Backend   string    `json:"backend,omitempty"`
+	// Experiment and Variant are set for requests in a prompt experiment
+	Experiment string  `json:"experiment,omitempty"`
+	Variant    string  `json:"variant,omitempty"`
+	Status     int     `json:"status"`
+	Usage      *Usage  `json:"usage,omitempty"`
+	CostUSD    float64 `json:"cost_usd"`
+	LatencyMS  float64 `json:"latency_ms"`
+}
+
+// newWebhookEvent describes the request rec records as an event of type
+// typ.
+func newWebhookEvent(typ string, rec *requestRecord, status int, latency time.Duration) webhookEvent {
+	event := webhookEvent{
+		ID:         uuid.New().String(),
+		Type:       typ,
+		Time:       time.Now().UTC(),
+		RequestID:  rec.RequestID,
+		KeyID:      rec.KeyID,
+		Model:      rec.Model,
+		Backend:    rec.Backend,
+		Experiment: rec.Experiment,
+		Variant:    rec.Variant,
+		Status:     status,
+		Usage:      rec.Usage,
+		LatencyMS:  float64(latency.Microseconds()) / 1000,
+	}
+	if rec.Usage != nil {
+		event.CostUSD = usageCost(rec.Model, rec.Usage)
+	}
+	return event
+}
+
+// webhookNotifier fans events out to one queue per endpoint, each drained
+// by its own worker so a slow or failing endpoint only delays itself.
+type webhookNotifier struct {
+	targets []*webhookTarget
+	events  map[string]bool
+}
+
+type webhookTarget struct {
+	url         string
+	secret      []byte
+	maxAttempts int
+	queue       chan []byte
+	client      *http.Client
+}
+
+// loadWebhooks reads WEBHOOK_URLS (comma-separated), WEBHOOK_SECRET,
+// WEBHOOK_EVENTS, WEBHOOK_QUEUE_SIZE and WEBHOOK_MAX_ATTEMPTS, and starts a
+// delivery worker per URL. It returns nil when webhooks are not configured.
+func loadWebhooks() (*webhookNotifier, error) {
+	raw := os.Getenv("WEBHOOK_URLS")
+	if raw == "" {
+		return nil, nil
+	}
+	queueSize, err := envInt("WEBHOOK_QUEUE_SIZE")
+	if err != nil {
+		return nil, err
+	}
+	if queueSize == 0 {
+		queueSize = defaultWebhookQueue
+	}
+	attempts, err := envInt("WEBHOOK_MAX_ATTEMPTS")
+	if err != nil {
+		return nil, err
+	}
+	if attempts == 0 {
+		attempts = defaultWebhookAttempts
+	}
+
+	events, err := envEventTypes("WEBHOOK_EVENTS")
+	if err != nil {
+		return nil, err
+	}
+	n := &webhookNotifier{events: events}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	for _, u := range strings.Split(raw, ",") {
+		u = strings.TrimSpace(u)
+		if parsed, err := url.Parse(u); err != nil || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid WEBHOOK_URLS entry %q", u)
+		}
+		t := &webhookTarget{
+			url:         u,
+			secret:      []byte(os.Getenv("WEBHOOK_SECRET")),
+			maxAttempts: attempts,
+			queue:       make(chan []byte, queueSize),
+			client:      client,
+		}
+		n.targets = append(n.targets, t)
+		go t.run()
+	}
+	return n, nil
+}
+
+// envEventTypes reads the comma-separated event types in the environment
+// variable name, defaulting to request.completed alone.
+func envEventTypes(name string) (map[string]bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return map[string]bool{eventCompleted: true}, nil
+	}
+	events := make(map[string]bool)
+	for _, e := range strings.Split(v, ",") {
+		switch e = strings.TrimSpace(e); e {
+		case eventCompleted, eventFailed, eventRateLimited:
+			events[e] = true
+		default:
+			return nil, fmt.Errorf("unknown %s entry %q", name, e)
+		}
+	}
+	return events, nil
+}
+
+// eventType classifies a finished request by its response status.
+func eventType(status int) string {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return eventRateLimited
+	case status >= 400:
+		return eventFailed
+	default:
+		return eventCompleted
+	}
+}
+
+// notify queues an event for every endpoint without blocking. Events that
+// don't fit in an endpoint's queue are dropped and counted.
+func (n *webhookNotifier) notify(rec *requestRecord, status int, latency time.Duration) {
+	if n == nil {
+		return
+	}
+	typ := eventType(status)
+	if !n.events[typ] {
+		return
+	}
+	body, err := json.Marshal(newWebhookEvent(typ, rec, status, latency))
+	if err != nil {
+		log.Printf("Error encoding webhook event: %v", err)
+		return
+	}
+	for _, t := range n.targets {
+		select {
+		case t.queue <- body:
+		default:
+			webhookDropped.Add(t.url, 1)
+		}
+	}
+}
+
+// run delivers queued events in order, retrying each with backoff.
+func (t *webhookTarget) run() {
+	for body := range t.queue {
+		result := "failed"
+		for attempt := range t.maxAttempts {
+			if attempt > 0 {
+				time.Sleep(time.Second << (attempt - 1))
+			}
+			retry, err := t.deliver(body)
+			if err == nil {
+				result = "ok"
+				break
+			}
+			log.Printf("Webhook delivery to %s failed (attempt %d/%d): %v", t.url, attempt+1, t.maxAttempts, err)
+			if !retry {
+				break
+			}
+		}
+		webhookDeliveries.Add(result, 1)
+	}
+}
+
+// deliver POSTs one event. Signed requests carry
+//
+//	X-Webhook-Timestamp: unix seconds
+//	X-Webhook-Signature: sha256=<hex(HMAC-SHA256(secret, timestamp + "." + body))>
+//
+// matching the scheme callers use to sign requests to the gateway. retry
+// reports whether the failure is worth another attempt.
+func (t *webhookTarget) deliver(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(t.secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, t.secret)
+		mac.Write([]byte(timestamp))
+		mac.Write([]byte("."))
+		mac.Write(body)
+		req.Header.Set("X-Webhook-Timestamp", timestamp)
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("status %d", resp.StatusCode)
+}